@@ -0,0 +1,200 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/sha1" // nolint:gosec
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sha1DigestInfoPrefix is the DER encoding of the DigestInfo of a SHA1
+// digest, up to the digest itself, as signed by RSASSA-PKCS1-v1_5.
+var sha1DigestInfoPrefix = []byte{0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14}
+
+// azureKeyVaultTokenEnv holds an access token for Key Vault.  Without it,
+// a token of the managed identity of the host is requested.
+const azureKeyVaultTokenEnv = "AZURE_KEYVAULT_TOKEN"
+
+// azureIdentityEndpoint is the endpoint of the instance metadata service
+// handing out the tokens of managed identities.
+var azureIdentityEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fvault.azure.net"
+
+// AzureKeyVaultSigner signs with an RSA key held in Azure Key Vault, so
+// that the private key never leaves the vault.  Key Vault only signs
+// SHA1 digests with the RSNULL algorithm, which pads the data as given,
+// so the DigestInfo of the digest is built here.
+type AzureKeyVaultSigner struct {
+	// keyURL is the URL of the key, with its version if it is pinned.
+	keyURL  string
+	keyName string
+	client  *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type azureSignRequest struct {
+	Algorithm string `json:"alg"`
+	Value     string `json:"value"`
+}
+
+type azureSignResponse struct {
+	Value string `json:"value"`
+}
+
+type azureTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresOn   string `json:"expires_on"`
+}
+
+// NewAzureKeyVaultSigner returns a signer using the key at keyURL, such as
+// https://example.vault.azure.net/keys/melange or, to pin its version,
+// https://example.vault.azure.net/keys/melange/<version>.  The public key
+// is named after the key, e.g. melange.rsa.pub.
+func NewAzureKeyVaultSigner(keyURL string, client *http.Client) (*AzureKeyVaultSigner, error) {
+	u, err := url.Parse(keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key URL: %w", err)
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if u.Scheme != "https" || u.Host == "" || len(parts) < 2 || len(parts) > 3 || parts[0] != "keys" || parts[1] == "" {
+		return nil, fmt.Errorf("%s is not the URL of a Key Vault key, https://<vault>/keys/<name>[/<version>]", keyURL)
+	}
+
+	return &AzureKeyVaultSigner{
+		keyURL:  strings.TrimSuffix(keyURL, "/"),
+		keyName: parts[1] + ".rsa.pub",
+		client:  client,
+	}, nil
+}
+
+// KeyName returns the name of the public key of the vault key.
+func (s *AzureKeyVaultSigner) KeyName() string {
+	return s.keyName
+}
+
+// accessToken returns the token authenticating the requests to the
+// vault.
+func (s *AzureKeyVaultSigner) accessToken() (string, error) {
+	if token := os.Getenv(azureKeyVaultTokenEnv); token != "" {
+		return token, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, azureIdentityEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting managed identity token (or set %s): %w", azureKeyVaultTokenEnv, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("requesting managed identity token: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var token azureTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("decoding managed identity token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("the instance metadata service returned no token")
+	}
+
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("decoding managed identity token expiry: %w", err)
+	}
+	s.token, s.expires = token.AccessToken, time.Unix(expiresOn, 0)
+
+	return s.token, nil
+}
+
+// SignSHA1Digest has the vault sign the DigestInfo of the provided SHA1
+// message digest.
+func (s *AzureKeyVaultSigner) SignSHA1Digest(sha1Digest []byte) ([]byte, error) {
+	if len(sha1Digest) != sha1.Size {
+		return nil, errDigestNotSH1
+	}
+
+	token, err := s.accessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	digestInfo := append(append([]byte{}, sha1DigestInfoPrefix...), sha1Digest...)
+	body, err := json.Marshal(azureSignRequest{
+		Algorithm: "RSNULL",
+		Value:     base64.RawURLEncoding.EncodeToString(digestInfo),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.keyURL+"/sign?api-version=7.4", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("signing: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var signed azureSignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signed.Value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+
+	return signature, nil
+}
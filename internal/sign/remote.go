@@ -0,0 +1,245 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The signing service protocol is plain JSON over HTTPS:
+//
+//   GET  /v1/key   returns {"key_name": "..."}
+//   POST /v1/sign  takes {"sha1_digest": "<base64>"} and returns
+//                  {"signature": "<base64>"}
+//
+// Both sides authenticate with TLS certificates.
+
+type keyResponse struct {
+	KeyName string `json:"key_name"`
+}
+
+type signRequest struct {
+	SHA1Digest []byte `json:"sha1_digest"`
+}
+
+type signResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// RemoteSigner requests signatures from a signing service, so that the
+// signing key does not need to be on the build host.
+type RemoteSigner struct {
+	url     string
+	client  *http.Client
+	keyName string
+}
+
+// TLSConfig returns a TLS configuration which presents the certificate
+// in certFile and keyFile, and trusts the CA certificates in caFile, or
+// the system roots if caFile is empty.
+func TLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+
+	return config, nil
+}
+
+// LoadCertPool returns a pool of the PEM encoded CA certificates in
+// caFile.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA certificates: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("%s does not contain PEM encoded certificates", caFile)
+	}
+	return pool, nil
+}
+
+// NewRemoteSigner returns a signer using the signing service at url,
+// authenticating with the client certificate in certFile and keyFile.
+// The service certificate is verified with the CA certificates in caFile.
+func NewRemoteSigner(url, certFile, keyFile, caFile string) (*RemoteSigner, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("a client certificate and key are required to use a signing service")
+	}
+
+	config, err := TLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return newRemoteSigner(url, &http.Client{Transport: transport})
+}
+
+func newRemoteSigner(url string, client *http.Client) (*RemoteSigner, error) {
+	s := &RemoteSigner{
+		url:    strings.TrimSuffix(url, "/"),
+		client: client,
+	}
+
+	var key keyResponse
+	if err := s.call(http.MethodGet, "/v1/key", nil, &key); err != nil {
+		return nil, fmt.Errorf("fetching signing key name: %w", err)
+	}
+
+	if key.KeyName == "" {
+		return nil, errors.New("signing service did not return a key name")
+	}
+	s.keyName = key.KeyName
+
+	return s, nil
+}
+
+func (s *RemoteSigner) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, s.url+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// KeyName returns the name of the public key of the signing service.
+func (s *RemoteSigner) KeyName() string {
+	return s.keyName
+}
+
+// SignSHA1Digest requests a signature of the provided SHA1 message digest.
+func (s *RemoteSigner) SignSHA1Digest(sha1Digest []byte) ([]byte, error) {
+	if len(sha1Digest) != sha1.Size {
+		return nil, errDigestNotSH1
+	}
+
+	var resp signResponse
+	if err := s.call(http.MethodPost, "/v1/sign", signRequest{SHA1Digest: sha1Digest}, &resp); err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return resp.Signature, nil
+}
+
+// NewServer returns a handler implementing the signing service with
+// signer.  It must be served with TLS, requiring client certificates.
+func NewServer(signer Signer) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/key", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, keyResponse{KeyName: signer.KeyName()})
+	})
+
+	mux.HandleFunc("/v1/sign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req signRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("malformed request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if len(req.SHA1Digest) != sha1.Size {
+			http.Error(w, errDigestNotSH1.Error(), http.StatusBadRequest)
+			return
+		}
+
+		signature, err := signer.SignSHA1Digest(req.SHA1Digest)
+		if err != nil {
+			log.Printf("unable to sign digest: %v", err)
+			http.Error(w, "unable to sign digest", http.StatusInternalServerError)
+			return
+		}
+
+		client := "unknown client"
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			client = r.TLS.PeerCertificates[0].Subject.String()
+		}
+		log.Printf("signed digest %x for %s", req.SHA1Digest, client)
+
+		writeJSON(w, signResponse{Signature: signature})
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("unable to write response: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// Signer signs the SHA1 digest of the control section of APKv2
+// packages.  Implementations must be safe for concurrent use, as the
+// packages of a batch are signed from several builds at once.
+type Signer interface {
+	// KeyName is the name of the public key, as installed in
+	// /etc/apk/keys, which verifies the signatures.
+	KeyName() string
+	// SignSHA1Digest returns the RSA PKCS#1 v1.5 signature of a SHA1
+	// digest.
+	SignSHA1Digest(sha1Digest []byte) ([]byte, error)
+}
+
+// LocalSigner signs with a private key read from a file.
+type LocalSigner struct {
+	keyFile    string
+	passphrase string
+
+	once sync.Once
+	key  *rsa.PrivateKey
+	err  error
+}
+
+// NewLocalSigner returns a signer using the PEM encoded RSA private key
+// in keyFile, which is decrypted with passphrase if it is encrypted.  The
+// key is only read when the first signature is made.
+func NewLocalSigner(keyFile, passphrase string) *LocalSigner {
+	return &LocalSigner{keyFile: keyFile, passphrase: passphrase}
+}
+
+// KeyName returns the name of the public key of the signing key, which
+// is the name of the signing key file followed by .pub.
+func (s *LocalSigner) KeyName() string {
+	return filepath.Base(s.keyFile) + ".pub"
+}
+
+func (s *LocalSigner) loadKey() {
+	keyFileContent, err := ioutil.ReadFile(s.keyFile)
+	if err != nil {
+		s.err = fmt.Errorf("reading key file: %w", err)
+		return
+	}
+
+	block, _ := pem.Decode(keyFileContent)
+	if block == nil {
+		s.err = errNoPemBlock
+		return
+	}
+
+	blockData := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
+		if s.passphrase == "" {
+			s.err = errNoPassphrase
+			return
+		}
+
+		blockData, err = x509.DecryptPEMBlock(block, []byte(s.passphrase)) //nolint:staticcheck
+		if err != nil {
+			s.err = fmt.Errorf("decrypt private key PEM block: %w", err)
+			return
+		}
+	}
+
+	s.key, err = x509.ParsePKCS1PrivateKey(blockData)
+	if err != nil {
+		s.err = fmt.Errorf("parse PKCS1 private key: %w", err)
+	}
+}
+
+// SignSHA1Digest signs the provided SHA1 message digest.
+func (s *LocalSigner) SignSHA1Digest(sha1Digest []byte) ([]byte, error) {
+	if len(sha1Digest) != sha1.Size {
+		return nil, errDigestNotSH1
+	}
+
+	s.once.Do(s.loadKey)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	signature, err := s.key.Sign(rand.Reader, sha1Digest, crypto.SHA1)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return signature, nil
+}
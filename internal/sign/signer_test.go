@@ -0,0 +1,216 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestKey writes a new RSA key pair, and returns the paths of the
+// private and public keys.
+func writeTestKey(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "test.rsa")
+	pubFile := keyFile + ".pub"
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyFile, pubFile
+}
+
+func TestLocalSigner(t *testing.T) {
+	keyFile, pubFile := writeTestKey(t)
+	s := NewLocalSigner(keyFile, "")
+
+	if got := s.KeyName(); got != "test.rsa.pub" {
+		t.Errorf("KeyName() = %q, want %q", got, "test.rsa.pub")
+	}
+
+	// signatures are made concurrently by the builds of a batch.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			digest := sha1.Sum([]byte{byte(i)}) // nolint:gosec
+			signature, err := s.SignSHA1Digest(digest[:])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if err := RSAVerifySHA1Digest(digest[:], signature, pubFile); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err := s.SignSHA1Digest([]byte("short")); err == nil {
+		t.Error("SignSHA1Digest() accepted a digest which is not SHA1")
+	}
+
+	if _, err := NewLocalSigner(filepath.Join(t.TempDir(), "missing"), "").SignSHA1Digest(make([]byte, sha1.Size)); err == nil {
+		t.Error("SignSHA1Digest() succeeded without a key")
+	}
+}
+
+func TestRemoteSigner(t *testing.T) {
+	keyFile, pubFile := writeTestKey(t)
+
+	srv := httptest.NewTLSServer(NewServer(NewLocalSigner(keyFile, "")))
+	defer srv.Close()
+
+	s, err := newRemoteSigner(srv.URL+"/", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.KeyName(); got != "test.rsa.pub" {
+		t.Errorf("KeyName() = %q, want %q", got, "test.rsa.pub")
+	}
+
+	digest := sha1.Sum([]byte("control")) // nolint:gosec
+	signature, err := s.SignSHA1Digest(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RSAVerifySHA1Digest(digest[:], signature, pubFile); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewRemoteSigner(srv.URL, "", "", ""); err == nil {
+		t.Error("NewRemoteSigner() succeeded without a client certificate")
+	}
+}
+
+func TestAzureKeyVaultSigner(t *testing.T) {
+	keyFile, pubFile := writeTestKey(t)
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing metadata header", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "identity-token", "expires_on": "%d"}`, time.Now().Add(time.Hour).Unix())
+	})
+	mux.HandleFunc("/keys/melange/v1/sign", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer identity-token" {
+			http.Error(w, "unauthorized: "+got, http.StatusUnauthorized)
+			return
+		}
+		var req azureSignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Algorithm != "RSNULL" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		digestInfo, err := base64.RawURLEncoding.DecodeString(req.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// RSNULL pads and signs the data as it is given.
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, 0, digestInfo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(azureSignResponse{Value: base64.RawURLEncoding.EncodeToString(signature)}) // nolint:errcheck
+	})
+
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	oldEndpoint := azureIdentityEndpoint
+	defer func() { azureIdentityEndpoint = oldEndpoint }()
+	azureIdentityEndpoint = srv.URL + "/token"
+	t.Setenv(azureKeyVaultTokenEnv, "")
+
+	s, err := NewAzureKeyVaultSigner(srv.URL+"/keys/melange/v1", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.KeyName(); got != "melange.rsa.pub" {
+		t.Errorf("KeyName() = %q, want %q", got, "melange.rsa.pub")
+	}
+
+	digest := sha1.Sum([]byte("control")) // nolint:gosec
+	signature, err := s.SignSHA1Digest(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RSAVerifySHA1Digest(digest[:], signature, pubFile); err != nil {
+		t.Error(err)
+	}
+
+	t.Setenv(azureKeyVaultTokenEnv, "stale-token")
+	if _, err := s.SignSHA1Digest(digest[:]); err == nil {
+		t.Error("SignSHA1Digest() succeeded with a rejected token")
+	}
+
+	for _, keyURL := range []string{
+		"http://example.vault.azure.net/keys/melange",
+		"https://example.vault.azure.net/secrets/melange",
+		"https://example.vault.azure.net/keys/",
+		"https://example.vault.azure.net/keys/melange/v1/extra",
+	} {
+		if _, err := NewAzureKeyVaultSigner(keyURL, srv.Client()); err == nil {
+			t.Errorf("NewAzureKeyVaultSigner(%q) succeeded", keyURL)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+
+	// the hash functions of the timestamp tokens.
+	_ "crypto/sha1" // nolint:gosec
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// The timestamps of the signatures are RFC 3161 time-stamp tokens: CMS
+// SignedData documents, signed by a time-stamping authority, whose
+// content is a TSTInfo stating the time at which the authority was
+// shown the SHA256 digest of a signature.  Since the signature existed
+// at that time, it can be trusted after its key is rotated or expires,
+// as long as the key was trusted then.
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+// timestampHashes are the hash functions of the timestamp tokens.
+var timestampHashes = map[string]crypto.Hash{
+	oidSHA1.String():   crypto.SHA1,
+	oidSHA256.String(): crypto.SHA256,
+	oidSHA384.String(): crypto.SHA384,
+	oidSHA512.String(): crypto.SHA512,
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string `asn1:"optional,utf8"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// tstInfo holds the fields of a TSTInfo up to its nonce, the following
+// ones are ignored.
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        asn1.RawValue
+	Accuracy       accuracy `asn1:"optional"`
+	Ordering       bool     `asn1:"optional"`
+	Nonce          *big.Int `asn1:"optional"`
+}
+
+// Timestamper requests RFC 3161 timestamps of signatures from a
+// time-stamping authority.
+type Timestamper struct {
+	url    string
+	client *http.Client
+}
+
+// NewTimestamper returns a timestamper using the time-stamping authority
+// at url, which it reaches with client, or the default client if nil.
+func NewTimestamper(url string, client *http.Client) *Timestamper {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Timestamper{url: url, client: client}
+}
+
+// Timestamp returns the DER encoded RFC 3161 time-stamp token of the
+// SHA256 digest of a signature, which includes the certificate of the
+// time-stamping authority.
+func (t *Timestamper) Timestamp(signature []byte) ([]byte, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	digest := crypto.SHA256.New()
+	digest.Write(signature)
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest.Sum(nil),
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client.Post(t.url, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("requesting timestamp: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading timestamp: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("time-stamping authority returned %s", resp.Status)
+	}
+
+	var tsr timeStampResp
+	if _, err := asn1.Unmarshal(body, &tsr); err != nil {
+		return nil, fmt.Errorf("parsing timestamp response: %w", err)
+	}
+	// 0 is granted, 1 granted with modifications.
+	if tsr.Status.Status > 1 {
+		return nil, fmt.Errorf("time-stamping authority rejected the request with status %d: %v", tsr.Status.Status, tsr.Status.StatusString)
+	}
+
+	token := tsr.TimeStampToken.FullBytes
+	info, _, err := parseTimestamp(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.check(signature); err != nil {
+		return nil, err
+	}
+	// a response without the nonce of the request may be replayed.
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("timestamp is not a response to the request, its nonce differs")
+	}
+
+	return token, nil
+}
+
+// parseTimestamp returns the TSTInfo of a time-stamp token, and the
+// signed data holding it.
+func parseTimestamp(token []byte) (*tstInfo, *signedData, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		return nil, nil, fmt.Errorf("parsing timestamp: %w", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, errors.New("timestamp is not signed data")
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, nil, fmt.Errorf("parsing timestamp: %w", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, nil, errors.New("timestamp does not hold a TSTInfo")
+	}
+
+	var info tstInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, nil, fmt.Errorf("parsing timestamp: %w", err)
+	}
+	return &info, &sd, nil
+}
+
+// check checks that the TSTInfo timestamps a signature.
+func (info *tstInfo) check(signature []byte) error {
+	h, ok := timestampHashes[info.MessageImprint.HashAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported timestamp hash algorithm %s", info.MessageImprint.HashAlgorithm.Algorithm)
+	}
+
+	digest := h.New()
+	digest.Write(signature)
+	if !bytes.Equal(digest.Sum(nil), info.MessageImprint.HashedMessage) {
+		return errors.New("timestamp is not one of the signature")
+	}
+	return nil
+}
+
+// time returns the time of the TSTInfo, a GeneralizedTime whose seconds
+// may have a fraction.
+func (info *tstInfo) time() (time.Time, error) {
+	if info.GenTime.Tag != asn1.TagGeneralizedTime {
+		return time.Time{}, errors.New("timestamp has no time")
+	}
+	return time.Parse("20060102150405Z0700", string(info.GenTime.Bytes))
+}
+
+// VerifyTimestamp verifies the time-stamp token of a signature, and
+// returns the time at which the signature existed.  The token must be
+// signed by the certificate it includes, which must chain to roots and
+// be valid for time-stamping, unless roots is nil.
+func VerifyTimestamp(token, signature []byte, roots *x509.CertPool) (time.Time, error) {
+	info, sd, err := parseTimestamp(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := info.check(signature); err != nil {
+		return time.Time{}, err
+	}
+	genTime, err := info.time()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing timestamp certificates: %w", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return time.Time{}, errors.New("timestamp must have one signer")
+	}
+	si := sd.SignerInfos[0]
+
+	cert, err := si.certificate(certs)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := si.verify(cert, sd.EncapContentInfo.EContent); err != nil {
+		return time.Time{}, err
+	}
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, c := range certs {
+			intermediates.AddCert(c)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   genTime,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		}); err != nil {
+			return time.Time{}, fmt.Errorf("verifying time-stamping authority: %w", err)
+		}
+	}
+
+	return genTime, nil
+}
+
+// certificate returns the certificate of the signer.
+func (si *signerInfo) certificate(certs []*x509.Certificate) (*x509.Certificate, error) {
+	var ias issuerAndSerialNumber
+	isIAS := si.SID.Class == asn1.ClassUniversal
+	if isIAS {
+		if _, err := asn1.Unmarshal(si.SID.FullBytes, &ias); err != nil {
+			return nil, fmt.Errorf("parsing timestamp signer: %w", err)
+		}
+	}
+
+	for _, c := range certs {
+		switch {
+		case isIAS && c.SerialNumber.Cmp(ias.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, ias.Issuer.FullBytes):
+			return c, nil
+		case !isIAS && si.SID.Tag == 0 && bytes.Equal(c.SubjectKeyId, si.SID.Bytes):
+			return c, nil
+		}
+	}
+	return nil, errors.New("timestamp does not include the certificate of its signer")
+}
+
+// verify verifies the signature of the signed attributes, and that they
+// hold the digest of the content.
+func (si *signerInfo) verify(cert *x509.Certificate, content []byte) error {
+	h, ok := timestampHashes[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported timestamp digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	if len(si.SignedAttrs.FullBytes) == 0 {
+		return errors.New("timestamp has no signed attributes")
+	}
+
+	// the signature is the one of the DER encoding of the attributes
+	// as a SET, not with their implicit tag.
+	signed := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		return fmt.Errorf("parsing timestamp attributes: %w", err)
+	}
+
+	digest := h.New()
+	digest.Write(content)
+	found := false
+	for _, a := range attrs {
+		if !a.Type.Equal(oidMessageDigest) || len(a.Values) != 1 {
+			continue
+		}
+		var md []byte
+		if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &md); err != nil {
+			return fmt.Errorf("parsing timestamp attributes: %w", err)
+		}
+		if !bytes.Equal(md, digest.Sum(nil)) {
+			return errors.New("timestamp content does not match its digest")
+		}
+		found = true
+	}
+	if !found {
+		return errors.New("timestamp has no message digest")
+	}
+
+	algorithm, err := signatureAlgorithm(cert.PublicKeyAlgorithm, h)
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(algorithm, signed, si.Signature); err != nil {
+		return fmt.Errorf("verifying timestamp signature: %w", err)
+	}
+	return nil
+}
+
+// signatureAlgorithm returns the signature algorithm of a key and hash.
+func signatureAlgorithm(key x509.PublicKeyAlgorithm, h crypto.Hash) (x509.SignatureAlgorithm, error) {
+	algorithms := map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+		x509.RSA: {
+			crypto.SHA1:   x509.SHA1WithRSA,
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		},
+		x509.ECDSA: {
+			crypto.SHA1:   x509.ECDSAWithSHA1,
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		},
+	}
+	if a, ok := algorithms[key][h]; ok {
+		return a, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported timestamp signature algorithm %s with %s", key, h)
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testTSA is a time-stamping authority answering with tokens of its
+// self-signed certificate.
+type testTSA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	time time.Time
+
+	// replay answers with a nonce other than the one of the request.
+	replay bool
+}
+
+func newTestTSA(t *testing.T) *testTSA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		Subject:               pkix.Name{CommonName: "test tsa"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testTSA{key: key, cert: cert, time: time.Now().UTC().Truncate(time.Second)}
+}
+
+// token returns the time-stamp token of a message imprint, answering a
+// request with nonce.
+func (tsa *testTSA) token(t *testing.T, imprint messageImprint, nonce *big.Int) []byte {
+	t.Helper()
+
+	genTime, err := asn1.MarshalWithParams(tsa.time, "generalized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3},
+		MessageImprint: imprint,
+		SerialNumber:   big.NewInt(1),
+		GenTime:        asn1.RawValue{FullBytes: genTime},
+		Accuracy:       accuracy{Seconds: 1},
+		Nonce:          nonce,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+	md, err := asn1.Marshal(digest.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := asn1.MarshalWithParams([]attribute{{Type: oidMessageDigest, Values: []asn1.RawValue{{FullBytes: md}}}}, "set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest = crypto.SHA256.New()
+	digest.Write(attrs)
+	sig, err := ecdsa.SignASN1(rand.Reader, tsa.key, digest.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid, err := asn1.Marshal(issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: tsa.cert.RawIssuer}, SerialNumber: tsa.cert.SerialNumber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256ID := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	// the signed attributes are implicitly tagged [0].
+	attrs[0] = 0xa0
+	sd, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256ID},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: oidTSTInfo, EContent: content},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsa.cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    sha256ID,
+			SignedAttrs:        asn1.RawValue{FullBytes: attrs},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func (tsa *testTSA) server(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/timestamp-query" {
+			http.Error(w, "bad content type", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req timeStampReq
+		if _, err := asn1.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		nonce := req.Nonce
+		if tsa.replay {
+			nonce = big.NewInt(1)
+		}
+
+		resp, err := asn1.Marshal(timeStampResp{TimeStampToken: asn1.RawValue{FullBytes: tsa.token(t, req.MessageImprint, nonce)}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.Write(resp) // nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTimestamp(t *testing.T) {
+	tsa := newTestTSA(t)
+	srv := tsa.server(t)
+
+	signature := []byte("signature")
+	token, err := NewTimestamper(srv.URL, srv.Client()).Timestamp(signature)
+	if err != nil {
+		t.Fatalf("unable to timestamp signature: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tsa.cert)
+	for _, pool := range []*x509.CertPool{nil, roots} {
+		genTime, err := VerifyTimestamp(token, signature, pool)
+		if err != nil {
+			t.Fatalf("unable to verify timestamp: %v", err)
+		}
+		if !genTime.Equal(tsa.time) {
+			t.Errorf("timestamp time is %s, expected %s", genTime, tsa.time)
+		}
+	}
+
+	if _, err := VerifyTimestamp(token, []byte("other signature"), nil); err == nil {
+		t.Error("verified the timestamp of another signature")
+	}
+
+	other := newTestTSA(t)
+	untrusted := x509.NewCertPool()
+	untrusted.AddCert(other.cert)
+	if _, err := VerifyTimestamp(token, signature, untrusted); err == nil {
+		t.Error("verified a timestamp of an untrusted authority")
+	}
+
+	// move the time of the token an hour later.
+	tampered := bytes.Replace(token, []byte(tsa.time.Format("2006010215")), []byte(tsa.time.Add(time.Hour).Format("2006010215")), 1)
+	if bytes.Equal(tampered, token) {
+		t.Fatal("unable to find the time of the timestamp")
+	}
+	if _, err := VerifyTimestamp(tampered, signature, nil); err == nil {
+		t.Error("verified a tampered timestamp")
+	}
+
+	// a response to another request is rejected.
+	tsa.replay = true
+	if _, err := NewTimestamper(srv.URL, srv.Client()).Timestamp(signature); err == nil {
+		t.Error("accepted a timestamp with another nonce")
+	}
+}
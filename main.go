@@ -16,12 +16,24 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"chainguard.dev/melange/pkg/cli"
+	"chainguard.dev/melange/pkg/errcode"
 )
 
 func main() {
-	if err := cli.New().Execute(); err != nil {
-		log.Fatalf("error during command execution: %v", err)
+	cmd := cli.New()
+
+	if err := cli.HandlePluginCommand(cmd, os.Args[1:]); err != nil {
+		log.Fatalf("error during plugin execution: %v", err)
+	}
+
+	if err := cmd.Execute(); err != nil {
+		log.Printf("error during command execution: %v", err)
+		// the code and hint of the failure, for the triage of
+		// failed builds.
+		errcode.Report(log.Writer(), err)
+		os.Exit(1)
 	}
 }
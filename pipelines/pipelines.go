@@ -0,0 +1,24 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pipelines embeds the built-in pipelines shipped with melange.
+package pipelines
+
+import "embed"
+
+// FS contains the built-in pipelines, keyed by their `uses` name with a
+// .yaml extension, e.g. "autoconf/configure.yaml".
+//
+//go:embed *.yaml */*.yaml
+var FS embed.FS
@@ -0,0 +1,230 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apk reads APKv2 packages, such as the ones emitted by melange.
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// PackageInfo is the parsed content of a .PKGINFO file.
+type PackageInfo struct {
+	// Fields holds every key = value line, in order.  Keys such as
+	// depend may appear several times.
+	Fields []Field
+	// Comments holds the comment lines, without the leading "#".
+	Comments []string
+}
+
+// Field is a single key = value line of a .PKGINFO file.
+type Field struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Get returns the value of the first field with the given key.
+func (pi *PackageInfo) Get(key string) string {
+	for _, f := range pi.Fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// GetAll returns the values of every field with the given key.
+func (pi *PackageInfo) GetAll(key string) []string {
+	values := []string{}
+	for _, f := range pi.Fields {
+		if f.Key == key {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// annotationComment prefixes the comments recording the annotations of
+// the package, as "annotation key: value".
+const annotationComment = "annotation "
+
+// Annotations returns the annotations recorded in the comments.
+func (pi *PackageInfo) Annotations() map[string]string {
+	annotations := map[string]string{}
+	for _, comment := range pi.Comments {
+		if !strings.HasPrefix(comment, annotationComment) {
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimPrefix(comment, annotationComment), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		annotations[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return annotations
+}
+
+// The comments recording the deprecation of the package: "deprecated",
+// or "deprecated: reason", followed by the replacement and end of life,
+// if any.
+const (
+	deprecatedComment  = "deprecated"
+	replacementComment = "replacement: "
+	endOfLifeComment   = "end of life: "
+)
+
+// dataHashComment prefixes the comments recording the additional digests
+// of the data section, as "datahash <algorithm>: <hex digest>".
+const dataHashComment = "datahash "
+
+// DataHashes returns the digests of the data section, keyed by
+// algorithm: the SHA256 digest of the datahash field, and the digests
+// recorded in the comments.
+func (pi *PackageInfo) DataHashes() map[string]string {
+	hashes := map[string]string{}
+	if datahash := pi.Get("datahash"); datahash != "" {
+		hashes["sha256"] = datahash
+	}
+	for _, comment := range pi.Comments {
+		if !strings.HasPrefix(comment, dataHashComment) {
+			continue
+		}
+		if alg, digest, ok := strings.Cut(strings.TrimPrefix(comment, dataHashComment), ": "); ok {
+			hashes[alg] = digest
+		}
+	}
+	return hashes
+}
+
+// Deprecation is the deprecation of a package recorded in the comments.
+type Deprecation struct {
+	Reason      string
+	Replacement string
+	// EndOfLife is a date, YYYY-MM-DD.
+	EndOfLife string
+}
+
+// Deprecation returns the deprecation recorded in the comments, or nil
+// when the package is not deprecated.
+func (pi *PackageInfo) Deprecation() *Deprecation {
+	d := Deprecation{}
+	deprecated := false
+	for _, comment := range pi.Comments {
+		switch {
+		case comment == deprecatedComment:
+			deprecated = true
+		case strings.HasPrefix(comment, deprecatedComment+": "):
+			deprecated = true
+			d.Reason = strings.TrimPrefix(comment, deprecatedComment+": ")
+		case strings.HasPrefix(comment, replacementComment):
+			d.Replacement = strings.TrimPrefix(comment, replacementComment)
+		case strings.HasPrefix(comment, endOfLifeComment):
+			d.EndOfLife = strings.TrimPrefix(comment, endOfLifeComment)
+		}
+	}
+
+	if !deprecated {
+		return nil
+	}
+	return &d
+}
+
+// ParsePackageInfo parses a .PKGINFO file.
+func ParsePackageInfo(r io.Reader) (*PackageInfo, error) {
+	pi := PackageInfo{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			pi.Comments = append(pi.Comments, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed .PKGINFO line: %q", line)
+		}
+
+		pi.Fields = append(pi.Fields, Field{
+			Key:   strings.TrimSpace(parts[0]),
+			Value: strings.TrimSpace(parts[1]),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read .PKGINFO: %w", err)
+	}
+
+	return &pi, nil
+}
+
+// ReadPackageInfo reads the .PKGINFO of an APKv2 package.
+//
+// An APKv2 package is a concatenation of gzip streams (signature, control
+// and data) whose tar archives are not terminated, except for the last one,
+// so they can be read as a single multistream tar archive.
+func ReadPackageInfo(r io.Reader) (*PackageInfo, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress package: %w", err)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("package does not contain a .PKGINFO")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read package: %w", err)
+		}
+
+		if hdr.Name != ".PKGINFO" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, fmt.Errorf("unable to read .PKGINFO: %w", err)
+		}
+
+		return ParsePackageInfo(&buf)
+	}
+}
+
+// ReadPackageInfoFile reads the .PKGINFO of the APKv2 package at path.
+func ReadPackageInfoFile(path string) (*PackageInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadPackageInfo(f)
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPackageInfo = `
+# Generated by melange.
+# config digest: sha256:abcd
+pkgname = foo
+pkgver = 1.2.3-r0
+depend = bar
+depend = baz>=1.0
+datahash = 0123
+`
+
+// gzipTar returns a gzip stream of a tar archive of files.  APKv2
+// packages only terminate the tar archive of their last stream.
+func gzipTar(t *testing.T, files map[string]string, last bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var err error
+	if last {
+		err = tw.Close()
+	} else {
+		err = tw.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParsePackageInfo(t *testing.T) {
+	pi, err := ParsePackageInfo(strings.NewReader(testPackageInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantComments := []string{"Generated by melange.", "config digest: sha256:abcd"}
+	if !reflect.DeepEqual(pi.Comments, wantComments) {
+		t.Errorf("Comments = %q, want %q", pi.Comments, wantComments)
+	}
+
+	if got := pi.Get("pkgver"); got != "1.2.3-r0" {
+		t.Errorf("Get(pkgver) = %q, want %q", got, "1.2.3-r0")
+	}
+
+	if got := pi.Get("url"); got != "" {
+		t.Errorf("Get(url) = %q, want an empty string", got)
+	}
+
+	wantDepends := []string{"bar", "baz>=1.0"}
+	if got := pi.GetAll("depend"); !reflect.DeepEqual(got, wantDepends) {
+		t.Errorf("GetAll(depend) = %q, want %q", got, wantDepends)
+	}
+}
+
+func TestPackageInfoAnnotations(t *testing.T) {
+	pi, err := ParsePackageInfo(strings.NewReader(testPackageInfo + "# annotation tier: base\n# annotation team: web: frontend\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"tier": "base", "team": "web: frontend"}
+	if got := pi.Annotations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Annotations() = %q, want %q", got, want)
+	}
+}
+
+func TestPackageInfoDataHashes(t *testing.T) {
+	pi, err := ParsePackageInfo(strings.NewReader("datahash = abcd\n# datahash sha512: ef01\n# datahash sha384\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"sha256": "abcd", "sha512": "ef01"}
+	if got := pi.DataHashes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DataHashes() = %q, want %q", got, want)
+	}
+}
+
+func TestParsePackageInfoMalformed(t *testing.T) {
+	if _, err := ParsePackageInfo(strings.NewReader("pkgname foo\n")); err == nil {
+		t.Error("ParsePackageInfo() succeeded on a line without =")
+	}
+}
+
+func TestReadPackageInfo(t *testing.T) {
+	signature := gzipTar(t, map[string]string{".SIGN.RSA.key.rsa.pub": "signature"}, false)
+	control := gzipTar(t, map[string]string{".PKGINFO": testPackageInfo}, false)
+	data := gzipTar(t, map[string]string{"usr/bin/foo": "#!/bin/sh\n"}, true)
+
+	tests := []struct {
+		name    string
+		streams [][]byte
+		wantErr bool
+	}{{
+		name:    "signed",
+		streams: [][]byte{signature, control, data},
+	}, {
+		name:    "unsigned",
+		streams: [][]byte{control, data},
+	}, {
+		name:    "no control stream",
+		streams: [][]byte{signature, data},
+		wantErr: true,
+	}, {
+		name:    "not gzip",
+		streams: [][]byte{[]byte("not a package")},
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pi, err := ReadPackageInfo(bytes.NewReader(bytes.Join(tt.streams, nil)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadPackageInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := pi.Get("pkgname"); got != "foo" {
+				t.Errorf("Get(pkgname) = %q, want %q", got, "foo")
+			}
+		})
+	}
+}
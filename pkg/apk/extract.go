@@ -0,0 +1,155 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractPackage writes the files of the data section of an APKv2
+// package into dir, like apk would install them, without running its
+// scripts.  It returns the .PKGINFO of the package and the headers of the
+// extracted files.  Ownership is not preserved.
+func ExtractPackage(r io.Reader, dir string) (*PackageInfo, []*tar.Header, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decompress package: %w", err)
+	}
+	defer gzr.Close()
+
+	var info *PackageInfo
+	files := []*tar.Header{}
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read package: %w", err)
+		}
+
+		if hdr.Name == ".PKGINFO" {
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, tr); err != nil {
+				return nil, nil, fmt.Errorf("unable to read .PKGINFO: %w", err)
+			}
+			if info, err = ParsePackageInfo(&buf); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		// the other control files are signatures and scripts.
+		if strings.HasPrefix(hdr.Name, ".") && !strings.Contains(hdr.Name, "/") {
+			continue
+		}
+
+		if err := extractEntry(tr, hdr, dir); err != nil {
+			return nil, nil, err
+		}
+		files = append(files, hdr)
+	}
+
+	if info == nil {
+		return nil, nil, errors.New("package does not contain a .PKGINFO")
+	}
+
+	return info, files, nil
+}
+
+// extractEntry writes an entry of the data section into dir.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dir string) error {
+	name := filepath.Clean(filepath.FromSlash(hdr.Name))
+	if !isLocal(name) {
+		return fmt.Errorf("package entry %s is outside of the package", hdr.Name)
+	}
+
+	path := filepath.Join(dir, name)
+	mode := hdr.FileInfo().Mode().Perm()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// the symlinks of the package must not lead the entries out of dir.
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, parent); err != nil || !isLocal(rel) {
+		return fmt.Errorf("package entry %s is outside of the package", hdr.Name)
+	}
+
+	// an earlier entry of the same name, e.g. a symlink out of dir, is
+	// replaced rather than followed.
+	if fi, err := os.Lstat(path); err == nil && (hdr.Typeflag != tar.TypeDir || !fi.IsDir()) {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("unable to replace %s: %w", hdr.Name, err)
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		return os.Chmod(path, mode)
+
+	case tar.TypeReg:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to extract %s: %w", hdr.Name, err)
+		}
+		return f.Close()
+
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, path)
+
+	case tar.TypeLink:
+		target := filepath.Clean(filepath.FromSlash(hdr.Linkname))
+		if !isLocal(target) {
+			return fmt.Errorf("package entry %s links outside of the package", hdr.Name)
+		}
+		return os.Link(filepath.Join(dir, target), path)
+	}
+
+	// device nodes and FIFOs cannot be created unprivileged, and are
+	// not needed to run the programs of the package.
+	return nil
+}
+
+// isLocal reports whether a cleaned path is relative and does not
+// escape its directory.
+func isLocal(path string) bool {
+	return !filepath.IsAbs(path) && path != ".." && !strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
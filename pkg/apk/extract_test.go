@@ -0,0 +1,148 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gzipTarEntries returns a gzip compressed, terminated tar archive of
+// the given entries.
+func gzipTarEntries(t *testing.T, entries []*tar.Header, contents map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, hdr := range entries {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(contents[hdr.Name]))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name][:hdr.Size])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestExtractPackage(t *testing.T) {
+	control := gzipTar(t, map[string]string{".PKGINFO": testPackageInfo, ".post-install": "#!/bin/sh\n"}, false)
+	data := gzipTarEntries(t, []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/foo", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "usr/bin/bar", Typeflag: tar.TypeSymlink, Linkname: "foo"},
+		{Name: "usr/bin/baz", Typeflag: tar.TypeLink, Linkname: "usr/bin/foo"},
+	}, map[string]string{"usr/bin/foo": "#!/bin/sh\n"})
+
+	dir := t.TempDir()
+	info, files, err := ExtractPackage(bytes.NewReader(append(control, data...)), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := info.Get("pkgname"); got != "foo" {
+		t.Errorf("pkgname = %q, want foo", got)
+	}
+	if len(files) != 5 {
+		t.Errorf("files = %d, want 5", len(files))
+	}
+
+	for _, name := range []string{"usr/bin/foo", "usr/bin/bar", "usr/bin/baz"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != "#!/bin/sh\n" {
+			t.Errorf("%s = %q, %v", name, data, err)
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "usr/bin/foo"))
+	if err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("usr/bin/foo mode = %v, %v, want 0755", fi, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".post-install")); err == nil {
+		t.Error("the scripts of the package are extracted")
+	}
+}
+
+func TestExtractPackageOutside(t *testing.T) {
+	control := gzipTar(t, map[string]string{".PKGINFO": testPackageInfo}, false)
+
+	for _, entries := range [][]*tar.Header{
+		{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}},
+		{{Name: "etc/passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+		{
+			{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: t.TempDir()},
+			{Name: "lib/escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		data := gzipTarEntries(t, entries, nil)
+		if _, _, err := ExtractPackage(bytes.NewReader(append(control, data...)), t.TempDir()); err == nil {
+			t.Errorf("ExtractPackage() of %s succeeded", entries[len(entries)-1].Name)
+		}
+	}
+}
+
+func TestExtractPackageReplacesSymlinks(t *testing.T) {
+	control := gzipTar(t, map[string]string{".PKGINFO": testPackageInfo}, false)
+
+	outside := t.TempDir()
+	target := filepath.Join(outside, "target")
+	if err := os.WriteFile(target, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a symlink out of the directory followed by a file of the same name.
+	data := gzipTarEntries(t, []*tar.Header{
+		{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: target},
+		{Name: "escape", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "dir", Typeflag: tar.TypeDir, Mode: 0700},
+	}, map[string]string{"escape": "inside"})
+
+	dir := t.TempDir()
+	if _, _, err := ExtractPackage(bytes.NewReader(append(control, data...)), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(target); err != nil || string(data) != "outside" {
+		t.Errorf("file outside of the package = %q, %v, want outside", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "escape")); err != nil || string(data) != "inside" {
+		t.Errorf("escape = %q, %v, want inside", data, err)
+	}
+
+	if fi, err := os.Stat(outside); err != nil || fi.Mode().Perm() == 0700 {
+		t.Errorf("directory outside of the package = %v, %v, want unchanged", fi, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "dir")); err != nil || !fi.IsDir() {
+		t.Errorf("dir = %v, %v, want a directory", fi, err)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IndexEntry is the record of a package in an APKINDEX.  Its fields are
+// keyed by single letters, such as P for the name and V for the version.
+type IndexEntry struct {
+	Fields []Field
+}
+
+// Get returns the value of the field with the given key.
+func (e *IndexEntry) Get(key string) string {
+	for _, f := range e.Fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Name returns the name of the package.
+func (e *IndexEntry) Name() string {
+	return e.Get("P")
+}
+
+// Version returns the version of the package.
+func (e *IndexEntry) Version() string {
+	return e.Get("V")
+}
+
+// Checksum returns the checksum of the control section of the package,
+// which apk verifies the package against.
+func (e *IndexEntry) Checksum() string {
+	return e.Get("C")
+}
+
+// Dependencies returns the dependencies of the package.
+func (e *IndexEntry) Dependencies() []string {
+	return strings.Fields(e.Get("D"))
+}
+
+// Provides returns the names provided by the package.
+func (e *IndexEntry) Provides() []string {
+	return strings.Fields(e.Get("p"))
+}
+
+// InstalledDatabase is the database of the packages installed in a root
+// filesystem, relative to it, which has the format of an APKINDEX.
+const InstalledDatabase = "lib/apk/db/installed"
+
+// ParseIndex parses the APKINDEX file of an index archive, or an
+// installed database.
+func ParseIndex(r io.Reader) ([]IndexEntry, error) {
+	entries := []IndexEntry{}
+	entry := IndexEntry{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(entry.Fields) > 0 {
+				entries = append(entries, entry)
+				entry = IndexEntry{}
+			}
+			continue
+		}
+
+		if len(line) < 2 || line[1] != ':' {
+			return nil, fmt.Errorf("malformed APKINDEX line: %q", line)
+		}
+
+		entry.Fields = append(entry.Fields, Field{Key: line[:1], Value: line[2:]})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read APKINDEX: %w", err)
+	}
+
+	if len(entry.Fields) > 0 {
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// ReadIndex reads the package records of an index archive, such as
+// APKINDEX.tar.gz.  Signed archives are read like packages: the
+// signature is a separate gzip stream preceding the index.
+func ReadIndex(r io.Reader) ([]IndexEntry, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress index: %w", err)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("index does not contain an APKINDEX")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read index: %w", err)
+		}
+
+		if hdr.Name != "APKINDEX" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, fmt.Errorf("unable to read APKINDEX: %w", err)
+		}
+
+		return ParseIndex(&buf)
+	}
+}
+
+// indexKeys maps the keys of .PKGINFO fields to the keys of the index
+// fields recording them, in the order they are written.  Fields which
+// may appear several times in a .PKGINFO are joined into one.
+var indexKeys = []struct {
+	pkginfo, index, sep string
+}{
+	{"pkgname", "P", ""},
+	{"pkgver", "V", ""},
+	{"arch", "A", ""},
+	{"size", "I", ""},
+	{"pkgdesc", "T", ""},
+	{"url", "U", ""},
+	{"license", "L", " AND "},
+	{"origin", "o", ""},
+	{"maintainer", "m", ""},
+	{"builddate", "t", ""},
+	{"commit", "c", ""},
+	{"provider_priority", "k", ""},
+	{"depend", "D", " "},
+	{"provides", "p", " "},
+	{"install_if", "i", " "},
+}
+
+// NewIndexEntry returns the index record of a package, given its
+// .PKGINFO, the SHA1 digest of its control section and the size of the
+// package file.
+func NewIndexEntry(info *PackageInfo, controlDigest []byte, size int64) IndexEntry {
+	entry := IndexEntry{Fields: []Field{
+		{Key: "C", Value: "Q1" + base64.StdEncoding.EncodeToString(controlDigest)},
+	}}
+
+	for _, k := range indexKeys {
+		values := info.GetAll(k.pkginfo)
+		if len(values) == 0 {
+			continue
+		}
+		if k.sep == "" {
+			values = values[:1]
+		}
+		entry.Fields = append(entry.Fields, Field{Key: k.index, Value: strings.Join(values, k.sep)})
+
+		// the size of the package file follows its architecture.
+		if k.index == "A" {
+			entry.Fields = append(entry.Fields, Field{Key: "S", Value: strconv.FormatInt(size, 10)})
+		}
+	}
+
+	return entry
+}
+
+// WriteIndex writes an unsigned index archive, like APKINDEX.tar.gz, of
+// the given package records.  It can be signed by prepending a
+// signature section, over the SHA1 digest of the archive.
+func WriteIndex(w io.Writer, entries []IndexEntry, description string) error {
+	var index bytes.Buffer
+	for _, entry := range entries {
+		for _, f := range entry.Fields {
+			fmt.Fprintf(&index, "%s:%s\n", f.Key, f.Value)
+		}
+		index.WriteString("\n")
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"DESCRIPTION", []byte(description)},
+		{"APKINDEX", index.Bytes()},
+	} {
+		hdr := &tar.Header{
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.data)),
+			Typeflag: tar.TypeReg,
+			Uname:    "root",
+			Gname:    "root",
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("unable to write index: %w", err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return fmt.Errorf("unable to write index: %w", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("unable to write index: %w", err)
+	}
+	return gzw.Close()
+}
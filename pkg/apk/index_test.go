@@ -0,0 +1,154 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testIndex = `C:Q1abcd=
+P:foo
+V:1.2.3-r0
+A:x86_64
+D:bar so:libc.musl-x86_64.so.1
+p:cmd:foo=1.2.3-r0
+
+C:Q1efgh=
+P:bar
+V:2.0-r1
+A:x86_64
+`
+
+func TestParseIndex(t *testing.T) {
+	entries, err := ParseIndex(strings.NewReader(testIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("ParseIndex() returned %d entries, want 2", len(entries))
+	}
+
+	foo := entries[0]
+	if foo.Name() != "foo" || foo.Version() != "1.2.3-r0" || foo.Checksum() != "Q1abcd=" {
+		t.Errorf("entry = %s %s %s, want foo 1.2.3-r0 Q1abcd=", foo.Name(), foo.Version(), foo.Checksum())
+	}
+
+	wantDepends := []string{"bar", "so:libc.musl-x86_64.so.1"}
+	if got := foo.Dependencies(); !reflect.DeepEqual(got, wantDepends) {
+		t.Errorf("Dependencies() = %q, want %q", got, wantDepends)
+	}
+
+	if got := foo.Provides(); !reflect.DeepEqual(got, []string{"cmd:foo=1.2.3-r0"}) {
+		t.Errorf("Provides() = %q, want [cmd:foo=1.2.3-r0]", got)
+	}
+
+	if got := entries[1].Dependencies(); len(got) != 0 {
+		t.Errorf("Dependencies() = %q, want none", got)
+	}
+}
+
+func TestParseIndexMalformed(t *testing.T) {
+	if _, err := ParseIndex(strings.NewReader("P:foo\nnot a field\n")); err == nil {
+		t.Error("ParseIndex() succeeded on a line without a key")
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	signature := gzipTar(t, map[string]string{".SIGN.RSA.key.rsa.pub": "signature"}, false)
+	index := gzipTar(t, map[string]string{"DESCRIPTION": "main", "APKINDEX": testIndex}, true)
+
+	tests := []struct {
+		name    string
+		streams [][]byte
+		wantErr bool
+	}{{
+		name:    "signed",
+		streams: [][]byte{signature, index},
+	}, {
+		name:    "unsigned",
+		streams: [][]byte{index},
+	}, {
+		name:    "no APKINDEX",
+		streams: [][]byte{gzipTar(t, map[string]string{"DESCRIPTION": "main"}, true)},
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := ReadIndex(bytes.NewReader(bytes.Join(tt.streams, nil)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadIndex() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(entries) != 2 {
+				t.Errorf("ReadIndex() returned %d entries, want 2", len(entries))
+			}
+		})
+	}
+}
+
+func TestWriteIndex(t *testing.T) {
+	info := &PackageInfo{Fields: []Field{
+		{Key: "pkgname", Value: "foo"},
+		{Key: "pkgver", Value: "1.2.3-r0"},
+		{Key: "arch", Value: "x86_64"},
+		{Key: "size", Value: "4096"},
+		{Key: "pkgdesc", Value: "the foo tool"},
+		{Key: "license", Value: "MIT"},
+		{Key: "license", Value: "Apache-2.0"},
+		{Key: "origin", Value: "foo"},
+		{Key: "depend", Value: "bar"},
+		{Key: "depend", Value: "!baz"},
+		{Key: "provides", Value: "cmd:foo=1.2.3-r0"},
+		{Key: "datahash", Value: "0123"},
+	}}
+
+	entry := NewIndexEntry(info, []byte{0xde, 0xad, 0xbe, 0xef}, 1234)
+	want := []Field{
+		{Key: "C", Value: "Q13q2+7w=="},
+		{Key: "P", Value: "foo"},
+		{Key: "V", Value: "1.2.3-r0"},
+		{Key: "A", Value: "x86_64"},
+		{Key: "S", Value: "1234"},
+		{Key: "I", Value: "4096"},
+		{Key: "T", Value: "the foo tool"},
+		{Key: "L", Value: "MIT AND Apache-2.0"},
+		{Key: "o", Value: "foo"},
+		{Key: "D", Value: "bar !baz"},
+		{Key: "p", Value: "cmd:foo=1.2.3-r0"},
+	}
+	if !reflect.DeepEqual(entry.Fields, want) {
+		t.Errorf("NewIndexEntry() = %v, want %v", entry.Fields, want)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteIndex(&buf, []IndexEntry{entry, {Fields: []Field{{Key: "P", Value: "bar"}}}}, "local"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !reflect.DeepEqual(entries[0], entry) || entries[1].Name() != "bar" {
+		t.Errorf("ReadIndex() = %v, want the written entries", entries)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Package is the parsed content of an APKv2 package.
+type Package struct {
+	Info *PackageInfo
+	// Signatures holds the signatures of the control section, keyed
+	// by the name of the public key verifying them.
+	Signatures map[string][]byte
+	// Timestamps holds the time-stamp tokens of the signatures, keyed
+	// like them.
+	Timestamps map[string][]byte
+	// Scripts holds the install scripts of the package, keyed by name,
+	// e.g. .post-install.
+	Scripts map[string][]byte
+	// ControlDigest is the SHA1 digest of the control section, which
+	// the signatures sign.
+	ControlDigest []byte
+	// DataDigest is the SHA256 digest of the data section, which is
+	// recorded as datahash in the .PKGINFO.
+	DataDigest []byte
+	// DataDigests holds the digests of the data section, keyed by
+	// the algorithms of PackageInfo.DataHashes.
+	DataDigests map[string][]byte
+	// Files holds the headers of the entries of the data section.
+	Files []*tar.Header
+	// SBOMs holds the JSON SBOMs installed by the package, keyed by
+	// path.
+	SBOMs map[string][]byte
+	// VEX holds the OpenVEX documents installed next to the SBOMs,
+	// keyed by path.
+	VEX map[string][]byte
+}
+
+// SBOMDir is the directory of the data section where packages install
+// their SBOMs.
+const SBOMDir = "var/lib/db/sbom/"
+
+// VEXExt is the extension of the OpenVEX documents installed in SBOMDir.
+const VEXExt = "openvex.json"
+
+// hashingReader hashes the bytes read from a buffered reader.  gzip reads
+// byte readers without buffering, so only the bytes of the current
+// stream are hashed.
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+	// extra are hashed as well, see DataDigests.
+	extra map[string]hash.Hash
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	for _, h := range hr.extra {
+		h.Write(p[:n])
+	}
+	return n, err
+}
+
+func (hr *hashingReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.h.Write([]byte{b})
+		for _, h := range hr.extra {
+			h.Write([]byte{b})
+		}
+	}
+	return b, err
+}
+
+// ReadPackage reads an APKv2 package.  Unlike ReadPackageInfo, it reads
+// the gzip streams of the package one by one, to compute the digests of
+// the control and data sections.
+func ReadPackage(r io.Reader) (*Package, error) {
+	pkg := &Package{
+		Signatures: map[string][]byte{},
+		Timestamps: map[string][]byte{},
+		Scripts:    map[string][]byte{},
+		Files:      []*tar.Header{},
+		SBOMs:      map[string][]byte{},
+		VEX:        map[string][]byte{},
+	}
+
+	br := bufio.NewReader(r)
+	var gzr *gzip.Reader
+
+	for section := 0; ; section++ {
+		hr := &hashingReader{r: br, h: sha1.New()} // nolint:gosec
+		if pkg.Info != nil {
+			hr.h = sha256.New()
+			hr.extra = map[string]hash.Hash{"sha512": sha512.New()}
+		}
+
+		var err error
+		if gzr == nil {
+			gzr, err = gzip.NewReader(hr)
+		} else {
+			err = gzr.Reset(hr)
+		}
+		if errors.Is(err, io.EOF) && section > 0 {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress package: %w", err)
+		}
+		gzr.Multistream(false)
+
+		isData := pkg.Info != nil
+		if err := pkg.readSection(tar.NewReader(gzr), isData); err != nil {
+			return nil, err
+		}
+
+		// the rest of the stream, such as the end of archive blocks,
+		// is part of the digest.
+		if _, err := io.Copy(io.Discard, gzr); err != nil {
+			return nil, fmt.Errorf("unable to read package: %w", err)
+		}
+
+		switch {
+		case isData:
+			pkg.DataDigest = hr.h.Sum(nil)
+			pkg.DataDigests = map[string][]byte{"sha256": pkg.DataDigest}
+			for alg, h := range hr.extra {
+				pkg.DataDigests[alg] = h.Sum(nil)
+			}
+		case pkg.Info != nil:
+			pkg.ControlDigest = hr.h.Sum(nil)
+		}
+	}
+
+	if pkg.Info == nil {
+		return nil, errors.New("package does not contain a .PKGINFO")
+	}
+
+	return pkg, nil
+}
+
+// readSection reads the entries of a section of a package.
+func (pkg *Package) readSection(tr *tar.Reader, isData bool) error {
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read package: %w", err)
+		}
+
+		if isData {
+			pkg.Files = append(pkg.Files, hdr)
+			// the signatures and attestations of the SBOMs are
+			// stored next to them.
+			if !strings.HasPrefix(hdr.Name, SBOMDir) || !strings.HasSuffix(hdr.Name, ".json") || hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return fmt.Errorf("unable to read %s: %w", hdr.Name, err)
+		}
+
+		switch {
+		case isData && strings.HasSuffix(hdr.Name, "."+VEXExt):
+			pkg.VEX[hdr.Name] = buf.Bytes()
+		case isData:
+			pkg.SBOMs[hdr.Name] = buf.Bytes()
+		case hdr.Name == ".PKGINFO":
+			pkg.Info, err = ParsePackageInfo(&buf)
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(hdr.Name, SignaturePrefix):
+			pkg.Signatures[strings.TrimPrefix(hdr.Name, SignaturePrefix)] = buf.Bytes()
+		case strings.HasPrefix(hdr.Name, TimestampPrefix):
+			pkg.Timestamps[strings.TrimPrefix(hdr.Name, TimestampPrefix)] = buf.Bytes()
+		case strings.HasPrefix(hdr.Name, "."):
+			pkg.Scripts[hdr.Name] = buf.Bytes()
+		}
+	}
+}
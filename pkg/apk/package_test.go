@@ -0,0 +1,71 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"testing"
+)
+
+func TestReadPackage(t *testing.T) {
+	signature := gzipTar(t, map[string]string{".SIGN.RSA.key.rsa.pub": "signature"}, false)
+	control := gzipTar(t, map[string]string{".PKGINFO": testPackageInfo, ".post-install": "#!/bin/sh\n"}, false)
+	data := gzipTar(t, map[string]string{"usr/bin/foo": "#!/bin/sh\n", SBOMDir + "foo.spdx.json": "{}", SBOMDir + "foo." + VEXExt: "[]"}, true)
+
+	pkg, err := ReadPackage(bytes.NewReader(bytes.Join([][]byte{signature, control, data}, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := pkg.Info.Get("pkgname"); got != "foo" {
+		t.Errorf("pkgname = %q, want foo", got)
+	}
+
+	if got := string(pkg.Signatures["key.rsa.pub"]); got != "signature" {
+		t.Errorf("signature = %q, want %q", got, "signature")
+	}
+
+	if _, ok := pkg.Scripts[".post-install"]; !ok || len(pkg.Scripts) != 1 {
+		t.Errorf("scripts = %v, want .post-install only", pkg.Scripts)
+	}
+
+	controlDigest := sha1.Sum(control) // nolint:gosec
+	if !bytes.Equal(pkg.ControlDigest, controlDigest[:]) {
+		t.Errorf("control digest = %x, want %x", pkg.ControlDigest, controlDigest)
+	}
+
+	dataDigest := sha256.Sum256(data)
+	if !bytes.Equal(pkg.DataDigest, dataDigest[:]) {
+		t.Errorf("data digest = %x, want %x", pkg.DataDigest, dataDigest)
+	}
+
+	if len(pkg.Files) != 3 {
+		t.Errorf("files = %v, want 3 files", pkg.Files)
+	}
+
+	if got := string(pkg.SBOMs[SBOMDir+"foo.spdx.json"]); got != "{}" || len(pkg.SBOMs) != 1 {
+		t.Errorf("SBOMs = %v, want the contents of foo.spdx.json", pkg.SBOMs)
+	}
+
+	if got := string(pkg.VEX[SBOMDir+"foo."+VEXExt]); got != "[]" || len(pkg.VEX) != 1 {
+		t.Errorf("VEX = %v, want the contents of foo.%s", pkg.VEX, VEXExt)
+	}
+
+	if _, err := ReadPackage(bytes.NewReader(data)); err == nil {
+		t.Error("ReadPackage() succeeded without a control section")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1" // nolint:gosec
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// SignaturePrefix prefixes the names of the signatures of the signature
+// section, which are followed by the name of the public key verifying
+// them.
+const SignaturePrefix = ".SIGN.RSA."
+
+// TimestampPrefix prefixes the names of the RFC 3161 time-stamp tokens of
+// the signatures, which are followed by the name of the public key of the
+// signature.  apk ignores them, as any signature of an unknown type.
+const TimestampPrefix = ".SIGN.TSR."
+
+// Signatures is the signature section of an APKv2 package or index
+// archive, which signs the gzip stream following it: the control section
+// of packages, the whole index of index archives.
+type Signatures struct {
+	// Signatures holds the signatures, keyed by the name of the public
+	// key verifying them.  It is empty when the archive is not signed.
+	Signatures map[string][]byte
+	// Timestamps holds the time-stamp tokens of the signatures, keyed
+	// like them.
+	Timestamps map[string][]byte
+	// Size is the size of the signature section, where the signed
+	// content starts.
+	Size int64
+	// Digest is the SHA1 digest of the gzip stream the signatures sign.
+	Digest []byte
+}
+
+// countingReader counts and hashes the bytes read from a buffered reader.
+// Like hashingReader, it lets gzip read byte by byte, so that the bytes
+// counted end with the current stream.
+type countingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.h.Write(p[:n])
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.h.Write([]byte{b})
+		cr.n++
+	}
+	return b, err
+}
+
+// ReadSignatures reads the signature section of an APKv2 package or index
+// archive, and the digest of the stream it signs.
+func ReadSignatures(r io.Reader) (*Signatures, error) {
+	sigs := &Signatures{Signatures: map[string][]byte{}, Timestamps: map[string][]byte{}}
+	cr := &countingReader{r: bufio.NewReader(r), h: sha1.New()} // nolint:gosec
+
+	gzr, err := gzip.NewReader(cr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress archive: %w", err)
+	}
+	defer gzr.Close()
+	gzr.Multistream(false)
+
+	signed := true
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read archive: %w", err)
+		}
+
+		if !strings.HasPrefix(hdr.Name, ".SIGN.") {
+			signed = false
+			break
+		}
+		if !strings.HasPrefix(hdr.Name, SignaturePrefix) && !strings.HasPrefix(hdr.Name, TimestampPrefix) {
+			return nil, fmt.Errorf("unsupported signature %s", hdr.Name)
+		}
+
+		sig, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", hdr.Name, err)
+		}
+		if strings.HasPrefix(hdr.Name, TimestampPrefix) {
+			sigs.Timestamps[strings.TrimPrefix(hdr.Name, TimestampPrefix)] = sig
+		} else {
+			sigs.Signatures[strings.TrimPrefix(hdr.Name, SignaturePrefix)] = sig
+		}
+	}
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return nil, fmt.Errorf("unable to read archive: %w", err)
+	}
+
+	if !signed {
+		// the first stream is the signed content.
+		sigs.Signatures = map[string][]byte{}
+		sigs.Timestamps = map[string][]byte{}
+		sigs.Digest = cr.h.Sum(nil)
+		return sigs, nil
+	}
+
+	sigs.Size = cr.n
+	cr.h.Reset()
+	if err := gzr.Reset(cr); err != nil {
+		return nil, fmt.Errorf("archive has no signed content: %w", err)
+	}
+	gzr.Multistream(false)
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return nil, fmt.Errorf("unable to read archive: %w", err)
+	}
+	sigs.Digest = cr.h.Sum(nil)
+
+	return sigs, nil
+}
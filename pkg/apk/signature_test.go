@@ -0,0 +1,57 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"testing"
+)
+
+func TestReadSignatures(t *testing.T) {
+	signature := gzipTar(t, map[string]string{".SIGN.RSA.key.rsa.pub": "signature", ".SIGN.TSR.key.rsa.pub": "timestamp"}, false)
+	control := gzipTar(t, map[string]string{".PKGINFO": testPackageInfo}, false)
+	data := gzipTar(t, map[string]string{"usr/bin/foo": "#!/bin/sh\n"}, true)
+	digest := sha1.Sum(control) // nolint:gosec
+
+	sigs, err := ReadSignatures(bytes.NewReader(bytes.Join([][]byte{signature, control, data}, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sigs.Signatures["key.rsa.pub"]) != "signature" || len(sigs.Signatures) != 1 {
+		t.Errorf("Signatures = %q, want the signature of key.rsa.pub", sigs.Signatures)
+	}
+	if string(sigs.Timestamps["key.rsa.pub"]) != "timestamp" || len(sigs.Timestamps) != 1 {
+		t.Errorf("Timestamps = %q, want the timestamp of key.rsa.pub", sigs.Timestamps)
+	}
+	if sigs.Size != int64(len(signature)) {
+		t.Errorf("Size = %d, want %d", sigs.Size, len(signature))
+	}
+	if !bytes.Equal(sigs.Digest, digest[:]) {
+		t.Errorf("Digest = %x, want %x", sigs.Digest, digest)
+	}
+
+	sigs, err = ReadSignatures(bytes.NewReader(bytes.Join([][]byte{control, data}, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sigs.Signatures) != 0 || sigs.Size != 0 || !bytes.Equal(sigs.Digest, digest[:]) {
+		t.Errorf("ReadSignatures() of an unsigned package = %+v, want no signatures and the digest %x", sigs, digest)
+	}
+
+	if _, err := ReadSignatures(bytes.NewReader(signature)); err == nil {
+		t.Errorf("ReadSignatures() of a signature section alone succeeded")
+	}
+}
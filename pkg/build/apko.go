@@ -0,0 +1,164 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"gopkg.in/yaml.v3"
+)
+
+// emittedPackage is a package written to the output directory by the
+// build.
+type emittedPackage struct {
+	name     string
+	version  string
+	filename string
+	// controlDigest is the SHA1 digest of the control section, which
+	// indexes record as the checksum of the package.
+	controlDigest []byte
+	// digest is the SHA256 digest of the package file.
+	digest []byte
+}
+
+// apkoFragment is the part of an apko image configuration installing
+// the packages of a build.
+type apkoFragment struct {
+	Contents struct {
+		Repositories []string `yaml:"repositories"`
+		Keyring      []string `yaml:"keyring,omitempty"`
+		Packages     []string `yaml:"packages"`
+	} `yaml:"contents"`
+}
+
+// apkoLock pins the packages of a build to their digests, like the
+// entries of apko lock files.
+type apkoLock struct {
+	Version  string `json:"version"`
+	Contents struct {
+		Repositories []apkoLockRepository `json:"repositories"`
+		Keyring      []string             `json:"keyring,omitempty"`
+		Packages     []apkoLockPackage    `json:"packages"`
+	} `json:"contents"`
+}
+
+type apkoLockRepository struct {
+	URL          string `json:"url"`
+	Architecture string `json:"architecture"`
+}
+
+type apkoLockPackage struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	URL          string `json:"url"`
+	// Checksum is the checksum of the control section of the package,
+	// as recorded in the indexes: Q1 followed by its base64 encoded
+	// SHA1 digest.
+	Checksum string `json:"checksum"`
+	// SHA256 is the digest of the package file.
+	SHA256 string `json:"sha256"`
+}
+
+// recordEmittedPackage records a package written to the output
+// directory, for the apko configuration fragment.
+func (pc *PackageContext) recordEmittedPackage(controlDigest, digest []byte) {
+	pc.Context.emittedPackages = append(pc.Context.emittedPackages, emittedPackage{
+		name:          pc.PackageName,
+		version:       fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+		filename:      pc.Filename(),
+		controlDigest: controlDigest,
+		digest:        digest,
+	})
+}
+
+// writeApkoFragment writes an apko configuration fragment installing the
+// packages written by the build, pinned to their version, next to them
+// as <package>-<version>-r<epoch>.apko.yaml, and a lock of the packages
+// to their digests as <package>-<version>-r<epoch>.apko.lock.json, if
+// it was requested.
+func (ctx *Context) writeApkoFragment() error {
+	if !ctx.ApkoFragment || len(ctx.emittedPackages) == 0 {
+		return nil
+	}
+
+	// apko looks the packages up in the subdirectory of the
+	// repository named after the architecture.
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	outDir, err := filepath.Abs(ctx.OutDir)
+	if err != nil {
+		return fmt.Errorf("unable to write apko configuration fragment: %w", err)
+	}
+	repository := filepath.Dir(outDir)
+	if filepath.Base(outDir) != arch {
+		log.Printf("warning: the output directory %s is not named after the architecture, %s, so apko will not find the packages in it", ctx.OutDir, arch)
+		repository = outDir
+	}
+
+	keyring := []string{}
+	if ctx.SigningKey != "" {
+		key, err := filepath.Abs(ctx.SigningKey + ".pub")
+		if err != nil {
+			return fmt.Errorf("unable to write apko configuration fragment: %w", err)
+		}
+		keyring = append(keyring, key)
+	}
+
+	var fragment apkoFragment
+	fragment.Contents.Repositories = []string{repository}
+	fragment.Contents.Keyring = keyring
+
+	lock := apkoLock{Version: "v1"}
+	lock.Contents.Repositories = []apkoLockRepository{{URL: repository, Architecture: arch}}
+	lock.Contents.Keyring = keyring
+
+	for _, p := range ctx.emittedPackages {
+		fragment.Contents.Packages = append(fragment.Contents.Packages, p.name+"="+p.version)
+		lock.Contents.Packages = append(lock.Contents.Packages, apkoLockPackage{
+			Name:         p.name,
+			Version:      p.version,
+			Architecture: arch,
+			URL:          filepath.Join(outDir, p.filename),
+			Checksum:     "Q1" + base64.StdEncoding.EncodeToString(p.controlDigest),
+			SHA256:       hex.EncodeToString(p.digest),
+		})
+	}
+
+	data, err := yaml.Marshal(&fragment)
+	if err != nil {
+		return fmt.Errorf("unable to write apko configuration fragment: %w", err)
+	}
+	lockData, err := json.MarshalIndent(&lock, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to write apko lock: %w", err)
+	}
+
+	pc := &PackageContext{Context: ctx, Origin: &ctx.Configuration.Package, PackageName: ctx.Configuration.Package.Name}
+	if err := pc.exportArtifact("apko.yaml", data); err != nil {
+		return fmt.Errorf("unable to write apko configuration fragment: %w", err)
+	}
+	if err := pc.exportArtifact("apko.lock.json", append(lockData, '\n')); err != nil {
+		return fmt.Errorf("unable to write apko lock: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteApkoFragment(t *testing.T) {
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	repository := t.TempDir()
+	outDir := filepath.Join(repository, arch)
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &Context{OutDir: outDir, ApkoFragment: true, SigningKey: filepath.Join(repository, "melange.rsa")}
+	ctx.Configuration.Package = Package{Name: "hello", Version: "2.12", Epoch: 1}
+	for _, name := range []string{"hello", "hello-doc"} {
+		pc := &PackageContext{Context: ctx, Origin: &ctx.Configuration.Package, PackageName: name}
+		pc.recordEmittedPackage([]byte{0xde, 0xad, 0xbe, 0xef}, []byte{0x01, 0x02})
+	}
+
+	if err := ctx.writeApkoFragment(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outDir, "hello-2.12-r1.apko.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fragment apkoFragment
+	if err := yaml.Unmarshal(data, &fragment); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fragment.Contents.Repositories, []string{repository}) {
+		t.Errorf("repositories = %q, want %q", fragment.Contents.Repositories, repository)
+	}
+	if !reflect.DeepEqual(fragment.Contents.Keyring, []string{filepath.Join(repository, "melange.rsa.pub")}) {
+		t.Errorf("keyring = %q, want the public key of the signing key", fragment.Contents.Keyring)
+	}
+	if want := []string{"hello=2.12-r1", "hello-doc=2.12-r1"}; !reflect.DeepEqual(fragment.Contents.Packages, want) {
+		t.Errorf("packages = %q, want %q", fragment.Contents.Packages, want)
+	}
+
+	data, err = os.ReadFile(filepath.Join(outDir, "hello-2.12-r1.apko.lock.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock apkoLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		t.Fatal(err)
+	}
+	want := apkoLockPackage{
+		Name:         "hello-doc",
+		Version:      "2.12-r1",
+		Architecture: arch,
+		URL:          filepath.Join(outDir, "hello-doc-2.12-r1.apk"),
+		Checksum:     "Q13q2+7w==",
+		SHA256:       "0102",
+	}
+	if len(lock.Contents.Packages) != 2 || lock.Contents.Packages[1] != want {
+		t.Errorf("lock packages = %+v, want hello and %+v", lock.Contents.Packages, want)
+	}
+	if len(ctx.artifacts) != 2 {
+		t.Errorf("artifacts = %q, want the fragment and the lock", ctx.artifacts)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Artifacts are passed between the builds of a batch without publishing
+// them as packages, such as a bootstrap compiler built by one
+// configuration and used to build another.  A build importing an
+// artifact is scheduled after the build exporting it, and the digests of
+// the artifacts are recorded in the packages of both.
+type Artifacts struct {
+	Exports []ArtifactExport `yaml:"exports"`
+	Imports []ArtifactImport `yaml:"imports"`
+}
+
+// ArtifactExport is a file or directory of the workspace which is
+// exported once the pipelines have run.
+type ArtifactExport struct {
+	Name string `yaml:"name"`
+	// Path is relative to the workspace.
+	Path string `yaml:"path"`
+}
+
+// ArtifactImport is an artifact exported by another build of the batch,
+// which is copied into the workspace before the pipelines run.
+type ArtifactImport struct {
+	Name string `yaml:"name"`
+	// Path is relative to the workspace, by default the name of the
+	// artifact.
+	Path string `yaml:"path"`
+}
+
+// destination returns the path of the imported artifact in the
+// workspace.
+func (ai *ArtifactImport) destination() string {
+	if ai.Path != "" {
+		return ai.Path
+	}
+	return ai.Name
+}
+
+// validate checks the names of the artifacts and that their paths are
+// within the workspace.
+func (a *Artifacts) validate() error {
+	exported := map[string]bool{}
+	for _, e := range a.Exports {
+		if err := validateArtifact(e.Name, e.Path); err != nil {
+			return err
+		}
+		if e.Path == "" {
+			return fmt.Errorf("exported artifact %s has no path", e.Name)
+		}
+		if exported[e.Name] {
+			return fmt.Errorf("artifact %s is exported more than once", e.Name)
+		}
+		exported[e.Name] = true
+	}
+
+	for _, i := range a.Imports {
+		if err := validateArtifact(i.Name, i.Path); err != nil {
+			return err
+		}
+		if exported[i.Name] {
+			return fmt.Errorf("artifact %s is both exported and imported", i.Name)
+		}
+	}
+
+	return nil
+}
+
+func validateArtifact(name, p string) error {
+	if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-") != "" || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%q is not an artifact name, which consists of letters, digits, '.', '_' and '-'", name)
+	}
+	if p != "" && (path.IsAbs(p) || path.Clean(p) != p || p == "." || p == ".." || strings.HasPrefix(p, "../")) {
+		return fmt.Errorf("path %q of artifact %s must be a clean path relative to the workspace", p, name)
+	}
+	return nil
+}
+
+// artifactStore keeps the artifacts exported by the builds of a batch,
+// each in the file or directory named after it.
+type artifactStore struct {
+	dir string
+
+	mu sync.Mutex
+	// digests maps the names of the exported artifacts to their
+	// digests.
+	digests map[string]string
+}
+
+func newArtifactStore() (*artifactStore, error) {
+	dir, err := os.MkdirTemp("", "melange-artifacts-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create artifact store: %w", err)
+	}
+	return &artifactStore{dir: dir, digests: map[string]string{}}, nil
+}
+
+func (s *artifactStore) remove() {
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("warning: unable to remove artifact store: %v", err)
+	}
+}
+
+// exportArtifacts copies the artifacts exported by the build into the
+// artifact store of its batch.
+func (ctx *Context) exportArtifacts() error {
+	exports := ctx.Configuration.Artifacts.Exports
+	if len(exports) == 0 {
+		return nil
+	}
+	if ctx.artifactStore == nil {
+		log.Printf("not exporting artifacts, as the build is not part of a batch")
+		return nil
+	}
+
+	for _, e := range exports {
+		src := filepath.Join(ctx.WorkspaceDir, filepath.FromSlash(e.Path))
+		dst := filepath.Join(ctx.artifactStore.dir, e.Name)
+		if err := copyTree(src, dst); err != nil {
+			return fmt.Errorf("unable to export artifact %s: %w", e.Name, err)
+		}
+
+		digest, err := treeDigest(dst)
+		if err != nil {
+			return fmt.Errorf("unable to export artifact %s: %w", e.Name, err)
+		}
+
+		ctx.artifactStore.mu.Lock()
+		ctx.artifactStore.digests[e.Name] = digest
+		ctx.artifactStore.mu.Unlock()
+
+		log.Printf("exported artifact %s from %s (%s)", e.Name, e.Path, digest)
+		ctx.exportedArtifacts = append(ctx.exportedArtifacts, e.Name+" "+digest)
+	}
+
+	return nil
+}
+
+// importArtifacts copies the artifacts imported by the build from the
+// artifact store of its batch into the workspace.
+func (ctx *Context) importArtifacts() error {
+	for _, i := range ctx.Configuration.Artifacts.Imports {
+		var digest string
+		var ok bool
+		if ctx.artifactStore != nil {
+			ctx.artifactStore.mu.Lock()
+			digest, ok = ctx.artifactStore.digests[i.Name]
+			ctx.artifactStore.mu.Unlock()
+		}
+		if !ok {
+			return fmt.Errorf("artifact %s was not exported by a build of the batch", i.Name)
+		}
+
+		dst := filepath.Join(ctx.WorkspaceDir, filepath.FromSlash(i.destination()))
+		if err := os.RemoveAll(dst); err != nil {
+			return fmt.Errorf("unable to import artifact %s: %w", i.Name, err)
+		}
+		if err := copyTree(filepath.Join(ctx.artifactStore.dir, i.Name), dst); err != nil {
+			return fmt.Errorf("unable to import artifact %s: %w", i.Name, err)
+		}
+
+		log.Printf("imported artifact %s into %s (%s)", i.Name, i.destination(), digest)
+		ctx.importedArtifacts = append(ctx.importedArtifacts, i.Name+" "+digest)
+	}
+
+	return nil
+}
+
+// ImportedArtifacts lists the artifacts imported by the build, with
+// their digests, for the provenance of the packages.
+func (ctx *Context) ImportedArtifacts() []string {
+	return ctx.importedArtifacts
+}
+
+// ExportedArtifacts lists the artifacts exported by the build, with
+// their digests.
+func (ctx *Context) ExportedArtifacts() []string {
+	return ctx.exportedArtifacts
+}
+
+// copyTree copies a file or directory, along with the modes of the files
+// and the symbolic links it contains.
+func copyTree(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	return filepath.Walk(src, func(p string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			return copyRegularFile(p, target, fi.Mode().Perm())
+		default:
+			return fmt.Errorf("%s is not a regular file, directory or symbolic link", p)
+		}
+	})
+}
+
+func copyRegularFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// treeDigest returns the digest of a file or directory, which covers the
+// paths, types, permissions and contents of the files it contains.
+func treeDigest(root string) (string, error) {
+	digest, err := hashTree(root, fs.FileMode.Perm)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + digest, nil
+}
+
+// hashTree returns the hex SHA256 digest of a file or directory, covering
+// the permissions of the files returned by perm.
+func hashTree(root string, perm func(fs.FileMode) fs.FileMode) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(root, func(p string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case fi.IsDir():
+			fmt.Fprintf(h, "dir %o %s\n", perm(fi.Mode()), rel)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "symlink %s %s\n", rel, link)
+		default:
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			fh := sha256.New()
+			_, err = io.Copy(fh, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "file %o %s %x\n", perm(fi.Mode()), rel, fh.Sum(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArtifactsValidate(t *testing.T) {
+	valid := Artifacts{
+		Exports: []ArtifactExport{{Name: "bootstrap-gcc", Path: "stage1/install"}},
+		Imports: []ArtifactImport{{Name: "bootstrap-binutils"}},
+	}
+	if err := valid.validate(); err != nil {
+		t.Error(err)
+	}
+
+	for _, a := range []Artifacts{
+		{Exports: []ArtifactExport{{Name: "gcc"}}},
+		{Exports: []ArtifactExport{{Name: "gcc", Path: "../gcc"}}},
+		{Exports: []ArtifactExport{{Name: "gcc", Path: "/usr"}}},
+		{Exports: []ArtifactExport{{Name: "gcc/1", Path: "gcc"}}},
+		{Exports: []ArtifactExport{{Name: "gcc", Path: "a"}, {Name: "gcc", Path: "b"}}},
+		{Exports: []ArtifactExport{{Name: "gcc", Path: "a"}}, Imports: []ArtifactImport{{Name: "gcc"}}},
+		{Imports: []ArtifactImport{{Name: "gcc", Path: "a/../../b"}}},
+	} {
+		if err := a.validate(); err == nil {
+			t.Errorf("%+v was accepted", a)
+		}
+	}
+}
+
+func TestExportImportArtifacts(t *testing.T) {
+	store, err := newArtifactStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.remove()
+
+	exporter := &Context{WorkspaceDir: t.TempDir(), artifactStore: store}
+	exporter.Configuration.Artifacts.Exports = []ArtifactExport{{Name: "bootstrap", Path: "stage1"}}
+	writeFile(t, filepath.Join(exporter.WorkspaceDir, "stage1/bin/cc"), "#!/bin/sh\n")
+	if err := os.Chmod(filepath.Join(exporter.WorkspaceDir, "stage1/bin/cc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("cc", filepath.Join(exporter.WorkspaceDir, "stage1/bin/gcc")); err != nil {
+		t.Fatal(err)
+	}
+
+	importer := &Context{WorkspaceDir: t.TempDir(), artifactStore: store}
+	importer.Configuration.Artifacts.Imports = []ArtifactImport{{Name: "bootstrap", Path: "tools/bootstrap"}}
+
+	if err := importer.importArtifacts(); err == nil {
+		t.Errorf("importing an artifact before it is exported succeeded")
+	}
+
+	if err := exporter.exportArtifacts(); err != nil {
+		t.Fatal(err)
+	}
+	if err := importer.importArtifacts(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(importer.WorkspaceDir, "tools/bootstrap")
+	if fi, err := os.Stat(filepath.Join(dir, "bin/cc")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("imported bin/cc: %v, %v", fi, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "bin/gcc")); err != nil || link != "cc" {
+		t.Errorf("imported bin/gcc links to %q: %v", link, err)
+	}
+
+	digest, err := treeDigest(filepath.Join(exporter.WorkspaceDir, "stage1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bootstrap " + digest}
+	if !reflect.DeepEqual(exporter.ExportedArtifacts(), want) || !reflect.DeepEqual(importer.ImportedArtifacts(), want) {
+		t.Errorf("exported %q, imported %q, want %q", exporter.ExportedArtifacts(), importer.ImportedArtifacts(), want)
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		t.Errorf("digest = %q", digest)
+	}
+}
+
+func TestBatchArtifacts(t *testing.T) {
+	contexts := []*Context{{}, {}, {}}
+	contexts[0].Configuration.Artifacts.Imports = []ArtifactImport{{Name: "bootstrap"}}
+	contexts[2].Configuration.Artifacts.Exports = []ArtifactExport{{Name: "bootstrap", Path: "out"}}
+	b := &Batch{ConfigFiles: []string{"a.yaml", "b.yaml", "c.yaml"}, Contexts: contexts}
+
+	if err := b.checkArtifacts(); err != nil {
+		t.Fatal(err)
+	}
+	if deps := b.dependencies(); !reflect.DeepEqual(deps, map[int][]int{0: {2}}) {
+		t.Errorf("dependencies() = %v", deps)
+	}
+
+	contexts[1].Configuration.Artifacts.Exports = []ArtifactExport{{Name: "bootstrap", Path: "out"}}
+	if err := b.checkArtifacts(); err == nil {
+		t.Errorf("an artifact exported by two builds was accepted")
+	}
+
+	contexts[1].Configuration.Artifacts.Exports = nil
+	contexts[1].Configuration.Artifacts.Imports = []ArtifactImport{{Name: "stage2"}}
+	if err := b.checkArtifacts(); err == nil {
+		t.Errorf("an artifact which is not exported was accepted")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Assertions check the output directory of a package where the step is
+// in the pipeline, usually at its end, so that packaging regressions,
+// such as a file which is no longer installed, fail the build instead of
+// being found in the published packages.  Every assertion is checked,
+// and the build fails with all the failed ones.
+type Assertions struct {
+	// Package is the package whose output directory is checked, by
+	// default the package or subpackage of the pipeline.
+	Package string `yaml:"package"`
+	// Files are glob patterns, relative to the output directory,
+	// which must each match a file.
+	Files []string `yaml:"files"`
+	// Links are the shared libraries which ELF files must link
+	// against.
+	Links []LinkAssertion `yaml:"links"`
+	// Commands must succeed in the build environment.
+	Commands []CommandAssertion `yaml:"commands"`
+}
+
+// LinkAssertion asserts that an ELF file links against shared libraries.
+type LinkAssertion struct {
+	// File is relative to the output directory.
+	File string `yaml:"file"`
+	// Libraries are the sonames which the file must need, such as
+	// libssl.so.3.
+	Libraries []string `yaml:"libraries"`
+}
+
+// CommandAssertion asserts that a command succeeds, and optionally that
+// its output matches a regular expression.
+type CommandAssertion struct {
+	// Run is a shell script fragment, such as
+	// "${{targets.destdir}}/usr/bin/hello --version".
+	Run string `yaml:"run"`
+	// Matches is a regular expression which the standard output and
+	// error of the command must match.
+	Matches string `yaml:"matches"`
+}
+
+// validateAssertions checks the assertions of pipelines.
+func validateAssertions(pipelines []Pipeline) error {
+	for _, p := range pipelines {
+		if err := validateAssertions(p.Pipeline); err != nil {
+			return err
+		}
+		if p.Assertions == nil {
+			continue
+		}
+
+		for _, pattern := range p.Assertions.Files {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("assertions: file %q: %w", pattern, err)
+			}
+		}
+		for _, l := range p.Assertions.Links {
+			if l.File == "" {
+				return errors.New("assertions: link is missing a file")
+			}
+			if len(l.Libraries) == 0 {
+				return fmt.Errorf("assertions: link of %s lists no libraries", l.File)
+			}
+		}
+		for _, c := range p.Assertions.Commands {
+			if c.Run == "" {
+				return errors.New("assertions: command is missing a script")
+			}
+			if _, err := regexp.Compile(c.Matches); err != nil {
+				return fmt.Errorf("assertions: command %q: %w", c.Run, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// substitute returns the assertions with the replacements of r.
+func (a *Assertions) substitute(r *strings.Replacer) *Assertions {
+	out := &Assertions{
+		Package: r.Replace(a.Package),
+		Files:   replaceAll(r, a.Files),
+	}
+	for _, l := range a.Links {
+		out.Links = append(out.Links, LinkAssertion{File: r.Replace(l.File), Libraries: replaceAll(r, l.Libraries)})
+	}
+	for _, c := range a.Commands {
+		out.Commands = append(out.Commands, CommandAssertion{Run: r.Replace(c.Run), Matches: r.Replace(c.Matches)})
+	}
+	return out
+}
+
+// values returns the strings of the assertions.
+func (a *Assertions) values() []string {
+	values := append([]string{a.Package}, a.Files...)
+	for _, l := range a.Links {
+		values = append(values, l.File)
+		values = append(values, l.Libraries...)
+	}
+	for _, c := range a.Commands {
+		values = append(values, c.Run, c.Matches)
+	}
+	return values
+}
+
+// packageName returns the name of the package whose output directory is
+// checked.
+func (a *Assertions) packageName(ctx *PipelineContext) string {
+	if a.Package != "" {
+		return a.Package
+	}
+	if ctx.Subpackage != nil {
+		return ctx.Subpackage.Name
+	}
+	return ctx.Package.Name
+}
+
+// Run checks the assertions, and returns an error listing the failed
+// ones.
+func (a *Assertions) Run(ctx *PipelineContext) error {
+	name := a.packageName(ctx)
+	dir := filepath.Join(ctx.Context.WorkspaceDir, "melange-out", name)
+
+	failures := []string{}
+	for _, pattern := range a.Files {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			failures = append(failures, fmt.Sprintf("no file matches %s", pattern))
+		}
+	}
+
+	for _, l := range a.Links {
+		failures = append(failures, checkLinks(dir, l)...)
+	}
+
+	replacer := replacerFromMap(mutateWith(ctx, nil))
+	for _, c := range a.Commands {
+		if problem, err := ctx.Context.checkCommand(replacer.Replace(c.Run), c.Matches); err != nil {
+			return err
+		} else if problem != "" {
+			failures = append(failures, problem)
+		}
+	}
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("package %s failed assertions:\n  %s", name, strings.Join(failures, "\n  "))
+	}
+
+	log.Printf("  package %s passed %d assertions", name, len(a.Files)+len(a.Links)+len(a.Commands))
+	return nil
+}
+
+// checkLinks returns the libraries of a link assertion which the file
+// does not need.
+func checkLinks(dir string, l LinkAssertion) []string {
+	f, err := openELF(filepath.Join(dir, l.File))
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", l.File, err)}
+	}
+	if f == nil {
+		return []string{fmt.Sprintf("%s is not an ELF file", l.File)}
+	}
+	defer f.Close()
+
+	needed, err := f.ImportedLibraries()
+	if err != nil {
+		return []string{fmt.Sprintf("%s: unable to read the needed libraries: %v", l.File, err)}
+	}
+
+	linked := map[string]bool{}
+	for _, lib := range needed {
+		linked[lib] = true
+	}
+
+	problems := []string{}
+	for _, lib := range l.Libraries {
+		if !linked[lib] {
+			problems = append(problems, fmt.Sprintf("%s does not link against %s", l.File, lib))
+		}
+	}
+	return problems
+}
+
+// checkCommand runs a command assertion in the build environment, and
+// returns why it failed, if it did.
+func (ctx *Context) checkCommand(fragment, matches string) (string, error) {
+	cmd, err := ctx.scriptCmd(fragment)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := cmd.CombinedOutput()
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Sprintf("command %q failed: %v: %s", fragment, err, strings.TrimSpace(string(out))), nil
+	}
+
+	if matches != "" {
+		re, err := regexp.Compile(matches)
+		if err != nil {
+			return "", err
+		}
+		if !re.Match(out) {
+			return fmt.Sprintf("output of command %q does not match %s: %s", fragment, matches, strings.TrimSpace(string(out))), nil
+		}
+	}
+
+	return "", nil
+}
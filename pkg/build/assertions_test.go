@@ -0,0 +1,120 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostRunner runs the commands of the tests on the host, in the
+// workspace.
+type hostRunner struct{}
+
+func (hostRunner) Name() string { return "test-host" }
+
+func (hostRunner) Command(ctx *Context, args ...string) (*exec.Cmd, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = ctx.WorkspaceDir
+	return cmd, nil
+}
+
+func init() {
+	RegisterRunner(hostRunner{})
+}
+
+func TestAssertions(t *testing.T) {
+	workspaceDir := t.TempDir()
+	compileTestProgram(t, workspaceDir)
+
+	cfg := &Configuration{Package: Package{Name: "foo", Version: "1.0"}}
+	pctx := &PipelineContext{
+		Context: &Context{WorkspaceDir: workspaceDir, Runner: "test-host", Configuration: *cfg},
+		Package: &cfg.Package,
+	}
+
+	f, err := openELF(filepath.Join(workspaceDir, "melange-out", "foo", "usr", "bin", "foo"))
+	if err != nil || f == nil {
+		t.Fatalf("openELF() = %v, %v", f, err)
+	}
+	needed, err := f.ImportedLibraries()
+	f.Close()
+	if err != nil || len(needed) == 0 {
+		t.Skipf("the test program links against no libraries: %v", err)
+	}
+
+	passing := &Assertions{
+		Files:    []string{"usr/bin/foo", "usr/bin/*"},
+		Links:    []LinkAssertion{{File: "usr/bin/foo", Libraries: needed}},
+		Commands: []CommandAssertion{{Run: "echo foo 1.0", Matches: `^foo 1\.0`}},
+	}
+	if err := (&Pipeline{Assertions: passing}).Run(pctx); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := &Assertions{
+		Files:    []string{"usr/bin/bar"},
+		Links:    []LinkAssertion{{File: "usr/bin/foo", Libraries: []string{"libssl.so.3"}}},
+		Commands: []CommandAssertion{{Run: "echo foo 2.0", Matches: `^foo 1\.0`}, {Run: "false"}},
+	}
+	err = (&Pipeline{Assertions: failing}).Run(pctx)
+	if err == nil {
+		t.Fatal("failed assertions did not fail the step")
+	}
+	for _, want := range []string{
+		"no file matches usr/bin/bar",
+		"usr/bin/foo does not link against libssl.so.3",
+		`output of command "echo foo 2.0" does not match`,
+		`command "false" failed`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+
+	// the package defaults to the subpackage of the pipeline.
+	if err := os.MkdirAll(filepath.Join(workspaceDir, "melange-out", "foo-doc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pctx.Subpackage = &Subpackage{Name: "foo-doc"}
+	if err := (&Pipeline{Assertions: &Assertions{Files: []string{"usr/bin/foo"}}}).Run(pctx); err == nil {
+		t.Error("the assertions checked the package instead of the subpackage")
+	}
+	if err := (&Pipeline{Assertions: &Assertions{Package: "foo", Files: []string{"usr/bin/foo"}}}).Run(pctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateAssertions(t *testing.T) {
+	for _, tt := range []struct {
+		assertions *Assertions
+		wantErr    bool
+	}{
+		{&Assertions{Files: []string{"usr/bin/*"}}, false},
+		{&Assertions{Files: []string{"usr/bin/["}}, true},
+		{&Assertions{Links: []LinkAssertion{{File: "usr/bin/foo"}}}, true},
+		{&Assertions{Links: []LinkAssertion{{Libraries: []string{"libc.so.6"}}}}, true},
+		{&Assertions{Commands: []CommandAssertion{{Run: "foo --version", Matches: "("}}}, true},
+		{&Assertions{Commands: []CommandAssertion{{Matches: "foo"}}}, true},
+	} {
+		pipelines := []Pipeline{{Pipeline: []Pipeline{{Assertions: tt.assertions}}}}
+		if err := validateAssertions(pipelines); (err != nil) != tt.wantErr {
+			t.Errorf("validateAssertions(%+v) = %v, wantErr %v", tt.assertions, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Credential authenticates requests to a repository host, either with a
+// username and password, or with a bearer token.
+type Credential struct {
+	Host     string
+	Username string
+	Password string
+	Token    string
+}
+
+// parseNetrc reads the credentials of a netrc file.  Only the machine,
+// login and password tokens are supported.
+func parseNetrc(path string) ([]Credential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open netrc file: %w", err)
+	}
+	defer f.Close()
+
+	creds := []Credential{}
+	var cred *Credential
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "machine":
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("%s: machine without a name", path)
+			}
+
+			creds = append(creds, Credential{Host: scanner.Text()})
+			cred = &creds[len(creds)-1]
+		case "login", "password":
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("%s: %s without a value", path, token)
+			}
+
+			if cred == nil {
+				continue
+			}
+
+			if token == "login" {
+				cred.Username = scanner.Text()
+			} else {
+				cred.Password = scanner.Text()
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read netrc file: %w", err)
+	}
+
+	return creds, nil
+}
+
+// parseHTTPAuth parses credentials in the format of the HTTP_AUTH
+// environment variable: a comma-separated list of basic:HOST:USER:PASSWORD
+// and bearer:HOST:TOKEN entries.
+func parseHTTPAuth(value string) ([]Credential, error) {
+	creds := []Credential{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 4)
+		switch {
+		case parts[0] == "basic" && len(parts) == 4:
+			creds = append(creds, Credential{Host: parts[1], Username: parts[2], Password: parts[3]})
+		case parts[0] == "bearer" && len(parts) == 3:
+			creds = append(creds, Credential{Host: parts[1], Token: parts[2]})
+		default:
+			return nil, fmt.Errorf("malformed HTTP_AUTH entry for %s, expected basic:HOST:USER:PASSWORD or bearer:HOST:TOKEN", parts[0])
+		}
+	}
+
+	return creds, nil
+}
+
+// secrets returns the strings which must not appear in logs.
+func (cred *Credential) secrets() []string {
+	secrets := []string{}
+	for _, s := range []string{cred.Password, cred.Token} {
+		if s == "" {
+			continue
+		}
+
+		secrets = append(secrets, s)
+
+		// secrets are escaped when embedded in repository URLs.
+		escaped := strings.TrimPrefix(url.UserPassword("", s).String(), ":")
+		if escaped != s {
+			secrets = append(secrets, escaped)
+		}
+	}
+	return secrets
+}
+
+var (
+	redactedSecretsMu sync.Mutex
+	// redactedSecrets holds the secrets of every credential loaded by
+	// melange, which are masked by the writers of NewRedactingWriter.
+	redactedSecrets = []string{}
+)
+
+// authTransport adds the credentials of the request host to requests.
+type authTransport struct {
+	base        http.RoundTripper
+	credentials map[string]Credential
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cred, ok := t.credentials[req.URL.Hostname()]
+	if ok && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		if cred.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+cred.Token)
+		} else {
+			req.SetBasicAuth(cred.Username, cred.Password)
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// redactingWriter masks the secrets of the loaded credentials.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer which masks the secrets of the
+// repository credentials loaded by melange before writing to w.  It is
+// meant to wrap the log output, which includes the output of apko and apk.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w}
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	redactedSecretsMu.Lock()
+	s := string(p)
+	for _, secret := range redactedSecrets {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	redactedSecretsMu.Unlock()
+
+	if _, err := rw.w.Write([]byte(s)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// configureAuth loads the repository credentials from the netrc file and
+// the HTTP_AUTH environment variable.  They are added to the requests made
+// by melange, and their secrets are registered for redaction.
+func (ctx *Context) configureAuth() error {
+	creds := []Credential{}
+
+	if ctx.NetrcFile != "" {
+		netrc, err := parseNetrc(ctx.NetrcFile)
+		if err != nil {
+			return err
+		}
+		creds = append(creds, netrc...)
+	}
+
+	if value, ok := os.LookupEnv("HTTP_AUTH"); ok {
+		env, err := parseHTTPAuth(value)
+		if err != nil {
+			return err
+		}
+		creds = append(creds, env...)
+	}
+
+	if len(creds) == 0 {
+		return nil
+	}
+
+	ctx.credentials = map[string]Credential{}
+
+	redactedSecretsMu.Lock()
+	for _, cred := range creds {
+		ctx.credentials[cred.Host] = cred
+		redactedSecrets = append(redactedSecrets, cred.secrets()...)
+	}
+	redactedSecretsMu.Unlock()
+
+	ctx.httpClient = &http.Client{
+		Transport: &authTransport{base: ctx.baseTransport(), credentials: ctx.credentials},
+	}
+
+	return nil
+}
+
+// client returns the HTTP client used for the requests of melange.
+func (ctx *Context) client() *http.Client {
+	if ctx.httpClient == nil {
+		return http.DefaultClient
+	}
+
+	return ctx.httpClient
+}
+
+// hasBearerRepositories reports whether a repository of the environment
+// needs a bearer token, which apk does not support.
+func (ctx *Context) hasBearerRepositories() bool {
+	for _, repo := range ctx.Configuration.Environment.Contents.Repositories {
+		if fields := strings.Fields(repo); len(fields) == 2 {
+			repo = fields[1]
+		}
+
+		u, err := url.Parse(repo)
+		if err != nil {
+			continue
+		}
+
+		if cred, ok := ctx.credentials[u.Hostname()]; ok && cred.Token != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticatedRepositories returns the repositories of the environment,
+// with the credentials for their host embedded, as apk only supports
+// basic authentication through the repository URL.  Bearer tokens cannot
+// be passed to apk, so those repositories must be fetched through the
+// repository mirror instead.
+func (ctx *Context) authenticatedRepositories() ([]string, error) {
+	repos := []string{}
+	for _, repo := range ctx.Configuration.Environment.Contents.Repositories {
+		tag := ""
+		if strings.HasPrefix(repo, "@") {
+			if fields := strings.Fields(repo); len(fields) == 2 {
+				tag, repo = fields[0]+" ", fields[1]
+			}
+		}
+
+		u, err := url.Parse(repo)
+		if err != nil || u.Host == "" {
+			repos = append(repos, tag+repo)
+			continue
+		}
+
+		cred, ok := ctx.credentials[u.Hostname()]
+		if !ok {
+			repos = append(repos, tag+repo)
+			continue
+		}
+
+		if cred.Token != "" {
+			return nil, fmt.Errorf("%s has a bearer token, but apk only supports basic authentication for package repositories", u.Hostname())
+		}
+
+		u.User = url.UserPassword(cred.Username, cred.Password)
+		repos = append(repos, tag+u.String())
+	}
+
+	return repos, nil
+}
+
+// removeGuestCredentials rewrites the repositories of the build
+// environment without credentials, so that the build pipelines cannot
+// read them.
+func (ctx *Context) removeGuestCredentials(guestDir string) error {
+	data := strings.Join(ctx.Configuration.Environment.Contents.Repositories, "\n") + "\n"
+
+	path := filepath.Join(guestDir, "etc", "apk", "repositories")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		return fmt.Errorf("unable to write apk repositories: %w", err)
+	}
+
+	return nil
+}
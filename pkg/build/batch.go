@@ -0,0 +1,596 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Batch builds several configurations in one invocation.  Builds are
+// scheduled so that a configuration which needs a package produced by
+// another configuration in the batch is built after it.  Among the
+// builds which are ready to run, those with a higher build priority
+// are started first, so that long builds do not hold up the batch.
+//
+// The output directory is indexed after every build, and added in front
+// of the repositories of the later builds, so that they are built
+// against the packages of the batch.  apk only trusts signed indexes,
+// so this requires a local signing key.  The ordering is also what lets
+// a batch skip the dependents of a failed build, instead of building
+// them against an outdated dependency.
+type Batch struct {
+	ConfigFiles []string
+	Contexts    []*Context
+	KeepGoing   bool
+	Jobs        int
+	Results     []BatchResult
+
+	buildOptions []Option
+	progress     *progress
+	history      *BuildHistory
+	fetchCache   *fetchCache
+	// deps maps the index of a context to the indexes of the
+	// contexts which build its build-time dependencies.
+	deps map[int][]int
+}
+
+// BatchResult is the outcome of building one configuration of a batch.
+type BatchResult struct {
+	ConfigFile string
+	Package    string
+	Err        error
+	// SkippedBecause names the package whose failure caused this
+	// build to be skipped, if it was skipped.
+	SkippedBecause string
+}
+
+type BatchOption func(*Batch) error
+
+// NewBatch creates a batch building each of the given configuration files.
+//
+// Every build in the batch uses its own workspace, a subdirectory of the
+// workspace directory named after the package it builds.  Pipelines
+// fetch sources into and write outputs below the workspace, so builds
+// sharing it, especially concurrent ones, would see each other's files.
+// Configurations which expect files to already be in the workspace
+// must provide them in that subdirectory, or be built on their own.
+func NewBatch(configFiles []string, opts ...BatchOption) (*Batch, error) {
+	b := Batch{
+		ConfigFiles: configFiles,
+	}
+
+	for _, opt := range opts {
+		if err := opt(&b); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, configFile := range configFiles {
+		buildOpts := append([]Option{}, b.buildOptions...)
+		buildOpts = append(buildOpts, WithConfig(configFile))
+
+		ctx, err := New(buildOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up build for %s: %w", configFile, err)
+		}
+
+		ctx.WorkspaceDir = filepath.Join(ctx.WorkspaceDir, ctx.Configuration.Package.Name)
+		b.Contexts = append(b.Contexts, ctx)
+	}
+
+	// builds with the same environment fetch the same packages, so
+	// the fetches are shared by the whole batch.
+	b.fetchCache = newFetchCache(defaultFetchCacheSize)
+	if len(b.Contexts) > 0 {
+		// the builds share their options, and so their proxy and
+		// CA settings.
+		transport := newBatchTransport(b.Contexts[0].baseTransport())
+		for _, ctx := range b.Contexts {
+			ctx.shareFetches(b.fetchCache, transport)
+		}
+	}
+
+	b.history = &BuildHistory{Packages: map[string][]float64{}}
+	if len(b.Contexts) > 0 && b.Contexts[0].CacheDir != "" {
+		history, err := LoadBuildHistory(b.Contexts[0].CacheDir)
+		if err != nil {
+			log.Printf("warning: build time estimates are unavailable: %v", err)
+		} else {
+			b.history = history
+		}
+	}
+
+	if err := b.checkArtifacts(); err != nil {
+		return nil, err
+	}
+
+	b.deps = b.dependencies()
+	if err := b.checkCycles(); err != nil {
+		return nil, fmt.Errorf("unable to schedule builds: %w", err)
+	}
+
+	return &b, nil
+}
+
+// WithBuildOptions sets the options used to create the build context
+// of every configuration in the batch.
+func WithBuildOptions(opts ...Option) BatchOption {
+	return func(b *Batch) error {
+		b.buildOptions = append(b.buildOptions, opts...)
+		return nil
+	}
+}
+
+// WithKeepGoing sets whether the batch continues building packages which
+// do not depend on a failed build, rather than stopping at the first
+// failure.
+func WithKeepGoing(keepGoing bool) BatchOption {
+	return func(b *Batch) error {
+		b.KeepGoing = keepGoing
+		return nil
+	}
+}
+
+// WithJobs sets how many builds of the batch may run at the same time.
+func WithJobs(jobs int) BatchOption {
+	return func(b *Batch) error {
+		b.Jobs = jobs
+		return nil
+	}
+}
+
+// packageName strips any version constraint from an apk world entry.
+func packageName(entry string) string {
+	if i := strings.IndexAny(entry, "<>=~"); i != -1 {
+		return entry[:i]
+	}
+	return entry
+}
+
+func (b *Batch) dependencies() map[int][]int {
+	providers := map[string]int{}
+	for i, ctx := range b.Contexts {
+		providers[ctx.Configuration.Package.Name] = i
+		for _, sp := range ctx.Configuration.Subpackages {
+			providers[sp.Name] = i
+		}
+	}
+
+	exporters := map[string]int{}
+	for i, ctx := range b.Contexts {
+		for _, e := range ctx.Configuration.Artifacts.Exports {
+			exporters[e.Name] = i
+		}
+	}
+
+	deps := map[int][]int{}
+	for i, ctx := range b.Contexts {
+		for _, entry := range ctx.Configuration.Environment.Contents.Packages {
+			if j, ok := providers[packageName(entry)]; ok && j != i {
+				deps[i] = append(deps[i], j)
+			}
+		}
+		// the builds importing an artifact are built after the
+		// build exporting it.
+		for _, imp := range ctx.Configuration.Artifacts.Imports {
+			if j, ok := exporters[imp.Name]; ok && j != i {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+
+	return deps
+}
+
+// checkArtifacts checks that every artifact imported by a build of the
+// batch is exported by exactly one other build.
+func (b *Batch) checkArtifacts() error {
+	exporters := map[string]string{}
+	for i, ctx := range b.Contexts {
+		for _, e := range ctx.Configuration.Artifacts.Exports {
+			if other, ok := exporters[e.Name]; ok {
+				return fmt.Errorf("artifact %s is exported by both %s and %s", e.Name, other, b.ConfigFiles[i])
+			}
+			exporters[e.Name] = b.ConfigFiles[i]
+		}
+	}
+
+	for i, ctx := range b.Contexts {
+		for _, imp := range ctx.Configuration.Artifacts.Imports {
+			if _, ok := exporters[imp.Name]; !ok {
+				return fmt.Errorf("artifact %s imported by %s is not exported by a build of the batch", imp.Name, b.ConfigFiles[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportsArtifacts reports whether a build of the batch exports
+// artifacts.
+func (b *Batch) exportsArtifacts() bool {
+	for _, ctx := range b.Contexts {
+		if len(ctx.Configuration.Artifacts.Exports) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCycles returns an error if the builds of the batch depend on each
+// other in a cycle, in which case they could never be scheduled.
+func (b *Batch) checkCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(b.Contexts))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle involving %s", b.ConfigFiles[i])
+		}
+
+		state[i] = visiting
+		for _, j := range b.deps[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+
+		return nil
+	}
+
+	for i := range b.Contexts {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expected returns how long a build is expected to take, based on the
+// build history.
+func (b *Batch) expected(i int) (time.Duration, bool) {
+	return b.history.Expected(b.Contexts[i].Configuration.Package.Name)
+}
+
+// before is used to decide which of two builds that are ready to run is
+// started first: the one with the higher build priority or, for equal
+// priorities, the one which is expected to take longer.
+func (b *Batch) before(i, j int) bool {
+	pi := b.Contexts[i].Configuration.Package.BuildPriority
+	pj := b.Contexts[j].Configuration.Package.BuildPriority
+	if pi != pj {
+		return pi > pj
+	}
+
+	di, _ := b.expected(i)
+	dj, _ := b.expected(j)
+	if di != dj {
+		return di > dj
+	}
+
+	return i < j
+}
+
+// estimate returns the expected remaining time of the batch, given the
+// builds which have not finished yet and when the running ones started.
+// Builds without history are assumed to take the average of those with.
+func (b *Batch) estimate(pending map[int]bool, started map[int]time.Time, jobs int) time.Duration {
+	var known, total time.Duration
+	count := 0
+	for i := range b.Contexts {
+		if d, ok := b.expected(i); ok {
+			known += d
+			count++
+		}
+	}
+
+	average := time.Duration(0)
+	if count > 0 {
+		average = known / time.Duration(count)
+	}
+
+	remaining := func(i int) time.Duration {
+		d, ok := b.expected(i)
+		if !ok {
+			d = average
+		}
+		return d
+	}
+
+	for i := range pending {
+		total += remaining(i)
+	}
+
+	for i, t := range started {
+		if d := remaining(i) - time.Since(t); d > 0 {
+			total += d
+		}
+	}
+
+	return total / time.Duration(jobs)
+}
+
+// readyBuilds returns the pending builds whose dependencies have all been
+// built, in the order they should be started.
+func (b *Batch) readyBuilds(pending map[int]bool, built map[int]bool) []int {
+	ready := []int{}
+	for i := range pending {
+		isReady := true
+		for _, j := range b.deps[i] {
+			if !built[j] {
+				isReady = false
+				break
+			}
+		}
+
+		if isReady {
+			ready = append(ready, i)
+		}
+	}
+
+	sort.Slice(ready, func(x, y int) bool {
+		return b.before(ready[x], ready[y])
+	})
+
+	return ready
+}
+
+// skipDependents skips the pending builds which depend on a broken
+// build, directly or through other skipped builds, and records them as
+// broken by the same package.
+func (b *Batch) skipDependents(pending map[int]bool, broken map[int]string) {
+	for skipped := true; skipped; {
+		skipped = false
+		for i := range pending {
+			for _, j := range b.deps[i] {
+				cause, ok := broken[j]
+				if !ok {
+					continue
+				}
+
+				pkg := b.Contexts[i].Configuration.Package.Name
+				log.Printf("skipping %s, as %s failed to build", pkg, cause)
+				b.Results = append(b.Results, BatchResult{
+					ConfigFile:     b.ConfigFiles[i],
+					Package:        pkg,
+					SkippedBecause: cause,
+				})
+
+				broken[i] = cause
+				delete(pending, i)
+				b.setState(i, stateSkipped)
+				skipped = true
+				break
+			}
+		}
+	}
+}
+
+// Run builds every configuration of the batch, running up to Jobs builds
+// at the same time.
+func (b *Batch) Run() error {
+	type finished struct {
+		index int
+		err   error
+	}
+
+	jobs := b.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	pending := map[int]bool{}
+	for i := range b.Contexts {
+		pending[i] = true
+	}
+
+	built := map[int]bool{}
+	// broken records, for each context which failed or was skipped,
+	// the name of the package which failed.
+	broken := map[int]string{}
+	var firstErr error
+
+	started := map[int]time.Time{}
+	done := make(chan finished)
+
+	if b.progress != nil {
+		names := []string{}
+		for _, ctx := range b.Contexts {
+			names = append(names, ctx.Configuration.Package.Name)
+		}
+
+		b.progress.start(names)
+		defer b.progress.finish()
+	}
+
+	if b.exportsArtifacts() {
+		store, err := newArtifactStore()
+		if err != nil {
+			return err
+		}
+		defer store.remove()
+
+		for _, ctx := range b.Contexts {
+			ctx.artifactStore = store
+		}
+	}
+
+	repo, err := b.outputRepository()
+	if err != nil {
+		return err
+	}
+	if repo != nil {
+		defer repo.remove()
+
+		for _, ctx := range b.Contexts {
+			ctx.outputRepository = repo
+		}
+	}
+
+	if eta := b.estimate(pending, started, jobs); eta > 0 {
+		log.Printf("building %d packages, estimated to take %s", len(pending), eta.Round(time.Second))
+	}
+	for {
+		b.skipDependents(pending, broken)
+
+		if firstErr == nil || b.KeepGoing {
+			for _, i := range b.readyBuilds(pending, built) {
+				if len(started) >= jobs {
+					break
+				}
+
+				delete(pending, i)
+				started[i] = time.Now()
+				b.setState(i, stateBuilding)
+
+				ctx := b.Contexts[i]
+				log.Printf("building %s (%s)", ctx.Configuration.Package.Name, b.ConfigFiles[i])
+
+				go func(i int) {
+					done <- finished{index: i, err: b.Contexts[i].BuildPackage()}
+				}(i)
+			}
+		}
+
+		if len(started) == 0 {
+			break
+		}
+
+		f := <-done
+		delete(started, f.index)
+
+		pkg := b.Contexts[f.index].Configuration.Package.Name
+		b.Results = append(b.Results, BatchResult{
+			ConfigFile: b.ConfigFiles[f.index],
+			Package:    pkg,
+			Err:        f.err,
+		})
+
+		if f.err != nil {
+			b.setState(f.index, stateFailed)
+			log.Printf("failed to build %s: %v", pkg, f.err)
+			broken[f.index] = pkg
+			if firstErr == nil {
+				firstErr = fmt.Errorf("unable to build %s: %w", pkg, f.err)
+			}
+			continue
+		}
+
+		built[f.index] = true
+		b.setState(f.index, stateBuilt)
+
+		if repo != nil {
+			if err := repo.update(); err != nil {
+				log.Printf("warning: unable to index the output directory after building %s: %v", pkg, err)
+			}
+		}
+
+		if eta := b.estimate(pending, started, jobs); eta > 0 {
+			log.Printf("%d packages left to build, estimated to take %s", len(pending)+len(started), eta.Round(time.Second))
+		}
+	}
+
+	if b.fetchCache != nil {
+		if hits, misses, size := b.fetchCache.stats(); hits > 0 {
+			log.Printf("served %d of %d repository fetches from the batch cache (%d MiB cached)", hits, hits+misses, size>>20)
+		}
+	}
+
+	if !b.KeepGoing {
+		return firstErr
+	}
+
+	b.Summarize()
+
+	if len(broken) > 0 {
+		return fmt.Errorf("%d of %d packages were not built", len(broken), len(b.Contexts))
+	}
+
+	return nil
+}
+
+// outputRepository returns the repository of the output directory, which
+// later builds install the packages of earlier ones from, or nil if no
+// build of the batch depends on another.
+func (b *Batch) outputRepository() (*outputRepository, error) {
+	if len(b.deps) == 0 {
+		return nil, nil
+	}
+
+	// the builds of a batch share their options, and so their
+	// output directory and signing key.
+	ctx := b.Contexts[0]
+	if ctx.SigningKey == "" {
+		log.Printf("warning: the packages of the batch are not installed by its later builds, as the output directory index cannot be signed without a signing key")
+		return nil, nil
+	}
+
+	signer, err := ctx.packageSigner()
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := filepath.Abs(ctx.SigningKey + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up output repository: %w", err)
+	}
+
+	repo, err := newOutputRepository(ctx.OutDir, signer, keyring)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.update(); err != nil {
+		repo.remove()
+		return nil, fmt.Errorf("unable to index the output directory: %w", err)
+	}
+
+	return repo, nil
+}
+
+// setState updates the progress view, if it is shown.
+func (b *Batch) setState(i int, state buildState) {
+	if b.progress != nil {
+		b.progress.set(i, state)
+	}
+}
+
+func (b *Batch) Summarize() {
+	log.Printf("batch summary:")
+	for _, result := range b.Results {
+		switch {
+		case result.SkippedBecause != "":
+			log.Printf("  %s: skipped (depends on %s)", result.Package, result.SkippedBecause)
+		case result.Err != nil:
+			log.Printf("  %s: failed: %v", result.Package, result.Err)
+		default:
+			log.Printf("  %s: built", result.Package)
+		}
+	}
+}
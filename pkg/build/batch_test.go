@@ -0,0 +1,185 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testBatch returns a batch of builds of the given packages, keyed by
+// name, each with the packages of its build environment.
+func testBatch(packages map[string][]string) *Batch {
+	names := []string{}
+	for name := range packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := &Batch{history: &BuildHistory{Packages: map[string][]float64{}}}
+	for _, name := range names {
+		ctx := &Context{}
+		ctx.Configuration.Package.Name = name
+		ctx.Configuration.Environment.Contents.Packages = packages[name]
+		b.ConfigFiles = append(b.ConfigFiles, name+".yaml")
+		b.Contexts = append(b.Contexts, ctx)
+	}
+	b.deps = b.dependencies()
+
+	return b
+}
+
+// index returns the index of the build of a package in the batch.
+func (b *Batch) index(t *testing.T, name string) int {
+	t.Helper()
+
+	for i, ctx := range b.Contexts {
+		if ctx.Configuration.Package.Name == name {
+			return i
+		}
+	}
+	t.Fatalf("no build of %s", name)
+	return -1
+}
+
+func TestBatchSkipDependents(t *testing.T) {
+	packages := map[string][]string{
+		"libfoo": {"busybox"},
+		"foo":    {"libfoo>=1.2"},
+		"foo-ui": {"foo", "gtk"},
+		"bar":    {"busybox"},
+		"baz":    {"bar", "foo-ui"},
+		"qux":    {"busybox"},
+	}
+
+	for _, tc := range []struct {
+		failed  string
+		skipped map[string]string
+	}{{
+		failed: "libfoo",
+		skipped: map[string]string{
+			"foo":    "libfoo",
+			"foo-ui": "libfoo",
+			"baz":    "libfoo",
+		},
+	}, {
+		failed: "bar",
+		skipped: map[string]string{
+			"baz": "bar",
+		},
+	}, {
+		failed:  "qux",
+		skipped: map[string]string{},
+	}} {
+		t.Run(tc.failed, func(t *testing.T) {
+			b := testBatch(packages)
+			failed := b.index(t, tc.failed)
+
+			pending := map[int]bool{}
+			for i := range b.Contexts {
+				if i != failed {
+					pending[i] = true
+				}
+			}
+			broken := map[int]string{failed: tc.failed}
+
+			b.skipDependents(pending, broken)
+
+			skipped := map[string]string{}
+			for _, r := range b.Results {
+				skipped[r.Package] = r.SkippedBecause
+			}
+			if !reflect.DeepEqual(skipped, tc.skipped) {
+				t.Errorf("skipped %v, want %v", skipped, tc.skipped)
+			}
+			if want := len(b.Contexts) - 1 - len(tc.skipped); len(pending) != want {
+				t.Errorf("%d builds pending, want %d", len(pending), want)
+			}
+			for name := range tc.skipped {
+				if i := b.index(t, name); pending[i] || broken[i] != tc.failed {
+					t.Errorf("%s is not recorded as broken by %s", name, tc.failed)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchBefore(t *testing.T) {
+	b := testBatch(map[string][]string{
+		"a": nil,
+		"b": nil,
+		"c": nil,
+		"d": nil,
+		"e": {"a"},
+	})
+	b.Contexts[b.index(t, "c")].Configuration.Package.BuildPriority = 10
+	b.Contexts[b.index(t, "d")].Configuration.Package.BuildPriority = -1
+	b.history.Record("a", 30*time.Second)
+	b.history.Record("b", 10*time.Minute)
+	b.history.Record("d", time.Hour)
+
+	for _, tc := range []struct {
+		first, second string
+		want          bool
+	}{
+		// a higher priority goes first, regardless of duration.
+		{"c", "b", true},
+		{"b", "c", false},
+		{"a", "d", true},
+		// for equal priorities, longer builds go first.
+		{"b", "a", true},
+		{"a", "b", false},
+		// builds with history are expected to take longer than
+		// those without.
+		{"a", "e", true},
+		// otherwise the order of the configurations is kept.
+		{"e", "e", false},
+	} {
+		if got := b.before(b.index(t, tc.first), b.index(t, tc.second)); got != tc.want {
+			t.Errorf("before(%s, %s) = %t, want %t", tc.first, tc.second, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		built []string
+		want  []string
+	}{{
+		want: []string{"c", "b", "a", "d"},
+	}, {
+		// e only depends on a, and a lower priority goes last.
+		built: []string{"a"},
+		want:  []string{"c", "b", "e", "d"},
+	}} {
+		pending := map[int]bool{}
+		for i := range b.Contexts {
+			pending[i] = true
+		}
+		built := map[int]bool{}
+		for _, name := range tc.built {
+			built[b.index(t, name)] = true
+			delete(pending, b.index(t, name))
+		}
+
+		got := []string{}
+		for _, i := range b.readyBuilds(pending, built) {
+			got = append(got, b.Contexts[i].Configuration.Package.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readyBuilds() with %q built = %q, want %q", tc.built, got, tc.want)
+		}
+	}
+}
@@ -15,16 +15,29 @@
 package build
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	apko_build "chainguard.dev/apko/pkg/build"
 	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/errcode"
+	"chainguard.dev/melange/pkg/sbom"
+	"chainguard.dev/melange/pkg/vex"
 	"gopkg.in/yaml.v3"
 )
 
@@ -33,15 +46,102 @@ type Package struct {
 	Version            string
 	Epoch              uint64
 	Description        string
+	URL                string
 	TargetArchitecture []string `yaml:"target-architecture"`
 	Copyright          []Copyright
 	Dependencies       Dependencies
+	// Deprecation marks the package and its subpackages as deprecated.
+	Deprecation *Deprecation `yaml:"deprecation"`
+	// BuildPriority orders the builds of a batch which are ready to run:
+	// builds with a higher priority are started first.
+	BuildPriority int `yaml:"build-priority"`
+	// SpecialFiles sets how the sockets, fifos and device nodes found
+	// in the output of the package and its subpackages are handled: they
+	// are an error by default, but they may be skipped, or kept except
+	// for sockets.
+	SpecialFiles string `yaml:"special-files"`
+	// PreserveXattrs stores the user and security extended attributes
+	// of the packaged files, such as file capabilities set by setcap or
+	// SELinux labels, for apk to restore them.
+	PreserveXattrs bool `yaml:"preserve-xattrs"`
+	// AutoSubpackages splits the shell completions and documentation
+	// of the package into -bash-completion, -zsh-completion and -doc
+	// subpackages, unless subpackages with those names are declared.
+	AutoSubpackages bool `yaml:"auto-subpackages"`
+	// Metapackage marks a package which only declares dependencies and
+	// provides.  It has no pipelines and no files, so it is built without
+	// a build environment.
+	Metapackage bool `yaml:"metapackage"`
+	// CompressDocs compresses the manual and info pages of the package
+	// and its subpackages with gzip.  It is enabled unless set to false.
+	CompressDocs *bool `yaml:"compress-docs"`
+	// PythonBytecompile byte-compiles the Python sources of the package
+	// and its subpackages with hash-based invalidation, so that the
+	// pycs are reproducible.  python3 must be in the build environment.
+	PythonBytecompile bool `yaml:"python-bytecompile"`
+	// Checks sets the level of the checks of the ELF files of the
+	// package and its subpackages, such as rpath or execstack: "error",
+	// "warn" or "off".  The checks which are not listed have their
+	// default level.
+	Checks map[string]string `yaml:"checks"`
+	// Sandbox sets the seccomp profile and capabilities of the build
+	// environment, which are recorded in the packages.
+	Sandbox Sandbox `yaml:"sandbox"`
+	// Faketime runs the pipelines with libfaketime preloaded, with
+	// the clock starting at this date, for date-sensitive test suites.
+	// It is a date such as 2022-01-01T00:00:00Z, or
+	// "source-date-epoch".  libfaketime must be in the build
+	// environment.
+	Faketime string `yaml:"faketime"`
+	// Locale and Timezone override the locale and timezone of the
+	// pipelines, which are C.UTF-8 and UTC unless melange is told
+	// otherwise, for tools whose output or tests depend on them.
+	Locale   string `yaml:"locale"`
+	Timezone string `yaml:"timezone"`
+	// PassEnv lists the variables of the host which are passed
+	// through to the pipelines, such as the tokens of private
+	// source hosts.  Their digests are recorded in the packages.
+	PassEnv []string `yaml:"pass-env"`
+	// SizeBudget is the expected size of the package, see SizeBudget.
+	SizeBudget *SizeBudget `yaml:"size-budget"`
+	// EnvironmentBudget is the expected size of the build
+	// environment, see EnvironmentBudget.
+	EnvironmentBudget *EnvironmentBudget `yaml:"environment-budget"`
+	// Supplier distributes the package, and Originator is its
+	// upstream author, as "Organization: <name>" or
+	// "Person: <name>".  They are recorded in the SBOMs, and the
+	// supplier defaults to the one of the settings file.
+	Supplier   string `yaml:"supplier"`
+	Originator string `yaml:"originator"`
+	// CPE lists the CPE 2.3 names of the package, which are recorded
+	// in the SBOMs for vulnerability scanners to match the package
+	// against the NVD.  A version of * is replaced by the one of the
+	// package.  When none are given, one is derived from the name of
+	// the package, see sbom.DeriveCPE.
+	CPE []string `yaml:"cpe"`
 }
 
+// shouldCompressDocs reports whether the manual and info pages of the
+// package are compressed.
+func (pkg *Package) shouldCompressDocs() bool {
+	return pkg.CompressDocs == nil || *pkg.CompressDocs
+}
+
+// The ways special files of the package output are handled.
+const (
+	SpecialFilesError = "error"
+	SpecialFilesSkip  = "skip"
+	SpecialFilesKeep  = "keep"
+)
+
 type Copyright struct {
 	Paths       []string
 	Attestation string
 	License     string
+	// LicensePath is the text of a custom license, LicenseRef-<id>,
+	// relative to the directory of the configuration file.  It is
+	// installed in the packages and recorded in their SBOMs.
+	LicensePath string `yaml:"license-path"`
 }
 
 type Pipeline struct {
@@ -50,11 +150,40 @@ type Pipeline struct {
 	With     map[string]string
 	Runs     string
 	Pipeline []Pipeline
+	Build    *NestedBuild
+	// Assertions check the output directory of a package, see
+	// Assertions.
+	Assertions *Assertions
 }
 
 type Subpackage struct {
-	Name     string
+	Name string
+	// Range is the data list the subpackage is generated for: there
+	// is a subpackage for every item of the list, in which
+	// ${{range.<field>}} is replaced by the fields of the item.
+	Range string `yaml:"range"`
+	// If skips the subpackage when false, see evalCondition.  It is
+	// evaluated for every item of the range.
+	If       string `yaml:"if"`
 	Pipeline []Pipeline
+	// Description, URL and Copyright default to the ones of the
+	// origin package when they are not set, and so do the runtime
+	// dependencies when the subpackage declares none.  The provides
+	// and conflicts of the origin package are not inherited.
+	Description  string
+	URL          string
+	Copyright    []Copyright
+	Dependencies Dependencies
+	// Deprecation marks the subpackage as deprecated, by default if
+	// the origin package is.
+	Deprecation *Deprecation `yaml:"deprecation"`
+	// SizeBudget is the expected size of the subpackage, see
+	// SizeBudget.  The budget of the origin package does not apply to
+	// its subpackages.
+	SizeBudget *SizeBudget `yaml:"size-budget"`
+	// CPE lists the CPE 2.3 names of the subpackage, by default the
+	// ones of the origin package.
+	CPE []string `yaml:"cpe"`
 }
 
 type Configuration struct {
@@ -62,29 +191,184 @@ type Configuration struct {
 	Environment apko_types.ImageConfiguration
 	Pipeline    []Pipeline
 	Subpackages []Subpackage
+	// RepositoryPins maps the location of the APKINDEX of a repository
+	// of the environment to its expected digest.
+	RepositoryPins map[string]string `yaml:"repository-pins"`
+	// Vars are substituted for ${{vars.<name>}} in the pipelines.
+	Vars map[string]string `yaml:"vars"`
+	// Annotations are recorded in the .PKGINFO of the packages, as
+	// comments.
+	Annotations map[string]string `yaml:"annotations"`
+	// Advisories state how vulnerabilities, such as the ones of
+	// bundled components, affect the packages.  They are written as
+	// OpenVEX documents next to the SBOMs, with the author and role of
+	// VEX.
+	Advisories vex.Advisories `yaml:"advisories"`
+	VEX        vex.Config     `yaml:"vex"`
+	// Artifacts are passed to and from the other builds of a batch.
+	Artifacts Artifacts `yaml:"artifacts"`
+	// Data are the lists which subpackages range over.
+	Data []DataList `yaml:"data"`
+	// Test is run by melange test --image, see Test.
+	Test *Test `yaml:"test"`
 }
 
 type Context struct {
-	Configuration     Configuration
-	ConfigFile        string
-	SourceDateEpoch   time.Time
-	WorkspaceDir      string
-	PipelineDir       string
-	GuestDir          string
-	SigningKey        string
-	SigningPassphrase string
-	UseProot          bool
+	Configuration        Configuration
+	ConfigFile           string
+	ConfigDigest         string
+	SettingsFile         string
+	SettingsDigest       string
+	Git                  *GitMetadata
+	SourceDateEpoch      time.Time
+	WorkspaceDir         string
+	PipelineDir          string
+	OverlayPipelineDirs  []string
+	OutDir               string
+	OutputLayout         string
+	CacheDir             string
+	RemoteCache          string
+	RemoteCacheMode      string
+	GoCacheSize          int64
+	JavaCacheSize        int64
+	StepCacheSize        int64
+	MavenRepository      string
+	RepositoryPinsFile   string
+	RepositorySnapshot   string
+	SnapshotDir          string
+	HTTPProxy            string
+	HTTPSProxy           string
+	NoProxy              string
+	CACertFile           string
+	NetrcFile            string
+	GuestDir             string
+	SigningKey           string
+	SigningPassphrase    string
+	SigningServer        string
+	SigningClientCert    string
+	SigningClientKey     string
+	SigningServerCA      string
+	SigningKMS           string
+	TimestampURL         string
+	UseProot             bool
+	Runner               string
+	SBOMGenerators       []string
+	SBOMFormats          []string
+	SBOMChecksums        []string
+	SBOMAttestation      bool
+	SBOMCheckNTIA        bool
+	SBOMStrict           bool
+	SBOMSkipSymlinks     bool
+	SBOMBuildEnvironment bool
+	DependencyTrackURL   string
+	ChecksumManifest     bool
+	ApkoFragment         bool
+	Digests              []string
+	EpochFromGit         bool
+	Force                bool
+	PublishedRepository  string
+	Locale               string
+	Timezone             string
+	PassEnv              []string
+	ReadOnlyRoot         bool
+
+	// nestingDepth is the number of parent builds which
+	// this build was started from.
+	nestingDepth int
+	// credentials maps repository hosts to the credentials used
+	// for them.
+	credentials map[string]Credential
+	// httpClient authenticates the requests made by melange.
+	httpClient *http.Client
+	// transport applies the proxy and CA settings to the requests
+	// made by melange, see configureNetwork.
+	transport *http.Transport
+	// mirror serves the verified repository indexes to apk, when
+	// the repositories are pinned or resolved from a snapshot, or
+	// the build is part of a batch.
+	mirror *repositoryMirror
+	// fetchCache is shared by the builds of a batch, see
+	// shareFetches.
+	fetchCache *fetchCache
+	// signer signs the packages, see packageSigner.
+	signer sign.Signer
+	// dependencyTrackAPIKey authenticates the uploads of the SBOMs
+	// to DependencyTrackURL.
+	dependencyTrackAPIKey string
+	// artifacts are the files written to OutDir, relative to it,
+	// see WriteChecksumManifest.
+	artifacts []string
+	// emittedPackages are the packages written to OutDir, see
+	// writeApkoFragment.
+	emittedPackages []emittedPackage
+	// artifactStore keeps the artifacts exported by the builds of
+	// the batch of the build, if any.
+	artifactStore *artifactStore
+	// outputRepository serves the packages built earlier in the
+	// batch of the build, if any, see Batch.Run.
+	outputRepository *outputRepository
+	// importedArtifacts and exportedArtifacts are the artifacts
+	// passed to and from the build, as "<name> <digest>".
+	importedArtifacts []string
+	exportedArtifacts []string
+	// resolvedPipelines are the pipelines used by the build, as
+	// "<uses> sha256:<digest>", see recordPipeline.
+	resolvedPipelines []string
+	// fetchedSources are the sources fetched by the fetch
+	// pipelines, see fetchSource.
+	fetchedSources []fetchedSource
+	// goCache holds the caches of the Go toolchain of the build
+	// environment, see openGoCache.
+	goCache *goCache
+	// java holds the Maven and Gradle caches and offline repository of
+	// the build environment, see openJavaTools.
+	java *javaTools
+	// stepTracker attributes the packaged files to the pipeline
+	// steps which produced them.
+	stepTracker *stepTracker
+	// originSBOM references the SPDX SBOM of the package, which the
+	// SBOMs of its subpackages depend on.  It is set when the package
+	// is emitted, before its subpackages.
+	originSBOM *sbom.DocumentRef
+	// buildEnvironmentSBOM references the SPDX SBOM of the build
+	// environment, which the SBOMs of the packages reference when
+	// SBOMBuildEnvironment is set.
+	buildEnvironmentSBOM *sbom.DocumentRef
+	// environmentSize is the size of the build environment in bytes,
+	// see checkEnvironmentSize.
+	environmentSize int64
+	// environmentDigest is the digest of the database of the packages
+	// installed in the build environment, see digestEnvironment.
+	environmentDigest string
+	// settings are the settings of the repository of the
+	// configuration file, see configureSettings.
+	settings *Settings
 }
 
 type Dependencies struct {
-	Runtime []string
+	Runtime  []string
+	Provides []string
+	// Conflicts are the packages which cannot be installed along with
+	// this one, e.g. another mail transfer agent.  They are emitted as
+	// "!" dependencies.
+	Conflicts []string
+	// ProviderPriority is used by apk to choose between the packages
+	// which provide the same name.
+	ProviderPriority int `yaml:"provider-priority"`
 }
 
 func New(opts ...Option) (*Context, error) {
 	ctx := Context{
-		ConfigFile:   ".melange.yaml",
-		WorkspaceDir: ".",
-		PipelineDir:  "/usr/share/melange/pipelines",
+		ConfigFile:      ".melange.yaml",
+		WorkspaceDir:    ".",
+		PipelineDir:     "/usr/share/melange/pipelines",
+		OutDir:          ".",
+		Runner:          defaultRunner,
+		Locale:          defaultLocale,
+		Timezone:        defaultTimezone,
+		GoCacheSize:     defaultGoCacheSize,
+		JavaCacheSize:   defaultJavaCacheSize,
+		RemoteCacheMode: RemoteCacheReadOnly,
 	}
 
 	for _, opt := range opts {
@@ -93,9 +377,100 @@ func New(opts ...Option) (*Context, error) {
 		}
 	}
 
+	if _, err := lookupRunner(ctx.Runner); err != nil {
+		return nil, errcode.Wrap(errcode.RunnerUnknown, err, "runner", ctx.Runner)
+	}
+
+	for _, name := range ctx.SBOMGenerators {
+		if _, err := lookupSBOMGenerator(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sbom.NewGenerator().ValidateFormats(ctx.SBOMFormats); err != nil {
+		return nil, err
+	}
+
+	if ctx.RemoteCache != "" {
+		if err := validateRemoteCache(ctx.RemoteCache, ctx.RemoteCacheMode); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sbom.ValidateChecksumAlgorithms(ctx.SBOMChecksums); err != nil {
+		return nil, err
+	}
+
+	if ctx.DependencyTrackURL != "" && !ctx.usesMelangeSBOMGenerator() {
+		return nil, errors.New("uploading SBOMs to Dependency-Track requires the melange SBOM generator")
+	}
+
+	if err := ctx.configureSettings(); err != nil {
+		return nil, errcode.Wrap(errcode.SettingsInvalid, err, "settings", ctx.SettingsFile)
+	}
+
+	if ctx.SigningKey != "" && ctx.SigningServer != "" {
+		return nil, errcode.Wrap(errcode.SigningOptions, errors.New("a signing key and a signing server cannot be used together"), "signing key", ctx.SigningKey, "signing server", ctx.SigningServer)
+	}
+	if ctx.SigningKMS != "" && (ctx.SigningKey != "" || ctx.SigningServer != "") {
+		return nil, errcode.Wrap(errcode.SigningOptions, errors.New("a KMS key cannot be used together with a signing key or server"), "signing kms", ctx.SigningKMS)
+	}
+
+	if ctx.SBOMAttestation {
+		if !ctx.signs() {
+			return nil, errors.New("attesting the SBOMs requires a signing key or server")
+		}
+		if !ctx.usesMelangeSBOMGenerator() {
+			return nil, errors.New("attesting the SBOMs requires the melange SBOM generator")
+		}
+	}
+
+	if ctx.SBOMBuildEnvironment && !ctx.usesMelangeSBOMGenerator() {
+		return nil, errors.New("referencing the SBOM of the build environment requires the melange SBOM generator")
+	}
+
+	if ctx.TimestampURL != "" && !ctx.signs() {
+		return nil, errors.New("timestamping the signatures requires a signing key or server")
+	}
+
+	if ctx.ChecksumManifest && !ctx.signs() {
+		return nil, errors.New("signing the checksum manifest requires a signing key or server")
+	}
+
+	if err := ctx.configureNetwork(); err != nil {
+		return nil, fmt.Errorf("failed to configure network access: %w", err)
+	}
+
+	if err := ctx.configureAuth(); err != nil {
+		return nil, fmt.Errorf("failed to load repository credentials: %w", err)
+	}
+
 	if err := ctx.Configuration.Load(ctx.ConfigFile); err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
+	ctx.Configuration.applySettings(ctx.settings)
+
+	configData, err := os.ReadFile(ctx.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	ctx.ConfigDigest = fmt.Sprintf("sha256:%x", sha256.Sum256(configData))
+
+	if git, err := gitMetadata(ctx.ConfigFile); err == nil {
+		ctx.Git = git
+	} else {
+		log.Printf("not recording git metadata: %v", err)
+	}
+
+	if ctx.EpochFromGit {
+		t, err := gitCommitTime(ctx.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to derive source date epoch from git: %w", err)
+		}
+
+		log.Printf("using the commit date of %s as the source date epoch: %d", ctx.ConfigFile, t.Unix())
+		ctx.SourceDateEpoch = t
+	}
 
 	// SOURCE_DATE_EPOCH will always overwrite the build flag
 	if v, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
@@ -125,6 +500,16 @@ func WithConfig(configFile string) Option {
 	}
 }
 
+// WithSettingsFile sets the settings file of the repository.  By
+// default, the melange.yaml in the directory of the configuration file
+// or its closest parent, up to the root of its git repository, is used.
+func WithSettingsFile(settingsFile string) Option {
+	return func(ctx *Context) error {
+		ctx.SettingsFile = settingsFile
+		return nil
+	}
+}
+
 // WithBuildDate sets the timestamps for the build context.
 // The string is parsed according to RFC3339.
 // An empty string is a special case and will default to
@@ -163,156 +548,1096 @@ func WithPipelineDir(pipelineDir string) Option {
 	}
 }
 
-// WithSigningKey sets the signing key path to use.
-func WithSigningKey(signingKey string) Option {
+// WithOverlayPipelineDirs sets directories whose pipelines take precedence
+// over the built-in pipelines.  Pipelines which are not found in any of
+// the overlay directories are still resolved from the built-in set.
+func WithOverlayPipelineDirs(dirs []string) Option {
 	return func(ctx *Context) error {
-		ctx.SigningKey = signingKey
+		ctx.OverlayPipelineDirs = dirs
 		return nil
 	}
 }
 
-// WithUseProot sets whether or not proot should be used.
-func WithUseProot(useProot bool) Option {
+// WithOutDir sets the output directory to use for the packages.
+func WithOutDir(outDir string) Option {
 	return func(ctx *Context) error {
-		ctx.UseProot = useProot
+		ctx.OutDir = outDir
 		return nil
 	}
 }
 
-// Load the configuration data from the build context configuration file.
-func (cfg *Configuration) Load(configFile string) error {
-	data, err := os.ReadFile(configFile)
-	if err != nil {
-		return fmt.Errorf("unable to load configuration file: %w", err)
+// WithOutputLayout sets the layout of the packages in the output
+// directory, OutputLayoutFlat or OutputLayoutContentAddressed.
+func WithOutputLayout(layout string) Option {
+	return func(ctx *Context) error {
+		switch layout {
+		case "", OutputLayoutFlat, OutputLayoutContentAddressed:
+		default:
+			return fmt.Errorf("output layout must be one of %s or %s", OutputLayoutFlat, OutputLayoutContentAddressed)
+		}
+
+		ctx.OutputLayout = layout
+		return nil
 	}
+}
 
-	if err := yaml.Unmarshal(data, cfg); err != nil {
-		return fmt.Errorf("unable to parse configuration file: %w", err)
+// WithCacheDir sets the directory used to persist data between builds,
+// such as the build history.  An empty string disables it.
+func WithCacheDir(cacheDir string) Option {
+	return func(ctx *Context) error {
+		ctx.CacheDir = cacheDir
+		return nil
 	}
+}
 
-	grp := apko_types.Group{
-		GroupName: "build",
-		GID:       1000,
-		Members:   []string{"build"},
+// WithRemoteCache shares the fetched sources and the step cache entries
+// of the builds through a remote cache, given as a URL whose scheme
+// selects its backend, such as s3://bucket/prefix.  The cache is only
+// read in the read-only mode, and the fetched sources and step cache
+// entries are also stored in it in the read-write mode.  An empty URL
+// disables it.
+func WithRemoteCache(cache, mode string) Option {
+	return func(ctx *Context) error {
+		ctx.RemoteCache = cache
+		ctx.RemoteCacheMode = mode
+		return nil
 	}
-	cfg.Environment.Accounts.Groups = []apko_types.Group{grp}
+}
 
-	usr := apko_types.User{
-		UserName: "build",
-		UID:      1000,
-		GID:      1000,
+// WithGoCacheSize bounds the size of the module and build caches of the
+// Go toolchains kept in the cache directory, or disables them when 0.
+func WithGoCacheSize(size int64) Option {
+	return func(ctx *Context) error {
+		ctx.GoCacheSize = size
+		return nil
 	}
-	cfg.Environment.Accounts.Users = []apko_types.User{usr}
+}
 
-	return nil
+// WithStepCacheSize bounds the size of the outputs of the steps of the
+// main pipelines kept in the cache directory, see stepCache.  A size of 0
+// disables the step cache.
+func WithStepCacheSize(size int64) Option {
+	return func(ctx *Context) error {
+		if size < 0 {
+			return fmt.Errorf("step cache size %d is negative", size)
+		}
+		ctx.StepCacheSize = size
+		return nil
+	}
 }
 
-func (ctx *Context) BuildWorkspace(workspaceDir string) error {
-	// Prepare workspace directory
-	if err := os.MkdirAll(ctx.WorkspaceDir, 0755); err != nil {
-		return err
+// WithJavaCacheSize bounds the size of the Maven and Gradle caches kept
+// in the cache directory.  A size of 0 disables them.
+func WithJavaCacheSize(size int64) Option {
+	return func(ctx *Context) error {
+		ctx.JavaCacheSize = size
+		return nil
 	}
+}
 
-	log.Printf("building workspace in '%s' with apko", workspaceDir)
+// WithMavenRepository sets a directory with the layout of a Maven
+// repository, such as a mirror of the artifacts of the builds, which the
+// Maven and Gradle of the build environments resolve from instead of the
+// network.
+func WithMavenRepository(dir string) Option {
+	return func(ctx *Context) error {
+		ctx.MavenRepository = dir
+		return nil
+	}
+}
 
-	// TODO(kaniini): update to apko 0.2 Build.New() when WithImageConfiguration
-	// is merged.
-	bc := apko_build.Context{
-		ImageConfiguration: ctx.Configuration.Environment,
-		WorkDir:            workspaceDir,
-		UseProot:           ctx.UseProot,
-		// TODO(kaniini): maybe support multiarch builds somehow
-		Arch: apko_types.Architecture(runtime.GOARCH),
+// WithRepositoryPinsFile sets the file recording the digests of the
+// repository indexes used for build environments.  Indexes missing from
+// it are trusted on first use and added to it.
+func WithRepositoryPinsFile(path string) Option {
+	return func(ctx *Context) error {
+		ctx.RepositoryPinsFile = path
+		return nil
 	}
-	bc.Summarize()
+}
 
-	if err := bc.BuildImage(); err != nil {
-		return fmt.Errorf("unable to generate image: %w", err)
+// WithRepositorySnapshot resolves the build environment against a
+// snapshot of the repository indexes, recorded by SnapshotIndexes.  The
+// snapshot is either the timestamp of a snapshot of snapshotDir, or the
+// path of a snapshot directory or manifest.
+func WithRepositorySnapshot(snapshot, snapshotDir string) Option {
+	return func(ctx *Context) error {
+		ctx.RepositorySnapshot = snapshot
+		ctx.SnapshotDir = snapshotDir
+		return nil
 	}
+}
 
-	log.Printf("successfully built workspace with apko")
+// WithProxy sets the HTTP and HTTPS proxies used for every network access,
+// and the hosts which are accessed without them.  Empty values keep the
+// settings of the environment.
+func WithProxy(httpProxy, httpsProxy, noProxy string) Option {
+	return func(ctx *Context) error {
+		ctx.HTTPProxy = httpProxy
+		ctx.HTTPSProxy = httpsProxy
+		ctx.NoProxy = noProxy
+		return nil
+	}
+}
 
-	return nil
+// WithCACertFile sets a file with additional PEM encoded CA certificates
+// trusted for every network access, including inside the build
+// environment.
+func WithCACertFile(caCertFile string) Option {
+	return func(ctx *Context) error {
+		ctx.CACertFile = caCertFile
+		return nil
+	}
 }
 
-func (ctx *Context) BuildPackage() error {
-	ctx.Summarize()
+// WithNetrcFile sets a netrc file with the credentials of the package
+// repositories.
+func WithNetrcFile(netrcFile string) Option {
+	return func(ctx *Context) error {
+		ctx.NetrcFile = netrcFile
+		return nil
+	}
+}
 
-	guestDir, err := os.MkdirTemp("", "melange-guest-*")
-	if err != nil {
-		return fmt.Errorf("unable to make guest directory: %w", err)
+// WithSigningKey sets the signing key path to use.
+func WithSigningKey(signingKey string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningKey = signingKey
+		return nil
 	}
-	ctx.GuestDir = guestDir
+}
 
-	if err := ctx.BuildWorkspace(guestDir); err != nil {
-		return fmt.Errorf("unable to build workspace: %w", err)
+// WithSigningServer sets a signing service which signs the packages
+// instead of a local signing key.  The client certificate and key are
+// used to authenticate to it, and its certificate is verified with the
+// CA certificates in serverCA, or the system roots if it is empty.
+func WithSigningServer(url, clientCert, clientKey, serverCA string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningServer = url
+		ctx.SigningClientCert = clientCert
+		ctx.SigningClientKey = clientKey
+		ctx.SigningServerCA = serverCA
+		return nil
 	}
+}
 
-	// run the main pipeline
-	log.Printf("running the main pipeline")
-	pctx := PipelineContext{
-		Context: ctx,
-		Package: &ctx.Configuration.Package,
+// WithSigningKMS sets a key management service key which signs the
+// packages instead of a local signing key, given by its URL.  Only Azure
+// Key Vault keys, https://<vault>/keys/<name>[/<version>], are supported.
+func WithSigningKMS(keyURL string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningKMS = keyURL
+		return nil
 	}
-	for _, p := range ctx.Configuration.Pipeline {
-		if err := p.Run(&pctx); err != nil {
-			return fmt.Errorf("unable to run pipeline: %w", err)
-		}
+}
+
+// WithTimestampURL sets the RFC 3161 time-stamping authority which
+// timestamps the signatures of the packages, so that they can be trusted
+// after their signing key is rotated or expires.
+func WithTimestampURL(url string) Option {
+	return func(ctx *Context) error {
+		ctx.TimestampURL = url
+		return nil
 	}
+}
 
-	// run any pipelines for subpackages
-	for _, sp := range ctx.Configuration.Subpackages {
-		log.Printf("running pipeline for subpackage %s", sp.Name)
-		pctx.Subpackage = &sp
+// WithUseProot sets whether or not proot should be used.
+func WithUseProot(useProot bool) Option {
+	return func(ctx *Context) error {
+		ctx.UseProot = useProot
+		return nil
+	}
+}
 
-		for _, p := range sp.Pipeline {
-			if err := p.Run(&pctx); err != nil {
-				return fmt.Errorf("unable to run pipeline: %w", err)
-			}
-		}
+// WithRunner sets the runner used to run the build pipelines.
+func WithRunner(runner string) Option {
+	return func(ctx *Context) error {
+		ctx.Runner = runner
+		return nil
 	}
+}
 
-	// emit main package
-	pkg := pctx.Package
-	if err := pkg.Emit(&pctx); err != nil {
-		return fmt.Errorf("unable to emit package: %w", err)
+// WithSBOMGenerators sets the SBOM generators which are run for every
+// package.
+func WithSBOMGenerators(sbomGenerators []string) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMGenerators = sbomGenerators
+		return nil
 	}
+}
 
-	// emit subpackages
-	for _, sp := range ctx.Configuration.Subpackages {
-		if err := sp.Emit(&pctx); err != nil {
-			return fmt.Errorf("unable to emit package: %w", err)
-		}
+// WithSBOMFormats sets the formats of the SBOMs of the melange SBOM
+// generator, by default SPDX.
+func WithSBOMFormats(formats []string) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMFormats = formats
+		return nil
 	}
+}
 
-	return nil
+// WithSBOMChecksums sets the checksum algorithms of the files listed in
+// the SBOMs of the melange SBOM generator, by default SHA1 and SHA256.
+func WithSBOMChecksums(algorithms []string) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMChecksums = algorithms
+		return nil
+	}
 }
 
-func (ctx *Context) Summarize() {
-	log.Printf("melange is building:")
-	log.Printf("  configuration file: %s", ctx.ConfigFile)
-	log.Printf("  workspace dir: %s", ctx.WorkspaceDir)
+// WithSBOMAttestation sets whether the SPDX SBOMs of the melange SBOM
+// generator are signed with the signing key of the packages, and attested
+// with an in-toto statement stored next to them in the packages.
+func WithSBOMAttestation(attest bool) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMAttestation = attest
+		return nil
+	}
 }
 
-func (ctx *Context) PrivilegedWorkspaceCmd(args ...string) (*exec.Cmd, error) {
-	args = append([]string{"-S", ctx.GuestDir, "-i", "1000:1000", "-b", fmt.Sprintf("%s:/home/build", ctx.WorkspaceDir), "-w", "/home/build"}, args...)
-	cmd := exec.Command("proot", args...)
+// WithSBOMCheckNTIA sets whether the NTIA minimum elements missing from
+// the SBOMs of the melange SBOM generator are logged as warnings.
+func WithSBOMCheckNTIA(check bool) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMCheckNTIA = check
+		return nil
+	}
+}
 
-	return cmd, nil
+// WithSBOMStrict sets whether the build fails when the SBOMs of the
+// melange SBOM generator do not meet the NTIA minimum elements.
+func WithSBOMStrict(strict bool) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMStrict = strict
+		return nil
+	}
 }
 
-func (ctx *Context) WorkspaceCmd(args ...string) (*exec.Cmd, error) {
-	baseargs := []string{
-		"--bind", ctx.GuestDir, "/",
-		"--bind", ctx.WorkspaceDir, "/home/build",
-		"--bind", "/etc/resolv.conf", "/etc/resolv.conf",
-		"--unshare-pid",
-		"--dev", "/dev",
-		"--proc", "/proc",
-		"--chdir", "/home/build",
-	}
-	args = append(baseargs, args...)
-	cmd := exec.Command("bwrap", args...)
-
-	return cmd, nil
+// WithSBOMBuildEnvironment sets whether an SPDX SBOM of the packages
+// installed in the build environment is written next to the packages,
+// as <package>-<version>-r<epoch>.build-environment.spdx.json, and
+// referenced by the SPDX SBOMs of the packages as a build dependency,
+// instead of them listing the packages of the environment.
+func WithSBOMBuildEnvironment(buildEnvironment bool) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMBuildEnvironment = buildEnvironment
+		return nil
+	}
+}
+
+// WithSBOMSkipSymlinks sets whether the symbolic links of the packages
+// are left out of the SBOMs of the melange SBOM generator.
+func WithSBOMSkipSymlinks(skip bool) Option {
+	return func(ctx *Context) error {
+		ctx.SBOMSkipSymlinks = skip
+		return nil
+	}
+}
+
+// WithDependencyTrack uploads the SBOMs of the melange SBOM generator to
+// a Dependency-Track server, with the API key of the
+// DEPENDENCY_TRACK_API_KEY environment variable.
+func WithDependencyTrack(url string) Option {
+	return func(ctx *Context) error {
+		if url == "" {
+			return nil
+		}
+
+		key := os.Getenv("DEPENDENCY_TRACK_API_KEY")
+		if key == "" {
+			return errors.New("uploading SBOMs to Dependency-Track requires an API key in DEPENDENCY_TRACK_API_KEY")
+		}
+
+		ctx.DependencyTrackURL = url
+		ctx.dependencyTrackAPIKey = key
+		return nil
+	}
+}
+
+// WithChecksumManifest sets whether a signed checksum manifest of the
+// packages, SBOMs and logs written to the output directory is written
+// along with them, see WriteChecksumManifest.
+func WithChecksumManifest(checksumManifest bool) Option {
+	return func(ctx *Context) error {
+		ctx.ChecksumManifest = checksumManifest
+		return nil
+	}
+}
+
+// WithApkoFragment sets whether an apko configuration fragment installing
+// the packages, and a lock of their digests, are written next to them,
+// see writeApkoFragment.
+func WithApkoFragment(apkoFragment bool) Option {
+	return func(ctx *Context) error {
+		ctx.ApkoFragment = apkoFragment
+		return nil
+	}
+}
+
+// WithDigests sets the digest algorithms recorded in the packages in
+// addition to the SHA1 digests of their files and the SHA256 digest of
+// their data section, for the apk versions which verify them.  The
+// digests of the files are recorded as PAX records of the data section,
+// and the digest of the data section as a comment of the .PKGINFO.  The
+// digests of the settings of the repository are used when none are set.
+func WithDigests(digests []string) Option {
+	return func(ctx *Context) error {
+		if err := validateDigests(digests); err != nil {
+			return err
+		}
+		ctx.Digests = digests
+		return nil
+	}
+}
+
+// WithEpochFromGit sets whether the source date epoch is derived from the
+// date of the last git commit which modified the configuration file.
+// The SOURCE_DATE_EPOCH environment variable still takes precedence.
+func WithEpochFromGit(epochFromGit bool) Option {
+	return func(ctx *Context) error {
+		ctx.EpochFromGit = epochFromGit
+		return nil
+	}
+}
+
+// WithForce sets whether existing packages with different contents may be
+// overwritten.
+func WithForce(force bool) Option {
+	return func(ctx *Context) error {
+		ctx.Force = force
+		return nil
+	}
+}
+
+// WithPublishedRepository sets the repository the packages are published
+// to, which CheckVersionBumped compares the configuration against.
+func WithPublishedRepository(repository string) Option {
+	return func(ctx *Context) error {
+		ctx.PublishedRepository = repository
+		return nil
+	}
+}
+
+// WithLocale sets the locale of the pipelines, unless the package sets
+// its own.  An empty locale selects the default, C.UTF-8.
+func WithLocale(locale string) Option {
+	return func(ctx *Context) error {
+		if locale != "" {
+			if err := validateLocale(locale); err != nil {
+				return err
+			}
+		}
+		ctx.Locale = locale
+		return nil
+	}
+}
+
+// WithTimezone sets the timezone of the pipelines, unless the package
+// sets its own.  An empty timezone selects the default, UTC.
+func WithTimezone(timezone string) Option {
+	return func(ctx *Context) error {
+		if timezone != "" {
+			if err := validateTimezone(timezone); err != nil {
+				return err
+			}
+		}
+		ctx.Timezone = timezone
+		return nil
+	}
+}
+
+// WithPassEnv sets the variables of the host which are passed through to
+// the pipelines of every package, in addition to the ones of the package.
+func WithPassEnv(names []string) Option {
+	return func(ctx *Context) error {
+		if err := validatePassEnv(names); err != nil {
+			return err
+		}
+		ctx.PassEnv = names
+		return nil
+	}
+}
+
+// WithReadOnlyRoot sets whether the root of the build environments is
+// mounted read-only, as if every package requested it.
+func WithReadOnlyRoot(readOnly bool) Option {
+	return func(ctx *Context) error {
+		ctx.ReadOnlyRoot = readOnly
+		return nil
+	}
+}
+
+// Load the configuration data from the build context configuration file.
+func (cfg *Configuration) Load(configFile string) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return errcode.Wrap(errcode.ConfigRead, fmt.Errorf("unable to load configuration file: %w", err), "config", configFile)
+	}
+
+	return cfg.parse(data, configFile)
+}
+
+// parse loads the contents of a configuration file.
+func (cfg *Configuration) parse(data []byte, configFile string) error {
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return errcode.Wrap(errcode.ConfigParse, fmt.Errorf("unable to parse configuration file: %w", err), "config", configFile)
+	}
+
+	if err := cfg.expandRanges(); err != nil {
+		return errcode.Wrap(errcode.ConfigInvalid, fmt.Errorf("invalid configuration: %w", err), "config", configFile)
+	}
+
+	grp := apko_types.Group{
+		GroupName: "build",
+		GID:       1000,
+		Members:   []string{"build"},
+	}
+	cfg.Environment.Accounts.Groups = []apko_types.Group{grp}
+
+	usr := apko_types.User{
+		UserName: "build",
+		UID:      1000,
+		GID:      1000,
+	}
+	cfg.Environment.Accounts.Users = []apko_types.User{usr}
+
+	if err := cfg.Validate(); err != nil {
+		return errcode.Wrap(errcode.ConfigInvalid, fmt.Errorf("invalid configuration: %w", err), "config", configFile)
+	}
+
+	return nil
+}
+
+func (deps *Dependencies) validate() error {
+	for _, dep := range append(deps.Runtime, deps.Provides...) {
+		if strings.TrimSpace(dep) == "" {
+			return errors.New("dependencies must not be empty")
+		}
+	}
+
+	if deps.ProviderPriority != 0 && len(deps.Provides) == 0 {
+		return errors.New("provider-priority is set, but nothing is provided")
+	}
+
+	for _, conflict := range deps.Conflicts {
+		if strings.TrimSpace(conflict) == "" {
+			return errors.New("conflicts must not be empty")
+		}
+
+		if strings.HasPrefix(conflict, "!") {
+			return fmt.Errorf("conflict %s must be given without a leading !", conflict)
+		}
+
+		for _, dep := range deps.Runtime {
+			if dependencyName(dep) == dependencyName(conflict) {
+				return fmt.Errorf("%s is both a dependency and a conflict", dependencyName(conflict))
+			}
+		}
+	}
+
+	return nil
+}
+
+// dependencyName returns the name of a dependency, without its version
+// constraint.
+func dependencyName(dep string) string {
+	if i := strings.IndexAny(dep, "<>=~"); i >= 0 {
+		return dep[:i]
+	}
+	return dep
+}
+
+// Validate checks that the package and its subpackages are well-formed.
+func (cfg *Configuration) Validate() error {
+	if cfg.Package.Name == "" {
+		return errors.New("package name is missing")
+	}
+
+	if cfg.Package.Version == "" {
+		return fmt.Errorf("package %s: version is missing", cfg.Package.Name)
+	}
+
+	if err := cfg.Package.Dependencies.validate(); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if cfg.Package.Metapackage {
+		if err := cfg.validateMetapackage(); err != nil {
+			return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+		}
+	}
+
+	if err := cfg.Package.Sandbox.validate(); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if cfg.Package.Locale != "" {
+		if err := validateLocale(cfg.Package.Locale); err != nil {
+			return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+		}
+	}
+
+	if cfg.Package.Timezone != "" {
+		if err := validateTimezone(cfg.Package.Timezone); err != nil {
+			return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+		}
+	}
+
+	if err := validateFaketime(cfg.Package.Faketime); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := validateChecks(cfg.Package.Checks); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	for _, agent := range []string{cfg.Package.Supplier, cfg.Package.Originator} {
+		if agent == "" {
+			continue
+		}
+		if err := sbom.ValidateAgent(agent); err != nil {
+			return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+		}
+	}
+
+	if err := cfg.Artifacts.validate(); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := validateCopyrights(cfg.Package.Copyright); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := cfg.Package.Deprecation.validate(); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := validateAssertions(cfg.Pipeline); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := cfg.Advisories.Validate(); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := validatePassEnv(cfg.Package.PassEnv); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := cfg.Package.SizeBudget.validate(); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := cfg.Package.EnvironmentBudget.validate(); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := validateCPEs(cfg.Package.CPE); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	if err := validateAnnotations(cfg.Annotations); err != nil {
+		return fmt.Errorf("package %s: %w", cfg.Package.Name, err)
+	}
+
+	switch cfg.Package.SpecialFiles {
+	case "", SpecialFilesError, SpecialFilesSkip, SpecialFilesKeep:
+	default:
+		return fmt.Errorf("package %s: special-files must be one of %s, %s or %s", cfg.Package.Name, SpecialFilesError, SpecialFilesSkip, SpecialFilesKeep)
+	}
+
+	names := map[string]bool{cfg.Package.Name: true}
+	for _, sp := range cfg.Subpackages {
+		if sp.Name == "" {
+			return errors.New("subpackage name is missing")
+		}
+
+		if names[sp.Name] {
+			return fmt.Errorf("subpackage %s: name is used more than once", sp.Name)
+		}
+		names[sp.Name] = true
+
+		if err := sp.Dependencies.validate(); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+
+		if err := validateCopyrights(sp.Copyright); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+
+		if err := sp.Deprecation.validate(); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+
+		if err := validateAssertions(sp.Pipeline); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+
+		if err := sp.SizeBudget.validate(); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+
+		if err := validateCPEs(sp.CPE); err != nil {
+			return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateMetapackage checks that a metapackage only declares metadata.
+func (cfg *Configuration) validateMetapackage() error {
+	deps := cfg.Package.Dependencies
+	if len(deps.Runtime) == 0 && len(deps.Provides) == 0 {
+		return errors.New("metapackage declares no dependencies or provides")
+	}
+
+	if len(cfg.Pipeline) > 0 {
+		return errors.New("metapackage has pipelines")
+	}
+
+	for _, sp := range cfg.Subpackages {
+		if len(sp.Pipeline) > 0 {
+			return fmt.Errorf("subpackage %s of metapackage has pipelines", sp.Name)
+		}
+	}
+
+	return nil
+}
+
+// buildMetapackage emits a metapackage and its subpackages, which have no
+// files.
+func (ctx *Context) buildMetapackage() error {
+	pctx := PipelineContext{
+		Context: ctx,
+		Package: &ctx.Configuration.Package,
+	}
+
+	subpackages := []Subpackage{{Name: ctx.Configuration.Package.Name}}
+	subpackages = append(subpackages, ctx.Configuration.Subpackages...)
+	for _, sp := range subpackages {
+		pc := PackageContext{Context: ctx, PackageName: sp.Name}
+		if err := os.MkdirAll(pc.WorkspaceSubdir(), 0755); err != nil {
+			return fmt.Errorf("unable to create package directory: %w", err)
+		}
+	}
+
+	if err := pctx.Package.Emit(&pctx); err != nil {
+		return fmt.Errorf("unable to emit package: %w", err)
+	}
+
+	for _, sp := range ctx.Configuration.Subpackages {
+		if err := sp.Emit(&pctx); err != nil {
+			return fmt.Errorf("unable to emit package: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (ctx *Context) BuildWorkspace(workspaceDir string) error {
+	// Prepare workspace directory
+	if err := os.MkdirAll(ctx.WorkspaceDir, 0755); err != nil {
+		return err
+	}
+
+	log.Printf("building workspace in '%s' with apko", workspaceDir)
+
+	if err := ctx.buildImage(workspaceDir, ctx.Configuration.Environment); err != nil {
+		return err
+	}
+
+	log.Printf("successfully built workspace with apko")
+
+	return nil
+}
+
+// buildImage builds the image of env into dir with apko, from the
+// repositories of the build.
+func (ctx *Context) buildImage(dir string, env apko_types.ImageConfiguration) error {
+	var repos []string
+	if ctx.mirror != nil {
+		// the mirror adds the credentials itself.
+		repos = ctx.mirror.repositories
+	} else {
+		var err error
+		repos, err = ctx.authenticatedRepositories()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the packages built earlier in the batch are installed from
+	// the output directory, which is searched first.
+	if r := ctx.outputRepository; r != nil {
+		repos = append([]string{r.dir}, repos...)
+		env.Contents.Keyring = append(append([]string{}, env.Contents.Keyring...), r.keyring)
+	}
+
+	// TODO(kaniini): update to apko 0.2 Build.New() when WithImageConfiguration
+	// is merged.
+	env.Contents.Repositories = repos
+
+	bc := apko_build.Context{
+		ImageConfiguration: env,
+		WorkDir:            dir,
+		UseProot:           ctx.UseProot,
+		// TODO(kaniini): maybe support multiarch builds somehow
+		Arch: apko_types.Architecture(runtime.GOARCH),
+	}
+	bc.Summarize()
+
+	if err := bc.BuildImage(); err != nil {
+		return fmt.Errorf("unable to generate image: %w", err)
+	}
+
+	return ctx.removeGuestCredentials(dir)
+}
+
+// configDigestComment prefixes the .PKGINFO comment which records the
+// digest of the configuration a package was built from.
+const configDigestComment = "config digest: "
+
+// CheckVersionBumped returns an error if the package or one of its
+// subpackages was already built into the output directory, or published
+// to PublishedRepository, from a different configuration without
+// changing the version or epoch.  Rebuilding it would replace the
+// package with different contents under the same name.
+func (ctx *Context) CheckVersionBumped() error {
+	names := []string{ctx.Configuration.Package.Name}
+	for _, sp := range ctx.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	var published []apk.IndexEntry
+	if ctx.PublishedRepository != "" {
+		url := indexURL(ctx.PublishedRepository, apko_types.Architecture(runtime.GOARCH).ToAPK())
+		data, err := ctx.fetchIndex(url)
+		if err != nil {
+			return fmt.Errorf("unable to fetch the index of the published repository: %w", err)
+		}
+		published, err = apk.ReadIndex(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("unable to read the index of the published repository: %w", err)
+		}
+	}
+
+	for _, name := range names {
+		pc := PackageContext{
+			Context:     ctx,
+			Origin:      &ctx.Configuration.Package,
+			PackageName: name,
+		}
+
+		path := filepath.Join(ctx.OutDir, pc.Filename())
+		pi, err := apk.ReadPackageInfoFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return fmt.Errorf("unable to read existing package %s: %w", path, err)
+		default:
+			if err := ctx.checkConfigDigest(pi, path); err != nil {
+				return err
+			}
+		}
+
+		version := fmt.Sprintf("%s-r%d", ctx.Configuration.Package.Version, ctx.Configuration.Package.Epoch)
+		for _, e := range published {
+			if e.Name() != name || e.Version() != version {
+				continue
+			}
+
+			url, pi, err := ctx.publishedPackageInfo(pc.Filename())
+			if err != nil {
+				return fmt.Errorf("unable to read published package %s: %w", url, err)
+			}
+			if err := ctx.checkConfigDigest(pi, url); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkConfigDigest returns an error if the package at path, whose
+// .PKGINFO is pi, was built from a different configuration.  Packages
+// which do not record their configuration are not checked.
+func (ctx *Context) checkConfigDigest(pi *apk.PackageInfo, path string) error {
+	for _, comment := range pi.Comments {
+		if !strings.HasPrefix(comment, configDigestComment) {
+			continue
+		}
+
+		if digest := strings.TrimPrefix(comment, configDigestComment); digest != ctx.ConfigDigest {
+			return fmt.Errorf("%s was built from a different configuration (%s) with the same version and epoch, bump the epoch with `melange bump --epoch %s`",
+				path, digest, ctx.ConfigFile)
+		}
+	}
+
+	return nil
+}
+
+// publishedPackageInfo reads the .PKGINFO of a package of the published
+// repository, which is a URL or a local directory, and returns it along
+// with the location of the package.
+func (ctx *Context) publishedPackageInfo(filename string) (string, *apk.PackageInfo, error) {
+	url := strings.TrimSuffix(indexURL(ctx.PublishedRepository, apko_types.Architecture(runtime.GOARCH).ToAPK()), "APKINDEX.tar.gz") + filename
+
+	var r io.ReadCloser
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		resp, err := ctx.client().Get(url)
+		if err != nil {
+			return url, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return url, nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(url)
+		if err != nil {
+			return url, nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	// only the control section is read.
+	pi, err := apk.ReadPackageInfo(r)
+	return url, pi, err
+}
+
+func (ctx *Context) BuildPackage() error {
+	ctx.Summarize()
+
+	if !ctx.Force {
+		if err := ctx.CheckVersionBumped(); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Configuration.Package.Metapackage {
+		log.Printf("building metapackage, without a build environment")
+		return ctx.buildMetapackage()
+	}
+
+	if err := ctx.checkSandbox(); err != nil {
+		return errcode.Wrap(errcode.RunnerUnsupported, err, "runner", ctx.Runner)
+	}
+
+	start := time.Now()
+
+	guestDir, err := os.MkdirTemp("", "melange-guest-*")
+	if err != nil {
+		return fmt.Errorf("unable to make guest directory: %w", err)
+	}
+	ctx.GuestDir = guestDir
+
+	hs := captureHostState()
+	defer ctx.reportLeftovers(hs)
+
+	// apk cannot use bearer tokens, so the repositories which need them
+	// are fetched through the mirror as well, like the repositories of
+	// batch builds, whose fetches are cached for the whole batch.
+	if ctx.RepositorySnapshot != "" || ctx.pinningRepositories() || ctx.hasBearerRepositories() || ctx.fetchCache != nil {
+		var indexes map[string][]byte
+		if ctx.RepositorySnapshot != "" {
+			// the snapshot indexes are verified against the digests
+			// of its manifest instead of the pins.
+			indexes, err = ctx.snapshotIndexes()
+			if err != nil {
+				return fmt.Errorf("unable to use repository snapshot: %w", err)
+			}
+		} else {
+			indexes, err = ctx.fetchIndexes()
+			if err != nil {
+				return err
+			}
+
+			if ctx.pinningRepositories() {
+				if err := ctx.checkRepositoryPins(indexDigests(indexes)); err != nil {
+					return fmt.Errorf("unable to verify repository pins: %w", err)
+				}
+			}
+		}
+
+		ctx.mirror, err = ctx.startRepositoryMirror(indexes)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ctx.mirror.Close()
+			ctx.mirror = nil
+		}()
+	}
+
+	if err := ctx.BuildWorkspace(guestDir); err != nil {
+		return fmt.Errorf("unable to build workspace: %w", err)
+	}
+
+	if err := ctx.checkEnvironmentSize(); err != nil {
+		return err
+	}
+
+	if err := ctx.digestEnvironment(); err != nil {
+		return err
+	}
+
+	if ctx.SBOMBuildEnvironment {
+		if err := ctx.writeBuildEnvironmentSBOM(); err != nil {
+			return fmt.Errorf("unable to write the SBOM of the build environment: %w", err)
+		}
+	}
+
+	if err := ctx.installCACert(); err != nil {
+		return fmt.Errorf("unable to install CA certificates: %w", err)
+	}
+
+	if err := ctx.prepareSandboxDirs(); err != nil {
+		return err
+	}
+
+	if err := ctx.openGoCache(); err != nil {
+		return err
+	}
+	defer ctx.closeGoCache()
+
+	// the caches opened before a failure are released too.
+	defer ctx.closeJavaTools()
+	if err := ctx.openJavaTools(); err != nil {
+		return err
+	}
+
+	if err := ctx.checkFaketime(); err != nil {
+		return err
+	}
+
+	if err := ctx.importArtifacts(); err != nil {
+		return err
+	}
+
+	ctx.stepTracker, err = newStepTracker(filepath.Join(ctx.WorkspaceDir, "melange-out"))
+	if err != nil {
+		return err
+	}
+
+	// run the main pipeline
+	log.Printf("running the main pipeline")
+	pctx := PipelineContext{
+		Context: ctx,
+		Package: &ctx.Configuration.Package,
+	}
+	stepCache, err := ctx.openStepCache()
+	if err != nil {
+		return err
+	}
+	defer ctx.closeStepCache(stepCache)
+	restored, err := stepCache.restore(ctx)
+	if err != nil {
+		return err
+	}
+	if restored > 0 {
+		log.Printf("restored the outputs of %d of %d steps from the step cache", restored, len(ctx.Configuration.Pipeline))
+	}
+	for i, p := range ctx.Configuration.Pipeline {
+		if i < restored {
+			continue
+		}
+		if err := p.Run(&pctx); err != nil {
+			return fmt.Errorf("unable to run pipeline: %w", err)
+		}
+		if err := ctx.stepTracker.record(stepName(nil, i, &p)); err != nil {
+			return err
+		}
+		if err := stepCache.store(ctx, i); err != nil {
+			log.Printf("warning: unable to cache the outputs of %s: %v", stepName(nil, i, &p), err)
+		}
+	}
+
+	ctx.addAutoSubpackages()
+
+	// run any pipelines for subpackages
+	for _, sp := range ctx.Configuration.Subpackages {
+		log.Printf("running pipeline for subpackage %s", sp.Name)
+		pctx.Subpackage = &sp
+
+		for i, p := range sp.Pipeline {
+			if err := p.Run(&pctx); err != nil {
+				return fmt.Errorf("unable to run pipeline: %w", err)
+			}
+			if err := ctx.stepTracker.record(stepName(&sp, i, &p)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ctx.Configuration.Package.PythonBytecompile {
+		if err := ctx.bytecompilePython(&pctx); err != nil {
+			return err
+		}
+		if err := ctx.stepTracker.record("python bytecompilation"); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.exportArtifacts(); err != nil {
+		return err
+	}
+
+	// emit main package
+	pkg := pctx.Package
+	if err := pkg.Emit(&pctx); err != nil {
+		return fmt.Errorf("unable to emit package: %w", err)
+	}
+
+	// emit subpackages
+	for _, sp := range ctx.Configuration.Subpackages {
+		if err := sp.Emit(&pctx); err != nil {
+			return fmt.Errorf("unable to emit package: %w", err)
+		}
+	}
+
+	if err := ctx.writeApkoFragment(); err != nil {
+		return err
+	}
+
+	if ctx.CacheDir != "" {
+		if err := recordBuild(ctx.CacheDir, pkg.Name, time.Since(start), ctx.environmentSize); err != nil {
+			log.Printf("warning: unable to record build history: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (ctx *Context) Summarize() {
+	log.Printf("melange is building:")
+	log.Printf("  configuration file: %s", ctx.ConfigFile)
+	if ctx.SettingsFile != "" {
+		log.Printf("  settings file: %s", ctx.SettingsFile)
+	}
+	log.Printf("  workspace dir: %s", ctx.WorkspaceDir)
+	if ctx.Git != nil {
+		log.Printf("  git commit: %s (uncommitted changes: %t)", ctx.Git.Commit, ctx.Git.Dirty)
+	}
+	if ctx.RepositorySnapshot != "" {
+		log.Printf("  repository snapshot: %s", ctx.RepositorySnapshot)
+	}
+	log.Printf("  locale: %s, timezone: %s", ctx.locale(), ctx.timezone())
+}
+
+func (ctx *Context) PrivilegedWorkspaceCmd(args ...string) (*exec.Cmd, error) {
+	return prootRunner{}.Command(ctx, args...)
+}
+
+// WorkspaceCmd returns a command which runs args inside the build
+// environment with the selected runner.
+func (ctx *Context) WorkspaceCmd(args ...string) (*exec.Cmd, error) {
+	r, err := lookupRunner(ctx.Runner)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Command(ctx, args...)
 }
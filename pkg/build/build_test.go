@@ -0,0 +1,198 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/errcode"
+	"gopkg.in/yaml.v3"
+)
+
+func TestValidateMetapackage(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{{
+		name: "dependencies only",
+		config: `
+package:
+  name: mta
+  version: 1.0
+  metapackage: true
+  dependencies:
+    runtime:
+      - postfix
+subpackages:
+  - name: mta-doc
+`,
+	}, {
+		name: "nothing declared",
+		config: `
+package:
+  name: mta
+  version: 1.0
+  metapackage: true
+`,
+		wantErr: true,
+	}, {
+		name: "pipeline",
+		config: `
+package:
+  name: mta
+  version: 1.0
+  metapackage: true
+  dependencies:
+    provides:
+      - sendmail
+pipeline:
+  - runs: true
+`,
+		wantErr: true,
+	}, {
+		name: "subpackage pipeline",
+		config: `
+package:
+  name: mta
+  version: 1.0
+  metapackage: true
+  dependencies:
+    provides:
+      - sendmail
+subpackages:
+  - name: mta-doc
+    pipeline:
+      - runs: true
+`,
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Configuration
+			if err := yaml.Unmarshal([]byte(tt.config), &cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildMetapackage(t *testing.T) {
+	ctx := &Context{WorkspaceDir: t.TempDir(), OutDir: t.TempDir()}
+	ctx.Configuration.Package = Package{
+		Name:         "mta",
+		Version:      "1.0",
+		Metapackage:  true,
+		Dependencies: Dependencies{Runtime: []string{"postfix"}, Provides: []string{"sendmail"}},
+	}
+	ctx.Configuration.Subpackages = []Subpackage{{Name: "mta-openrc"}}
+
+	if err := ctx.BuildPackage(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(ctx.OutDir, "mta-1.0-r0.apk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pkg, err := apk.ReadPackage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pkg.Files) != 0 {
+		t.Errorf("metapackage has %d files, want none", len(pkg.Files))
+	}
+	if got := pkg.Info.GetAll("depend"); !reflect.DeepEqual(got, []string{"postfix"}) {
+		t.Errorf("depend = %q, want [postfix]", got)
+	}
+	if got := pkg.Info.GetAll("provides"); !reflect.DeepEqual(got, []string{"sendmail"}) {
+		t.Errorf("provides = %q, want [sendmail]", got)
+	}
+
+	if _, err := os.Stat(filepath.Join(ctx.OutDir, "mta-openrc-1.0-r0.apk")); err != nil {
+		t.Errorf("subpackage was not emitted: %v", err)
+	}
+}
+
+func TestDependenciesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		deps    Dependencies
+		wantErr bool
+	}{{
+		name: "conflicts",
+		deps: Dependencies{Runtime: []string{"libc"}, Conflicts: []string{"exim", "sendmail<9"}},
+	}, {
+		name:    "empty conflict",
+		deps:    Dependencies{Conflicts: []string{" "}},
+		wantErr: true,
+	}, {
+		name:    "leading bang",
+		deps:    Dependencies{Conflicts: []string{"!exim"}},
+		wantErr: true,
+	}, {
+		name:    "dependency and conflict",
+		deps:    Dependencies{Runtime: []string{"exim>=4"}, Conflicts: []string{"exim"}},
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.deps.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadErrorCodes(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		config string
+		want   errcode.Code
+	}{
+		{"", errcode.ConfigRead},
+		{"package: [", errcode.ConfigParse},
+		{"package:\n  name: hello\n  dependencies:\n    runtime:\n      - hello\n", errcode.ConfigInvalid},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("config-%d.yaml", i))
+		if tt.config != "" {
+			writeFile(t, path, tt.config)
+		}
+
+		var cfg Configuration
+		err := cfg.Load(path)
+		var e *errcode.Error
+		if !errors.As(err, &e) || e.Code != tt.want || e.Context["config"] != path {
+			t.Errorf("Load(%q) = %v, want an error with code %s", tt.config, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scalarEdit replaces the value of a scalar node in a YAML document.
+type scalarEdit struct {
+	node  *yaml.Node
+	value string
+}
+
+// mappingValue returns the value node of key in a mapping node.
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping", node.Line)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1], nil
+		}
+	}
+
+	return nil, fmt.Errorf("line %d: no %s key", node.Line, key)
+}
+
+// quotedEnd returns the position after the closing quote of the quoted
+// scalar starting at start, or -1 if it does not end on the same line.
+// Double-quoted scalars escape quotes with a backslash, single-quoted
+// scalars by doubling them.
+func quotedEnd(line string, start int, quote byte) int {
+	for i := start + 1; i < len(line); i++ {
+		switch {
+		case quote == '"' && line[i] == '\\':
+			i++
+		case line[i] != quote:
+		case quote == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		default:
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// applyScalarEdits rewrites scalar values in place, so that the
+// formatting and comments of the rest of the document are preserved.
+func applyScalarEdits(data []byte, edits []scalarEdit) ([]byte, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+
+	// apply the edits from the end of the document, so that earlier
+	// positions stay valid.
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].node.Line != edits[j].node.Line {
+			return edits[i].node.Line > edits[j].node.Line
+		}
+		return edits[i].node.Column > edits[j].node.Column
+	})
+
+	for _, e := range edits {
+		if e.node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: expected a scalar", e.node.Line)
+		}
+
+		line := lines[e.node.Line-1]
+		start := e.node.Column - 1
+
+		var end int
+		var value string
+		switch e.node.Style {
+		case yaml.DoubleQuotedStyle:
+			end = quotedEnd(line, start, '"')
+			value = strconv.Quote(e.value)
+		case yaml.SingleQuotedStyle:
+			end = quotedEnd(line, start, '\'')
+			value = "'" + strings.ReplaceAll(e.value, "'", "''") + "'"
+		case 0:
+			end = start + len(e.node.Value)
+			value = e.value
+		default:
+			return nil, fmt.Errorf("line %d: unsupported scalar style", e.node.Line)
+		}
+
+		if end == -1 {
+			return nil, fmt.Errorf("line %d: unterminated quoted scalar", e.node.Line)
+		}
+
+		lines[e.node.Line-1] = line[:start] + value + line[end:]
+	}
+
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// mappingKey returns the key node of key in a mapping node, or nil if the
+// mapping does not have it.
+func mappingKey(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i]
+		}
+	}
+
+	return nil
+}
+
+// insertLine inserts a line after the given line of a document, which
+// is counted from 1.
+func insertLine(data []byte, after int, line string) []byte {
+	lines := strings.SplitAfter(string(data), "\n")
+	if after > len(lines) {
+		after = len(lines)
+	}
+
+	// the line the new one follows may be the last one, without a
+	// trailing newline.
+	if !strings.HasSuffix(lines[after-1], "\n") {
+		lines[after-1] += "\n"
+	}
+
+	inserted := append([]string{}, lines[:after]...)
+	inserted = append(inserted, line+"\n")
+	inserted = append(inserted, lines[after:]...)
+
+	return []byte(strings.Join(inserted, ""))
+}
+
+// BumpConfig updates the package version or epoch of a configuration
+// file.  Setting a new version resets the epoch to 0, otherwise the
+// epoch is incremented.
+func BumpConfig(configFile string, version string) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("unable to load configuration file: %w", err)
+	}
+
+	data, err = bumpConfigData(data, version)
+	if err != nil {
+		return fmt.Errorf("unable to bump %s: %w", configFile, err)
+	}
+
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(configFile, data, fi.Mode())
+}
+
+// bumpConfigData applies BumpConfig to the contents of a configuration
+// file.  The epoch key is optional, as it defaults to 0, so it is added
+// after the version key when it needs to be set.
+func bumpConfigData(data []byte, version string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse configuration file: %w", err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("configuration file is empty")
+	}
+
+	pkg, err := mappingValue(doc.Content[0], "package")
+	if err != nil {
+		return nil, err
+	}
+
+	versionNode, err := mappingValue(pkg, "version")
+	if err != nil {
+		return nil, err
+	}
+
+	edits := []scalarEdit{}
+	if version != "" {
+		edits = append(edits, scalarEdit{node: versionNode, value: version})
+	}
+
+	epochKey := mappingKey(pkg, "epoch")
+	if epochKey == nil {
+		data, err := applyScalarEdits(data, edits)
+		if err != nil {
+			return nil, err
+		}
+
+		// a missing epoch is 0, which is what a new version needs.
+		if version != "" {
+			return data, nil
+		}
+
+		if pkg.Style == yaml.FlowStyle {
+			return nil, fmt.Errorf("line %d: unable to add an epoch to a flow mapping", pkg.Line)
+		}
+
+		versionKey := mappingKey(pkg, "version")
+		indent := strings.Repeat(" ", versionKey.Column-1)
+
+		return insertLine(data, versionNode.Line, indent+"epoch: 1"), nil
+	}
+
+	epochNode, err := mappingValue(pkg, "epoch")
+	if err != nil {
+		return nil, err
+	}
+
+	if version != "" {
+		edits = append(edits, scalarEdit{node: epochNode, value: "0"})
+	} else {
+		epoch, err := strconv.ParseUint(epochNode.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: unable to parse epoch: %w", epochNode.Line, err)
+		}
+
+		edits = append(edits, scalarEdit{node: epochNode, value: strconv.FormatUint(epoch+1, 10)})
+	}
+
+	return applyScalarEdits(data, edits)
+}
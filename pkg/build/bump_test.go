@@ -0,0 +1,232 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/apk"
+	"gopkg.in/yaml.v3"
+)
+
+func TestApplyScalarEdits(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		value string
+		want  string
+	}{{
+		name:  "plain",
+		doc:   "version: 1.2.3 # upstream\n",
+		value: "1.2.4",
+		want:  "version: 1.2.4 # upstream\n",
+	}, {
+		name:  "single-quoted",
+		doc:   "version: '1.2.3' # upstream\n",
+		value: "1.2.4",
+		want:  "version: '1.2.4' # upstream\n",
+	}, {
+		name:  "single-quoted with an escaped quote",
+		doc:   "version: 'it''s' # upstream\n",
+		value: "it's not",
+		want:  "version: 'it''s not' # upstream\n",
+	}, {
+		name:  "double-quoted",
+		doc:   "version: \"1.2.3\" # upstream\n",
+		value: "1.2.4",
+		want:  "version: \"1.2.4\" # upstream\n",
+	}, {
+		name:  "double-quoted with an escaped quote",
+		doc:   "version: \"a \\\" b\" # \"quoted\"\n",
+		value: "c",
+		want:  "version: \"c\" # \"quoted\"\n",
+	}, {
+		name:  "nested and without a trailing newline",
+		doc:   "package:\n  name: foo\n  version: 1.2.3",
+		value: "2.0.0",
+		want:  "package:\n  name: foo\n  version: 2.0.0",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+
+			node := doc.Content[0]
+			if pkg, err := mappingValue(node, "package"); err == nil {
+				node = pkg
+			}
+
+			version, err := mappingValue(node, "version")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := applyScalarEdits([]byte(tt.doc), []scalarEdit{{node: version, value: tt.value}})
+			if err != nil {
+				t.Fatalf("applyScalarEdits() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("applyScalarEdits() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBumpConfigData(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		version string
+		want    string
+		wantErr bool
+	}{{
+		name: "increment the epoch",
+		doc:  "package:\n  name: foo\n  version: 1.2.3\n  epoch: 4 # keep\n",
+		want: "package:\n  name: foo\n  version: 1.2.3\n  epoch: 5 # keep\n",
+	}, {
+		name:    "new version resets the epoch",
+		doc:     "package:\n  name: foo\n  version: \"1.2.3\"\n  epoch: 4\n",
+		version: "1.3.0",
+		want:    "package:\n  name: foo\n  version: \"1.3.0\"\n  epoch: 0\n",
+	}, {
+		name: "missing epoch is added",
+		doc:  "# comment\npackage:\n    name: foo\n    version: 1.2.3\n    description: bar\n",
+		want: "# comment\npackage:\n    name: foo\n    version: 1.2.3\n    epoch: 1\n    description: bar\n",
+	}, {
+		name: "missing epoch is added at the end of the document",
+		doc:  "package:\n  name: foo\n  version: 1.2.3",
+		want: "package:\n  name: foo\n  version: 1.2.3\n  epoch: 1\n",
+	}, {
+		name:    "new version without an epoch",
+		doc:     "package:\n  name: foo\n  version: 1.2.3\n",
+		version: "1.3.0",
+		want:    "package:\n  name: foo\n  version: 1.3.0\n",
+	}, {
+		name:    "no version",
+		doc:     "package:\n  name: foo\n",
+		wantErr: true,
+	}, {
+		name:    "malformed epoch",
+		doc:     "package:\n  name: foo\n  version: 1.2.3\n  epoch: one\n",
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bumpConfigData([]byte(tt.doc), tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bumpConfigData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("bumpConfigData() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckVersionBumped(t *testing.T) {
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+
+	for _, tc := range []struct {
+		name string
+		// local and published are the config digests of foo-1.0-r0
+		// in the output directory and published repository, if it
+		// is there.
+		local, published string
+		publishedVersion string
+		err              string
+	}{{
+		name: "not built yet",
+	}, {
+		name:      "same configuration",
+		local:     "sha256:same",
+		published: "sha256:same",
+	}, {
+		name:  "changed since the local build",
+		local: "sha256:old",
+		err:   "was built from a different configuration (sha256:old)",
+	}, {
+		name:      "changed since it was published",
+		local:     "sha256:same",
+		published: "sha256:old",
+		err:       "was built from a different configuration (sha256:old)",
+	}, {
+		name:             "published with another epoch",
+		published:        "sha256:old",
+		publishedVersion: "1.0-r1",
+	}, {
+		name:      "published without a digest",
+		published: "none",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			outDir := t.TempDir()
+			repo := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(repo, arch), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			pkginfo := func(digest, version string) string {
+				data := "pkgname = foo\npkgver = " + version + "\n"
+				if digest != "none" {
+					data = "# config digest: " + digest + "\n" + data
+				}
+				return data
+			}
+
+			if tc.local != "" {
+				writePackageInfoAPK(t, filepath.Join(outDir, "foo-1.0-r0.apk"), pkginfo(tc.local, "1.0-r0"))
+			}
+			entries := []apk.IndexEntry{}
+			if tc.published != "" {
+				version := tc.publishedVersion
+				if version == "" {
+					version = "1.0-r0"
+				}
+				writePackageInfoAPK(t, filepath.Join(repo, arch, "foo-"+version+".apk"), pkginfo(tc.published, version))
+				entries = append(entries, apk.IndexEntry{Fields: []apk.Field{{Key: "P", Value: "foo"}, {Key: "V", Value: version}}})
+			}
+			index, err := os.Create(filepath.Join(repo, arch, "APKINDEX.tar.gz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := apk.WriteIndex(index, entries, "published"); err != nil {
+				t.Fatal(err)
+			}
+			index.Close()
+
+			ctx := &Context{OutDir: outDir, PublishedRepository: repo, ConfigFile: "foo.yaml", ConfigDigest: "sha256:same"}
+			ctx.Configuration.Package = Package{Name: "foo", Version: "1.0"}
+
+			err = ctx.CheckVersionBumped()
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("CheckVersionBumped() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("CheckVersionBumped() = %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gcsEndpoint is the endpoint of the XML API of Google Cloud Storage.
+var gcsEndpoint = "https://storage.googleapis.com"
+
+// gcsCacheBackend keeps the remote cache in a Google Cloud Storage
+// bucket, given as gs://bucket/prefix.  Requests are authorized with the
+// access token of GOOGLE_OAUTH_ACCESS_TOKEN, such as the one printed by
+// gcloud auth print-access-token, and are anonymous otherwise.
+type gcsCacheBackend struct{}
+
+func (gcsCacheBackend) Name() string {
+	return "gs"
+}
+
+func (gcsCacheBackend) request(method string, u *url.URL, object string, body io.Reader) (*http.Request, error) {
+	object = strings.Trim(u.Host+u.Path, "/") + "/" + object
+	req, err := http.NewRequest(method, gcsEndpoint+"/"+object, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func (b gcsCacheBackend) Get(ctx *Context, u *url.URL, digest string) (io.ReadCloser, error) {
+	return b.getObject(ctx, u, artifactObject(digest))
+}
+
+func (b gcsCacheBackend) Put(ctx *Context, u *url.URL, digest string, r io.Reader, size int64) error {
+	return b.putObject(ctx, u, artifactObject(digest), r, size)
+}
+
+func (b gcsCacheBackend) Resolve(ctx *Context, u *url.URL, key string) (string, error) {
+	return resolveObject(ctx, b, u, key)
+}
+
+func (b gcsCacheBackend) Index(ctx *Context, u *url.URL, key, digest string, size int64) error {
+	return indexObject(ctx, b, u, key, digest)
+}
+
+func (b gcsCacheBackend) getObject(ctx *Context, u *url.URL, object string) (io.ReadCloser, error) {
+	req, err := b.request(http.MethodGet, u, object, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cacheRequest(ctx.client(), req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b gcsCacheBackend) putObject(ctx *Context, u *url.URL, object string, r io.Reader, size int64) error {
+	req, err := b.request(http.MethodPut, u, object, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := cacheRequest(ctx.client(), req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3CacheBackend keeps the remote cache in an S3 bucket, given as
+// s3://bucket/prefix.  Requests are signed with the credentials of
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, in the
+// region of AWS_REGION or AWS_DEFAULT_REGION, and are anonymous without
+// credentials.  AWS_ENDPOINT_URL selects an S3 compatible service, whose
+// buckets are addressed by path.
+type s3CacheBackend struct{}
+
+func (s3CacheBackend) Name() string {
+	return "s3"
+}
+
+func (s3CacheBackend) request(method string, u *url.URL, object string, body io.Reader) (*http.Request, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	key := strings.Trim(u.Path, "/") + "/" + object
+	key = strings.TrimPrefix(key, "/")
+
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", u.Host, region, key)
+	if custom := os.Getenv("AWS_ENDPOINT_URL"); custom != "" {
+		endpoint = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(custom, "/"), u.Host, key)
+	}
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessKey := os.Getenv("AWS_ACCESS_KEY_ID"); accessKey != "" {
+		signS3Request(req, region, accessKey, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), time.Now())
+	}
+	return req, nil
+}
+
+func (b s3CacheBackend) Get(ctx *Context, u *url.URL, digest string) (io.ReadCloser, error) {
+	return b.getObject(ctx, u, artifactObject(digest))
+}
+
+func (b s3CacheBackend) Put(ctx *Context, u *url.URL, digest string, r io.Reader, size int64) error {
+	return b.putObject(ctx, u, artifactObject(digest), r, size)
+}
+
+func (b s3CacheBackend) Resolve(ctx *Context, u *url.URL, key string) (string, error) {
+	return resolveObject(ctx, b, u, key)
+}
+
+func (b s3CacheBackend) Index(ctx *Context, u *url.URL, key, digest string, size int64) error {
+	return indexObject(ctx, b, u, key, digest)
+}
+
+func (b s3CacheBackend) getObject(ctx *Context, u *url.URL, object string) (io.ReadCloser, error) {
+	req, err := b.request(http.MethodGet, u, object, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cacheRequest(ctx.client(), req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b s3CacheBackend) putObject(ctx *Context, u *url.URL, object string, r io.Reader, size int64) error {
+	req, err := b.request(http.MethodPut, u, object, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := cacheRequest(ctx.client(), req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// signS3Request signs a request of S3 with AWS Signature Version 4.  The
+// payload is not signed, as the artifacts are verified by their digests.
+func signS3Request(req *http.Request, region, accessKey, secretKey, sessionToken string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.Query().Encode())
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\nUNSIGNED-PAYLOAD", signedHeaders)
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	hash := sha256.Sum256([]byte(canonical.String()))
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%x", amzDate, scope, hash)
+
+	signature := hex.EncodeToString(hmacSHA256(sigV4Key(secretKey, date, region, "s3"), stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// sigV4Key derives the signing key of AWS Signature Version 4.
+func sigV4Key(secretKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// ociCacheBackend keeps the remote cache in the blobs of a repository of
+// an OCI registry, given as oci://registry/repository, whose digests are
+// the ones of the artifacts.  Indexed artifacts are the layer of a
+// manifest tagged with their key.  Registries asking for a bearer token
+// are authenticated with the credentials of the netrc file for their
+// token service.
+//
+// Registries may garbage collect the blobs which no manifest references,
+// so the fetched sources only last as long as the registry keeps them.
+type ociCacheBackend struct{}
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar"
+	// ociEmptyConfig is the empty JSON object configuring the
+	// manifests of the indexed artifacts.
+	ociEmptyConfig     = "{}"
+	ociEmptyConfigType = "application/vnd.oci.empty.v1+json"
+)
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+func (ociCacheBackend) Name() string {
+	return "oci"
+}
+
+// registryURL returns the base URL of the API of the repository.  The
+// registries on the loopback interface, such as the ones of tests, are
+// accessed with plain HTTP.
+func (ociCacheBackend) registryURL(u *url.URL) string {
+	scheme := "https"
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, u.Host, strings.Trim(u.Path, "/"))
+}
+
+func (b ociCacheBackend) Get(ctx *Context, u *url.URL, digest string) (io.ReadCloser, error) {
+	s := &registrySession{client: ctx.client()}
+	resp, err := s.do(http.MethodGet, fmt.Sprintf("%s/blobs/sha256:%s", b.registryURL(u), digest), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b ociCacheBackend) Put(ctx *Context, u *url.URL, digest string, r io.Reader, size int64) error {
+	s := &registrySession{client: ctx.client()}
+	resp, err := s.do(http.MethodPost, b.registryURL(u)+"/blobs/uploads/", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("registry returned no upload location: %v", err)
+	}
+	query := location.Query()
+	query.Set("digest", "sha256:"+digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = s.do(http.MethodPut, location.String(), r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b ociCacheBackend) Resolve(ctx *Context, u *url.URL, key string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/manifests/%s", b.registryURL(u), key), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", ociManifestType)
+
+	s := &registrySession{client: ctx.client()}
+	resp, err := s.send(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var m ociManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&m); err != nil {
+		return "", fmt.Errorf("unable to parse the manifest of %s: %w", key, err)
+	}
+	if len(m.Layers) != 1 || !strings.HasPrefix(m.Layers[0].Digest, "sha256:") {
+		return "", fmt.Errorf("the manifest of %s does not have a single SHA256 layer", key)
+	}
+	return strings.TrimPrefix(m.Layers[0].Digest, "sha256:"), nil
+}
+
+func (b ociCacheBackend) Index(ctx *Context, u *url.URL, key, digest string, size int64) error {
+	config := fmt.Sprintf("%x", sha256.Sum256([]byte(ociEmptyConfig)))
+	if err := b.Put(ctx, u, config, strings.NewReader(ociEmptyConfig), int64(len(ociEmptyConfig))); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        ociDescriptor{MediaType: ociEmptyConfigType, Digest: "sha256:" + config, Size: int64(len(ociEmptyConfig))},
+		Layers:        []ociDescriptor{{MediaType: ociLayerType, Digest: "sha256:" + digest, Size: size}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/manifests/%s", b.registryURL(u), key), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ociManifestType)
+
+	s := &registrySession{client: ctx.client()}
+	resp, err := s.send(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// registrySession sends the requests of an OCI registry, with the
+// bearer token obtained on the first request, if the registry asks for
+// one.
+type registrySession struct {
+	client *http.Client
+	token  string
+}
+
+// do sends a request, see send.
+func (s *registrySession) do(method, target string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	return s.send(req)
+}
+
+// send sends a request.  The requests whose body can be read again, or
+// without body, are sent again with a token when the registry asks for
+// one.
+func (s *registrySession) send(req *http.Request) (*http.Response, error) {
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && s.token == "" && (req.Body == nil || req.GetBody != nil) {
+		resp.Body.Close()
+		if err := s.authenticate(resp.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		return s.send(req)
+	}
+
+	return checkCacheResponse(req, resp, err)
+}
+
+// challengeParam matches the parameters of a WWW-Authenticate challenge.
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate obtains a token from the token service of a bearer
+// challenge of the registry.
+func (s *registrySession) authenticate(challenge string) error {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("registry requires unsupported authentication %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("registry challenge %q has no token service", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cacheRequest(s.client, req)
+	if err != nil {
+		return fmt.Errorf("unable to obtain a registry token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("unable to obtain a registry token: %w", err)
+	}
+
+	s.token = token.Token
+	if s.token == "" {
+		s.token = token.AccessToken
+	}
+	if s.token == "" {
+		return fmt.Errorf("token service %s returned no token", realm.Redacted())
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// The levels of the checks of packaged files.
+const (
+	CheckLevelError = "error"
+	CheckLevelWarn  = "warn"
+	CheckLevelOff   = "off"
+)
+
+// elfCheck is a check of the ELF files of a package, which returns the
+// problems found in a file.
+type elfCheck struct {
+	name  string
+	level string
+	run   func(cc *checkContext, f *elf.File) []string
+}
+
+// elfChecks are the checks of the ELF files of packages.  Their level
+// can be changed with the checks of the package configuration.
+var elfChecks = []elfCheck{{
+	name:  "rpath",
+	level: CheckLevelWarn,
+	run:   checkRPath,
+}, {
+	name:  "interpreter",
+	level: CheckLevelWarn,
+	run:   checkInterpreter,
+}, {
+	name:  "textrel",
+	level: CheckLevelWarn,
+	run:   checkTextRel,
+}, {
+	name:  "execstack",
+	level: CheckLevelWarn,
+	run:   checkExecStack,
+}, {
+	name:  "arch",
+	level: CheckLevelError,
+	run:   checkArch,
+}}
+
+// elfMachines are the machines and classes of the ELF files of each
+// architecture, keyed by GOARCH.
+var elfMachines = map[string]struct {
+	machine elf.Machine
+	class   elf.Class
+}{
+	"386":     {elf.EM_386, elf.ELFCLASS32},
+	"amd64":   {elf.EM_X86_64, elf.ELFCLASS64},
+	"arm":     {elf.EM_ARM, elf.ELFCLASS32},
+	"arm64":   {elf.EM_AARCH64, elf.ELFCLASS64},
+	"ppc64le": {elf.EM_PPC64, elf.ELFCLASS64},
+	"riscv64": {elf.EM_RISCV, elf.ELFCLASS64},
+	"s390x":   {elf.EM_S390, elf.ELFCLASS64},
+}
+
+// checkContext is what the checks know about the build.
+type checkContext struct {
+	// arch is the target architecture of the build, as a GOARCH.
+	arch string
+	// roots are the directories where files referenced by the
+	// packaged files may be found: the build environment and the
+	// output directories of every package of the build.
+	roots []string
+}
+
+// exists reports whether a path of the installed system exists in one of
+// the roots.
+func (cc *checkContext) exists(path string) bool {
+	for _, root := range cc.roots {
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validateChecks checks the levels of the checks of a package.
+func validateChecks(checks map[string]string) error {
+	for name, level := range checks {
+		if lookupCheckLevel(name) == "" {
+			return fmt.Errorf("unknown check %s", name)
+		}
+
+		switch level {
+		case CheckLevelError, CheckLevelWarn, CheckLevelOff:
+		default:
+			return fmt.Errorf("check %s: level must be one of %s, %s or %s", name, CheckLevelError, CheckLevelWarn, CheckLevelOff)
+		}
+	}
+
+	return nil
+}
+
+// lookupCheckLevel returns the default level of a check, or an empty
+// string if there is no such check.
+func lookupCheckLevel(name string) string {
+	for _, check := range elfChecks {
+		if check.name == name {
+			return check.level
+		}
+	}
+	return ""
+}
+
+// checkLevel returns the level of a check for the package.
+func (pkg *Package) checkLevel(name string) string {
+	if level, ok := pkg.Checks[name]; ok {
+		return level
+	}
+	return lookupCheckLevel(name)
+}
+
+// runChecks runs the checks of the ELF files in the output directory of
+// a package.  Problems are logged as warnings, or returned as an error
+// for the checks which are errors.
+func (pc *PackageContext) runChecks() error {
+	cc := &checkContext{arch: runtime.GOARCH}
+	if pc.Context.GuestDir != "" {
+		cc.roots = append(cc.roots, pc.Context.GuestDir)
+	}
+	outputs, err := filepath.Glob(filepath.Join(pc.Context.WorkspaceDir, "melange-out", "*"))
+	if err != nil {
+		return err
+	}
+	cc.roots = append(cc.roots, outputs...)
+
+	failures := []string{}
+
+	root := pc.WorkspaceSubdir()
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := openELF(path)
+		if err != nil || f == nil {
+			return err
+		}
+		defer f.Close()
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		for _, check := range elfChecks {
+			level := pc.Origin.checkLevel(check.name)
+			if level == CheckLevelOff {
+				continue
+			}
+
+			for _, problem := range check.run(cc, f) {
+				msg := fmt.Sprintf("%s: %s (%s check)", rel, problem, check.name)
+				if level == CheckLevelError {
+					failures = append(failures, msg)
+				} else {
+					log.Printf("warning: %s", msg)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to check package files: %w", err)
+	}
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("package %s failed checks:\n  %s", pc.PackageName, strings.Join(failures, "\n  "))
+	}
+
+	return nil
+}
+
+// openELF opens a file if it is an ELF file, and returns nil otherwise.
+func openELF(path string) (*elf.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(elf.ELFMAG))
+	_, err = io.ReadFull(file, magic)
+	file.Close()
+	if err != nil || string(magic) != elf.ELFMAG {
+		return nil, nil
+	}
+
+	f, err := elf.Open(path)
+	if err != nil {
+		// files with the ELF magic are not all valid, e.g. test data.
+		return nil, nil
+	}
+
+	return f, nil
+}
+
+// dynamicTags returns the values of the entries of the dynamic section of
+// an ELF file, keyed by tag.
+func dynamicTags(f *elf.File) map[elf.DynTag][]uint64 {
+	tags := map[elf.DynTag][]uint64{}
+
+	ds := f.SectionByType(elf.SHT_DYNAMIC)
+	if ds == nil {
+		return tags
+	}
+
+	data, err := ds.Data()
+	if err != nil {
+		return tags
+	}
+
+	for len(data) > 0 {
+		var tag elf.DynTag
+		var value uint64
+
+		switch f.Class {
+		case elf.ELFCLASS32:
+			if len(data) < 8 {
+				return tags
+			}
+			tag = elf.DynTag(f.ByteOrder.Uint32(data[0:4]))
+			value = uint64(f.ByteOrder.Uint32(data[4:8]))
+			data = data[8:]
+		case elf.ELFCLASS64:
+			if len(data) < 16 {
+				return tags
+			}
+			tag = elf.DynTag(f.ByteOrder.Uint64(data[0:8]))
+			value = f.ByteOrder.Uint64(data[8:16])
+			data = data[16:]
+		default:
+			return tags
+		}
+
+		if tag == elf.DT_NULL {
+			break
+		}
+		tags[tag] = append(tags[tag], value)
+	}
+
+	return tags
+}
+
+// checkRPath flags the RPATH and RUNPATH entries which point into the
+// build directory, or which are relative to the working directory.
+func checkRPath(cc *checkContext, f *elf.File) []string {
+	problems := []string{}
+
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		paths, err := f.DynString(tag)
+		if err != nil {
+			continue
+		}
+
+		for _, path := range paths {
+			for _, entry := range strings.Split(path, ":") {
+				switch {
+				case entry == "":
+					problems = append(problems, fmt.Sprintf("%s has an empty entry, which is the working directory", tag))
+				case strings.HasPrefix(entry, "/home/build"):
+					problems = append(problems, fmt.Sprintf("%s %s points into the build directory", tag, entry))
+				case !strings.HasPrefix(entry, "/") && !strings.HasPrefix(entry, "$ORIGIN") && !strings.HasPrefix(entry, "${ORIGIN}"):
+					problems = append(problems, fmt.Sprintf("%s %s is relative to the working directory", tag, entry))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkInterpreter flags programs whose interpreter is neither in the
+// build environment nor in a package of the build.
+func checkInterpreter(cc *checkContext, f *elf.File) []string {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return []string{fmt.Sprintf("unable to read the interpreter: %v", err)}
+		}
+
+		interp := string(bytes.TrimRight(data, "\x00"))
+		if !cc.exists(interp) {
+			return []string{fmt.Sprintf("interpreter %s is not installed", interp)}
+		}
+	}
+
+	return nil
+}
+
+// checkTextRel flags files needing relocations of their text segment,
+// which cannot be shared between processes and defeat W^X.
+func checkTextRel(cc *checkContext, f *elf.File) []string {
+	tags := dynamicTags(f)
+
+	textrel := len(tags[elf.DT_TEXTREL]) > 0
+	for _, flags := range tags[elf.DT_FLAGS] {
+		textrel = textrel || elf.DynFlag(flags)&elf.DF_TEXTREL != 0
+	}
+
+	if textrel {
+		return []string{"has text relocations"}
+	}
+	return nil
+}
+
+// checkExecStack flags files requesting an executable stack.
+func checkExecStack(cc *checkContext, f *elf.File) []string {
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_GNU_STACK && prog.Flags&elf.PF_X != 0 {
+			return []string{"requests an executable stack"}
+		}
+	}
+	return nil
+}
+
+// checkArch flags files built for another architecture than the target
+// of the build, such as host binaries of cross or emulated builds.
+func checkArch(cc *checkContext, f *elf.File) []string {
+	want, ok := elfMachines[cc.arch]
+	if !ok {
+		return nil
+	}
+
+	if f.Machine != want.machine || f.Class != want.class {
+		return []string{fmt.Sprintf("built for %s (%s), not %s", f.Machine, f.Class, cc.arch)}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// compileTestProgram compiles a C program with the host compiler into
+// the output directory of package foo of a workspace.
+func compileTestProgram(t *testing.T, workspaceDir string, flags ...string) {
+	t.Helper()
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+
+	src := filepath.Join(t.TempDir(), "main.c")
+	if err := os.WriteFile(src, []byte("int main(void) { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(workspaceDir, "melange-out", "foo", "usr", "bin", "foo")
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	args := append([]string{"-o", bin, src}, flags...)
+	if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+		t.Skipf("unable to compile test program: %v: %s", err, out)
+	}
+}
+
+func TestELFChecks(t *testing.T) {
+	workspaceDir := t.TempDir()
+	compileTestProgram(t, workspaceDir, "-Wl,-rpath,/home/build/lib:$ORIGIN/../lib", "-Wl,-z,execstack")
+
+	f, err := openELF(filepath.Join(workspaceDir, "melange-out", "foo", "usr", "bin", "foo"))
+	if err != nil || f == nil {
+		t.Fatalf("openELF() = %v, %v", f, err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		check  func(*checkContext, *elf.File) []string
+		roots  []string
+		wantN  int
+		wanted string
+	}{{
+		check:  checkRPath,
+		wantN:  1,
+		wanted: "/home/build/lib points into the build directory",
+	}, {
+		check:  checkExecStack,
+		wantN:  1,
+		wanted: "executable stack",
+	}, {
+		check:  checkInterpreter,
+		roots:  []string{t.TempDir()},
+		wantN:  1,
+		wanted: "is not installed",
+	}, {
+		check: checkInterpreter,
+		roots: []string{"/"},
+	}, {
+		check: checkTextRel,
+	}}
+
+	for _, tt := range tests {
+		problems := tt.check(&checkContext{roots: tt.roots}, f)
+		if len(problems) != tt.wantN || (tt.wanted != "" && !strings.Contains(problems[0], tt.wanted)) {
+			t.Errorf("problems = %q, want %d containing %q", problems, tt.wantN, tt.wanted)
+		}
+	}
+}
+
+func TestRunChecksLevels(t *testing.T) {
+	workspaceDir := t.TempDir()
+	compileTestProgram(t, workspaceDir, "-Wl,-rpath,/home/build/lib")
+
+	// non-ELF files, even with the ELF magic, are ignored.
+	if err := os.WriteFile(filepath.Join(workspaceDir, "melange-out", "foo", "usr", "bin", "fake"), []byte("\x7fELF not really"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		checks  map[string]string
+		wantErr bool
+	}{
+		{checks: nil},
+		{checks: map[string]string{"rpath": CheckLevelError}, wantErr: true},
+		{checks: map[string]string{"rpath": CheckLevelOff, "interpreter": CheckLevelError}},
+	} {
+		pc := PackageContext{
+			Context:     &Context{WorkspaceDir: workspaceDir, GuestDir: "/"},
+			Origin:      &Package{Name: "foo", Checks: tt.checks},
+			PackageName: "foo",
+		}
+
+		err := pc.runChecks()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checks %v: runChecks() error = %v, wantErr %v", tt.checks, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "usr/bin/foo") {
+			t.Errorf("runChecks() error = %v, want the offending path", err)
+		}
+	}
+}
+
+func TestValidateChecks(t *testing.T) {
+	if err := validateChecks(map[string]string{"rpath": CheckLevelError, "execstack": CheckLevelOff}); err != nil {
+		t.Error(err)
+	}
+
+	for _, checks := range []map[string]string{
+		{"unknown": CheckLevelError},
+		{"rpath": "fatal"},
+	} {
+		if err := validateChecks(checks); err == nil {
+			t.Errorf("validateChecks(%v) succeeded", checks)
+		}
+	}
+
+	if got := (&Package{}).checkLevel("rpath"); !reflect.DeepEqual(got, CheckLevelWarn) {
+		t.Errorf("default level = %q, want %q", got, CheckLevelWarn)
+	}
+}
+
+func TestCheckArch(t *testing.T) {
+	workspaceDir := t.TempDir()
+	compileTestProgram(t, workspaceDir)
+
+	f, err := openELF(filepath.Join(workspaceDir, "melange-out", "foo", "usr", "bin", "foo"))
+	if err != nil || f == nil {
+		t.Fatalf("openELF() = %v, %v", f, err)
+	}
+	defer f.Close()
+
+	if problems := checkArch(&checkContext{arch: runtime.GOARCH}, f); len(problems) != 0 {
+		t.Errorf("host binary: problems = %q", problems)
+	}
+
+	other := "arm64"
+	if runtime.GOARCH == "arm64" {
+		other = "amd64"
+	}
+	if problems := checkArch(&checkContext{arch: other}, f); len(problems) != 1 {
+		t.Errorf("target %s: problems = %q, want 1", other, problems)
+	}
+
+	// unknown architectures are not checked.
+	if problems := checkArch(&checkContext{arch: "mips"}, f); len(problems) != 0 {
+		t.Errorf("target mips: problems = %q", problems)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigChange is a difference between two package configurations.
+type ConfigChange struct {
+	// Path locates the setting, such as package.version,
+	// package.dependencies.runtime or
+	// subpackages[hello-doc].pipeline[0](split/manpages).with.package.
+	Path string `json:"path"`
+	// Old and New are the values of the setting, Old is empty for an
+	// added setting and New for a removed one.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// Kind returns "added", "removed" or "changed".
+func (c *ConfigChange) Kind() string {
+	switch {
+	case c.Old == "":
+		return "added"
+	case c.New == "":
+		return "removed"
+	default:
+		return "changed"
+	}
+}
+
+// LoadConfigRevision loads a configuration file as of a git revision, or
+// as it is when rev is empty.
+func LoadConfigRevision(configFile, rev string) (*Configuration, error) {
+	cfg := &Configuration{}
+	if rev == "" {
+		if err := cfg.Load(configFile); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	data, err := gitOutput(configFile, "show", rev+":./"+filepath.Base(configFile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s at %s: %w", configFile, rev, err)
+	}
+	if err := cfg.parse([]byte(data), configFile); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configValue is a setting of a flattened configuration.
+type configValue struct {
+	path  string
+	value string
+	// zero is set for the zero values of the numbers and booleans.
+	zero bool
+}
+
+// CompareConfigs returns the differences between two configurations,
+// sorted by path, ignoring their formatting, comments and the order of
+// their mappings.  The lists of values, such as the dependencies or the
+// packages of the environment, are compared as sets, and the subpackages
+// by name, while the pipelines are compared step by step.
+func CompareConfigs(old, new *Configuration) ([]ConfigChange, error) {
+	oldValues, err := flattenConfig(old)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := flattenConfig(new)
+	if err != nil {
+		return nil, err
+	}
+
+	// the settings of added and removed subpackages and pipeline
+	// steps which have zero values are not reported, as they are
+	// unset.
+	changes := []ConfigChange{}
+	for key, o := range oldValues {
+		n, ok := newValues[key]
+		switch {
+		case !ok && !o.zero:
+			changes = append(changes, ConfigChange{Path: o.path, Old: o.value})
+		case n.value != o.value:
+			changes = append(changes, ConfigChange{Path: o.path, Old: o.value, New: n.value})
+		}
+	}
+	for key, n := range newValues {
+		if _, ok := oldValues[key]; !ok && !n.zero {
+			changes = append(changes, ConfigChange{Path: n.path, New: n.value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Path != changes[j].Path {
+			return changes[i].Path < changes[j].Path
+		}
+		if changes[i].Old != changes[j].Old {
+			return changes[i].Old < changes[j].Old
+		}
+		return changes[i].New < changes[j].New
+	})
+	return changes, nil
+}
+
+// flattenConfig maps the settings of a configuration to their values,
+// keyed by their paths and, for the members of lists, by their values.
+// The settings of the build user and group, which melange adds to all
+// the configurations, are left out.
+func flattenConfig(cfg *Configuration) (map[string]configValue, error) {
+	c := *cfg
+	c.Environment.Accounts.Users = nil
+	c.Environment.Accounts.Groups = nil
+
+	data, err := yaml.Marshal(&c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal configuration: %w", err)
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal configuration: %w", err)
+	}
+
+	values := map[string]configValue{}
+	flattenConfigValue(values, "", tree)
+	return values, nil
+}
+
+// flattenConfigValue adds the settings of a value at path.  The empty
+// values are left out, so that a setting which is set to an empty value
+// compares equal to an unset one.
+func flattenConfigValue(values map[string]configValue, path string, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		for key, value := range v {
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+			flattenConfigValue(values, p, value)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return
+		}
+
+		if names := listNames(v); names != nil {
+			for i, value := range v {
+				flattenConfigValue(values, fmt.Sprintf("%s[%s]", path, names[i]), value)
+			}
+			return
+		}
+
+		for i, value := range v {
+			switch m := value.(type) {
+			case map[string]interface{}:
+				p := fmt.Sprintf("%s[%d]", path, i)
+				if label := stepLabel(m); label != "" {
+					p += "(" + label + ")"
+				}
+				flattenConfigValue(values, p, m)
+			case []interface{}:
+				flattenConfigValue(values, fmt.Sprintf("%s[%d]", path, i), m)
+			default:
+				s := fmt.Sprint(value)
+				values[path+"\x00"+s] = configValue{path: path, value: s}
+			}
+		}
+	default:
+		s := fmt.Sprint(v)
+		if s != "" {
+			values[path] = configValue{path: path, value: s, zero: v == 0 || v == false}
+		}
+	}
+}
+
+// listNames returns the names of the mappings of a list, such as the
+// subpackages, when all of them have distinct names, or nil.
+func listNames(list []interface{}) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, value := range list {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		name, ok := m["name"].(string)
+		if !ok || name == "" || seen[name] {
+			return nil
+		}
+		// the named steps of the pipelines are still compared
+		// in order.
+		if _, ok := m["runs"]; ok {
+			return nil
+		}
+		if _, ok := m["uses"]; ok {
+			return nil
+		}
+		names = append(names, name)
+		seen[name] = true
+	}
+	return names
+}
+
+// stepLabel labels the steps of the pipelines with the pipelines they
+// use, so that replacing a pipeline by another one is reported as the
+// removal of its settings and the addition of the ones of the other.
+func stepLabel(m map[string]interface{}) string {
+	uses, _ := m["uses"].(string)
+	return uses
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const compareOldConfig = `package:
+  name: hello
+  version: 2.12
+  epoch: 1
+  dependencies:
+    runtime: [glibc, libintl]
+environment:
+  contents:
+    packages: [busybox, build-base]
+vars:
+  prefix: /usr
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://ftp.gnu.org/gnu/hello/hello-2.12.tar.gz
+      expected-sha256: cf04af86dc085268c5f4470fbae49b18afbc221b78096aab842d934a76bad0ab
+  - runs: make install
+subpackages:
+  - name: hello-doc
+    pipeline:
+      - uses: split/manpages
+`
+
+// compareNewConfig changes the formatting and the order of the settings
+// of compareOldConfig, besides bumping it.
+const compareNewConfig = `# bumped
+package:
+  name: hello
+  epoch: 0
+  version: "2.13"
+  dependencies:
+    runtime:
+      - libintl
+      - glibc
+      - ncurses
+environment:
+  contents:
+    packages:
+      - build-base
+pipeline:
+  - uses: fetch
+    with:
+      expected-sha256: 7d0fe3ba8ac8e6b7cf34a1fc4fc2ee4f1bdda75a2d3ae4d1a0e4bd3e5cb02c2d
+      uri: https://ftp.gnu.org/gnu/hello/hello-2.13.tar.gz
+  - runs: make install
+subpackages:
+  - name: hello-lang
+    pipeline:
+      - uses: split/locales
+  - name: hello-doc
+    pipeline:
+      - uses: split/manpages
+`
+
+func TestCompareConfigs(t *testing.T) {
+	dir := t.TempDir()
+	load := func(config string) *Configuration {
+		t.Helper()
+
+		path := filepath.Join(dir, "hello.yaml")
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfigRevision(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	old, new := load(compareOldConfig), load(compareNewConfig)
+	changes, err := CompareConfigs(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ConfigChange{
+		{Path: "environment.contents.packages", Old: "busybox"},
+		{Path: "package.dependencies.runtime", New: "ncurses"},
+		{Path: "package.epoch", Old: "1", New: "0"},
+		{Path: "package.version", Old: "2.12", New: "2.13"},
+		{Path: "pipeline[0](fetch).with.expected-sha256", Old: "cf04af86dc085268c5f4470fbae49b18afbc221b78096aab842d934a76bad0ab", New: "7d0fe3ba8ac8e6b7cf34a1fc4fc2ee4f1bdda75a2d3ae4d1a0e4bd3e5cb02c2d"},
+		{Path: "pipeline[0](fetch).with.uri", Old: "https://ftp.gnu.org/gnu/hello/hello-2.12.tar.gz", New: "https://ftp.gnu.org/gnu/hello/hello-2.13.tar.gz"},
+		{Path: "subpackages[hello-lang].name", New: "hello-lang"},
+		{Path: "subpackages[hello-lang].pipeline[0](split/locales).uses", New: "split/locales"},
+		{Path: "vars.prefix", Old: "/usr"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("CompareConfigs() =\n%+v\nwant\n%+v", changes, want)
+	}
+	if kinds := []string{changes[0].Kind(), changes[1].Kind(), changes[2].Kind()}; !reflect.DeepEqual(kinds, []string{"removed", "added", "changed"}) {
+		t.Errorf("kinds = %q", kinds)
+	}
+
+	if changes, err := CompareConfigs(new, new); err != nil || len(changes) != 0 {
+		t.Errorf("CompareConfigs() of a configuration with itself = %+v, %v", changes, err)
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	path := filepath.Join(dir, "hello.yaml")
+	git := func(args ...string) {
+		t.Helper()
+
+		if _, err := gitOutput(path, append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	load(compareOldConfig)
+	git("add", "hello.yaml")
+	git("commit", "-q", "-m", "add hello")
+	load(compareNewConfig)
+
+	old, err = LoadConfigRevision(path, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := CompareConfigs(old, new); err != nil || !reflect.DeepEqual(changes, want) {
+		t.Errorf("CompareConfigs() of the committed configuration = %+v, %v", changes, err)
+	}
+}
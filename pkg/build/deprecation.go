@@ -0,0 +1,140 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"chainguard.dev/melange/pkg/sbom"
+)
+
+// endOfLifeLayout is the layout of the end of life dates.
+const endOfLifeLayout = "2006-01-02"
+
+// Deprecation marks a package as deprecated, so that its consumers move
+// to its replacement before it is removed from the repositories.  It is
+// recorded in the .PKGINFO and the SBOMs of the package.
+type Deprecation struct {
+	// Reason tells why the package is deprecated.
+	Reason string `yaml:"reason"`
+	// Replacement is the package replacing this one, if any.
+	Replacement string `yaml:"replacement"`
+	// EndOfLife is the date, YYYY-MM-DD, after which the package is
+	// no longer updated and may be removed.
+	EndOfLife string `yaml:"end-of-life"`
+}
+
+func (d *Deprecation) validate() error {
+	if d == nil {
+		return nil
+	}
+
+	if strings.ContainsAny(d.Reason, "\r\n") {
+		return fmt.Errorf("deprecation: reason must be a single line")
+	}
+	if d.Replacement != "" && (strings.ContainsAny(d.Replacement, " \t\r\n") || dependencyName(d.Replacement) != d.Replacement) {
+		return fmt.Errorf("deprecation: replacement %q must be a package name", d.Replacement)
+	}
+	if d.EndOfLife != "" {
+		if _, err := time.Parse(endOfLifeLayout, d.EndOfLife); err != nil {
+			return fmt.Errorf("deprecation: end-of-life %q must be a date, YYYY-MM-DD", d.EndOfLife)
+		}
+	}
+
+	return nil
+}
+
+// sbom returns the deprecation recorded in the SBOMs, nil for the
+// packages which are not deprecated.
+func (d *Deprecation) sbom() *sbom.Deprecation {
+	if d == nil {
+		return nil
+	}
+
+	eol, _ := time.Parse(endOfLifeLayout, d.EndOfLife)
+	return &sbom.Deprecation{Reason: d.Reason, Replacement: d.Replacement, EndOfLife: eol}
+}
+
+// substitute returns a copy of the deprecation with the replacements
+// applied to it.
+func (d *Deprecation) substitute(r *strings.Replacer) *Deprecation {
+	if d == nil {
+		return nil
+	}
+
+	return &Deprecation{
+		Reason:      r.Replace(d.Reason),
+		Replacement: r.Replace(d.Replacement),
+		EndOfLife:   d.EndOfLife,
+	}
+}
+
+// DeprecatedPackage is a deprecated package of a repository.
+type DeprecatedPackage struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Reason      string `json:"reason,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	EndOfLife   string `json:"end_of_life,omitempty"`
+}
+
+// DeprecationReport returns the deprecated packages of the repository
+// directory, every version of them, sorted by end of life, the ones
+// without end of life last, then by name and version.
+func DeprecationReport(dir string) ([]DeprecatedPackage, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := readPackageInfos(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	report := []DeprecatedPackage{}
+	for _, pi := range infos {
+		d := pi.Deprecation()
+		if d == nil {
+			continue
+		}
+		report = append(report, DeprecatedPackage{
+			Name:        pi.Get("pkgname"),
+			Version:     pi.Get("pkgver"),
+			Reason:      d.Reason,
+			Replacement: d.Replacement,
+			EndOfLife:   d.EndOfLife,
+		})
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		switch {
+		case a.EndOfLife != b.EndOfLife && (a.EndOfLife == "" || b.EndOfLife == ""):
+			return b.EndOfLife == ""
+		case a.EndOfLife != b.EndOfLife:
+			return a.EndOfLife < b.EndOfLife
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		default:
+			return a.Version < b.Version
+		}
+	})
+	return report, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"chainguard.dev/melange/pkg/apk"
+)
+
+func TestDeprecation(t *testing.T) {
+	for _, d := range []*Deprecation{
+		{EndOfLife: "30/06/2023"},
+		{Replacement: "hello>2"},
+		{Reason: "unmaintained\nupstream"},
+	} {
+		if err := d.validate(); err == nil {
+			t.Errorf("validate() accepted %+v", d)
+		}
+	}
+
+	// the subpackages are deprecated with their origin package.
+	origin := &Package{Name: "hello", Version: "2.12", Deprecation: &Deprecation{Reason: "unmaintained upstream", Replacement: "hello2", EndOfLife: "2023-06-30"}}
+	ctx := &Context{Configuration: Configuration{Package: *origin}}
+	for _, sp := range []Subpackage{{Name: "hello-doc"}, {Name: "hello-compat", Deprecation: &Deprecation{}}} {
+		pc := PackageContext{Context: ctx, Origin: origin, PackageName: sp.Name, Deprecation: sp.Deprecation}
+		if pc.Deprecation == nil {
+			pc.Deprecation = origin.Deprecation
+		}
+
+		var buf bytes.Buffer
+		if err := pc.GenerateControlData(&buf); err != nil {
+			t.Fatal(err)
+		}
+		pi, err := apk.ParsePackageInfo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := &apk.Deprecation{Reason: "unmaintained upstream", Replacement: "hello2", EndOfLife: "2023-06-30"}
+		if sp.Deprecation != nil {
+			want = &apk.Deprecation{}
+		}
+		if got := pi.Deprecation(); !reflect.DeepEqual(got, want) {
+			t.Errorf("deprecation of %s = %+v, want %+v", sp.Name, got, want)
+		}
+	}
+
+	dir := t.TempDir()
+	writePackageInfoAPK(t, filepath.Join(dir, "hello-2.12-r0.apk"), "# deprecated: unmaintained upstream\n# replacement: hello2\n# end of life: 2023-06-30\npkgname = hello\npkgver = 2.12-r0\n")
+	writePackageInfoAPK(t, filepath.Join(dir, "hello-compat-2.12-r0.apk"), "# deprecated\npkgname = hello-compat\npkgver = 2.12-r0\n")
+	writePackageInfoAPK(t, filepath.Join(dir, "libfoo-1.0-r0.apk"), "# deprecated\n# end of life: 2022-12-31\npkgname = libfoo\npkgver = 1.0-r0\n")
+	writePackageInfoAPK(t, filepath.Join(dir, "hello2-1.0-r0.apk"), "pkgname = hello2\npkgver = 1.0-r0\n")
+
+	report, err := DeprecationReport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DeprecatedPackage{
+		{Name: "libfoo", Version: "1.0-r0", EndOfLife: "2022-12-31"},
+		{Name: "hello", Version: "2.12-r0", Reason: "unmaintained upstream", Replacement: "hello2", EndOfLife: "2023-06-30"},
+		{Name: "hello-compat", Version: "2.12-r0"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("DeprecationReport() = %+v, want %+v", report, want)
+	}
+}
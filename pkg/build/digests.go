@@ -0,0 +1,54 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// packageDigests are the digest algorithms which can be recorded in the
+// packages in addition to the SHA1 digests of their files, which
+// apk-tools 2 verifies, and the SHA256 digest of their data section,
+// the datahash.
+var packageDigests = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// validateDigests checks that the digest algorithms are supported.
+func validateDigests(digests []string) error {
+	for _, alg := range digests {
+		if _, ok := packageDigests[alg]; !ok {
+			names := []string{}
+			for name := range packageDigests {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown digest algorithm %q, must be one of %s", alg, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// fileDigestRecord returns the PAX record of the digest of a file of the
+// data section, like the APK-TOOLS.checksum.SHA1 record of apk-tools.
+func fileDigestRecord(alg string) string {
+	return "APK-TOOLS.checksum." + strings.ToUpper(alg)
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// docDirs are the directories of manual and info pages, relative to the
+// output directory of a package.
+var docDirs = []string{"usr/share/man", "usr/share/info"}
+
+// compressedSuffixes are the suffixes of pages which are already
+// compressed.
+var compressedSuffixes = []string{".gz", ".bz2", ".xz", ".zst"}
+
+// compressDocs compresses the manual and info pages of the output
+// directory of a package with gzip.  The compressed pages do not record
+// a name or time, so that they are reproducible.  Symlinks to pages are
+// renamed and pointed to the compressed pages.
+func compressDocs(root string) error {
+	symlinks := []string{}
+
+	for _, dir := range docDirs {
+		err := filepath.WalkDir(filepath.Join(root, dir), func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == filepath.Join(root, dir) {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case d.Type()&fs.ModeSymlink != 0:
+				symlinks = append(symlinks, path)
+			case d.Type().IsRegular() && !isCompressed(path) && d.Name() != "dir":
+				if err := compressFile(path); err != nil {
+					return fmt.Errorf("unable to compress %s: %w", path, err)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// symlinks may point to other symlinks, which are renamed first.
+	for changed := true; changed; {
+		changed = false
+
+		remaining := []string{}
+		for _, link := range symlinks {
+			renamed, err := compressSymlink(root, link)
+			if err != nil {
+				return err
+			}
+
+			if renamed {
+				changed = true
+			} else {
+				remaining = append(remaining, link)
+			}
+		}
+		symlinks = remaining
+	}
+
+	return nil
+}
+
+func isCompressed(path string) bool {
+	for _, suffix := range compressedSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressFile replaces a file with a gzip compressed copy, named with a
+// .gz suffix.
+func compressFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gzw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(gzw, in); err != nil {
+		return err
+	}
+
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// compressSymlink renames a symlink to a page which was compressed, and
+// reports whether it did.
+func compressSymlink(root, link string) (bool, error) {
+	if isCompressed(link) {
+		return false, nil
+	}
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		return false, err
+	}
+
+	resolved := filepath.Join(filepath.Dir(link), target)
+	if filepath.IsAbs(target) {
+		resolved = filepath.Join(root, target)
+	}
+
+	if _, err := os.Lstat(resolved); err == nil {
+		return false, nil
+	}
+	if _, err := os.Lstat(resolved + ".gz"); err != nil {
+		return false, nil
+	}
+
+	if err := os.Remove(link); err != nil {
+		return false, err
+	}
+
+	if err := os.Symlink(target+".gz", link+".gz"); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressDocs(t *testing.T) {
+	root := t.TempDir()
+	man1 := filepath.Join(root, "usr/share/man/man1")
+	if err := os.MkdirAll(man1, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{
+		"foo.1":    ".TH FOO 1\n",
+		"bar.1.gz": "already compressed",
+	} {
+		if err := os.WriteFile(filepath.Join(man1, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a relative symlink, an absolute one, and one to another symlink.
+	for link, target := range map[string]string{
+		"foo-alias.1": "foo.1",
+		"foo-abs.1":   "/usr/share/man/man1/foo.1",
+		"chained.1":   "foo-alias.1",
+		"dangling.1":  "missing.1",
+	} {
+		if err := os.Symlink(target, filepath.Join(man1, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := compressDocs(root); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(man1, "foo.1.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(gzr); err != nil || string(got) != ".TH FOO 1\n" {
+		t.Errorf("foo.1.gz = %q, %v, want the page", got, err)
+	}
+	if gzr.Name != "" || !gzr.ModTime.IsZero() {
+		t.Errorf("gzip header records %q and %v, want neither", gzr.Name, gzr.ModTime)
+	}
+
+	for _, name := range []string{"foo.1", "foo-alias.1", "foo-abs.1", "chained.1"} {
+		if _, err := os.Lstat(filepath.Join(man1, name)); err == nil {
+			t.Errorf("%s still exists", name)
+		}
+	}
+
+	for link, want := range map[string]string{
+		"foo-alias.1.gz": "foo.1.gz",
+		"foo-abs.1.gz":   "/usr/share/man/man1/foo.1.gz",
+		"chained.1.gz":   "foo-alias.1.gz",
+		"dangling.1":     "missing.1",
+	} {
+		if got, err := os.Readlink(filepath.Join(man1, link)); err != nil || got != want {
+			t.Errorf("%s -> %q, %v, want %q", link, got, err, want)
+		}
+	}
+
+	if got, err := os.ReadFile(filepath.Join(man1, "bar.1.gz")); err != nil || string(got) != "already compressed" {
+		t.Errorf("bar.1.gz = %q, %v, want it unchanged", got, err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The locale and timezone of the pipelines, unless melange is told
+// otherwise.  Locale-dependent tools, such as sort or date, would
+// otherwise produce output depending on the host of the build.
+const (
+	defaultLocale   = "C.UTF-8"
+	defaultTimezone = "UTC"
+)
+
+// scriptEnvironment returns the variables exported by the scripts of the
+// pipelines, as KEY=value.
+func (ctx *Context) scriptEnvironment() ([]string, error) {
+	locale := ctx.locale()
+	env := []string{
+		"LANG=" + locale,
+		"LC_ALL=" + locale,
+		// LANGUAGE takes precedence over LC_ALL for the
+		// translated messages of gettext.
+		"LANGUAGE=",
+		"TZ=" + ctx.timezone(),
+	}
+
+	dirs, err := ctx.sandboxDirEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, dirs...)
+	env = append(env, ctx.goCacheEnvironment()...)
+	env = append(env, ctx.javaEnvironment()...)
+
+	faketime, err := ctx.faketimeEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, faketime...)
+
+	env = append(env, ctx.passEnvironment()...)
+
+	return env, nil
+}
+
+// locale returns the locale of the pipelines.
+func (ctx *Context) locale() string {
+	if ctx.Configuration.Package.Locale != "" {
+		return ctx.Configuration.Package.Locale
+	}
+	if ctx.Locale != "" {
+		return ctx.Locale
+	}
+	return defaultLocale
+}
+
+// timezone returns the timezone of the pipelines.
+func (ctx *Context) timezone() string {
+	if ctx.Configuration.Package.Timezone != "" {
+		return ctx.Configuration.Package.Timezone
+	}
+	if ctx.Timezone != "" {
+		return ctx.Timezone
+	}
+	return defaultTimezone
+}
+
+// validateLocale checks a locale name, such as C.UTF-8 or
+// en_US.UTF-8@euro.
+func validateLocale(locale string) error {
+	if locale == "" || strings.Trim(locale, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_.-@") != "" {
+		return fmt.Errorf("locale %q is not a locale name, such as C.UTF-8", locale)
+	}
+	return nil
+}
+
+// validateTimezone checks a timezone name, such as UTC or
+// Europe/Berlin.
+func validateTimezone(timezone string) error {
+	if timezone == "" || strings.Trim(timezone, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_+-/:") != "" {
+		return fmt.Errorf("timezone %q is not a timezone name, such as UTC", timezone)
+	}
+	return nil
+}
+
+// exportEnvironment returns the shell commands exporting the variables
+// of env.
+func exportEnvironment(env []string) string {
+	var b strings.Builder
+	for _, kv := range env {
+		k, v := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		fmt.Fprintf(&b, "export %s=%s\n", k, shellQuote(v))
+	}
+	return b.String()
+}
+
+// shellQuote quotes s for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
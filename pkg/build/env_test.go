@@ -0,0 +1,82 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScriptEnvironmentLocale(t *testing.T) {
+	tests := []struct {
+		ctx          *Context
+		locale, tz   string
+		wantLocale   string
+		wantTimezone string
+	}{{
+		ctx:          &Context{},
+		wantLocale:   "C.UTF-8",
+		wantTimezone: "UTC",
+	}, {
+		ctx:          &Context{Locale: "en_US.UTF-8", Timezone: "Europe/Berlin"},
+		wantLocale:   "en_US.UTF-8",
+		wantTimezone: "Europe/Berlin",
+	}, {
+		ctx:          &Context{Locale: "en_US.UTF-8", Timezone: "Europe/Berlin"},
+		locale:       "de_DE.UTF-8@euro",
+		tz:           "America/New_York",
+		wantLocale:   "de_DE.UTF-8@euro",
+		wantTimezone: "America/New_York",
+	}}
+
+	for _, tt := range tests {
+		tt.ctx.Configuration.Package.Locale = tt.locale
+		tt.ctx.Configuration.Package.Timezone = tt.tz
+
+		env, err := tt.ctx.scriptEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"LANG=" + tt.wantLocale, "LC_ALL=" + tt.wantLocale, "LANGUAGE=", "TZ=" + tt.wantTimezone}
+		if !reflect.DeepEqual(env[:len(want)], want) {
+			t.Errorf("scriptEnvironment() = %q, want %q first", env, want)
+		}
+	}
+}
+
+func TestValidateLocaleTimezone(t *testing.T) {
+	for _, locale := range []string{"C", "C.UTF-8", "en_US.ISO-8859-1", "sr_RS@latin"} {
+		if err := validateLocale(locale); err != nil {
+			t.Errorf("validateLocale(%q) = %v", locale, err)
+		}
+	}
+	for _, locale := range []string{"", "en US", "C'; rm -rf /"} {
+		if err := validateLocale(locale); err == nil {
+			t.Errorf("validateLocale(%q) succeeded", locale)
+		}
+	}
+
+	for _, tz := range []string{"UTC", "Europe/Berlin", "Etc/GMT+5", "America/Port-au-Prince"} {
+		if err := validateTimezone(tz); err != nil {
+			t.Errorf("validateTimezone(%q) = %v", tz, err)
+		}
+	}
+	for _, tz := range []string{"", "Europe Berlin", "$(id)"} {
+		if err := validateTimezone(tz); err == nil {
+			t.Errorf("validateTimezone(%q) succeeded", tz)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FaketimeSourceDateEpoch runs the pipelines at the source date epoch of
+// the build.
+const FaketimeSourceDateEpoch = "source-date-epoch"
+
+// faketimeLibrary is where libfaketime is installed in the build
+// environment.
+const faketimeLibrary = "/usr/lib/faketime/libfaketime.so.1"
+
+// faketimeLayouts are the accepted layouts of the faketime date.
+var faketimeLayouts = []string{time.RFC3339, "2006-01-02"}
+
+// validateFaketime checks the faketime setting of a package.
+func validateFaketime(value string) error {
+	if value == "" || value == FaketimeSourceDateEpoch {
+		return nil
+	}
+
+	if _, err := parseFaketime(value); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseFaketime parses a faketime date.
+func parseFaketime(value string) (time.Time, error) {
+	for _, layout := range faketimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("faketime: %q is neither %s nor a date such as 2022-01-01 or 2022-01-01T00:00:00Z", value, FaketimeSourceDateEpoch)
+}
+
+// faketime returns the date the pipelines run at, if the package sets
+// one.
+func (ctx *Context) faketime() (time.Time, bool, error) {
+	value := ctx.Configuration.Package.Faketime
+	switch value {
+	case "":
+		return time.Time{}, false, nil
+	case FaketimeSourceDateEpoch:
+		if ctx.SourceDateEpoch.IsZero() {
+			return time.Time{}, false, errors.New("faketime: the source date epoch of the build is not set")
+		}
+		return ctx.SourceDateEpoch, true, nil
+	}
+
+	t, err := parseFaketime(value)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// faketimeEnvironment returns the variables preloading libfaketime into
+// the pipelines, so that the clock starts at the date of the package.
+// The clock still advances, and the monotonic clocks are not faked, as
+// build tools measuring timeouts with them would hang.
+//
+// Time namespaces only offset the monotonic and boot clocks, not the
+// time of day, so they cannot serve date-sensitive test suites.
+// Statically linked programs do not load libfaketime.
+func (ctx *Context) faketimeEnvironment() ([]string, error) {
+	t, ok, err := ctx.faketime()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	// libfaketime reads the date in the timezone of the pipelines.
+	loc, err := time.LoadLocation(ctx.timezone())
+	if err != nil {
+		loc = time.UTC
+	}
+
+	return []string{
+		"LD_PRELOAD=" + faketimeLibrary,
+		"FAKETIME=@" + t.In(loc).Format("2006-01-02 15:04:05"),
+		"FAKETIME_DONT_FAKE_MONOTONIC=1",
+	}, nil
+}
+
+// checkFaketime checks that libfaketime is installed in the build
+// environment, if the package sets a date.
+func (ctx *Context) checkFaketime() error {
+	if _, ok, err := ctx.faketime(); err != nil || !ok {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(ctx.GuestDir, faketimeLibrary)); err != nil {
+		return fmt.Errorf("faketime needs libfaketime in the build environment: %w", err)
+	}
+
+	return nil
+}
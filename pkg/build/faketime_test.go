@@ -0,0 +1,104 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFaketimeEnvironment(t *testing.T) {
+	tests := []struct {
+		faketime string
+		epoch    time.Time
+		want     string
+		wantErr  bool
+	}{
+		{faketime: ""},
+		{faketime: "2022-01-01", want: "@2022-01-01 00:00:00"},
+		{faketime: "2022-03-04T05:06:07+01:00", want: "@2022-03-04 04:06:07"},
+		{faketime: FaketimeSourceDateEpoch, epoch: time.Unix(1650000000, 0), want: "@2022-04-15 05:20:00"},
+		{faketime: FaketimeSourceDateEpoch, wantErr: true},
+		{faketime: "next tuesday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		ctx := &Context{SourceDateEpoch: tt.epoch}
+		ctx.Configuration.Package.Faketime = tt.faketime
+
+		env, err := ctx.faketimeEnvironment()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: faketimeEnvironment() error = %v, wantErr %t", tt.faketime, err, tt.wantErr)
+			continue
+		}
+
+		var want []string
+		if tt.want != "" {
+			want = []string{"LD_PRELOAD=" + faketimeLibrary, "FAKETIME=" + tt.want, "FAKETIME_DONT_FAKE_MONOTONIC=1"}
+		}
+		if !reflect.DeepEqual(env, want) {
+			t.Errorf("%q: faketimeEnvironment() = %q, want %q", tt.faketime, env, want)
+		}
+	}
+
+	// the date is given in the timezone of the pipelines.
+	if _, err := time.LoadLocation("Asia/Tokyo"); err == nil {
+		ctx := &Context{Timezone: "Asia/Tokyo"}
+		ctx.Configuration.Package.Faketime = "2022-01-01T00:00:00Z"
+
+		env, err := ctx.faketimeEnvironment()
+		if err != nil || env[1] != "FAKETIME=@2022-01-01 09:00:00" {
+			t.Errorf("faketimeEnvironment() in Asia/Tokyo = %q, %v", env, err)
+		}
+	}
+
+	if err := validateFaketime("next tuesday"); err == nil {
+		t.Error("validateFaketime() succeeded for an invalid date")
+	}
+}
+
+func TestCheckFaketime(t *testing.T) {
+	ctx := &Context{GuestDir: t.TempDir()}
+	if err := ctx.checkFaketime(); err != nil {
+		t.Errorf("checkFaketime() without faketime = %v", err)
+	}
+
+	ctx.Configuration.Package.Faketime = "2022-01-01"
+	if err := ctx.checkFaketime(); err == nil {
+		t.Error("checkFaketime() succeeded without libfaketime")
+	}
+
+	lib := filepath.Join(ctx.GuestDir, faketimeLibrary)
+	if err := os.MkdirAll(filepath.Dir(lib), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lib, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.checkFaketime(); err != nil {
+		t.Errorf("checkFaketime() = %v", err)
+	}
+}
+
+func TestExportEnvironment(t *testing.T) {
+	got := exportEnvironment([]string{"FAKETIME=@2022-01-01 00:00:00", "QUOTE=it's"})
+	want := "export FAKETIME='@2022-01-01 00:00:00'\nexport QUOTE='it'\\''s'\n"
+	if got != want {
+		t.Errorf("exportEnvironment() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fetchAttempts is the number of times the candidate URLs of a source
+// are tried, one after the other, before the fetch fails.
+const fetchAttempts = 3
+
+// fetchBackoff is the delay before the candidate URLs of a source are
+// tried again, which doubles after every attempt.
+var fetchBackoff = 2 * time.Second
+
+// fetchedSource is a source fetched by the fetch pipeline.
+type fetchedSource struct {
+	// URI is the uri input of the pipeline.
+	URI string
+	// URL is the candidate the source was fetched from, the uri or
+	// one of the mirrors.
+	URL    string
+	SHA256 string
+}
+
+// fetchSource downloads the source of a fetch pipeline into the
+// workspace, given the inputs of the pipeline.  The uri and the
+// whitespace separated mirrors are candidates which are tried in turn,
+// until one serves a file with the expected SHA256 digest.  Candidates
+// serving another file are not tried again, while failed requests are
+// retried after a delay.
+func (ctx *Context) fetchSource(with map[string]string) error {
+	uri := with["${{inputs.uri}}"]
+	expected := strings.ToLower(with["${{inputs.expected-sha256}}"])
+	if expected == "" || strings.HasPrefix(expected, "${{") {
+		return fmt.Errorf("fetching %s requires its expected-sha256", uri)
+	}
+
+	candidates := []string{uri}
+	if mirrors, ok := with["${{inputs.mirrors}}"]; ok && !strings.HasPrefix(mirrors, "${{") {
+		candidates = append(candidates, strings.Fields(mirrors)...)
+	}
+
+	// the fetch pipeline expects the source as the base name of the
+	// uri, whichever candidate serves it.
+	dest := filepath.Join(ctx.WorkspaceDir, path.Base(uri))
+
+	if ctx.restoreSource(expected, dest) {
+		log.Printf("restored %s from the remote cache", path.Base(uri))
+		ctx.fetchedSources = append(ctx.fetchedSources, fetchedSource{URI: uri, URL: uri, SHA256: expected})
+		return nil
+	}
+
+	failures := []string{}
+	backoff := fetchBackoff
+	for attempt := 1; attempt <= fetchAttempts && len(candidates) > 0; attempt++ {
+		if attempt > 1 {
+			log.Printf("retrying the fetch of %s in %s", path.Base(uri), backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		retry := []string{}
+		for _, url := range candidates {
+			err := ctx.download(url, dest, expected)
+			if err == nil {
+				log.Printf("fetched %s from %s", path.Base(uri), url)
+				ctx.storeSource(expected, dest)
+				ctx.fetchedSources = append(ctx.fetchedSources, fetchedSource{URI: uri, URL: url, SHA256: expected})
+				return nil
+			}
+
+			log.Printf("warning: unable to fetch %s: %v", url, err)
+			failures = append(failures, err.Error())
+
+			var mismatch *digestMismatchError
+			if !errors.As(err, &mismatch) {
+				retry = append(retry, url)
+			}
+		}
+		candidates = retry
+	}
+
+	return fmt.Errorf("unable to fetch %s from any of its URLs: %s", uri, strings.Join(failures, "; "))
+}
+
+// digestMismatchError is a download whose digest is not the expected
+// one, which is not worth retrying.
+type digestMismatchError struct {
+	url, digest, expected string
+}
+
+func (e *digestMismatchError) Error() string {
+	return fmt.Sprintf("%s has digest %s, expected %s", e.url, e.digest, e.expected)
+}
+
+// download writes the file at url to dest, if its SHA256 digest is the
+// expected one.
+func (ctx *Context) download(url, dest, expected string) error {
+	resp, err := ctx.client().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	return saveVerified(resp.Body, url, dest, expected)
+}
+
+// saveVerified writes the file read from r, which was fetched from url,
+// to dest, if its SHA256 digest is the expected one.
+func saveVerified(r io.Reader, url, dest, expected string) error {
+	f, err := os.CreateTemp(filepath.Dir(dest), ".melange-fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", url, err)
+	}
+
+	if digest := fmt.Sprintf("%x", h.Sum(nil)); digest != expected {
+		return &digestMismatchError{url: url, digest: digest, expected: expected}
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), dest)
+}
+
+// FetchedSources describes the sources fetched by the build, and the
+// URLs they were fetched from, for the provenance of the packages.
+func (ctx *Context) FetchedSources() []string {
+	sources := []string{}
+	for _, s := range ctx.fetchedSources {
+		sources = append(sources, fmt.Sprintf("%s sha256:%s", s.URL, s.SHA256))
+	}
+	return sources
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFetchSource(t *testing.T) {
+	fetchBackoff = 0
+	source := "hello, world\n"
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(source)))
+
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/flaky/hello.tar.gz":
+			// fails the first attempt only.
+			if requests[r.URL.Path] == 1 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, source)
+		case "/tampered/hello.tar.gz":
+			fmt.Fprint(w, "tampered\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := &Context{WorkspaceDir: t.TempDir()}
+	with := map[string]string{
+		"${{inputs.uri}}":             srv.URL + "/gone/hello.tar.gz",
+		"${{inputs.mirrors}}":         srv.URL + "/tampered/hello.tar.gz\n" + srv.URL + "/flaky/hello.tar.gz",
+		"${{inputs.expected-sha256}}": digest,
+	}
+	if err := ctx.fetchSource(with); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "hello.tar.gz"))
+	if err != nil || string(data) != source {
+		t.Errorf("fetched %q, %v", data, err)
+	}
+
+	// the tampered mirror is not tried again.
+	want := map[string]int{"/gone/hello.tar.gz": 2, "/tampered/hello.tar.gz": 1, "/flaky/hello.tar.gz": 2}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+
+	if got := ctx.FetchedSources(); !reflect.DeepEqual(got, []string{srv.URL + "/flaky/hello.tar.gz sha256:" + digest}) {
+		t.Errorf("FetchedSources() = %q", got)
+	}
+
+	with["${{inputs.mirrors}}"] = srv.URL + "/tampered/hello.tar.gz"
+	if err := ctx.fetchSource(with); err == nil {
+		t.Errorf("fetching from failing mirrors succeeded")
+	}
+
+	delete(with, "${{inputs.expected-sha256}}")
+	if err := ctx.fetchSource(with); err == nil {
+		t.Errorf("fetching without an expected digest succeeded")
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// defaultFetchCacheSize bounds the memory used by the fetch cache of a
+// batch.  Responses which do not fit are still fetched, but streamed
+// through instead of kept.
+const defaultFetchCacheSize = 1 << 30
+
+// fetchCache keeps the repository indexes and packages fetched by the
+// builds of a batch in memory, so that builds with the same environment
+// download them once.  Concurrent requests for the same URL wait for a
+// single fetch.  Only successful responses are kept.
+type fetchCache struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*fetchEntry
+	size    int64
+	hits    int
+	misses  int
+}
+
+// fetchEntry is a response of the fetch cache, which is ready when done
+// is closed.
+type fetchEntry struct {
+	done chan struct{}
+	resp *cachedResponse
+	err  error
+}
+
+// cachedResponse is a fetched response.  Responses which do not fit in
+// the cache have no data, but a body which streams them to the single
+// caller which fetched them.
+type cachedResponse struct {
+	status int
+	header http.Header
+	data   []byte
+	body   io.ReadCloser
+}
+
+// open returns a reader of the response.
+func (r *cachedResponse) open() io.ReadCloser {
+	if r.body != nil {
+		return r.body
+	}
+
+	return io.NopCloser(bytes.NewReader(r.data))
+}
+
+func newFetchCache(maxSize int64) *fetchCache {
+	return &fetchCache{
+		maxSize: maxSize,
+		entries: map[string]*fetchEntry{},
+	}
+}
+
+// get returns the response of a GET request of url, fetching it with
+// client unless it is cached.
+func (fc *fetchCache) get(client *http.Client, url string) (*cachedResponse, error) {
+	fc.mu.Lock()
+	if e, ok := fc.entries[url]; ok {
+		fc.hits++
+		fc.mu.Unlock()
+
+		<-e.done
+		if e.err == nil && e.resp.body != nil {
+			// the response was streamed to the fetching build, which
+			// cannot be shared.
+			fc.mu.Lock()
+			fc.hits--
+			fc.misses++
+			fc.mu.Unlock()
+
+			return fetchResponse(client, url, 0)
+		}
+		return e.resp, e.err
+	}
+
+	e := &fetchEntry{done: make(chan struct{})}
+	fc.entries[url] = e
+	fc.misses++
+	budget := fc.maxSize - fc.size
+	fc.mu.Unlock()
+
+	e.resp, e.err = fetchResponse(client, url, budget)
+
+	fc.mu.Lock()
+	if e.err != nil || e.resp.status != http.StatusOK || e.resp.body != nil || fc.size+int64(len(e.resp.data)) > fc.maxSize {
+		delete(fc.entries, url)
+	} else {
+		fc.size += int64(len(e.resp.data))
+	}
+	fc.mu.Unlock()
+
+	close(e.done)
+
+	return e.resp, e.err
+}
+
+// stats returns the number of requests served from the cache, the number
+// of fetches and the size of the cached responses.
+func (fc *fetchCache) stats() (hits, misses int, size int64) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return fc.hits, fc.misses, fc.size
+}
+
+// fetchResponse fetches url and reads the response, unless it is larger
+// than budget, in which case it is streamed through.
+func fetchResponse(client *http.Client, url string, budget int64) (*cachedResponse, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &cachedResponse{
+		status: resp.StatusCode,
+		header: resp.Header,
+	}
+
+	if resp.StatusCode == http.StatusOK && resp.ContentLength > budget {
+		cr.body = resp.Body
+		return cr, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, budget+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("reading %s: %w", url, err)
+	}
+
+	if int64(len(data)) > budget {
+		cr.body = &struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return cr, nil
+	}
+	resp.Body.Close()
+
+	cr.data = data
+	return cr, nil
+}
+
+// cachingDialer dials with the addresses of a host resolved by an
+// earlier connection, so that the builds of a batch resolve each
+// repository host once.
+type cachingDialer struct {
+	dialer   net.Dialer
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	addrs map[string][]string
+}
+
+func newCachingDialer() *cachingDialer {
+	return &cachingDialer{
+		resolver: net.DefaultResolver,
+		addrs:    map[string][]string{},
+	}
+}
+
+// DialContext connects to the address on the named network, trying the
+// addresses of the host in turn.
+func (d *cachingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// lookup returns the addresses of a host.
+func (d *cachingDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	addrs, ok := d.addrs[host]
+	d.mu.Unlock()
+	if ok {
+		return addrs, nil
+	}
+
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.addrs[host] = addrs
+	d.mu.Unlock()
+
+	return addrs, nil
+}
+
+// newBatchTransport returns the transport shared by the builds of a
+// batch, based on their own, which keeps connections to the repositories
+// alive between builds and caches the addresses of their hosts.
+func newBatchTransport(base *http.Transport) http.RoundTripper {
+	t := base.Clone()
+	t.DialContext = newCachingDialer().DialContext
+
+	return t
+}
+
+// shareFetches makes the build use the fetch cache and transport shared
+// by the builds of a batch.
+func (ctx *Context) shareFetches(cache *fetchCache, transport http.RoundTripper) {
+	ctx.fetchCache = cache
+
+	if ctx.httpClient == nil {
+		ctx.httpClient = &http.Client{Transport: transport}
+		return
+	}
+
+	if at, ok := ctx.httpClient.Transport.(*authTransport); ok {
+		at.base = transport
+		return
+	}
+	ctx.httpClient = &http.Client{Transport: transport}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+func TestFetchCache(t *testing.T) {
+	var fetches int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+
+		switch r.URL.Path {
+		case "/foo.apk":
+			io.WriteString(w, "foo") // nolint:errcheck
+		case "/large.apk":
+			io.WriteString(w, "too large for the cache") // nolint:errcheck
+		case "/chunked.apk":
+			// without a Content-Length, the size is only known
+			// while reading.
+			io.WriteString(w, "too large ") // nolint:errcheck
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "and chunked") // nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	fc := newFetchCache(8)
+
+	// concurrent requests wait for a single fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := fc.get(http.DefaultClient, upstream.URL+"/foo.apk")
+			if err != nil || resp.status != http.StatusOK || string(resp.data) != "foo" {
+				t.Errorf("get() = %v, %v", resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+
+	// errors and responses which do not fit are not kept.
+	for i := 0; i < 2; i++ {
+		if resp, err := fc.get(http.DefaultClient, upstream.URL+"/missing.apk"); err != nil || resp.status != http.StatusNotFound {
+			t.Errorf("get() = %v, %v, want not found", resp, err)
+		}
+		for path, want := range map[string]string{
+			"/large.apk":   "too large for the cache",
+			"/chunked.apk": "too large and chunked",
+		} {
+			resp, err := fc.get(http.DefaultClient, upstream.URL+path)
+			if err != nil {
+				t.Fatalf("get(%s): %v", path, err)
+			}
+
+			// responses which do not fit are streamed, not buffered.
+			if resp.data != nil {
+				t.Errorf("get(%s) buffered %q", path, resp.data)
+			}
+
+			r := resp.open()
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(data) != want {
+				t.Errorf("get(%s) = %q, %v, want %q", path, data, err, want)
+			}
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 7 {
+		t.Errorf("fetched %d times, want 7", n)
+	}
+
+	if hits, misses, size := fc.stats(); hits != 9 || misses != 7 || size != 3 {
+		t.Errorf("stats() = %d, %d, %d, want 9, 7, 3", hits, misses, size)
+	}
+}
+
+func TestRepositoryMirrorFetchCache(t *testing.T) {
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+
+	var fetches int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+
+		switch r.URL.Path {
+		case "/main/" + arch + "/APKINDEX.tar.gz":
+			io.WriteString(w, "index") // nolint:errcheck
+		case "/main/" + arch + "/foo-1.0-r0.apk":
+			io.WriteString(w, "package") // nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	cache := newFetchCache(defaultFetchCacheSize)
+	transport := newBatchTransport(http.DefaultTransport.(*http.Transport))
+
+	// two builds of a batch with the same environment.
+	for i := 0; i < 2; i++ {
+		ctx := &Context{}
+		ctx.Configuration.Environment.Contents.Repositories = []string{upstream.URL + "/main"}
+		ctx.shareFetches(cache, transport)
+
+		indexes, err := ctx.fetchIndexes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := ctx.startRepositoryMirror(indexes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.Get(m.repositories[0] + "/" + arch + "/foo-1.0-r0.apk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(data) != "package" {
+			t.Errorf("package = %q, %v", data, err)
+		}
+
+		m.Close()
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("fetched %d times from upstream, want 2", n)
+	}
+}
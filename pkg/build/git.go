@@ -0,0 +1,103 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitOutput runs git in the directory containing path and returns its
+// trimmed standard output.
+func gitOutput(path string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = filepath.Dir(path)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitCommitTime returns the commit date of the last commit which
+// modified the file at path.
+func gitCommitTime(path string) (time.Time, error) {
+	out, err := gitOutput(path, "log", "-1", "--format=%ct", "--", filepath.Base(path))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if out == "" {
+		return time.Time{}, fmt.Errorf("%s has not been committed", path)
+	}
+
+	sec, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse commit date: %w", err)
+	}
+
+	return time.Unix(sec, 0), nil
+}
+
+// GitMetadata describes the git commit a configuration file was built
+// from.
+type GitMetadata struct {
+	Commit string
+	Author string
+	// Dirty is set when the configuration file has uncommitted
+	// changes, in which case the build does not exactly match Commit.
+	Dirty bool
+}
+
+// gitMetadata captures the last commit which modified the file at path.
+// Only that file is considered, so that unrelated commits and files,
+// such as the packages written next to it, do not change the metadata
+// recorded in the packages.
+func gitMetadata(path string) (*GitMetadata, error) {
+	out, err := gitOutput(path, "log", "-1", "--format=%H%n%an <%ae>", "--", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if out == "" {
+		return nil, fmt.Errorf("%s has not been committed", path)
+	}
+
+	lines := strings.SplitN(out, "\n", 2)
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("unexpected git log output: %q", out)
+	}
+
+	status, err := gitOutput(path, "status", "--porcelain", "--", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &GitMetadata{
+		Commit: lines[0],
+		Author: lines[1],
+		Dirty:  status != "",
+	}, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitMetadata(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "foo.yaml")
+
+	git := func(args ...string) string {
+		t.Helper()
+
+		out, err := gitOutput(config, append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	write := func(name, content string) {
+		t.Helper()
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "-q")
+	write("foo.yaml", "package: {}\n")
+	git("add", "foo.yaml")
+	git("commit", "-q", "-m", "add foo")
+	configCommit := git("rev-parse", "HEAD")
+
+	// unrelated commits and files do not affect the metadata.
+	write("other.yaml", "package: {}\n")
+	git("add", "other.yaml")
+	git("commit", "-q", "-m", "add other")
+	write("foo-1.0-r0.apk", "package")
+
+	md, err := gitMetadata(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := GitMetadata{Commit: configCommit, Author: "Test <test@example.com>"}
+	if *md != want {
+		t.Errorf("gitMetadata() = %+v, want %+v", *md, want)
+	}
+
+	write("foo.yaml", "package: {name: foo}\n")
+
+	md, err = gitMetadata(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !md.Dirty {
+		t.Error("gitMetadata() is not dirty after modifying the configuration")
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultGoCacheSize bounds the size of the Go caches kept in the
+	// cache directory.
+	defaultGoCacheSize = 10 << 30
+
+	// goCacheGuestDir is where the Go caches are bound in the build
+	// environment.
+	goCacheGuestDir = "/var/cache/melange/go"
+
+	// cacheStamp is touched in the caches of a toolchain whenever a
+	// build uses them, to evict the least recently used caches first.
+	cacheStamp = ".last-used"
+)
+
+// goRoots are the GOROOTs of the Go toolchains of the build
+// environments, relative to their root.
+var goRoots = []string{"usr/lib/go", "usr/local/go"}
+
+// goCache is the module and build cache of a Go toolchain, which is
+// shared by the builds using the same toolchain version.  The builds
+// hold a shared lock of the cache, so that it is not evicted while
+// they use it; the go command locks the files of the caches itself.
+type goCache struct {
+	dir  string
+	lock *os.File
+}
+
+// goToolchainVersion returns the version of the Go toolchain installed
+// in the build environment, such as go1.21.3, or an empty string if
+// none is installed.
+func (ctx *Context) goToolchainVersion() (string, error) {
+	for _, goroot := range goRoots {
+		data, err := os.ReadFile(filepath.Join(ctx.GuestDir, goroot, "VERSION"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		version := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+		if !strings.HasPrefix(version, "go") || strings.Trim(version, "abcdefghijklmnopqrstuvwxyz0123456789.-+") != "" {
+			return "", fmt.Errorf("%s/VERSION does not start with a Go version: %q", goroot, version)
+		}
+		return version, nil
+	}
+
+	return "", nil
+}
+
+// goCacheRoot returns the directory of the Go caches in the cache
+// directory.
+func (ctx *Context) goCacheRoot() string {
+	return filepath.Join(ctx.CacheDir, "go")
+}
+
+// openGoCache binds the caches of the Go toolchain of the build
+// environment, if any, into it.  The caches are only kept in a cache
+// directory, and not at all when their size is bounded to 0.
+func (ctx *Context) openGoCache() error {
+	if ctx.CacheDir == "" || ctx.GoCacheSize <= 0 {
+		return nil
+	}
+
+	version, err := ctx.goToolchainVersion()
+	if err != nil {
+		return fmt.Errorf("unable to find the Go toolchain: %w", err)
+	}
+	if version == "" {
+		return nil
+	}
+
+	root := ctx.goCacheRoot()
+	dir := filepath.Join(root, version)
+	for _, d := range []string{filepath.Join(dir, "mod"), filepath.Join(dir, "build"), filepath.Join(ctx.GuestDir, goCacheGuestDir)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("unable to create the Go caches: %w", err)
+		}
+	}
+
+	lock, err := useCache(dir)
+	if err != nil {
+		return fmt.Errorf("unable to use the Go caches: %w", err)
+	}
+
+	log.Printf("using the Go caches of %s in %s", version, dir)
+	ctx.goCache = &goCache{dir: dir, lock: lock}
+
+	return nil
+}
+
+// closeGoCache releases the Go caches of the build, and evicts the least
+// recently used caches above the size bound.
+func (ctx *Context) closeGoCache() {
+	if ctx.goCache == nil {
+		return
+	}
+
+	ctx.goCache.lock.Close()
+	ctx.goCache = nil
+
+	if err := evictCaches(ctx.goCacheRoot(), ctx.GoCacheSize); err != nil {
+		log.Printf("warning: unable to evict Go caches: %v", err)
+	}
+}
+
+// goCacheBinds returns the directories of the host bound into the build
+// environment for the Go caches, keyed by their path in the build
+// environment.
+func (ctx *Context) goCacheBinds() map[string]string {
+	if ctx.goCache == nil {
+		return nil
+	}
+	return map[string]string{goCacheGuestDir: ctx.goCache.dir}
+}
+
+// goCacheEnvironment returns the variables locating the Go caches.
+func (ctx *Context) goCacheEnvironment() []string {
+	if ctx.goCache == nil {
+		return nil
+	}
+	return []string{
+		"GOMODCACHE=" + goCacheGuestDir + "/mod",
+		"GOCACHE=" + goCacheGuestDir + "/build",
+	}
+}
+
+// useCache holds a shared lock of the cache in dir, so that it is not
+// evicted while the build uses it, and records its use.  The lock is
+// released by closing the returned file.
+func useCache(dir string) (*os.File, error) {
+	// the lock is kept outside of the cache, which is removed when
+	// evicted.
+	lock, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_SH); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, cacheStamp), nil, 0644); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(dir, cacheStamp), now, now); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// evictCaches removes the least recently used caches of root, such as
+// the caches of the Go toolchains, until they fit in maxSize.  The
+// caches in use by builds are kept.
+func evictCaches(root string, maxSize int64) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+
+	type cacheDir struct {
+		dir      string
+		size     int64
+		lastUsed time.Time
+	}
+
+	caches := []cacheDir{}
+	var total int64
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		c := cacheDir{dir: filepath.Join(root, e.Name())}
+		if fi, err := os.Stat(filepath.Join(c.dir, cacheStamp)); err == nil {
+			c.lastUsed = fi.ModTime()
+		}
+		c.size, err = dirSize(c.dir)
+		if err != nil {
+			return err
+		}
+
+		caches = append(caches, c)
+		total += c.size
+	}
+
+	sort.Slice(caches, func(i, j int) bool { return caches[i].lastUsed.Before(caches[j].lastUsed) })
+
+	for _, c := range caches {
+		if total <= maxSize {
+			break
+		}
+
+		evicted, err := evictCache(c.dir)
+		if err != nil {
+			return err
+		}
+		if evicted {
+			log.Printf("evicted the caches in %s (%d bytes)", c.dir, c.size)
+			total -= c.size
+		}
+	}
+
+	return nil
+}
+
+// evictCache removes the cache in dir, unless a build uses it.
+func evictCache(dir string) (bool, error) {
+	lock, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// the go command makes the module cache read-only.
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.Chmod(path, 0755)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, os.RemoveAll(dir)
+}
+
+// dirSize returns the size of the regular files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGoToolchainVersion(t *testing.T) {
+	ctx := &Context{GuestDir: t.TempDir()}
+	if version, err := ctx.goToolchainVersion(); err != nil || version != "" {
+		t.Errorf("goToolchainVersion() without toolchain = %q, %v", version, err)
+	}
+
+	path := filepath.Join(ctx.GuestDir, "usr/lib/go/VERSION")
+	writeFile(t, path, "go1.21.3\ntime 2023-10-09T17:04:35Z\n")
+	if version, err := ctx.goToolchainVersion(); err != nil || version != "go1.21.3" {
+		t.Errorf("goToolchainVersion() = %q, %v, want go1.21.3", version, err)
+	}
+
+	writeFile(t, path, "../../etc\n")
+	if _, err := ctx.goToolchainVersion(); err == nil {
+		t.Error("goToolchainVersion() accepted an invalid version")
+	}
+}
+
+func TestOpenGoCache(t *testing.T) {
+	ctx := &Context{
+		Runner:       "bubblewrap",
+		GuestDir:     t.TempDir(),
+		WorkspaceDir: "/work",
+		CacheDir:     t.TempDir(),
+		GoCacheSize:  defaultGoCacheSize,
+	}
+	ctx.Configuration.Package.Sandbox.Seccomp = SeccompUnconfined
+
+	// without a toolchain, no cache is used.
+	if err := ctx.openGoCache(); err != nil || ctx.goCache != nil {
+		t.Fatalf("openGoCache() without toolchain = %v", err)
+	}
+
+	writeFile(t, filepath.Join(ctx.GuestDir, "usr/lib/go/VERSION"), "go1.21.3\n")
+	if err := ctx.openGoCache(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.closeGoCache()
+
+	dir := filepath.Join(ctx.CacheDir, "go", "go1.21.3")
+	for _, d := range []string{filepath.Join(dir, "mod"), filepath.Join(dir, "build"), filepath.Join(ctx.GuestDir, goCacheGuestDir)} {
+		if fi, err := os.Stat(d); err != nil || !fi.IsDir() {
+			t.Errorf("%s is not a directory: %v", d, err)
+		}
+	}
+
+	env, err := ctx.scriptEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"GOMODCACHE=/var/cache/melange/go/mod", "GOCACHE=/var/cache/melange/go/build"} {
+		if !strings.Contains(strings.Join(env, "\n"), want) {
+			t.Errorf("environment %q does not set %s", env, want)
+		}
+	}
+
+	cmd, err := bubblewrapRunner{}.Command(ctx, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(cmd.Args, " "), "--bind "+dir+" "+goCacheGuestDir) {
+		t.Errorf("args = %q, want the Go caches bound", cmd.Args)
+	}
+
+	// the caches in use are not evicted.
+	if err := evictCaches(ctx.goCacheRoot(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("the Go caches in use were evicted: %v", err)
+	}
+
+	ctx.closeGoCache()
+	ctx.GoCacheSize = 0
+	if err := ctx.openGoCache(); err != nil || ctx.goCache != nil {
+		t.Errorf("openGoCache() of disabled caches = %v", err)
+	}
+}
+
+func TestEvictGoCaches(t *testing.T) {
+	root := t.TempDir()
+	for i, version := range []string{"go1.19.1", "go1.20.2", "go1.21.3"} {
+		dir := filepath.Join(root, version)
+		writeFile(t, filepath.Join(dir, "mod/example.com/m@v1.0.0/m.go"), strings.Repeat("x", 1000))
+		writeFile(t, filepath.Join(dir, cacheStamp), "")
+		used := time.Now().Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, cacheStamp), used, used); err != nil {
+			t.Fatal(err)
+		}
+		// the go command makes the module cache read-only.
+		mod := filepath.Join(dir, "mod/example.com/m@v1.0.0")
+		if err := os.Chmod(mod, 0555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(mod, 0755) })
+	}
+
+	// a build uses the least recently used caches.
+	lock, err := os.OpenFile(filepath.Join(root, "go1.19.1.lock"), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_SH); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := evictCaches(root, 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := []string{}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			kept = append(kept, e.Name())
+		}
+	}
+	if want := []string{"go1.19.1", "go1.21.3"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept caches = %q, want %q", kept, want)
+	}
+}
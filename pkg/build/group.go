@@ -0,0 +1,208 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"chainguard.dev/melange/pkg/apk"
+	"gopkg.in/yaml.v3"
+)
+
+// annotationSelector selects packages by one of their annotations.
+type annotationSelector struct {
+	key, value string
+	// negate selects the packages without the annotation value.
+	negate bool
+	// exists selects the packages with the annotation, whatever its
+	// value.
+	exists bool
+}
+
+// PackageQuery selects the packages of a repository matching every one
+// of its selectors.
+type PackageQuery struct {
+	selectors []annotationSelector
+}
+
+// ParsePackageQuery parses annotation selectors: key=value selects the
+// packages annotated with the value, key!=value the other ones, and key
+// the packages with the annotation.
+func ParsePackageQuery(exprs []string) (*PackageQuery, error) {
+	q := &PackageQuery{}
+	for _, expr := range exprs {
+		sel := annotationSelector{}
+		switch {
+		case strings.Contains(expr, "!="):
+			kv := strings.SplitN(expr, "!=", 2)
+			sel.key, sel.value, sel.negate = kv[0], kv[1], true
+		case strings.Contains(expr, "="):
+			kv := strings.SplitN(expr, "=", 2)
+			sel.key, sel.value = kv[0], kv[1]
+		default:
+			sel.key, sel.exists = expr, true
+		}
+
+		sel.key = strings.TrimSpace(sel.key)
+		sel.value = strings.TrimSpace(sel.value)
+		if sel.key == "" {
+			return nil, fmt.Errorf("selector %q has no annotation name", expr)
+		}
+		q.selectors = append(q.selectors, sel)
+	}
+	return q, nil
+}
+
+// Matches returns whether a package with the given annotations is
+// selected.
+func (q *PackageQuery) Matches(annotations map[string]string) bool {
+	for _, sel := range q.selectors {
+		value, ok := annotations[sel.key]
+		switch {
+		case sel.exists && !ok:
+			return false
+		case sel.negate && ok && value == sel.value:
+			return false
+		case !sel.exists && !sel.negate && (!ok || value != sel.value):
+			return false
+		}
+	}
+	return true
+}
+
+// QueryRepository returns the sorted names of the packages of the
+// repository directory selected by q.  Every version of a package is
+// considered, so that a package is selected when any of its versions is.
+func QueryRepository(dir string, q *PackageQuery) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := readPackageInfos(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	for i, pi := range infos {
+		name := pi.Get("pkgname")
+		if name == "" {
+			return nil, fmt.Errorf("%s has no pkgname", paths[i])
+		}
+		if q.Matches(pi.Annotations()) {
+			selected[name] = true
+		}
+	}
+
+	names := []string{}
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// readPackageInfos reads the .PKGINFO of the packages, one package per
+// CPU at a time, since large repositories hold thousands of packages.
+func readPackageInfos(paths []string) ([]*apk.PackageInfo, error) {
+	infos := make([]*apk.PackageInfo, len(paths))
+	errs := make([]error, len(paths))
+
+	workers := runtime.NumCPU()
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				infos[i], errs[i] = apk.ReadPackageInfoFile(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", paths[i], err)
+		}
+	}
+	return infos, nil
+}
+
+// WorldFile returns an apk world file installing the packages.
+func WorldFile(names []string) []byte {
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintln(&b, name)
+	}
+	return []byte(b.String())
+}
+
+// GroupConfig returns the configuration of a metapackage depending on
+// the packages, which melange builds without a build environment.
+func GroupConfig(name, version, description string, names []string) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, errors.New("metapackage has no packages")
+	}
+
+	type dependencies struct {
+		Runtime []string `yaml:"runtime"`
+	}
+	type group struct {
+		Name         string       `yaml:"name"`
+		Version      string       `yaml:"version"`
+		Epoch        uint64       `yaml:"epoch"`
+		Description  string       `yaml:"description,omitempty"`
+		Metapackage  bool         `yaml:"metapackage"`
+		Dependencies dependencies `yaml:"dependencies"`
+	}
+
+	cfg := Configuration{}
+	cfg.Package.Name = name
+	cfg.Package.Version = version
+	cfg.Package.Description = description
+	cfg.Package.Metapackage = true
+	cfg.Package.Dependencies.Runtime = names
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(struct {
+		Package group `yaml:"package"`
+	}{group{
+		Name:         name,
+		Version:      version,
+		Description:  description,
+		Metapackage:  true,
+		Dependencies: dependencies{Runtime: names},
+	}})
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writePackageInfoAPK writes a package holding only a .PKGINFO.
+func writePackageInfoAPK(t *testing.T, path, pkginfo string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	if err := tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Mode: 0644, Size: int64(len(pkginfo))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(pkginfo)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryRepository(t *testing.T) {
+	dir := t.TempDir()
+	writePackageInfoAPK(t, filepath.Join(dir, "busybox-1.35-r0.apk"), "# annotation tier: base\npkgname = busybox\n")
+	writePackageInfoAPK(t, filepath.Join(dir, "busybox-1.36-r0.apk"), "# annotation tier: base\npkgname = busybox\n")
+	writePackageInfoAPK(t, filepath.Join(dir, "musl-1.2-r0.apk"), "# annotation tier: base\n# annotation experimental: yes\npkgname = musl\n")
+	writePackageInfoAPK(t, filepath.Join(dir, "hello-2.12-r0.apk"), "# annotation tier: extra\npkgname = hello\n")
+	writePackageInfoAPK(t, filepath.Join(dir, "curl-7.0-r0.apk"), "pkgname = curl\n")
+
+	for _, tt := range []struct {
+		selectors []string
+		want      []string
+	}{
+		{nil, []string{"busybox", "curl", "hello", "musl"}},
+		{[]string{"tier=base"}, []string{"busybox", "musl"}},
+		{[]string{"tier=base", "experimental!=yes"}, []string{"busybox"}},
+		{[]string{"tier"}, []string{"busybox", "hello", "musl"}},
+		{[]string{"tier!=base"}, []string{"curl", "hello"}},
+	} {
+		q, err := ParsePackageQuery(tt.selectors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := QueryRepository(dir, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("QueryRepository(%q) = %q, want %q", tt.selectors, got, tt.want)
+		}
+	}
+
+	if _, err := ParsePackageQuery([]string{"=base"}); err == nil {
+		t.Error("ParsePackageQuery() accepted a selector without annotation name")
+	}
+}
+
+func TestQueryRepositoryErrors(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 64; i++ {
+		writePackageInfoAPK(t, filepath.Join(dir, fmt.Sprintf("pkg%d-1.0-r0.apk", i)), fmt.Sprintf("pkgname = pkg%d\n", i))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken-1.0-r0.apk"), []byte("not a package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := ParsePackageQuery(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := QueryRepository(dir, q); err == nil || !strings.Contains(err.Error(), "broken-1.0-r0.apk") {
+		t.Errorf("QueryRepository() = %v, want an error about the broken package", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "broken-1.0-r0.apk")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := QueryRepository(dir, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 64 {
+		t.Errorf("QueryRepository() returned %d packages, want 64", len(got))
+	}
+}
+
+func TestGroupConfig(t *testing.T) {
+	if got := string(WorldFile([]string{"busybox", "musl"})); got != "busybox\nmusl\n" {
+		t.Errorf("WorldFile() = %q", got)
+	}
+
+	data, err := GroupConfig("base", "1.0", "the base packages", []string{"busybox", "musl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "base.yaml")
+	writeFile(t, path, string(data))
+
+	var cfg Configuration
+	if err := cfg.Load(path); err != nil {
+		t.Fatalf("generated configuration does not load: %v\n%s", err, data)
+	}
+	if !cfg.Package.Metapackage || !reflect.DeepEqual(cfg.Package.Dependencies.Runtime, []string{"busybox", "musl"}) {
+		t.Errorf("generated package = %+v", cfg.Package)
+	}
+
+	if _, err := GroupConfig("base", "1.0", "", nil); err == nil {
+		t.Error("GroupConfig() accepted an empty group")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// buildHistoryFile is the name of the build history database
+	// inside the cache directory.
+	buildHistoryFile = "build-history.json"
+
+	// buildHistoryLength is the number of durations kept per package.
+	buildHistoryLength = 10
+)
+
+// buildHistoryMu serializes updates of the build history from builds
+// running in parallel.
+var buildHistoryMu sync.Mutex
+
+// BuildHistory records how long the previous successful builds of each
+// package took, and how large their build environments were.
+type BuildHistory struct {
+	// Packages maps a package name to its build durations in
+	// seconds, oldest first.
+	Packages map[string][]float64 `json:"packages"`
+	// EnvironmentSizes maps a package name to the size in bytes of
+	// the build environment of its last build.
+	EnvironmentSizes map[string]int64 `json:"environment_sizes,omitempty"`
+}
+
+// LoadBuildHistory reads the build history from the cache directory.  A
+// missing history is not an error, an empty history is returned instead.
+func LoadBuildHistory(cacheDir string) (*BuildHistory, error) {
+	h := BuildHistory{
+		Packages:         map[string][]float64{},
+		EnvironmentSizes: map[string]int64{},
+	}
+
+	data, err := os.ReadFile(filepath.Join(cacheDir, buildHistoryFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read build history: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("unable to parse build history: %w", err)
+	}
+
+	if h.Packages == nil {
+		h.Packages = map[string][]float64{}
+	}
+	if h.EnvironmentSizes == nil {
+		h.EnvironmentSizes = map[string]int64{}
+	}
+
+	return &h, nil
+}
+
+// Save writes the build history to the cache directory.
+func (h *BuildHistory) Save(cacheDir string) error {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("unable to create cache directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode build history: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(cacheDir, buildHistoryFile+".*")
+	if err != nil {
+		return fmt.Errorf("unable to write build history: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write build history: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write build history: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(cacheDir, buildHistoryFile))
+}
+
+// Expected returns the average duration of the recorded builds of a
+// package, if there are any.
+func (h *BuildHistory) Expected(pkg string) (time.Duration, bool) {
+	durations := h.Packages[pkg]
+	if len(durations) == 0 {
+		return 0, false
+	}
+
+	total := 0.0
+	for _, d := range durations {
+		total += d
+	}
+
+	return time.Duration(total / float64(len(durations)) * float64(time.Second)), true
+}
+
+// Record adds the duration of a build of a package, discarding the
+// oldest durations beyond buildHistoryLength.
+func (h *BuildHistory) Record(pkg string, d time.Duration) {
+	durations := append(h.Packages[pkg], d.Seconds())
+	if len(durations) > buildHistoryLength {
+		durations = durations[len(durations)-buildHistoryLength:]
+	}
+	h.Packages[pkg] = durations
+}
+
+// regressed reports whether a build which took d is significantly slower
+// than the expected duration: half again as long, and by at least
+// half a minute, so that noise on short builds is not reported.
+func regressed(d, expected time.Duration) bool {
+	return d > expected*3/2 && d-expected > 30*time.Second
+}
+
+// recordBuild adds a build duration and the size of its build
+// environment, when known, to the history kept in the cache directory,
+// and warns when the build time regressed.
+func recordBuild(cacheDir, pkg string, d time.Duration, environmentSize int64) error {
+	buildHistoryMu.Lock()
+	defer buildHistoryMu.Unlock()
+
+	h, err := LoadBuildHistory(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	if expected, ok := h.Expected(pkg); ok && regressed(d, expected) {
+		log.Printf("warning: building %s took %s, compared to %s on average",
+			pkg, d.Round(time.Second), expected.Round(time.Second))
+	}
+
+	h.Record(pkg, d)
+	if environmentSize > 0 {
+		h.EnvironmentSizes[pkg] = environmentSize
+	}
+
+	return h.Save(cacheDir)
+}
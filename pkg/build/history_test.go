@@ -0,0 +1,129 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegressed(t *testing.T) {
+	for _, tc := range []struct {
+		d, expected time.Duration
+		want        bool
+	}{
+		{d: 3 * time.Minute, expected: time.Minute, want: true},
+		{d: 10 * time.Minute, expected: 6 * time.Minute, want: true},
+		// not half again as long.
+		{d: 8 * time.Minute, expected: 6 * time.Minute, want: false},
+		{d: 90 * time.Second, expected: time.Minute, want: false},
+		// less than half a minute slower.
+		{d: 20 * time.Second, expected: 5 * time.Second, want: false},
+		{d: 40 * time.Second, expected: 10 * time.Second, want: false},
+		{d: 41 * time.Second, expected: 10 * time.Second, want: true},
+		{d: time.Minute, expected: 2 * time.Minute, want: false},
+	} {
+		if got := regressed(tc.d, tc.expected); got != tc.want {
+			t.Errorf("regressed(%s, %s) = %t, want %t", tc.d, tc.expected, got, tc.want)
+		}
+	}
+}
+
+func TestBuildHistory(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	h, err := LoadBuildHistory(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.Expected("foo"); ok {
+		t.Error("an empty history has an expected duration")
+	}
+
+	for i := 1; i <= buildHistoryLength+2; i++ {
+		if err := recordBuild(cacheDir, "foo", time.Duration(i)*time.Minute, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err = LoadBuildHistory(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(h.Packages["foo"]); got != buildHistoryLength {
+		t.Errorf("%d durations kept, want %d", got, buildHistoryLength)
+	}
+	// the durations of builds 3 to 12 are kept.
+	if got, _ := h.Expected("foo"); got != 450*time.Second {
+		t.Errorf("Expected() = %s, want 7m30s", got)
+	}
+	if got := h.EnvironmentSizes["foo"]; got != buildHistoryLength+2 {
+		t.Errorf("environment size = %d, want %d", got, buildHistoryLength+2)
+	}
+}
+
+func TestBatchEstimate(t *testing.T) {
+	b := testBatch(map[string][]string{
+		"a": nil,
+		"b": nil,
+		"c": nil,
+		"d": nil,
+	})
+	b.history.Record("a", 10*time.Minute)
+	b.history.Record("b", 20*time.Minute)
+	b.history.Record("b", 40*time.Minute)
+
+	a, c, d := b.index(t, "a"), b.index(t, "c"), b.index(t, "d")
+	for _, tc := range []struct {
+		name    string
+		pending []int
+		started map[int]time.Time
+		jobs    int
+		want    time.Duration
+	}{{
+		name:    "builds without history take the average",
+		pending: []int{a, c, d},
+		jobs:    1,
+		want:    10*time.Minute + 2*20*time.Minute,
+	}, {
+		name:    "spread over the jobs",
+		pending: []int{a, c, d},
+		jobs:    2,
+		want:    25 * time.Minute,
+	}, {
+		name:    "running builds count what is left",
+		pending: []int{c},
+		started: map[int]time.Time{a: time.Now().Add(-4 * time.Minute)},
+		jobs:    1,
+		want:    26 * time.Minute,
+	}, {
+		name:    "overdue builds count nothing",
+		started: map[int]time.Time{a: time.Now().Add(-time.Hour)},
+		jobs:    1,
+		want:    0,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			pending := map[int]bool{}
+			for _, i := range tc.pending {
+				pending[i] = true
+			}
+			got := b.estimate(pending, tc.started, tc.jobs)
+			// the running builds are measured against the clock.
+			if diff := got - tc.want; diff > time.Second || diff < -time.Second {
+				t.Errorf("estimate() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultJavaCacheSize bounds the size of the Maven and Gradle
+	// caches kept in the cache directory.
+	defaultJavaCacheSize = 10 << 30
+
+	// mavenCacheGuestDir is where the local Maven repository is bound
+	// in the build environment.
+	mavenCacheGuestDir = "/var/cache/melange/maven"
+
+	// gradleGuestHome is the GRADLE_USER_HOME of the build
+	// environment, whose caches directory is bound from the cache
+	// directory.
+	gradleGuestHome = "/var/lib/melange/gradle"
+
+	// mavenSettingsGuestPath is the Maven settings file of the build
+	// environment, which locates the local repository and the offline
+	// repository.
+	mavenSettingsGuestPath = "/var/lib/melange/maven-settings.xml"
+
+	// offlineRepositoryGuestDir is where the offline Maven repository
+	// is bound in the build environment.
+	offlineRepositoryGuestDir = "/var/lib/melange/maven-repository"
+)
+
+// javaTools holds the caches of Maven and Gradle, and the offline Maven
+// repository, which are bound into the build environment.  Unlike the Go
+// caches, they are shared by all the toolchain versions: Maven and
+// Gradle key their caches by artifact.
+type javaTools struct {
+	binds map[string]string
+	env   []string
+	locks []*os.File
+}
+
+// javaCacheRoot returns the directory of the Maven and Gradle caches in
+// the cache directory.
+func (ctx *Context) javaCacheRoot() string {
+	return filepath.Join(ctx.CacheDir, "java")
+}
+
+// openJavaTools configures the Maven and Gradle of the build environment,
+// if any, to use the caches of the cache directory, unless their size is
+// bounded to 0, and to resolve the artifacts from the offline Maven
+// repository, if one is given.
+func (ctx *Context) openJavaTools() error {
+	tools := []string{}
+	for _, tool := range []string{"mvn", "gradle"} {
+		if _, err := os.Stat(filepath.Join(ctx.GuestDir, "usr/bin", tool)); err == nil {
+			tools = append(tools, tool)
+		}
+	}
+	if len(tools) == 0 {
+		if ctx.MavenRepository != "" {
+			log.Printf("warning: neither Maven nor Gradle is in the build environment, the offline Maven repository is not used")
+		}
+		return nil
+	}
+
+	j := &javaTools{binds: map[string]string{}}
+	ctx.java = j
+	cached := ctx.CacheDir != "" && ctx.JavaCacheSize > 0
+
+	offline := ""
+	if ctx.MavenRepository != "" {
+		dir, err := filepath.Abs(ctx.MavenRepository)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("the offline Maven repository %s is not a directory", ctx.MavenRepository)
+		}
+		j.binds[offlineRepositoryGuestDir] = dir
+		offline = "file://" + offlineRepositoryGuestDir
+		log.Printf("resolving the Maven artifacts from the offline repository %s", dir)
+	}
+
+	for _, tool := range tools {
+		switch tool {
+		case "mvn":
+			if cached {
+				if err := j.bindCache(filepath.Join(ctx.javaCacheRoot(), "maven"), mavenCacheGuestDir); err != nil {
+					return fmt.Errorf("unable to use the Maven cache: %w", err)
+				}
+			}
+			if !cached && offline == "" {
+				continue
+			}
+
+			path := filepath.Join(ctx.GuestDir, mavenSettingsGuestPath)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, []byte(mavenSettings(cached, offline)), 0644); err != nil {
+				return fmt.Errorf("unable to write the Maven settings: %w", err)
+			}
+			j.env = append(j.env, "MAVEN_ARGS=-s "+mavenSettingsGuestPath)
+
+		case "gradle":
+			if cached {
+				if err := j.bindCache(filepath.Join(ctx.javaCacheRoot(), "gradle"), gradleGuestHome+"/caches"); err != nil {
+					return fmt.Errorf("unable to use the Gradle cache: %w", err)
+				}
+			}
+			if !cached && offline == "" {
+				continue
+			}
+
+			if offline != "" {
+				path := filepath.Join(ctx.GuestDir, gradleGuestHome, "init.d", "melange-offline-repository.gradle")
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					return err
+				}
+				if err := os.WriteFile(path, []byte(gradleInitScript(offline)), 0644); err != nil {
+					return fmt.Errorf("unable to write the Gradle init script: %w", err)
+				}
+			}
+			j.env = append(j.env, "GRADLE_USER_HOME="+gradleGuestHome)
+		}
+	}
+
+	for guest := range j.binds {
+		if err := os.MkdirAll(filepath.Join(ctx.GuestDir, guest), 0755); err != nil {
+			return err
+		}
+	}
+
+	if cached {
+		log.Printf("using the caches of %s in %s", strings.Join(tools, " and "), ctx.javaCacheRoot())
+	}
+	return nil
+}
+
+// bindCache binds the cache in dir into the build environment at guest.
+func (j *javaTools) bindCache(dir, guest string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	lock, err := useCache(dir)
+	if err != nil {
+		return err
+	}
+	j.locks = append(j.locks, lock)
+	j.binds[guest] = dir
+	return nil
+}
+
+// closeJavaTools releases the Maven and Gradle caches of the build, and
+// evicts the least recently used one above the size bound.
+func (ctx *Context) closeJavaTools() {
+	if ctx.java == nil {
+		return
+	}
+
+	locked := len(ctx.java.locks) > 0
+	for _, lock := range ctx.java.locks {
+		lock.Close()
+	}
+	ctx.java = nil
+
+	if !locked {
+		return
+	}
+	if err := evictCaches(ctx.javaCacheRoot(), ctx.JavaCacheSize); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("warning: unable to evict Java caches: %v", err)
+	}
+}
+
+// javaBinds returns the directories of the host bound into the build
+// environment for Maven and Gradle, keyed by their path in the build
+// environment.
+func (ctx *Context) javaBinds() map[string]string {
+	if ctx.java == nil {
+		return nil
+	}
+	return ctx.java.binds
+}
+
+// javaEnvironment returns the variables configuring Maven and Gradle.
+func (ctx *Context) javaEnvironment() []string {
+	if ctx.java == nil {
+		return nil
+	}
+	return ctx.java.env
+}
+
+// mavenSettings returns the Maven settings locating the local repository
+// in the cache, if cached, and mirroring every repository with the
+// offline repository at url, if any.
+func mavenSettings(cached bool, url string) string {
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	b.WriteString("<!-- Generated by melange. -->\n")
+	b.WriteString("<settings xmlns=\"http://maven.apache.org/SETTINGS/1.0.0\">\n")
+	if cached {
+		fmt.Fprintf(&b, "  <localRepository>%s</localRepository>\n", mavenCacheGuestDir)
+	}
+	if url != "" {
+		b.WriteString("  <mirrors>\n")
+		b.WriteString("    <mirror>\n")
+		b.WriteString("      <id>melange-offline-repository</id>\n")
+		b.WriteString("      <mirrorOf>*</mirrorOf>\n")
+		fmt.Fprintf(&b, "      <url>%s</url>\n", url)
+		b.WriteString("    </mirror>\n")
+		b.WriteString("  </mirrors>\n")
+	}
+	b.WriteString("</settings>\n")
+	return b.String()
+}
+
+// gradleInitScript returns a Gradle init script replacing the
+// repositories of the builds and of their plugins with the offline
+// repository at url.
+func gradleInitScript(url string) string {
+	return fmt.Sprintf(`// Generated by melange.
+def offlineRepository = '%s'
+
+def useOfflineRepository = { RepositoryHandler repositories ->
+    repositories.all { ArtifactRepository repo ->
+        if (repo.name != 'melange-offline-repository') {
+            repositories.remove(repo)
+        }
+    }
+    repositories.maven {
+        name 'melange-offline-repository'
+        url offlineRepository
+    }
+}
+
+settingsEvaluated { settings ->
+    useOfflineRepository(settings.pluginManagement.repositories)
+}
+
+allprojects { project ->
+    useOfflineRepository(project.buildscript.repositories)
+    useOfflineRepository(project.repositories)
+}
+`, url)
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenJavaTools(t *testing.T) {
+	ctx := &Context{
+		Runner:          "bubblewrap",
+		GuestDir:        t.TempDir(),
+		WorkspaceDir:    "/work",
+		CacheDir:        t.TempDir(),
+		JavaCacheSize:   defaultJavaCacheSize,
+		MavenRepository: t.TempDir(),
+	}
+	ctx.Configuration.Package.Sandbox.Seccomp = SeccompUnconfined
+
+	// without Maven or Gradle, nothing is configured.
+	if err := ctx.openJavaTools(); err != nil || ctx.java != nil {
+		t.Fatalf("openJavaTools() without Maven or Gradle = %v", err)
+	}
+
+	writeFile(t, filepath.Join(ctx.GuestDir, "usr/bin/mvn"), "#!/bin/sh\n")
+	writeFile(t, filepath.Join(ctx.GuestDir, "usr/bin/gradle"), "#!/bin/sh\n")
+	if err := ctx.openJavaTools(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.closeJavaTools()
+
+	binds := ctx.javaBinds()
+	for guest, host := range map[string]string{
+		mavenCacheGuestDir:          filepath.Join(ctx.CacheDir, "java", "maven"),
+		gradleGuestHome + "/caches": filepath.Join(ctx.CacheDir, "java", "gradle"),
+		offlineRepositoryGuestDir:   ctx.MavenRepository,
+	} {
+		if binds[guest] != host {
+			t.Errorf("%s is bound from %q, want %s", guest, binds[guest], host)
+		}
+		if fi, err := os.Stat(filepath.Join(ctx.GuestDir, guest)); err != nil || !fi.IsDir() {
+			t.Errorf("%s is not a directory of the build environment: %v", guest, err)
+		}
+	}
+
+	env, err := ctx.scriptEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"MAVEN_ARGS=-s " + mavenSettingsGuestPath, "GRADLE_USER_HOME=" + gradleGuestHome} {
+		if !strings.Contains(strings.Join(env, "\n"), want) {
+			t.Errorf("environment %q does not set %s", env, want)
+		}
+	}
+
+	settings, err := os.ReadFile(filepath.Join(ctx.GuestDir, mavenSettingsGuestPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<localRepository>" + mavenCacheGuestDir + "</localRepository>", "<mirrorOf>*</mirrorOf>", "<url>file://" + offlineRepositoryGuestDir + "</url>"} {
+		if !strings.Contains(string(settings), want) {
+			t.Errorf("Maven settings %s do not contain %s", settings, want)
+		}
+	}
+	script, err := os.ReadFile(filepath.Join(ctx.GuestDir, gradleGuestHome, "init.d", "melange-offline-repository.gradle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(script), "file://"+offlineRepositoryGuestDir) {
+		t.Errorf("Gradle init script %s does not use the offline repository", script)
+	}
+
+	cmd, err := bubblewrapRunner{}.Command(ctx, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(cmd.Args, " "), "--bind "+ctx.MavenRepository+" "+offlineRepositoryGuestDir) {
+		t.Errorf("args = %q, want the offline repository bound", cmd.Args)
+	}
+
+	// without caches, only the offline repository is configured.
+	ctx.closeJavaTools()
+	ctx.JavaCacheSize = 0
+	if err := ctx.openJavaTools(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctx.javaBinds()[mavenCacheGuestDir]; ok || len(ctx.javaBinds()) != 1 {
+		t.Errorf("binds of disabled caches = %q, want the offline repository only", ctx.javaBinds())
+	}
+	settings, err = os.ReadFile(filepath.Join(ctx.GuestDir, mavenSettingsGuestPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(settings), "localRepository") {
+		t.Errorf("Maven settings of disabled caches %s locate the local repository", settings)
+	}
+
+	ctx.closeJavaTools()
+	ctx.MavenRepository = filepath.Join(ctx.CacheDir, "missing")
+	if err := ctx.openJavaTools(); err == nil {
+		t.Error("openJavaTools() accepted a missing offline repository")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"chainguard.dev/melange/pkg/sbom"
+)
+
+// licensesDir is where the packages install the texts of their custom
+// licenses, below a directory named after the package.
+const licensesDir = "usr/share/licenses"
+
+// validateCopyrights checks the license texts of the copyrights, which
+// are only needed for the custom licenses, LicenseRef-<id>.
+func validateCopyrights(copyrights []Copyright) error {
+	for _, c := range copyrights {
+		if c.LicensePath == "" {
+			continue
+		}
+
+		if !sbom.IsLicenseRef(c.License) {
+			return fmt.Errorf("copyright: license-path is only used by custom licenses, LicenseRef-<id>, not %q", c.License)
+		}
+
+		p := filepath.ToSlash(c.LicensePath)
+		if path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("copyright: license-path %q must be a path below the directory of the configuration file", c.LicensePath)
+		}
+	}
+
+	return nil
+}
+
+// licenseTexts returns the texts of the custom licenses of the package,
+// read from the directory of the configuration file.
+func (pc *PackageContext) licenseTexts() ([]sbom.ExtractedLicense, error) {
+	licenses := []sbom.ExtractedLicense{}
+	seen := map[string]bool{}
+
+	for _, c := range pc.Copyright {
+		if c.LicensePath == "" || seen[c.License] {
+			continue
+		}
+
+		text, err := os.ReadFile(filepath.Join(filepath.Dir(pc.Context.ConfigFile), c.LicensePath))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the text of %s: %w", c.License, err)
+		}
+
+		licenses = append(licenses, sbom.ExtractedLicense{ID: c.License, Text: string(text)})
+		seen[c.License] = true
+	}
+
+	return licenses, nil
+}
+
+// installLicenseTexts installs the texts of the custom licenses of the
+// package as /usr/share/licenses/<package>/<LicenseRef-id>.  The custom
+// licenses without text are logged.
+func (pc *PackageContext) installLicenseTexts() error {
+	licenses, err := pc.licenseTexts()
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, l := range licenses {
+		known[l.ID] = true
+	}
+	for _, c := range pc.Copyright {
+		for _, id := range sbom.LicenseRefs(c.License) {
+			if !known[id] {
+				log.Printf("warning: the text of the license %s of %s is unknown, set the license-path of its copyright", id, pc.PackageName)
+				known[id] = true
+			}
+		}
+	}
+
+	if len(licenses) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(pc.WorkspaceSubdir(), licensesDir, pc.PackageName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to install license texts: %w", err)
+	}
+
+	for _, l := range licenses {
+		if err := os.WriteFile(filepath.Join(dir, l.ID), []byte(l.Text), 0644); err != nil {
+			return fmt.Errorf("unable to install license texts: %w", err)
+		}
+	}
+
+	return nil
+}
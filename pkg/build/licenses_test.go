@@ -0,0 +1,97 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/apk"
+)
+
+func TestLicenseTexts(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "licenses/Example"), "Permission is granted to use this software.\n")
+
+	ctx := &Context{ConfigFile: filepath.Join(dir, "hello.yaml"), WorkspaceDir: t.TempDir(), SBOMGenerators: []string{"melange"}}
+	ctx.Configuration.Package = Package{Name: "hello", Version: "1.0"}
+	pc := &PackageContext{Context: ctx, Origin: &ctx.Configuration.Package, PackageName: "hello", Copyright: []Copyright{
+		{License: "MIT"},
+		{License: "LicenseRef-Example", LicensePath: "licenses/Example"},
+	}}
+	if err := os.MkdirAll(pc.WorkspaceSubdir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pc.installLicenseTexts(); err != nil {
+		t.Fatal(err)
+	}
+	text, err := os.ReadFile(filepath.Join(pc.WorkspaceSubdir(), "usr/share/licenses/hello/LicenseRef-Example"))
+	if err != nil || string(text) != "Permission is granted to use this software.\n" {
+		t.Errorf("installed license text = %q, %v", text, err)
+	}
+
+	if err := (melangeSBOMGenerator{}).Generate(pc); err != nil {
+		t.Fatal(err)
+	}
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	data, err := os.ReadFile(filepath.Join(pc.WorkspaceSubdir(), apk.SBOMDir, "hello-1.0-r0", "sbom-"+arch+".spdx.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Packages []struct {
+			LicenseDeclared string `json:"licenseDeclared"`
+		} `json:"packages"`
+		ExtractedLicenses []struct {
+			LicenseID     string `json:"licenseId"`
+			ExtractedText string `json:"extractedText"`
+		} `json:"hasExtractedLicensingInfos"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Packages[0].LicenseDeclared != "MIT AND LicenseRef-Example" || len(doc.ExtractedLicenses) != 1 || doc.ExtractedLicenses[0].ExtractedText != string(text) {
+		t.Errorf("SBOM = %s", data)
+	}
+
+	pc.Copyright[1].LicensePath = "licenses/Missing"
+	if err := pc.installLicenseTexts(); err == nil {
+		t.Error("installLicenseTexts() succeeded without license text")
+	}
+}
+
+func TestValidateCopyrights(t *testing.T) {
+	if err := validateCopyrights([]Copyright{{License: "LicenseRef-Example", LicensePath: "LICENSE"}}); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []Copyright{
+		{License: "MIT", LicensePath: "LICENSE"},
+		{License: "MIT AND LicenseRef-Example", LicensePath: "LICENSE"},
+		{License: "LicenseRef-Example", LicensePath: "/etc/passwd"},
+		{License: "LicenseRef-Example", LicensePath: "../LICENSE"},
+	} {
+		if err := validateCopyrights([]Copyright{c}); err == nil {
+			t.Errorf("validateCopyrights(%+v) succeeded", c)
+		}
+	}
+}
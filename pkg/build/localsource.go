@@ -0,0 +1,123 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localSourcePath returns the absolute path of the source of a
+// local-source pipeline, whose relative paths are relative to the
+// directory of the configuration file.
+func (ctx *Context) localSourcePath(with map[string]string) string {
+	path := with["${{inputs.path}}"]
+	if path == "" || strings.HasPrefix(path, "${{") {
+		return ""
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(ctx.ConfigFile), path)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+// localSourceDigest returns the hex SHA256 digest of a local source: the
+// digest of a file, or the one of the paths, types, contents and
+// executable bits of the files of a directory, which do not depend on
+// the umask of the checkout.
+func localSourceDigest(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if fi.IsDir() {
+		return hashTree(path, func(mode fs.FileMode) fs.FileMode {
+			return mode.Perm() & 0111
+		})
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// copyLocalSource copies the file or directory of a local-source pipeline
+// into the workspace, given the inputs of the pipeline, if its digest is
+// the expected one.  A file is copied into the destination directory,
+// and the contents of a directory are copied into it.
+func (ctx *Context) copyLocalSource(with map[string]string) error {
+	path := ctx.localSourcePath(with)
+	if path == "" {
+		return fmt.Errorf("local-source requires a path")
+	}
+	expected := strings.ToLower(with["${{inputs.expected-sha256}}"])
+	if expected == "" || strings.HasPrefix(expected, "${{") {
+		return fmt.Errorf("local source %s requires its expected-sha256", path)
+	}
+
+	digest, err := localSourceDigest(path)
+	if err != nil {
+		return fmt.Errorf("unable to read local source: %w", err)
+	}
+	if digest != expected {
+		return fmt.Errorf("local source %s has digest %s, expected %s", path, digest, expected)
+	}
+
+	dest := with["${{inputs.destination}}"]
+	if dest == "" || strings.HasPrefix(dest, "${{") {
+		dest = "."
+	}
+	dest = filepath.Join(ctx.WorkspaceDir, dest)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(path))
+	}
+
+	if err := copyTree(path, dest); err != nil {
+		return fmt.Errorf("unable to copy local source %s: %w", path, err)
+	}
+
+	log.Printf("copied %s into the workspace", path)
+	ctx.fetchedSources = append(ctx.fetchedSources, fetchedSource{URI: path, URL: localSourceURL(path), SHA256: digest})
+	return nil
+}
+
+// localSourceURL returns the URL of a local source, which locates it on
+// the build host.
+func localSourceURL(path string) string {
+	return "file://" + filepath.ToSlash(path)
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyLocalSource(t *testing.T) {
+	dir := t.TempDir()
+	ctx := &Context{ConfigFile: filepath.Join(dir, "hello.yaml"), WorkspaceDir: t.TempDir()}
+
+	source := "hello, world\n"
+	if err := os.WriteFile(filepath.Join(dir, "hello.c"), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "src", "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "lib", "main.c"), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "configure"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// a relative path is relative to the configuration file.
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(source)))
+	with := map[string]string{
+		"${{inputs.path}}":            "hello.c",
+		"${{inputs.expected-sha256}}": digest,
+		"${{inputs.destination}}":     "${{inputs.destination}}",
+	}
+	if err := ctx.copyLocalSource(with); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "hello.c")); err != nil || string(data) != source {
+		t.Errorf("copied %q, %v", data, err)
+	}
+
+	want := "file://" + filepath.ToSlash(filepath.Join(dir, "hello.c")) + " sha256:" + digest
+	if got := ctx.FetchedSources(); len(got) != 1 || got[0] != want {
+		t.Errorf("FetchedSources() = %q, want %q", got, want)
+	}
+
+	// the digest of a directory only covers the executable bits of the
+	// files, so that it does not depend on the umask.
+	treeDigest, err := localSourceDigest(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "src", "lib", "main.c"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := localSourceDigest(filepath.Join(dir, "src")); err != nil || got != treeDigest {
+		t.Errorf("digest after chmod = %s, %v, want %s", got, err, treeDigest)
+	}
+
+	with = map[string]string{
+		"${{inputs.path}}":            filepath.Join(dir, "src"),
+		"${{inputs.expected-sha256}}": treeDigest,
+		"${{inputs.destination}}":     "build",
+	}
+	if err := ctx.copyLocalSource(with); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "build", "lib", "main.c")); err != nil || string(data) != source {
+		t.Errorf("copied %q, %v", data, err)
+	}
+	if fi, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "build", "configure")); err != nil || fi.Mode().Perm()&0100 == 0 {
+		t.Errorf("configure is not executable: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "src", "lib", "main.c"), []byte("tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.copyLocalSource(with); err == nil || !strings.Contains(err.Error(), "expected "+treeDigest) {
+		t.Errorf("copying a modified source: %v", err)
+	}
+
+	delete(with, "${{inputs.expected-sha256}}")
+	if err := ctx.copyLocalSource(with); err == nil {
+		t.Errorf("copying a source without digest succeeded")
+	}
+}
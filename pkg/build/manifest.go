@@ -0,0 +1,179 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/internal/sign"
+)
+
+// ChecksumManifestName is the name of the checksum manifest written to
+// the output directory, in the format of sha256sum.  Its signature is
+// written next to it, with the .sig extension.
+const ChecksumManifestName = "SHA256SUMS"
+
+// recordArtifact records a file written to the output directory, given
+// its path relative to it, to be listed in the checksum manifest.
+func (ctx *Context) recordArtifact(name string) {
+	ctx.artifacts = append(ctx.artifacts, name)
+}
+
+// exportArtifact writes a file describing the package next to it in the
+// output directory, as <package>-<version>-r<epoch>.<ext>, and records
+// it for the checksum manifest.
+func (pc *PackageContext) exportArtifact(ext string, data []byte) error {
+	name := pc.Identity() + "." + ext
+	if err := writeFileAtomic(filepath.Join(pc.Context.OutDir, name), data); err != nil {
+		return err
+	}
+	pc.Context.recordArtifact(name)
+	return nil
+}
+
+// WriteChecksumManifest writes the checksum manifest of the files
+// written to the output directory by the build, if it was requested.
+// The manifest also lists the extra files, such as the build log, which
+// must be in the output directory as well.
+func (ctx *Context) WriteChecksumManifest(extra ...string) error {
+	if !ctx.ChecksumManifest {
+		return nil
+	}
+	return ctx.writeChecksumManifest(ctx.artifacts, extra)
+}
+
+// WriteChecksumManifest writes the checksum manifest of the files
+// written by all the builds of the batch, which share their output
+// directory, if it was requested.
+func (b *Batch) WriteChecksumManifest(extra ...string) error {
+	if len(b.Contexts) == 0 || !b.Contexts[0].ChecksumManifest {
+		return nil
+	}
+
+	artifacts := []string{}
+	for _, ctx := range b.Contexts {
+		artifacts = append(artifacts, ctx.artifacts...)
+	}
+	return b.Contexts[0].writeChecksumManifest(artifacts, extra)
+}
+
+func (ctx *Context) writeChecksumManifest(artifacts, extra []string) error {
+	names := append([]string{}, artifacts...)
+	for _, path := range extra {
+		name, err := filepath.Rel(ctx.OutDir, path)
+		if err != nil || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("unable to list %s in the checksum manifest: it is not in the output directory %s", path, ctx.OutDir)
+		}
+		names = append(names, name)
+	}
+
+	signer, err := ctx.packageSigner()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := checksumManifest(ctx.OutDir, names)
+	if err != nil {
+		return fmt.Errorf("unable to write checksum manifest: %w", err)
+	}
+
+	signature, err := signChecksumManifest(manifest, signer)
+	if err != nil {
+		return ctx.signingError(fmt.Errorf("unable to sign checksum manifest: %w", err))
+	}
+
+	path := filepath.Join(ctx.OutDir, ChecksumManifestName)
+	if err := writeFileAtomic(path, manifest); err != nil {
+		return fmt.Errorf("unable to write checksum manifest: %w", err)
+	}
+	if err := writeFileAtomic(path+".sig", signature); err != nil {
+		return fmt.Errorf("unable to write checksum manifest: %w", err)
+	}
+
+	log.Printf("wrote %s, listing %d files, signed with %s", path, bytes.Count(manifest, []byte("\n")), signer.KeyName())
+
+	return nil
+}
+
+// checksumManifest returns the SHA256 checksums of the files of dir,
+// given their paths relative to it, as written by sha256sum.
+func checksumManifest(dir string, names []string) ([]byte, error) {
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&b, "%x  %s\n", h.Sum(nil), filepath.ToSlash(name))
+	}
+
+	return b.Bytes(), nil
+}
+
+// signChecksumManifest signs the manifest with the signing key of the
+// packages, which signs SHA1 digests with RSA PKCS#1 v1.5, so that the
+// signature is verified with
+//
+//	openssl dgst -sha1 -verify <key>.pub -signature SHA256SUMS.sig SHA256SUMS
+func signChecksumManifest(manifest []byte, signer sign.Signer) ([]byte, error) {
+	digest := sha1.Sum(manifest) // nolint:gosec
+	return signer.SignSHA1Digest(digest[:])
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers
+// never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".melange-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
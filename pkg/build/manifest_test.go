@@ -0,0 +1,82 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/internal/sign"
+)
+
+func TestWriteChecksumManifest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	writeFile(t, keyFile, string(keyPEM))
+	writeFile(t, filepath.Join(dir, "hello-1.0-r0.apk"), "apk")
+	writeFile(t, filepath.Join(dir, "hello-1.0-r0.spdx.json"), "{}")
+	writeFile(t, filepath.Join(dir, "melange-batch.log"), "log")
+
+	ctx := &Context{
+		OutDir:           dir,
+		ChecksumManifest: true,
+		signer:           sign.NewLocalSigner(keyFile, ""),
+	}
+	ctx.recordArtifact("hello-1.0-r0.spdx.json")
+	ctx.recordArtifact("hello-1.0-r0.apk")
+
+	if err := ctx.WriteChecksumManifest(filepath.Join(dir, "melange-batch.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(dir, ChecksumManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("%x  hello-1.0-r0.apk\n%x  hello-1.0-r0.spdx.json\n%x  melange-batch.log\n",
+		sha256.Sum256([]byte("apk")), sha256.Sum256([]byte("{}")), sha256.Sum256([]byte("log")))
+	if string(manifest) != want {
+		t.Errorf("manifest = %q, want %q", manifest, want)
+	}
+
+	signature, err := os.ReadFile(filepath.Join(dir, ChecksumManifestName+".sig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha1.Sum(manifest) // nolint:gosec
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], signature); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+
+	if err := ctx.WriteChecksumManifest(filepath.Join(t.TempDir(), "melange-batch.log")); err == nil {
+		t.Errorf("listing a file outside of the output directory succeeded")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+// repositoryMirror serves the remote repositories of the build
+// environment to apk from the local host.  Their indexes are served from
+// the exact bytes melange fetched and verified, so apk cannot be handed
+// a different index than the one checked against the pins.  apk verifies
+// the packages against the checksums of the index, so the other requests
+// are simply forwarded to the upstream repositories, with the
+// credentials of their host, including bearer tokens which apk does not
+// support itself.
+type repositoryMirror struct {
+	client *http.Client
+	// cache keeps the fetched packages of the builds of a batch.
+	cache  *fetchCache
+	server *http.Server
+	// prefix is a random path prefix, so that other users of the
+	// host cannot use the mirror to fetch from private repositories.
+	prefix string
+
+	// repositories are the repositories of the environment, with the
+	// remote ones replaced by their location on the mirror.
+	repositories []string
+	// upstreams maps the number of a mirrored repository to its URL.
+	upstreams map[int]string
+	// indexes maps request paths to the verified index bytes.
+	indexes map[string][]byte
+}
+
+// startRepositoryMirror starts a mirror of the remote repositories of the
+// build environment, serving the given indexes, which are keyed by
+// APKINDEX location.
+func (ctx *Context) startRepositoryMirror(indexes map[string][]byte) (*repositoryMirror, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to start repository mirror: %w", err)
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to start repository mirror: %w", err)
+	}
+
+	m := &repositoryMirror{
+		client:    ctx.client(),
+		cache:     ctx.fetchCache,
+		prefix:    "/" + hex.EncodeToString(token),
+		upstreams: map[int]string{},
+		indexes:   map[string][]byte{},
+	}
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	for n, repo := range ctx.Configuration.Environment.Contents.Repositories {
+		tag, url := "", repo
+		if strings.HasPrefix(repo, "@") {
+			if fields := strings.Fields(repo); len(fields) == 2 {
+				tag, url = fields[0]+" ", fields[1]
+			}
+		}
+
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			m.repositories = append(m.repositories, repo)
+			continue
+		}
+
+		m.upstreams[n] = strings.TrimSuffix(url, "/")
+		m.indexes[fmt.Sprintf("%s/%d/%s/APKINDEX.tar.gz", m.prefix, n, arch)] = indexes[indexURL(repo, arch)]
+		m.repositories = append(m.repositories, fmt.Sprintf("%shttp://%s%s/%d", tag, listener.Addr(), m.prefix, n))
+	}
+
+	m.server = &http.Server{Handler: m}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("warning: repository mirror failed: %v", err)
+		}
+	}()
+
+	return m, nil
+}
+
+func (m *repositoryMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if data, ok := m.indexes[r.URL.Path]; ok {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data) // nolint:errcheck
+		}
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, m.prefix+"/")
+	parts := strings.SplitN(path, "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	upstream, ok := m.upstreams[n]
+	if path == r.URL.Path || err != nil || !ok || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if m.cache != nil && r.Method == http.MethodGet && strings.HasSuffix(parts[1], ".apk") {
+		m.serveCached(w, upstream+"/"+parts[1])
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstream+"/"+parts[1], nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Printf("warning: unable to fetch %s: %v", req.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Length", "Content-Type", "Last-Modified"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("warning: unable to forward %s: %v", req.URL, err)
+	}
+}
+
+// serveCached serves a package from the fetch cache of the batch.
+func (m *repositoryMirror) serveCached(w http.ResponseWriter, url string) {
+	resp, err := m.cache.get(m.client, url)
+	if err != nil {
+		log.Printf("warning: unable to fetch %s: %v", url, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	for _, header := range []string{"Content-Type", "Last-Modified"} {
+		if value := resp.header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.data)))
+
+	w.WriteHeader(resp.status)
+	w.Write(resp.data) // nolint:errcheck
+}
+
+// Close stops the mirror.
+func (m *repositoryMirror) Close() error {
+	return m.server.Close()
+}
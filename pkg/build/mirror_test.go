@@ -0,0 +1,118 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+func TestRepositoryMirror(t *testing.T) {
+	t.Setenv("HTTP_AUTH", "bearer:127.0.0.1:t0ken")
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+
+	index := "verified index"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/main/" + arch + "/APKINDEX.tar.gz":
+			io.WriteString(w, index) // nolint:errcheck
+		case "/main/" + arch + "/foo-1.0-r0.apk":
+			io.WriteString(w, "package") // nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	ctx := &Context{}
+	ctx.Configuration.Environment.Contents.Repositories = []string{upstream.URL + "/main"}
+	if err := ctx.configureAuth(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ctx.hasBearerRepositories() {
+		t.Error("hasBearerRepositories() = false, want true")
+	}
+
+	indexes, err := ctx.fetchIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// local repositories are read by apk directly.
+	ctx.Configuration.Environment.Contents.Repositories = append(ctx.Configuration.Environment.Contents.Repositories, "@local /srv/repo")
+
+	m, err := ctx.startRepositoryMirror(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if len(m.repositories) != 2 || m.repositories[1] != "@local /srv/repo" {
+		t.Fatalf("repositories = %v, want the local repository to be kept", m.repositories)
+	}
+
+	// the upstream index changes after it was verified.
+	index = "tampered index"
+
+	get := func(url string) (int, string) {
+		t.Helper()
+
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, string(body)
+	}
+
+	mirrored := m.repositories[0]
+
+	if status, body := get(mirrored + "/" + arch + "/APKINDEX.tar.gz"); status != http.StatusOK || body != "verified index" {
+		t.Errorf("index = %d %q, want the verified index", status, body)
+	}
+
+	if status, body := get(mirrored + "/" + arch + "/foo-1.0-r0.apk"); status != http.StatusOK || body != "package" {
+		t.Errorf("package = %d %q, want it to be forwarded", status, body)
+	}
+
+	if status, _ := get(mirrored + "/" + arch + "/missing.apk"); status != http.StatusNotFound {
+		t.Errorf("missing package = %d, want %d", status, http.StatusNotFound)
+	}
+
+	// requests without the random prefix are refused.
+	withoutPrefix := strings.Replace(mirrored, m.prefix, "", 1)
+	if status, _ := get(withoutPrefix + "/" + arch + "/foo-1.0-r0.apk"); status != http.StatusNotFound {
+		t.Errorf("request without the prefix = %d, want %d", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// maxNestingDepth bounds how deeply nested builds may recurse, so that
+// a configuration which (indirectly) builds itself fails instead of
+// running forever.
+const maxNestingDepth = 4
+
+// NestedBuild describes a child package build which is run as a pipeline
+// step, e.g. to bootstrap a helper needed by the parent build.
+//
+// The child is built in its own temporary workspace, so it cannot see or
+// modify the parent workspace.  The resulting packages are handed off by
+// writing them into Destination inside the parent workspace.
+type NestedBuild struct {
+	// Config is the path of the child configuration file, relative
+	// to the parent workspace.
+	Config string
+	// Destination is the directory, relative to the parent workspace,
+	// which receives the packages built by the child.  It defaults
+	// to "melange-nested".
+	Destination string
+}
+
+func (nb *NestedBuild) Identity() string {
+	return fmt.Sprintf("build %s", nb.Config)
+}
+
+func (nb *NestedBuild) destination() string {
+	if nb.Destination != "" {
+		return nb.Destination
+	}
+	return "melange-nested"
+}
+
+// Run builds the child configuration and writes its packages into the
+// parent workspace.
+func (nb *NestedBuild) Run(pctx *PipelineContext) error {
+	parent := pctx.Context
+
+	if nb.Config == "" {
+		return fmt.Errorf("nested build is missing a configuration file")
+	}
+
+	if parent.nestingDepth >= maxNestingDepth {
+		return fmt.Errorf("nested build %s exceeds the maximum nesting depth of %d", nb.Config, maxNestingDepth)
+	}
+
+	workspaceDir, err := os.MkdirTemp("", "melange-nested-*")
+	if err != nil {
+		return fmt.Errorf("unable to make nested workspace directory: %w", err)
+	}
+	defer os.RemoveAll(workspaceDir)
+
+	child, err := New(
+		WithConfig(filepath.Join(parent.WorkspaceDir, nb.Config)),
+		WithWorkspaceDir(workspaceDir),
+		WithPipelineDir(parent.PipelineDir),
+		WithOverlayPipelineDirs(parent.OverlayPipelineDirs),
+		WithOutDir(filepath.Join(parent.WorkspaceDir, nb.destination())),
+		WithCacheDir(parent.CacheDir),
+		WithGoCacheSize(parent.GoCacheSize),
+		WithJavaCacheSize(parent.JavaCacheSize),
+		WithStepCacheSize(parent.StepCacheSize),
+		WithMavenRepository(parent.MavenRepository),
+		WithRemoteCache(parent.RemoteCache, parent.RemoteCacheMode),
+		WithRepositoryPinsFile(parent.RepositoryPinsFile),
+		WithRepositorySnapshot(parent.RepositorySnapshot, parent.SnapshotDir),
+		WithProxy(parent.HTTPProxy, parent.HTTPSProxy, parent.NoProxy),
+		WithCACertFile(parent.CACertFile),
+		WithNetrcFile(parent.NetrcFile),
+		WithSettingsFile(parent.SettingsFile),
+		WithSigningKey(parent.SigningKey),
+		WithSigningServer(parent.SigningServer, parent.SigningClientCert, parent.SigningClientKey, parent.SigningServerCA),
+		WithSigningKMS(parent.SigningKMS),
+		WithTimestampURL(parent.TimestampURL),
+		WithUseProot(parent.UseProot),
+		WithRunner(parent.Runner),
+		WithSBOMGenerators(parent.SBOMGenerators),
+		WithSBOMFormats(parent.SBOMFormats),
+		WithSBOMChecksums(parent.SBOMChecksums),
+		WithSBOMAttestation(parent.SBOMAttestation),
+		WithSBOMCheckNTIA(parent.SBOMCheckNTIA),
+		WithSBOMSkipSymlinks(parent.SBOMSkipSymlinks),
+		WithSBOMBuildEnvironment(parent.SBOMBuildEnvironment),
+		WithSBOMStrict(parent.SBOMStrict),
+		WithDependencyTrack(parent.DependencyTrackURL),
+		WithApkoFragment(parent.ApkoFragment),
+		WithDigests(parent.Digests),
+		WithForce(parent.Force),
+		WithPublishedRepository(parent.PublishedRepository),
+		WithLocale(parent.Locale),
+		WithReadOnlyRoot(parent.ReadOnlyRoot),
+		WithTimezone(parent.Timezone),
+		WithPassEnv(parent.PassEnv),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to set up nested build: %w", err)
+	}
+
+	child.SourceDateEpoch = parent.SourceDateEpoch
+	child.SigningPassphrase = parent.SigningPassphrase
+	child.signer = parent.signer
+	child.nestingDepth = parent.nestingDepth + 1
+	if parent.fetchCache != nil {
+		child.shareFetches(parent.fetchCache, newBatchTransport(child.baseTransport()))
+	}
+
+	log.Printf("starting nested build of %s", nb.Config)
+
+	if err := child.BuildPackage(); err != nil {
+		return fmt.Errorf("nested build of %s failed: %w", nb.Config, err)
+	}
+
+	log.Printf("nested build of %s finished, packages are in %s", nb.Config, nb.destination())
+
+	return nil
+}
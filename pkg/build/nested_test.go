@@ -0,0 +1,79 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNestedBuildIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		build       NestedBuild
+		identity    string
+		destination string
+	}{{
+		build:       NestedBuild{Config: "helper.yaml"},
+		identity:    "build helper.yaml",
+		destination: "melange-nested",
+	}, {
+		build:       NestedBuild{Config: "sub/helper.yaml", Destination: "out"},
+		identity:    "build sub/helper.yaml",
+		destination: "out",
+	}} {
+		if got := tc.build.Identity(); got != tc.identity {
+			t.Errorf("Identity() = %q, want %q", got, tc.identity)
+		}
+		if got := tc.build.destination(); got != tc.destination {
+			t.Errorf("%s: destination() = %q, want %q", tc.identity, got, tc.destination)
+		}
+		p := Pipeline{Build: &tc.build}
+		if got := p.Identity(); got != tc.identity {
+			t.Errorf("pipeline Identity() = %q, want %q", got, tc.identity)
+		}
+	}
+}
+
+func TestNestedBuildErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		build NestedBuild
+		depth int
+		err   string
+	}{{
+		name: "missing configuration",
+		err:  "missing a configuration file",
+	}, {
+		name:  "too deep",
+		build: NestedBuild{Config: "helper.yaml"},
+		depth: maxNestingDepth,
+		err:   "exceeds the maximum nesting depth",
+	}, {
+		name:  "configuration not found",
+		build: NestedBuild{Config: "does-not-exist.yaml"},
+		err:   "does-not-exist.yaml",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &Context{WorkspaceDir: t.TempDir(), Runner: defaultRunner, nestingDepth: tc.depth}
+			err := tc.build.Run(&PipelineContext{Context: ctx})
+			if err == nil {
+				t.Fatal("Run() succeeded")
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Run() = %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// systemCABundles are the usual locations of the CA bundle of the host.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// hostCertFile is the CA bundle SSL_CERT_FILE pointed at when melange
+// started, before it was replaced with the bundle including the custom
+// CA certificates.
+var hostCertFile = os.Getenv("SSL_CERT_FILE")
+
+// guestCABundle is the location of the CA bundle in the build environment.
+const guestCABundle = "etc/ssl/certs/ca-certificates.crt"
+
+// readCACert reads the custom CA certificates, and checks that they are
+// PEM encoded.
+func (ctx *Context) readCACert() ([]byte, error) {
+	data, err := os.ReadFile(ctx.CACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificates: %w", err)
+	}
+
+	if block, _ := pem.Decode(data); block == nil {
+		return nil, fmt.Errorf("%s does not contain PEM encoded certificates", ctx.CACertFile)
+	}
+
+	return data, nil
+}
+
+// configureNetwork applies the proxy and CA settings to the requests made
+// by melange, through the transport of the build, see newTransport.
+//
+// They are also applied to the environment of melange, which apk, when
+// it is run by apko, and the build pipelines, which inherit the
+// environment, use.  apk reads these variables only once, so they must be
+// set before any repository is fetched.
+func (ctx *Context) configureNetwork() error {
+	proxies := map[string]string{
+		"HTTP_PROXY":  ctx.HTTPProxy,
+		"HTTPS_PROXY": ctx.HTTPSProxy,
+		"NO_PROXY":    ctx.NoProxy,
+	}
+
+	for name, value := range proxies {
+		if value == "" {
+			continue
+		}
+
+		for _, n := range []string{name, strings.ToLower(name)} {
+			if err := os.Setenv(n, value); err != nil {
+				return fmt.Errorf("unable to set %s: %w", n, err)
+			}
+		}
+	}
+
+	if ctx.HTTPProxy != "" || ctx.HTTPSProxy != "" || ctx.CACertFile != "" {
+		t, err := ctx.newTransport()
+		if err != nil {
+			return err
+		}
+		ctx.transport = t
+		ctx.httpClient = &http.Client{Transport: t}
+	}
+
+	if ctx.CACertFile == "" {
+		return nil
+	}
+
+	caCert, err := ctx.readCACert()
+	if err != nil {
+		return err
+	}
+
+	bundles := systemCABundles
+	if hostCertFile != "" {
+		bundles = append([]string{hostCertFile}, bundles...)
+	}
+
+	var bundle bytes.Buffer
+	for _, path := range bundles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		bundle.Write(data)
+		bundle.WriteString("\n")
+		break
+	}
+
+	// the bundle replaces the one of the host, so the custom CA alone
+	// would make every other certificate untrusted.
+	if bundle.Len() == 0 {
+		return fmt.Errorf("unable to find the CA bundle of the host to add the custom CA certificates to, tried %s", strings.Join(bundles, ", "))
+	}
+	bundle.Write(caCert)
+
+	path, err := ctx.writeCABundle(bundle.Bytes())
+	if err != nil {
+		return fmt.Errorf("unable to write CA bundle: %w", err)
+	}
+
+	return os.Setenv("SSL_CERT_FILE", path)
+}
+
+// newTransport returns the transport of the requests made by melange,
+// which uses the proxies of the build and trusts its CA certificates in
+// addition to those of the host.  Unlike the default transport, it does
+// not depend on the environment melange was started with, so concurrent
+// builds with different settings do not affect each other.
+func (ctx *Context) newTransport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = ctx.proxy
+
+	if ctx.CACertFile != "" {
+		caCert, err := ctx.readCACert()
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("unable to parse the CA certificates of %s", ctx.CACertFile)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return t, nil
+}
+
+// proxy returns the proxy of a request: the HTTP or HTTPS proxy of the
+// build, depending on the scheme, unless the host is loopback or matches
+// NoProxy.  Without a proxy for the scheme, the environment decides.
+func (ctx *Context) proxy(req *http.Request) (*url.URL, error) {
+	proxy := ctx.HTTPProxy
+	if req.URL.Scheme == "https" {
+		proxy = ctx.HTTPSProxy
+	}
+	if proxy == "" {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	if !useProxy(req.URL.Host, ctx.NoProxy) {
+		return nil, nil
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %w", proxy, err)
+	}
+
+	return u, nil
+}
+
+// useProxy reports whether requests to host go through the proxy, given
+// NO_PROXY style exclusions: a comma separated list of IP addresses,
+// CIDR ranges and domain names, which also match their subdomains, or
+// "*" for all hosts.
+func useProxy(host, noProxy string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.ToLower(strings.Trim(hostname, "[]"))
+
+	ip := net.ParseIP(hostname)
+	if hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return false
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case entry == "*":
+			return false
+		case ip != nil:
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return false
+			}
+			if entry == hostname {
+				return false
+			}
+		default:
+			if h, _, err := net.SplitHostPort(entry); err == nil {
+				if entry != strings.ToLower(host) {
+					continue
+				}
+				entry = h
+			}
+			entry = strings.TrimPrefix(entry, ".")
+			if hostname == entry || strings.HasSuffix(hostname, "."+entry) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// baseTransport returns the transport which the requests of melange are
+// made with, before authentication.
+func (ctx *Context) baseTransport() *http.Transport {
+	if ctx.transport != nil {
+		return ctx.transport
+	}
+	return http.DefaultTransport.(*http.Transport)
+}
+
+// writeCABundle writes the CA bundle trusted by melange to a location
+// only the current user can write to.  In the cache directory, the
+// bundle is named after its contents, so that it is shared by concurrent
+// and later builds instead of piling up.
+func (ctx *Context) writeCABundle(bundle []byte) (string, error) {
+	if ctx.CacheDir == "" {
+		f, err := os.CreateTemp("", "melange-ca-*.pem")
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		if _, err := f.Write(bundle); err != nil {
+			return "", err
+		}
+
+		return f.Name(), f.Close()
+	}
+
+	dir := filepath.Join(ctx.CacheDir, "ca-bundles")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%x.pem", sha256.Sum256(bundle)))
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, bundle) {
+		return path, nil
+	}
+
+	f, err := os.CreateTemp(dir, ".ca-*.pem")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(bundle); err != nil {
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(f.Name(), path)
+}
+
+// installCACert appends the custom CA certificates to the CA bundle of
+// the build environment, so that tools such as wget and git trust them.
+func (ctx *Context) installCACert() error {
+	if ctx.CACertFile == "" {
+		return nil
+	}
+
+	caCert, err := ctx.readCACert()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ctx.GuestDir, guestCABundle)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create CA bundle directory: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open CA bundle: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append([]byte("\n"), caCert...)); err != nil {
+		return fmt.Errorf("unable to write CA bundle: %w", err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCACert = `-----BEGIN CERTIFICATE-----
+MIIBcTCCARegAwIBAgIUdRy3H2aBqKYrYbLF0ohuOkmuyA8wCgYIKoZIzj0EAwIw
+DTELMAkGA1UEAwwCY2EwIBcNMjYxMDE3MDkyMTM4WhgPMjEyNjA5MjMwOTIxMzha
+MA0xCzAJBgNVBAMMAmNhMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEaGjAR/dV
+JDsCEwNx84UuNOsdZ55Qy+Hcy01J1y17l9kgW8sgKgLImUiTi7a8sCh0f/KNQAW8
+OvniWMnlA8fKhKNTMFEwHQYDVR0OBBYEFKd12OrnkdyWBuC57yKSTO0dCLg4MB8G
+A1UdIwQYMBaAFKd12OrnkdyWBuC57yKSTO0dCLg4MA8GA1UdEwEB/wQFMAMBAf8w
+CgYIKoZIzj0EAwIDSAAwRQIga03+iPFuLvjPQ1dAzmJJ3nnRzEPt1n/Nu1vKQwwt
+cBECIQDKOQpgdeKtujX5B/ObmLnisxmvloanjSb+UDsVJBZOJg==
+-----END CERTIFICATE-----
+`
+
+func TestConfigureNetworkCABundle(t *testing.T) {
+	dir := t.TempDir()
+
+	caCertFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caCertFile, []byte(testCACert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	systemBundle := filepath.Join(dir, "system.pem")
+	if err := os.WriteFile(systemBundle, []byte("system roots\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldBundles, oldHostCertFile := systemCABundles, hostCertFile
+	defer func() {
+		systemCABundles, hostCertFile = oldBundles, oldHostCertFile
+	}()
+	hostCertFile = ""
+
+	t.Setenv("SSL_CERT_FILE", "")
+
+	for _, cacheDir := range []string{"", filepath.Join(dir, "cache")} {
+		systemCABundles = []string{systemBundle}
+
+		ctx := &Context{CACertFile: caCertFile, CacheDir: cacheDir}
+		if err := ctx.configureNetwork(); err != nil {
+			t.Fatal(err)
+		}
+
+		path := os.Getenv("SSL_CERT_FILE")
+		if cacheDir == "" {
+			defer os.Remove(path)
+		} else if !strings.HasPrefix(path, cacheDir) {
+			t.Errorf("bundle %s is not in the cache directory %s", path, cacheDir)
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm()&0022 != 0 {
+			t.Errorf("bundle %s is writable by others: %v", path, fi.Mode())
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "system roots\n\n" + testCACert; string(data) != want {
+			t.Errorf("bundle = %q, want %q", data, want)
+		}
+
+		// without a bundle of the host, the custom CA would be the only
+		// one trusted.
+		systemCABundles = []string{filepath.Join(dir, "missing.pem")}
+		if err := ctx.configureNetwork(); err == nil {
+			t.Error("configureNetwork() succeeded without a CA bundle on the host")
+		}
+	}
+}
+
+func TestUseProxy(t *testing.T) {
+	for _, tc := range []struct {
+		host, noProxy string
+		want          bool
+	}{
+		{"example.com", "", true},
+		{"example.com:8443", "", true},
+		{"localhost:8080", "", false},
+		{"127.0.0.1:8080", "", false},
+		{"[::1]:8080", "", false},
+		{"example.com", "*", false},
+		{"example.com", "example.com", false},
+		{"packages.example.com", "example.com", false},
+		{"packages.example.com", ".example.com", false},
+		{"badexample.com", "example.com", true},
+		{"example.com:8443", "example.com:8443", false},
+		{"example.com:443", "example.com:8443", true},
+		{"10.1.2.3", "10.0.0.0/8", false},
+		{"10.1.2.3:80", "10.1.2.3", false},
+		{"192.168.1.1", "10.0.0.0/8, other.example.com", true},
+		{"Packages.Example.COM", "EXAMPLE.com", false},
+	} {
+		if got := useProxy(tc.host, tc.noProxy); got != tc.want {
+			t.Errorf("useProxy(%q, %q) = %t, want %t", tc.host, tc.noProxy, got, tc.want)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	dir := t.TempDir()
+	caCertFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caCertFile, []byte(testCACert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("HTTPS_PROXY", "")
+	ctx := &Context{
+		HTTPProxy:  "proxy.example.com:3128",
+		HTTPSProxy: "https://secure-proxy.example.com",
+		NoProxy:    "internal.example.com",
+		CACertFile: caCertFile,
+	}
+	transport, err := ctx.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"http://dl-cdn.alpinelinux.org/alpine", "http://proxy.example.com:3128"},
+		{"https://packages.wolfi.dev/os", "https://secure-proxy.example.com"},
+		{"https://git.internal.example.com/repo.git", ""},
+		{"http://127.0.0.1:8080/mirror", ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != tc.want {
+			t.Errorf("proxy of %s = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+
+	block, _ := pem.Decode([]byte(testCACert))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.TLSClientConfig == nil {
+		t.Fatal("the transport does not trust the CA certificates")
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: transport.TLSClientConfig.RootCAs}); err != nil {
+		t.Errorf("the transport does not trust the CA certificates: %v", err)
+	}
+
+	ctx.CACertFile = filepath.Join(dir, "missing.pem")
+	if _, err := ctx.newTransport(); err == nil {
+		t.Error("newTransport() succeeded without the CA certificates")
+	}
+}
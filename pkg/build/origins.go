@@ -0,0 +1,150 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// OriginReport describes the packages of a repository built from the
+// same configuration: an origin package and its subpackages.
+type OriginReport struct {
+	Origin string `json:"origin"`
+	// Versions are the versions of the origin package, empty when it
+	// is not in the repository.
+	Versions []string `json:"versions"`
+	// Packages are the names of the origin package and its
+	// subpackages, sorted.
+	Packages    []string `json:"packages"`
+	Subpackages int      `json:"subpackages"`
+	// Size is the total size of the package files of every version,
+	// and InstalledSize the total size of their contents.
+	Size          int64 `json:"size"`
+	InstalledSize int64 `json:"installed_size"`
+	// Skew lists the subpackages whose versions are not the ones of
+	// the origin package.
+	Skew []VersionSkew `json:"skew,omitempty"`
+}
+
+// VersionSkew is a subpackage out of sync with its origin package.
+type VersionSkew struct {
+	Package string `json:"package"`
+	// Missing are the versions of the origin package which the
+	// subpackage lacks, and Extra the versions of the subpackage which
+	// the origin package lacks.
+	Missing []string `json:"missing,omitempty"`
+	Extra   []string `json:"extra,omitempty"`
+}
+
+// OriginsReport groups the packages of the repository directory by
+// origin, sorted by origin.  The packages without origin, which older
+// versions of melange built, are their own origin.
+func OriginsReport(dir string) ([]OriginReport, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := readPackageInfos(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := map[string]*OriginReport{}
+	// versions maps the origins to the versions of their packages.
+	versions := map[string]map[string]map[string]bool{}
+	for i, pi := range infos {
+		name := pi.Get("pkgname")
+		origin := pi.Get("origin")
+		if origin == "" {
+			origin = name
+		}
+
+		r, ok := reports[origin]
+		if !ok {
+			r = &OriginReport{Origin: origin, Versions: []string{}, Packages: []string{}}
+			reports[origin] = r
+			versions[origin] = map[string]map[string]bool{}
+		}
+
+		fi, err := os.Stat(paths[i])
+		if err != nil {
+			return nil, err
+		}
+		r.Size += fi.Size()
+		if size, err := strconv.ParseInt(pi.Get("size"), 10, 64); err == nil {
+			r.InstalledSize += size
+		}
+
+		if versions[origin][name] == nil {
+			versions[origin][name] = map[string]bool{}
+			r.Packages = append(r.Packages, name)
+		}
+		versions[origin][name][pi.Get("pkgver")] = true
+	}
+
+	origins := []OriginReport{}
+	for origin, r := range reports {
+		sort.Strings(r.Packages)
+		r.Subpackages = len(r.Packages)
+
+		originVersions, ok := versions[origin][origin]
+		if ok {
+			r.Subpackages--
+			r.Versions = sortedKeys(originVersions)
+		}
+
+		for _, name := range r.Packages {
+			if name == origin {
+				continue
+			}
+
+			skew := VersionSkew{Package: name}
+			for v := range originVersions {
+				if !versions[origin][name][v] {
+					skew.Missing = append(skew.Missing, v)
+				}
+			}
+			for v := range versions[origin][name] {
+				if !originVersions[v] {
+					skew.Extra = append(skew.Extra, v)
+				}
+			}
+			if len(skew.Missing) > 0 || len(skew.Extra) > 0 {
+				sort.Strings(skew.Missing)
+				sort.Strings(skew.Extra)
+				r.Skew = append(r.Skew, skew)
+			}
+		}
+
+		origins = append(origins, *r)
+	}
+
+	sort.Slice(origins, func(i, j int) bool { return origins[i].Origin < origins[j].Origin })
+	return origins, nil
+}
+
+// sortedKeys returns the members of a set, sorted.
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
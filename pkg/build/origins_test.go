@@ -0,0 +1,72 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOriginsReport(t *testing.T) {
+	dir := t.TempDir()
+	for name, pkginfo := range map[string]string{
+		"hello-2.12-r0.apk":     "pkgname = hello\npkgver = 2.12-r0\norigin = hello\nsize = 100\n",
+		"hello-2.12-r1.apk":     "pkgname = hello\npkgver = 2.12-r1\norigin = hello\nsize = 100\n",
+		"hello-doc-2.12-r0.apk": "pkgname = hello-doc\npkgver = 2.12-r0\norigin = hello\nsize = 10\n",
+		"hello-doc-2.11-r0.apk": "pkgname = hello-doc\npkgver = 2.11-r0\norigin = hello\nsize = 10\n",
+		"hello-dev-2.12-r0.apk": "pkgname = hello-dev\npkgver = 2.12-r0\norigin = hello\nsize = 1\n",
+		"hello-dev-2.12-r1.apk": "pkgname = hello-dev\npkgver = 2.12-r1\norigin = hello\nsize = 1\n",
+		"libfoo-1.0-r0.apk":     "pkgname = libfoo\npkgver = 1.0-r0\nsize = 5\n",
+		"bar-doc-1.0-r0.apk":    "pkgname = bar-doc\npkgver = 1.0-r0\norigin = bar\nsize = 5\n",
+	} {
+		writePackageInfoAPK(t, filepath.Join(dir, name), pkginfo)
+	}
+
+	origins, err := OriginsReport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range origins {
+		if origins[i].Size <= 0 {
+			t.Errorf("size of %s = %d", origins[i].Origin, origins[i].Size)
+		}
+		origins[i].Size = 0
+	}
+
+	want := []OriginReport{{
+		Origin:        "bar",
+		Versions:      []string{},
+		Packages:      []string{"bar-doc"},
+		Subpackages:   1,
+		InstalledSize: 5,
+		Skew:          []VersionSkew{{Package: "bar-doc", Extra: []string{"1.0-r0"}}},
+	}, {
+		Origin:        "hello",
+		Versions:      []string{"2.12-r0", "2.12-r1"},
+		Packages:      []string{"hello", "hello-dev", "hello-doc"},
+		Subpackages:   2,
+		InstalledSize: 222,
+		Skew:          []VersionSkew{{Package: "hello-doc", Missing: []string{"2.12-r1"}, Extra: []string{"2.11-r0"}}},
+	}, {
+		Origin:        "libfoo",
+		Versions:      []string{"1.0-r0"},
+		Packages:      []string{"libfoo"},
+		InstalledSize: 5,
+	}}
+	if !reflect.DeepEqual(origins, want) {
+		t.Errorf("OriginsReport() =\n%+v\nwant\n%+v", origins, want)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// The layouts of the packages in the output directory.
+const (
+	// OutputLayoutFlat writes the packages to the output directory
+	// under their names, <package>-<version>-r<epoch>.apk.
+	OutputLayoutFlat = "flat"
+	// OutputLayoutContentAddressed writes the packages under their
+	// digest, sha256/<hex>.apk, and links their names to them.
+	OutputLayoutContentAddressed = "content-addressed"
+)
+
+// contentAddressedDir is the directory of the output directory holding
+// the packages written with OutputLayoutContentAddressed.
+const contentAddressedDir = "sha256"
+
+// storePackage moves a package written to a temporary file of the output
+// directory to its name there, according to the output layout.
+//
+// With OutputLayoutContentAddressed, the package is moved to
+// sha256/<hex>.apk, which never changes once written since its name is
+// its digest, so that concurrent writers of the same package write the
+// same file, and mirrors can copy the blobs before the links.  The name
+// of the package is then replaced atomically with a symbolic link to it.
+func (pc *PackageContext) storePackage(tmp string, digest []byte) error {
+	outPath := filepath.Join(pc.Context.OutDir, pc.Filename())
+	if pc.Context.OutputLayout != OutputLayoutContentAddressed {
+		return os.Rename(tmp, outPath)
+	}
+
+	blob := filepath.Join(contentAddressedDir, hex.EncodeToString(digest)+".apk")
+	if err := os.MkdirAll(filepath.Join(pc.Context.OutDir, contentAddressedDir), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(pc.Context.OutDir, blob)); err != nil {
+		return err
+	}
+
+	if err := linkAtomic(blob, outPath); err != nil {
+		return fmt.Errorf("unable to link %s: %w", pc.Filename(), err)
+	}
+
+	pc.Context.recordArtifact(blob)
+	return nil
+}
+
+// linkAtomic replaces path with a symbolic link to target.  Symbolic
+// links cannot be created over existing files, so the link is made under
+// a unique name first.
+func linkAtomic(target, path string) error {
+	link, err := os.CreateTemp(filepath.Dir(path), ".melange-link-*")
+	if err != nil {
+		return err
+	}
+	link.Close()
+	if err := os.Remove(link.Name()); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, link.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(link.Name(), path); err != nil {
+		os.Remove(link.Name())
+		return err
+	}
+	return nil
+}
+
+// isContentAddressed reports whether a path is a package written with
+// OutputLayoutContentAddressed.
+func isContentAddressed(path string) bool {
+	return filepath.Base(filepath.Dir(path)) == contentAddressedDir && filepath.Ext(path) == ".apk"
+}
+
+// rehashPackage moves a package written with OutputLayoutContentAddressed
+// whose contents changed, such as when it was re-signed, to the name of
+// its new digest, and returns it.
+func rehashPackage(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	rehashed := filepath.Join(filepath.Dir(path), hex.EncodeToString(h.Sum(nil))+".apk")
+	if err := os.Rename(path, rehashed); err != nil {
+		return "", err
+	}
+	return rehashed, nil
+}
+
+// relinkPackages points the symbolic links of a directory tree to the
+// packages which were moved, keyed by their previous path.
+func relinkPackages(dir string, moved map[string]string) error {
+	if len(moved) == 0 {
+		return nil
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		abs := target
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(filepath.Dir(path), target)
+		}
+
+		rehashed, ok := moved[abs]
+		if !ok {
+			return nil
+		}
+		if !filepath.IsAbs(target) {
+			if rehashed, err = filepath.Rel(filepath.Dir(path), rehashed); err != nil {
+				return err
+			}
+		}
+		return linkAtomic(rehashed, path)
+	})
+}
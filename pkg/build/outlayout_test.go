@@ -0,0 +1,135 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"chainguard.dev/melange/internal/sign"
+)
+
+// digestName returns the name of a package written with the
+// content-addressed layout.
+func digestName(data []byte) string {
+	digest := sha256.Sum256(data)
+	return filepath.Join(contentAddressedDir, hex.EncodeToString(digest[:])+".apk")
+}
+
+func TestStorePackage(t *testing.T) {
+	for _, layout := range []string{OutputLayoutFlat, OutputLayoutContentAddressed} {
+		ctx := &Context{OutDir: t.TempDir(), OutputLayout: layout}
+		pc := &PackageContext{Context: ctx, Origin: &Package{Name: "hello", Version: "2.12"}, PackageName: "hello"}
+		outPath := filepath.Join(ctx.OutDir, pc.Filename())
+
+		for _, contents := range []string{"first build", "second build"} {
+			tmp := filepath.Join(ctx.OutDir, ".melange-apk-test")
+			writeFile(t, tmp, contents)
+			digest := sha256.Sum256([]byte(contents))
+			if err := pc.storePackage(tmp, digest[:]); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != contents {
+				t.Errorf("%s: %s = %q, want %q", layout, pc.Filename(), data, contents)
+			}
+
+			target, err := os.Readlink(outPath)
+			switch {
+			case layout == OutputLayoutFlat && err == nil:
+				t.Errorf("%s: %s is a link", layout, pc.Filename())
+			case layout == OutputLayoutContentAddressed && target != digestName([]byte(contents)):
+				t.Errorf("%s: %s links to %q, want %q", layout, pc.Filename(), target, digestName([]byte(contents)))
+			}
+		}
+
+		if layout == OutputLayoutContentAddressed {
+			want := []string{digestName([]byte("first build")), digestName([]byte("second build"))}
+			if !reflect.DeepEqual(ctx.artifacts, want) {
+				t.Errorf("artifacts = %q, want %q", ctx.artifacts, want)
+			}
+			if _, err := os.Stat(filepath.Join(ctx.OutDir, want[0])); err != nil {
+				t.Errorf("the package of the first build was removed: %v", err)
+			}
+		}
+	}
+
+	if err := WithOutputLayout("tree")(&Context{}); err == nil {
+		t.Error("WithOutputLayout() accepted an unknown layout")
+	}
+}
+
+func TestResignContentAddressed(t *testing.T) {
+	keys := t.TempDir()
+	oldKey := writeTestKey(t, keys, "old.rsa")
+	newKey := writeTestKey(t, keys, "new.rsa")
+
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "hello.apk")
+	writePackageInfoAPK(t, tmp, "pkgname = hello\npkgver = 2.12-r0\n")
+	signTestArchive(t, tmp, sign.NewLocalSigner(oldKey, ""))
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+
+	ctx := &Context{OutDir: dir, OutputLayout: OutputLayoutContentAddressed, ChecksumManifest: true, signer: sign.NewLocalSigner(oldKey, "")}
+	pc := &PackageContext{Context: ctx, Origin: &Package{Name: "hello", Version: "2.12"}, PackageName: "hello"}
+	if err := pc.storePackage(tmp, digest[:]); err != nil {
+		t.Fatal(err)
+	}
+	ctx.recordArtifact(pc.Filename())
+	if err := ctx.WriteChecksumManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResignRepository(dir, oldKey+".pub", sign.NewLocalSigner(newKey, ""), nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, digestName(data))); err == nil {
+		t.Error("the package is still named after its digest before it was re-signed")
+	}
+
+	resigned, err := os.ReadFile(filepath.Join(dir, pc.Filename()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, pc.Filename())); err != nil || target != digestName(resigned) {
+		t.Errorf("%s links to %q, %v, want %q", pc.Filename(), target, err, digestName(resigned))
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(dir, ChecksumManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := checksumManifest(dir, []string{digestName(resigned), pc.Filename()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(manifest, want) {
+		t.Errorf("checksum manifest = %q, want %q", manifest, want)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/apk"
+)
+
+// outputRepository makes the packages written to the output directory by
+// the builds of a batch available to its later builds.  The output
+// directory is indexed after every build, and served as a repository
+// through a temporary directory, whose subdirectory named after the
+// architecture links to it, as apk expects.
+type outputRepository struct {
+	// dir is the temporary repository directory.
+	dir    string
+	outDir string
+	signer sign.Signer
+	// keyring is the public key which verifies the index.
+	keyring string
+}
+
+// newOutputRepository sets up the repository of outDir.  Its index is
+// signed with signer, whose public key is keyring.
+func newOutputRepository(outDir string, signer sign.Signer, keyring string) (*outputRepository, error) {
+	outDir, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up output repository: %w", err)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to set up output repository: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "melange-repository-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up output repository: %w", err)
+	}
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	if err := os.Symlink(outDir, filepath.Join(dir, arch)); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to set up output repository: %w", err)
+	}
+
+	return &outputRepository{dir: dir, outDir: outDir, signer: signer, keyring: keyring}, nil
+}
+
+func (r *outputRepository) remove() {
+	if err := os.RemoveAll(r.dir); err != nil {
+		log.Printf("warning: unable to remove output repository: %v", err)
+	}
+}
+
+// update writes the index of the packages in the output directory to
+// its APKINDEX.tar.gz, replacing any previous index.
+func (r *outputRepository) update() error {
+	paths, err := filepath.Glob(filepath.Join(r.outDir, "*.apk"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	entries := []apk.IndexEntry{}
+	for _, path := range paths {
+		entry, err := readIndexEntry(path)
+		if err != nil {
+			return fmt.Errorf("unable to index %s: %w", filepath.Base(path), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	var index bytes.Buffer
+	if err := apk.WriteIndex(&index, entries, "melange output"); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if r.signer != nil {
+		digest := sha1.Sum(index.Bytes()) // nolint:gosec
+		signature, err := r.signer.SignSHA1Digest(digest[:])
+		if err != nil {
+			return fmt.Errorf("unable to sign index: %w", err)
+		}
+		signatures := map[string][]byte{r.signer.KeyName(): signature}
+		if err := writeSignatureSection(&out, signatures, nil, time.Unix(0, 0)); err != nil {
+			return fmt.Errorf("unable to write signature tarball: %w", err)
+		}
+	}
+	out.Write(index.Bytes())
+
+	tmp, err := os.CreateTemp(r.outDir, ".melange-APKINDEX-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(r.outDir, "APKINDEX.tar.gz"))
+}
+
+// readIndexEntry returns the index record of the package at path.
+func readIndexEntry(path string) (apk.IndexEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return apk.IndexEntry{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return apk.IndexEntry{}, err
+	}
+
+	pkg, err := apk.ReadPackage(f)
+	if err != nil {
+		return apk.IndexEntry{}, err
+	}
+
+	return apk.NewIndexEntry(pkg.Info, pkg.ControlDigest, info.Size()), nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/apk"
+)
+
+func TestOutputRepository(t *testing.T) {
+	key := writeTestKey(t, t.TempDir(), "melange.rsa")
+	outDir := t.TempDir()
+	writePackageInfoAPK(t, filepath.Join(outDir, "foo-1.0-r0.apk"), "pkgname = foo\npkgver = 1.0-r0\ndepend = bar\n")
+
+	signer := sign.NewLocalSigner(key, "")
+	repo, err := newOutputRepository(outDir, signer, key+".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.remove()
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	for _, tc := range []struct {
+		name  string
+		write string
+		want  []string
+	}{{
+		name: "existing packages",
+		want: []string{"foo"},
+	}, {
+		name:  "package built by the batch",
+		write: "bar",
+		want:  []string{"bar", "foo"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.write != "" {
+				writePackageInfoAPK(t, filepath.Join(outDir, tc.write+"-1.0-r0.apk"), "pkgname = "+tc.write+"\npkgver = 1.0-r0\n")
+			}
+			if err := repo.update(); err != nil {
+				t.Fatal(err)
+			}
+
+			// apk finds the index below the directory named after
+			// the architecture.
+			data, err := os.ReadFile(filepath.Join(repo.dir, arch, "APKINDEX.tar.gz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sigs, err := apk.ReadSignatures(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sign.RSAVerifySHA1Digest(sigs.Digest, sigs.Signatures[signer.KeyName()], key+".pub"); err != nil {
+				t.Errorf("index signature does not verify: %v", err)
+			}
+
+			entries, err := apk.ReadIndex(bytes.NewReader(data[sigs.Size:]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.Name())
+				if e.Checksum() == "" {
+					t.Errorf("%s has no checksum", e.Name())
+				}
+			}
+			if !reflect.DeepEqual(names, tc.want) {
+				t.Errorf("indexed %q, want %q", names, tc.want)
+			}
+		})
+	}
+}
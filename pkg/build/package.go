@@ -19,7 +19,9 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
@@ -29,6 +31,7 @@ import (
 
 	"chainguard.dev/apko/pkg/tarball"
 	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/errcode"
 	"github.com/psanford/memfs"
 )
 
@@ -36,26 +39,85 @@ type PackageContext struct {
 	Context       *Context
 	Origin        *Package
 	PackageName   string
+	Description   string
+	URL           string
+	Copyright     []Copyright
+	Dependencies  Dependencies
+	Deprecation   *Deprecation
+	SizeBudget    *SizeBudget
+	CPE           []string
 	InstalledSize int64
 	DataHash      string
+	// DataHashes are the additional digests of the data section,
+	// keyed by algorithm, see WithDigests.
+	DataHashes map[string]string
 }
 
 func (pkg *Package) Emit(ctx *PipelineContext) error {
 	fakesp := Subpackage{
-		Name: pkg.Name,
+		Name:         pkg.Name,
+		Description:  pkg.Description,
+		URL:          pkg.URL,
+		Copyright:    pkg.Copyright,
+		Dependencies: pkg.Dependencies,
+		Deprecation:  pkg.Deprecation,
+		SizeBudget:   pkg.SizeBudget,
+		CPE:          pkg.CPE,
 	}
 	return fakesp.Emit(ctx)
 }
 
 func (spkg *Subpackage) Emit(ctx *PipelineContext) error {
+	origin := &ctx.Context.Configuration.Package
+
 	pc := PackageContext{
-		Context:     ctx.Context,
-		Origin:      &ctx.Context.Configuration.Package,
-		PackageName: spkg.Name,
+		Context:      ctx.Context,
+		Origin:       origin,
+		PackageName:  spkg.Name,
+		Description:  spkg.Description,
+		URL:          spkg.URL,
+		Copyright:    spkg.Copyright,
+		Dependencies: spkg.Dependencies,
+		Deprecation:  spkg.Deprecation,
+		SizeBudget:   spkg.SizeBudget,
+		CPE:          spkg.CPE,
+	}
+
+	if pc.Description == "" {
+		pc.Description = origin.Description
+	}
+	if pc.URL == "" {
+		pc.URL = origin.URL
+	}
+	if len(pc.Copyright) == 0 {
+		pc.Copyright = origin.Copyright
+	}
+	if pc.Deprecation == nil {
+		pc.Deprecation = origin.Deprecation
+	}
+	if len(pc.CPE) == 0 {
+		pc.CPE = origin.CPE
+	}
+	if len(pc.Dependencies.Runtime) == 0 {
+		pc.Dependencies.Runtime = inheritedRuntime(origin.Dependencies.Runtime, spkg.Name)
 	}
+
 	return pc.EmitPackage()
 }
 
+// inheritedRuntime returns the runtime dependencies of the origin package
+// which a subpackage inherits: all of them, except the dependencies on the
+// subpackage itself.
+func inheritedRuntime(runtime []string, name string) []string {
+	deps := []string{}
+	for _, dep := range runtime {
+		if packageName(dep) != name {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
 func (pc *PackageContext) Identity() string {
 	return fmt.Sprintf("%s-%s-r%d", pc.PackageName, pc.Origin.Version, pc.Origin.Epoch)
 }
@@ -70,17 +132,77 @@ func (pc *PackageContext) WorkspaceSubdir() string {
 
 var controlTemplate = `
 # Generated by melange.
+# config digest: {{.Context.ConfigDigest}}
+# sandbox: {{.Context.SandboxProfile}}
+{{- with .Context.EnvironmentSize }}
+# build environment size: {{.}}
+{{- end }}
+{{- with .Context.SettingsDigest }}
+# settings digest: {{.}}
+{{- end }}
+{{- range $alg, $hash := .DataHashes }}
+# datahash {{ $alg }}: {{ $hash }}
+{{- end }}
+{{- range $passed := .Context.PassedEnvironment }}
+# passed environment: {{ $passed }}
+{{- end }}
+{{- range $source := .Context.FetchedSources }}
+# source: {{ $source }}
+{{- end }}
+{{- range $artifact := .Context.ImportedArtifacts }}
+# imported artifact: {{ $artifact }}
+{{- end }}
+{{- range $artifact := .Context.ExportedArtifacts }}
+# exported artifact: {{ $artifact }}
+{{- end }}
+{{- range $annotation := .Context.Configuration.SortedAnnotations }}
+# annotation {{ $annotation }}
+{{- end }}
+{{- with .Deprecation }}
+# deprecated{{ with .Reason }}: {{ . }}{{ end }}
+{{- with .Replacement }}
+# replacement: {{ . }}
+{{- end }}
+{{- with .EndOfLife }}
+# end of life: {{ . }}
+{{- end }}
+{{- end }}
+{{- with .Context.Git }}
+# commit author: {{.Author}}
+{{- if .Dirty }}
+# built from an uncommitted configuration
+{{- end }}
+{{- end }}
 pkgname = {{.PackageName}}
 pkgver = {{.Origin.Version}}-r{{.Origin.Epoch}}
 arch = x86_64
+origin = {{.Origin.Name}}
 size = {{.InstalledSize}}
-pkgdesc = {{.Origin.Description}}
-{{- range $copyright := .Origin.Copyright }}
+{{- if not .Context.SourceDateEpoch.IsZero }}
+builddate = {{.Context.SourceDateEpoch.Unix}}
+{{- end }}
+pkgdesc = {{.Description}}
+{{- if .URL }}
+url = {{.URL}}
+{{- end }}
+{{- with .Context.Git }}
+commit = {{.Commit}}
+{{- end }}
+{{- range $copyright := .Copyright }}
 license = {{ $copyright.License }}
 {{- end }}
-{{- range $dep := .Origin.Dependencies.Runtime }}
+{{- range $dep := .Dependencies.Runtime }}
 depend = {{ $dep }}
 {{- end }}
+{{- range $dep := .Dependencies.Conflicts }}
+depend = !{{ $dep }}
+{{- end }}
+{{- range $dep := .Dependencies.Provides }}
+provides = {{ $dep }}
+{{- end }}
+{{- if .Dependencies.ProviderPriority }}
+provider_priority = {{.Dependencies.ProviderPriority}}
+{{- end }}
 datahash = {{.DataHash}}
 `
 
@@ -89,8 +211,73 @@ func (pc *PackageContext) GenerateControlData(w io.Writer) error {
 	return template.Must(tmpl.Parse(controlTemplate)).Execute(w, pc)
 }
 
-func (pc *PackageContext) SignatureName() string {
-	return fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(pc.Context.SigningKey))
+func (pc *PackageContext) SignatureName(signer sign.Signer) string {
+	return fmt.Sprintf(".SIGN.RSA.%s", signer.KeyName())
+}
+
+// packageSigner returns the signer of the packages, or nil if they are
+// not signed.  It is created on first use, as connecting to a signing
+// service is only worth it once there is something to sign.
+func (ctx *Context) packageSigner() (sign.Signer, error) {
+	if ctx.signer != nil {
+		return ctx.signer, nil
+	}
+
+	switch {
+	case ctx.SigningKMS != "":
+		signer, err := sign.NewAzureKeyVaultSigner(ctx.SigningKMS, ctx.client())
+		if err != nil {
+			return nil, ctx.signingError(err)
+		}
+		ctx.signer = signer
+	case ctx.SigningServer != "":
+		signer, err := sign.NewRemoteSigner(ctx.SigningServer, ctx.SigningClientCert, ctx.SigningClientKey, ctx.SigningServerCA)
+		if err != nil {
+			return nil, ctx.signingError(fmt.Errorf("unable to connect to signing server: %w", err))
+		}
+		ctx.signer = signer
+	case ctx.SigningKey != "":
+		ctx.signer = sign.NewLocalSigner(ctx.SigningKey, ctx.SigningPassphrase)
+	}
+
+	return ctx.signer, nil
+}
+
+// signs reports whether the packages are signed, with a signing key,
+// server or KMS key.
+func (ctx *Context) signs() bool {
+	return ctx.SigningKey != "" || ctx.SigningServer != "" || ctx.SigningKMS != ""
+}
+
+// signingError attaches the code of the signing key, server or KMS key in
+// use to a signing failure.
+func (ctx *Context) signingError(err error) error {
+	if ctx.SigningKMS != "" {
+		return errcode.Wrap(errcode.SigningKMS, err, "signing kms", ctx.SigningKMS)
+	}
+	if ctx.SigningServer != "" {
+		return errcode.Wrap(errcode.SigningServer, err, "signing server", ctx.SigningServer)
+	}
+	return errcode.Wrap(errcode.SigningKey, err, "signing key", ctx.SigningKey)
+}
+
+// timestampSignatures returns the time-stamp tokens of signatures, keyed
+// like them, or none if there is no time-stamping authority.
+func (ctx *Context) timestampSignatures(signatures map[string][]byte) (map[string][]byte, error) {
+	timestamps := map[string][]byte{}
+	if ctx.TimestampURL == "" {
+		return timestamps, nil
+	}
+
+	timestamper := sign.NewTimestamper(ctx.TimestampURL, ctx.client())
+	for name, signature := range signatures {
+		token, err := timestamper.Timestamp(signature)
+		if err != nil {
+			return nil, errcode.Wrap(errcode.SigningTimestamp, fmt.Errorf("unable to timestamp signature: %w", err), "timestamp url", ctx.TimestampURL)
+		}
+		timestamps[name] = token
+	}
+	return timestamps, nil
 }
 
 func combine(out io.Writer, inputs ...io.Reader) error {
@@ -103,6 +290,37 @@ func combine(out io.Writer, inputs ...io.Reader) error {
 	return nil
 }
 
+// checkOverwrite returns an error if a different package already exists
+// at path, unless overwriting is forced.  Replacing a published package
+// with different contents under the same name breaks mirrors and apk
+// caches.
+func (pc *PackageContext) checkOverwrite(path string, digest []byte) error {
+	existing, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open existing apk file: %w", err)
+	}
+	defer existing.Close()
+
+	existingDigest := sha256.New()
+	if _, err := io.Copy(existingDigest, existing); err != nil {
+		return fmt.Errorf("unable to read existing apk file: %w", err)
+	}
+
+	if bytes.Equal(digest, existingDigest.Sum(nil)) {
+		return nil
+	}
+
+	if pc.Context.Force {
+		log.Printf("warning: overwriting %s, which has different contents", path)
+		return nil
+	}
+
+	return fmt.Errorf("%s already exists with different contents, bump the epoch or use --force to overwrite it", path)
+}
+
 // TODO(kaniini): generate APKv3 packages
 func (pc *PackageContext) EmitPackage() error {
 	log.Printf("generating package %s", pc.Identity())
@@ -111,47 +329,69 @@ func (pc *PackageContext) EmitPackage() error {
 	if err != nil {
 		return fmt.Errorf("unable to open temporary file for writing: %w", err)
 	}
+	defer os.Remove(dataTarGz.Name())
 	defer dataTarGz.Close()
 
-	tarctx, err := tarball.NewContext(
-		tarball.WithSourceDateEpoch(pc.Context.SourceDateEpoch),
-		tarball.WithOverrideUIDGID(0, 0),
-		tarball.WithOverrideUname("root"),
-		tarball.WithOverrideGname("root"),
-		tarball.WithUseChecksums(true),
-	)
-	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+	if err := pc.installLicenseTexts(); err != nil {
+		return err
 	}
 
-	fsys := os.DirFS(pc.WorkspaceSubdir())
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	if pc.Origin.shouldCompressDocs() {
+		if err := compressDocs(pc.WorkspaceSubdir()); err != nil {
+			return fmt.Errorf("unable to compress documentation: %w", err)
 		}
+	}
+
+	if err := pc.runChecks(); err != nil {
+		return err
+	}
 
-		fi, err := d.Info()
+	for _, name := range pc.Context.SBOMGenerators {
+		g, err := lookupSBOMGenerator(name)
 		if err != nil {
 			return err
 		}
 
-		pc.InstalledSize += fi.Size()
-		return nil
-	}); err != nil {
-		return fmt.Errorf("unable to preprocess package data: %w", err)
+		if err := g.Generate(pc); err != nil {
+			return fmt.Errorf("unable to generate SBOM with %s: %w", name, err)
+		}
+	}
+
+	if err := pc.generateVEX(); err != nil {
+		return err
 	}
 
 	// TODO(kaniini): generate so:/cmd: virtuals for the filesystem
 	// prepare data.tar.gz
 	dataDigest := sha256.New()
-	dataMW := io.MultiWriter(dataDigest, dataTarGz)
-	if err := tarctx.WriteArchiveFromFS(pc.WorkspaceSubdir(), fsys, dataMW); err != nil {
+	dataWriters := []io.Writer{dataDigest, dataTarGz}
+	extraDigests := map[string]hash.Hash{}
+	for _, alg := range pc.Context.Digests {
+		if alg != "sha256" {
+			extraDigests[alg] = packageDigests[alg]()
+			dataWriters = append(dataWriters, extraDigests[alg])
+		}
+	}
+	dataMW := io.MultiWriter(dataWriters...)
+	da := &dataArchive{
+		sourceDateEpoch: pc.Context.SourceDateEpoch,
+		specialFiles:    pc.Origin.SpecialFiles,
+		preserveXattrs:  pc.Origin.PreserveXattrs,
+		digests:         pc.Context.Digests,
+	}
+	pc.InstalledSize, err = da.write(pc.WorkspaceSubdir(), dataMW)
+	if err != nil {
 		return fmt.Errorf("unable to write data tarball: %w", err)
 	}
 
 	pc.DataHash = hex.EncodeToString(dataDigest.Sum(nil))
 	log.Printf("  data.tar.gz installed-size: %d", pc.InstalledSize)
 	log.Printf("  data.tar.gz digest: %s", pc.DataHash)
+	pc.DataHashes = map[string]string{}
+	for alg, h := range extraDigests {
+		pc.DataHashes[alg] = hex.EncodeToString(h.Sum(nil))
+		log.Printf("  data.tar.gz %s digest: %s", alg, pc.DataHashes[alg])
+	}
 
 	if _, err := dataTarGz.Seek(0, io.SeekStart); err != nil {
 		return fmt.Errorf("unable to rewind data tarball: %w", err)
@@ -183,6 +423,7 @@ func (pc *PackageContext) EmitPackage() error {
 	if err != nil {
 		return fmt.Errorf("unable to open temporary file for writing: %w", err)
 	}
+	defer os.Remove(controlTarGz.Name())
 	defer controlTarGz.Close()
 
 	controlDigest := sha1.New() // nolint:gosec
@@ -200,25 +441,30 @@ func (pc *PackageContext) EmitPackage() error {
 
 	combinedParts := []io.Reader{controlTarGz, dataTarGz}
 
-	if pc.Context.SigningKey != "" {
-		signatureFS := memfs.New()
-		signatureBuf, err := sign.RSASignSHA1Digest(controlDigest.Sum(nil),
-			pc.Context.SigningKey, pc.Context.SigningPassphrase)
-		if err != nil {
-			return fmt.Errorf("unable to generate signature: %w", err)
-		}
+	signer, err := pc.Context.packageSigner()
+	if err != nil {
+		return err
+	}
 
-		if err := signatureFS.WriteFile(pc.SignatureName(), signatureBuf, 0644); err != nil {
-			return fmt.Errorf("unable to build signature FS: %w", err)
+	if signer != nil {
+		signatureBuf, err := signer.SignSHA1Digest(controlDigest.Sum(nil))
+		if err != nil {
+			return pc.Context.signingError(fmt.Errorf("unable to generate signature: %w", err))
 		}
 
 		signatureTarGz, err := os.CreateTemp("", "melange-signature-*.tar.gz")
 		if err != nil {
 			return fmt.Errorf("unable to open temporary file for writing: %w", err)
 		}
+		defer os.Remove(signatureTarGz.Name())
 		defer signatureTarGz.Close()
 
-		if err := multitarctx.WriteArchiveFromFS(".", signatureFS, signatureTarGz); err != nil {
+		signatures := map[string][]byte{signer.KeyName(): signatureBuf}
+		timestamps, err := pc.Context.timestampSignatures(signatures)
+		if err != nil {
+			return err
+		}
+		if err := writeSignatureSection(signatureTarGz, signatures, timestamps, pc.Context.SourceDateEpoch); err != nil {
 			return fmt.Errorf("unable to write signature tarball: %w", err)
 		}
 
@@ -230,17 +476,50 @@ func (pc *PackageContext) EmitPackage() error {
 	}
 
 	// build the final tarball
-	outFile, err := os.Create(pc.Filename())
+	if err := os.MkdirAll(pc.Context.OutDir, 0755); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	outFile, err := os.CreateTemp(pc.Context.OutDir, ".melange-apk-*")
 	if err != nil {
 		return fmt.Errorf("unable to create apk file: %w", err)
 	}
+	defer os.Remove(outFile.Name())
 	defer outFile.Close()
 
-	if err := combine(outFile, combinedParts...); err != nil {
+	apkDigest := sha256.New()
+	if err := combine(io.MultiWriter(outFile, apkDigest), combinedParts...); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	fi, err := os.Stat(outFile.Name())
+	if err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+	if err := pc.checkSizeBudget(fi.Size()); err != nil {
+		return err
+	}
+
+	outPath := filepath.Join(pc.Context.OutDir, pc.Filename())
+	if err := pc.checkOverwrite(outPath, apkDigest.Sum(nil)); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(outFile.Name(), 0644); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	if err := pc.storePackage(outFile.Name(), apkDigest.Sum(nil)); err != nil {
 		return fmt.Errorf("unable to write apk file: %w", err)
 	}
 
-	log.Printf("wrote %s", outFile.Name())
+	log.Printf("wrote %s", outPath)
+	pc.Context.recordArtifact(pc.Filename())
+	pc.recordEmittedPackage(controlDigest.Sum(nil), apkDigest.Sum(nil))
 
 	return nil
 }
@@ -0,0 +1,136 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chainguard.dev/melange/pkg/apk"
+)
+
+func TestGenerateControlDataDependencies(t *testing.T) {
+	pc := PackageContext{
+		Context:     &Context{},
+		Origin:      &Package{Name: "postfix", Version: "3.7"},
+		PackageName: "postfix",
+		Dependencies: Dependencies{
+			Runtime:   []string{"libc"},
+			Provides:  []string{"sendmail"},
+			Conflicts: []string{"exim"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := pc.GenerateControlData(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	pi, err := apk.ParsePackageInfo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := pi.GetAll("depend"); !reflect.DeepEqual(got, []string{"libc", "!exim"}) {
+		t.Errorf("depend = %q, want [libc !exim]", got)
+	}
+	if got := pi.GetAll("provides"); !reflect.DeepEqual(got, []string{"sendmail"}) {
+		t.Errorf("provides = %q, want [sendmail]", got)
+	}
+}
+
+func TestInheritedRuntime(t *testing.T) {
+	for _, tc := range []struct {
+		runtime []string
+		name    string
+		want    []string
+	}{{
+		runtime: []string{"libc", "ca-certificates"},
+		name:    "postfix-doc",
+		want:    []string{"libc", "ca-certificates"},
+	}, {
+		runtime: []string{"postfix-libs>=3.7", "libc"},
+		name:    "postfix-libs",
+		want:    []string{"libc"},
+	}, {
+		name: "postfix-doc",
+		want: []string{},
+	}} {
+		if got := inheritedRuntime(tc.runtime, tc.name); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("inheritedRuntime(%q, %s) = %q, want %q", tc.runtime, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "foo-1.0-r0.apk")
+	if err := os.WriteFile(existing, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	same := sha256.Sum256([]byte("existing"))
+	different := sha256.Sum256([]byte("rebuilt"))
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		digest []byte
+		force  bool
+		err    string
+	}{{
+		name:   "new package",
+		path:   filepath.Join(dir, "foo-1.1-r0.apk"),
+		digest: different[:],
+	}, {
+		name:   "identical contents",
+		path:   existing,
+		digest: same[:],
+	}, {
+		name:   "different contents",
+		path:   existing,
+		digest: different[:],
+		err:    "already exists with different contents",
+	}, {
+		name:   "different contents with force",
+		path:   existing,
+		digest: different[:],
+		force:  true,
+	}, {
+		name:   "unreadable",
+		path:   dir,
+		digest: different[:],
+		err:    "unable to read existing apk file",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := PackageContext{Context: &Context{Force: tc.force}}
+			err := pc.checkOverwrite(tc.path, tc.digest)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("checkOverwrite() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("checkOverwrite() = %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// reservedEnvironment lists the variables set by melange for the
+// pipelines, which cannot be passed through from the host.
+var reservedEnvironment = []string{
+	"PATH", "HOME", "TMPDIR", "LANG", "LC_ALL", "LANGUAGE", "TZ", "LD_PRELOAD",
+	"XDG_*", "FAKETIME*",
+}
+
+// validatePassEnv checks the names of the variables passed through from
+// the host.
+func validatePassEnv(names []string) error {
+	for _, name := range names {
+		if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" || (name[0] >= '0' && name[0] <= '9') {
+			return fmt.Errorf("%q is not the name of an environment variable", name)
+		}
+
+		for _, reserved := range reservedEnvironment {
+			if name == reserved || strings.HasSuffix(reserved, "*") && strings.HasPrefix(name, strings.TrimSuffix(reserved, "*")) {
+				return fmt.Errorf("%s is set by melange and cannot be passed through", name)
+			}
+		}
+	}
+	return nil
+}
+
+// passEnvNames returns the sorted names of the variables passed through
+// from the host, allowed either by the package or by melange.
+func (ctx *Context) passEnvNames() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, name := range append(append([]string{}, ctx.PassEnv...), ctx.Configuration.Package.PassEnv...) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// passEnvironment returns the variables of the host passed through to
+// the pipelines, as KEY=value.  The allowed variables which are not set
+// on the host are not set for the pipelines either.
+func (ctx *Context) passEnvironment() []string {
+	env := []string{}
+	for _, name := range ctx.passEnvNames() {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// PassedEnvironment describes the variables passed through from the host
+// for the provenance of the packages.  The values may be secrets, so only
+// their digests are recorded.
+func (ctx *Context) PassedEnvironment() []string {
+	passed := []string{}
+	for _, name := range ctx.passEnvNames() {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			passed = append(passed, name+" unset")
+			continue
+		}
+		passed = append(passed, fmt.Sprintf("%s sha256:%x", name, sha256.Sum256([]byte(value))))
+	}
+	return passed
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidatePassEnv(t *testing.T) {
+	if err := validatePassEnv([]string{"GITHUB_TOKEN", "GOPROXY", "_X1"}); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{"", "1X", "FOO-BAR", "A=B", "PATH", "LD_PRELOAD", "XDG_CONFIG_HOME", "FAKETIME_DONT_RESET"} {
+		if err := validatePassEnv([]string{name}); err == nil {
+			t.Errorf("validatePassEnv(%q) succeeded", name)
+		}
+	}
+}
+
+func TestPassEnvironment(t *testing.T) {
+	t.Setenv("GOPROXY", "https://proxy.example.com")
+	t.Setenv("GITHUB_TOKEN", "secret")
+
+	ctx := &Context{PassEnv: []string{"GOPROXY", "MELANGE_TEST_UNSET"}}
+	ctx.Configuration.Package.PassEnv = []string{"GITHUB_TOKEN", "GOPROXY"}
+
+	env, err := ctx.scriptEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"GITHUB_TOKEN=secret", "GOPROXY=https://proxy.example.com"}
+	if got := env[len(env)-2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("passed environment = %q, want %q", got, want)
+	}
+
+	pc := PackageContext{Context: ctx, Origin: &Package{Name: "hello"}, PackageName: "hello"}
+	var buf bytes.Buffer
+	if err := pc.GenerateControlData(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		// sha256 of "secret"
+		"# passed environment: GITHUB_TOKEN sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b\n",
+		"# passed environment: MELANGE_TEST_UNSET unset\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("%q is not recorded in:\n%s", line, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Error("the value of a passed variable is recorded")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/errcode"
+	"gopkg.in/yaml.v3"
+)
+
+// repositoryPinsMu serializes updates of the repository pins file from
+// builds running in parallel.
+var repositoryPinsMu sync.Mutex
+
+// indexURL returns the location of the APKINDEX of a repository, as
+// listed in the environment, for an architecture.
+func indexURL(repository, arch string) string {
+	// repositories may be tagged, e.g. "@testing https://...".
+	if strings.HasPrefix(repository, "@") {
+		if fields := strings.Fields(repository); len(fields) == 2 {
+			repository = fields[1]
+		}
+	}
+
+	return fmt.Sprintf("%s/%s/APKINDEX.tar.gz", strings.TrimSuffix(repository, "/"), arch)
+}
+
+// fetchIndex fetches an APKINDEX.
+func (ctx *Context) fetchIndex(url string) ([]byte, error) {
+	var r io.ReadCloser
+
+	if ctx.fetchCache != nil && (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
+		resp, err := ctx.fetchCache.get(ctx.client(), url)
+		if err != nil {
+			return nil, err
+		}
+
+		r = resp.open()
+		if resp.status != http.StatusOK {
+			r.Close()
+			return nil, fmt.Errorf("fetching %s: %s", url, http.StatusText(resp.status))
+		}
+	} else if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		resp, err := ctx.client().Get(url)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+		}
+
+		r = resp.Body
+	} else {
+		f, err := os.Open(url)
+		if err != nil {
+			return nil, err
+		}
+
+		r = f
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", url, err)
+	}
+
+	return data, nil
+}
+
+// fetchIndexes fetches the APKINDEX of every repository of the build
+// environment, keyed by APKINDEX location.
+func (ctx *Context) fetchIndexes() (map[string][]byte, error) {
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+
+	indexes := map[string][]byte{}
+	for _, repo := range ctx.Configuration.Environment.Contents.Repositories {
+		url := indexURL(repo, arch)
+
+		data, err := ctx.fetchIndex(url)
+		if err != nil {
+			return nil, errcode.Wrap(errcode.FetchIndex, fmt.Errorf("unable to fetch repository index: %w", err), "url", url)
+		}
+
+		indexes[url] = data
+	}
+
+	return indexes, nil
+}
+
+// indexDigests returns the digests of repository indexes, keyed by
+// APKINDEX location.
+func indexDigests(indexes map[string][]byte) map[string]string {
+	digests := map[string]string{}
+	for url, data := range indexes {
+		digests[url] = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	}
+
+	return digests
+}
+
+// pinningRepositories reports whether the repository indexes need to be
+// verified.
+func (ctx *Context) pinningRepositories() bool {
+	return len(ctx.Configuration.RepositoryPins) > 0 || ctx.RepositoryPinsFile != ""
+}
+
+// loadRepositoryPins reads the pins recorded in the repository pins file.
+func (ctx *Context) loadRepositoryPins() (map[string]string, error) {
+	pins := map[string]string{}
+
+	data, err := os.ReadFile(ctx.RepositoryPinsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read repository pins: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("unable to parse repository pins: %w", err)
+	}
+
+	if pins == nil {
+		pins = map[string]string{}
+	}
+
+	return pins, nil
+}
+
+// checkRepositoryPins verifies the digests of the repository indexes
+// against the pins of the configuration and of the repository pins file.
+// Indexes which are not pinned in the file yet are trusted on first use
+// and recorded in it.
+func (ctx *Context) checkRepositoryPins(digests map[string]string) error {
+	for url, pin := range ctx.Configuration.RepositoryPins {
+		digest, ok := digests[url]
+		if !ok {
+			return fmt.Errorf("%s is pinned, but is not an index of the build environment", url)
+		}
+
+		if digest != pin {
+			return errcode.Wrap(errcode.FetchIntegrity, fmt.Errorf("%s has digest %s, but is pinned to %s", url, digest, pin), "url", url)
+		}
+	}
+
+	if ctx.RepositoryPinsFile == "" {
+		return nil
+	}
+
+	repositoryPinsMu.Lock()
+	defer repositoryPinsMu.Unlock()
+
+	pins, err := ctx.loadRepositoryPins()
+	if err != nil {
+		return err
+	}
+
+	updated := false
+	for url, digest := range digests {
+		pin, ok := pins[url]
+		if !ok {
+			log.Printf("pinning %s to %s", url, digest)
+			pins[url] = digest
+			updated = true
+			continue
+		}
+
+		if digest != pin {
+			return errcode.Wrap(errcode.FetchIntegrity, fmt.Errorf("%s has digest %s, but was pinned to %s in %s", url, digest, pin, ctx.RepositoryPinsFile), "url", url, "pins", ctx.RepositoryPinsFile)
+		}
+	}
+
+	if !updated {
+		return nil
+	}
+
+	data, err := yaml.Marshal(pins)
+	if err != nil {
+		return fmt.Errorf("unable to encode repository pins: %w", err)
+	}
+
+	if err := os.WriteFile(ctx.RepositoryPinsFile, data, 0644); err != nil {
+		return fmt.Errorf("unable to write repository pins: %w", err)
+	}
+
+	return nil
+}
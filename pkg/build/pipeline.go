@@ -16,14 +16,20 @@ package build
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 
+	"chainguard.dev/melange/pipelines"
+	"chainguard.dev/melange/pkg/errcode"
 	"gopkg.in/yaml.v3"
 )
 
@@ -40,6 +46,12 @@ func (p *Pipeline) Identity() string {
 	if p.Uses != "" {
 		return p.Uses
 	}
+	if p.Build != nil {
+		return p.Build.Identity()
+	}
+	if p.Assertions != nil {
+		return "assertions"
+	}
 	return "???"
 }
 
@@ -63,6 +75,10 @@ func mutateWith(ctx *PipelineContext, with map[string]string) map[string]string
 		nw["${{targets.subpkgdir}}"] = fmt.Sprintf("/home/build/melange-out/%s", ctx.Subpackage.Name)
 	}
 
+	for k, v := range ctx.Context.Configuration.varReplacements() {
+		nw[k] = v
+	}
+
 	for k, v := range with {
 		// already mutated?
 		if strings.HasPrefix(k, "${{") {
@@ -81,11 +97,49 @@ func mutateWith(ctx *PipelineContext, with map[string]string) map[string]string
 	return nw
 }
 
+// readBuiltinPipeline reads a built-in pipeline from the pipeline
+// directory, falling back to the pipelines embedded in melange.
+func readBuiltinPipeline(ctx *Context, uses string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(ctx.PipelineDir, uses+".yaml"))
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return fs.ReadFile(pipelines.FS, uses+".yaml")
+}
+
+// readPipeline resolves the pipeline referenced by uses.  Overlay
+// directories are searched first, in order, so that individual built-in
+// pipelines can be shadowed without replacing the whole set.
+func readPipeline(ctx *Context, uses string) ([]byte, error) {
+	for _, dir := range ctx.OverlayPipelineDirs {
+		data, err := os.ReadFile(filepath.Join(dir, uses+".yaml"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := readBuiltinPipeline(ctx, uses); err == nil {
+			log.Printf("warning: pipeline %s from %s overrides the built-in pipeline", uses, dir)
+		}
+
+		return data, nil
+	}
+
+	return readBuiltinPipeline(ctx, uses)
+}
+
 func (p *Pipeline) loadUse(ctx *PipelineContext, uses string, with map[string]string) error {
-	data, err := os.ReadFile(filepath.Join(ctx.Context.PipelineDir, uses+".yaml"))
+	data, err := readPipeline(ctx.Context, uses)
 	if err != nil {
 		return fmt.Errorf("unable to load pipeline: %w", err)
 	}
+	ctx.Context.recordPipeline(uses, data)
 
 	if err := yaml.Unmarshal(data, p); err != nil {
 		return fmt.Errorf("unable to parse pipeline: %w", err)
@@ -101,6 +155,18 @@ func (p *Pipeline) loadUse(ctx *PipelineContext, uses string, with map[string]st
 	return nil
 }
 
+// recordPipeline records the definition a pipeline was resolved to, for
+// the provenance of the packages.
+func (ctx *Context) recordPipeline(uses string, data []byte) {
+	resolved := fmt.Sprintf("%s sha256:%x", uses, sha256.Sum256(data))
+	for _, p := range ctx.resolvedPipelines {
+		if p == resolved {
+			return
+		}
+	}
+	ctx.resolvedPipelines = append(ctx.resolvedPipelines, resolved)
+}
+
 func (p *Pipeline) dumpWith() {
 	for k, v := range p.With {
 		log.Printf("    %s: %s", k, v)
@@ -117,7 +183,23 @@ func (p *Pipeline) evalUse(ctx *PipelineContext) error {
 	log.Printf("  using %s", p.Uses)
 	sp.dumpWith()
 
+	// sources are fetched by melange, which retries and rotates
+	// across the mirrors, before the pipeline verifies and extracts
+	// them.
+	if p.Uses == "fetch" {
+		if err := ctx.Context.fetchSource(sp.With); err != nil {
+			return errcode.Wrap(errcode.FetchSource, err, "uri", sp.With["${{inputs.uri}}"])
+		}
+	}
+	if p.Uses == "local-source" {
+		if err := ctx.Context.copyLocalSource(sp.With); err != nil {
+			return err
+		}
+	}
 	if err := sp.Run(ctx); err != nil {
+		if p.Uses == "fetch" {
+			return errcode.Wrap(errcode.FetchSource, err, "uri", sp.With["${{inputs.uri}}"])
+		}
 		return err
 	}
 
@@ -137,14 +219,29 @@ func monitorPipe(pipe io.ReadCloser) {
 	}
 }
 
-func (p *Pipeline) evalRun(ctx *PipelineContext) error {
-	replacer := replacerFromMap(p.With)
-	fragment := replacer.Replace(p.Runs)
+// scriptCmd returns the command running a shell script fragment in the
+// build environment.
+func (ctx *Context) scriptCmd(fragment string) (*exec.Cmd, error) {
 	sys_path := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
-	script := fmt.Sprintf("#!/bin/sh\nset -e\nexport PATH=%s\n%s\nexit 0\n", sys_path, fragment)
+	env, err := ctx.scriptEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf("#!/bin/sh\nset -e\nexport PATH=%s\n%s%s\nexit 0\n", sys_path, exportEnvironment(env), fragment)
 	command := []string{"/bin/sh", "-c", script}
 
-	cmd, err := ctx.Context.WorkspaceCmd(command...)
+	return ctx.WorkspaceCmd(command...)
+}
+
+func (p *Pipeline) evalRun(ctx *PipelineContext) error {
+	replacements := ctx.Context.Configuration.varReplacements()
+	for k, v := range p.With {
+		replacements[k] = v
+	}
+	replacer := replacerFromMap(replacements)
+	fragment := replacer.Replace(p.Runs)
+
+	cmd, err := ctx.Context.scriptCmd(fragment)
 	if err != nil {
 		return err
 	}
@@ -159,7 +256,16 @@ func (p *Pipeline) evalRun(ctx *PipelineContext) error {
 		return err
 	}
 
-	if err := cmd.Start(); err != nil {
+	err = cmd.Start()
+	// the command has its own copies of the extra files, such as the
+	// seccomp program of the sandbox.
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return errcode.Wrap(errcode.RunnerMissing, err, "runner", ctx.Context.Runner)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -184,6 +290,12 @@ func (p *Pipeline) Run(ctx *PipelineContext) error {
 	if p.Runs != "" {
 		return p.evalRun(ctx)
 	}
+	if p.Build != nil {
+		return p.Build.Run(ctx)
+	}
+	if p.Assertions != nil {
+		return p.Assertions.Run(ctx)
+	}
 
 	for _, sp := range p.Pipeline {
 		if err := sp.Run(ctx); err != nil {
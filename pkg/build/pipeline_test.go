@@ -0,0 +1,112 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPipeline(t *testing.T) {
+	builtin := t.TempDir()
+	first := t.TempDir()
+	second := t.TempDir()
+	for path, data := range map[string]string{
+		filepath.Join(builtin, "make.yaml"):              "builtin make",
+		filepath.Join(builtin, "go", "build.yaml"):       "builtin go/build",
+		filepath.Join(first, "make.yaml"):                "first make",
+		filepath.Join(second, "make.yaml"):               "second make",
+		filepath.Join(second, "go", "build.yaml"):        "second go/build",
+		filepath.Join(second, "custom", "deploy.yaml"):   "second custom/deploy",
+		filepath.Join(builtin, "custom", "ignored.yaml"): "builtin custom/ignored",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		overlays []string
+		uses     string
+		want     string
+		wantErr  bool
+	}{{
+		name: "built-in without overlays",
+		uses: "make",
+		want: "builtin make",
+	}, {
+		name:     "first overlay wins",
+		overlays: []string{first, second},
+		uses:     "make",
+		want:     "first make",
+	}, {
+		name:     "overlay order matters",
+		overlays: []string{second, first},
+		uses:     "make",
+		want:     "second make",
+	}, {
+		name:     "nested pipeline from a later overlay",
+		overlays: []string{first, second},
+		uses:     "go/build",
+		want:     "second go/build",
+	}, {
+		name:     "pipeline only in an overlay",
+		overlays: []string{first, second},
+		uses:     "custom/deploy",
+		want:     "second custom/deploy",
+	}, {
+		name:     "falls back to the pipeline directory",
+		overlays: []string{first, second},
+		uses:     "custom/ignored",
+		want:     "builtin custom/ignored",
+	}, {
+		name:     "falls back to the embedded pipelines",
+		overlays: []string{first},
+		uses:     "fetch",
+	}, {
+		name:     "unknown pipeline",
+		overlays: []string{first, second},
+		uses:     "does/not/exist",
+		wantErr:  true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &Context{PipelineDir: builtin, OverlayPipelineDirs: tc.overlays}
+			data, err := readPipeline(ctx, tc.uses)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("readPipeline(%q) succeeded", tc.uses)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == "" {
+				if len(data) == 0 {
+					t.Errorf("readPipeline(%q) is empty", tc.uses)
+				}
+				return
+			}
+			if got := string(data); got != tc.want {
+				t.Errorf("readPipeline(%q) = %q, want %q", tc.uses, got, tc.want)
+			}
+		})
+	}
+}
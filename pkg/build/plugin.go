@@ -0,0 +1,182 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"plugin"
+	"sort"
+	"sync"
+)
+
+// Runner runs the commands of the build pipelines inside the build
+// environment.
+type Runner interface {
+	// Name is the name the runner is selected by.
+	Name() string
+	// Command returns a command which runs args inside the build
+	// environment of ctx, with the workspace at /home/build.
+	Command(ctx *Context, args ...string) (*exec.Cmd, error)
+}
+
+// SBOMGenerator describes the contents of packages.
+type SBOMGenerator interface {
+	// Name is the name the generator is selected by.
+	Name() string
+	// Generate is called before a package is archived, and may add
+	// files to the package below pc.WorkspaceSubdir().
+	Generate(pc *PackageContext) error
+}
+
+// CacheBackend stores the artifacts which builds share through a remote
+// cache, such as fetched sources.  Artifacts are addressed by the hex
+// SHA256 digest of their contents.
+type CacheBackend interface {
+	// Name is the URL scheme the backend is selected by, such as s3.
+	Name() string
+	// Get returns the artifact with the digest from the cache at u,
+	// or an error wrapping fs.ErrNotExist if it is not cached.
+	Get(ctx *Context, u *url.URL, digest string) (io.ReadCloser, error)
+	// Put stores the artifact with the digest and size in the cache
+	// at u.
+	Put(ctx *Context, u *url.URL, digest string, r io.Reader, size int64) error
+}
+
+// CacheIndex is implemented by the cache backends which also find
+// artifacts by a key of the inputs they were produced from, such as the
+// entries of the step cache.  The backends which do not implement it
+// only share fetched sources.
+type CacheIndex interface {
+	// Resolve returns the digest of the artifact indexed by key in the
+	// cache at u, or an error wrapping fs.ErrNotExist if there is none.
+	Resolve(ctx *Context, u *url.URL, key string) (string, error)
+	// Index indexes the stored artifact with the digest and size by
+	// key in the cache at u.
+	Index(ctx *Context, u *url.URL, key, digest string, size int64) error
+}
+
+var (
+	pluginsMu      sync.Mutex
+	runners        = map[string]Runner{}
+	sbomGenerators = map[string]SBOMGenerator{}
+	cacheBackends  = map[string]CacheBackend{}
+)
+
+// RegisterRunner makes a runner available to builds.  It is meant to be
+// called from the init function of the package implementing the runner.
+func RegisterRunner(r Runner) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	runners[r.Name()] = r
+}
+
+// RegisterSBOMGenerator makes an SBOM generator available to builds.  It
+// is meant to be called from the init function of the package
+// implementing the generator.
+func RegisterSBOMGenerator(g SBOMGenerator) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	sbomGenerators[g.Name()] = g
+}
+
+// RegisterCacheBackend makes a remote cache backend available to builds.
+// It is meant to be called from the init function of the package
+// implementing the backend.
+func RegisterCacheBackend(b CacheBackend) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	cacheBackends[b.Name()] = b
+}
+
+// Runners returns the names of the registered runners.
+func Runners() []string {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	names := []string{}
+	for name := range runners {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// SBOMGenerators returns the names of the registered SBOM generators.
+func SBOMGenerators() []string {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	names := []string{}
+	for name := range sbomGenerators {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func lookupRunner(name string) (Runner, error) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	r, ok := runners[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown runner %q", name)
+	}
+
+	return r, nil
+}
+
+func lookupSBOMGenerator(name string) (SBOMGenerator, error) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	g, ok := sbomGenerators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown SBOM generator %q", name)
+	}
+
+	return g, nil
+}
+
+func lookupCacheBackend(name string) (CacheBackend, error) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	b, ok := cacheBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown remote cache backend %q", name)
+	}
+
+	return b, nil
+}
+
+// LoadPlugin opens a Go plugin, built with `go build -buildmode=plugin`
+// against the same version of melange.  The plugin registers its runners,
+// SBOM generators and remote cache backends from its init functions.
+func LoadPlugin(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return fmt.Errorf("unable to load plugin %s: %w", path, err)
+	}
+
+	return nil
+}
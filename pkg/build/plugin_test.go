@@ -0,0 +1,123 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testSBOMGenerator struct{}
+
+func (testSBOMGenerator) Name() string { return "test-generator" }
+
+func (testSBOMGenerator) Generate(pc *PackageContext) error { return nil }
+
+type testCacheBackend struct{}
+
+func (testCacheBackend) Name() string { return "test-cache" }
+
+func (testCacheBackend) Get(ctx *Context, u *url.URL, digest string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(digest)), nil
+}
+
+func (testCacheBackend) Put(ctx *Context, u *url.URL, digest string, r io.Reader, size int64) error {
+	return nil
+}
+
+func TestPluginLookup(t *testing.T) {
+	RegisterSBOMGenerator(testSBOMGenerator{})
+	RegisterCacheBackend(testCacheBackend{})
+	t.Cleanup(func() {
+		pluginsMu.Lock()
+		defer pluginsMu.Unlock()
+		delete(sbomGenerators, "test-generator")
+		delete(cacheBackends, "test-cache")
+	})
+
+	for _, tc := range []struct {
+		kind string
+		name string
+		err  string
+	}{{
+		kind: "runner", name: "bubblewrap",
+	}, {
+		kind: "runner", name: "proot",
+	}, {
+		kind: "runner", name: "test-host",
+	}, {
+		kind: "runner", name: "docker", err: `unknown runner "docker"`,
+	}, {
+		kind: "generator", name: "melange",
+	}, {
+		kind: "generator", name: "test-generator",
+	}, {
+		kind: "generator", name: "syft", err: `unknown SBOM generator "syft"`,
+	}, {
+		kind: "backend", name: "s3",
+	}, {
+		kind: "backend", name: "test-cache",
+	}, {
+		kind: "backend", name: "ftp", err: `unknown remote cache backend "ftp"`,
+	}} {
+		var got string
+		var err error
+		switch tc.kind {
+		case "runner":
+			var r Runner
+			if r, err = lookupRunner(tc.name); err == nil {
+				got = r.Name()
+			}
+		case "generator":
+			var g SBOMGenerator
+			if g, err = lookupSBOMGenerator(tc.name); err == nil {
+				got = g.Name()
+			}
+		case "backend":
+			var b CacheBackend
+			if b, err = lookupCacheBackend(tc.name); err == nil {
+				got = b.Name()
+			}
+		}
+
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s %s: error = %v, want %q", tc.kind, tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.kind, tc.name, err)
+		} else if got != tc.name {
+			t.Errorf("%s %s: found %s", tc.kind, tc.name, got)
+		}
+	}
+
+	if got, want := SBOMGenerators(), []string{"melange", "test-generator"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SBOMGenerators() = %q, want %q", got, want)
+	}
+	if got, want := Runners(), []string{"bubblewrap", "proot", "test-host"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Runners() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadPluginMissing(t *testing.T) {
+	if err := LoadPlugin("/does/not/exist.so"); err == nil {
+		t.Error("LoadPlugin succeeded")
+	}
+}
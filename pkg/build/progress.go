@@ -0,0 +1,530 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+// progressReadSize is the size of the blocks of the log file read to
+// find the lines shown.
+const progressReadSize = 16 * 1024
+
+// buildState is the state of one build of a batch.
+type buildState string
+
+const (
+	statePending  buildState = "pending"
+	stateBuilding buildState = "building"
+	stateBuilt    buildState = "built"
+	stateFailed   buildState = "failed"
+	stateSkipped  buildState = "skipped"
+)
+
+// stateOrder sorts the builds shown first when they do not all fit on
+// the terminal.
+var stateOrder = map[buildState]int{
+	stateBuilding: 0,
+	stateFailed:   1,
+	statePending:  2,
+	stateSkipped:  3,
+	stateBuilt:    4,
+}
+
+type buildStatus struct {
+	state    buildState
+	started  time.Time
+	finished time.Time
+}
+
+// progress is a live view of the builds of a batch, redrawn in place on
+// a terminal.  The log output is written to a file while it is shown,
+// and the end of that file is displayed below the builds.  The log can
+// be scrolled with the arrow, page and home/end keys, or j, k, g and G.
+type progress struct {
+	out     io.Writer
+	logFile string
+	// size returns the number of rows and columns of the terminal.
+	size func() (int, int)
+
+	mu       sync.Mutex
+	names    []string
+	statuses []buildStatus
+	lines    int
+	// anchor is the offset in the log file of the end of the last
+	// line shown when the log is scrolled back, or -1 when its end
+	// is followed.
+	anchor int64
+	// logRows is the number of log lines shown by the last frame,
+	// which the page keys scroll by.
+	logRows int
+
+	tty      *os.File
+	ttyState *syscall.Termios
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// WithProgress shows a live view of the builds of the batch on out,
+// which should be a terminal.  logFile is the file the log output is
+// written to, whose end is shown below the builds.
+func WithProgress(out io.Writer, logFile string) BatchOption {
+	return func(b *Batch) error {
+		b.progress = newProgress(out, logFile)
+		return nil
+	}
+}
+
+func newProgress(out io.Writer, logFile string) *progress {
+	p := &progress{out: out, logFile: logFile, anchor: -1}
+	p.size = func() (int, int) {
+		if f, ok := out.(*os.File); ok {
+			if rows, cols, err := terminalSize(f); err == nil && rows > 0 && cols > 0 {
+				return rows, cols
+			}
+		}
+		return 24, 80
+	}
+	return p
+}
+
+func (p *progress) start(names []string) {
+	p.names = names
+	p.statuses = make([]buildStatus, len(names))
+	for i := range p.statuses {
+		p.statuses[i].state = statePending
+	}
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	keys := p.openKeys()
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.render(false)
+			case key := <-keys:
+				p.scroll(key)
+				p.render(false)
+			case <-p.stop:
+				p.render(true)
+				return
+			}
+		}
+	}()
+}
+
+// finish draws the final state of the builds and stops the view.
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+	p.closeKeys()
+}
+
+func (p *progress) set(i int, state buildState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := &p.statuses[i]
+	s.state = state
+	switch state {
+	case stateBuilding:
+		s.started = time.Now()
+	case stateBuilt, stateFailed:
+		s.finished = time.Now()
+	}
+}
+
+// openKeys reads the keys pressed on the controlling terminal, which is
+// switched to reading them unbuffered and without echo until the view
+// is stopped.  No keys are read without a terminal.
+func (p *progress) openKeys() <-chan string {
+	keys := make(chan string)
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return keys
+	}
+	state, err := getTermios(tty)
+	if err != nil {
+		tty.Close()
+		return keys
+	}
+	raw := *state
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(tty, &raw); err != nil {
+		tty.Close()
+		return keys
+	}
+	p.tty = tty
+	p.ttyState = state
+
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := tty.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case keys <- string(buf[:n]):
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return keys
+}
+
+// closeKeys restores the terminal.
+func (p *progress) closeKeys() {
+	if p.tty == nil {
+		return
+	}
+	setTermios(p.tty, p.ttyState)
+	p.tty.Close()
+	p.tty = nil
+}
+
+// scroll scrolls the log for a key.
+func (p *progress) scroll(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	page := p.logRows
+	if page < 1 {
+		page = 1
+	}
+
+	switch key {
+	case "k", "\x1b[A", "\x1bOA":
+		p.scrollBy(-1, page)
+	case "j", "\x1b[B", "\x1bOB":
+		p.scrollBy(1, page)
+	case "b", "\x1b[5~":
+		p.scrollBy(-page, page)
+	case " ", "\x1b[6~":
+		p.scrollBy(page, page)
+	case "g", "\x1b[H", "\x1b[1~", "\x1bOH":
+		// scrolling up from the start stops at the top.
+		p.anchor = 0
+		p.scrollBy(-1, page)
+	case "G", "\x1b[F", "\x1b[4~", "\x1bOF":
+		p.anchor = -1
+	}
+}
+
+// scrollBy moves the last line of the log shown by n lines, of the page
+// lines shown.  The first line of the log stays at the top, and the end
+// of the log is followed once it is reached.
+func (p *progress) scrollBy(n, page int) {
+	f, err := os.Open(p.logFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	end := p.anchor
+	if end < 0 || end > fi.Size() {
+		end = fi.Size()
+	}
+
+	var next int64
+	if n < 0 {
+		_, next = lastLines(f, end, -n)
+		if lines, _ := lastLines(f, next, page); len(lines) < page {
+			next = nextLines(f, 0, page, fi.Size())
+		}
+	} else {
+		next = nextLines(f, end, n, fi.Size())
+	}
+
+	if next >= fi.Size() {
+		p.anchor = -1
+		return
+	}
+	p.anchor = next
+}
+
+// lastLines returns up to n lines ending at the offset end of f, and the
+// offset of the first of them.
+func lastLines(f io.ReaderAt, end int64, n int) ([]string, int64) {
+	if n <= 0 {
+		return nil, end
+	}
+
+	var data []byte
+	start := end
+	for start > 0 {
+		size := int64(progressReadSize)
+		if size > start {
+			size = start
+		}
+		block := make([]byte, size)
+		if _, err := f.ReadAt(block, start-size); err != nil && err != io.EOF {
+			break
+		}
+		data = append(block, data...)
+		start -= size
+
+		// a line is complete once the newline before it is read.
+		if bytes.Count(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) >= n {
+			break
+		}
+	}
+
+	trimmed := bytes.TrimSuffix(data, []byte("\n"))
+	lines := strings.Split(string(trimmed), "\n")
+	if len(trimmed) == 0 {
+		lines = nil
+	}
+	if len(lines) > n {
+		skipped := strings.Join(lines[:len(lines)-n], "\n")
+		start += int64(len(skipped)) + 1
+		lines = lines[len(lines)-n:]
+	}
+	return lines, start
+}
+
+// nextLines returns the offset of the end of the n lines starting at the
+// offset start of f, or size if the log ends before.
+func nextLines(f io.ReaderAt, start int64, n int, size int64) int64 {
+	block := make([]byte, progressReadSize)
+	for offset := start; offset < size; {
+		read, err := f.ReadAt(block, offset)
+		for i, c := range block[:read] {
+			if c != '\n' {
+				continue
+			}
+			n--
+			if n == 0 {
+				return offset + int64(i) + 1
+			}
+		}
+		offset += int64(read)
+		if err != nil || read == 0 {
+			break
+		}
+	}
+	return size
+}
+
+// logLines returns the lines of the log shown, ending at the anchor or
+// at the end of the log.
+func (p *progress) logLines(n int) []string {
+	f, err := os.Open(p.logFile)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+
+	end := p.anchor
+	if end < 0 || end > fi.Size() {
+		end = fi.Size()
+	}
+	lines, _ := lastLines(f, end, n)
+	return lines
+}
+
+func (p *progress) render(final bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rows, cols := p.size()
+	frame := p.frame(final, rows, cols)
+
+	// move back to the start of the previous frame and clear it.
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.lines)
+	}
+
+	p.out.Write(frame)
+	p.lines = bytes.Count(frame, []byte("\n"))
+}
+
+// frame draws the builds and the log.  Frames fit in rows-1 lines of
+// cols columns, as the terminal scrolls when its last line is written,
+// which would break redrawing the frame in place.
+func (p *progress) frame(final bool, rows, cols int) []byte {
+	height := rows - 1
+	if height < 2 {
+		height = 2
+	}
+
+	// the builds take up to half of the terminal, less the header.
+	shown := make([]int, len(p.statuses))
+	for i := range shown {
+		shown[i] = i
+	}
+	maxBuilds := height/2 - 1
+	if final {
+		maxBuilds = height - 3
+	}
+	if maxBuilds < 1 {
+		maxBuilds = 1
+	}
+	hidden := 0
+	if len(shown) > maxBuilds {
+		// keep the builds in progress and the failures in view.
+		sort.SliceStable(shown, func(a, b int) bool {
+			return stateOrder[p.statuses[shown[a]].state] < stateOrder[p.statuses[shown[b]].state]
+		})
+		shown = shown[:maxBuilds-1]
+		sort.Ints(shown)
+		hidden = len(p.statuses) - len(shown)
+	}
+
+	var table bytes.Buffer
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tARCH\tSTATUS\tELAPSED")
+	for _, i := range shown {
+		s := p.statuses[i]
+		elapsed := ""
+		switch {
+		case !s.finished.IsZero():
+			elapsed = s.finished.Sub(s.started).Round(time.Second).String()
+		case !s.started.IsZero():
+			elapsed = time.Since(s.started).Round(time.Second).String()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.names[i], arch, s.state, elapsed)
+	}
+	tw.Flush()
+
+	frame := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n") {
+		frame = append(frame, truncateLine(line, cols))
+	}
+	if hidden > 0 {
+		frame = append(frame, truncateLine(fmt.Sprintf("... %d more: %s", hidden, p.counts(shown)), cols))
+	}
+
+	if final {
+		frame = append(frame, "", truncateLine("the build log is in "+p.logFile, cols))
+	} else {
+		logRows := height - len(frame) - 2
+		if logRows > 0 {
+			title := "log (" + p.logFile + ")"
+			if p.anchor >= 0 {
+				title += ", scrolled back, G follows"
+			}
+			frame = append(frame, "", truncateLine(title+":", cols))
+			for _, line := range p.logLines(logRows) {
+				frame = append(frame, "  "+truncateLine(line, cols-2))
+			}
+		}
+		p.logRows = logRows
+	}
+
+	return []byte(strings.Join(frame, "\n") + "\n")
+}
+
+// counts summarizes the states of the builds which are not shown.
+func (p *progress) counts(shown []int) string {
+	counts := map[buildState]int{}
+	for _, s := range p.statuses {
+		counts[s.state]++
+	}
+	for _, i := range shown {
+		counts[p.statuses[i].state]--
+	}
+	parts := []string{}
+	for _, state := range []buildState{stateBuilding, stateFailed, statePending, stateSkipped, stateBuilt} {
+		if counts[state] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[state], state))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// truncateLine makes a line of the log fit in width columns, which
+// would otherwise wrap and throw off the number of lines to redraw.
+// Control characters are replaced, so that the line cannot move the
+// cursor.
+func truncateLine(line string, width int) string {
+	if width < 1 {
+		return ""
+	}
+	runes := []rune(line)
+	for i, r := range runes {
+		if r < ' ' || r == 0x7f {
+			runes[i] = ' '
+		}
+	}
+	if len(runes) > width {
+		runes = runes[:width]
+	}
+	return string(runes)
+}
+
+// terminalSize returns the number of rows and columns of a terminal.
+func terminalSize(f *os.File) (int, int, error) {
+	var ws struct {
+		rows, cols, x, y uint16
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.rows), int(ws.cols), nil
+}
+
+func getTermios(f *os.File) (*syscall.Termios, error) {
+	t := &syscall.Termios{}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(t))); errno != 0 {
+		return nil, errno
+	}
+	return t, nil
+}
+
+func setTermios(f *os.File, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func testProgress(t *testing.T, builds int, logLines []string) *progress {
+	logFile := filepath.Join(t.TempDir(), "melange-batch.log")
+	if err := os.WriteFile(logFile, []byte(strings.Join(logLines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newProgress(nil, logFile)
+	p.size = func() (int, int) { return 20, 40 }
+	for i := 0; i < builds; i++ {
+		p.names = append(p.names, fmt.Sprintf("package-%d", i))
+		p.statuses = append(p.statuses, buildStatus{state: statePending})
+	}
+	return p
+}
+
+func frameLines(p *progress, final bool) []string {
+	rows, cols := p.size()
+	return strings.Split(strings.TrimSuffix(string(p.frame(final, rows, cols)), "\n"), "\n")
+}
+
+func TestProgressFrame(t *testing.T) {
+	logLines := []string{}
+	for i := 1; i <= 100; i++ {
+		logLines = append(logLines, fmt.Sprintf("line %d ünïcödé ✓ %s", i, strings.Repeat("é", 40)))
+	}
+	p := testProgress(t, 50, logLines)
+	p.statuses[30].state = stateBuilding
+	p.statuses[42].state = stateFailed
+
+	for _, final := range []bool{false, true} {
+		lines := frameLines(p, final)
+		if len(lines) > 19 {
+			t.Errorf("frame(final=%t) has %d lines, want at most 19", final, len(lines))
+		}
+		for _, line := range lines {
+			if n := utf8.RuneCountInString(line); n > 40 || !utf8.ValidString(line) {
+				t.Errorf("frame(final=%t) line %q has %d runes", final, line, n)
+			}
+		}
+
+		frame := strings.Join(lines, "\n")
+		for _, want := range []string{"package-30", "package-42", "more: ", " pending"} {
+			if !strings.Contains(frame, want) {
+				t.Errorf("frame(final=%t) does not show %q:\n%s", final, want, frame)
+			}
+		}
+	}
+
+	lines := frameLines(p, false)
+	if !strings.Contains(strings.Join(lines, "\n"), "... 43 more: 43 pending") {
+		t.Errorf("frame does not summarize the hidden builds:\n%s", strings.Join(lines, "\n"))
+	}
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "  line 100 ") {
+		t.Errorf("frame ends with %q, want the end of the log", last)
+	}
+
+	// a few builds are all shown.
+	p = testProgress(t, 3, logLines)
+	frame := strings.Join(frameLines(p, false), "\n")
+	if strings.Contains(frame, "more:") || !strings.Contains(frame, "package-2") {
+		t.Errorf("frame of three builds:\n%s", frame)
+	}
+}
+
+func TestProgressScroll(t *testing.T) {
+	logLines := []string{}
+	for i := 1; i <= 100; i++ {
+		logLines = append(logLines, fmt.Sprintf("line %d", i))
+	}
+	p := testProgress(t, 1, logLines)
+
+	last := func() string {
+		lines := frameLines(p, false)
+		return strings.TrimSpace(lines[len(lines)-1])
+	}
+	first := func() string {
+		lines := frameLines(p, false)
+		return strings.TrimSpace(lines[len(lines)-p.logRows])
+	}
+
+	if got := last(); got != "line 100" {
+		t.Fatalf("last line = %q, want line 100", got)
+	}
+
+	for _, tt := range []struct {
+		key  string
+		want string
+	}{
+		{"k", "line 99"},
+		{"\x1b[A", "line 98"},
+		{"j", "line 99"},
+		{"\x1b[5~", fmt.Sprintf("line %d", 99-p.logRows)},
+		{"\x1b[6~", "line 99"},
+		{"j", "line 100"},
+		{"j", "line 100"},
+		{"g", fmt.Sprintf("line %d", p.logRows)},
+		{"k", fmt.Sprintf("line %d", p.logRows)},
+		{"G", "line 100"},
+	} {
+		p.scroll(tt.key)
+		if got := last(); got != tt.want {
+			t.Errorf("last line after %q = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	p.scroll("g")
+	if got := first(); got != "line 1" {
+		t.Errorf("first line at the top = %q, want line 1", got)
+	}
+
+	// the view stays in place when the log grows.
+	p.scroll("k")
+	before := last()
+	f, err := os.OpenFile(p.logFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, "line 101")
+	f.Close()
+	if got := last(); got != before {
+		t.Errorf("last line after the log grew = %q, want %q", got, before)
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	for _, tt := range []struct {
+		line  string
+		width int
+		want  string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo wörld", 4, "héll"},
+		{"✓✓✓", 2, "✓✓"},
+		{"a\tb\x1b[2Jc", 10, "a b [2Jc"},
+		{"hello", 0, ""},
+	} {
+		if got := truncateLine(tt.line, tt.width); got != tt.want {
+			t.Errorf("truncateLine(%q, %d) = %q, want %q", tt.line, tt.width, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// fileStamp identifies the contents of a file without reading it.
+type fileStamp struct {
+	size  int64
+	mtime int64
+	inode uint64
+}
+
+func stampFile(fi fs.FileInfo) fileStamp {
+	stamp := fileStamp{size: fi.Size(), mtime: fi.ModTime().UnixNano()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		stamp.inode = uint64(st.Ino)
+	}
+	return stamp
+}
+
+// stepTracker attributes the files of the output directories of the
+// packages to the pipeline steps which produced them, by comparing the
+// output directories before and after every step.  A file created or
+// modified by several steps is attributed to the last one.
+type stepTracker struct {
+	// root is the directory of the output directories, melange-out.
+	root string
+	// stamps are the files of the output directories after the last
+	// step, keyed by their path relative to root.
+	stamps map[string]fileStamp
+	// steps are the steps which produced the files, keyed like stamps.
+	steps map[string]string
+}
+
+// newStepTracker returns a tracker of the output directories below root,
+// which attributes none of their current files to a step.
+func newStepTracker(root string) (*stepTracker, error) {
+	t := &stepTracker{root: root, stamps: map[string]fileStamp{}, steps: map[string]string{}}
+	if _, err := t.scan(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// scan updates the stamps of the files, and returns the files which were
+// created or modified since the previous scan.
+func (t *stepTracker) scan() ([]string, error) {
+	changed := []string{}
+	stamps := map[string]fileStamp{}
+
+	err := filepath.WalkDir(t.root, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == t.root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		stamp := stampFile(fi)
+		if old, ok := t.stamps[rel]; !ok || old != stamp {
+			changed = append(changed, rel)
+		}
+		stamps[rel] = stamp
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan the output directories: %w", err)
+	}
+
+	t.stamps = stamps
+	return changed, nil
+}
+
+// record attributes the files created or modified since the previous
+// step to a step.  The files moved by the step, such as the ones split
+// into subpackages, are attributed to it too.
+func (t *stepTracker) record(step string) error {
+	changed, err := t.scan()
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range changed {
+		t.steps[rel] = step
+	}
+	for rel := range t.steps {
+		if _, ok := t.stamps[rel]; !ok {
+			delete(t.steps, rel)
+		}
+	}
+	return nil
+}
+
+// restore attributes the files restored from the step cache to the
+// steps which produced them when they were cached.
+func (t *stepTracker) restore(steps map[string]string) error {
+	if t == nil {
+		return nil
+	}
+	if _, err := t.scan(); err != nil {
+		return err
+	}
+
+	for rel, step := range steps {
+		if _, ok := t.stamps[rel]; ok {
+			t.steps[rel] = step
+		}
+	}
+	return nil
+}
+
+// packageSteps returns the steps which produced the files of a package,
+// keyed by their path relative to the output directory of the package.
+func (t *stepTracker) packageSteps(pkg string) map[string]string {
+	steps := map[string]string{}
+	if t == nil {
+		return steps
+	}
+
+	prefix := pkg + "/"
+	for rel, step := range t.steps {
+		if strings.HasPrefix(rel, prefix) {
+			steps[strings.TrimPrefix(rel, prefix)] = step
+		}
+	}
+	return steps
+}
+
+// stepName describes a step of the main pipeline, or of the pipeline of
+// a subpackage, by its position and identity.
+func stepName(sp *Subpackage, i int, p *Pipeline) string {
+	name := fmt.Sprintf("step %d", i+1)
+	if id := p.Identity(); id != "???" {
+		name += " (" + id + ")"
+	}
+	if sp != nil {
+		name = fmt.Sprintf("subpackage %s %s", sp.Name, name)
+	}
+	return name
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStepTracker(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "melange-out")
+	write := func(path, contents string) {
+		t.Helper()
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the output directories do not exist before the first step.
+	tracker, err := newStepTracker(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("foo/usr/bin/foo", "foo")
+	write("foo/usr/share/doc/foo/README", "readme")
+	if err := tracker.record("step 1 (autoconf/make-install)"); err != nil {
+		t.Fatal(err)
+	}
+
+	write("foo/usr/bin/foo", "stripped")
+	if err := tracker.record("step 2 (strip)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(root, "foo/usr/share/doc"), filepath.Join(t.TempDir(), "doc")); err != nil {
+		t.Fatal(err)
+	}
+	write("foo-doc/usr/share/doc/foo/README", "readme")
+	if err := tracker.record("subpackage foo-doc step 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := tracker.packageSteps("foo"), map[string]string{"usr/bin/foo": "step 2 (strip)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("packageSteps(foo) = %v, want %v", got, want)
+	}
+	if got, want := tracker.packageSteps("foo-doc"), map[string]string{"usr/share/doc/foo/README": "subpackage foo-doc step 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("packageSteps(foo-doc) = %v, want %v", got, want)
+	}
+
+	var none *stepTracker
+	if got := none.packageSteps("foo"); len(got) != 0 {
+		t.Errorf("packageSteps() of no tracker = %v", got)
+	}
+}
+
+func TestStepName(t *testing.T) {
+	for _, tt := range []struct {
+		sp   *Subpackage
+		p    Pipeline
+		want string
+	}{
+		{nil, Pipeline{Uses: "autoconf/make"}, "step 2 (autoconf/make)"},
+		{nil, Pipeline{Runs: "make"}, "step 2"},
+		{&Subpackage{Name: "foo-dev"}, Pipeline{Name: "split headers"}, "subpackage foo-dev step 2 (split headers)"},
+	} {
+		if got := stepName(tt.sp, 1, &tt.p); got != tt.want {
+			t.Errorf("stepName() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strconv"
+)
+
+// errFound stops a walk once what it looks for is found.
+var errFound = errors.New("found")
+
+// hasPythonSources reports whether a directory contains .py files.
+func hasPythonSources(dir string) (bool, error) {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() && filepath.Ext(path) == ".py" {
+			return errFound
+		}
+
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, errFound):
+		return true, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	}
+
+	return false, err
+}
+
+// bytecompilePython byte-compiles the Python sources of the package and
+// its subpackages in the build environment, once their pipelines have run.
+// Each package is compiled in its own output directory, so that the
+// __pycache__ directories are shipped along with their sources.
+func (ctx *Context) bytecompilePython(pctx *PipelineContext) error {
+	names := []string{ctx.Configuration.Package.Name}
+	for _, sp := range ctx.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	epoch := ""
+	if !ctx.SourceDateEpoch.IsZero() {
+		epoch = strconv.FormatInt(ctx.SourceDateEpoch.Unix(), 10)
+	}
+
+	for _, name := range names {
+		found, err := hasPythonSources(filepath.Join(ctx.WorkspaceDir, "melange-out", name))
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		log.Printf("byte-compiling the Python sources of %s", name)
+
+		p := Pipeline{
+			Uses: "python/bytecompile",
+			With: map[string]string{
+				"dir":               fmt.Sprintf("/home/build/melange-out/%s", name),
+				"source-date-epoch": epoch,
+			},
+		}
+		if err := p.Run(pctx); err != nil {
+			return fmt.Errorf("unable to byte-compile %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHasPythonSources(t *testing.T) {
+	dir := t.TempDir()
+	pkgDir := filepath.Join(dir, "usr/lib/python3.10/site-packages/foo")
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := hasPythonSources(dir); err != nil || found {
+		t.Errorf("hasPythonSources() = %t, %v, want false", found, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(pkgDir, "__init__.py"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := hasPythonSources(dir); err != nil || !found {
+		t.Errorf("hasPythonSources() = %t, %v, want true", found, err)
+	}
+
+	if found, err := hasPythonSources(filepath.Join(dir, "missing")); err != nil || found {
+		t.Errorf("hasPythonSources() = %t, %v, want false for a missing directory", found, err)
+	}
+}
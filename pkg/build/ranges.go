@@ -0,0 +1,241 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DataList is a list of items which subpackages can range over, such as
+// the locales of a package.  Each item maps the names of its fields to
+// their values.
+type DataList struct {
+	Name  string              `yaml:"name"`
+	Items []map[string]string `yaml:"items"`
+}
+
+// expandRanges replaces the subpackages ranging over a data list with a
+// subpackage for each of its items, in which ${{range.<field>}} is
+// replaced by the field of the item.  Subpackages whose if condition is
+// false, after the substitution, are skipped.
+func (cfg *Configuration) expandRanges() error {
+	lists := map[string]*DataList{}
+	for i, d := range cfg.Data {
+		if d.Name == "" {
+			return fmt.Errorf("data list %d has no name", i)
+		}
+		if _, ok := lists[d.Name]; ok {
+			return fmt.Errorf("data list %s is defined more than once", d.Name)
+		}
+		lists[d.Name] = &cfg.Data[i]
+	}
+
+	subpackages := []Subpackage{}
+	for _, sp := range cfg.Subpackages {
+		if sp.Range == "" {
+			keep, err := evalCondition(sp.If)
+			if err != nil {
+				return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+			}
+			if keep {
+				subpackages = append(subpackages, sp)
+			}
+			continue
+		}
+
+		list, ok := lists[sp.Range]
+		if !ok {
+			return fmt.Errorf("subpackage %s ranges over the unknown data list %s", sp.Name, sp.Range)
+		}
+
+		for i, item := range list.Items {
+			replacements := []string{}
+			for field, value := range item {
+				replacements = append(replacements, "${{range."+field+"}}", value)
+			}
+			expanded := sp.substitute(strings.NewReplacer(replacements...))
+			expanded.Range = ""
+
+			if ref := expanded.rangeReference(); ref != "" {
+				return fmt.Errorf("subpackage %s: item %d of %s has no field for %s", sp.Name, i, list.Name, ref)
+			}
+
+			keep, err := evalCondition(expanded.If)
+			if err != nil {
+				return fmt.Errorf("subpackage %s: %w", expanded.Name, err)
+			}
+			expanded.If = ""
+			if keep {
+				subpackages = append(subpackages, expanded)
+			}
+		}
+	}
+
+	cfg.Subpackages = subpackages
+	return nil
+}
+
+// substitute returns a copy of the subpackage with the replacements
+// applied to its fields and pipelines.
+func (sp *Subpackage) substitute(r *strings.Replacer) Subpackage {
+	out := *sp
+	out.Name = r.Replace(sp.Name)
+	out.If = r.Replace(sp.If)
+	out.Description = r.Replace(sp.Description)
+	out.URL = r.Replace(sp.URL)
+	out.Deprecation = sp.Deprecation.substitute(r)
+
+	out.Copyright = nil
+	for _, c := range sp.Copyright {
+		out.Copyright = append(out.Copyright, Copyright{
+			Paths:       replaceAll(r, c.Paths),
+			Attestation: r.Replace(c.Attestation),
+			License:     r.Replace(c.License),
+			LicensePath: r.Replace(c.LicensePath),
+		})
+	}
+
+	out.Dependencies.Runtime = replaceAll(r, sp.Dependencies.Runtime)
+	out.Dependencies.Provides = replaceAll(r, sp.Dependencies.Provides)
+	out.Dependencies.Conflicts = replaceAll(r, sp.Dependencies.Conflicts)
+	out.Pipeline = substitutePipelines(r, sp.Pipeline)
+
+	return out
+}
+
+func substitutePipelines(r *strings.Replacer, pipelines []Pipeline) []Pipeline {
+	if pipelines == nil {
+		return nil
+	}
+
+	out := make([]Pipeline, len(pipelines))
+	for i, p := range pipelines {
+		out[i] = p
+		out[i].Name = r.Replace(p.Name)
+		out[i].Uses = r.Replace(p.Uses)
+		out[i].Runs = r.Replace(p.Runs)
+		if p.With != nil {
+			out[i].With = map[string]string{}
+			for k, v := range p.With {
+				out[i].With[k] = r.Replace(v)
+			}
+		}
+		if p.Assertions != nil {
+			out[i].Assertions = p.Assertions.substitute(r)
+		}
+		out[i].Pipeline = substitutePipelines(r, p.Pipeline)
+	}
+
+	return out
+}
+
+func replaceAll(r *strings.Replacer, values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = r.Replace(v)
+	}
+	return out
+}
+
+// rangeReference returns a ${{range.<field>}} reference left in the
+// subpackage, if any.
+func (sp *Subpackage) rangeReference() string {
+	found := ""
+	check := func(s string) {
+		if i := strings.Index(s, "${{range."); i >= 0 && found == "" {
+			found = s[i:]
+			if j := strings.Index(found, "}}"); j >= 0 {
+				found = found[:j+2]
+			}
+		}
+	}
+
+	check(sp.Name)
+	check(sp.If)
+	check(sp.Description)
+	check(sp.URL)
+	if d := sp.Deprecation; d != nil {
+		check(d.Reason)
+		check(d.Replacement)
+	}
+	for _, c := range sp.Copyright {
+		check(c.Attestation)
+		check(c.License)
+		check(c.LicensePath)
+		for _, p := range c.Paths {
+			check(p)
+		}
+	}
+	for _, dep := range append(append(append([]string{}, sp.Dependencies.Runtime...), sp.Dependencies.Provides...), sp.Dependencies.Conflicts...) {
+		check(dep)
+	}
+
+	var walk func(pipelines []Pipeline)
+	walk = func(pipelines []Pipeline) {
+		for _, p := range pipelines {
+			check(p.Name)
+			check(p.Uses)
+			check(p.Runs)
+			for _, v := range p.With {
+				check(v)
+			}
+			if p.Assertions != nil {
+				for _, v := range p.Assertions.values() {
+					check(v)
+				}
+			}
+			walk(p.Pipeline)
+		}
+	}
+	walk(sp.Pipeline)
+
+	return found
+}
+
+// evalCondition evaluates the if condition of a subpackage, which is
+// empty, true, false, or the comparison of two values with == or !=.
+// Values may be quoted with ' or ".
+func evalCondition(cond string) (bool, error) {
+	cond = strings.TrimSpace(cond)
+
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(cond, op); i >= 0 {
+			equal := unquote(cond[:i]) == unquote(cond[i+len(op):])
+			return equal == (op == "=="), nil
+		}
+	}
+
+	switch strings.ToLower(unquote(cond)) {
+	case "", "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("condition %q must be true, false, or a comparison with == or !=", cond)
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
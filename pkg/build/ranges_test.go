@@ -0,0 +1,112 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandRanges(t *testing.T) {
+	config := `
+package:
+  name: hello
+  version: 1.0
+data:
+  - name: locales
+    items:
+      - name: de
+        language: German
+        translated: "yes"
+      - name: fr
+        language: French
+        translated: "yes"
+      - name: eo
+        language: Esperanto
+        translated: "no"
+subpackages:
+  - range: locales
+    if: ${{range.translated}} == 'yes'
+    name: hello-lang-${{range.name}}
+    description: ${{range.language}} translations of hello
+    dependencies:
+      runtime:
+        - hello
+    pipeline:
+      - runs: |
+          mkdir -p ${{targets.subpkgdir}}/usr/share/locale
+          mv ${{targets.destdir}}/usr/share/locale/${{range.name}} ${{targets.subpkgdir}}/usr/share/locale/
+  - name: hello-doc
+`
+	path := filepath.Join(t.TempDir(), "hello.yaml")
+	writeFile(t, path, config)
+
+	var cfg Configuration
+	if err := cfg.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, sp := range cfg.Subpackages {
+		names = append(names, sp.Name)
+	}
+	if want := []string{"hello-lang-de", "hello-lang-fr", "hello-doc"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("subpackages = %q, want %q", names, want)
+	}
+
+	fr := cfg.Subpackages[1]
+	if fr.Description != "French translations of hello" || fr.Range != "" || fr.If != "" {
+		t.Errorf("subpackage = %+v", fr)
+	}
+	if want := "mkdir -p ${{targets.subpkgdir}}/usr/share/locale\nmv ${{targets.destdir}}/usr/share/locale/fr ${{targets.subpkgdir}}/usr/share/locale/\n"; fr.Pipeline[0].Runs != want {
+		t.Errorf("runs = %q, want %q", fr.Pipeline[0].Runs, want)
+	}
+}
+
+func TestExpandRangesErrors(t *testing.T) {
+	for _, cfg := range []Configuration{{
+		Subpackages: []Subpackage{{Name: "x-${{range.name}}", Range: "missing"}},
+	}, {
+		Data:        []DataList{{Name: "l", Items: []map[string]string{{"name": "a"}}}},
+		Subpackages: []Subpackage{{Name: "x-${{range.nmae}}", Range: "l"}},
+	}, {
+		Data:        []DataList{{Name: "l"}, {Name: "l"}},
+		Subpackages: []Subpackage{},
+	}, {
+		Subpackages: []Subpackage{{Name: "x", If: "maybe"}},
+	}} {
+		if err := cfg.expandRanges(); err == nil {
+			t.Errorf("expandRanges() of %+v succeeded", cfg)
+		}
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	for cond, want := range map[string]bool{
+		"":              true,
+		"true":          true,
+		"False":         false,
+		"de == de":      true,
+		"'de' == 'fr'":  false,
+		`"" != ""`:      false,
+		"x86_64 != arm": true,
+	} {
+		got, err := evalCondition(cond)
+		if err != nil || got != want {
+			t.Errorf("evalCondition(%q) = %t, %v, want %t", cond, got, err, want)
+		}
+	}
+}
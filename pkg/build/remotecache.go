@@ -0,0 +1,545 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The modes of the remote cache.
+const (
+	// RemoteCacheReadOnly restores artifacts from the remote cache,
+	// which suits the builds of untrusted changes.
+	RemoteCacheReadOnly = "read-only"
+	// RemoteCacheReadWrite also stores the artifacts fetched by the
+	// build in the remote cache.
+	RemoteCacheReadWrite = "read-write"
+)
+
+func init() {
+	RegisterCacheBackend(fileCacheBackend{})
+	RegisterCacheBackend(httpCacheBackend{scheme: "http"})
+	RegisterCacheBackend(httpCacheBackend{scheme: "https"})
+	RegisterCacheBackend(gcsCacheBackend{})
+	RegisterCacheBackend(s3CacheBackend{})
+	RegisterCacheBackend(ociCacheBackend{})
+}
+
+// validateRemoteCache checks the URL and mode of a remote cache.
+func validateRemoteCache(cache, mode string) error {
+	u, err := url.Parse(cache)
+	if err != nil {
+		return fmt.Errorf("invalid remote cache URL: %w", err)
+	}
+	if _, err := lookupCacheBackend(u.Scheme); err != nil {
+		return err
+	}
+
+	switch mode {
+	case RemoteCacheReadOnly, RemoteCacheReadWrite:
+	default:
+		return fmt.Errorf("remote cache mode must be %s or %s", RemoteCacheReadOnly, RemoteCacheReadWrite)
+	}
+
+	return nil
+}
+
+// remoteCache returns the backend and the URL of the remote cache, or a
+// nil backend if the build has none.
+func (ctx *Context) remoteCache() (CacheBackend, *url.URL) {
+	if ctx.RemoteCache == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(ctx.RemoteCache)
+	if err != nil {
+		return nil, nil
+	}
+	b, err := lookupCacheBackend(u.Scheme)
+	if err != nil {
+		return nil, nil
+	}
+
+	return b, u
+}
+
+// restoreSource writes the source with the SHA256 digest from the remote
+// cache to dest.  It reports whether the source was cached, and intact:
+// the digest of the restored source is verified, so that a corrupt or
+// tampered cache only makes the build fetch the source.
+func (ctx *Context) restoreSource(digest, dest string) bool {
+	b, u := ctx.remoteCache()
+	if b == nil {
+		return false
+	}
+
+	r, err := b.Get(ctx, u, digest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		log.Printf("warning: unable to read the remote cache: %v", err)
+		return false
+	}
+	defer r.Close()
+
+	if err := saveVerified(r, u.Redacted(), dest, digest); err != nil {
+		log.Printf("warning: unable to restore %s from the remote cache: %v", filepath.Base(dest), err)
+		return false
+	}
+
+	return true
+}
+
+// storeSource stores the fetched source with the SHA256 digest in the
+// remote cache, if it is writable.  Failures only make later builds
+// fetch the source, so they are logged as warnings.
+func (ctx *Context) storeSource(digest, path string) {
+	b, u := ctx.remoteCache()
+	if b == nil || ctx.RemoteCacheMode != RemoteCacheReadWrite {
+		return
+	}
+
+	if err := putFile(ctx, b, u, digest, path); err != nil {
+		log.Printf("warning: unable to store %s in the remote cache: %v", filepath.Base(path), err)
+	}
+}
+
+// sha256Digest matches the hex SHA256 digests of the artifacts.
+var sha256Digest = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// restoreStepEntry writes the entry of the step cache with key from the
+// remote cache to entry, and reports whether it was cached, and intact:
+// the digest of the archive of the entry is verified before it is
+// extracted, so that a corrupt or tampered cache only makes the build run
+// the steps.
+func (ctx *Context) restoreStepEntry(key, entry string) bool {
+	b, u := ctx.remoteCache()
+	idx, ok := b.(CacheIndex)
+	if !ok {
+		return false
+	}
+
+	digest, err := idx.Resolve(ctx, u, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if err == nil && !sha256Digest.MatchString(digest) {
+		err = fmt.Errorf("invalid digest %q", digest)
+	}
+	if err != nil {
+		log.Printf("warning: unable to look up step %s in the remote cache: %v", key, err)
+		return false
+	}
+
+	r, err := b.Get(ctx, u, digest)
+	if err != nil {
+		log.Printf("warning: unable to read step %s from the remote cache: %v", key, err)
+		return false
+	}
+	defer r.Close()
+
+	archive := filepath.Join(ctx.CacheDir, ".steps-"+key+".tar")
+	defer os.Remove(archive)
+	if err := saveVerified(r, u.Redacted(), archive, digest); err != nil {
+		log.Printf("warning: unable to restore step %s from the remote cache: %v", key, err)
+		return false
+	}
+
+	tmp, err := os.MkdirTemp(ctx.CacheDir, ".steps-")
+	if err != nil {
+		log.Printf("warning: unable to restore step %s from the remote cache: %v", key, err)
+		return false
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := untarStepEntry(archive, tmp); err != nil {
+		log.Printf("warning: unable to restore step %s from the remote cache: %v", key, err)
+		return false
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		if _, serr := os.Stat(entry); serr != nil {
+			log.Printf("warning: unable to restore step %s from the remote cache: %v", key, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// storeStepEntry stores the entry of the step cache with key in the
+// remote cache, if it is writable and the entry is not already there.
+// Failures only make later builds run the steps, so they are logged as
+// warnings.
+func (ctx *Context) storeStepEntry(key, entry string) {
+	b, u := ctx.remoteCache()
+	idx, ok := b.(CacheIndex)
+	if !ok || ctx.RemoteCacheMode != RemoteCacheReadWrite {
+		return
+	}
+
+	if _, err := idx.Resolve(ctx, u, key); err == nil {
+		return
+	}
+
+	f, err := os.CreateTemp(ctx.CacheDir, ".steps-*.tar")
+	if err != nil {
+		log.Printf("warning: unable to store step %s in the remote cache: %v", key, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	if err := tarStepEntry(entry, io.MultiWriter(f, h)); err != nil {
+		log.Printf("warning: unable to store step %s in the remote cache: %v", key, err)
+		return
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	digest := fmt.Sprintf("%x", h.Sum(nil))
+	if err == nil {
+		err = b.Put(ctx, u, digest, f, size)
+	}
+	if err == nil {
+		err = idx.Index(ctx, u, key, digest, size)
+	}
+	if err != nil {
+		log.Printf("warning: unable to store step %s in the remote cache: %v", key, err)
+	}
+}
+
+// tarStepEntry writes the files of an entry of the step cache to w as a
+// tar archive, keeping the modification times of the files.
+func tarStepEntry(entry string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(entry, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(entry, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// PAX keeps the fractions of seconds of the times.
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// untarStepEntry extracts an archive of an entry of the step cache into
+// dir.  The entries of the archive may not lead out of dir.
+func untarStepEntry(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %s is outside of the entry", hdr.Name)
+		}
+		path := filepath.Join(root, name)
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(path)); err != nil || parent != filepath.Dir(path) {
+			return fmt.Errorf("archive entry %s is outside of the entry", hdr.Name)
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(path, mode.Perm()|0700)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, path)
+		case tar.TypeReg:
+			var out *os.File
+			out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+			}
+		default:
+			err = fmt.Errorf("archive entry %s is not a file, directory or symbolic link", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// objectCacheBackend is a cache backend storing named objects: the
+// artifacts below sha256/ and the digests of the indexed artifacts below
+// steps/, by key.
+type objectCacheBackend interface {
+	getObject(ctx *Context, u *url.URL, object string) (io.ReadCloser, error)
+	putObject(ctx *Context, u *url.URL, object string, r io.Reader, size int64) error
+}
+
+// artifactObject returns the name of the object of an artifact.
+func artifactObject(digest string) string {
+	return "sha256/" + digest
+}
+
+func resolveObject(ctx *Context, b objectCacheBackend, u *url.URL, key string) (string, error) {
+	r, err := b.getObject(ctx, u, "steps/"+key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, 128))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func indexObject(ctx *Context, b objectCacheBackend, u *url.URL, key, digest string) error {
+	return b.putObject(ctx, u, "steps/"+key, strings.NewReader(digest), int64(len(digest)))
+}
+
+func putFile(ctx *Context, b CacheBackend, u *url.URL, digest, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return b.Put(ctx, u, digest, f, fi.Size())
+}
+
+// fileCacheBackend keeps the remote cache in a directory, such as a
+// network file system shared by the builders, given as file:///path.
+type fileCacheBackend struct{}
+
+func (fileCacheBackend) Name() string {
+	return "file"
+}
+
+func (fileCacheBackend) path(u *url.URL, object string) string {
+	return filepath.Join(filepath.FromSlash(u.Path), filepath.FromSlash(object))
+}
+
+func (b fileCacheBackend) Get(ctx *Context, u *url.URL, digest string) (io.ReadCloser, error) {
+	return b.getObject(ctx, u, artifactObject(digest))
+}
+
+func (b fileCacheBackend) Put(ctx *Context, u *url.URL, digest string, r io.Reader, size int64) error {
+	return b.putObject(ctx, u, artifactObject(digest), r, size)
+}
+
+func (b fileCacheBackend) Resolve(ctx *Context, u *url.URL, key string) (string, error) {
+	return resolveObject(ctx, b, u, key)
+}
+
+func (b fileCacheBackend) Index(ctx *Context, u *url.URL, key, digest string, size int64) error {
+	return indexObject(ctx, b, u, key, digest)
+}
+
+func (b fileCacheBackend) getObject(ctx *Context, u *url.URL, object string) (io.ReadCloser, error) {
+	return os.Open(b.path(u, object))
+}
+
+func (b fileCacheBackend) putObject(ctx *Context, u *url.URL, object string, r io.Reader, size int64) error {
+	path := b.path(u, object)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// other builders may read the artifact concurrently, so it is
+	// written atomically.
+	f, err := os.CreateTemp(filepath.Dir(path), ".melange-cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// httpCacheBackend keeps the remote cache on a server storing the
+// artifacts with PUT requests and serving them with GET requests, with
+// the credentials of the netrc file.
+type httpCacheBackend struct {
+	scheme string
+}
+
+func (b httpCacheBackend) Name() string {
+	return b.scheme
+}
+
+func (b httpCacheBackend) Get(ctx *Context, u *url.URL, digest string) (io.ReadCloser, error) {
+	return b.getObject(ctx, u, artifactObject(digest))
+}
+
+func (b httpCacheBackend) Put(ctx *Context, u *url.URL, digest string, r io.Reader, size int64) error {
+	return b.putObject(ctx, u, artifactObject(digest), r, size)
+}
+
+func (b httpCacheBackend) Resolve(ctx *Context, u *url.URL, key string) (string, error) {
+	return resolveObject(ctx, b, u, key)
+}
+
+func (b httpCacheBackend) Index(ctx *Context, u *url.URL, key, digest string, size int64) error {
+	return indexObject(ctx, b, u, key, digest)
+}
+
+func (httpCacheBackend) getObject(ctx *Context, u *url.URL, object string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, cacheObjectURL(u, object), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cacheRequest(ctx.client(), req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (httpCacheBackend) putObject(ctx *Context, u *url.URL, object string, r io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, cacheObjectURL(u, object), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := cacheRequest(ctx.client(), req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// cacheObjectURL returns the URL of an object below the URL of an HTTP
+// remote cache.
+func cacheObjectURL(u *url.URL, object string) string {
+	o := *u
+	o.Path = strings.TrimSuffix(u.Path, "/") + "/" + object
+	o.RawPath = ""
+	return o.String()
+}
+
+// cacheRequest sends a request of a remote cache backend, and returns
+// the response if it succeeded.  An artifact which is not cached is
+// reported as fs.ErrNotExist.
+func cacheRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	return checkCacheResponse(req, resp, err)
+}
+
+// checkCacheResponse returns the response of a request of a remote cache
+// backend if it succeeded, see cacheRequest.
+func checkCacheResponse(req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", req.URL.Redacted(), fs.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,303 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// objectServer stores the bodies of PUT requests and serves them to GET
+// requests, if check accepts the request.
+func objectServer(t *testing.T, check func(r *http.Request) bool) *httptest.Server {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if check != nil && !check(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = data
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// registryServer is an OCI registry storing blobs and manifests, which
+// asks for a bearer token.
+func registryServer(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	blobs := map[string][]byte{}
+	manifests := map[string][]byte{}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.URL.Query().Get("scope") != "repository:cache:pull,push" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"token": "secret"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:cache:pull,push"`, srv.URL))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/cache/blobs/uploads/":
+			w.Header().Set("Location", "/v2/cache/blobs/uploads/1?state=x")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && r.URL.Path == "/v2/cache/blobs/uploads/1":
+			if r.URL.Query().Get("state") != "x" {
+				http.Error(w, "bad state", http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			blobs[r.URL.Query().Get("digest")] = data
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2/cache/blobs/"):
+			data, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/cache/blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v2/cache/manifests/"):
+			data, _ := io.ReadAll(r.Body)
+			var m ociManifest
+			if r.Header.Get("Content-Type") != ociManifestType || json.Unmarshal(data, &m) != nil {
+				http.Error(w, "bad manifest", http.StatusBadRequest)
+				return
+			}
+			// the blobs of a manifest must be pushed first.
+			for _, d := range append(m.Layers, m.Config) {
+				if _, ok := blobs[d.Digest]; !ok {
+					http.Error(w, "blob unknown", http.StatusBadRequest)
+					return
+				}
+			}
+			manifests[strings.TrimPrefix(r.URL.Path, "/v2/cache/manifests/")] = data
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2/cache/manifests/"):
+			data, ok := manifests[strings.TrimPrefix(r.URL.Path, "/v2/cache/manifests/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", ociManifestType)
+			w.Write(data)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestCacheBackends(t *testing.T) {
+	data := []byte("hello, world\n")
+	digest := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	httpSrv := objectServer(t, nil)
+	gcsSrv := objectServer(t, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer gcs-token" && strings.HasPrefix(r.URL.Path, "/bucket/prefix/")
+	})
+	s3Srv := objectServer(t, func(r *http.Request) bool {
+		return strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") && strings.HasPrefix(r.URL.Path, "/bucket/prefix/")
+	})
+	registry := registryServer(t)
+
+	gcsEndpoint = gcsSrv.URL
+	t.Cleanup(func() { gcsEndpoint = "https://storage.googleapis.com" })
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "gcs-token")
+	t.Setenv("AWS_ENDPOINT_URL", s3Srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	registryURL, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cache := range []string{
+		"file://" + t.TempDir(),
+		httpSrv.URL + "/cache",
+		"gs://bucket/prefix",
+		"s3://bucket/prefix",
+		"oci://" + registryURL.Host + "/cache",
+	} {
+		u, err := url.Parse(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := lookupCacheBackend(u.Scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &Context{}
+
+		if _, err := b.Get(ctx, u, digest); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: Get() of a missing artifact = %v, want fs.ErrNotExist", cache, err)
+		}
+
+		if err := b.Put(ctx, u, digest, strings.NewReader(string(data)), int64(len(data))); err != nil {
+			t.Errorf("%s: Put() = %v", cache, err)
+			continue
+		}
+
+		r, err := b.Get(ctx, u, digest)
+		if err != nil {
+			t.Errorf("%s: Get() = %v", cache, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != string(data) {
+			t.Errorf("%s: Get() returned %q, %v", cache, got, err)
+		}
+
+		// the artifacts are indexed by key.
+		idx, ok := b.(CacheIndex)
+		if !ok {
+			t.Errorf("%s: the backend does not index artifacts", cache)
+			continue
+		}
+		key := strings.Repeat("ab", 32)
+		if _, err := idx.Resolve(ctx, u, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: Resolve() of a missing key = %v, want fs.ErrNotExist", cache, err)
+		}
+		if err := idx.Index(ctx, u, key, digest, int64(len(data))); err != nil {
+			t.Errorf("%s: Index() = %v", cache, err)
+			continue
+		}
+		if resolved, err := idx.Resolve(ctx, u, key); err != nil || resolved != digest {
+			t.Errorf("%s: Resolve() = %q, %v, want %s", cache, resolved, err, digest)
+		}
+	}
+}
+
+func TestSigV4Key(t *testing.T) {
+	// the example of the AWS documentation.
+	key := sigV4Key("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	if got, want := hex.EncodeToString(key), "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("sigV4Key() = %s, want %s", got, want)
+	}
+}
+
+func TestFetchSourceRemoteCache(t *testing.T) {
+	fetchBackoff = 0
+	source := "hello, world\n"
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(source)))
+
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprint(w, source)
+	}))
+	defer srv.Close()
+
+	cacheDir := t.TempDir()
+	with := map[string]string{
+		"${{inputs.uri}}":             srv.URL + "/hello.tar.gz",
+		"${{inputs.expected-sha256}}": digest,
+	}
+	fetch := func(mode string) {
+		t.Helper()
+		ctx := &Context{WorkspaceDir: t.TempDir(), RemoteCache: "file://" + cacheDir, RemoteCacheMode: mode}
+		if err := ctx.fetchSource(with); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "hello.tar.gz"))
+		if err != nil || string(data) != source {
+			t.Errorf("fetched %q, %v", data, err)
+		}
+	}
+
+	// a read-only cache is not written.
+	fetch(RemoteCacheReadOnly)
+	fetch(RemoteCacheReadWrite)
+	if fetches != 2 {
+		t.Errorf("%d fetches, want 2", fetches)
+	}
+
+	fetch(RemoteCacheReadOnly)
+	if fetches != 2 {
+		t.Errorf("the source was fetched instead of restored from the remote cache")
+	}
+
+	// a corrupt artifact is fetched again.
+	if err := os.WriteFile(filepath.Join(cacheDir, "sha256", digest), []byte("tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fetch(RemoteCacheReadOnly)
+	if fetches != 3 {
+		t.Errorf("a corrupt artifact of the remote cache was restored")
+	}
+}
+
+func TestValidateRemoteCache(t *testing.T) {
+	for _, tt := range []struct {
+		cache, mode string
+		wantErr     bool
+	}{
+		{"s3://bucket/prefix", RemoteCacheReadOnly, false},
+		{"oci://registry.example.com/cache", RemoteCacheReadWrite, false},
+		{"ftp://cache.example.com", RemoteCacheReadOnly, true},
+		{"s3://bucket/prefix", "write-only", true},
+	} {
+		if err := validateRemoteCache(tt.cache, tt.mode); (err != nil) != tt.wantErr {
+			t.Errorf("validateRemoteCache(%q, %q) = %v, wantErr %v", tt.cache, tt.mode, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"chainguard.dev/apko/pkg/tarball"
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/apk"
+	"github.com/psanford/memfs"
+)
+
+// ResignRepository re-signs the packages and index archives of the
+// repository directory, and its subdirectories, with signer, after
+// verifying their signatures with oldKey, the public key being rotated
+// out.  Only the signed sections are rewritten: the checksums of the
+// packages recorded in the indexes remain valid.
+//
+// The signature of oldKey is replaced by the one of signer, unless
+// keepOld is set, so that clients which only trust one of the keys can
+// install the packages during the rotation.  The other signatures are
+// kept, with their timestamps.  The new signature is timestamped by
+// timestamper, unless it is nil.  The checksum manifests of the
+// directories are rewritten and signed with signer.
+func ResignRepository(dir, oldKey string, signer sign.Signer, timestamper *sign.Timestamper, keepOld bool) error {
+	manifests := []string{}
+	moved := map[string]string{}
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch name := d.Name(); {
+		case d.IsDir() || strings.HasPrefix(name, ".melange-"):
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			// the names of the packages written with the
+			// content-addressed layout are relinked below.
+			return nil
+		case name == ChecksumManifestName:
+			manifests = append(manifests, path)
+			return nil
+		case !strings.HasSuffix(name, ".apk") && name != "APKINDEX.tar.gz":
+			return nil
+		}
+
+		if err := resignArchive(path, oldKey, signer, timestamper, keepOld); err != nil {
+			return fmt.Errorf("unable to re-sign %s: %w", path, err)
+		}
+		if isContentAddressed(path) {
+			rehashed, err := rehashPackage(path)
+			if err != nil {
+				return fmt.Errorf("unable to rename %s: %w", path, err)
+			}
+			moved[path] = rehashed
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := relinkPackages(dir, moved); err != nil {
+		return fmt.Errorf("unable to relink the packages: %w", err)
+	}
+
+	for _, path := range manifests {
+		if err := resignChecksumManifest(path, signer, moved); err != nil {
+			return fmt.Errorf("unable to re-sign %s: %w", path, err)
+		}
+	}
+
+	log.Printf("re-signed %d packages and indexes with %s", count, signer.KeyName())
+	return nil
+}
+
+// resignArchive replaces the signature section of a package or index
+// archive.
+func resignArchive(path, oldKey string, signer sign.Signer, timestamper *sign.Timestamper, keepOld bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sigs, err := apk.ReadSignatures(f)
+	if err != nil {
+		return err
+	}
+
+	oldName := filepath.Base(oldKey)
+	oldSignature, ok := sigs.Signatures[oldName]
+	if !ok {
+		return fmt.Errorf("it is not signed with %s", oldName)
+	}
+	if err := sign.RSAVerifySHA1Digest(sigs.Digest, oldSignature, oldKey); err != nil {
+		return fmt.Errorf("its signature does not verify with %s: %w", oldKey, err)
+	}
+
+	signature, err := signer.SignSHA1Digest(sigs.Digest)
+	if err != nil {
+		return fmt.Errorf("unable to generate signature: %w", err)
+	}
+	if !keepOld {
+		delete(sigs.Signatures, oldName)
+		delete(sigs.Timestamps, oldName)
+	}
+	sigs.Signatures[signer.KeyName()] = signature
+	delete(sigs.Timestamps, signer.KeyName())
+	if timestamper != nil {
+		token, err := timestamper.Timestamp(signature)
+		if err != nil {
+			return fmt.Errorf("unable to timestamp signature: %w", err)
+		}
+		sigs.Timestamps[signer.KeyName()] = token
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".melange-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if err := writeSignatureSection(w, sigs.Signatures, sigs.Timestamps, time.Unix(0, 0)); err != nil {
+		return fmt.Errorf("unable to write signature tarball: %w", err)
+	}
+	if _, err := f.Seek(sigs.Size, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(out.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), path)
+}
+
+// writeSignatureSection writes the signature section of a package or
+// index archive, the signatures and their time-stamp tokens keyed by the
+// name of their public key.
+func writeSignatureSection(w io.Writer, signatures, timestamps map[string][]byte, sourceDateEpoch time.Time) error {
+	multitarctx, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(sourceDateEpoch),
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+		tarball.WithSkipClose(true),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to build tarball context: %w", err)
+	}
+
+	names := make([]string, 0, len(signatures))
+	for name := range signatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	signatureFS := memfs.New()
+	for _, name := range names {
+		if err := signatureFS.WriteFile(apk.SignaturePrefix+name, signatures[name], 0644); err != nil {
+			return fmt.Errorf("unable to build signature FS: %w", err)
+		}
+		if token, ok := timestamps[name]; ok {
+			if err := signatureFS.WriteFile(apk.TimestampPrefix+name, token, 0644); err != nil {
+				return fmt.Errorf("unable to build signature FS: %w", err)
+			}
+		}
+	}
+
+	return multitarctx.WriteArchiveFromFS(".", signatureFS, w)
+}
+
+// resignChecksumManifest rewrites a checksum manifest, whose files may
+// have been re-signed, and signs it with signer.
+func resignChecksumManifest(path string, signer sign.Signer, moved map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if _, name, ok := strings.Cut(line, "  "); ok {
+			name = filepath.FromSlash(name)
+			if rehashed, ok := moved[filepath.Join(filepath.Dir(path), name)]; ok {
+				if name, err = filepath.Rel(filepath.Dir(path), rehashed); err != nil {
+					return err
+				}
+			}
+			names = append(names, name)
+		}
+	}
+
+	manifest, err := checksumManifest(filepath.Dir(path), names)
+	if err != nil {
+		return err
+	}
+	signature, err := signChecksumManifest(manifest, signer)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(manifest, data) {
+		if err := writeFileAtomic(path, manifest); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path+".sig", signature)
+}
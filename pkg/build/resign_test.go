@@ -0,0 +1,159 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/apk"
+)
+
+// writeTestKey writes a new signing key and its public key to dir, and
+// returns the path of the signing key.
+func writeTestKey(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, name)
+	writeFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	writeFile(t, keyFile+".pub", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})))
+	return keyFile
+}
+
+// signTestArchive prepends the signature section of signer to the
+// archive at path, with a placeholder timestamp.
+func signTestArchive(t *testing.T, path string, signer sign.Signer) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha1.Sum(data) // nolint:gosec
+	signature, err := signer.SignSHA1Digest(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeSignatureSection(&buf, map[string][]byte{signer.KeyName(): signature}, map[string][]byte{signer.KeyName(): []byte("timestamp")}, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, buf.String()+string(data))
+}
+
+func TestResignRepository(t *testing.T) {
+	keys := t.TempDir()
+	oldKey := writeTestKey(t, keys, "old.rsa")
+	newKey := writeTestKey(t, keys, "new.rsa")
+	otherKey := writeTestKey(t, keys, "other.rsa")
+
+	for _, keepOld := range []bool{false, true} {
+		dir := t.TempDir()
+		apkPath := filepath.Join(dir, "x86_64", "hello-2.12-r0.apk")
+		if err := os.MkdirAll(filepath.Dir(apkPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writePackageInfoAPK(t, apkPath, "pkgname = hello\npkgver = 2.12-r0\n")
+		signTestArchive(t, apkPath, sign.NewLocalSigner(oldKey, ""))
+
+		ctx := &Context{OutDir: filepath.Join(dir, "x86_64"), ChecksumManifest: true, signer: sign.NewLocalSigner(oldKey, "")}
+		ctx.recordArtifact("hello-2.12-r0.apk")
+		if err := ctx.WriteChecksumManifest(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ResignRepository(dir, oldKey+".pub", sign.NewLocalSigner(newKey, ""), nil, keepOld); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(apkPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg, err := apk.ReadPackage(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg.Info.Get("pkgname") != "hello" {
+			t.Errorf("re-signed package is named %q, want hello", pkg.Info.Get("pkgname"))
+		}
+
+		wantSignatures := 1
+		if keepOld {
+			wantSignatures = 2
+			if err := sign.RSAVerifySHA1Digest(pkg.ControlDigest, pkg.Signatures["old.rsa.pub"], oldKey+".pub"); err != nil {
+				t.Errorf("keepOld: signature of the old key does not verify: %v", err)
+			}
+		}
+		if _, ok := pkg.Timestamps["old.rsa.pub"]; ok != keepOld || len(pkg.Timestamps) != wantSignatures-1 {
+			t.Errorf("keepOld=%t: got timestamps %q, want the one of the old key only if it is kept", keepOld, pkg.Timestamps)
+		}
+		if len(pkg.Signatures) != wantSignatures {
+			t.Errorf("keepOld=%t: got signatures of %d keys, want %d", keepOld, len(pkg.Signatures), wantSignatures)
+		}
+		if err := sign.RSAVerifySHA1Digest(pkg.ControlDigest, pkg.Signatures["new.rsa.pub"], newKey+".pub"); err != nil {
+			t.Errorf("keepOld=%t: signature of the new key does not verify: %v", keepOld, err)
+		}
+
+		manifest, err := os.ReadFile(filepath.Join(dir, "x86_64", ChecksumManifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := checksumManifest(filepath.Join(dir, "x86_64"), []string{"hello-2.12-r0.apk"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(manifest, want) {
+			t.Errorf("keepOld=%t: checksum manifest = %q, want %q", keepOld, manifest, want)
+		}
+		signature, err := os.ReadFile(filepath.Join(dir, "x86_64", ChecksumManifestName+".sig"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha1.Sum(manifest) // nolint:gosec
+		if err := sign.RSAVerifySHA1Digest(digest[:], signature, newKey+".pub"); err != nil {
+			t.Errorf("keepOld=%t: checksum manifest signature does not verify: %v", keepOld, err)
+		}
+	}
+
+	// packages not signed with the old key are not re-signed.
+	dir := t.TempDir()
+	apkPath := filepath.Join(dir, "hello-2.12-r0.apk")
+	writePackageInfoAPK(t, apkPath, "pkgname = hello\n")
+	signTestArchive(t, apkPath, sign.NewLocalSigner(otherKey, ""))
+	if err := ResignRepository(dir, oldKey+".pub", sign.NewLocalSigner(newKey, ""), nil, false); err == nil {
+		t.Errorf("re-signing a package not signed with the old key succeeded")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// defaultRunner is the runner used when none is selected.
+const defaultRunner = "bubblewrap"
+
+func init() {
+	RegisterRunner(bubblewrapRunner{})
+	RegisterRunner(prootRunner{})
+}
+
+// bubblewrapRunner runs commands in an unprivileged bubblewrap sandbox,
+// with the seccomp profile and capabilities of the package.
+type bubblewrapRunner struct{}
+
+func (bubblewrapRunner) Name() string {
+	return "bubblewrap"
+}
+
+func (bubblewrapRunner) Command(ctx *Context, args ...string) (*exec.Cmd, error) {
+	rootBind := "--bind"
+	if ctx.readOnlyRoot() {
+		rootBind = "--ro-bind"
+	}
+
+	baseargs := []string{
+		rootBind, ctx.GuestDir, "/",
+		"--bind", ctx.WorkspaceDir, "/home/build",
+		"--bind", "/etc/resolv.conf", "/etc/resolv.conf",
+		"--unshare-pid",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--chdir", "/home/build",
+	}
+
+	extraFiles := []*os.File{}
+	sandboxArgs, err := ctx.bubblewrapSandboxArgs(&extraFiles)
+	if err != nil {
+		return nil, err
+	}
+	baseargs = append(baseargs, sandboxArgs...)
+
+	args = append(baseargs, args...)
+	cmd := exec.Command("bwrap", args...)
+	cmd.ExtraFiles = extraFiles
+
+	return cmd, nil
+}
+
+// prootRunner runs commands with proot, as the build user.
+type prootRunner struct{}
+
+func (prootRunner) Name() string {
+	return "proot"
+}
+
+func (prootRunner) Command(ctx *Context, args ...string) (*exec.Cmd, error) {
+	baseargs := []string{"-S", ctx.GuestDir, "-i", "1000:1000", "-b", fmt.Sprintf("%s:/home/build", ctx.WorkspaceDir), "-w", "/home/build"}
+
+	dirs, err := ctx.hostDirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		baseargs = append(baseargs, "-b", fmt.Sprintf("%s:%s", dir, dir))
+	}
+	for guest, host := range ctx.goCacheBinds() {
+		baseargs = append(baseargs, "-b", fmt.Sprintf("%s:%s", host, guest))
+	}
+	for guest, host := range ctx.javaBinds() {
+		baseargs = append(baseargs, "-b", fmt.Sprintf("%s:%s", host, guest))
+	}
+
+	args = append(baseargs, args...)
+	cmd := exec.Command("proot", args...)
+
+	return cmd, nil
+}
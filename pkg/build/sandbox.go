@@ -0,0 +1,366 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The seccomp profiles of the build environment.
+const (
+	// SeccompDefault denies the system calls which administer the
+	// host, such as loading kernel modules or setting the clock.
+	SeccompDefault = "default"
+	// SeccompStrict also denies the system calls which inspect other
+	// processes or build new sandboxes, such as ptrace, mount and
+	// unshare.
+	SeccompStrict = "strict"
+	// SeccompUnconfined does not filter system calls.
+	SeccompUnconfined = "unconfined"
+)
+
+// Sandbox is the isolation of the build environment of a package.
+type Sandbox struct {
+	// Seccomp is the seccomp profile of the build environment:
+	// "default", "strict" or, exceptionally, "unconfined".
+	Seccomp string `yaml:"seccomp"`
+	// Capabilities are added to the build environment, exceptionally,
+	// such as CAP_SYS_PTRACE for test suites which trace processes.
+	Capabilities []string `yaml:"capabilities"`
+	// Home is where HOME and the XDG base directories of the
+	// pipelines are: "private" to the build, the default, or, when
+	// a build needs the dotfiles of the user running melange,
+	// "host".
+	Home string `yaml:"home"`
+	// Tmp is where TMPDIR of the pipelines is: "private" to the
+	// build, the default, or "host".
+	Tmp string `yaml:"tmp"`
+	// ReadOnlyRoot mounts the root of the build environment read-only,
+	// so that the pipelines cannot modify the toolchain installed in
+	// it.  Only the workspace, /tmp and the Writable directories can
+	// be written.
+	ReadOnlyRoot bool `yaml:"read-only-root"`
+	// Writable are the absolute paths of the directories of the build
+	// environment which stay writable under a read-only root.
+	Writable []string `yaml:"writable"`
+}
+
+// seccompDenied are the system calls denied by each seccomp profile.
+var seccompDenied = map[string][]string{
+	SeccompDefault: defaultDeniedSyscalls,
+	SeccompStrict: append(append([]string{}, defaultDeniedSyscalls...),
+		"ptrace", "process_vm_readv", "process_vm_writev", "personality",
+		"userfaultfd", "bpf", "perf_event_open", "unshare", "setns",
+		"mount", "umount2", "pivot_root", "keyctl", "add_key",
+		"request_key", "open_by_handle_at", "name_to_handle_at"),
+}
+
+var defaultDeniedSyscalls = []string{
+	"kexec_load", "kexec_file_load", "init_module", "finit_module",
+	"delete_module", "reboot", "swapon", "swapoff", "acct",
+	"settimeofday", "clock_settime", "adjtimex", "clock_adjtime",
+	"iopl", "ioperm",
+}
+
+// seccompArch is the audit architecture and the system call numbers of
+// an architecture.
+type seccompArch struct {
+	audit    uint32
+	syscalls map[string]uint32
+}
+
+// seccompArchs are the architectures which seccomp profiles can be
+// applied on, keyed by GOARCH.  The system calls which an architecture
+// does not have are not listed.
+var seccompArchs = map[string]seccompArch{
+	"amd64": {
+		audit: 0xc000003e,
+		syscalls: map[string]uint32{
+			"kexec_load": 246, "kexec_file_load": 320, "init_module": 175,
+			"finit_module": 313, "delete_module": 176, "reboot": 169,
+			"swapon": 167, "swapoff": 168, "acct": 163,
+			"settimeofday": 164, "clock_settime": 227, "adjtimex": 159,
+			"clock_adjtime": 305, "iopl": 172, "ioperm": 173,
+			"ptrace": 101, "process_vm_readv": 310, "process_vm_writev": 311,
+			"personality": 135, "userfaultfd": 323, "bpf": 321,
+			"perf_event_open": 298, "unshare": 272, "setns": 308,
+			"mount": 165, "umount2": 166, "pivot_root": 155,
+			"keyctl": 250, "add_key": 248, "request_key": 249,
+			"open_by_handle_at": 304, "name_to_handle_at": 303,
+		},
+	},
+	"arm64": {
+		audit: 0xc00000b7,
+		syscalls: map[string]uint32{
+			"kexec_load": 104, "kexec_file_load": 294, "init_module": 105,
+			"finit_module": 273, "delete_module": 106, "reboot": 142,
+			"swapon": 224, "swapoff": 225, "acct": 89,
+			"settimeofday": 170, "clock_settime": 112, "adjtimex": 171,
+			"clock_adjtime": 266, "ptrace": 117, "process_vm_readv": 270,
+			"process_vm_writev": 271, "personality": 92, "userfaultfd": 282,
+			"bpf": 280, "perf_event_open": 241, "unshare": 97, "setns": 268,
+			"mount": 40, "umount2": 39, "pivot_root": 41,
+			"keyctl": 219, "add_key": 217, "request_key": 218,
+			"open_by_handle_at": 265, "name_to_handle_at": 264,
+		},
+	},
+}
+
+// The classic BPF instructions and seccomp return values used by the
+// seccomp programs.
+const (
+	bpfLdWAbs = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+
+	// x32SyscallBit marks the system calls of the x32 ABI of amd64.
+	x32SyscallBit = 0x40000000
+
+	errnoEPERM  = 1
+	errnoENOSYS = 38
+)
+
+// validate checks the sandbox of a package.
+func (sb *Sandbox) validate() error {
+	switch sb.Seccomp {
+	case "", SeccompDefault, SeccompStrict, SeccompUnconfined:
+	default:
+		return fmt.Errorf("sandbox: seccomp must be one of %s, %s or %s", SeccompDefault, SeccompStrict, SeccompUnconfined)
+	}
+
+	if err := validateSandboxDir("home", sb.Home); err != nil {
+		return err
+	}
+	if err := validateSandboxDir("tmp", sb.Tmp); err != nil {
+		return err
+	}
+
+	if err := validateWritableDirs(sb.Writable); err != nil {
+		return err
+	}
+
+	for _, c := range sb.Capabilities {
+		name := strings.TrimPrefix(c, "CAP_")
+		if name == c || name == "" || strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZ_") != "" {
+			return fmt.Errorf("sandbox: %q is not a capability, such as CAP_SYS_PTRACE", c)
+		}
+	}
+
+	return nil
+}
+
+// seccompProfile returns the seccomp profile requested for the build
+// environment.
+func (sb *Sandbox) seccompProfile() string {
+	if sb.Seccomp == "" {
+		return SeccompDefault
+	}
+	return sb.Seccomp
+}
+
+// appliedSeccompProfile returns the seccomp profile which is applied to
+// the build environment.  Only the bubblewrap runner applies profiles,
+// on the architectures in seccompArchs.
+func (ctx *Context) appliedSeccompProfile() string {
+	if ctx.Runner != "bubblewrap" {
+		return SeccompUnconfined
+	}
+	if _, ok := seccompArchs[runtime.GOARCH]; !ok {
+		return SeccompUnconfined
+	}
+	return ctx.Configuration.Package.Sandbox.seccompProfile()
+}
+
+// checkSandbox checks that the sandbox requested by the package can be
+// applied.  The default profile is applied where it can be, but the
+// build fails instead of silently running without a stricter profile
+// or with fewer capabilities than requested.
+func (ctx *Context) checkSandbox() error {
+	sb := &ctx.Configuration.Package.Sandbox
+
+	if sb.seccompProfile() == SeccompStrict && ctx.appliedSeccompProfile() != SeccompStrict {
+		return fmt.Errorf("the %s seccomp profile cannot be applied by the %s runner on %s", SeccompStrict, ctx.Runner, runtime.GOARCH)
+	}
+
+	if len(sb.Capabilities) > 0 && ctx.Runner != "bubblewrap" {
+		return fmt.Errorf("capabilities cannot be added by the %s runner", ctx.Runner)
+	}
+
+	if err := ctx.checkSandboxDirs(); err != nil {
+		return err
+	}
+
+	if ctx.readOnlyRoot() && ctx.Runner != "bubblewrap" {
+		return fmt.Errorf("a read-only root cannot be applied by the %s runner", ctx.Runner)
+	}
+
+	if sb.seccompProfile() == SeccompUnconfined || len(sb.Capabilities) > 0 || sb.hostHome() || sb.hostTmp() {
+		log.Printf("warning: the build environment is less isolated than usual: %s", ctx.SandboxProfile())
+	}
+
+	return nil
+}
+
+// SandboxProfile describes the isolation applied to the build
+// environment, which is recorded in the packages.
+func (ctx *Context) SandboxProfile() string {
+	profile := fmt.Sprintf("runner %s, seccomp %s", ctx.Runner, ctx.appliedSeccompProfile())
+	if caps := ctx.Configuration.Package.Sandbox.Capabilities; len(caps) > 0 {
+		profile += ", capabilities " + strings.Join(caps, ",")
+	}
+	if ctx.Configuration.Package.Sandbox.hostHome() {
+		profile += ", home " + SandboxDirHost
+	}
+	if ctx.Configuration.Package.Sandbox.hostTmp() {
+		profile += ", tmp " + SandboxDirHost
+	}
+	if ctx.readOnlyRoot() {
+		profile += ", read-only root"
+		if writable := ctx.Configuration.Package.Sandbox.Writable; len(writable) > 0 {
+			profile += " writable " + strings.Join(writable, ",")
+		}
+	}
+	return profile
+}
+
+// seccompProgram returns the seccomp program of a profile for an
+// architecture, as an array of struct sock_filter.  The denied system
+// calls fail with EPERM.  System calls of other ABIs, such as 32-bit
+// programs on amd64, are allowed by the default profile and fail with
+// ENOSYS in the strict profile.
+func seccompProgram(profile, goarch string) ([]byte, error) {
+	arch, ok := seccompArchs[goarch]
+	if !ok {
+		return nil, fmt.Errorf("seccomp profiles are not supported on %s", goarch)
+	}
+
+	otherABI := uint32(seccompRetAllow)
+	if profile == SeccompStrict {
+		otherABI = seccompRetErrno | errnoENOSYS
+	}
+
+	denied := []uint32{}
+	for _, name := range seccompDenied[profile] {
+		if nr, ok := arch.syscalls[name]; ok {
+			denied = append(denied, nr)
+		}
+	}
+
+	type sockFilter struct {
+		Code uint16
+		Jt   uint8
+		Jf   uint8
+		K    uint32
+	}
+
+	prog := []sockFilter{
+		// seccomp_data.arch
+		{Code: bpfLdWAbs, K: 4},
+		{Code: bpfJeqK, Jt: 1, Jf: 0, K: arch.audit},
+		{Code: bpfRetK, K: otherABI},
+		// seccomp_data.nr
+		{Code: bpfLdWAbs, K: 0},
+	}
+	if goarch == "amd64" {
+		prog = append(prog,
+			sockFilter{Code: bpfJgeK, Jt: 0, Jf: 1, K: x32SyscallBit},
+			sockFilter{Code: bpfRetK, K: otherABI},
+		)
+	}
+	for _, nr := range denied {
+		prog = append(prog,
+			sockFilter{Code: bpfJeqK, Jt: 0, Jf: 1, K: nr},
+			sockFilter{Code: bpfRetK, K: seccompRetErrno | errnoEPERM},
+		)
+	}
+	prog = append(prog, sockFilter{Code: bpfRetK, K: seccompRetAllow})
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, prog); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bubblewrapSandboxArgs returns the arguments of bubblewrap applying the
+// sandbox of the package to cmd, whose seccomp program is passed as an
+// extra file.  The caller closes the extra files once cmd is started.
+func (ctx *Context) bubblewrapSandboxArgs(extraFiles *[]*os.File) ([]string, error) {
+	args := []string{}
+
+	for _, c := range ctx.Configuration.Package.Sandbox.Capabilities {
+		args = append(args, "--cap-add", c)
+	}
+
+	// the writable directories are bound over the read-only root,
+	// before the directories of the host, which may replace /tmp.
+	for _, dir := range ctx.writableDirs() {
+		args = append(args, "--bind", filepath.Join(ctx.GuestDir, dir), dir)
+	}
+
+	dirs, err := ctx.hostDirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		args = append(args, "--bind", dir, dir)
+	}
+	for guest, host := range ctx.goCacheBinds() {
+		args = append(args, "--bind", host, guest)
+	}
+	for guest, host := range ctx.javaBinds() {
+		args = append(args, "--bind", host, guest)
+	}
+
+	profile := ctx.appliedSeccompProfile()
+	if profile == SeccompUnconfined {
+		return args, nil
+	}
+
+	prog, err := seccompProgram(profile, runtime.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to pass the seccomp program: %w", err)
+	}
+
+	// the program is much smaller than the pipe buffer.
+	_, err = w.Write(prog)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("unable to pass the seccomp program: %w", err)
+	}
+
+	*extraFiles = append(*extraFiles, r)
+	args = append(args, "--seccomp", fmt.Sprint(2+len(*extraFiles)))
+
+	return args, nil
+}
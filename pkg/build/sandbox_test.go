@@ -0,0 +1,348 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// runSeccompProgram evaluates a seccomp program for a system call, with
+// the few instructions used by seccompProgram.
+func runSeccompProgram(t *testing.T, prog []byte, audit, nr uint32) uint32 {
+	t.Helper()
+
+	var acc uint32
+	for pc := 0; pc*8 < len(prog); pc++ {
+		ins := prog[pc*8 : pc*8+8]
+		code := binary.LittleEndian.Uint16(ins[0:2])
+		jt, jf := int(ins[2]), int(ins[3])
+		k := binary.LittleEndian.Uint32(ins[4:8])
+
+		switch code {
+		case bpfLdWAbs:
+			switch k {
+			case 0:
+				acc = nr
+			case 4:
+				acc = audit
+			default:
+				t.Fatalf("load of offset %d", k)
+			}
+		case bpfJeqK, bpfJgeK:
+			if (code == bpfJeqK && acc == k) || (code == bpfJgeK && acc >= k) {
+				pc += jt
+			} else {
+				pc += jf
+			}
+		case bpfRetK:
+			return k
+		default:
+			t.Fatalf("unknown instruction %#x", code)
+		}
+	}
+
+	t.Fatal("program does not return")
+	return 0
+}
+
+func TestSeccompProgram(t *testing.T) {
+	const (
+		auditX86_64 = 0xc000003e
+		auditI386   = 0x40000003
+	)
+
+	tests := []struct {
+		profile string
+		audit   uint32
+		nr      uint32
+		want    uint32
+	}{
+		{SeccompDefault, auditX86_64, 39, seccompRetAllow},                              // getpid
+		{SeccompDefault, auditX86_64, 175, seccompRetErrno | errnoEPERM},                // init_module
+		{SeccompDefault, auditX86_64, 101, seccompRetAllow},                             // ptrace
+		{SeccompDefault, auditI386, 128, seccompRetAllow},                               // 32-bit init_module
+		{SeccompStrict, auditX86_64, 101, seccompRetErrno | errnoEPERM},                 // ptrace
+		{SeccompStrict, auditX86_64, 272, seccompRetErrno | errnoEPERM},                 // unshare
+		{SeccompStrict, auditX86_64, 39, seccompRetAllow},                               // getpid
+		{SeccompStrict, auditX86_64, x32SyscallBit | 39, seccompRetErrno | errnoENOSYS}, // x32 getpid
+		{SeccompStrict, auditI386, 20, seccompRetErrno | errnoENOSYS},                   // 32-bit getpid
+	}
+
+	for _, tt := range tests {
+		prog, err := seccompProgram(tt.profile, "amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := runSeccompProgram(t, prog, tt.audit, tt.nr); got != tt.want {
+			t.Errorf("%s profile, arch %#x, system call %#x: got %#x, want %#x", tt.profile, tt.audit, tt.nr, got, tt.want)
+		}
+	}
+
+	if _, err := seccompProgram(SeccompDefault, "mips"); err == nil {
+		t.Error("seccompProgram() succeeded on mips")
+	}
+}
+
+func TestSandboxValidate(t *testing.T) {
+	for _, sb := range []Sandbox{
+		{},
+		{Seccomp: SeccompStrict},
+		{Seccomp: SeccompUnconfined, Capabilities: []string{"CAP_SYS_PTRACE"}},
+		{ReadOnlyRoot: true, Writable: []string{"/var/cache/ccache"}},
+	} {
+		if err := sb.validate(); err != nil {
+			t.Errorf("validate(%+v) = %v", sb, err)
+		}
+	}
+
+	for _, sb := range []Sandbox{
+		{Seccomp: "relaxed"},
+		{Capabilities: []string{"SYS_PTRACE"}},
+		{Capabilities: []string{"CAP_"}},
+		{Capabilities: []string{"CAP_SYS_PTRACE --bind / /"}},
+		{ReadOnlyRoot: true, Writable: []string{"var/cache"}},
+		{ReadOnlyRoot: true, Writable: []string{"/usr/../etc"}},
+		{ReadOnlyRoot: true, Writable: []string{"/"}},
+	} {
+		if err := sb.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded", sb)
+		}
+	}
+}
+
+func TestSandboxProfile(t *testing.T) {
+	if _, ok := seccompArchs[runtime.GOARCH]; !ok {
+		t.Skipf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+
+	tests := []struct {
+		runner  string
+		sandbox Sandbox
+		want    string
+		wantErr bool
+	}{{
+		runner: "bubblewrap",
+		want:   "runner bubblewrap, seccomp default",
+	}, {
+		runner:  "bubblewrap",
+		sandbox: Sandbox{Seccomp: SeccompStrict, Capabilities: []string{"CAP_SYS_PTRACE", "CAP_NET_RAW"}},
+		want:    "runner bubblewrap, seccomp strict, capabilities CAP_SYS_PTRACE,CAP_NET_RAW",
+	}, {
+		runner: "proot",
+		want:   "runner proot, seccomp unconfined",
+	}, {
+		runner:  "proot",
+		sandbox: Sandbox{Seccomp: SeccompStrict},
+		want:    "runner proot, seccomp unconfined",
+		wantErr: true,
+	}, {
+		runner:  "proot",
+		sandbox: Sandbox{Capabilities: []string{"CAP_SYS_PTRACE"}},
+		want:    "runner proot, seccomp unconfined, capabilities CAP_SYS_PTRACE",
+		wantErr: true,
+	}, {
+		runner:  "bubblewrap",
+		sandbox: Sandbox{ReadOnlyRoot: true, Writable: []string{"/var/cache/ccache"}},
+		want:    "runner bubblewrap, seccomp default, read-only root writable /var/cache/ccache",
+	}, {
+		runner:  "proot",
+		sandbox: Sandbox{ReadOnlyRoot: true},
+		want:    "runner proot, seccomp unconfined, read-only root",
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		ctx := &Context{Runner: tt.runner}
+		ctx.Configuration.Package.Sandbox = tt.sandbox
+
+		if got := ctx.SandboxProfile(); got != tt.want {
+			t.Errorf("SandboxProfile() = %q, want %q", got, tt.want)
+		}
+		if err := ctx.checkSandbox(); (err != nil) != tt.wantErr {
+			t.Errorf("%s %+v: checkSandbox() = %v, wantErr %t", tt.runner, tt.sandbox, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBubblewrapSandboxArgs(t *testing.T) {
+	if _, ok := seccompArchs[runtime.GOARCH]; !ok {
+		t.Skipf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+
+	ctx := &Context{Runner: "bubblewrap", GuestDir: "/guest", WorkspaceDir: "/work"}
+	ctx.Configuration.Package.Sandbox = Sandbox{Capabilities: []string{"CAP_SYS_PTRACE"}}
+
+	cmd, err := bubblewrapRunner{}.Command(ctx, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cmd.ExtraFiles) != 1 {
+		t.Fatalf("extra files = %v, want the seccomp program", cmd.ExtraFiles)
+	}
+	defer cmd.ExtraFiles[0].Close()
+
+	found := 0
+	for i, arg := range cmd.Args {
+		switch {
+		case arg == "--cap-add" && cmd.Args[i+1] == "CAP_SYS_PTRACE":
+			found++
+		case arg == "--seccomp" && cmd.Args[i+1] == "3":
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("args = %q, want the capability and the seccomp program on fd 3", cmd.Args)
+	}
+
+	want, err := seccompProgram(SeccompDefault, runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(want)+1)
+	n, _ := cmd.ExtraFiles[0].Read(got)
+	if string(got[:n]) != string(want) {
+		t.Errorf("the extra file is not the seccomp program")
+	}
+}
+
+func TestSandboxDirEnvironment(t *testing.T) {
+	t.Setenv("HOME", "/home/builder")
+	t.Setenv("TMPDIR", "/var/tmp")
+	t.Setenv("XDG_CONFIG_HOME", "/home/builder/conf")
+
+	tests := []struct {
+		sandbox Sandbox
+		want    []string
+	}{{
+		want: []string{
+			"HOME=/tmp/melange-home",
+			"XDG_CACHE_HOME=/tmp/melange-home/.cache",
+			"XDG_CONFIG_HOME=/tmp/melange-home/.config",
+			"XDG_DATA_HOME=/tmp/melange-home/.local/share",
+			"XDG_STATE_HOME=/tmp/melange-home/.local/state",
+			"XDG_RUNTIME_DIR=/tmp/melange-runtime",
+			"TMPDIR=/tmp/melange-tmp",
+		},
+	}, {
+		sandbox: Sandbox{Home: SandboxDirHost, Tmp: SandboxDirHost},
+		want: []string{
+			"HOME=/home/builder",
+			"XDG_CONFIG_HOME=/home/builder/conf",
+			"TMPDIR=/var/tmp",
+		},
+	}}
+
+	for _, tt := range tests {
+		ctx := &Context{}
+		ctx.Configuration.Package.Sandbox = tt.sandbox
+
+		env, err := ctx.sandboxDirEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(env, tt.want) {
+			t.Errorf("sandboxDirEnvironment() = %q, want %q", env, tt.want)
+		}
+	}
+}
+
+func TestSandboxDirs(t *testing.T) {
+	if err := (&Sandbox{Home: "shared"}).validate(); err == nil {
+		t.Error("validate() accepted an unknown home directory")
+	}
+
+	ctx := &Context{GuestDir: t.TempDir(), Runner: "lima"}
+	if err := ctx.prepareSandboxDirs(); err != nil {
+		t.Fatal(err)
+	}
+	for dir, mode := range map[string]os.FileMode{
+		privateHomeDir:    0755,
+		privateRuntimeDir: 0700,
+		privateTmpDir:     0777 | os.ModeSticky,
+	} {
+		fi, err := os.Stat(filepath.Join(ctx.GuestDir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode() & (os.ModePerm | os.ModeSticky); got != mode {
+			t.Errorf("mode of %s = %v, want %v", dir, got, mode)
+		}
+	}
+
+	ctx.Configuration.Package.Sandbox.Tmp = SandboxDirHost
+	if err := ctx.checkSandboxDirs(); err == nil {
+		t.Error("checkSandboxDirs() accepted the temporary directory of the host with the lima runner")
+	}
+	ctx.Runner = "bubblewrap"
+	if err := ctx.checkSandboxDirs(); err != nil {
+		t.Errorf("checkSandboxDirs() = %v", err)
+	}
+}
+
+func TestReadOnlyRoot(t *testing.T) {
+	ctx := &Context{Runner: "bubblewrap", GuestDir: t.TempDir(), WorkspaceDir: "/work", ReadOnlyRoot: true}
+	ctx.Configuration.Package.Sandbox = Sandbox{Seccomp: SeccompUnconfined, Writable: []string{"/var/cache/ccache"}}
+
+	if err := ctx.prepareSandboxDirs(); err != nil {
+		t.Fatal(err)
+	}
+	for dir, mode := range map[string]os.FileMode{
+		"/home/build":       0755,
+		"/tmp":              0777 | os.ModeSticky,
+		"/var/cache/ccache": 0755,
+	} {
+		fi, err := os.Stat(filepath.Join(ctx.GuestDir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode() & (os.ModePerm | os.ModeSticky); got != mode {
+			t.Errorf("mode of %s = %v, want %v", dir, got, mode)
+		}
+	}
+
+	cmd, err := bubblewrapRunner{}.Command(ctx, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := strings.Join(cmd.Args, " ")
+	for _, want := range []string{
+		"--ro-bind " + ctx.GuestDir + " / --bind /work /home/build",
+		"--bind " + ctx.GuestDir + "/tmp /tmp",
+		"--bind " + ctx.GuestDir + "/var/cache/ccache /var/cache/ccache",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args = %q, want %q", args, want)
+		}
+	}
+
+	ctx.ReadOnlyRoot = false
+	cmd, err = bubblewrapRunner{}.Command(ctx, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Args[1] != "--bind" || len(ctx.writableDirs()) != 0 {
+		t.Errorf("args = %q, want a writable root", cmd.Args)
+	}
+}
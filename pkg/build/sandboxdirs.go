@@ -0,0 +1,205 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The locations of the home and temporary directories of the pipelines.
+const (
+	// SandboxDirPrivate uses a directory of the build environment,
+	// which starts empty and is discarded with it.
+	SandboxDirPrivate = "private"
+	// SandboxDirHost binds the directory of the host into the build
+	// environment, so that the pipelines can read and write the
+	// dotfiles and caches of the user running melange.
+	SandboxDirHost = "host"
+)
+
+// The private directories of the build environment.
+const (
+	privateHomeDir    = "/tmp/melange-home"
+	privateTmpDir     = "/tmp/melange-tmp"
+	privateRuntimeDir = "/tmp/melange-runtime"
+)
+
+// validateSandboxDir checks the location of a directory of the sandbox.
+func validateSandboxDir(name, value string) error {
+	switch value {
+	case "", SandboxDirPrivate, SandboxDirHost:
+		return nil
+	}
+	return fmt.Errorf("sandbox: %s must be %s or %s", name, SandboxDirPrivate, SandboxDirHost)
+}
+
+// hostHome reports whether the pipelines use the home directory of the
+// host.
+func (sb *Sandbox) hostHome() bool {
+	return sb.Home == SandboxDirHost
+}
+
+// hostTmp reports whether the pipelines use the temporary directory of
+// the host.
+func (sb *Sandbox) hostTmp() bool {
+	return sb.Tmp == SandboxDirHost
+}
+
+// hostDirs returns the directories of the host which are bound into the
+// build environment at the same path.
+func (ctx *Context) hostDirs() ([]string, error) {
+	sb := &ctx.Configuration.Package.Sandbox
+	dirs := []string{}
+
+	if sb.hostHome() {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: unable to use the home directory of the host: %w", err)
+		}
+		dirs = append(dirs, home)
+	}
+
+	if sb.hostTmp() {
+		dirs = append(dirs, os.TempDir())
+	}
+
+	return dirs, nil
+}
+
+// sandboxDirEnvironment returns the variables locating the home and
+// temporary directories of the pipelines.  The XDG base directories are
+// below the home directory, as the ones of the host are only used with
+// the home directory of the host.
+func (ctx *Context) sandboxDirEnvironment() ([]string, error) {
+	sb := &ctx.Configuration.Package.Sandbox
+	env := []string{}
+
+	if sb.hostHome() {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: unable to use the home directory of the host: %w", err)
+		}
+		env = append(env, "HOME="+home)
+		for _, name := range []string{"XDG_CACHE_HOME", "XDG_CONFIG_HOME", "XDG_DATA_HOME", "XDG_STATE_HOME"} {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	} else {
+		env = append(env,
+			"HOME="+privateHomeDir,
+			"XDG_CACHE_HOME="+privateHomeDir+"/.cache",
+			"XDG_CONFIG_HOME="+privateHomeDir+"/.config",
+			"XDG_DATA_HOME="+privateHomeDir+"/.local/share",
+			"XDG_STATE_HOME="+privateHomeDir+"/.local/state",
+			"XDG_RUNTIME_DIR="+privateRuntimeDir,
+		)
+	}
+
+	if sb.hostTmp() {
+		env = append(env, "TMPDIR="+os.TempDir())
+	} else {
+		env = append(env, "TMPDIR="+privateTmpDir)
+	}
+
+	return env, nil
+}
+
+// validateWritableDirs checks the writable directories of a read-only
+// root.
+func validateWritableDirs(writable []string) error {
+	for _, dir := range writable {
+		if !filepath.IsAbs(dir) || filepath.Clean(dir) != dir || dir == "/" {
+			return fmt.Errorf("sandbox: writable directory %q must be a clean absolute path below /", dir)
+		}
+	}
+	return nil
+}
+
+// readOnlyRoot reports whether the root of the build environment is
+// mounted read-only, as requested by the package or by melange.
+func (ctx *Context) readOnlyRoot() bool {
+	return ctx.ReadOnlyRoot || ctx.Configuration.Package.Sandbox.ReadOnlyRoot
+}
+
+// writableDirs returns the directories of the build environment which
+// are bound writable over a read-only root, if any.  The workspace is
+// bound separately.
+func (ctx *Context) writableDirs() []string {
+	if !ctx.readOnlyRoot() {
+		return nil
+	}
+	return append([]string{"/tmp"}, ctx.Configuration.Package.Sandbox.Writable...)
+}
+
+// prepareSandboxDirs creates the private directories of the build
+// environment, and the mount points of a read-only root, which cannot
+// be created once it is mounted.
+func (ctx *Context) prepareSandboxDirs() error {
+	sb := &ctx.Configuration.Package.Sandbox
+
+	dirs := map[string]os.FileMode{}
+	if ctx.readOnlyRoot() {
+		for _, dir := range append([]string{"/home/build"}, ctx.writableDirs()...) {
+			if _, err := os.Stat(filepath.Join(ctx.GuestDir, dir)); errors.Is(err, os.ErrNotExist) {
+				dirs[dir] = 0755
+			}
+		}
+		if _, ok := dirs["/tmp"]; ok {
+			dirs["/tmp"] = 0777 | os.ModeSticky
+		}
+	}
+	if !sb.hostHome() {
+		dirs[privateHomeDir] = 0755
+		dirs[privateRuntimeDir] = 0700
+	}
+	if !sb.hostTmp() {
+		dirs[privateTmpDir] = 0777 | os.ModeSticky
+	}
+
+	for dir, mode := range dirs {
+		path := filepath.Join(ctx.GuestDir, dir)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("unable to make %s in the build environment: %w", dir, err)
+		}
+		// the permissions are not subject to the umask.
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("unable to make %s in the build environment: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// checkSandboxDirs checks that the directories of the host requested by
+// the package can be bound into the build environment.
+func (ctx *Context) checkSandboxDirs() error {
+	dirs, err := ctx.hostDirs()
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	if ctx.Runner != "bubblewrap" && ctx.Runner != "proot" {
+		return errors.New("the directories of the host can only be used with the bubblewrap and proot runners")
+	}
+
+	return nil
+}
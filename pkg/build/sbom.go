@@ -0,0 +1,363 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/sbom"
+	"sigs.k8s.io/release-utils/version"
+)
+
+func init() {
+	RegisterSBOMGenerator(melangeSBOMGenerator{})
+}
+
+// melangeSBOMGenerator installs SBOMs of the files of the packages, in
+// the formats of Context.SBOMFormats, below apk.SBOMDir.
+type melangeSBOMGenerator struct{}
+
+func (melangeSBOMGenerator) Name() string {
+	return "melange"
+}
+
+// usesMelangeSBOMGenerator reports whether the melange SBOM generator
+// runs for the packages.
+func (ctx *Context) usesMelangeSBOMGenerator() bool {
+	for _, name := range ctx.SBOMGenerators {
+		if name == (melangeSBOMGenerator{}).Name() {
+			return true
+		}
+	}
+	return false
+}
+
+func (melangeSBOMGenerator) Generate(pc *PackageContext) error {
+	licenses := []string{}
+	copyrights := []string{}
+	for _, c := range pc.Copyright {
+		if c.License != "" {
+			licenses = append(licenses, c.License)
+		}
+		if c.Attestation != "" {
+			copyrights = append(copyrights, strings.TrimSpace(c.Attestation))
+		}
+	}
+
+	licenseTexts, err := pc.licenseTexts()
+	if err != nil {
+		return err
+	}
+
+	spec := &sbom.Spec{
+		Path:               pc.WorkspaceSubdir(),
+		OutputDir:          filepath.Join(pc.WorkspaceSubdir(), apk.SBOMDir, pc.Identity()),
+		PackageName:        pc.PackageName,
+		PackageVersion:     fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+		Arch:               apko_types.Architecture(runtime.GOARCH).ToAPK(),
+		License:            strings.Join(licenses, " AND "),
+		Copyright:          strings.Join(copyrights, "\n"),
+		ExtractedLicenses:  licenseTexts,
+		Supplier:           pc.Origin.Supplier,
+		Originator:         pc.Origin.Originator,
+		CPEs:               pc.cpes(),
+		Sources:            pc.sbomSources(),
+		Deprecation:        pc.Deprecation.sbom(),
+		Provenance:         pc.Context.sbomProvenance(),
+		SourceDateEpoch:    pc.Context.SourceDateEpoch,
+		Formats:            pc.Context.SBOMFormats,
+		ChecksumAlgorithms: pc.Context.SBOMChecksums,
+		CheckNTIA:          pc.Context.SBOMCheckNTIA,
+		StrictNTIA:         pc.Context.SBOMStrict,
+		SkipSymlinks:       pc.Context.SBOMSkipSymlinks,
+		FileSteps:          pc.Context.stepTracker.packageSteps(pc.PackageName),
+	}
+
+	// the subpackages reference the SBOM of their origin package,
+	// which lists the sources it is built from.
+	isOrigin := pc.PackageName == pc.Origin.Name
+	if !isOrigin {
+		spec.Origin = pc.Context.originSBOM
+	}
+	spec.BuildEnvironment = pc.Context.buildEnvironmentSBOM
+
+	if pc.Context.SBOMAttestation {
+		signer, err := pc.Context.packageSigner()
+		if err != nil {
+			return err
+		}
+		spec.Signer = sbomSigner{signer}
+	}
+
+	if pc.Context.DependencyTrackURL != "" {
+		spec.Exporters = append(spec.Exporters, &sbom.DependencyTrack{
+			URL:    pc.Context.DependencyTrackURL,
+			APIKey: pc.Context.dependencyTrackAPIKey,
+			Client: pc.Context.httpClient,
+		})
+	}
+
+	if pc.Context.CacheDir != "" {
+		spec.ChecksumCache = filepath.Join(pc.Context.CacheDir, "sbom-checksums", pc.PackageName+".json")
+	}
+
+	if err := sbom.NewGenerator().Generate(spec); err != nil {
+		return err
+	}
+
+	if isOrigin {
+		if err := pc.recordOriginSBOM(spec.OutputDir, spec.Arch); err != nil {
+			return err
+		}
+	}
+
+	if pc.Context.ChecksumManifest {
+		return pc.exportSBOMs(spec.OutputDir, spec.Arch)
+	}
+
+	return nil
+}
+
+// recordOriginSBOM records the SPDX SBOM of the origin package, if it
+// has one, for the SBOMs of its subpackages to reference.
+func (pc *PackageContext) recordOriginSBOM(dir, arch string) error {
+	pc.Context.originSBOM = nil
+
+	data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("sbom-%s.spdx.json", arch)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read the SBOM of %s: %w", pc.PackageName, err)
+	}
+
+	ref, err := sbom.NewDocumentRef(pc.PackageName, data)
+	if err != nil {
+		return fmt.Errorf("unable to reference the SBOM of %s: %w", pc.PackageName, err)
+	}
+	pc.Context.originSBOM = ref
+	return nil
+}
+
+// cpes returns the CPE 2.3 names of a package, with the version of the
+// origin package.  When none are declared, the name is derived from the
+// origin package, also for subpackages, as the vulnerable files of a
+// project are often split into them.
+func (pc *PackageContext) cpes() []string {
+	if len(pc.CPE) == 0 {
+		return []string{sbom.DeriveCPE(pc.Origin.Name, pc.Origin.Version)}
+	}
+
+	cpes := []string{}
+	for _, cpe := range pc.CPE {
+		cpes = append(cpes, sbom.WithCPEVersion(cpe, pc.Origin.Version))
+	}
+	return cpes
+}
+
+// validateCPEs checks the CPE 2.3 names of a package.
+func validateCPEs(cpes []string) error {
+	for _, cpe := range cpes {
+		if err := sbom.ValidateCPE(cpe); err != nil {
+			return fmt.Errorf("cpe: %w", err)
+		}
+	}
+	return nil
+}
+
+// sbomSources returns the sources a package is built from, the ones of
+// its pipelines, and not the ones of the other packages of the
+// configuration, whose subpackages depend on the origin package instead.
+func (pc *PackageContext) sbomSources() []sbom.Source {
+	cfg := &pc.Context.Configuration
+	if pc.PackageName == pc.Origin.Name {
+		return pc.Context.sbomSources(cfg.Pipeline, nil)
+	}
+	for i := range cfg.Subpackages {
+		if cfg.Subpackages[i].Name == pc.PackageName {
+			return pc.Context.sbomSources(cfg.Subpackages[i].Pipeline, &cfg.Subpackages[i])
+		}
+	}
+	return []sbom.Source{}
+}
+
+// sbomSources returns the sources of pipelines: the tarballs of the
+// fetch pipelines, the local files and directories of the local-source
+// pipelines and the checkouts of the git-checkout pipelines, such as the
+// ones of overlay pipeline directories.
+func (ctx *Context) sbomSources(pipelines []Pipeline, sp *Subpackage) []sbom.Source {
+	pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package, Subpackage: sp}
+	sources := []sbom.Source{}
+	seen := map[sbom.Source]bool{}
+
+	var walk func(pipelines []Pipeline)
+	walk = func(pipelines []Pipeline) {
+		for _, p := range pipelines {
+			walk(p.Pipeline)
+
+			with := mutateWith(pctx, p.With)
+			var s sbom.Source
+			switch p.Uses {
+			case "fetch":
+				s = sbom.Source{URL: with["${{inputs.uri}}"], SHA256: with["${{inputs.expected-sha256}}"]}
+				// the source may have been fetched from a mirror.
+				for _, fetched := range ctx.fetchedSources {
+					if fetched.URI == s.URL {
+						s.URL = fetched.URL
+					}
+				}
+			case "local-source":
+				path := ctx.localSourcePath(with)
+				if path == "" {
+					continue
+				}
+				s = sbom.Source{URL: localSourceURL(path), SHA256: with["${{inputs.expected-sha256}}"]}
+			case "git-checkout":
+				s = sbom.Source{URL: with["${{inputs.repository}}"], Commit: with["${{inputs.expected-commit}}"]}
+			default:
+				continue
+			}
+
+			if s.URL == "" || seen[s] {
+				continue
+			}
+			seen[s] = true
+			sources = append(sources, s)
+		}
+	}
+
+	walk(pipelines)
+	return sources
+}
+
+// exportSBOMs writes the SBOMs of the package, along with their
+// signatures and attestations, next to the package in the output
+// directory as <package>-<version>-r<epoch>.<format>, so that they are
+// listed in the checksum manifest.
+func (pc *PackageContext) exportSBOMs(dir, arch string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("unable to export SBOMs: %w", err)
+	}
+
+	prefix := "sbom-" + arch + "."
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("unable to export SBOMs: %w", err)
+		}
+
+		if err := pc.exportArtifact(strings.TrimPrefix(e.Name(), prefix), data); err != nil {
+			return fmt.Errorf("unable to export SBOMs: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// digestEnvironment records the digest of the database of the packages
+// installed in the build environment, which identifies it.
+func (ctx *Context) digestEnvironment() error {
+	data, err := os.ReadFile(filepath.Join(ctx.GuestDir, apk.InstalledDatabase))
+	if err != nil {
+		return fmt.Errorf("unable to read the packages of the build environment: %w", err)
+	}
+
+	ctx.environmentDigest = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	return nil
+}
+
+// sbomProvenance describes how the packages are built in their SBOMs.
+func (ctx *Context) sbomProvenance() *sbom.Provenance {
+	return &sbom.Provenance{
+		ConfigDigest:     ctx.ConfigDigest,
+		Pipelines:        ctx.resolvedPipelines,
+		Builder:          "melange " + version.GetVersionInfo().GitVersion,
+		Runner:           ctx.Runner,
+		BuildEnvironment: ctx.environmentDigest,
+	}
+}
+
+// sbomSigner signs the SBOMs with the signing key of the packages, whose
+// signers only sign SHA1 digests with RSA PKCS#1 v1.5, like the
+// signatures of the packages.
+type sbomSigner struct {
+	signer sign.Signer
+}
+
+func (s sbomSigner) KeyID() string {
+	return s.signer.KeyName()
+}
+
+func (s sbomSigner) Sign(message []byte) ([]byte, error) {
+	digest := sha1.Sum(message)
+	return s.signer.SignSHA1Digest(digest[:])
+}
+
+// writeBuildEnvironmentSBOM writes the SPDX SBOM of the packages
+// installed in the build environment next to the packages, see
+// WithSBOMBuildEnvironment.
+func (ctx *Context) writeBuildEnvironmentSBOM() error {
+	f, err := os.Open(filepath.Join(ctx.GuestDir, apk.InstalledDatabase))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := apk.ParseIndex(f)
+	if err != nil {
+		return err
+	}
+	packages := []sbom.BuildPackage{}
+	for _, e := range entries {
+		packages = append(packages, sbom.BuildPackage{Name: e.Name(), Version: e.Version(), Arch: e.Get("A"), License: e.Get("L")})
+	}
+
+	created := ctx.SourceDateEpoch
+	if created.IsZero() {
+		created = time.Now()
+	}
+	pc := &PackageContext{Context: ctx, Origin: &ctx.Configuration.Package, PackageName: ctx.Configuration.Package.Name}
+	data, err := sbom.GenerateBuildEnvironment(pc.Identity()+"-build-environment", packages, created)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ctx.OutDir, 0755); err != nil {
+		return err
+	}
+	if err := pc.exportArtifact("build-environment.spdx.json", data); err != nil {
+		return err
+	}
+
+	ctx.buildEnvironmentSBOM, err = sbom.NewDocumentRef("build-environment", data)
+	return err
+}
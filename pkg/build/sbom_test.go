@@ -0,0 +1,165 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/sbom"
+	"gopkg.in/yaml.v3"
+)
+
+func TestSBOMSources(t *testing.T) {
+	config := `
+package:
+  name: hello
+  version: 1.2
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/hello-${{package.version}}.tar.gz
+      expected-sha256: 0123
+  - pipeline:
+      - uses: git-checkout
+        with:
+          repository: https://github.com/example/hello-extras.git
+          expected-commit: abcdef0
+  - runs: make
+subpackages:
+  - name: hello-doc
+    pipeline:
+      - uses: fetch
+        with:
+          uri: https://example.com/hello-doc-${{package.version}}.tar.gz
+          expected-sha256: 4567
+  - name: hello-dev
+`
+	ctx := &Context{}
+	if err := yaml.Unmarshal([]byte(config), &ctx.Configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sbom.Source{{
+		URL:    "https://example.com/hello-1.2.tar.gz",
+		SHA256: "0123",
+	}, {
+		URL:    "https://github.com/example/hello-extras.git",
+		Commit: "abcdef0",
+	}}
+	pc := &PackageContext{Context: ctx, Origin: &ctx.Configuration.Package, PackageName: "hello"}
+	if got := pc.sbomSources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sbomSources() = %+v, want %+v", got, want)
+	}
+
+	// the subpackages only list the sources of their own pipelines.
+	pc.PackageName = "hello-doc"
+	want = []sbom.Source{{URL: "https://example.com/hello-doc-1.2.tar.gz", SHA256: "4567"}}
+	if got := pc.sbomSources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sbomSources() of hello-doc = %+v, want %+v", got, want)
+	}
+	pc.PackageName = "hello-dev"
+	if got := pc.sbomSources(); len(got) != 0 {
+		t.Errorf("sbomSources() of hello-dev = %+v, want none", got)
+	}
+}
+
+func TestCPEs(t *testing.T) {
+	origin := &Package{Name: "hello", Version: "2.12"}
+	pc := &PackageContext{Origin: origin, PackageName: "hello-doc"}
+	if got, want := pc.cpes(), []string{"cpe:2.3:a:hello:hello:2.12:*:*:*:*:*:*:*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("derived cpes() = %q, want %q", got, want)
+	}
+
+	pc.CPE = []string{"cpe:2.3:a:gnu:hello:*:*:*:*:*:*:*:*", "cpe:2.3:a:gnu:hello:2.10:*:*:*:*:*:*:*"}
+	if got, want := pc.cpes(), []string{"cpe:2.3:a:gnu:hello:2.12:*:*:*:*:*:*:*", "cpe:2.3:a:gnu:hello:2.10:*:*:*:*:*:*:*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("declared cpes() = %q, want %q", got, want)
+	}
+
+	if err := validateCPEs(pc.CPE); err != nil {
+		t.Errorf("validateCPEs() = %v", err)
+	}
+	if err := validateCPEs([]string{"cpe:/a:gnu:hello"}); err == nil {
+		t.Errorf("validateCPEs() of a CPE 2.2 URI succeeded")
+	}
+}
+
+func TestWriteBuildEnvironmentSBOM(t *testing.T) {
+	ctx := &Context{GuestDir: t.TempDir(), OutDir: filepath.Join(t.TempDir(), "x86_64"), SourceDateEpoch: time.Unix(0, 0)}
+	ctx.Configuration.Package = Package{Name: "hello", Version: "2.12"}
+	writeFile(t, filepath.Join(ctx.GuestDir, apk.InstalledDatabase), `P:busybox
+V:1.36.1-r0
+A:x86_64
+L:GPL-2.0-only
+F:bin
+R:busybox
+
+P:make
+V:4.4.1-r0
+A:x86_64
+L:GPL-3.0-or-later
+`)
+
+	if err := ctx.writeBuildEnvironmentSBOM(); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "hello-2.12-r0.build-environment.spdx.json"
+	data, err := os.ReadFile(filepath.Join(ctx.OutDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ctx.artifacts, []string{name}) {
+		t.Errorf("artifacts = %q, want %q", ctx.artifacts, name)
+	}
+	if problems, err := sbom.ValidateSPDX(data); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() = %q, %v, want no problem", problems, err)
+	}
+	for _, purl := range []string{"pkg:apk/busybox@1.36.1-r0?arch=x86_64", "pkg:apk/make@4.4.1-r0?arch=x86_64"} {
+		if !strings.Contains(string(data), purl) {
+			t.Errorf("build environment SBOM does not list %s", purl)
+		}
+	}
+
+	ref := ctx.buildEnvironmentSBOM
+	if ref == nil || ref.ID != "build-environment" || ref.Element != sbom.BuildEnvironmentElement {
+		t.Errorf("build environment SBOM reference = %+v", ref)
+	}
+}
+
+func TestSBOMProvenance(t *testing.T) {
+	ctx := &Context{GuestDir: t.TempDir(), ConfigDigest: "sha256:c0ff", Runner: "bubblewrap"}
+	writeFile(t, filepath.Join(ctx.GuestDir, apk.InstalledDatabase), "P:busybox\nV:1.36.1-r0\n\n")
+
+	if err := ctx.digestEnvironment(); err != nil {
+		t.Fatal(err)
+	}
+	ctx.recordPipeline("fetch", []byte("pipeline: []\n"))
+	ctx.recordPipeline("autoconf/configure", []byte("pipeline: []\n"))
+	ctx.recordPipeline("fetch", []byte("pipeline: []\n"))
+
+	p := ctx.sbomProvenance()
+	if len(p.Pipelines) != 2 || !strings.HasPrefix(p.Pipelines[0], "fetch sha256:") || !strings.HasPrefix(p.Pipelines[1], "autoconf/configure sha256:") {
+		t.Errorf("pipelines = %q, want fetch and autoconf/configure once", p.Pipelines)
+	}
+	if p.ConfigDigest != "sha256:c0ff" || p.Runner != "bubblewrap" || !strings.HasPrefix(p.BuildEnvironment, "sha256:") || !strings.HasPrefix(p.Builder, "melange ") {
+		t.Errorf("provenance = %+v", p)
+	}
+}
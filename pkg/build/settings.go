@@ -0,0 +1,284 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/sbom"
+	"gopkg.in/yaml.v3"
+)
+
+// SettingsFileName is the name of the settings file shared by the
+// package configurations of a repository.
+const SettingsFileName = "melange.yaml"
+
+// Settings holds the defaults of the package configurations of a
+// repository, so that they are not repeated in every configuration and
+// on the command line.
+type Settings struct {
+	// Repositories and Keyring are added to the build environments,
+	// before the ones of the configurations.
+	Repositories []string `yaml:"repositories"`
+	Keyring      []string `yaml:"keyring"`
+	// Vars are substituted for ${{vars.<name>}} in the pipelines,
+	// unless the configuration sets the same variables.
+	Vars map[string]string `yaml:"vars"`
+	// Annotations are recorded in the packages, unless the
+	// configuration sets the same annotations.
+	Annotations map[string]string `yaml:"annotations"`
+	// Supplier is the supplier of the packages which do not set
+	// theirs, as "Organization: <name>".
+	Supplier string `yaml:"supplier"`
+	// Signing is used when no signing key or server is given on the
+	// command line.
+	Signing SigningSettings `yaml:"signing"`
+	// Digests are the digest algorithms recorded in the packages, for
+	// the apk versions of the repository, when none are given on the
+	// command line, see WithDigests.
+	Digests []string `yaml:"digests"`
+}
+
+// SigningSettings configures the signing of the packages, like the
+// --signing-* flags.
+type SigningSettings struct {
+	Key        string `yaml:"key"`
+	Server     string `yaml:"server"`
+	ClientCert string `yaml:"client-cert"`
+	ClientKey  string `yaml:"client-key"`
+	ServerCA   string `yaml:"server-ca"`
+	// KMS is the URL of a key management service key, see
+	// WithSigningKMS.
+	KMS string `yaml:"kms"`
+	// TimestampURL is the time-stamping authority of the signatures,
+	// see WithTimestampURL.
+	TimestampURL string `yaml:"timestamp-url"`
+}
+
+// findSettingsFile returns the settings file in the directory of the
+// configuration file or the closest of its parents, up to the root of
+// its git repository, or an empty string if there is none.
+func findSettingsFile(configFile string) (string, error) {
+	config, err := filepath.Abs(configFile)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(config)
+	for {
+		path := filepath.Join(dir, SettingsFileName)
+		if _, err := os.Stat(path); err == nil && path != config {
+			return path, nil
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return "", nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadSettings reads a settings file.  The relative paths of the
+// keyring and the signing files are relative to the settings file.
+func loadSettings(path string) (*Settings, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load settings file: %w", err)
+	}
+
+	settings := &Settings{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(settings); err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("unable to parse settings file %s: %w", path, err)
+	}
+
+	if err := validateAnnotations(settings.Annotations); err != nil {
+		return nil, nil, fmt.Errorf("settings file %s: %w", path, err)
+	}
+
+	if settings.Supplier != "" {
+		if err := sbom.ValidateAgent(settings.Supplier); err != nil {
+			return nil, nil, fmt.Errorf("settings file %s: %w", path, err)
+		}
+	}
+
+	if err := validateDigests(settings.Digests); err != nil {
+		return nil, nil, fmt.Errorf("settings file %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for i, key := range settings.Keyring {
+		if !strings.Contains(key, "://") {
+			settings.Keyring[i] = relativeTo(dir, key)
+		}
+	}
+	s := &settings.Signing
+	for _, p := range []*string{&s.Key, &s.ClientCert, &s.ClientKey, &s.ServerCA} {
+		*p = relativeTo(dir, *p)
+	}
+
+	return settings, data, nil
+}
+
+// relativeTo resolves a relative path against dir.
+func relativeTo(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// configureSettings loads the settings of the repository of the
+// configuration file, and signs with them unless signing was configured
+// on the command line.
+func (ctx *Context) configureSettings() error {
+	if ctx.SettingsFile == "" {
+		path, err := findSettingsFile(ctx.ConfigFile)
+		if err != nil {
+			return fmt.Errorf("unable to find settings file: %w", err)
+		}
+		if path == "" {
+			return nil
+		}
+		ctx.SettingsFile = path
+	}
+
+	settings, data, err := loadSettings(ctx.SettingsFile)
+	if err != nil {
+		return err
+	}
+	ctx.settings = settings
+	ctx.SettingsDigest = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+
+	if !ctx.signs() {
+		ctx.SigningKey = settings.Signing.Key
+		ctx.SigningServer = settings.Signing.Server
+		ctx.SigningKMS = settings.Signing.KMS
+		ctx.SigningClientCert = settings.Signing.ClientCert
+		ctx.SigningClientKey = settings.Signing.ClientKey
+		ctx.SigningServerCA = settings.Signing.ServerCA
+	}
+
+	if ctx.TimestampURL == "" {
+		ctx.TimestampURL = settings.Signing.TimestampURL
+	}
+
+	if len(ctx.Digests) == 0 {
+		ctx.Digests = settings.Digests
+	}
+
+	return nil
+}
+
+// applySettings adds the settings of the repository to the
+// configuration.
+func (cfg *Configuration) applySettings(settings *Settings) {
+	if settings == nil {
+		return
+	}
+
+	contents := &cfg.Environment.Contents
+	contents.Repositories = mergeLists(settings.Repositories, contents.Repositories)
+	contents.Keyring = mergeLists(settings.Keyring, contents.Keyring)
+	cfg.Vars = mergeMaps(settings.Vars, cfg.Vars)
+	cfg.Annotations = mergeMaps(settings.Annotations, cfg.Annotations)
+	if cfg.Package.Supplier == "" {
+		cfg.Package.Supplier = settings.Supplier
+	}
+}
+
+// mergeLists returns the defaults followed by the values which are not
+// among them.
+func mergeLists(defaults, values []string) []string {
+	merged := []string{}
+	seen := map[string]bool{}
+	for _, v := range append(append([]string{}, defaults...), values...) {
+		if !seen[v] {
+			seen[v] = true
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
+// mergeMaps returns the defaults overridden by the values.
+func mergeMaps(defaults, values map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return values
+	}
+
+	merged := map[string]string{}
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return merged
+}
+
+// validateAnnotations checks that the annotations can be recorded in the
+// .PKGINFO.
+func validateAnnotations(annotations map[string]string) error {
+	for k, v := range annotations {
+		if k == "" || strings.ContainsAny(k, ": \t\n") {
+			return fmt.Errorf("annotation %q must be a non-empty name without colons or whitespace", k)
+		}
+		if strings.Contains(v, "\n") {
+			return fmt.Errorf("annotation %s must be a single line", k)
+		}
+	}
+	return nil
+}
+
+// varReplacements returns the substitutions of the variables of the
+// configuration.
+func (cfg *Configuration) varReplacements() map[string]string {
+	nw := map[string]string{}
+	for k, v := range cfg.Vars {
+		nw[fmt.Sprintf("${{vars.%s}}", k)] = v
+	}
+	return nw
+}
+
+// SortedAnnotations returns the annotations of the configuration as
+// "key: value", sorted by key.
+func (cfg *Configuration) SortedAnnotations() []string {
+	keys := []string{}
+	for k := range cfg.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	annotations := []string{}
+	for _, k := range keys {
+		annotations = append(annotations, fmt.Sprintf("%s: %s", k, cfg.Annotations[k]))
+	}
+	return annotations
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindSettingsFile(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(repo, "packages", "hello", "hello.yaml")
+	writeFile(t, config, "package: {name: hello}\n")
+
+	// settings outside of the git repository are not used.
+	writeFile(t, filepath.Join(root, SettingsFileName), "vars: {}\n")
+	if path, err := findSettingsFile(config); err != nil || path != "" {
+		t.Errorf("findSettingsFile() = %q, %v, want none", path, err)
+	}
+
+	writeFile(t, filepath.Join(repo, SettingsFileName), "vars: {}\n")
+	if path, err := findSettingsFile(config); err != nil || path != filepath.Join(repo, SettingsFileName) {
+		t.Errorf("findSettingsFile() = %q, %v, want the settings of the repository", path, err)
+	}
+
+	// a configuration named like the settings file is not its own
+	// settings.
+	config = filepath.Join(repo, "packages", "world", SettingsFileName)
+	writeFile(t, config, "package: {name: world}\n")
+	if path, err := findSettingsFile(config); err != nil || path != filepath.Join(repo, SettingsFileName) {
+		t.Errorf("findSettingsFile() = %q, %v, want the settings of the repository", path, err)
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, SettingsFileName)
+	writeFile(t, path, `repositories:
+  - https://packages.example.com/os
+keyring:
+  - keys/example.rsa.pub
+  - https://packages.example.com/os/example.rsa.pub
+signing:
+  key: keys/example.rsa
+`)
+
+	settings, _, err := loadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(dir, "keys/example.rsa.pub"), "https://packages.example.com/os/example.rsa.pub"}
+	if !reflect.DeepEqual(settings.Keyring, want) {
+		t.Errorf("keyring = %q, want %q", settings.Keyring, want)
+	}
+	if want := filepath.Join(dir, "keys/example.rsa"); settings.Signing.Key != want {
+		t.Errorf("signing key = %q, want %q", settings.Signing.Key, want)
+	}
+
+	writeFile(t, path, "package:\n  name: hello\n")
+	if _, _, err := loadSettings(path); err == nil {
+		t.Error("loadSettings() accepted a package configuration")
+	}
+
+	writeFile(t, path, "annotations:\n  \"bad key\": value\n")
+	if _, _, err := loadSettings(path); err == nil {
+		t.Error("loadSettings() accepted an invalid annotation")
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	cfg := Configuration{
+		Vars:        map[string]string{"mirror": "https://mirror.example.com"},
+		Annotations: map[string]string{"team": "web"},
+	}
+	cfg.Environment.Contents.Repositories = []string{"https://extra.example.com", "https://packages.example.com/os"}
+
+	cfg.applySettings(&Settings{
+		Repositories: []string{"https://packages.example.com/os"},
+		Keyring:      []string{"/keys/example.rsa.pub"},
+		Vars:         map[string]string{"mirror": "https://default.example.com", "llvm": "15"},
+		Annotations:  map[string]string{"team": "platform", "org": "example"},
+	})
+
+	if want := []string{"https://packages.example.com/os", "https://extra.example.com"}; !reflect.DeepEqual(cfg.Environment.Contents.Repositories, want) {
+		t.Errorf("repositories = %q, want %q", cfg.Environment.Contents.Repositories, want)
+	}
+	if want := []string{"/keys/example.rsa.pub"}; !reflect.DeepEqual(cfg.Environment.Contents.Keyring, want) {
+		t.Errorf("keyring = %q, want %q", cfg.Environment.Contents.Keyring, want)
+	}
+	if want := map[string]string{"mirror": "https://mirror.example.com", "llvm": "15"}; !reflect.DeepEqual(cfg.Vars, want) {
+		t.Errorf("vars = %v, want %v", cfg.Vars, want)
+	}
+	if want := []string{"org: example", "team: web"}; !reflect.DeepEqual(cfg.SortedAnnotations(), want) {
+		t.Errorf("annotations = %q, want %q", cfg.SortedAnnotations(), want)
+	}
+
+	ctx := &PipelineContext{Context: &Context{Configuration: cfg}, Package: &Package{Name: "clang"}}
+	with := mutateWith(ctx, map[string]string{"version": "${{vars.llvm}}"})
+	if got := with["${{inputs.version}}"]; got != "15" {
+		t.Errorf("${{inputs.version}} = %q, want 15", got)
+	}
+
+	pc := PackageContext{Context: ctx.Context, Origin: &Package{Name: "clang"}, PackageName: "clang"}
+	var buf bytes.Buffer
+	if err := pc.GenerateControlData(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "# annotation org: example\n# annotation team: web\n") {
+		t.Errorf("annotations are not recorded in:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// SizeBudget is the expected size of a package, so that a package which
+// grows past it, usually because test data or debug symbols were
+// accidentally installed, fails the build or is warned about.
+type SizeBudget struct {
+	// InstalledSize is the budget of the size of the contents of the
+	// package, such as 12MiB.
+	InstalledSize string `yaml:"installed-size"`
+	// Size is the budget of the size of the .apk file.
+	Size string `yaml:"size"`
+	// Threshold is the percentage by which the sizes may exceed their
+	// budgets, 0 by default.
+	Threshold int `yaml:"threshold"`
+	// Level is "error", the default, to fail the build when a budget
+	// is exceeded, or "warn" to only log it.
+	Level string `yaml:"level"`
+}
+
+// sizeUnits are the suffixes of the sizes of the budgets, longest first.
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes, optionally with a binary unit such
+// as MiB.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSpace(s)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, must be a number of bytes, optionally followed by KiB, MiB or GiB", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func (b *SizeBudget) validate() error {
+	if b == nil {
+		return nil
+	}
+
+	if b.InstalledSize == "" && b.Size == "" {
+		return fmt.Errorf("size-budget: neither installed-size nor size is set")
+	}
+	for _, s := range []string{b.InstalledSize, b.Size} {
+		if s == "" {
+			continue
+		}
+		if _, err := parseSize(s); err != nil {
+			return fmt.Errorf("size-budget: %w", err)
+		}
+	}
+	if b.Threshold < 0 {
+		return fmt.Errorf("size-budget: threshold must not be negative")
+	}
+
+	switch b.Level {
+	case "", CheckLevelError, CheckLevelWarn:
+	default:
+		return fmt.Errorf("size-budget: level must be one of %s or %s", CheckLevelError, CheckLevelWarn)
+	}
+
+	return nil
+}
+
+// exceeded returns the sizes of a package which exceed their budgets by
+// more than the threshold, and logs every size against its budget.
+func (b *SizeBudget) exceeded(name string, installedSize, size int64) []string {
+	problems := []string{}
+	for _, s := range []struct {
+		what   string
+		budget string
+		size   int64
+	}{
+		{"installed size", b.InstalledSize, installedSize},
+		{"size", b.Size, size},
+	} {
+		if s.budget == "" {
+			continue
+		}
+		// the budgets were validated with the configuration.
+		budget, _ := parseSize(s.budget)
+		limit := budget + budget*int64(b.Threshold)/100
+
+		percent := 0.0
+		if budget > 0 {
+			percent = float64(s.size) * 100 / float64(budget)
+		}
+		log.Printf("  package %s %s: %d bytes, %.0f%% of the %s budget", name, s.what, s.size, percent, s.budget)
+
+		if s.size > limit {
+			problems = append(problems, fmt.Sprintf("%s of %d bytes exceeds the budget of %s by more than %d%%", s.what, s.size, s.budget, b.Threshold))
+		}
+	}
+	return problems
+}
+
+// checkSizeBudget checks the sizes of a package against its budget.
+func (pc *PackageContext) checkSizeBudget(size int64) error {
+	if pc.SizeBudget == nil {
+		return nil
+	}
+
+	problems := pc.SizeBudget.exceeded(pc.PackageName, pc.InstalledSize, size)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if pc.SizeBudget.Level == CheckLevelWarn {
+		for _, problem := range problems {
+			log.Printf("warning: package %s: %s", pc.PackageName, problem)
+		}
+		return nil
+	}
+	return fmt.Errorf("package %s: %s", pc.PackageName, strings.Join(problems, ", "))
+}
+
+// EnvironmentBudget is the expected size of the build environment of a
+// package, so that a build whose dependencies pull in a lot more than
+// before, such as a full toolchain through a new transitive dependency,
+// fails or is warned about.
+type EnvironmentBudget struct {
+	// Size is the budget of the total size of the files of the build
+	// environment, such as 2GiB.
+	Size string `yaml:"size"`
+	// Growth is the percentage by which the build environment may
+	// grow compared to the previous build of the package, recorded
+	// in the build history of the cache directory.  It is not
+	// checked when unset.
+	Growth int `yaml:"growth"`
+	// Level is "error", the default, to fail the build when the
+	// budget is exceeded, or "warn" to only log it.
+	Level string `yaml:"level"`
+}
+
+func (b *EnvironmentBudget) validate() error {
+	if b == nil {
+		return nil
+	}
+
+	if b.Size == "" && b.Growth == 0 {
+		return fmt.Errorf("environment-budget: neither size nor growth is set")
+	}
+	if b.Size != "" {
+		if _, err := parseSize(b.Size); err != nil {
+			return fmt.Errorf("environment-budget: %w", err)
+		}
+	}
+	if b.Growth < 0 {
+		return fmt.Errorf("environment-budget: growth must not be negative")
+	}
+
+	switch b.Level {
+	case "", CheckLevelError, CheckLevelWarn:
+	default:
+		return fmt.Errorf("environment-budget: level must be one of %s or %s", CheckLevelError, CheckLevelWarn)
+	}
+
+	return nil
+}
+
+// exceeded returns how a build environment of the given size exceeds
+// the budget, given the size of the environment of the previous build,
+// 0 when unknown.
+func (b *EnvironmentBudget) exceeded(size, previous int64) []string {
+	problems := []string{}
+
+	if b.Size != "" {
+		// the budget was validated with the configuration.
+		budget, _ := parseSize(b.Size)
+		if size > budget {
+			problems = append(problems, fmt.Sprintf("build environment of %d bytes exceeds the budget of %s", size, b.Size))
+		}
+	}
+
+	if b.Growth > 0 && previous > 0 {
+		limit := previous + previous*int64(b.Growth)/100
+		if size > limit {
+			problems = append(problems, fmt.Sprintf("build environment of %d bytes grew by more than %d%% from %d bytes in the previous build", size, b.Growth, previous))
+		}
+	}
+
+	return problems
+}
+
+// checkEnvironmentSize measures the build environment once it is
+// installed, and checks it against the environment budget of the
+// package.
+func (ctx *Context) checkEnvironmentSize() error {
+	size, err := dirSize(ctx.GuestDir)
+	if err != nil {
+		return fmt.Errorf("unable to measure the build environment: %w", err)
+	}
+	ctx.environmentSize = size
+
+	previous := int64(0)
+	if ctx.CacheDir != "" {
+		buildHistoryMu.Lock()
+		h, err := LoadBuildHistory(ctx.CacheDir)
+		buildHistoryMu.Unlock()
+		if err != nil {
+			log.Printf("warning: %v", err)
+		} else {
+			previous = h.EnvironmentSizes[ctx.Configuration.Package.Name]
+		}
+	}
+
+	if previous > 0 {
+		log.Printf("build environment: %d bytes, %d bytes in the previous build", size, previous)
+	} else {
+		log.Printf("build environment: %d bytes", size)
+	}
+
+	b := ctx.Configuration.Package.EnvironmentBudget
+	if b == nil {
+		return nil
+	}
+
+	problems := b.exceeded(size, previous)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if b.Level == CheckLevelWarn {
+		for _, problem := range problems {
+			log.Printf("warning: package %s: %s", ctx.Configuration.Package.Name, problem)
+		}
+		return nil
+	}
+	return fmt.Errorf("package %s: %s", ctx.Configuration.Package.Name, strings.Join(problems, ", "))
+}
+
+// EnvironmentSize returns the size of the build environment in bytes,
+// or 0 before it is installed.
+func (ctx *Context) EnvironmentSize() int64 {
+	return ctx.environmentSize
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"512":     512,
+		"12MiB":   12 << 20,
+		"1.5 KiB": 1536,
+		"2G":      2 << 30,
+		"100B":    100,
+	} {
+		got, err := parseSize(s)
+		if err != nil {
+			t.Errorf("parseSize(%q): %v", s, err)
+		} else if got != want {
+			t.Errorf("parseSize(%q) = %d, want %d", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"", "MiB", "-1", "12 TB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSizeBudget(t *testing.T) {
+	for _, b := range []*SizeBudget{
+		{},
+		{Size: "lots"},
+		{Size: "1MiB", Threshold: -5},
+		{Size: "1MiB", Level: "off"},
+	} {
+		if err := b.validate(); err == nil {
+			t.Errorf("validate() accepted %+v", b)
+		}
+	}
+
+	pc := &PackageContext{PackageName: "hello", InstalledSize: 1100, SizeBudget: &SizeBudget{InstalledSize: "1000", Size: "500", Threshold: 10}}
+	if err := pc.checkSizeBudget(400); err != nil {
+		t.Errorf("checkSizeBudget() = %v, want the sizes within the threshold", err)
+	}
+	if err := pc.checkSizeBudget(551); err == nil {
+		t.Error("checkSizeBudget() succeeded with a size over the threshold")
+	}
+
+	pc.SizeBudget.Level = CheckLevelWarn
+	if err := pc.checkSizeBudget(551); err != nil {
+		t.Errorf("checkSizeBudget() = %v, want a warning", err)
+	}
+
+	pc.SizeBudget = nil
+	if err := pc.checkSizeBudget(1 << 30); err != nil {
+		t.Errorf("checkSizeBudget() = %v without a budget", err)
+	}
+}
+
+func TestEnvironmentBudget(t *testing.T) {
+	for _, b := range []*EnvironmentBudget{
+		{},
+		{Size: "lots"},
+		{Size: "1GiB", Growth: -5},
+		{Growth: 10, Level: "off"},
+	} {
+		if err := b.validate(); err == nil {
+			t.Errorf("validate() accepted %+v", b)
+		}
+	}
+
+	b := &EnvironmentBudget{Size: "1000", Growth: 20}
+	if problems := b.exceeded(900, 800); len(problems) != 0 {
+		t.Errorf("exceeded() = %v, want the size within the budget", problems)
+	}
+	if problems := b.exceeded(1100, 0); len(problems) != 1 {
+		t.Errorf("exceeded() = %v, want the size over the budget", problems)
+	}
+	if problems := b.exceeded(900, 700); len(problems) != 1 {
+		t.Errorf("exceeded() = %v, want the growth over the threshold", problems)
+	}
+}
+
+func TestCheckEnvironmentSize(t *testing.T) {
+	guestDir := t.TempDir()
+	cacheDir := t.TempDir()
+	writeFile(t, filepath.Join(guestDir, "usr/bin/cc"), strings.Repeat("x", 1000))
+
+	h, err := LoadBuildHistory(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.EnvironmentSizes["hello"] = 500
+	if err := h.Save(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &Context{GuestDir: guestDir, CacheDir: cacheDir}
+	ctx.Configuration.Package.Name = "hello"
+	if err := ctx.checkEnvironmentSize(); err != nil {
+		t.Errorf("checkEnvironmentSize() = %v without a budget", err)
+	}
+	if got := ctx.EnvironmentSize(); got != 1000 {
+		t.Errorf("EnvironmentSize() = %d, want 1000", got)
+	}
+
+	ctx.Configuration.Package.EnvironmentBudget = &EnvironmentBudget{Growth: 50}
+	if err := ctx.checkEnvironmentSize(); err == nil {
+		t.Error("checkEnvironmentSize() succeeded with the environment twice as large as before")
+	}
+
+	ctx.Configuration.Package.EnvironmentBudget.Level = CheckLevelWarn
+	if err := ctx.checkEnvironmentSize(); err != nil {
+		t.Errorf("checkEnvironmentSize() = %v, want a warning", err)
+	}
+
+	if err := recordBuild(cacheDir, "hello", time.Minute, ctx.EnvironmentSize()); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Configuration.Package.EnvironmentBudget.Level = ""
+	if err := ctx.checkEnvironmentSize(); err != nil {
+		t.Errorf("checkEnvironmentSize() = %v after recording the build", err)
+	}
+}
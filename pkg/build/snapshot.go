@@ -0,0 +1,251 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/errcode"
+)
+
+// SnapshotTimeFormat is the format of the names of snapshot directories.
+const SnapshotTimeFormat = "20060102T150405Z"
+
+// SnapshotManifestFile is the name of the manifest in a snapshot directory.
+const SnapshotManifestFile = "manifest.json"
+
+// SnapshotManifest describes a snapshot of the repository indexes of a
+// build environment.
+type SnapshotManifest struct {
+	Timestamp    time.Time            `json:"timestamp"`
+	Repositories []SnapshotRepository `json:"repositories"`
+}
+
+// SnapshotRepository is the copy of the index of a repository for an
+// architecture.
+type SnapshotRepository struct {
+	// Repository is the repository as listed in the environment.
+	Repository string `json:"repository"`
+	Arch       string `json:"arch"`
+	// Index is the location of the copy of the APKINDEX, relative to the
+	// snapshot directory.
+	Index    string            `json:"index"`
+	Digest   string            `json:"digest"`
+	Packages []SnapshotPackage `json:"packages"`
+}
+
+// SnapshotPackage is a package of a repository index.  The checksum is
+// the one apk verifies the package against.
+type SnapshotPackage struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// SnapshotIndexes copies the indexes of the repositories of the build
+// environment into a new directory of outDir named after the time of the
+// snapshot, along with a manifest of their packages.  The files of a
+// snapshot are read-only and existing snapshots are never overwritten.
+// The indexes of the host architecture are copied if archs is empty.
+func (ctx *Context) SnapshotIndexes(outDir string, archs []string, now time.Time) (string, error) {
+	if len(archs) == 0 {
+		archs = []string{apko_types.Architecture(runtime.GOARCH).ToAPK()}
+	}
+
+	manifest := SnapshotManifest{Timestamp: now.UTC().Truncate(time.Second)}
+	indexes := map[string][]byte{}
+
+	for i, repo := range ctx.Configuration.Environment.Contents.Repositories {
+		for _, arch := range archs {
+			url := indexURL(repo, arch)
+
+			data, err := ctx.fetchIndex(url)
+			if err != nil {
+				return "", fmt.Errorf("unable to fetch repository index: %w", err)
+			}
+
+			entries, err := apk.ReadIndex(bytes.NewReader(data))
+			if err != nil {
+				return "", fmt.Errorf("unable to read %s: %w", url, err)
+			}
+
+			sr := SnapshotRepository{
+				Repository: repo,
+				Arch:       arch,
+				Index:      filepath.Join(strconv.Itoa(i), arch, "APKINDEX.tar.gz"),
+				Digest:     fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+				Packages:   []SnapshotPackage{},
+			}
+
+			for _, entry := range entries {
+				sr.Packages = append(sr.Packages, SnapshotPackage{
+					Name:     entry.Name(),
+					Version:  entry.Version(),
+					Checksum: entry.Checksum(),
+				})
+			}
+
+			manifest.Repositories = append(manifest.Repositories, sr)
+			indexes[sr.Index] = data
+		}
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create snapshot directory: %w", err)
+	}
+
+	dir := filepath.Join(outDir, manifest.Timestamp.Format(SnapshotTimeFormat))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create snapshot: %w", err)
+	}
+
+	for path, data := range indexes {
+		if err := writeReadOnly(filepath.Join(dir, path), data); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("unable to encode snapshot manifest: %w", err)
+	}
+
+	// the manifest is written last, so that snapshots which were not
+	// completed have none.
+	if err := writeReadOnly(filepath.Join(dir, SnapshotManifestFile), append(data, '\n')); err != nil {
+		return "", err
+	}
+
+	log.Printf("wrote snapshot of %d repository indexes to %s", len(manifest.Repositories), dir)
+
+	return dir, nil
+}
+
+// LoadSnapshot reads the manifest of a snapshot, given the path of the
+// snapshot directory or of its manifest.  It returns the manifest and the
+// snapshot directory.
+func LoadSnapshot(path string) (*SnapshotManifest, string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to find snapshot: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if fi.IsDir() {
+		dir = path
+		path = filepath.Join(path, SnapshotManifestFile)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read snapshot manifest: %w", err)
+	}
+
+	manifest := &SnapshotManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, "", fmt.Errorf("unable to parse snapshot manifest %s: %w", path, err)
+	}
+
+	return manifest, dir, nil
+}
+
+// snapshotPath returns the location of the repository snapshot of the
+// build: the snapshot of the snapshot directory with that timestamp, or a
+// path otherwise.
+func (ctx *Context) snapshotPath() string {
+	if _, err := time.Parse(SnapshotTimeFormat, ctx.RepositorySnapshot); err == nil {
+		return filepath.Join(ctx.SnapshotDir, ctx.RepositorySnapshot)
+	}
+
+	return ctx.RepositorySnapshot
+}
+
+// snapshotIndexes reads the indexes of the repositories of the build
+// environment from the repository snapshot, keyed by APKINDEX location
+// like fetchIndexes.  Every remote repository of the environment must be
+// in the snapshot.  Local repositories are used as they are.
+func (ctx *Context) snapshotIndexes() (map[string][]byte, error) {
+	manifest, dir, err := LoadSnapshot(ctx.snapshotPath())
+	if err != nil {
+		return nil, err
+	}
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+
+	indexes := map[string][]byte{}
+	for _, repo := range ctx.Configuration.Environment.Contents.Repositories {
+		url := indexURL(repo, arch)
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+
+		var sr *SnapshotRepository
+		for i := range manifest.Repositories {
+			if manifest.Repositories[i].Repository == repo && manifest.Repositories[i].Arch == arch {
+				sr = &manifest.Repositories[i]
+				break
+			}
+		}
+		if sr == nil {
+			return nil, fmt.Errorf("the %s index of %s is not in snapshot %s", arch, repo, dir)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, sr.Index))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read snapshot index: %w", err)
+		}
+
+		if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); digest != sr.Digest {
+			return nil, errcode.Wrap(errcode.FetchIntegrity, fmt.Errorf("snapshot index %s has digest %s, but the manifest records %s", sr.Index, digest, sr.Digest), "snapshot", dir)
+		}
+
+		indexes[url] = data
+	}
+
+	log.Printf("resolving the build environment from the snapshot of %s", manifest.Timestamp.Format(time.RFC3339))
+
+	return indexes, nil
+}
+
+// writeReadOnly writes a new read-only file.
+func writeReadOnly(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create %s: %w", filepath.Dir(path), err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", path, err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write %s: %w", path, err)
+	}
+
+	return f.Close()
+}
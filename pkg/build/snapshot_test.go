@@ -0,0 +1,215 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+// indexArchive returns an APKINDEX.tar.gz containing index.
+func indexArchive(t *testing.T, index string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "APKINDEX",
+		Mode:     0644,
+		Size:     int64(len(index)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(index)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestSnapshotIndexes(t *testing.T) {
+	index := indexArchive(t, "C:Q1abcd=\nP:foo\nV:1.0-r0\n\nC:Q1efgh=\nP:bar\nV:2.0-r1\n")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/main/x86_64/APKINDEX.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(index) // nolint:errcheck
+	}))
+	defer upstream.Close()
+
+	ctx := &Context{}
+	ctx.Configuration.Environment.Contents.Repositories = []string{upstream.URL + "/main"}
+
+	outDir := t.TempDir()
+	now := time.Date(2022, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	dir, err := ctx.SnapshotIndexes(outDir, []string{"x86_64"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := filepath.Join(outDir, "20220601T123000Z"); dir != want {
+		t.Errorf("SnapshotIndexes() = %s, want %s", dir, want)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, SnapshotManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest SnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Repositories) != 1 {
+		t.Fatalf("manifest has %d repositories, want 1", len(manifest.Repositories))
+	}
+
+	repo := manifest.Repositories[0]
+	wantPackages := []SnapshotPackage{
+		{Name: "foo", Version: "1.0-r0", Checksum: "Q1abcd="},
+		{Name: "bar", Version: "2.0-r1", Checksum: "Q1efgh="},
+	}
+	if !reflect.DeepEqual(repo.Packages, wantPackages) {
+		t.Errorf("packages = %v, want %v", repo.Packages, wantPackages)
+	}
+
+	copied, err := os.ReadFile(filepath.Join(dir, repo.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied, index) {
+		t.Error("the snapshot index differs from the repository index")
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, repo.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0444 {
+		t.Errorf("index mode = %v, want read-only", fi.Mode().Perm())
+	}
+
+	if _, err := ctx.SnapshotIndexes(outDir, []string{"x86_64"}, now); err == nil {
+		t.Error("SnapshotIndexes() overwrote an existing snapshot")
+	}
+}
+
+func TestSnapshotIndexesResolve(t *testing.T) {
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	index := indexArchive(t, "C:Q1abcd=\nP:foo\nV:1.0-r0\n")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(index) // nolint:errcheck
+	}))
+	defer upstream.Close()
+
+	repo := upstream.URL + "/main"
+	recorder := &Context{}
+	recorder.Configuration.Environment.Contents.Repositories = []string{repo}
+
+	outDir := t.TempDir()
+	dir, err := recorder.SnapshotIndexes(outDir, nil, time.Date(2022, 6, 1, 12, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		snapshot     string
+		repositories []string
+		wantErr      bool
+	}{{
+		name:         "timestamp",
+		snapshot:     "20220601T123000Z",
+		repositories: []string{repo, "/srv/local"},
+	}, {
+		name:         "directory",
+		snapshot:     dir,
+		repositories: []string{repo},
+	}, {
+		name:         "manifest",
+		snapshot:     filepath.Join(dir, SnapshotManifestFile),
+		repositories: []string{repo},
+	}, {
+		name:         "unknown timestamp",
+		snapshot:     "20220101T000000Z",
+		repositories: []string{repo},
+		wantErr:      true,
+	}, {
+		name:         "repository not in the snapshot",
+		snapshot:     dir,
+		repositories: []string{upstream.URL + "/community"},
+		wantErr:      true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &Context{RepositorySnapshot: tt.snapshot, SnapshotDir: outDir}
+			ctx.Configuration.Environment.Contents.Repositories = tt.repositories
+
+			indexes, err := ctx.snapshotIndexes()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("snapshotIndexes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(indexes) != 1 || !bytes.Equal(indexes[indexURL(repo, arch)], index) {
+				t.Errorf("snapshotIndexes() = %v, want the recorded index of %s", indexes, repo)
+			}
+		})
+	}
+
+	// a snapshot index which was modified is refused.
+	path := filepath.Join(dir, "0", arch, "APKINDEX.tar.gz")
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &Context{RepositorySnapshot: dir}
+	ctx.Configuration.Environment.Contents.Repositories = []string{repo}
+	if _, err := ctx.snapshotIndexes(); err == nil {
+		t.Error("snapshotIndexes() accepted a modified index")
+	}
+}
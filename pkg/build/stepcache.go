@@ -0,0 +1,522 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stepCacheState is the file of a step cache entry which records the
+// state of the build after the cached steps, besides the workspace.
+const stepCacheState = "state.json"
+
+// stepCache restores the workspace after the steps of the main pipeline
+// from the cache directory, instead of running them again, when neither
+// the steps nor their inputs changed since a previous build.  It lets the
+// packaging of a package be iterated on without building it again.  The
+// entries missing from the cache directory are restored from the remote
+// cache, if any, and the entries stored are shared through it when it is
+// writable.
+//
+// The entry of a step is keyed on the build environment, the identity of
+// the package, the variables and environment of the pipelines, the files
+// of the workspace at the start of the main pipeline, and the definitions
+// of the step and of all the steps before it, including the pipelines
+// they use.  The rest of the configuration, such as the subpackages and
+// the dependencies of the packages, is not part of the key.  An entry
+// holds the files of the workspace created or modified since the start of
+// the main pipeline, with their modification times so that incremental
+// build systems do not run again, and the files deleted since then.
+//
+// The files of the workspace are identified by their paths, modes, sizes
+// and modification times, but not their inodes, so that a copy of the
+// workspace keeping the modification times uses the same entries.  The
+// steps are expected to only change the workspace.  Nested builds are not
+// cached, nor the steps after them.
+type stepCache struct {
+	root      string
+	workspace string
+	// exclude are the directories of the workspace which are not
+	// cached, such as the cache directory.
+	exclude map[string]bool
+	// keys are the keys of the entries of the steps, by position.
+	keys []string
+	// initial are the files of the workspace at the start of the main
+	// pipeline, keyed by their slash path relative to it.
+	initial map[string]workspaceFile
+	// stored are the files of the workspace when last stored or
+	// restored, which are linked from last rather than copied when
+	// unchanged.
+	stored map[string]workspaceFile
+	last   string
+	// lock keeps last from being evicted, see useCache.
+	lock *os.File
+}
+
+// workspaceFile identifies a file, directory or symbolic link of the
+// workspace without reading it.
+type workspaceFile struct {
+	mode  fs.FileMode
+	stamp fileStamp
+}
+
+// stepCacheEntry is the state of the build recorded with the workspace.
+type stepCacheEntry struct {
+	Deleted           []string          `json:"deleted,omitempty"`
+	FetchedSources    []fetchedSource   `json:"fetched_sources,omitempty"`
+	ResolvedPipelines []string          `json:"resolved_pipelines,omitempty"`
+	Steps             map[string]string `json:"steps,omitempty"`
+}
+
+func (ctx *Context) stepCacheRoot() string {
+	return filepath.Join(ctx.CacheDir, "steps")
+}
+
+// openStepCache returns the step cache of the main pipeline, or nil if it
+// is disabled.  It is opened before the main pipeline runs.
+func (ctx *Context) openStepCache() (*stepCache, error) {
+	if ctx.CacheDir == "" || ctx.StepCacheSize <= 0 {
+		return nil, nil
+	}
+
+	workspace, err := filepath.Abs(ctx.WorkspaceDir)
+	if err != nil {
+		return nil, err
+	}
+	c := &stepCache{
+		root:      ctx.stepCacheRoot(),
+		workspace: workspace,
+		exclude:   map[string]bool{},
+	}
+	for _, dir := range []string{ctx.CacheDir, ctx.OutDir, ctx.GuestDir} {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if abs != workspace {
+			c.exclude[abs] = true
+		}
+	}
+
+	if err := os.MkdirAll(c.root, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create the step cache: %w", err)
+	}
+
+	c.initial, err = c.scan()
+	if err != nil {
+		return nil, err
+	}
+	c.stored = c.initial
+
+	c.keys, err = ctx.stepCacheKeys(c.initial)
+	if err != nil {
+		log.Printf("warning: unable to use the step cache: %v", err)
+		return nil, nil
+	}
+	if len(c.keys) == 0 {
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+// stepCacheKeys returns the keys of the entries of the steps of the main
+// pipeline, up to the first nested build, starting from the files of the
+// workspace initial.
+func (ctx *Context) stepCacheKeys(initial map[string]workspaceFile) ([]string, error) {
+	cfg := &ctx.Configuration
+	h := sha256.New()
+
+	fmt.Fprintf(h, "build environment %s\n", ctx.environmentDigest)
+	fmt.Fprintf(h, "package %s %s %d\n", cfg.Package.Name, cfg.Package.Version, cfg.Package.Epoch)
+	fmt.Fprintf(h, "arch %s\n", runtime.GOARCH)
+	fmt.Fprintf(h, "runner %s\n", ctx.Runner)
+	fmt.Fprintf(h, "source date epoch %d\n", ctx.SourceDateEpoch.Unix())
+	fmt.Fprintf(h, "locale %s\ntimezone %s\n", ctx.locale(), ctx.timezone())
+	faketime, err := ctx.faketimeEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range append(faketime, ctx.PassedEnvironment()...) {
+		fmt.Fprintf(h, "env %s\n", env)
+	}
+	vars, err := yaml.Marshal(cfg.Vars)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(vars)
+
+	paths := make([]string, 0, len(initial))
+	for rel := range initial {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		f := initial[rel]
+		fmt.Fprintf(h, "file %q %o %d %d\n", rel, uint32(f.mode), f.stamp.size, f.stamp.mtime)
+	}
+
+	keys := []string{}
+	for i := range cfg.Pipeline {
+		cacheable, err := ctx.hashStep(h, &cfg.Pipeline[i])
+		if err != nil {
+			return nil, err
+		}
+		if !cacheable {
+			break
+		}
+		keys = append(keys, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	return keys, nil
+}
+
+// hashStep writes the definition of a step, and of the pipelines it uses,
+// to h.  It returns false for a step which cannot be cached.
+func (ctx *Context) hashStep(h hash.Hash, p *Pipeline) (bool, error) {
+	if p.Build != nil {
+		return false, nil
+	}
+
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(h, "step %d\n", len(data))
+	h.Write(data)
+
+	if p.Uses != "" {
+		data, err := readPipeline(ctx, p.Uses)
+		if err != nil {
+			return false, fmt.Errorf("unable to load pipeline %s: %w", p.Uses, err)
+		}
+		fmt.Fprintf(h, "uses %s %d\n", p.Uses, len(data))
+		h.Write(data)
+
+		used := Pipeline{}
+		if err := yaml.Unmarshal(data, &used); err != nil {
+			return false, fmt.Errorf("unable to parse pipeline %s: %w", p.Uses, err)
+		}
+		if cacheable, err := ctx.hashStep(h, &used); !cacheable || err != nil {
+			return false, err
+		}
+	}
+
+	for i := range p.Pipeline {
+		if cacheable, err := ctx.hashStep(h, &p.Pipeline[i]); !cacheable || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// scan returns the files, directories and symbolic links of the
+// workspace, keyed by their slash path relative to it.
+func (c *stepCache) scan() (map[string]workspaceFile, error) {
+	files := map[string]workspaceFile{}
+	err := filepath.WalkDir(c.workspace, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == c.workspace {
+			return nil
+		}
+		if d.IsDir() && c.exclude[path] {
+			return filepath.SkipDir
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() && fi.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(c.workspace, path)
+		if err != nil {
+			return err
+		}
+
+		f := workspaceFile{mode: fi.Mode()}
+		if !fi.IsDir() {
+			f.stamp = stampFile(fi)
+		}
+		files[filepath.ToSlash(rel)] = f
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan the workspace: %w", err)
+	}
+	return files, nil
+}
+
+// restore restores the workspace and the state of the build after the
+// longest cached prefix of the steps, and returns the number of steps
+// restored.
+func (c *stepCache) restore(ctx *Context) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+
+	for n := len(c.keys); n > 0; n-- {
+		entry := filepath.Join(c.root, c.keys[n-1])
+		if _, err := os.Stat(entry); err != nil && !ctx.restoreStepEntry(c.keys[n-1], entry) {
+			continue
+		}
+
+		lock, err := useCache(entry)
+		if err != nil {
+			log.Printf("warning: unable to use the step cache %s: %v", entry, err)
+			continue
+		}
+		state := stepCacheEntry{}
+		data, err := os.ReadFile(filepath.Join(entry, stepCacheState))
+		if err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+		if err != nil {
+			lock.Close()
+			log.Printf("warning: unable to use the step cache %s: %v", entry, err)
+			continue
+		}
+
+		if err := c.restoreEntry(entry, &state); err != nil {
+			lock.Close()
+			return 0, fmt.Errorf("unable to restore the step cache %s: %w", entry, err)
+		}
+
+		ctx.fetchedSources = append(ctx.fetchedSources, state.FetchedSources...)
+		for _, p := range state.ResolvedPipelines {
+			if !containsString(ctx.resolvedPipelines, p) {
+				ctx.resolvedPipelines = append(ctx.resolvedPipelines, p)
+			}
+		}
+		if err := ctx.stepTracker.restore(state.Steps); err != nil {
+			lock.Close()
+			return 0, err
+		}
+
+		c.stored, err = c.scan()
+		if err != nil {
+			lock.Close()
+			return 0, err
+		}
+		c.use(entry, lock)
+		return n, nil
+	}
+
+	return 0, nil
+}
+
+// restoreEntry copies the files of an entry over the workspace, and
+// deletes the files deleted by its steps.
+func (c *stepCache) restoreEntry(entry string, state *stepCacheEntry) error {
+	files := filepath.Join(entry, "files")
+	err := filepath.Walk(files, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(files, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(c.workspace, rel)
+
+		if existing, err := os.Lstat(target); err == nil && !(existing.IsDir() && fi.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFileTimes(path, target, fi)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range state.Deleted {
+		if err := os.RemoveAll(filepath.Join(c.workspace, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store stores the workspace and the state of the build after the step
+// at position i.  Entries which already exist are kept.
+func (c *stepCache) store(ctx *Context, i int) error {
+	if c == nil || i >= len(c.keys) {
+		return nil
+	}
+
+	current, err := c.scan()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(ctx.CacheDir, ".steps-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	state := stepCacheEntry{
+		FetchedSources:    ctx.fetchedSources,
+		ResolvedPipelines: ctx.resolvedPipelines,
+	}
+	if ctx.stepTracker != nil {
+		state.Steps = ctx.stepTracker.steps
+	}
+
+	paths := make([]string, 0, len(current))
+	for rel := range current {
+		paths = append(paths, rel)
+	}
+	// directories sort before the files they hold.
+	sort.Strings(paths)
+
+	files := filepath.Join(tmp, "files")
+	if err := os.Mkdir(files, 0755); err != nil {
+		return err
+	}
+	for _, rel := range paths {
+		f := current[rel]
+		if old, ok := c.initial[rel]; ok && old.mode.Type() == f.mode.Type() && (f.mode.IsDir() || old == f) {
+			continue
+		}
+
+		src := filepath.Join(c.workspace, filepath.FromSlash(rel))
+		dst := filepath.Join(files, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		switch {
+		case f.mode.IsDir():
+			err = os.MkdirAll(dst, f.mode.Perm()|0700)
+		case f.mode&fs.ModeSymlink != 0:
+			var link string
+			link, err = os.Readlink(src)
+			if err == nil {
+				err = os.Symlink(link, dst)
+			}
+		default:
+			// the files unchanged since the previous entry are
+			// shared with it.
+			if c.last != "" && c.stored[rel] == f {
+				if os.Link(filepath.Join(c.last, "files", filepath.FromSlash(rel)), dst) == nil {
+					continue
+				}
+			}
+			var fi fs.FileInfo
+			fi, err = os.Lstat(src)
+			if err == nil {
+				err = copyFileTimes(src, dst, fi)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for rel := range c.initial {
+		if _, ok := current[rel]; !ok {
+			state.Deleted = append(state.Deleted, rel)
+		}
+	}
+	sort.Strings(state.Deleted)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, stepCacheState), data, 0644); err != nil {
+		return err
+	}
+
+	entry := filepath.Join(c.root, c.keys[i])
+	if err := os.Rename(tmp, entry); err != nil {
+		if _, serr := os.Stat(entry); serr != nil {
+			return err
+		}
+	}
+
+	lock, err := useCache(entry)
+	if err != nil {
+		return err
+	}
+	c.stored = current
+	c.use(entry, lock)
+
+	ctx.storeStepEntry(c.keys[i], entry)
+	return nil
+}
+
+// use makes entry the last entry stored or restored.
+func (c *stepCache) use(entry string, lock *os.File) {
+	if c.lock != nil {
+		c.lock.Close()
+	}
+	c.last = entry
+	c.lock = lock
+}
+
+// closeStepCache releases the step cache, and evicts the least recently used
+// entries beyond the size of the cache.
+func (ctx *Context) closeStepCache(c *stepCache) {
+	if c == nil {
+		return
+	}
+	if c.lock != nil {
+		c.lock.Close()
+	}
+
+	if err := evictCaches(c.root, ctx.StepCacheSize); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("warning: unable to evict the step cache: %v", err)
+	}
+}
+
+// copyFileTimes copies a regular file, keeping its modification time.
+func copyFileTimes(src, dst string, fi fs.FileInfo) error {
+	if err := copyRegularFile(src, dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
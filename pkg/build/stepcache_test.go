@@ -0,0 +1,328 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func stepCacheContext(t *testing.T, cacheDir string, steps ...string) *Context {
+	ctx := &Context{
+		WorkspaceDir:      t.TempDir(),
+		CacheDir:          cacheDir,
+		StepCacheSize:     1 << 30,
+		environmentDigest: "sha256:1234",
+	}
+	ctx.Configuration.Package.Name = "hello"
+	ctx.Configuration.Package.Version = "1.0"
+	for _, runs := range steps {
+		ctx.Configuration.Pipeline = append(ctx.Configuration.Pipeline, Pipeline{Runs: runs})
+	}
+	return ctx
+}
+
+func TestStepCacheKeys(t *testing.T) {
+	ctx := stepCacheContext(t, t.TempDir(), "make", "make install")
+	mtime := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	initial := map[string]workspaceFile{
+		"src":         {mode: fs.ModeDir | 0755},
+		"src/hello.c": {mode: 0644, stamp: fileStamp{size: 14, mtime: mtime.UnixNano(), inode: 1}},
+	}
+	keys, err := ctx.stepCacheKeys(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] == keys[1] {
+		t.Fatalf("stepCacheKeys() = %q, want two keys", keys)
+	}
+
+	// the packaging is not part of the keys.
+	ctx.Configuration.Package.Description = "hello world"
+	ctx.Configuration.Subpackages = []Subpackage{{Name: "hello-doc"}}
+	if again, err := ctx.stepCacheKeys(initial); err != nil || !reflect.DeepEqual(again, keys) {
+		t.Errorf("stepCacheKeys() after packaging changes = %q, %v, want %q", again, err, keys)
+	}
+
+	ctx.Configuration.Pipeline[1].Runs = "make install DESTDIR=/home/build/melange-out/hello"
+	changed, err := ctx.stepCacheKeys(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed[0] != keys[0] || changed[1] == keys[1] {
+		t.Errorf("stepCacheKeys() after changing step 2 = %q, was %q", changed, keys)
+	}
+
+	// the inodes of the files of the workspace are not part of the keys,
+	// their other attributes are.
+	initial["src/hello.c"] = workspaceFile{mode: 0644, stamp: fileStamp{size: 14, mtime: mtime.UnixNano(), inode: 2}}
+	if again, err := ctx.stepCacheKeys(initial); err != nil || !reflect.DeepEqual(again, changed) {
+		t.Errorf("stepCacheKeys() of a copy of the workspace = %q, %v, want %q", again, err, changed)
+	}
+	initial["src/hello.c"] = workspaceFile{mode: 0644, stamp: fileStamp{size: 14, mtime: mtime.Add(time.Second).UnixNano(), inode: 2}}
+	if edited, err := ctx.stepCacheKeys(initial); err != nil || edited[0] == changed[0] || edited[1] == changed[1] {
+		t.Errorf("stepCacheKeys() after editing the workspace = %q, %v, was %q", edited, err, changed)
+	}
+
+	ctx.environmentDigest = "sha256:5678"
+	if changed, err := ctx.stepCacheKeys(initial); err != nil || changed[0] == keys[0] {
+		t.Errorf("stepCacheKeys() after changing the build environment = %q, %v, was %q", changed, err, keys)
+	}
+
+	// nested builds and the steps after them are not cached.
+	ctx.Configuration.Pipeline = append([]Pipeline{ctx.Configuration.Pipeline[0], {Build: &NestedBuild{}}}, ctx.Configuration.Pipeline[1:]...)
+	if nested, err := ctx.stepCacheKeys(initial); err != nil || len(nested) != 1 {
+		t.Errorf("stepCacheKeys() with a nested build = %q, %v, want one key", nested, err)
+	}
+}
+
+func TestStepCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	mtime := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// populate prepares a workspace as checked out.
+	populate := func(ctx *Context) {
+		for name, content := range map[string]string{"src/hello.c": "int main() {}\n", "stale.o": "stale\n"} {
+			path := filepath.Join(ctx.WorkspaceDir, name)
+			writeFile(t, path, content)
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var err error
+		ctx.stepTracker, err = newStepTracker(filepath.Join(ctx.WorkspaceDir, "melange-out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := stepCacheContext(t, cacheDir, "make", "make install")
+	populate(ctx)
+	c, err := ctx.openStepCache()
+	if err != nil || c == nil {
+		t.Fatalf("openStepCache() = %v, %v", c, err)
+	}
+	if n, err := c.restore(ctx); err != nil || n != 0 {
+		t.Fatalf("restore() of an empty cache = %d, %v", n, err)
+	}
+
+	// step 1 builds and cleans up.
+	writeFile(t, filepath.Join(ctx.WorkspaceDir, "hello.o"), "object\n")
+	if err := os.Chtimes(filepath.Join(ctx.WorkspaceDir, "hello.o"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(ctx.WorkspaceDir, "stale.o")); err != nil {
+		t.Fatal(err)
+	}
+	ctx.fetchedSources = []fetchedSource{{URI: "https://example.com/hello.tar.gz", URL: "https://example.com/hello.tar.gz", SHA256: "abcd"}}
+	if err := ctx.stepTracker.record("step 1 (make)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.store(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// step 2 installs.
+	writeFile(t, filepath.Join(ctx.WorkspaceDir, "melange-out/hello/usr/bin/hello"), "binary\n")
+	if err := ctx.stepTracker.record("step 2 (make install)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.store(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx.closeStepCache(c)
+
+	// the files unchanged since step 1 are shared by the entries.
+	var inodes []uint64
+	for _, key := range c.keys {
+		fi, err := os.Stat(filepath.Join(c.root, key, "files", "hello.o"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inodes = append(inodes, fi.Sys().(*syscall.Stat_t).Ino)
+	}
+	if inodes[0] != inodes[1] {
+		t.Errorf("hello.o is copied into every entry, inodes %d", inodes)
+	}
+
+	// a later build restores both steps into a new checkout.
+	ctx = stepCacheContext(t, cacheDir, "make", "make install")
+	populate(ctx)
+	c, err = ctx.openStepCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.restore(ctx); err != nil || n != 2 {
+		t.Fatalf("restore() = %d, %v, want 2 steps", n, err)
+	}
+	ctx.closeStepCache(c)
+
+	fi, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "hello.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("restored hello.o modified at %s, want %s", fi.ModTime(), mtime)
+	}
+	if _, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "stale.o")); !os.IsNotExist(err) {
+		t.Errorf("stale.o deleted by step 1 was not deleted: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "melange-out/hello/usr/bin/hello")); err != nil || string(data) != "binary\n" {
+		t.Errorf("restored usr/bin/hello = %q, %v", data, err)
+	}
+	if len(ctx.fetchedSources) != 1 || ctx.fetchedSources[0].SHA256 != "abcd" {
+		t.Errorf("restored fetched sources = %+v", ctx.fetchedSources)
+	}
+	if steps := ctx.stepTracker.packageSteps("hello"); steps["usr/bin/hello"] != "step 2 (make install)" {
+		t.Errorf("restored steps = %q", steps)
+	}
+
+	// changing step 2 only restores step 1.
+	ctx = stepCacheContext(t, cacheDir, "make", "make install-strip")
+	populate(ctx)
+	c, err = ctx.openStepCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.restore(ctx); err != nil || n != 1 {
+		t.Fatalf("restore() after changing step 2 = %d, %v, want 1 step", n, err)
+	}
+	ctx.closeStepCache(c)
+	if _, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "melange-out/hello/usr/bin/hello")); !os.IsNotExist(err) {
+		t.Errorf("the outputs of step 2 were restored: %v", err)
+	}
+
+	// a checkout of other sources restores nothing.
+	ctx = stepCacheContext(t, cacheDir, "make", "make install")
+	populate(ctx)
+	writeFile(t, filepath.Join(ctx.WorkspaceDir, "src/hello.c"), "int main() { return 1; }\n")
+	c, err = ctx.openStepCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.restore(ctx); err != nil || n != 0 {
+		t.Fatalf("restore() after editing the sources = %d, %v, want no step", n, err)
+	}
+	ctx.closeStepCache(c)
+	if _, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "hello.o")); !os.IsNotExist(err) {
+		t.Errorf("the outputs of step 1 were restored over other sources: %v", err)
+	}
+}
+
+func TestStepCacheRemote(t *testing.T) {
+	remote := t.TempDir()
+	mtime := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// open opens the step cache of a build with its own cache directory
+	// in a workspace as checked out.
+	open := func(mode string, steps ...string) (*Context, *stepCache) {
+		t.Helper()
+		ctx := stepCacheContext(t, t.TempDir(), steps...)
+		ctx.RemoteCache = "file://" + remote
+		ctx.RemoteCacheMode = mode
+		path := filepath.Join(ctx.WorkspaceDir, "src/hello.c")
+		writeFile(t, path, "int main() {}\n")
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		ctx.stepTracker, err = newStepTracker(filepath.Join(ctx.WorkspaceDir, "melange-out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ctx.openStepCache()
+		if err != nil || c == nil {
+			t.Fatalf("openStepCache() = %v, %v", c, err)
+		}
+		return ctx, c
+	}
+	indexed := func(key string) bool {
+		_, err := os.Stat(filepath.Join(remote, "steps", key))
+		return err == nil
+	}
+
+	ctx, c := open(RemoteCacheReadWrite, "make", "make install")
+	if n, err := c.restore(ctx); err != nil || n != 0 {
+		t.Fatalf("restore() of an empty cache = %d, %v", n, err)
+	}
+	writeFile(t, filepath.Join(ctx.WorkspaceDir, "hello.o"), "object\n")
+	if err := os.Chtimes(filepath.Join(ctx.WorkspaceDir, "hello.o"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.store(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(ctx.WorkspaceDir, "melange-out/hello/usr/bin/hello"), "binary\n")
+	if err := ctx.stepTracker.record("step 2 (make install)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.store(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx.closeStepCache(c)
+	keys := c.keys
+	for _, key := range keys {
+		if !indexed(key) {
+			t.Errorf("step %s was not stored in the remote cache", key)
+		}
+	}
+
+	// a builder with another cache directory restores both steps.
+	ctx, c = open(RemoteCacheReadOnly, "make", "make install")
+	if n, err := c.restore(ctx); err != nil || n != 2 {
+		t.Fatalf("restore() from the remote cache = %d, %v, want 2 steps", n, err)
+	}
+	ctx.closeStepCache(c)
+	if fi, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "hello.o")); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("restored hello.o = %v, %v, modified at %s", fi, err, mtime)
+	}
+	if data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "melange-out/hello/usr/bin/hello")); err != nil || string(data) != "binary\n" {
+		t.Errorf("restored usr/bin/hello = %q, %v", data, err)
+	}
+
+	// a read-only cache is not written.
+	ctx, c = open(RemoteCacheReadOnly, "make", "make install-strip")
+	if n, err := c.restore(ctx); err != nil || n != 1 {
+		t.Fatalf("restore() after changing step 2 = %d, %v, want 1 step", n, err)
+	}
+	if err := c.store(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx.closeStepCache(c)
+	if indexed(c.keys[1]) {
+		t.Error("a read-only build stored its step in the remote cache")
+	}
+
+	// a corrupt entry is not restored.
+	for _, key := range keys {
+		digest, err := os.ReadFile(filepath.Join(remote, "steps", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(remote, "sha256", string(digest)), []byte("tampered\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, c = open(RemoteCacheReadOnly, "make", "make install")
+	if n, err := c.restore(ctx); err != nil || n != 0 {
+		t.Errorf("restore() of a corrupt remote cache = %d, %v, want no step", n, err)
+	}
+	ctx.closeStepCache(c)
+}
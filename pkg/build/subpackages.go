@@ -0,0 +1,91 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// autoSubpackage is a conventional subpackage, which is split from the
+// main package when it contains one of the paths of the subpackage.
+type autoSubpackage struct {
+	suffix      string
+	description string
+	paths       []string
+	uses        string
+}
+
+var autoSubpackages = []autoSubpackage{{
+	suffix:      "-bash-completion",
+	description: "bash completions",
+	paths:       []string{"usr/share/bash-completion"},
+	uses:        "split/bash-completion",
+}, {
+	suffix:      "-zsh-completion",
+	description: "zsh completions",
+	paths:       []string{"usr/share/zsh"},
+	uses:        "split/zsh-completion",
+}, {
+	suffix:      "-doc",
+	description: "documentation",
+	paths:       []string{"usr/share/man", "usr/share/info", "usr/share/doc"},
+	uses:        "split/doc",
+}}
+
+// addAutoSubpackages adds the conventional subpackages for the shell
+// completions and documentation found in the output of the main
+// pipeline, when the package enables them.  Subpackages which are
+// declared in the configuration are left alone.
+func (ctx *Context) addAutoSubpackages() {
+	pkg := &ctx.Configuration.Package
+	if !pkg.AutoSubpackages {
+		return
+	}
+
+	declared := map[string]bool{}
+	for _, sp := range ctx.Configuration.Subpackages {
+		declared[sp.Name] = true
+	}
+
+	destDir := filepath.Join(ctx.WorkspaceDir, "melange-out", pkg.Name)
+	for _, auto := range autoSubpackages {
+		name := pkg.Name + auto.suffix
+		if declared[name] {
+			continue
+		}
+
+		found := false
+		for _, path := range auto.paths {
+			if _, err := os.Stat(filepath.Join(destDir, path)); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		log.Printf("adding subpackage %s for the %s of %s", name, auto.description, pkg.Name)
+
+		ctx.Configuration.Subpackages = append(ctx.Configuration.Subpackages, Subpackage{
+			Name:        name,
+			Description: fmt.Sprintf("%s (%s)", pkg.Description, auto.description),
+			Pipeline:    []Pipeline{{Uses: auto.uses}},
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAddAutoSubpackages(t *testing.T) {
+	workspaceDir := t.TempDir()
+	for _, dir := range []string{"usr/share/bash-completion/completions", "usr/share/info"} {
+		if err := os.MkdirAll(filepath.Join(workspaceDir, "melange-out", "foo", dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		declared []string
+		want     []string
+	}{{
+		name: "disabled",
+		want: []string{},
+	}, {
+		name:    "enabled",
+		enabled: true,
+		want:    []string{"foo-bash-completion", "foo-doc"},
+	}, {
+		name:     "declared",
+		enabled:  true,
+		declared: []string{"foo-doc"},
+		want:     []string{"foo-doc", "foo-bash-completion"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &Context{WorkspaceDir: workspaceDir}
+			ctx.Configuration.Package = Package{Name: "foo", Description: "foo", AutoSubpackages: tt.enabled}
+			for _, name := range tt.declared {
+				ctx.Configuration.Subpackages = append(ctx.Configuration.Subpackages, Subpackage{Name: name})
+			}
+
+			ctx.addAutoSubpackages()
+
+			names := []string{}
+			for _, sp := range ctx.Configuration.Subpackages {
+				names = append(names, sp.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("subpackages = %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1" // nolint:gosec
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dataArchive writes the data section of a package: a gzip compressed
+// tar archive of a directory, with the APK-TOOLS.checksum.SHA1 extension
+// apk uses to verify the installed files.
+//
+// The archive is streamed while the directory is walked, so memory use
+// does not grow with the number of files: only the names of the
+// directories being walked are held, which is also needed to write the
+// entries in a reproducible order.  Regular files are read twice, once
+// for their checksum, which precedes their contents in the archive.
+//
+// The holes of sparse files are not read, but they are still stored as
+// zeros, since apk cannot install sparse entries.  Sockets, fifos and
+// device nodes are handled as set by specialFiles.  The user and security
+// extended attributes of files are stored if preserveXattrs is set.  The
+// digests of the files with the algorithms of digests are stored next to
+// their SHA1 digests, see fileDigestRecord.
+type dataArchive struct {
+	sourceDateEpoch time.Time
+	specialFiles    string
+	preserveXattrs  bool
+	digests         []string
+
+	tw *tar.Writer
+	// buf is reused for copying every file.
+	buf []byte
+	// installedSize is the size of every entry of the archive.
+	installedSize int64
+}
+
+// write writes the data archive of dir to out, and returns the installed
+// size of the package.
+func (da *dataArchive) write(dir string, out io.Writer) (int64, error) {
+	gzw := gzip.NewWriter(out)
+	da.tw = tar.NewWriter(gzw)
+	da.buf = make([]byte, 128*1024)
+	da.installedSize = 0
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return 0, err
+	}
+	da.installedSize += fi.Size()
+
+	if err := da.walk(dir, ""); err != nil {
+		return 0, err
+	}
+
+	if err := da.tw.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := gzw.Close(); err != nil {
+		return 0, err
+	}
+
+	return da.installedSize, nil
+}
+
+// walk writes the entries of the directory at the path relative to root
+// dir, in lexical order.
+func (da *dataArchive) walk(root, dir string) error {
+	f, err := os.Open(filepath.Join(root, dir))
+	if err != nil {
+		return err
+	}
+
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		name = path.Join(dir, name)
+
+		fi, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			return err
+		}
+
+		if err := da.writeEntry(root, name, fi); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if fi.IsDir() {
+			if err := da.walk(root, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeEntry writes the header and contents of a file of the archive.
+func (da *dataArchive) writeEntry(root, name string, fi os.FileInfo) error {
+	if fi.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice) != 0 {
+		switch da.specialFiles {
+		case SpecialFilesSkip:
+			log.Printf("warning: skipping special file %s (%s)", name, fi.Mode().Type())
+			return nil
+		case SpecialFilesKeep:
+			if fi.Mode()&os.ModeSocket != 0 {
+				return errors.New("sockets cannot be packaged")
+			}
+		default:
+			return fmt.Errorf("special files cannot be packaged (%s), remove it or set special-files in the package configuration", fi.Mode().Type())
+		}
+	}
+
+	da.installedSize += fi.Size()
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(filepath.Join(root, name)); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	header.AccessTime = da.sourceDateEpoch
+	header.ModTime = da.sourceDateEpoch
+	header.ChangeTime = da.sourceDateEpoch
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = "root"
+	header.Gname = "root"
+	header.PAXRecords = map[string]string{}
+
+	if da.preserveXattrs && link == "" {
+		xattrs, err := readXattrs(filepath.Join(root, name))
+		if err != nil {
+			return err
+		}
+		for key, value := range xattrs {
+			header.PAXRecords["SCHILY.xattr."+key] = value
+		}
+	}
+
+	switch {
+	case link != "":
+		for record, digest := range da.linkChecksums(link) {
+			header.PAXRecords[record] = digest
+		}
+	case fi.Mode().IsRegular():
+		checksums, err := da.checksums(filepath.Join(root, name))
+		if err != nil {
+			return err
+		}
+		for record, digest := range checksums {
+			header.PAXRecords[record] = digest
+		}
+	}
+
+	if err := da.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(root, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if isSparse(fi) {
+		log.Printf("warning: %s is sparse, it is stored with its holes filled", name)
+	}
+
+	// a file which changed since it was checksummed makes the tar
+	// writer fail, as the size in the header no longer matches.
+	if _, err := da.copy(da.tw, f); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hashes returns the hashes of the digests of the files, keyed by their
+// PAX record.
+func (da *dataArchive) hashes() map[string]hash.Hash {
+	hashes := map[string]hash.Hash{"APK-TOOLS.checksum.SHA1": sha1.New()} // nolint:gosec
+	for _, alg := range da.digests {
+		hashes[fileDigestRecord(alg)] = packageDigests[alg]()
+	}
+	return hashes
+}
+
+// checksums returns the hex encoded digests of a file, keyed by their
+// PAX record.
+func (da *dataArchive) checksums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := da.hashes()
+	writers := []io.Writer{}
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	if _, err := da.copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+
+	checksums := map[string]string{}
+	for record, h := range hashes {
+		checksums[record] = hex.EncodeToString(h.Sum(nil))
+	}
+	return checksums, nil
+}
+
+// linkChecksums returns the hex encoded digests of the target of a
+// symbolic link, keyed by their PAX record.
+func (da *dataArchive) linkChecksums(link string) map[string]string {
+	checksums := map[string]string{}
+	for record, h := range da.hashes() {
+		h.Write([]byte(link))
+		checksums[record] = hex.EncodeToString(h.Sum(nil))
+	}
+	return checksums
+}
+
+// copy copies a file with the buffer of the archive, without reading the
+// holes of sparse files.  The file is hidden behind an io.Reader, as
+// io.CopyBuffer ignores the buffer and allocates a new one when the
+// source implements io.WriterTo.
+func (da *dataArchive) copy(w io.Writer, f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if isSparse(fi) {
+		return io.CopyBuffer(w, &sparseReader{f: f, size: fi.Size()}, da.buf)
+	}
+
+	return io.CopyBuffer(w, struct{ io.Reader }{f}, da.buf)
+}
+
+// isSparse reports whether fewer blocks are allocated to a regular file
+// than its size needs.
+func isSparse(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode().IsRegular() && st.Blocks*512 < fi.Size()
+}
+
+// xattrNamespaces are the namespaces of the extended attributes which are
+// packaged.  The other namespaces, such as trusted, only make sense on the
+// build host.
+var xattrNamespaces = []string{"user.", "security."}
+
+// readXattrs returns the packaged extended attributes of a file.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	list := make([]byte, size)
+	size, err = syscall.Listxattr(path, list)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, key := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		packaged := false
+		for _, ns := range xattrNamespaces {
+			packaged = packaged || strings.HasPrefix(key, ns)
+		}
+		if !packaged {
+			continue
+		}
+
+		size, err := syscall.Getxattr(path, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("reading extended attribute %s: %w", key, err)
+		}
+
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("reading extended attribute %s: %w", key, err)
+		}
+
+		xattrs[key] = string(value[:size])
+	}
+
+	return xattrs, nil
+}
+
+// seekData and seekHole are the lseek whences finding the data and holes
+// of sparse files.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// sparseReader reads a sparse file, returning zeros for its holes without
+// reading them.  The regions of the file are found as it is read, so
+// that fragmented files do not need a large map.
+type sparseReader struct {
+	f    *os.File
+	pos  int64
+	size int64
+	// holeEnd is the end of the hole at pos, dataEnd the end of the
+	// data at pos.
+	holeEnd int64
+	dataEnd int64
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.pos >= r.holeEnd && r.pos >= r.dataEnd {
+		if err := r.nextRegion(); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.pos < r.holeEnd {
+		if remaining := r.holeEnd - r.pos; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		r.pos += int64(len(p))
+		return len(p), nil
+	}
+
+	if remaining := r.dataEnd - r.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.f.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// nextRegion finds the hole or data at the current position.
+func (r *sparseReader) nextRegion() error {
+	data, err := r.f.Seek(r.pos, seekData)
+	switch {
+	case errors.Is(err, syscall.ENXIO):
+		// the file ends with a hole.
+		r.holeEnd = r.size
+		return nil
+	case err != nil:
+		// holes cannot be found, the whole file is read.
+		r.dataEnd = r.size
+		return nil
+	case data > r.pos:
+		r.holeEnd = data
+		return nil
+	}
+
+	hole, err := r.f.Seek(r.pos, seekHole)
+	if err != nil {
+		hole = r.size
+	}
+	r.dataEnd = hole
+
+	return nil
+}
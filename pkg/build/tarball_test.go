@@ -0,0 +1,314 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readArchive returns the headers of a gzip compressed tar archive.
+func readArchive(t *testing.T, data []byte) []*tar.Header {
+	t.Helper()
+
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := []*tar.Header{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, hdr)
+	}
+}
+
+func TestWriteDataArchive(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "usr", "bin", "foo"), []byte("hello\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("foo", filepath.Join(dir, "usr", "bin", "bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := time.Unix(1650000000, 0)
+
+	var buf bytes.Buffer
+	if _, err := (&dataArchive{sourceDateEpoch: epoch}).write(dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := readArchive(t, buf.Bytes())
+
+	names := []string{}
+	for _, hdr := range headers {
+		names = append(names, hdr.Name)
+
+		if !hdr.ModTime.Equal(epoch) || hdr.Uname != "root" || hdr.Uid != 0 {
+			t.Errorf("%s: header = %v %s %d, want the source date epoch and root", hdr.Name, hdr.ModTime, hdr.Uname, hdr.Uid)
+		}
+	}
+
+	wantNames := []string{"usr", "usr/bin", "usr/bin/bar", "usr/bin/foo"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("entries = %q, want %q", names, wantNames)
+	}
+
+	checksums := map[string]string{
+		// sha1("foo") and sha1("hello\n")
+		"usr/bin/bar": "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+		"usr/bin/foo": "f572d396fae9206628714fb2ce00f72e94f2258f",
+	}
+	for _, hdr := range headers {
+		if got := hdr.PAXRecords["APK-TOOLS.checksum.SHA1"]; got != checksums[hdr.Name] {
+			t.Errorf("%s: checksum = %q, want %q", hdr.Name, got, checksums[hdr.Name])
+		}
+	}
+
+	// the archive is reproducible.
+	var again bytes.Buffer
+	if _, err := (&dataArchive{sourceDateEpoch: epoch}).write(dir, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Error("writing the same directory twice produced different archives")
+	}
+}
+
+func TestWriteDataArchiveDigests(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "foo"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("foo", filepath.Join(dir, "bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	da := &dataArchive{digests: []string{"sha256", "sha512"}}
+	if _, err := da.write(dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		// sha256("foo") and sha256("hello\n")
+		"bar": {"APK-TOOLS.checksum.SHA256": "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+		"foo": {"APK-TOOLS.checksum.SHA256": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"},
+	}
+	for _, hdr := range readArchive(t, buf.Bytes()) {
+		for record, digest := range want[hdr.Name] {
+			if got := hdr.PAXRecords[record]; got != digest {
+				t.Errorf("%s: %s = %q, want %q", hdr.Name, record, got, digest)
+			}
+		}
+		if len(hdr.PAXRecords["APK-TOOLS.checksum.SHA512"]) != 128 || hdr.PAXRecords["APK-TOOLS.checksum.SHA1"] == "" {
+			t.Errorf("%s: PAX records = %v, want SHA1 and SHA512 checksums", hdr.Name, hdr.PAXRecords)
+		}
+	}
+}
+
+func TestValidateDigests(t *testing.T) {
+	if err := validateDigests([]string{"sha256", "sha512"}); err != nil {
+		t.Errorf("validateDigests() = %v", err)
+	}
+	if err := validateDigests([]string{"md5"}); err == nil {
+		t.Error("validateDigests() succeeded with md5")
+	}
+}
+
+// readArchiveFile returns the contents of a file of a gzip compressed tar
+// archive.
+func readArchiveFile(t *testing.T, data []byte, name string) []byte {
+	t.Helper()
+
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("%s not found in the archive: %v", name, err)
+		}
+		if hdr.Name != name {
+			continue
+		}
+
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+}
+
+func TestWriteDataArchiveSparse(t *testing.T) {
+	dir := t.TempDir()
+
+	// 1MB with a single byte of data in the middle, and holes around it.
+	f, err := os.Create(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 1<<19); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(fi) {
+		t.Log("the file system does not support sparse files, the file is read densely")
+	}
+
+	var buf bytes.Buffer
+	if _, err := (&dataArchive{}).write(dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 1<<20)
+	want[1<<19] = 'x'
+	if got := readArchiveFile(t, buf.Bytes(), "disk.img"); !bytes.Equal(got, want) {
+		t.Error("the sparse file was not stored with its holes filled")
+	}
+}
+
+func TestWriteDataArchiveSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644); err != nil {
+		t.Skipf("unable to make a fifo: %v", err)
+	}
+
+	tests := []struct {
+		specialFiles string
+		wantNames    []string
+		wantErr      bool
+	}{{
+		specialFiles: "",
+		wantErr:      true,
+	}, {
+		specialFiles: SpecialFilesSkip,
+		wantNames:    []string{"file"},
+	}, {
+		specialFiles: SpecialFilesKeep,
+		wantNames:    []string{"fifo", "file"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.specialFiles, func(t *testing.T) {
+			var buf bytes.Buffer
+			_, err := (&dataArchive{specialFiles: tt.specialFiles}).write(dir, &buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			names := []string{}
+			for _, hdr := range readArchive(t, buf.Bytes()) {
+				names = append(names, hdr.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("entries = %q, want %q", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestWriteDataArchiveXattrs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(path, "user.melange.test", []byte("value"), 0); err != nil {
+		t.Skipf("unable to set extended attributes: %v", err)
+	}
+
+	for _, preserve := range []bool{false, true} {
+		var buf bytes.Buffer
+		if _, err := (&dataArchive{preserveXattrs: preserve}).write(dir, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		want := ""
+		if preserve {
+			want = "value"
+		}
+
+		headers := readArchive(t, buf.Bytes())
+		if got := headers[0].PAXRecords["SCHILY.xattr.user.melange.test"]; got != want {
+			t.Errorf("preserveXattrs = %t: xattr = %q, want %q", preserve, got, want)
+		}
+	}
+}
+
+func BenchmarkWriteDataArchive(b *testing.B) {
+	for _, count := range []int{1000, 10000} {
+		dir := b.TempDir()
+		for i := 0; i < count; i++ {
+			sub := filepath.Join(dir, fmt.Sprintf("%03d", i%100))
+			if err := os.MkdirAll(sub, 0755); err != nil {
+				b.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("file-%d", i)), []byte("data"), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.Run(fmt.Sprintf("%d files", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := (&dataArchive{}).write(dir, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
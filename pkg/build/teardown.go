@@ -0,0 +1,233 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procDir is where the process information is read from.
+var procDir = "/proc"
+
+// hostState is the state of the host which a build may leak into:
+// the running processes, the entries of the temporary directory and the
+// mount points.
+type hostState struct {
+	processes map[string]bool
+	tempFiles map[string]bool
+	mounts    map[string]bool
+}
+
+// captureHostState records the state of the host before a build.
+func captureHostState() *hostState {
+	hs := &hostState{
+		processes: map[string]bool{},
+		tempFiles: map[string]bool{},
+		mounts:    map[string]bool{},
+	}
+
+	if names, err := readDirNames(procDir); err == nil {
+		for _, name := range names {
+			hs.processes[name] = true
+		}
+	}
+
+	if names, err := readDirNames(os.TempDir()); err == nil {
+		for _, name := range names {
+			hs.tempFiles[name] = true
+		}
+	}
+
+	if mounts, err := readMountPoints(); err == nil {
+		for _, m := range mounts {
+			hs.mounts[m] = true
+		}
+	}
+
+	return hs
+}
+
+// leftovers returns what the build left behind on the host since the
+// state was captured: processes started since then which still run in
+// the build environment or the workspace, new mounts and new temporary
+// files.  The temporary
+// directories of melange itself, which are named melange-*, are not
+// reported.
+func (hs *hostState) leftovers(ctx *Context) []string {
+	found := []string{}
+
+	dirs := []string{}
+	for _, dir := range []string{ctx.GuestDir, ctx.WorkspaceDir} {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			dirs = append(dirs, abs)
+		}
+	}
+
+	for _, p := range buildProcesses(dirs, hs.processes) {
+		found = append(found, fmt.Sprintf("process %s", p))
+	}
+
+	if mounts, err := readMountPoints(); err == nil {
+		for _, m := range mounts {
+			if !hs.mounts[m] {
+				found = append(found, fmt.Sprintf("mount %s", m))
+			}
+		}
+	}
+
+	if names, err := readDirNames(os.TempDir()); err == nil {
+		for _, name := range names {
+			if !hs.tempFiles[name] && !strings.HasPrefix(name, "melange-") {
+				found = append(found, fmt.Sprintf("temporary file %s", filepath.Join(os.TempDir(), name)))
+			}
+		}
+	}
+
+	return found
+}
+
+// reportLeftovers logs what the build left behind on the host.
+func (ctx *Context) reportLeftovers(hs *hostState) {
+	found := hs.leftovers(ctx)
+	if len(found) == 0 {
+		return
+	}
+
+	log.Printf("warning: the build left %d leftovers on the host:", len(found))
+	for _, f := range found {
+		log.Printf("  %s", f)
+	}
+}
+
+// readDirNames returns the sorted names of the entries of a directory.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// readMountPoints returns the mount points of the mount namespace of
+// melange.
+func readMountPoints() ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(procDir, "self", "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMountInfo(data), nil
+}
+
+// parseMountInfo returns the mount points of a mountinfo file, whose
+// fifth field is the mount point with octal escapes.
+func parseMountInfo(data []byte) []string {
+	mounts := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPoint(fields[4]))
+	}
+
+	return mounts
+}
+
+// unescapeMountPoint decodes the octal escapes of spaces, tabs, newlines
+// and backslashes in the mount points of mountinfo.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// buildProcesses returns the processes, except the ones in skip, whose
+// working or root directory is inside one of the directories, as
+// "pid (command)".  The processes of other users cannot be inspected and
+// are skipped.
+func buildProcesses(dirs []string, skip map[string]bool) []string {
+	entries, err := readDirNames(procDir)
+	if err != nil {
+		return nil
+	}
+
+	found := []string{}
+	for _, name := range entries {
+		pid, err := strconv.Atoi(name)
+		if err != nil || pid == os.Getpid() || skip[name] {
+			continue
+		}
+
+		for _, link := range []string{"cwd", "root"} {
+			target, err := os.Readlink(filepath.Join(procDir, name, link))
+			if err != nil || !insideAny(target, dirs) {
+				continue
+			}
+
+			comm, _ := os.ReadFile(filepath.Join(procDir, name, "comm"))
+			found = append(found, fmt.Sprintf("%d (%s)", pid, strings.TrimSpace(string(comm))))
+			break
+		}
+	}
+
+	return found
+}
+
+// insideAny reports whether a path is one of the directories or inside
+// one of them.
+func insideAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	data := []byte(`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+35 22 0:30 / /tmp/with\040space rw,nosuid - tmpfs tmpfs rw
+36 22 0:31 / /tmp/back\134slash rw - tmpfs tmpfs rw
+`)
+
+	want := []string{"/", "/tmp/with space", `/tmp/back\slash`}
+	if got := parseMountInfo(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMountInfo() = %q, want %q", got, want)
+	}
+}
+
+func TestLeftovers(t *testing.T) {
+	if _, err := os.Stat(filepath.Join(procDir, "self", "mountinfo")); err != nil {
+		t.Skip("no procfs")
+	}
+
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	ctx := &Context{
+		GuestDir:     t.TempDir(),
+		WorkspaceDir: t.TempDir(),
+	}
+
+	// processes running before the build are not leftovers.
+	before := exec.Command("sleep", "60")
+	before.Dir = ctx.WorkspaceDir
+	if err := before.Start(); err != nil {
+		t.Skipf("unable to start process: %v", err)
+	}
+	defer before.Process.Kill()
+
+	hs := captureHostState()
+	if found := hs.leftovers(ctx); len(found) != 0 {
+		t.Errorf("leftovers() = %q, want none", found)
+	}
+
+	leaked := exec.Command("sleep", "60")
+	leaked.Dir = ctx.WorkspaceDir
+	if err := leaked.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer leaked.Process.Kill()
+
+	for _, name := range []string{"leaked", "melange-guest-1"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		fmt.Sprintf("process %d (sleep)", leaked.Process.Pid),
+		fmt.Sprintf("temporary file %s", filepath.Join(tmpDir, "leaked")),
+	}
+	if got := hs.leftovers(ctx); !reflect.DeepEqual(got, want) {
+		t.Errorf("leftovers() = %q, want %q", got, want)
+	}
+}
+
+func TestInsideAny(t *testing.T) {
+	dirs := []string{"/tmp/guest", "/work"}
+
+	for path, want := range map[string]bool{
+		"/tmp/guest":         true,
+		"/tmp/guest/usr/bin": true,
+		"/tmp/guest2":        false,
+		"/":                  false,
+		"/work/src":          true,
+	} {
+		if got := insideAny(path, dirs); got != want {
+			t.Errorf("insideAny(%q) = %t, want %t", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/apk"
+)
+
+// builtPackage is a package built from the configuration.
+type builtPackage struct {
+	path string
+	info *apk.PackageInfo
+}
+
+// loaderPatterns are the dynamic loaders of musl and glibc, relative to
+// the root of an environment.
+var loaderPatterns = []string{
+	"lib/ld-musl-*.so.1",
+	"lib64/ld-linux-*.so.2",
+	"lib/ld-linux-*.so.*",
+}
+
+// pathDirs are the directories searched for the programs run with env.
+var pathDirs = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// TestDependencies checks that the packages built from the configuration
+// declare the runtime dependencies of their programs and libraries.
+//
+// Every package is installed into an otherwise empty environment with
+// its runtime dependencies, where the dynamic loader lists the shared
+// libraries of every ELF file, and the interpreters of the scripts are
+// looked up.  The dependencies built from the same configuration are
+// installed from the output directory.
+func (ctx *Context) TestDependencies() error {
+	pkgs, err := ctx.builtPackages()
+	if err != nil {
+		return err
+	}
+
+	failures := []string{}
+	for _, pkg := range pkgs {
+		problems, err := ctx.testPackageDependencies(pkg, pkgs)
+		if err != nil {
+			return fmt.Errorf("unable to test %s: %w", pkg.info.Get("pkgname"), err)
+		}
+
+		for _, problem := range problems {
+			failures = append(failures, fmt.Sprintf("%s: %s", pkg.info.Get("pkgname"), problem))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("missing runtime dependencies:\n  %s", strings.Join(failures, "\n  "))
+	}
+
+	log.Printf("all runtime dependencies are declared")
+
+	return nil
+}
+
+// builtPackages reads the packages built from the configuration into the
+// output directory.  The main package must have been built.
+func (ctx *Context) builtPackages() ([]builtPackage, error) {
+	names := []string{ctx.Configuration.Package.Name}
+	for _, sp := range ctx.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+	if ctx.Configuration.Package.AutoSubpackages {
+		for _, auto := range autoSubpackages {
+			names = append(names, ctx.Configuration.Package.Name+auto.suffix)
+		}
+	}
+
+	pkgs := []builtPackage{}
+	for i, name := range names {
+		pc := PackageContext{
+			Context:     ctx,
+			Origin:      &ctx.Configuration.Package,
+			PackageName: name,
+		}
+
+		path := filepath.Join(ctx.OutDir, pc.Filename())
+		info, err := apk.ReadPackageInfoFile(path)
+		if errors.Is(err, fs.ErrNotExist) && i > 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read package %s, build it first: %w", path, err)
+		}
+
+		pkgs = append(pkgs, builtPackage{path: path, info: info})
+	}
+
+	return pkgs, nil
+}
+
+// localClosure splits the runtime dependencies of a package into the
+// packages of the build which satisfy them, including the package
+// itself and their own dependencies, and the names which are installed
+// from the repositories.
+func localClosure(pkg builtPackage, pkgs []builtPackage) ([]builtPackage, []string) {
+	providers := map[string]int{}
+	for i, p := range pkgs {
+		providers[p.info.Get("pkgname")] = i
+		for _, provides := range p.info.GetAll("provides") {
+			providers[dependencyName(provides)] = i
+		}
+	}
+
+	local := []builtPackage{}
+	external := map[string]bool{}
+	seen := map[string]bool{}
+
+	queue := []builtPackage{pkg}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if seen[p.path] {
+			continue
+		}
+		seen[p.path] = true
+		local = append(local, p)
+
+		for _, dep := range p.info.GetAll("depend") {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			if i, ok := providers[dependencyName(dep)]; ok {
+				queue = append(queue, pkgs[i])
+				continue
+			}
+			external[dep] = true
+		}
+	}
+
+	names := []string{}
+	for dep := range external {
+		names = append(names, dep)
+	}
+	sort.Strings(names)
+
+	return local, names
+}
+
+// testPackageDependencies installs a package with its runtime
+// dependencies into a new environment, and returns the problems of its
+// files.
+func (ctx *Context) testPackageDependencies(pkg builtPackage, pkgs []builtPackage) ([]string, error) {
+	local, external := localClosure(pkg, pkgs)
+
+	guestDir, err := os.MkdirTemp("", "melange-test-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to make test environment directory: %w", err)
+	}
+	defer os.RemoveAll(guestDir)
+
+	workDir, err := os.MkdirTemp("", "melange-test-work-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to make test workspace directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	log.Printf("installing %s with %s into a minimal environment", pkg.info.Get("pkgname"), strings.Join(external, " "))
+
+	env := ctx.Configuration.Environment
+	env.Contents.Packages = external
+	if err := ctx.buildImage(guestDir, env); err != nil {
+		return nil, err
+	}
+
+	var files []*tar.Header
+	for _, p := range local {
+		f, err := os.Open(p.path)
+		if err != nil {
+			return nil, err
+		}
+
+		_, extracted, err := apk.ExtractPackage(f, guestDir)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to install %s: %w", p.path, err)
+		}
+
+		if p.path == pkg.path {
+			files = extracted
+		}
+	}
+
+	tctx := *ctx
+	tctx.GuestDir = guestDir
+	tctx.WorkspaceDir = workDir
+
+	dc := &depsChecker{
+		root: guestDir,
+		list: func(loader, path string) ([]byte, error) {
+			cmd, err := tctx.WorkspaceCmd(loader, "--list", path)
+			if err != nil {
+				return nil, err
+			}
+			defer func() {
+				for _, f := range cmd.ExtraFiles {
+					f.Close()
+				}
+			}()
+
+			return cmd.CombinedOutput()
+		},
+	}
+
+	return dc.check(files), nil
+}
+
+// depsChecker checks the dependencies of the files of a package
+// installed into an environment.
+type depsChecker struct {
+	// root is the directory of the environment.
+	root string
+	// list runs the dynamic loader of the environment, at its path
+	// inside the environment, to list the libraries of a file.
+	list func(loader, path string) ([]byte, error)
+}
+
+// check returns the problems of the given files of a package.
+func (dc *depsChecker) check(files []*tar.Header) []string {
+	problems := []string{}
+
+	for _, hdr := range files {
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		path := filepath.Join(dc.root, hdr.Name)
+		if f, err := openELF(path); err == nil && f != nil {
+			problems = append(problems, dc.checkELF(hdr.Name, f)...)
+			f.Close()
+			continue
+		}
+
+		if hdr.FileInfo().Mode().Perm()&0111 != 0 {
+			problems = append(problems, dc.checkScript(hdr.Name, path)...)
+		}
+	}
+
+	return problems
+}
+
+// checkELF returns the problems of an ELF file of a package.
+func (dc *depsChecker) checkELF(name string, f *elf.File) []string {
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return nil
+	}
+
+	loader := ""
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return []string{fmt.Sprintf("%s: unable to read the interpreter: %v", name, err)}
+		}
+		loader = string(bytes.TrimRight(data, "\x00"))
+		if _, err := resolveInRoot(dc.root, loader); err != nil {
+			return []string{fmt.Sprintf("%s: interpreter %s is not provided by a runtime dependency", name, loader)}
+		}
+	}
+
+	needed, err := f.ImportedLibraries()
+	if err != nil || len(needed) == 0 {
+		// statically linked.
+		return nil
+	}
+
+	if loader == "" {
+		loader = findLoader(dc.root)
+		if loader == "" {
+			return []string{fmt.Sprintf("%s: no dynamic loader is provided by a runtime dependency", name)}
+		}
+	}
+
+	out, err := dc.list(loader, "/"+name)
+	problems := []string{}
+	for _, missing := range parseLoaderList(out) {
+		problems = append(problems, fmt.Sprintf("%s: %s", name, missing))
+	}
+	if err != nil && len(problems) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: the dynamic loader failed: %v: %s", name, err, bytes.TrimSpace(out)))
+	}
+
+	return problems
+}
+
+// checkScript returns the problems of an executable script of a
+// package.
+func (dc *depsChecker) checkScript(name, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return nil
+	}
+
+	interp, prog := scriptInterpreter(line)
+	if interp == "" {
+		return nil
+	}
+
+	if _, err := resolveInRoot(dc.root, interp); err != nil {
+		return []string{fmt.Sprintf("%s: interpreter %s is not provided by a runtime dependency", name, interp)}
+	}
+
+	if prog == "" {
+		return nil
+	}
+
+	for _, dir := range pathDirs {
+		if _, err := resolveInRoot(dc.root, filepath.Join(dir, prog)); err == nil {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("%s: interpreter %s is not provided by a runtime dependency", name, prog)}
+}
+
+// scriptInterpreter returns the interpreter of the first line of a
+// script, and the program it runs if it is env.
+func scriptInterpreter(line string) (string, string) {
+	if !strings.HasPrefix(line, "#!") {
+		return "", ""
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return "", ""
+	}
+
+	if filepath.Base(fields[0]) == "env" {
+		for _, arg := range fields[1:] {
+			if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+				return fields[0], arg
+			}
+		}
+	}
+
+	return fields[0], ""
+}
+
+// findLoader returns the path of the dynamic loader of an environment,
+// or an empty string if there is none.
+func findLoader(root string) string {
+	for _, pattern := range loaderPatterns {
+		dir, err := resolveInRoot(root, filepath.Dir(pattern))
+		if err != nil {
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.Base(pattern)))
+		if err != nil || len(matches) == 0 {
+			continue
+		}
+
+		return "/" + filepath.Join(filepath.Dir(pattern), filepath.Base(matches[0]))
+	}
+
+	return ""
+}
+
+// parseLoaderList returns the libraries and symbols which the dynamic
+// loader of glibc or musl did not find when listing the libraries of a
+// file.
+func parseLoaderList(out []byte) []string {
+	missing := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		// glibc: "libfoo.so.1 => not found"
+		case strings.HasSuffix(line, "=> not found"):
+			lib := strings.TrimSpace(strings.TrimSuffix(line, "=> not found"))
+			missing = append(missing, fmt.Sprintf("%s is not provided by a runtime dependency (so:%s)", lib, lib))
+
+		// glibc: "/usr/bin/foo: error while loading shared
+		// libraries: libfoo.so.1: cannot open shared object file: No
+		// such file or directory"
+		case strings.Contains(line, "error while loading shared libraries: "):
+			lib := line[strings.Index(line, "error while loading shared libraries: ")+len("error while loading shared libraries: "):]
+			if i := strings.Index(lib, ":"); i >= 0 {
+				lib = lib[:i]
+			}
+			missing = append(missing, fmt.Sprintf("%s is not provided by a runtime dependency (so:%s)", lib, lib))
+
+		// musl: "Error loading shared library libfoo.so.1: No such
+		// file or directory (needed by /usr/bin/foo)"
+		case strings.HasPrefix(line, "Error loading shared library "):
+			lib := strings.TrimPrefix(line, "Error loading shared library ")
+			if i := strings.Index(lib, ":"); i >= 0 {
+				lib = lib[:i]
+			}
+			missing = append(missing, fmt.Sprintf("%s is not provided by a runtime dependency (so:%s)", lib, lib))
+
+		// musl: "Error relocating /usr/bin/foo: bar: symbol not found"
+		case strings.HasPrefix(line, "Error relocating ") && strings.HasSuffix(line, "symbol not found"):
+			parts := strings.Split(line, ": ")
+			if len(parts) == 3 {
+				missing = append(missing, fmt.Sprintf("symbol %s is not provided by a runtime dependency", parts[1]))
+			}
+
+		// glibc: "symbol lookup error: ..." or "version `GLIBC_2.34'
+		// not found"
+		case strings.Contains(line, "symbol lookup error") || (strings.Contains(line, "version `") && strings.HasSuffix(line, "not found")):
+			missing = append(missing, line)
+		}
+	}
+
+	return missing
+}
+
+// resolveInRoot resolves a path of an environment to a path on the host,
+// following symbolic links inside the environment, and returns an error
+// if it does not exist.
+func resolveInRoot(root, path string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(path, "/")
+
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > 40 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chainguard.dev/melange/pkg/apk"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"usr/lib", "usr/bin"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"lib":                "usr/lib",
+		"usr/bin/python3":    "/usr/bin/python3.10",
+		"usr/bin/escape":     "../../../../../etc/passwd",
+		"usr/lib/libfoo.so":  "libfoo.so.1",
+		"usr/lib/libloop.so": "libloop.so",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"usr/bin/python3.10", "usr/lib/libfoo.so.1"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/usr/bin/python3":  "usr/bin/python3.10",
+		"/lib/libfoo.so":    "usr/lib/libfoo.so.1",
+		"/lib/../bin/../..": "",
+		"/usr/bin/escape":   "",
+		"/lib/libloop.so":   "",
+		"/lib/libbar.so":    "",
+	} {
+		got, err := resolveInRoot(root, path)
+		if want == "" {
+			// ".." does not leave the root, the other paths do not
+			// exist in the root.
+			if path == "/lib/../bin/../.." {
+				want = "."
+			} else {
+				if err == nil {
+					t.Errorf("resolveInRoot(%s) = %s, want an error", path, got)
+				}
+				continue
+			}
+		}
+		if err != nil || got != filepath.Join(root, want) {
+			t.Errorf("resolveInRoot(%s) = %s, %v, want %s", path, got, err, want)
+		}
+	}
+}
+
+func TestParseLoaderList(t *testing.T) {
+	glibc := []byte(`	linux-vdso.so.1 (0x00007ffd)
+	libfoo.so.1 => not found
+	libc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x00007f)
+`)
+	musl := []byte(`	/lib/ld-musl-x86_64.so.1 (0x7f)
+Error loading shared library libbar.so.2: No such file or directory (needed by /usr/bin/bar)
+Error relocating /usr/bin/bar: bar_init: symbol not found
+`)
+
+	if got, want := parseLoaderList(glibc), []string{"libfoo.so.1 is not provided by a runtime dependency (so:libfoo.so.1)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLoaderList(glibc) = %q, want %q", got, want)
+	}
+
+	want := []string{
+		"libbar.so.2 is not provided by a runtime dependency (so:libbar.so.2)",
+		"symbol bar_init is not provided by a runtime dependency",
+	}
+	if got := parseLoaderList(musl); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLoaderList(musl) = %q, want %q", got, want)
+	}
+}
+
+func TestParseLoaderListHost(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "foo.c"), []byte("int foo(void) { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.c"), []byte("int foo(void);\nint main(void) { return foo(); }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"-shared", "-fPIC", "-o", filepath.Join(dir, "libfoo.so"), filepath.Join(dir, "foo.c")},
+		{"-o", filepath.Join(dir, "main"), filepath.Join(dir, "main.c"), "-L" + dir, "-lfoo"},
+	} {
+		if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+			t.Skipf("unable to compile test program: %v: %s", err, out)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, "libfoo.so")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := elf.Open(filepath.Join(dir, "main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	loader := ""
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, _ := io.ReadAll(prog.Open())
+			loader = string(bytes.TrimRight(data, "\x00"))
+		}
+	}
+
+	out, _ := exec.Command(loader, "--list", filepath.Join(dir, "main")).CombinedOutput()
+	if got := parseLoaderList(out); len(got) != 1 || !strings.Contains(got[0], "libfoo.so") {
+		t.Errorf("parseLoaderList(%q) = %q, want libfoo.so", out, got)
+	}
+}
+
+func TestScriptInterpreter(t *testing.T) {
+	for line, want := range map[string][2]string{
+		"#!/bin/sh\n":                     {"/bin/sh", ""},
+		"#! /usr/bin/perl -w\n":           {"/usr/bin/perl", ""},
+		"#!/usr/bin/env python3\n":        {"/usr/bin/env", "python3"},
+		"#!/usr/bin/env -S LANG=C ruby\n": {"/usr/bin/env", "ruby"},
+		"#!/usr/bin/env LANG=C node -e\n": {"/usr/bin/env", "node"},
+		"echo not a script\n":             {"", ""},
+		"#!\n":                            {"", ""},
+	} {
+		interp, prog := scriptInterpreter(line)
+		if interp != want[0] || prog != want[1] {
+			t.Errorf("scriptInterpreter(%q) = %q, %q, want %q, %q", line, interp, prog, want[0], want[1])
+		}
+	}
+}
+
+func TestLocalClosure(t *testing.T) {
+	pkg := func(name string, fields ...apk.Field) builtPackage {
+		return builtPackage{
+			path: name + ".apk",
+			info: &apk.PackageInfo{Fields: append([]apk.Field{{Key: "pkgname", Value: name}}, fields...)},
+		}
+	}
+
+	pkgs := []builtPackage{
+		pkg("foo", apk.Field{Key: "depend", Value: "so:libfoo.so.1"}, apk.Field{Key: "depend", Value: "so:libc.musl-x86_64.so.1"}),
+		pkg("foo-libs", apk.Field{Key: "provides", Value: "so:libfoo.so.1=1"}, apk.Field{Key: "depend", Value: "zlib>=1.2"}),
+		pkg("foo-dev", apk.Field{Key: "depend", Value: "foo-libs"}, apk.Field{Key: "depend", Value: "!foo-old"}),
+	}
+
+	local, external := localClosure(pkgs[0], pkgs)
+
+	names := []string{}
+	for _, p := range local {
+		names = append(names, p.info.Get("pkgname"))
+	}
+	if want := []string{"foo", "foo-libs"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("local = %q, want %q", names, want)
+	}
+	if want := []string{"so:libc.musl-x86_64.so.1", "zlib>=1.2"}; !reflect.DeepEqual(external, want) {
+		t.Errorf("external = %q, want %q", external, want)
+	}
+
+	if _, external := localClosure(pkgs[2], pkgs); !reflect.DeepEqual(external, []string{"zlib>=1.2"}) {
+		t.Errorf("external = %q, want [zlib>=1.2]", external)
+	}
+}
+
+func TestDepsChecker(t *testing.T) {
+	workspaceDir := t.TempDir()
+	compileTestProgram(t, workspaceDir)
+	root := filepath.Join(workspaceDir, "melange-out", "foo")
+
+	f, err := openELF(filepath.Join(root, "usr", "bin", "foo"))
+	if err != nil || f == nil {
+		t.Fatalf("openELF() = %v, %v", f, err)
+	}
+	loader := ""
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, _ := io.ReadAll(prog.Open())
+			loader = string(bytes.TrimRight(data, "\x00"))
+		}
+	}
+	f.Close()
+	if loader == "" {
+		t.Skip("the test program is statically linked")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "usr", "bin", "script"), []byte("#!/usr/bin/env python3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "usr", "bin", "env"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []*tar.Header{
+		{Name: "usr/bin/foo", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "usr/bin/script", Typeflag: tar.TypeReg, Mode: 0755},
+	}
+
+	listed := []string{}
+	dc := &depsChecker{
+		root: root,
+		list: func(loader, path string) ([]byte, error) {
+			listed = append(listed, loader+" "+path)
+			return []byte("\tlibfoo.so.1 => not found\n"), nil
+		},
+	}
+
+	want := []string{
+		"usr/bin/foo: interpreter " + loader + " is not provided by a runtime dependency",
+		"usr/bin/script: interpreter python3 is not provided by a runtime dependency",
+	}
+	if got := dc.check(files); !reflect.DeepEqual(got, want) {
+		t.Errorf("check() = %q, want %q", got, want)
+	}
+
+	// once the loader is installed, it lists the libraries.
+	if err := os.MkdirAll(filepath.Join(root, filepath.Dir(loader)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, loader), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []string{
+		"usr/bin/foo: libfoo.so.1 is not provided by a runtime dependency (so:libfoo.so.1)",
+		"usr/bin/script: interpreter python3 is not provided by a runtime dependency",
+	}
+	if got := dc.check(files); !reflect.DeepEqual(got, want) {
+		t.Errorf("check() = %q, want %q", got, want)
+	}
+	if want := []string{loader + " /usr/bin/foo"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("listed = %q, want %q", listed, want)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"chainguard.dev/apko/pkg/tarball"
+	"chainguard.dev/melange/pkg/apk"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	v1tarball "github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// Test is the test of the packages built from a configuration, run by
+// melange test --image in an image holding the package.
+type Test struct {
+	// Packages are installed into the test image from the
+	// repositories of the build environment, in addition to the
+	// runtime dependencies of the package, such as a shell and the
+	// tools of the test.
+	Packages []string `yaml:"packages"`
+	// Pipeline is the test, whose runs steps are run in order by a
+	// script which is the entrypoint of the image.  Only runs steps,
+	// and the ones of nested pipelines, are supported.
+	Pipeline []Pipeline `yaml:"pipeline"`
+}
+
+// testScriptPath is the path of the test script in the test image.
+const testScriptPath = "/usr/share/melange/test.sh"
+
+// invalidTagChars are the characters of versions which are not allowed
+// in image tags, such as the + of build metadata.
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// testScript returns the script running the steps of the test, with the
+// package and variables substituted.
+func (ctx *Context) testScript() (string, error) {
+	pkg := ctx.Configuration.Package
+	replacements := ctx.Configuration.varReplacements()
+	replacements["${{package.name}}"] = pkg.Name
+	replacements["${{package.version}}"] = pkg.Version
+	replacements["${{package.epoch}}"] = strconv.FormatUint(pkg.Epoch, 10)
+	replacer := replacerFromMap(replacements)
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\nset -e\nexport PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n")
+
+	var add func(steps []Pipeline) error
+	add = func(steps []Pipeline) error {
+		for _, p := range steps {
+			if p.Uses != "" || p.Build != nil || p.Assertions != nil {
+				return fmt.Errorf("test step %s: only runs steps are supported in tests", p.Identity())
+			}
+			if p.Name != "" {
+				fmt.Fprintf(&b, "echo %s\n", strconv.Quote("running test step "+p.Name))
+			}
+			if p.Runs != "" {
+				b.WriteString(replacer.Replace(p.Runs))
+				if !strings.HasSuffix(p.Runs, "\n") {
+					b.WriteString("\n")
+				}
+			}
+			if err := add(p.Pipeline); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := add(ctx.Configuration.Test.Pipeline); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// TestImageName returns the name of the image file written by
+// TestImage to the output directory.
+func (ctx *Context) TestImageName() string {
+	pc := PackageContext{Context: ctx, Origin: &ctx.Configuration.Package, PackageName: ctx.Configuration.Package.Name}
+	return pc.Identity() + ".test-image.tar"
+}
+
+// TestImage builds an OCI image holding the package built from the
+// configuration, with its runtime dependencies and the packages of the
+// test, whose entrypoint runs the test, and writes it to the output
+// directory as <package>-<version>-r<epoch>.test-image.tar, to be loaded
+// with docker load.  The test is then run in the root of the image
+// with the runner.
+func (ctx *Context) TestImage() error {
+	if ctx.Configuration.Test == nil || len(ctx.Configuration.Test.Pipeline) == 0 {
+		return errors.New("the configuration has no test pipeline")
+	}
+
+	script, err := ctx.testScript()
+	if err != nil {
+		return err
+	}
+
+	pkgs, err := ctx.builtPackages()
+	if err != nil {
+		return err
+	}
+	local, external := localClosure(pkgs[0], pkgs)
+
+	guestDir, err := os.MkdirTemp("", "melange-test-*")
+	if err != nil {
+		return fmt.Errorf("unable to make test image directory: %w", err)
+	}
+	defer os.RemoveAll(guestDir)
+
+	workDir, err := os.MkdirTemp("", "melange-test-work-*")
+	if err != nil {
+		return fmt.Errorf("unable to make test workspace directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	env := ctx.Configuration.Environment
+	env.Contents.Packages = append(external, ctx.Configuration.Test.Packages...)
+	log.Printf("installing %s with %s into the test image", pkgs[0].info.Get("pkgname"), strings.Join(env.Contents.Packages, " "))
+	if err := ctx.buildImage(guestDir, env); err != nil {
+		return err
+	}
+	if err := installBuiltPackages(guestDir, local); err != nil {
+		return err
+	}
+
+	if _, err := resolveInRoot(guestDir, "/bin/sh"); err != nil {
+		return errors.New("the test image has no /bin/sh to run the test, add a shell, such as busybox, to the packages of the test")
+	}
+	if err := os.MkdirAll(filepath.Join(guestDir, filepath.Dir(testScriptPath)), 0755); err != nil {
+		return fmt.Errorf("unable to write test script: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(guestDir, testScriptPath), []byte(script), 0755); err != nil {
+		return fmt.Errorf("unable to write test script: %w", err)
+	}
+
+	path := filepath.Join(ctx.OutDir, ctx.TestImageName())
+	if err := ctx.writeTestImage(guestDir, path); err != nil {
+		return fmt.Errorf("unable to write test image: %w", err)
+	}
+	log.Printf("wrote test image %s", path)
+
+	log.Printf("running the test")
+	tctx := *ctx
+	tctx.GuestDir = guestDir
+	tctx.WorkspaceDir = workDir
+	p := Pipeline{Runs: "exec /bin/sh " + testScriptPath}
+	if err := p.evalRun(&PipelineContext{Context: &tctx, Package: &tctx.Configuration.Package}); err != nil {
+		return fmt.Errorf("test failed: %w", err)
+	}
+	log.Printf("test passed")
+
+	return nil
+}
+
+// installBuiltPackages installs packages built from the configuration
+// into an environment.
+func installBuiltPackages(root string, pkgs []builtPackage) error {
+	for _, p := range pkgs {
+		f, err := os.Open(p.path)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = apk.ExtractPackage(f, root)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to install %s: %w", p.path, err)
+		}
+	}
+	return nil
+}
+
+// writeTestImage writes an image of a single layer holding root, whose
+// entrypoint is the test script, to path.
+func (ctx *Context) writeTestImage(root, path string) error {
+	layer, err := os.CreateTemp("", "melange-test-layer-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+
+	tw, err := tarball.NewContext(tarball.WithSourceDateEpoch(ctx.SourceDateEpoch))
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteArchive(root, layer); err != nil {
+		return err
+	}
+	if err := layer.Close(); err != nil {
+		return err
+	}
+
+	v1Layer, err := v1tarball.LayerFromFile(layer.Name())
+	if err != nil {
+		return err
+	}
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer: v1Layer,
+		History: v1.History{
+			CreatedBy: "melange test",
+			Created:   v1.Time{Time: ctx.SourceDateEpoch},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Architecture = runtime.GOARCH
+	cfg.OS = "linux"
+	cfg.Created = v1.Time{Time: ctx.SourceDateEpoch}
+	cfg.Config.Entrypoint = []string{"/bin/sh", testScriptPath}
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		return err
+	}
+
+	pkg := ctx.Configuration.Package
+	tag, err := name.NewTag(fmt.Sprintf("melange-test/%s:%s-r%d", strings.ToLower(pkg.Name), invalidTagChars.ReplaceAllString(pkg.Version, "_"), pkg.Epoch))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return v1tarball.WriteToFile(path, tag, img)
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	v1tarball "github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestTestScript(t *testing.T) {
+	ctx := &Context{}
+	ctx.Configuration.Package = Package{Name: "hello", Version: "2.12", Epoch: 1}
+	ctx.Configuration.Vars = map[string]string{"greeting": "Hello, world!"}
+	ctx.Configuration.Test = &Test{Pipeline: []Pipeline{
+		{Name: "version", Runs: "${{package.name}} --version | grep ${{package.version}}"},
+		{Pipeline: []Pipeline{{Runs: "hello | grep '${{vars.greeting}}'\n"}}},
+	}}
+
+	script, err := ctx.testScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `#!/bin/sh
+set -e
+export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+echo "running test step version"
+hello --version | grep 2.12
+hello | grep 'Hello, world!'
+`
+	if script != want {
+		t.Errorf("testScript() = %q, want %q", script, want)
+	}
+
+	ctx.Configuration.Test.Pipeline = append(ctx.Configuration.Test.Pipeline, Pipeline{Uses: "fetch"})
+	if _, err := ctx.testScript(); err == nil {
+		t.Errorf("testScript() with a uses step succeeded")
+	}
+}
+
+func TestWriteTestImage(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "usr/bin/hello"), "#!/bin/sh\necho hello\n")
+
+	ctx := &Context{SourceDateEpoch: time.Unix(1650000000, 0)}
+	ctx.Configuration.Package = Package{Name: "hello", Version: "2.12+git1", Epoch: 1}
+	if got, want := ctx.TestImageName(), "hello-2.12+git1-r1.test-image.tar"; got != want {
+		t.Errorf("TestImageName() = %q, want %q", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), ctx.TestImageName())
+	if err := ctx.writeTestImage(root, path); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := v1tarball.ImageFromPath(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/bin/sh", testScriptPath}; !reflect.DeepEqual(cfg.Config.Entrypoint, want) {
+		t.Errorf("entrypoint = %q, want %q", cfg.Config.Entrypoint, want)
+	}
+	if !cfg.Created.Time.Equal(ctx.SourceDateEpoch) {
+		t.Errorf("created = %v, want the source date epoch", cfg.Created.Time)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 {
+		t.Errorf("image has %d layers, want 1", len(layers))
+	}
+}
+
+func TestTestImageWithoutTest(t *testing.T) {
+	ctx := &Context{}
+	if err := ctx.TestImage(); err == nil {
+		t.Errorf("TestImage() without a test pipeline succeeded")
+	}
+}
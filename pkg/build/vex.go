@@ -0,0 +1,72 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/sbom"
+	"chainguard.dev/melange/pkg/vex"
+)
+
+// generateVEX writes the OpenVEX document of the advisories of the
+// configuration next to the SBOMs of the package, as
+// vex-<arch>.openvex.json.
+func (pc *PackageContext) generateVEX() error {
+	cfg := &pc.Context.Configuration
+	if len(cfg.Advisories) == 0 {
+		return nil
+	}
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	spec := &vex.Spec{
+		PackageURL: sbom.PackageURL(pc.PackageName, fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch), arch),
+		Config:     cfg.VEX,
+		Advisories: cfg.Advisories,
+		Timestamp:  pc.Context.SourceDateEpoch,
+	}
+	if spec.Config.Author == "" && pc.Origin.Supplier != "" {
+		_, name, _ := strings.Cut(pc.Origin.Supplier, ":")
+		spec.Config.Author = strings.TrimSpace(name)
+	}
+
+	data, err := vex.Generate(spec)
+	if err != nil {
+		return fmt.Errorf("unable to generate OpenVEX document: %w", err)
+	}
+
+	dir := filepath.Join(pc.WorkspaceSubdir(), apk.SBOMDir, pc.Identity())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create SBOM directory: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("vex-%s.%s", arch, apk.VEXExt)), data, 0644); err != nil {
+		return fmt.Errorf("unable to write OpenVEX document: %w", err)
+	}
+
+	if pc.Context.ChecksumManifest {
+		if err := pc.exportArtifact(apk.VEXExt, data); err != nil {
+			return fmt.Errorf("unable to export OpenVEX document: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/vex"
+)
+
+func TestGenerateVEX(t *testing.T) {
+	ctx := &Context{WorkspaceDir: t.TempDir(), OutDir: t.TempDir(), ChecksumManifest: true}
+	ctx.Configuration.Package = Package{Name: "hello", Version: "1.0", Supplier: "Organization: Example, Inc."}
+	ctx.Configuration.Advisories = vex.Advisories{
+		"CVE-2023-0001": {{Status: vex.StatusFixed}},
+	}
+	pc := &PackageContext{Context: ctx, Origin: &ctx.Configuration.Package, PackageName: "hello"}
+
+	if err := pc.generateVEX(); err != nil {
+		t.Fatal(err)
+	}
+
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	data, err := os.ReadFile(filepath.Join(pc.WorkspaceSubdir(), apk.SBOMDir, "hello-1.0-r0", "vex-"+arch+"."+apk.VEXExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Author     string `json:"author"`
+		Statements []struct {
+			Products []struct {
+				ID string `json:"@id"`
+			} `json:"products"`
+		} `json:"statements"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Author != "Example, Inc." || len(doc.Statements) != 1 || doc.Statements[0].Products[0].ID != "pkg:apk/hello@1.0-r0?arch="+arch {
+		t.Errorf("OpenVEX document = %s", data)
+	}
+
+	if _, err := os.Stat(filepath.Join(ctx.OutDir, "hello-1.0-r0."+apk.VEXExt)); err != nil || len(ctx.artifacts) != 1 {
+		t.Errorf("OpenVEX document was not exported: %v", err)
+	}
+}
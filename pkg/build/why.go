@@ -0,0 +1,405 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// DependencyExplanation explains the runtime dependencies of a package
+// built from the configuration.
+type DependencyExplanation struct {
+	// Schema identifies the schema of the explanation, see package
+	// schema.
+	Schema       string             `json:"schema"`
+	Package      string             `json:"package"`
+	Path         string             `json:"path"`
+	Dependencies []DependencyReason `json:"dependencies"`
+}
+
+// DependencyReason explains a runtime dependency of a package.
+type DependencyReason struct {
+	// Dependency is the dependency as recorded in the .PKGINFO, with
+	// a leading ! for conflicts.
+	Dependency string `json:"dependency"`
+	// Line is the line of the configuration file declaring the
+	// dependency, 0 if it was not found there.
+	Line int `json:"line,omitempty"`
+	// Needs lists the files of the package which need a shared
+	// library or a command provided by the dependency, such as
+	// "usr/bin/hello: so:libintl.so.8".
+	Needs []string `json:"needs,omitempty"`
+	// Providers lists the packages which satisfy the dependency: the
+	// packages built from the configuration, or else the packages of
+	// the repositories.
+	Providers []string `json:"providers,omitempty"`
+	// Local is set when the providers are built from the
+	// configuration.
+	Local bool `json:"local,omitempty"`
+}
+
+// provider is a package which may satisfy dependencies.
+type provider struct {
+	name     string
+	provides []string
+}
+
+// fileNeed is a shared library or command needed by a file of a
+// package, as the so: or cmd: name a dependency provides.
+type fileNeed struct {
+	file string
+	name string
+}
+
+// ExplainDependencies explains why a package built from the
+// configuration into the output directory depends on each of its runtime
+// dependencies: the line of the configuration which declares it, the
+// shared libraries needed by its ELF files and the interpreters of its
+// scripts which the dependency provides, and the packages which satisfy
+// it.  Those are looked up in the packages built from the configuration
+// first, then in the given repositories, or the repositories of the
+// environment of the configuration when none are given.
+func (ctx *Context) ExplainDependencies(name string, repositories []string) (*DependencyExplanation, error) {
+	if name == "" {
+		name = ctx.Configuration.Package.Name
+	}
+
+	pkgs, err := ctx.builtPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	var pkg *builtPackage
+	for i := range pkgs {
+		if pkgs[i].info.Get("pkgname") == name {
+			pkg = &pkgs[i]
+		}
+	}
+	if pkg == nil {
+		return nil, fmt.Errorf("package %s is not built from %s into %s", name, ctx.ConfigFile, ctx.OutDir)
+	}
+
+	data, err := os.ReadFile(ctx.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration: %w", err)
+	}
+	lines, err := dependencyLines(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse configuration: %w", err)
+	}
+
+	needs, err := packageNeeds(pkg.path)
+	if err != nil {
+		return nil, err
+	}
+
+	local := []provider{}
+	for _, p := range pkgs {
+		local = append(local, provider{name: p.info.Get("pkgname"), provides: p.info.GetAll("provides")})
+	}
+
+	if len(repositories) == 0 {
+		repositories = ctx.Configuration.Environment.Contents.Repositories
+	}
+	remote, err := ctx.repositoryProviders(repositories)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &DependencyExplanation{
+		Schema:       schema.DependencyExplanation,
+		Package:      name,
+		Path:         pkg.path,
+		Dependencies: []DependencyReason{},
+	}
+	for _, dep := range pkg.info.GetAll("depend") {
+		reason := DependencyReason{
+			Dependency: dep,
+			Line:       lines.find(name, dep),
+		}
+
+		if !strings.HasPrefix(dep, "!") {
+			reason.Providers = satisfying(dep, local)
+			reason.Local = len(reason.Providers) > 0
+			if !reason.Local {
+				reason.Providers = satisfying(dep, remote)
+			}
+
+			for _, need := range needs {
+				if neededFrom(need.name, dep, reason.Providers, local, remote) {
+					reason.Needs = append(reason.Needs, fmt.Sprintf("%s: %s", need.file, need.name))
+				}
+			}
+		}
+
+		explanation.Dependencies = append(explanation.Dependencies, reason)
+	}
+
+	return explanation, nil
+}
+
+// repositoryProviders reads the packages of the indexes of the
+// repositories.
+func (ctx *Context) repositoryProviders(repositories []string) ([]provider, error) {
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+
+	providers := []provider{}
+	for _, repo := range repositories {
+		url := indexURL(repo, arch)
+		data, err := ctx.fetchIndex(url)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch repository index: %w", err)
+		}
+
+		entries, err := apk.ReadIndex(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", url, err)
+		}
+
+		for _, e := range entries {
+			providers = append(providers, provider{name: e.Name(), provides: e.Provides()})
+		}
+	}
+
+	return providers, nil
+}
+
+// satisfying returns the names of the packages which satisfy a
+// dependency, by name or by what they provide, regardless of its version
+// constraint.
+func satisfying(dep string, providers []provider) []string {
+	dep = dependencyName(dep)
+
+	found := map[string]bool{}
+	for _, p := range providers {
+		if p.name == dep {
+			found[p.name] = true
+			continue
+		}
+		for _, provides := range p.provides {
+			if dependencyName(provides) == dep {
+				found[p.name] = true
+				break
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// neededFrom reports whether a so: or cmd: name needed by a file is the
+// dependency itself, or is provided by one of the packages satisfying
+// the dependency.
+func neededFrom(need, dep string, names []string, providerSets ...[]provider) bool {
+	if dependencyName(dep) == need {
+		return true
+	}
+
+	for _, providers := range providerSets {
+		for _, p := range providers {
+			if !containsString(names, p.name) {
+				continue
+			}
+			for _, provides := range p.provides {
+				if dependencyName(provides) == need {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// packageNeeds extracts a package, and returns the shared libraries
+// needed by its ELF files and the interpreters of its scripts.
+func packageNeeds(path string) ([]fileNeed, error) {
+	dir, err := os.MkdirTemp("", "melange-why-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to make extraction directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, files, err := apk.ExtractPackage(f, dir)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract %s: %w", path, err)
+	}
+
+	needs := []fileNeed{}
+	for _, hdr := range files {
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		file := filepath.Join(dir, hdr.Name)
+		if ef, err := openELF(file); err == nil && ef != nil {
+			libs, err := ef.ImportedLibraries()
+			ef.Close()
+			if err != nil {
+				continue
+			}
+			for _, lib := range libs {
+				needs = append(needs, fileNeed{file: hdr.Name, name: "so:" + lib})
+			}
+			continue
+		}
+
+		if hdr.FileInfo().Mode().Perm()&0111 == 0 {
+			continue
+		}
+		if interp := scriptCommand(file); interp != "" {
+			needs = append(needs, fileNeed{file: hdr.Name, name: "cmd:" + interp})
+		}
+	}
+
+	return needs, nil
+}
+
+// scriptCommand returns the name of the command interpreting a script,
+// the program run with env if it is used.
+func scriptCommand(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return ""
+	}
+
+	interp, prog := scriptInterpreter(line)
+	if prog != "" {
+		return prog
+	}
+	if interp == "" {
+		return ""
+	}
+	return filepath.Base(interp)
+}
+
+// configLines maps the names of the packages of a configuration file,
+// as written there, to the lines declaring their dependencies and
+// conflicts.
+type configLines map[string]map[string]int
+
+// find returns the line declaring a dependency of a package, or 0.  The
+// subpackages generated from ranges are not declared under their own
+// names, so any line declaring the same dependency in a subpackage whose
+// name is substituted is returned for them.
+func (cl configLines) find(pkg, dep string) int {
+	if line, ok := cl[pkg][dep]; ok {
+		return line
+	}
+	if _, ok := cl[pkg]; ok {
+		return 0
+	}
+
+	names := []string{}
+	for name := range cl {
+		if strings.Contains(name, "${{") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if line, ok := cl[name][dep]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+// dependencyLines returns the lines of the runtime dependencies and
+// conflicts of the package and subpackages of a configuration file.
+// Conflicts are keyed with a leading !, like in the .PKGINFO.
+func dependencyLines(data []byte) (configLines, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, errors.New("empty configuration")
+	}
+	root := doc.Content[0]
+
+	lines := configLines{}
+	addPackage := func(node *yaml.Node) {
+		name, err := mappingValue(node, "name")
+		if err != nil {
+			return
+		}
+		pkgLines := map[string]int{}
+		lines[name.Value] = pkgLines
+
+		deps, err := mappingValue(node, "dependencies")
+		if err != nil {
+			return
+		}
+
+		for key, prefix := range map[string]string{"runtime": "", "conflicts": "!"} {
+			list, err := mappingValue(deps, key)
+			if err != nil || list.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, item := range list.Content {
+				pkgLines[prefix+item.Value] = item.Line
+			}
+		}
+	}
+
+	if pkg, err := mappingValue(root, "package"); err == nil {
+		addPackage(pkg)
+	}
+	if subpkgs, err := mappingValue(root, "subpackages"); err == nil && subpkgs.Kind == yaml.SequenceNode {
+		for _, sp := range subpkgs.Content {
+			addPackage(sp)
+		}
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/schema"
+)
+
+func TestDependencyLines(t *testing.T) {
+	lines, err := dependencyLines([]byte(`package:
+  name: hello
+  dependencies:
+    runtime:
+      - libintl
+      - python3
+subpackages:
+  - name: hello-doc
+  - name: ${{range.key}}-hello
+    range: flavors
+    dependencies:
+      runtime:
+        - ${{range.value}}
+        - busybox
+      conflicts:
+        - toybox
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		pkg, dep string
+		want     int
+	}{
+		{"hello", "libintl", 5},
+		{"hello", "python3", 6},
+		{"hello", "busybox", 0},
+		{"hello-doc", "busybox", 0},
+		{"small-hello", "busybox", 14},
+		{"small-hello", "!toybox", 16},
+	} {
+		if got := lines.find(tt.pkg, tt.dep); got != tt.want {
+			t.Errorf("find(%q, %q) = %d, want %d", tt.pkg, tt.dep, got, tt.want)
+		}
+	}
+}
+
+func TestSatisfying(t *testing.T) {
+	providers := []provider{
+		{name: "gettext", provides: []string{"so:libintl.so.8=8", "cmd:msgfmt=0.21"}},
+		{name: "musl-libintl", provides: []string{"so:libintl.so.8"}},
+		{name: "python3"},
+	}
+
+	if got, want := satisfying("so:libintl.so.8", providers), []string{"gettext", "musl-libintl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("satisfying() = %v, want %v", got, want)
+	}
+	if got, want := satisfying("python3>=3.10", providers), []string{"python3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("satisfying() = %v, want %v", got, want)
+	}
+	if got := satisfying("perl", providers); len(got) != 0 {
+		t.Errorf("satisfying() = %v, want no providers", got)
+	}
+
+	if !neededFrom("so:libintl.so.8", "gettext", []string{"gettext"}, providers) {
+		t.Error("neededFrom() = false for a library provided by the dependency")
+	}
+	if neededFrom("cmd:python3", "gettext", []string{"gettext"}, providers) {
+		t.Error("neededFrom() = true for a command not provided by the dependency")
+	}
+	if !neededFrom("cmd:python3", "cmd:python3", nil) {
+		t.Error("neededFrom() = false for the dependency itself")
+	}
+}
+
+// writeTarGz writes a gzipped tarball holding the given files.
+func writeTarGz(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	for _, name := range []string{".PKGINFO", "APKINDEX", "usr/bin/hello-py"} {
+		contents, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExplainDependencies(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "packages")
+	repo := filepath.Join(dir, "repo")
+	arch := apko_types.Architecture(runtime.GOARCH).ToAPK()
+	for _, d := range []string{outDir, filepath.Join(repo, arch)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configFile := filepath.Join(dir, "hello.yaml")
+	writeFile(t, configFile, `package:
+  name: hello
+  version: 1.0
+  epoch: 0
+  dependencies:
+    runtime:
+      - python3
+      - busybox
+`)
+
+	writeTarGz(t, filepath.Join(outDir, "hello-1.0-r0.apk"), map[string]string{
+		".PKGINFO":         "pkgname = hello\ndepend = python3\ndepend = busybox\ndepend = !toybox\n",
+		"usr/bin/hello-py": "#!/usr/bin/env python3\nprint('hello')\n",
+	})
+	writeTarGz(t, filepath.Join(repo, arch, "APKINDEX.tar.gz"), map[string]string{
+		"APKINDEX": "P:python-3.11\nV:3.11.4-r0\np:python3=3.11.4-r0 cmd:python3=3.11.4-r0\n\nP:busybox\nV:1.36.1-r0\n\n",
+	})
+
+	ctx := &Context{ConfigFile: configFile, OutDir: outDir}
+	ctx.Configuration.Package = Package{Name: "hello", Version: "1.0"}
+
+	explanation, err := ctx.ExplainDependencies("", []string{repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DependencyReason{{
+		Dependency: "python3",
+		Line:       7,
+		Needs:      []string{"usr/bin/hello-py: cmd:python3"},
+		Providers:  []string{"python-3.11"},
+	}, {
+		Dependency: "busybox",
+		Line:       8,
+		Providers:  []string{"busybox"},
+	}, {
+		Dependency: "!toybox",
+	}}
+	if !reflect.DeepEqual(explanation.Dependencies, want) {
+		t.Errorf("ExplainDependencies() = %+v, want %+v", explanation.Dependencies, want)
+	}
+
+	data, err := json.Marshal(explanation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate(explanation.Schema, data); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ctx.ExplainDependencies("hello-dev", []string{repo}); err == nil {
+		t.Error("ExplainDependencies() succeeded for a package which was not built")
+	}
+}
@@ -17,9 +17,13 @@ package cli
 import (
 	"context"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/sbom"
 	"github.com/spf13/cobra"
 )
 
@@ -27,22 +31,159 @@ func Build() *cobra.Command {
 	var buildDate string
 	var workspaceDir string
 	var pipelineDir string
+	var overlayPipelineDirs []string
+	var outDir string
+	var outputLayout string
+	var cacheDir string
+	var repositoryPinsFile string
+	var repositorySnapshot string
+	var snapshotDir string
+	var httpProxy string
+	var httpsProxy string
+	var noProxy string
+	var caCertFile string
+	var netrcFile string
 	var signingKey string
+	var signingServer string
+	var signingClientCert string
+	var signingClientKey string
+	var signingServerCA string
+	var signingKMS string
+	var timestampURL string
 	var useProot bool
+	var runner string
+	var settingsFile string
+	var sbomGenerators []string
+	var sbomFormats []string
+	var sbomChecksums []string
+	var sbomAttestation bool
+	var sbomCheckNTIA bool
+	var sbomStrict bool
+	var sbomSkipSymlinks bool
+	var sbomBuildEnvironment bool
+	var dependencyTrackURL string
+	var checksumManifest bool
+	var apkoFragment bool
+	var digests []string
+	var plugins []string
+	var epochFromGit bool
+	var force bool
+	var publishedRepository string
+	var locale string
+	var timezone string
+	var passEnv []string
+	var readOnlyRoot bool
+	var goCacheSize int64
+	var javaCacheSize int64
+	var stepCacheSize int64
+	var mavenRepository string
+	var remoteCache string
+	var remoteCacheMode string
+	var keepGoing bool
+	var jobs int
+	var showProgress bool
 
 	cmd := &cobra.Command{
-		Use:     "build",
-		Short:   "Build a package from a YAML configuration file",
-		Long:    `Build a package from a YAML configuration file.`,
-		Example: `  melange build [config.yaml]`,
+		Use:   "build",
+		Short: "Build a package from a YAML configuration file",
+		Long: `Build a package from a YAML configuration file.
+
+When several configuration files are given, they are built in an order
+where packages needed by the build environment of another configuration
+are built first.  The build environments are still resolved from the
+configured repositories, so packages built earlier in the same run are
+only used if one of those repositories serves the output directory.
+
+Builds of the same run can pass files, such as a bootstrap compiler, to
+each other without publishing them as packages, with the artifacts
+exports and imports of their configurations.`,
+		Example: `  melange build [config.yaml...]`,
 		Args:    cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			// mask repository credentials in the output of melange,
+			// apko and apk.
+			log.SetOutput(build.NewRedactingWriter(log.Writer()))
+
+			for _, path := range plugins {
+				if err := build.LoadPlugin(path); err != nil {
+					return err
+				}
+			}
+
 			options := []build.Option{
 				build.WithBuildDate(buildDate),
 				build.WithWorkspaceDir(workspaceDir),
 				build.WithPipelineDir(pipelineDir),
+				build.WithOverlayPipelineDirs(overlayPipelineDirs),
+				build.WithSettingsFile(settingsFile),
+				build.WithOutDir(outDir),
+				build.WithOutputLayout(outputLayout),
+				build.WithCacheDir(cacheDir),
+				build.WithGoCacheSize(goCacheSize << 20),
+				build.WithJavaCacheSize(javaCacheSize << 20),
+				build.WithStepCacheSize(stepCacheSize << 20),
+				build.WithMavenRepository(mavenRepository),
+				build.WithRemoteCache(remoteCache, remoteCacheMode),
+				build.WithRepositoryPinsFile(repositoryPinsFile),
+				build.WithRepositorySnapshot(repositorySnapshot, snapshotDir),
+				build.WithProxy(httpProxy, httpsProxy, noProxy),
+				build.WithCACertFile(caCertFile),
+				build.WithNetrcFile(netrcFile),
 				build.WithSigningKey(signingKey),
+				build.WithSigningServer(signingServer, signingClientCert, signingClientKey, signingServerCA),
+				build.WithSigningKMS(signingKMS),
+				build.WithTimestampURL(timestampURL),
 				build.WithUseProot(useProot),
+				build.WithRunner(runner),
+				build.WithSBOMGenerators(sbomGenerators),
+				build.WithSBOMFormats(sbomFormats),
+				build.WithSBOMChecksums(sbomChecksums),
+				build.WithSBOMAttestation(sbomAttestation),
+				build.WithSBOMCheckNTIA(sbomCheckNTIA),
+				build.WithSBOMStrict(sbomStrict),
+				build.WithSBOMSkipSymlinks(sbomSkipSymlinks),
+				build.WithSBOMBuildEnvironment(sbomBuildEnvironment),
+				build.WithDependencyTrack(dependencyTrackURL),
+				build.WithChecksumManifest(checksumManifest),
+				build.WithApkoFragment(apkoFragment),
+				build.WithDigests(digests),
+				build.WithEpochFromGit(epochFromGit),
+				build.WithForce(force),
+				build.WithPublishedRepository(publishedRepository),
+				build.WithLocale(locale),
+				build.WithTimezone(timezone),
+				build.WithPassEnv(passEnv),
+				build.WithReadOnlyRoot(readOnlyRoot),
+			}
+
+			if len(args) > 1 {
+				batchOptions := []build.BatchOption{
+					build.WithBuildOptions(options...),
+					build.WithKeepGoing(keepGoing),
+					build.WithJobs(jobs),
+				}
+
+				var batchLog *os.File
+				if showProgress && isTerminal(os.Stderr) {
+					// the log is listed in the checksum manifest,
+					// which only covers the output directory.
+					logDir := workspaceDir
+					if checksumManifest {
+						logDir = outDir
+					}
+
+					logFile := filepath.Join(logDir, "melange-batch.log")
+					f, err := os.Create(logFile)
+					if err != nil {
+						return fmt.Errorf("unable to create build log: %w", err)
+					}
+					batchLog = f
+
+					log.SetOutput(build.NewRedactingWriter(f))
+					batchOptions = append(batchOptions, build.WithProgress(os.Stderr, logFile))
+				}
+
+				return BuildBatchCmd(cmd.Context(), args, batchLog, batchOptions...)
 			}
 
 			if len(args) > 0 {
@@ -59,14 +200,82 @@ func Build() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
-	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", cwd, "directory used for the workspace at /home/build")
+	cmd.Flags().BoolVar(&epochFromGit, "source-date-epoch-from-git", false, "derive the timestamps of the files inside the package from the last git commit of the configuration file")
+	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", cwd, "directory used for the workspace at /home/build, when building several configurations each one uses the subdirectory named after its package")
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "/usr/share/melange/pipelines", "directory used to store defined pipelines")
+	cmd.Flags().StringSliceVar(&overlayPipelineDirs, "overlay-pipeline-dir", []string{}, "directories with pipelines which override individual built-in pipelines")
+	cmd.Flags().StringVar(&settingsFile, "settings", "", "settings file with the repositories, keyrings, vars, annotations and signing configuration shared by the configurations, by default the melange.yaml next to the configuration file or in its closest parent directory")
+	cmd.Flags().StringVar(&outDir, "out-dir", ".", "directory where packages will be output")
+	cmd.Flags().StringVar(&outputLayout, "output-layout", build.OutputLayoutFlat, "layout of the packages in the output directory: flat, or content-addressed to write them as sha256/<digest>.apk, linked from their names")
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", defaultCacheDir(), "directory used to keep data between builds, such as build times")
+	cmd.Flags().Int64Var(&goCacheSize, "go-cache-size", 10<<10, "maximum size in MiB of the module and build caches of the Go toolchains kept in the cache directory, 0 disables them")
+	cmd.Flags().Int64Var(&stepCacheSize, "step-cache-size", 0, "maximum size in MiB of the outputs of the steps of the main pipelines kept in the cache directory, which are restored instead of running the steps again, 0 disables them")
+	cmd.Flags().Int64Var(&javaCacheSize, "java-cache-size", 10<<10, "maximum size in MiB of the Maven and Gradle caches kept in the cache directory, 0 disables them")
+	cmd.Flags().StringVar(&mavenRepository, "maven-repository", "", "directory of an offline Maven repository which Maven and Gradle resolve the artifacts from instead of the network")
+	cmd.Flags().StringVar(&remoteCache, "remote-cache", "", "URL of a cache of the fetched sources and step outputs shared by builders, such as file:///srv/cache, https://cache.example.com, s3://bucket/prefix, gs://bucket/prefix or oci://registry/repository")
+	cmd.Flags().StringVar(&remoteCacheMode, "remote-cache-mode", build.RemoteCacheReadOnly, "whether the fetched sources and step outputs are also stored in the remote cache (read-only, read-write)")
+	cmd.Flags().StringVar(&repositoryPinsFile, "repository-pins", "", "file with the expected digests of the repository indexes, new repositories are pinned on first use")
+	cmd.Flags().StringVar(&repositorySnapshot, "repository-snapshot", "", "resolve the build environment from a repository snapshot, given its timestamp or the path of its directory or manifest")
+	cmd.Flags().StringVar(&snapshotDir, "snapshot-dir", "./snapshots/", "directory of the repository snapshots recorded by melange index snapshot")
+	cmd.Flags().StringVar(&httpProxy, "http-proxy", "", "proxy used for HTTP requests, including inside the build environment")
+	cmd.Flags().StringVar(&httpsProxy, "https-proxy", "", "proxy used for HTTPS requests, including inside the build environment")
+	cmd.Flags().StringVar(&noProxy, "no-proxy", "", "comma-separated list of hosts which are accessed without a proxy")
+	cmd.Flags().StringVar(&caCertFile, "ca-cert-file", "", "file with additional PEM encoded CA certificates to trust, including inside the build environment")
+	cmd.Flags().StringVar(&netrcFile, "netrc", "", "netrc file with the credentials of the package repositories, in addition to the ones of $HTTP_AUTH")
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
+	cmd.Flags().StringVar(&signingServer, "signing-server", "", "URL of a signing service (see melange sign-server) to sign with instead of a local key")
+	cmd.Flags().StringVar(&signingClientCert, "signing-client-cert", "", "TLS client certificate used to authenticate to the signing service")
+	cmd.Flags().StringVar(&signingClientKey, "signing-client-key", "", "TLS client key used to authenticate to the signing service")
+	cmd.Flags().StringVar(&signingServerCA, "signing-server-ca", "", "CA certificates used to verify the signing service, instead of the system roots")
+	cmd.Flags().StringVar(&signingKMS, "signing-kms", "", "URL of an Azure Key Vault key to sign with instead of a local key, https://<vault>/keys/<name>[/<version>]")
+	cmd.Flags().StringVar(&timestampURL, "timestamp-url", "", "URL of an RFC 3161 time-stamping authority which timestamps the signatures of the packages")
 	cmd.Flags().BoolVar(&useProot, "use-proot", false, "whether to use proot for fakeroot")
+	cmd.Flags().StringVar(&runner, "runner", "bubblewrap", "runner used to run the build pipelines")
+	cmd.Flags().StringSliceVar(&sbomGenerators, "sbom-generator", []string{}, "SBOM generators to run for every package")
+	cmd.Flags().StringSliceVar(&sbomFormats, "sbom-format", []string{sbom.FormatSPDX}, fmt.Sprintf("formats of the SBOMs of the melange SBOM generator (%s)", strings.Join(sbom.NewGenerator().Formats(), ", ")))
+	cmd.Flags().StringSliceVar(&sbomChecksums, "sbom-checksum", []string{sbom.ChecksumSHA1, sbom.ChecksumSHA256}, "checksum algorithms of the files listed in the SBOMs (sha1, sha256, sha512), sha256 is required")
+	cmd.Flags().BoolVar(&sbomCheckNTIA, "sbom-ntia", false, "warn about the NTIA minimum elements, such as the supplier, missing from the SBOMs")
+	cmd.Flags().BoolVar(&sbomStrict, "sbom-strict", false, "fail the build when the SBOMs do not meet the NTIA minimum elements")
+	cmd.Flags().BoolVar(&sbomSkipSymlinks, "sbom-skip-symlinks", false, "leave the symbolic links of the packages out of the SBOMs")
+	cmd.Flags().BoolVar(&sbomBuildEnvironment, "sbom-build-environment", false, "write an SPDX SBOM of the build environment next to the packages, which their SPDX SBOMs reference as a build dependency")
+	cmd.Flags().BoolVar(&sbomAttestation, "sbom-attest", false, "sign the SPDX SBOMs with the signing key and store an in-toto attestation of them in the packages")
+	cmd.Flags().StringVar(&dependencyTrackURL, "dependency-track-url", "", "upload the SBOMs of the melange SBOM generator to this Dependency-Track server, with the API key of $DEPENDENCY_TRACK_API_KEY")
+	cmd.Flags().BoolVar(&checksumManifest, "checksum-manifest", false, "write a SHA256SUMS manifest of the packages, SBOMs and build log written to the output directory, signed with the signing key, the SBOMs of the melange SBOM generator are also written next to the packages")
+	cmd.Flags().BoolVar(&apkoFragment, "apko-fragment", false, "write an apko configuration fragment installing the packages, <package>-<version>-r<epoch>.apko.yaml, and a lock of their digests, <package>-<version>-r<epoch>.apko.lock.json, next to them")
+	cmd.Flags().StringSliceVar(&digests, "digest", []string{}, "digest algorithms recorded in the packages in addition to the SHA1 digests of their files and the SHA256 datahash, for the apk versions which verify them (sha256, sha512), the ones of the settings of the repository if unset")
+	cmd.Flags().StringSliceVar(&plugins, "plugin", []string{}, "Go plugins to load, which can provide runners and SBOM generators")
+	cmd.Flags().StringVar(&locale, "locale", "C.UTF-8", "locale of the pipelines (LANG and LC_ALL), unless the package sets its own")
+	cmd.Flags().StringVar(&timezone, "timezone", "UTC", "timezone of the pipelines (TZ), unless the package sets its own")
+	cmd.Flags().BoolVar(&readOnlyRoot, "read-only-root", false, "mount the root of the build environments read-only, except for the workspace, /tmp and the writable directories of the sandbox of the packages")
+	cmd.Flags().StringSliceVar(&passEnv, "pass-env", []string{}, "environment variables of the host to pass through to the pipelines, whose digests are recorded in the packages")
+	cmd.Flags().BoolVar(&force, "force", false, "overwrite existing packages which have different contents")
+	cmd.Flags().StringVar(&publishedRepository, "published-repository", "", "repository the packages are published to, whose packages of the same version and epoch must have been built from the same configuration, unless --force is given")
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "number of configurations to build at the same time")
+	cmd.Flags().BoolVar(&showProgress, "progress", false, "when building several configurations on a terminal, show the state of every build instead of the log, which is written to melange-batch.log in the workspace directory, or the output directory with --checksum-manifest")
+	cmd.Flags().BoolVarP(&keepGoing, "keep-going", "k", false, "when building several configurations, keep building the packages which do not depend on a failed build")
 
 	return cmd
 }
 
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// defaultCacheDir returns the melange directory in the user cache
+// directory, or an empty string if there is none.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "melange")
+}
+
 func BuildCmd(ctx context.Context, opts ...build.Option) error {
 	bc, err := build.New(opts...)
 	if err != nil {
@@ -77,5 +286,35 @@ func BuildCmd(ctx context.Context, opts ...build.Option) error {
 		return fmt.Errorf("failed to build package: %w", err)
 	}
 
-	return nil
+	return bc.WriteChecksumManifest()
+}
+
+// BuildBatchCmd builds the configuration files as a batch.  batchLog is
+// the file the log is written to, if any, which is closed once the
+// batch is built and listed in its checksum manifest.
+func BuildBatchCmd(ctx context.Context, configFiles []string, batchLog *os.File, opts ...build.BatchOption) error {
+	if batchLog != nil {
+		defer batchLog.Close()
+	}
+
+	b, err := build.NewBatch(configFiles, opts...)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Run(); err != nil {
+		return fmt.Errorf("failed to build packages: %w", err)
+	}
+
+	extra := []string{}
+	if batchLog != nil {
+		// the log cannot change once its checksum is taken.
+		log.SetOutput(build.NewRedactingWriter(os.Stderr))
+		if err := batchLog.Close(); err != nil {
+			return fmt.Errorf("unable to write build log: %w", err)
+		}
+		extra = append(extra, batchLog.Name())
+	}
+
+	return b.WriteChecksumManifest(extra...)
 }
@@ -0,0 +1,57 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Bump() *cobra.Command {
+	var epoch bool
+	var version string
+
+	cmd := &cobra.Command{
+		Use:   "bump",
+		Short: "Update the version or epoch of a package configuration",
+		Long: `Update the version or epoch of a package configuration.
+
+Setting a new version resets the epoch to 0.  Bumping the epoch is
+needed when the configuration changed but the version did not, so that
+the new package does not replace an already published one.`,
+		Example: `  melange bump --epoch config.yaml
+  melange bump --version 2.13 config.yaml`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if epoch == (version != "") {
+				return errors.New("exactly one of --epoch and --version must be given")
+			}
+
+			if err := build.BumpConfig(args[0], version); err != nil {
+				return fmt.Errorf("failed to bump %s: %w", args[0], err)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&epoch, "epoch", false, "increment the epoch of the package")
+	cmd.Flags().StringVar(&version, "version", "", "new version of the package")
+
+	return cmd
+}
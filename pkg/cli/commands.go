@@ -27,6 +27,19 @@ func New() *cobra.Command {
 	}
 
 	cmd.AddCommand(Build())
+	cmd.AddCommand(Bump())
+	cmd.AddCommand(CompareConfig())
+	cmd.AddCommand(Group())
+	cmd.AddCommand(Index())
+	cmd.AddCommand(Info())
+	cmd.AddCommand(Plugin())
+	cmd.AddCommand(Resign())
+	cmd.AddCommand(SBOM())
+	cmd.AddCommand(Scan())
+	cmd.AddCommand(Schema())
+	cmd.AddCommand(SignServer())
+	cmd.AddCommand(Test())
+	cmd.AddCommand(Why())
 	cmd.AddCommand(version.Version())
 	return cmd
 }
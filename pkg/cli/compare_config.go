@@ -0,0 +1,120 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func CompareConfig() *cobra.Command {
+	var from, to string
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "compare-config",
+		Short: "Compare two package configurations",
+		Long: `Compare two package configurations.
+
+The settings of the configurations are compared, whatever their formatting,
+comments and order: the changed package metadata, dependencies, packages
+of the environment, vars, pipelines and subpackages are printed.  Lists
+of values are compared as sets, subpackages by name, and the steps of the
+pipelines in order.
+
+Either two configuration files are compared, or two git revisions of one,
+with --from and --to, which defaults to the working tree.`,
+		Example: `  melange compare-config old/hello.yaml hello.yaml
+  melange compare-config --from HEAD~1 hello.yaml`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var oldFile, newFile, oldRev, newRev string
+			switch {
+			case len(args) == 2 && from == "" && to == "":
+				oldFile, newFile = args[0], args[1]
+			case len(args) == 1 && from != "":
+				oldFile, newFile = args[0], args[0]
+				oldRev, newRev = from, to
+			default:
+				return errors.New("either two configuration files, or one with --from, must be given")
+			}
+
+			old, err := build.LoadConfigRevision(oldFile, oldRev)
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %w", oldFile, err)
+			}
+			new, err := build.LoadConfigRevision(newFile, newRev)
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %w", newFile, err)
+			}
+
+			changes, err := build.CompareConfigs(old, new)
+			if err != nil {
+				return fmt.Errorf("failed to compare the configurations: %w", err)
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(changes)
+			}
+
+			printConfigChanges(cmd.OutOrStdout(), changes)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&from, "from", "", "git revision of the configuration to compare")
+	cmd.Flags().StringVar(&to, "to", "", "git revision of the configuration to compare with, the working tree by default")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the changes as JSON")
+
+	return cmd
+}
+
+// printConfigChanges prints the added settings with a +, the removed ones
+// with a - and the changed ones with a ~, followed by the lines of their
+// multi-line values, such as scripts.
+func printConfigChanges(w io.Writer, changes []build.ConfigChange) {
+	for _, c := range changes {
+		switch {
+		case strings.Contains(c.Old, "\n") || strings.Contains(c.New, "\n"):
+			fmt.Fprintf(w, "~ %s:\n", c.Path)
+			printValueLines(w, "-", c.Old)
+			printValueLines(w, "+", c.New)
+		case c.Kind() == "added":
+			fmt.Fprintf(w, "+ %s: %s\n", c.Path, c.New)
+		case c.Kind() == "removed":
+			fmt.Fprintf(w, "- %s: %s\n", c.Path, c.Old)
+		default:
+			fmt.Fprintf(w, "~ %s: %s -> %s\n", c.Path, c.Old, c.New)
+		}
+	}
+}
+
+// printValueLines prints the lines of a value, if any, after a marker.
+func printValueLines(w io.Writer, marker, value string) {
+	if value == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(value, "\n"), "\n") {
+		fmt.Fprintf(w, "    %s %s\n", marker, line)
+	}
+}
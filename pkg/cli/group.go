@@ -0,0 +1,92 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Group() *cobra.Command {
+	var repositoryDir string
+	var selectors []string
+	var metapackage string
+	var version string
+	var description string
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "group",
+		Short: "Generate an installation set from the annotations of the packages of a repository",
+		Long: `Generate an installation set from the annotations of the packages of a repository.
+
+The packages of the repository directory are selected by the annotations
+recorded in their .PKGINFO: key=value selects the packages annotated with
+the value, key!=value the other ones, and key the packages with the
+annotation.  A package must match every selector.
+
+The names of the selected packages are written as an apk world file,
+or, with --metapackage, as the configuration of a metapackage depending
+on them, which melange builds like any other configuration.`,
+		Example: `  melange group --repository-dir packages/x86_64 --select tier=base > world
+  melange group --repository-dir packages/x86_64 --select tier=base --metapackage base --version 1.0 --output base.yaml`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if metapackage != "" && version == "" {
+				return errors.New("--version must be given with --metapackage")
+			}
+
+			q, err := build.ParsePackageQuery(selectors)
+			if err != nil {
+				return err
+			}
+
+			names, err := build.QueryRepository(repositoryDir, q)
+			if err != nil {
+				return fmt.Errorf("failed to query %s: %w", repositoryDir, err)
+			}
+			if len(names) == 0 {
+				return fmt.Errorf("no package of %s matches the selectors", repositoryDir)
+			}
+
+			data := build.WorldFile(names)
+			if metapackage != "" {
+				data, err = build.GroupConfig(metapackage, version, description, names)
+				if err != nil {
+					return fmt.Errorf("failed to generate metapackage %s: %w", metapackage, err)
+				}
+			}
+
+			if output == "" {
+				_, err := cmd.OutOrStdout().Write(data)
+				return err
+			}
+			return os.WriteFile(output, data, 0644)
+		},
+	}
+
+	cmd.Flags().StringVar(&repositoryDir, "repository-dir", ".", "directory of the packages to select from")
+	cmd.Flags().StringSliceVar(&selectors, "select", []string{}, "annotation selectors of the packages, such as tier=base")
+	cmd.Flags().StringVar(&metapackage, "metapackage", "", "name of the metapackage to generate, instead of a world file")
+	cmd.Flags().StringVar(&version, "version", "", "version of the metapackage")
+	cmd.Flags().StringVar(&description, "description", "", "description of the metapackage")
+	cmd.Flags().StringVar(&output, "output", "", "file written, instead of the standard output")
+
+	return cmd
+}
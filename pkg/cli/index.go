@@ -0,0 +1,201 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Index() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "index",
+		Short: "Manage repository indexes",
+	}
+
+	cmd.AddCommand(IndexSnapshot())
+	cmd.AddCommand(IndexDeprecations())
+	cmd.AddCommand(IndexOrigins())
+	return cmd
+}
+
+func IndexSnapshot() *cobra.Command {
+	var outDir string
+	var archs []string
+	var netrcFile string
+
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Record the current indexes of the repositories of a build environment",
+		Long: `Record the current indexes of the repositories of a build environment.
+
+The APKINDEX of every repository of the environment of the configuration
+is copied into a new read-only directory of the output directory, named
+after the UTC time of the snapshot, e.g. 20220601T123000Z.  The snapshot
+includes a manifest.json listing the name, version and checksum of every
+package of the indexes.
+
+Existing snapshots are never overwritten.`,
+		Example: `  melange index snapshot --arch x86_64,aarch64 --out-dir snapshots config.yaml`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := build.New(
+				build.WithConfig(args[0]),
+				build.WithNetrcFile(netrcFile),
+			)
+			if err != nil {
+				return err
+			}
+
+			dir, err := ctx.SnapshotIndexes(outDir, archs, time.Now())
+			if err != nil {
+				return fmt.Errorf("failed to snapshot repository indexes: %w", err)
+			}
+
+			fmt.Fprintln(cmd.OutOrStdout(), dir)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&outDir, "out-dir", "./snapshots/", "directory where snapshots are written")
+	cmd.Flags().StringSliceVar(&archs, "arch", []string{}, "architectures of the indexes to record, the host architecture if unset")
+	cmd.Flags().StringVar(&netrcFile, "netrc", "", "netrc file with the credentials of the package repositories, in addition to the ones of $HTTP_AUTH")
+
+	return cmd
+}
+
+func IndexDeprecations() *cobra.Command {
+	var repositoryDir string
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "deprecations",
+		Short: "Report the deprecated packages of a repository",
+		Long: `Report the deprecated packages of a repository.
+
+Every version of the packages of the repository directory whose
+configuration marks them as deprecated is listed, with the reason of the
+deprecation, the replacement and the end of life of the package, soonest
+end of life first.`,
+		Example: `  melange index deprecations --repository-dir packages/x86_64`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := build.DeprecationReport(repositoryDir)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", repositoryDir, err)
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(report)
+			}
+
+			for _, p := range report {
+				details := []string{}
+				if p.EndOfLife != "" {
+					details = append(details, "end of life on "+p.EndOfLife)
+				}
+				if p.Replacement != "" {
+					details = append(details, "replaced by "+p.Replacement)
+				}
+				if p.Reason != "" {
+					details = append(details, p.Reason)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s-%s: %s\n", p.Name, p.Version, strings.Join(append([]string{"deprecated"}, details...), "; "))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&repositoryDir, "repository-dir", ".", "directory of the packages to report on")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the report as JSON")
+
+	return cmd
+}
+
+func IndexOrigins() *cobra.Command {
+	var repositoryDir string
+	var skewOnly bool
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "origins",
+		Short: "Report the packages of a repository by origin",
+		Long: `Report the packages of a repository by origin.
+
+The packages of the repository directory are grouped by origin, the
+package built with them from the same configuration.  For every origin,
+the versions of the origin package, the number of subpackages and the
+total size of the packages, archived and installed, are printed.
+
+The subpackages whose versions are not the ones of their origin package,
+such as subpackages left behind when the origin package was updated, are
+reported as version skew.`,
+		Example: `  melange index origins --repository-dir packages/x86_64 --skew-only`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			origins, err := build.OriginsReport(repositoryDir)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", repositoryDir, err)
+			}
+
+			if skewOnly {
+				skewed := []build.OriginReport{}
+				for _, o := range origins {
+					if len(o.Skew) > 0 {
+						skewed = append(skewed, o)
+					}
+				}
+				origins = skewed
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(origins)
+			}
+
+			w := cmd.OutOrStdout()
+			for _, o := range origins {
+				versions := strings.Join(o.Versions, ", ")
+				if versions == "" {
+					versions = "origin package missing"
+				}
+				fmt.Fprintf(w, "%s (%s): %d subpackages, %d bytes, %d bytes installed\n", o.Origin, versions, o.Subpackages, o.Size, o.InstalledSize)
+				for _, s := range o.Skew {
+					if len(s.Missing) > 0 {
+						fmt.Fprintf(w, "  skew: %s lacks %s\n", s.Package, strings.Join(s.Missing, ", "))
+					}
+					if len(s.Extra) > 0 {
+						fmt.Fprintf(w, "  skew: %s has %s\n", s.Package, strings.Join(s.Extra, ", "))
+					}
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&repositoryDir, "repository-dir", ".", "directory of the packages to report on")
+	cmd.Flags().BoolVar(&skewOnly, "skew-only", false, "only report the origins whose subpackages are out of sync")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the report as JSON")
+
+	return cmd
+}
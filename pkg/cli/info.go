@@ -0,0 +1,330 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"archive/tar"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/schema"
+	"github.com/spf13/cobra"
+)
+
+// packageSummary is the description of a package printed by melange info.
+type packageSummary struct {
+	// Schema identifies the schema of the description, see package
+	// schema.
+	Schema       string      `json:"schema"`
+	Path         string      `json:"path"`
+	PackageInfo  []apk.Field `json:"pkginfo"`
+	Dependencies []string    `json:"dependencies"`
+	Provides     []string    `json:"provides"`
+	Scripts      []string    `json:"scripts"`
+	Files        int         `json:"files"`
+	Directories  int         `json:"directories"`
+	Symlinks     int         `json:"symlinks"`
+	// DataSize is the size of the regular files of the package.
+	DataSize      int64 `json:"data_size"`
+	DataHashValid bool  `json:"datahash_valid"`
+	// DataHashes holds the validity of the additional digests of the
+	// data section recorded in the .PKGINFO, keyed by algorithm.
+	DataHashes map[string]bool `json:"datahashes,omitempty"`
+	SBOMs      []sbomSummary   `json:"sboms"`
+	Signatures []signature     `json:"signatures"`
+}
+
+type sbomSummary struct {
+	Path     string `json:"path"`
+	Format   string `json:"format"`
+	Name     string `json:"name,omitempty"`
+	Packages int    `json:"packages"`
+}
+
+type signature struct {
+	KeyName string `json:"key_name"`
+	// Status is "verified", "invalid", or "unverified" when no key
+	// with the name of the signing key was given.
+	Status string `json:"status"`
+	// Timestamp is the time at which the signature existed, according
+	// to its RFC 3161 time-stamp token, if it has one.
+	Timestamp string `json:"timestamp,omitempty"`
+	// TimestampStatus is "verified", "invalid", or "unverified" when no
+	// --timestamp-ca was given to verify the time-stamping authority.
+	TimestampStatus string `json:"timestamp_status,omitempty"`
+}
+
+func Info() *cobra.Command {
+	var keys []string
+	var asJSON bool
+	var timestampCA string
+
+	cmd := &cobra.Command{
+		Use:   "info",
+		Short: "Describe apk packages",
+		Long: `Describe apk packages.
+
+The .PKGINFO, dependencies, install scripts, file statistics and SBOMs of
+each package are printed, along with the status of its signatures.
+Signatures are verified with the public keys given with --key, which are
+matched by file name.  The time-stamping authorities of the timestamps of
+the signatures are verified with the CA certificates of --timestamp-ca.`,
+		Example: `  melange info --key melange.rsa.pub hello-2.12-r0.apk`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var roots *x509.CertPool
+			if timestampCA != "" {
+				var err error
+				if roots, err = sign.LoadCertPool(timestampCA); err != nil {
+					return err
+				}
+			}
+
+			summaries := []*packageSummary{}
+			for _, path := range args {
+				summary, err := summarizePackage(path, keys, roots)
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", path, err)
+				}
+				summaries = append(summaries, summary)
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(summaries)
+			}
+
+			for _, summary := range summaries {
+				printSummary(cmd.OutOrStdout(), summary)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&keys, "key", []string{}, "public keys verifying the package signatures")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the descriptions as JSON")
+	cmd.Flags().StringVar(&timestampCA, "timestamp-ca", "", "CA certificates verifying the time-stamping authorities of the signature timestamps")
+
+	return cmd
+}
+
+func summarizePackage(path string, keys []string, roots *x509.CertPool) (*packageSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pkg, err := apk.ReadPackage(f)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &packageSummary{
+		Schema:        schema.PackageInfo,
+		Path:          path,
+		PackageInfo:   pkg.Info.Fields,
+		Dependencies:  pkg.Info.GetAll("depend"),
+		Provides:      pkg.Info.GetAll("provides"),
+		Scripts:       []string{},
+		SBOMs:         []sbomSummary{},
+		Signatures:    []signature{},
+		DataHashValid: pkg.Info.Get("datahash") == hex.EncodeToString(pkg.DataDigest),
+	}
+
+	for alg, digest := range pkg.Info.DataHashes() {
+		if alg == "sha256" {
+			continue
+		}
+		if summary.DataHashes == nil {
+			summary.DataHashes = map[string]bool{}
+		}
+		summary.DataHashes[alg] = digest == hex.EncodeToString(pkg.DataDigests[alg])
+	}
+
+	for name := range pkg.Scripts {
+		summary.Scripts = append(summary.Scripts, name)
+	}
+	sort.Strings(summary.Scripts)
+
+	for _, hdr := range pkg.Files {
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			summary.Directories++
+		case tar.TypeSymlink:
+			summary.Symlinks++
+		default:
+			summary.Files++
+			summary.DataSize += hdr.Size
+		}
+	}
+
+	for sbomPath, data := range pkg.SBOMs {
+		summary.SBOMs = append(summary.SBOMs, summarizeSBOM(sbomPath, data))
+	}
+	sort.Slice(summary.SBOMs, func(i, j int) bool { return summary.SBOMs[i].Path < summary.SBOMs[j].Path })
+
+	for keyName, sig := range pkg.Signatures {
+		status := "unverified"
+		for _, key := range keys {
+			if filepath.Base(key) != keyName {
+				continue
+			}
+
+			status = "verified"
+			if err := sign.RSAVerifySHA1Digest(pkg.ControlDigest, sig, key); err != nil {
+				status = "invalid"
+			}
+			break
+		}
+
+		s := signature{KeyName: keyName, Status: status}
+		if token, ok := pkg.Timestamps[keyName]; ok {
+			s.Timestamp, s.TimestampStatus = summarizeTimestamp(token, sig, roots)
+		}
+		summary.Signatures = append(summary.Signatures, s)
+	}
+	sort.Slice(summary.Signatures, func(i, j int) bool { return summary.Signatures[i].KeyName < summary.Signatures[j].KeyName })
+
+	return summary, nil
+}
+
+// summarizeTimestamp returns the time of the time-stamp token of a
+// signature, and its status.
+func summarizeTimestamp(token, sig []byte, roots *x509.CertPool) (string, string) {
+	t, err := sign.VerifyTimestamp(token, sig, nil)
+	if err != nil {
+		return "", "invalid"
+	}
+	if roots == nil {
+		return t.UTC().Format(time.RFC3339), "unverified"
+	}
+	if _, err := sign.VerifyTimestamp(token, sig, roots); err != nil {
+		return t.UTC().Format(time.RFC3339), "invalid"
+	}
+	return t.UTC().Format(time.RFC3339), "verified"
+}
+
+// summarizeSBOM recognizes SPDX 2, SPDX 3 JSON-LD and CycloneDX JSON
+// documents.
+func summarizeSBOM(path string, data []byte) sbomSummary {
+	var doc struct {
+		SPDXVersion string            `json:"spdxVersion"`
+		Name        string            `json:"name"`
+		Packages    []json.RawMessage `json:"packages"`
+		BOMFormat   string            `json:"bomFormat"`
+		SpecVersion string            `json:"specVersion"`
+		Components  []json.RawMessage `json:"components"`
+		Graph       []struct {
+			Type        string `json:"type"`
+			Name        string `json:"name"`
+			SpecVersion string `json:"specVersion"`
+		} `json:"@graph"`
+	}
+
+	summary := sbomSummary{Path: path, Format: "unknown"}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return summary
+	}
+
+	switch {
+	case doc.SPDXVersion != "":
+		summary.Format = doc.SPDXVersion
+		summary.Name = doc.Name
+		summary.Packages = len(doc.Packages)
+	case len(doc.Graph) > 0:
+		for _, e := range doc.Graph {
+			switch e.Type {
+			case "CreationInfo":
+				summary.Format = "SPDX-" + e.SpecVersion
+			case "SpdxDocument":
+				summary.Name = e.Name
+			case "software_Package":
+				summary.Packages++
+			}
+		}
+	case doc.BOMFormat != "":
+		summary.Format = fmt.Sprintf("%s-%s", doc.BOMFormat, doc.SpecVersion)
+		summary.Packages = len(doc.Components)
+	}
+
+	return summary
+}
+
+func printSummary(w io.Writer, summary *packageSummary) {
+	fmt.Fprintf(w, "%s:\n", summary.Path)
+	for _, field := range summary.PackageInfo {
+		fmt.Fprintf(w, "  %s = %s\n", field.Key, field.Value)
+	}
+
+	fmt.Fprintf(w, "  dependencies: %s\n", listOrNone(summary.Dependencies))
+	fmt.Fprintf(w, "  provides: %s\n", listOrNone(summary.Provides))
+	fmt.Fprintf(w, "  scripts: %s\n", listOrNone(summary.Scripts))
+	fmt.Fprintf(w, "  contents: %d files (%d bytes), %d directories, %d symlinks\n",
+		summary.Files, summary.DataSize, summary.Directories, summary.Symlinks)
+
+	if summary.DataHashValid {
+		fmt.Fprintf(w, "  datahash: valid\n")
+	} else {
+		fmt.Fprintf(w, "  datahash: INVALID\n")
+	}
+	algs := []string{}
+	for alg := range summary.DataHashes {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	for _, alg := range algs {
+		if summary.DataHashes[alg] {
+			fmt.Fprintf(w, "  datahash %s: valid\n", alg)
+		} else {
+			fmt.Fprintf(w, "  datahash %s: INVALID\n", alg)
+		}
+	}
+
+	if len(summary.SBOMs) == 0 {
+		fmt.Fprintf(w, "  sbom: none\n")
+	}
+	for _, sbom := range summary.SBOMs {
+		fmt.Fprintf(w, "  sbom: %s (%s, %d packages)\n", sbom.Path, sbom.Format, sbom.Packages)
+	}
+
+	if len(summary.Signatures) == 0 {
+		fmt.Fprintf(w, "  signature: unsigned\n")
+	}
+	for _, sig := range summary.Signatures {
+		fmt.Fprintf(w, "  signature: %s (%s)\n", sig.KeyName, sig.Status)
+		if sig.TimestampStatus != "" {
+			fmt.Fprintf(w, "  timestamp: %s (%s)\n", strings.TrimSpace(sig.KeyName+" "+sig.Timestamp), sig.TimestampStatus)
+		}
+	}
+}
+
+func listOrNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, " ")
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+// pluginPrefix is the prefix of executables in $PATH which are
+// exposed as melange subcommands, e.g. melange-foo for `melange foo`.
+const pluginPrefix = "melange-"
+
+func Plugin() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugin",
+		Short: "Inspect external melange plugins",
+		Long: `Inspect external melange plugins.
+
+Any executable in $PATH named melange-<name> can be invoked as
+'melange <name>', with the remaining arguments passed to it.
+
+Runners and SBOM generators can be added with Go plugins, which are
+loaded with 'melange build --plugin'.  They register their runners and
+generators with build.RegisterRunner and build.RegisterSBOMGenerator.`,
+	}
+
+	cmd.AddCommand(PluginList())
+	return cmd
+}
+
+func PluginList() *cobra.Command {
+	var goPlugins []string
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List the plugins found in $PATH, and the available runners and SBOM generators",
+		Example: `  melange plugin list --plugin ./my-runner.so`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, path := range goPlugins {
+				if err := build.LoadPlugin(path); err != nil {
+					return err
+				}
+			}
+
+			for _, path := range findPlugins() {
+				fmt.Fprintln(cmd.OutOrStdout(), path)
+			}
+			for _, name := range build.Runners() {
+				fmt.Fprintf(cmd.OutOrStdout(), "runner: %s\n", name)
+			}
+			for _, name := range build.SBOMGenerators() {
+				fmt.Fprintf(cmd.OutOrStdout(), "sbom generator: %s\n", name)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&goPlugins, "plugin", []string{}, "Go plugins to load")
+	return cmd
+}
+
+// findPlugins returns the paths of all plugins in $PATH.  When several
+// directories contain a plugin of the same name, only the first one is
+// returned, as that is the one which would be executed.
+func findPlugins() []string {
+	seen := map[string]bool{}
+	plugins := []string{}
+
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, pluginPrefix) || seen[name] {
+				continue
+			}
+
+			path, err := exec.LookPath(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+
+			seen[name] = true
+			plugins = append(plugins, path)
+		}
+	}
+
+	sort.Strings(plugins)
+	return plugins
+}
+
+// HandlePluginCommand replaces the current process with the plugin named
+// by the first argument, if that argument is not a builtin subcommand and
+// a matching melange-<name> executable exists in $PATH.  It returns nil
+// without doing anything otherwise.
+func HandlePluginCommand(root *cobra.Command, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return nil
+	}
+
+	if _, _, err := root.Find(args); err == nil {
+		return nil
+	}
+
+	path, err := exec.LookPath(pluginPrefix + args[0])
+	if err != nil {
+		return nil
+	}
+
+	argv := append([]string{path}, args[1:]...)
+	if err := syscall.Exec(path, argv, os.Environ()); err != nil {
+		return fmt.Errorf("unable to run plugin %s: %w", path, err)
+	}
+
+	return nil
+}
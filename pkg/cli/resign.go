@@ -0,0 +1,76 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Resign() *cobra.Command {
+	var oldKey string
+	var newKey string
+	var keepOld bool
+	var timestampURL string
+
+	cmd := &cobra.Command{
+		Use:   "resign",
+		Short: "Re-sign the packages and indexes of a repository with a new key",
+		Long: `Re-sign the packages and indexes of a repository with a new key.
+
+The packages (*.apk) and indexes (APKINDEX.tar.gz) of the repository
+directory, and its subdirectories, are re-signed with the new signing
+key, after verifying that they are signed with the old one, given by
+its public key.  The signature of the old key is replaced, unless
+--keep-old is set: packages signed with both keys can be installed by
+clients trusting either of them while the new public key is rolled out.
+
+Only the signatures are rewritten, so the checksums of the packages in
+the indexes remain valid.  The checksum manifests (SHA256SUMS) of the
+repository are updated and signed with the new key.
+
+The new signatures are timestamped by the RFC 3161 time-stamping
+authority given with --timestamp-url, if any.  The timestamps of the
+signatures which are kept are kept too.`,
+		Example: `  melange resign packages --old-key melange.rsa.pub --new-key melange-2023.rsa --keep-old`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if oldKey == "" || newKey == "" {
+				return errors.New("--old-key and --new-key are required")
+			}
+
+			signer := sign.NewLocalSigner(newKey, "")
+			var timestamper *sign.Timestamper
+			if timestampURL != "" {
+				timestamper = sign.NewTimestamper(timestampURL, nil)
+			}
+			if err := build.ResignRepository(args[0], oldKey, signer, timestamper, keepOld); err != nil {
+				return fmt.Errorf("failed to re-sign %s: %w", args[0], err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&oldKey, "old-key", "", "public key of the key being rotated out, which the packages must be signed with")
+	cmd.Flags().StringVar(&newKey, "new-key", "", "key to re-sign the packages with")
+	cmd.Flags().BoolVar(&keepOld, "keep-old", false, "keep the signatures of the old key next to the new ones")
+	cmd.Flags().StringVar(&timestampURL, "timestamp-url", "", "URL of an RFC 3161 time-stamping authority which timestamps the new signatures")
+
+	return cmd
+}
@@ -0,0 +1,395 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/sbom"
+	"github.com/spf13/cobra"
+)
+
+func SBOM() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sbom",
+		Short: "Inspect the SBOMs of packages",
+	}
+
+	cmd.AddCommand(sbomDiff())
+	cmd.AddCommand(sbomMerge())
+	cmd.AddCommand(sbomValidate())
+	return cmd
+}
+
+func sbomDiff() *cobra.Command {
+	var format string
+
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare the SPDX SBOMs of two versions of a package",
+		Long: `Compare the SPDX SBOMs of two versions of a package.
+
+The SPDX 2 JSON documents installed by two apk packages, or given as
+files, are compared: the added, removed and updated components of the
+package, the changed licenses, and the added, removed and changed files
+are printed as text, JSON, or markdown for release notes.`,
+		Example: `  melange sbom diff hello-2.11-r0.apk hello-2.12-r0.apk
+  melange sbom diff --format markdown hello-2.11-r0.apk hello-2.12-r0.apk`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			docs := [][]byte{}
+			for _, path := range args {
+				found, err := readSPDXDocuments(path)
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", path, err)
+				}
+				if len(found) != 1 {
+					return fmt.Errorf("%s has %d SPDX SBOMs, not one", path, len(found))
+				}
+				docs = append(docs, found[0])
+			}
+
+			diff, err := sbom.DiffSPDX(docs[0], docs[1])
+			if err != nil {
+				return err
+			}
+
+			switch format {
+			case "text":
+				printSBOMDiff(cmd.OutOrStdout(), diff)
+			case "json":
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(diff)
+			case "markdown":
+				printSBOMDiffMarkdown(cmd.OutOrStdout(), diff)
+			default:
+				return fmt.Errorf("unknown format %q, must be text, json or markdown", format)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "text", "format of the differences: text, json or markdown")
+
+	return cmd
+}
+
+// printSBOMDiff prints the added components and files with a +, the
+// removed ones with a - and the updated ones with a ~, like
+// printConfigChanges.
+func printSBOMDiff(w io.Writer, diff *sbom.Diff) {
+	fmt.Fprintf(w, "%s -> %s\n", diff.Old, diff.New)
+	if diff.Empty() {
+		fmt.Fprintf(w, "no changes\n")
+		return
+	}
+
+	for _, c := range diff.Dependencies {
+		switch c.Kind() {
+		case "added":
+			fmt.Fprintf(w, "+ dependency %s %s\n", c.Name, c.New)
+		case "removed":
+			fmt.Fprintf(w, "- dependency %s %s\n", c.Name, c.Old)
+		default:
+			fmt.Fprintf(w, "~ dependency %s: %s -> %s\n", c.Name, c.Old, c.New)
+		}
+	}
+	for _, c := range diff.Licenses {
+		fmt.Fprintf(w, "~ license %s: %s -> %s\n", c.Name, c.Old, c.New)
+	}
+	for _, path := range diff.Files.Added {
+		fmt.Fprintf(w, "+ file %s\n", path)
+	}
+	for _, path := range diff.Files.Removed {
+		fmt.Fprintf(w, "- file %s\n", path)
+	}
+	for _, path := range diff.Files.Changed {
+		fmt.Fprintf(w, "~ file %s\n", path)
+	}
+	fmt.Fprintf(w, "files: %d added, %d removed, %d changed, %d unchanged\n",
+		len(diff.Files.Added), len(diff.Files.Removed), len(diff.Files.Changed), diff.Files.Unchanged)
+}
+
+// printSBOMDiffMarkdown prints the differences as sections of release
+// notes.
+func printSBOMDiffMarkdown(w io.Writer, diff *sbom.Diff) {
+	fmt.Fprintf(w, "## Changes from %s to %s\n", diff.Old, diff.New)
+	if diff.Empty() {
+		fmt.Fprintf(w, "\nNo changes.\n")
+		return
+	}
+
+	if len(diff.Dependencies) > 0 {
+		fmt.Fprintf(w, "\n### Dependencies\n\n| Dependency | Change | Old | New |\n| --- | --- | --- | --- |\n")
+		for _, c := range diff.Dependencies {
+			fmt.Fprintf(w, "| `%s` | %s | %s | %s |\n", c.Name, c.Kind(), c.Old, c.New)
+		}
+	}
+
+	if len(diff.Licenses) > 0 {
+		fmt.Fprintf(w, "\n### Licenses\n\n| Package | Old | New |\n| --- | --- | --- |\n")
+		for _, c := range diff.Licenses {
+			fmt.Fprintf(w, "| `%s` | %s | %s |\n", c.Name, c.Old, c.New)
+		}
+	}
+
+	fmt.Fprintf(w, "\n### Files\n\n%d added, %d removed, %d changed, %d unchanged.\n",
+		len(diff.Files.Added), len(diff.Files.Removed), len(diff.Files.Changed), diff.Files.Unchanged)
+	for _, files := range []struct {
+		kind  string
+		paths []string
+	}{
+		{"Added", diff.Files.Added},
+		{"Removed", diff.Files.Removed},
+		{"Changed", diff.Files.Changed},
+	} {
+		if len(files.paths) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n<details><summary>%s files</summary>\n\n", files.kind)
+		for _, path := range files.paths {
+			fmt.Fprintf(w, "- `%s`\n", path)
+		}
+		fmt.Fprintf(w, "\n</details>\n")
+	}
+}
+
+func sbomMerge() *cobra.Command {
+	var name string
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "merge",
+		Short: "Merge the SPDX SBOMs of packages into one document",
+		Long: `Merge the SPDX SBOMs of packages into one document.
+
+The SPDX 2 JSON documents installed by each apk package, or given as
+files, such as the SBOMs of a package and its subpackages for every
+architecture, are merged into a single SPDX document, for a release to
+have one SBOM.  The packages found in several documents with the same
+package URL and checksums, such as the components shared by the
+packages, are listed once.  The merged document references every
+document it is merged from.`,
+		Example: `  melange sbom merge --name hello-2.12 --output hello-2.12.spdx.json packages/*/hello*-2.12-r0.apk`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if name == "" {
+				return errors.New("--name is required")
+			}
+
+			docs := [][]byte{}
+			for _, path := range args {
+				found, err := readSPDXDocuments(path)
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", path, err)
+				}
+				docs = append(docs, found...)
+			}
+
+			data, err := sbom.MergeSPDX(name, docs)
+			if err != nil {
+				return err
+			}
+			data = append(data, '\n')
+
+			if output == "" {
+				_, err := cmd.OutOrStdout().Write(data)
+				return err
+			}
+			return os.WriteFile(output, data, 0644)
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "name of the merged document, such as the name and version of the release")
+	cmd.Flags().StringVar(&output, "output", "", "file to write the merged document to, instead of the standard output")
+
+	return cmd
+}
+
+// readSPDXDocuments returns the SPDX 2 documents installed by an apk
+// package, sorted by path, or the contents of an SBOM file.
+func readSPDXDocuments(path string) ([][]byte, error) {
+	if !strings.HasSuffix(path, ".apk") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{data}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pkg, err := apk.ReadPackage(f)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for sbomPath, data := range pkg.SBOMs {
+		if isSPDX2(data) {
+			paths = append(paths, sbomPath)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no SPDX 2 SBOM found in the package")
+	}
+	sort.Strings(paths)
+
+	docs := [][]byte{}
+	for _, sbomPath := range paths {
+		docs = append(docs, pkg.SBOMs[sbomPath])
+	}
+	return docs, nil
+}
+
+func sbomValidate() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the SPDX SBOMs of packages",
+		Long: `Validate the SPDX SBOMs of packages.
+
+The SPDX 2.3 JSON documents installed by each apk package, or the SPDX
+documents given as files, are checked against the SPDX 2.3 schema: the
+required properties, and the values of the enumerations, such as the
+checksum algorithms and relationship types.  The identifiers which the
+relationships reference must be elements of the document.
+
+The checksums of the files listed in the SBOMs of a package are verified
+against the contents of the package.`,
+		Example: `  melange sbom validate hello-2.12-r0.apk
+  melange sbom validate hello-2.12-r0.spdx.json`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			failed := 0
+			for _, path := range args {
+				results, err := validateSBOMs(path)
+				if err != nil {
+					return fmt.Errorf("failed to validate %s: %w", path, err)
+				}
+
+				for _, r := range results {
+					if len(r.problems) == 0 {
+						fmt.Fprintf(cmd.OutOrStdout(), "%s: valid\n", r.path)
+						continue
+					}
+
+					failed++
+					fmt.Fprintf(cmd.OutOrStdout(), "%s: INVALID\n", r.path)
+					for _, problem := range r.problems {
+						fmt.Fprintf(cmd.OutOrStdout(), "  %s\n", problem)
+					}
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d SBOMs are invalid", failed)
+			}
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+// sbomValidation is the result of the validation of an SBOM.
+type sbomValidation struct {
+	path     string
+	problems []string
+}
+
+// validateSBOMs validates an SPDX document, or the SPDX documents of an
+// apk package.
+func validateSBOMs(path string) ([]sbomValidation, error) {
+	if !strings.HasSuffix(path, ".apk") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		problems, err := sbom.ValidateSPDX(data)
+		if err != nil {
+			return nil, err
+		}
+		return []sbomValidation{{path: path, problems: problems}}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pkg, err := apk.ReadPackage(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// the checksums are verified against the extracted package.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	root, err := os.MkdirTemp("", "melange-sbom-validate-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+	if _, _, err := apk.ExtractPackage(f, root); err != nil {
+		return nil, err
+	}
+
+	results := []sbomValidation{}
+	for sbomPath, data := range pkg.SBOMs {
+		if !isSPDX2(data) {
+			continue
+		}
+
+		problems, err := sbom.ValidateSPDX(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sbomPath, err)
+		}
+		mismatched, err := sbom.VerifySPDXChecksums(data, root)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sbomPath, err)
+		}
+
+		results = append(results, sbomValidation{path: path + ":" + sbomPath, problems: append(problems, mismatched...)})
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no SPDX 2 SBOM found in the package")
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].path < results[j].path })
+
+	return results, nil
+}
+
+// isSPDX2 reports whether an SBOM is an SPDX 2 JSON document.
+func isSPDX2(data []byte) bool {
+	var doc struct {
+		SPDXVersion string `json:"spdxVersion"`
+	}
+	return json.Unmarshal(data, &doc) == nil && strings.HasPrefix(doc.SPDXVersion, "SPDX-2")
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"chainguard.dev/melange/pkg/vuln"
+	"github.com/spf13/cobra"
+)
+
+func Scan() *cobra.Command {
+	var osvURL string
+	var baselineFile string
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "scan",
+		Short: "Report the known vulnerabilities of the packages of a repository",
+		Long: `Report the known vulnerabilities of the packages of a repository.
+
+The components listed with a package URL in the SPDX and CycloneDX SBOMs
+of every package of the repository directory are looked up in an OSV
+database.  Packages without an SBOM are reported as not scanned.
+
+With --baseline, the findings which are not in a previous JSON report
+for the same package are flagged as new, so that the packages which need
+a rebuild first can be found.`,
+		Example: `  melange scan --json ./packages/x86_64 > report.json
+  melange scan --baseline report.json ./packages/x86_64`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := vuln.ScanRepository(args[0], &vuln.OSVClient{URL: osvURL})
+			if err != nil {
+				return fmt.Errorf("failed to scan %s: %w", args[0], err)
+			}
+
+			if baselineFile != "" {
+				data, err := os.ReadFile(baselineFile)
+				if err != nil {
+					return fmt.Errorf("failed to read baseline report: %w", err)
+				}
+
+				baseline := &vuln.Report{}
+				if err := json.Unmarshal(data, baseline); err != nil {
+					return fmt.Errorf("failed to parse baseline report: %w", err)
+				}
+
+				report.MarkNew(baseline)
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(report)
+			}
+
+			printReport(cmd.OutOrStdout(), report)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&osvURL, "osv-url", vuln.DefaultOSVURL, "location of the OSV API")
+	cmd.Flags().StringVar(&baselineFile, "baseline", "", "previous JSON report, to flag the new findings")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the report as JSON")
+
+	return cmd
+}
+
+func printReport(w io.Writer, report *vuln.Report) {
+	for _, pr := range report.Packages {
+		switch {
+		case pr.NoSBOM:
+			fmt.Fprintf(w, "%s: not scanned, no SBOM\n", pr.File)
+			continue
+		case len(pr.Findings) == 0:
+			fmt.Fprintf(w, "%s: no known vulnerabilities\n", pr.File)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: %d vulnerabilities\n", pr.File, len(pr.Findings))
+		for _, f := range pr.Findings {
+			marker := ""
+			if f.New {
+				marker = " (new)"
+			}
+			fmt.Fprintf(w, "  %s in %s%s\n", f.ID, f.Component, marker)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"chainguard.dev/melange/pkg/schema"
+	"github.com/spf13/cobra"
+)
+
+func Schema() *cobra.Command {
+	var validateFile string
+
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON schemas of the machine-readable outputs",
+		Long: `Print the JSON schemas of the machine-readable outputs.
+
+Without a name, the names of the schemas are listed, such as
+scan-report/v1.  With a name, the schema is printed, in its latest
+version unless the name has one.  The outputs which are JSON objects
+record the $id of their schema in their "schema" property.
+
+Within a version, a schema only changes compatibly: optional properties
+are added and descriptions clarified.  Removing or renaming a property,
+changing its type or meaning, or making it required is a new version.
+
+With --validate, a JSON document is checked against the schema instead.`,
+		Example: `  melange schema
+  melange schema scan-report > scan-report.schema.json
+  melange schema --validate report.json scan-report/v1`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if validateFile != "" && len(args) == 0 {
+				return errors.New("--validate needs the name of a schema")
+			}
+
+			if len(args) == 0 {
+				for _, name := range schema.Names() {
+					fmt.Fprintln(cmd.OutOrStdout(), name)
+				}
+				return nil
+			}
+
+			if validateFile != "" {
+				data, err := os.ReadFile(validateFile)
+				if err != nil {
+					return err
+				}
+				return schema.Validate(args[0], data)
+			}
+
+			data, err := schema.Get(args[0])
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(data)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&validateFile, "validate", "", "JSON document to check against the schema")
+
+	return cmd
+}
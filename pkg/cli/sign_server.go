@@ -0,0 +1,74 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+
+	"chainguard.dev/melange/internal/sign"
+	"github.com/spf13/cobra"
+)
+
+func SignServer() *cobra.Command {
+	var listen string
+	var signingKey string
+	var tlsCert string
+	var tlsKey string
+	var clientCA string
+
+	cmd := &cobra.Command{
+		Use:   "sign-server",
+		Short: "Sign packages for remote builds",
+		Long: `Sign packages for remote builds.
+
+The signing service holds the signing key, so that build workers can
+sign packages with 'melange build --signing-server' without having
+access to the key.  Clients must present a certificate issued by one of
+the CAs of --client-ca.`,
+		Example: `  melange sign-server --signing-key melange.rsa --tls-cert server.crt --tls-key server.key --client-ca clients.pem`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if signingKey == "" || tlsCert == "" || tlsKey == "" || clientCA == "" {
+				return errors.New("--signing-key, --tls-cert, --tls-key and --client-ca are required")
+			}
+
+			config, err := sign.TLSConfig(tlsCert, tlsKey, clientCA)
+			if err != nil {
+				return err
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+
+			srv := &http.Server{
+				Addr:      listen,
+				Handler:   sign.NewServer(sign.NewLocalSigner(signingKey, "")),
+				TLSConfig: config,
+			}
+
+			log.Printf("signing packages on %s", listen)
+			return srv.ListenAndServeTLS("", "")
+		},
+	}
+
+	cmd.Flags().StringVar(&listen, "listen", ":8443", "address to listen on")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to sign packages with")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate of the service")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS key of the service")
+	cmd.Flags().StringVar(&clientCA, "client-ca", "", "CA certificates which issue the certificates of the clients")
+
+	return cmd
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"log"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Test() *cobra.Command {
+	var outDir string
+	var runner string
+	var netrcFile string
+	var checkDeps bool
+	var image bool
+
+	cmd := &cobra.Command{
+		Use:   "test",
+		Short: "Test the packages built from a YAML configuration file",
+		Long: `Test the packages built from a YAML configuration file.
+
+With --check-deps, every package built into the output directory is
+installed with its runtime dependencies only into an otherwise empty
+environment.  The dynamic loader of the environment lists the shared
+libraries of every program and library of the package, and the
+interpreters of its scripts are looked up, to report the dependencies
+which the package does not declare.
+
+With --image, an OCI image holding the package built into the output
+directory, its runtime dependencies and the packages of the test section
+of the configuration is written to the output directory as
+<package>-<version>-r<epoch>.test-image.tar.  Its entrypoint is a script
+running the steps of the test pipeline, which is run in the root of the
+image with the runner.  The image can be loaded with docker load to
+inspect the package.`,
+		Example: `  melange test --check-deps --out-dir packages config.yaml
+  melange test --image --out-dir packages config.yaml`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !checkDeps && !image {
+				return errors.New("no tests were selected, see --check-deps and --image")
+			}
+
+			log.SetOutput(build.NewRedactingWriter(log.Writer()))
+
+			ctx, err := build.New(
+				build.WithConfig(args[0]),
+				build.WithOutDir(outDir),
+				build.WithRunner(runner),
+				build.WithNetrcFile(netrcFile),
+			)
+			if err != nil {
+				return err
+			}
+
+			if checkDeps {
+				if err := ctx.TestDependencies(); err != nil {
+					return err
+				}
+			}
+			if image {
+				if err := ctx.TestImage(); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&outDir, "out-dir", ".", "directory where the packages were output")
+	cmd.Flags().StringVar(&runner, "runner", "bubblewrap", "runner used to run the dynamic loader and the test pipeline in the test environment")
+	cmd.Flags().StringVar(&netrcFile, "netrc", "", "netrc file with the credentials of the package repositories, in addition to the ones of $HTTP_AUTH")
+	cmd.Flags().BoolVar(&checkDeps, "check-deps", false, "check that the packages declare the runtime dependencies of their programs, libraries and scripts")
+	cmd.Flags().BoolVar(&image, "image", false, "build a test image holding the package, whose entrypoint runs the test pipeline of the configuration, and run the test in it")
+
+	return cmd
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Why() *cobra.Command {
+	var outDir string
+	var repositories []string
+	var netrcFile string
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "why",
+		Short: "Explain the runtime dependencies of a package built from a YAML configuration file",
+		Long: `Explain the runtime dependencies of a package built from a YAML configuration file.
+
+For every runtime dependency of the package built into the output
+directory, the main package unless another one is named, the line of the
+configuration file declaring it is printed, along with the files of the
+package which need a shared library or an interpreter that it provides,
+and the packages expected to satisfy it.  Those are the packages built
+from the same configuration, or else the packages of the repositories
+given with --repository, which default to the repositories of the
+environment of the configuration.  Version constraints are not taken into
+account.`,
+		Example: `  melange why --out-dir packages config.yaml
+  melange why --repository https://packages.wolfi.dev/os config.yaml hello-dev`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := build.New(
+				build.WithConfig(args[0]),
+				build.WithOutDir(outDir),
+				build.WithNetrcFile(netrcFile),
+			)
+			if err != nil {
+				return err
+			}
+
+			name := ""
+			if len(args) > 1 {
+				name = args[1]
+			}
+
+			explanation, err := ctx.ExplainDependencies(name, repositories)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(explanation)
+			}
+
+			printExplanation(cmd.OutOrStdout(), explanation)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&outDir, "out-dir", ".", "directory where the packages were output")
+	cmd.Flags().StringSliceVar(&repositories, "repository", []string{}, "repositories expected to satisfy the dependencies, instead of the ones of the environment")
+	cmd.Flags().StringVar(&netrcFile, "netrc", "", "netrc file with the credentials of the package repositories, in addition to the ones of $HTTP_AUTH")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the explanation as JSON")
+
+	return cmd
+}
+
+func printExplanation(w io.Writer, explanation *build.DependencyExplanation) {
+	fmt.Fprintf(w, "%s (%s):\n", explanation.Package, explanation.Path)
+	if len(explanation.Dependencies) == 0 {
+		fmt.Fprintln(w, "  no runtime dependencies")
+		return
+	}
+
+	for _, reason := range explanation.Dependencies {
+		if reason.Line > 0 {
+			fmt.Fprintf(w, "  %s: declared on line %d\n", reason.Dependency, reason.Line)
+		} else {
+			fmt.Fprintf(w, "  %s: not declared in the configuration\n", reason.Dependency)
+		}
+
+		for _, need := range reason.Needs {
+			fmt.Fprintf(w, "    needed by %s\n", need)
+		}
+
+		switch {
+		case strings.HasPrefix(reason.Dependency, "!"):
+		case len(reason.Providers) == 0:
+			fmt.Fprintln(w, "    not satisfied by any package")
+		case reason.Local:
+			fmt.Fprintf(w, "    satisfied by %s, built from the configuration\n", strings.Join(reason.Providers, ", "))
+		default:
+			fmt.Fprintf(w, "    satisfied by %s\n", strings.Join(reason.Providers, ", "))
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package errcode catalogs the failures melange reports to its users.
+// Each has a stable code, which build farms can use to triage failed
+// builds, and a suggested fix, which is printed along with the error.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Code identifies a kind of failure.  Codes are never renumbered or
+// reused: new kinds of failures get new codes.
+type Code string
+
+// The codes of the configuration errors.
+const (
+	// ConfigRead is a configuration file which cannot be read.
+	ConfigRead Code = "MEL-101"
+	// ConfigParse is a configuration file which is not valid YAML.
+	ConfigParse Code = "MEL-102"
+	// ConfigInvalid is a configuration with invalid values.
+	ConfigInvalid Code = "MEL-103"
+	// SettingsInvalid is a settings file which cannot be used.
+	SettingsInvalid Code = "MEL-104"
+)
+
+// The codes of the runner errors.
+const (
+	// RunnerUnknown is a runner which is not registered.
+	RunnerUnknown Code = "MEL-201"
+	// RunnerUnsupported is a sandbox which the runner cannot apply.
+	RunnerUnsupported Code = "MEL-202"
+	// RunnerMissing is a runner whose program is not installed.
+	RunnerMissing Code = "MEL-203"
+)
+
+// The codes of the fetch errors.
+const (
+	// FetchIndex is a repository index which cannot be fetched.
+	FetchIndex Code = "MEL-301"
+	// FetchIntegrity is a repository index which does not match its
+	// pin or snapshot.
+	FetchIntegrity Code = "MEL-302"
+	// FetchSource is a source which the fetch pipeline cannot fetch
+	// or verify.
+	FetchSource Code = "MEL-303"
+)
+
+// The codes of the signing errors.
+const (
+	// SigningKey is a signing key which cannot be used.
+	SigningKey Code = "MEL-401"
+	// SigningServer is a signing server which cannot be used.
+	SigningServer Code = "MEL-402"
+	// SigningOptions are signing options which conflict.
+	SigningOptions Code = "MEL-403"
+	// SigningTimestamp is a time-stamping authority which cannot be used.
+	SigningTimestamp Code = "MEL-404"
+	// SigningKMS is a key management service key which cannot be used.
+	SigningKMS Code = "MEL-405"
+)
+
+type entry struct {
+	summary string
+	hint    string
+}
+
+var catalog = map[Code]entry{
+	ConfigRead: {
+		"the configuration file cannot be read",
+		"check the path of the configuration file given to melange, which defaults to .melange.yaml",
+	},
+	ConfigParse: {
+		"the configuration file is not valid YAML",
+		"fix the YAML syntax at the reported line, keys are case sensitive",
+	},
+	ConfigInvalid: {
+		"the configuration is invalid",
+		"fix the reported field of the configuration file",
+	},
+	SettingsInvalid: {
+		"the settings file cannot be used",
+		"fix the reported field of the settings file, or select another one with --settings",
+	},
+	RunnerUnknown: {
+		"the runner is unknown",
+		"use the bubblewrap or proot runner, or load the plugin providing the runner with --plugin",
+	},
+	RunnerUnsupported: {
+		"the runner cannot apply the sandbox of the package",
+		"use the bubblewrap runner, or relax the sandbox of the package",
+	},
+	RunnerMissing: {
+		"the program of the runner is not installed",
+		"install bubblewrap (bwrap) or proot, or select the installed one with --runner",
+	},
+	FetchIndex: {
+		"a repository index cannot be fetched",
+		"check the network, the proxy settings and the credentials of the repository (--netrc, $HTTP_AUTH)",
+	},
+	FetchIntegrity: {
+		"a repository index does not match its pin or snapshot",
+		"if the repository was updated on purpose, update the pins or record a new snapshot, otherwise check for tampering",
+	},
+	FetchSource: {
+		"a source cannot be fetched or does not match its checksum",
+		"check the uri and expected-sha256 of the fetch pipeline, and that the source is still available",
+	},
+	SigningKey: {
+		"the signing key cannot be used",
+		"check that --signing-key is a PEM encoded RSA private key, and the passphrase of encrypted keys",
+	},
+	SigningServer: {
+		"the signing server cannot be used",
+		"check the URL, the client certificate and key, and the CA of the signing server",
+	},
+	SigningOptions: {
+		"the signing options conflict",
+		"use only one of --signing-key, --signing-server and --signing-kms, on the command line or in the settings file",
+	},
+	SigningTimestamp: {
+		"the signatures cannot be timestamped",
+		"check the URL of the time-stamping authority given with --timestamp-url",
+	},
+	SigningKMS: {
+		"the KMS key cannot be used",
+		"check the URL of the key, and that the managed identity of the host or $AZURE_KEYVAULT_TOKEN may sign with it",
+	},
+}
+
+// Codes returns the codes of the catalog, in order.
+func Codes() []Code {
+	codes := []Code{}
+	for code := range catalog {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	return codes
+}
+
+// Summary describes the failure identified by the code.
+func (c Code) Summary() string {
+	return catalog[c].summary
+}
+
+// Hint suggests how to fix the failure identified by the code.
+func (c Code) Hint() string {
+	return catalog[c].hint
+}
+
+// Error is a failure of the catalog.  Its message is the one of the
+// error it wraps.
+type Error struct {
+	Code Code
+	// Context describes what failed, such as the configuration file
+	// or the URL which was fetched.
+	Context map[string]string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap attaches a code and context, given as key and value pairs, to an
+// error.  Errors which already have a code keep it, as the innermost
+// code is the most specific.
+func Wrap(code Code, err error, context ...string) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	e = &Error{Code: code, Context: map[string]string{}, Err: err}
+	for i := 0; i+1 < len(context); i += 2 {
+		e.Context[context[i]] = context[i+1]
+	}
+	return e
+}
+
+// Report prints the code, the context and the hint of the failure of
+// err, if it has a code, and reports whether it did.  The first line is
+// always "error <code>: <summary>".
+func Report(w io.Writer, err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	fmt.Fprintf(w, "error %s: %s\n", e.Code, e.Code.Summary())
+
+	keys := []string{}
+	for k := range e.Context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s: %s\n", k, e.Context[k])
+	}
+
+	if hint := e.Code.Hint(); hint != "" {
+		fmt.Fprintf(w, "  hint: %s\n", hint)
+	}
+
+	return true
+}
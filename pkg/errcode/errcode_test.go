@@ -0,0 +1,71 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	seen := map[Code]bool{}
+	for _, code := range Codes() {
+		if !strings.HasPrefix(string(code), "MEL-") || seen[code] {
+			t.Errorf("code %q is malformed or duplicated", code)
+		}
+		seen[code] = true
+
+		if code.Summary() == "" || code.Hint() == "" {
+			t.Errorf("code %s has no summary or hint", code)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	cause := errors.New("yaml: line 3: mapping values are not allowed in this context")
+	err := fmt.Errorf("failed to load configuration: %w", Wrap(ConfigParse, cause, "config", "hello.yaml"))
+
+	if !errors.Is(err, cause) {
+		t.Errorf("the wrapped error is not the cause")
+	}
+	if err.Error() != "failed to load configuration: "+cause.Error() {
+		t.Errorf("message = %q", err)
+	}
+
+	// the innermost code is kept.
+	var e *Error
+	if !errors.As(Wrap(ConfigInvalid, err), &e) || e.Code != ConfigParse {
+		t.Errorf("code = %v, want %s", e, ConfigParse)
+	}
+
+	var b bytes.Buffer
+	if !Report(&b, err) {
+		t.Fatalf("Report() found no code")
+	}
+	want := "error MEL-102: the configuration file is not valid YAML\n  config: hello.yaml\n  hint: " + ConfigParse.Hint() + "\n"
+	if b.String() != want {
+		t.Errorf("Report() = %q, want %q", b.String(), want)
+	}
+
+	if Report(&b, cause) {
+		t.Errorf("Report() reported an error without a code")
+	}
+	if Wrap(ConfigParse, nil) != nil {
+		t.Errorf("Wrap(nil) is not nil")
+	}
+}
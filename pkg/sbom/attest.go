@@ -0,0 +1,120 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The types of the in-toto attestations of the SBOMs.
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	spdxPredicateType   = "https://spdx.dev/Document"
+	dssePayloadType     = "application/vnd.in-toto+json"
+)
+
+// Signer signs the attestations of the SBOMs.
+type Signer interface {
+	// KeyID identifies the key which verifies the signatures.
+	KeyID() string
+	// Sign returns the signature of a message.
+	Sign(message []byte) ([]byte, error)
+}
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// dssePAE returns the pre-authentication encoding of a DSSE payload,
+// which is what is signed.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// attest writes the signature of an SPDX SBOM, as <sbom>.sig, and an
+// in-toto attestation of it whose subjects are the files of the package,
+// as the DSSE envelope <sbom>.att.
+func attest(signer Signer, path string, doc []byte, contents *packageContents) error {
+	sig, err := signer.Sign(doc)
+	if err != nil {
+		return fmt.Errorf("unable to sign %s: %w", filepath.Base(path), err)
+	}
+	if err := os.WriteFile(path+".sig", sig, 0644); err != nil {
+		return err
+	}
+
+	statement := inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []inTotoSubject{},
+		PredicateType: spdxPredicateType,
+		Predicate:     doc,
+	}
+	for _, f := range contents.files {
+		if f.link != "" {
+			continue
+		}
+		statement.Subject = append(statement.Subject, inTotoSubject{
+			Name:   "/" + f.path,
+			Digest: map[string]string{ChecksumSHA256: f.digests[ChecksumSHA256]},
+		})
+	}
+
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+
+	sig, err = signer.Sign(dssePAE(dssePayloadType, payload))
+	if err != nil {
+		return fmt.Errorf("unable to sign the attestation of %s: %w", filepath.Base(path), err)
+	}
+
+	envelope, err := json.Marshal(dsseEnvelope{
+		PayloadType: dssePayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{{
+			KeyID: signer.KeyID(),
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path+".att", envelope, 0644)
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// BuildEnvironmentElement is the SPDX identifier of the package of the
+// SBOM of a build environment, which contains the packages installed in
+// it.
+const BuildEnvironmentElement = "SPDXRef-Package-build-environment"
+
+// BuildPackage is a package installed in a build environment.
+type BuildPackage struct {
+	Name    string
+	Version string
+	Arch    string
+	// License is the license expression recorded in the package.
+	License string
+}
+
+// GenerateBuildEnvironment returns the SPDX 2 JSON document of the build
+// environment of a package, named name, with the packages installed in
+// it.  The SBOMs of the packages built in the environment reference it
+// with Spec.BuildEnvironment, instead of listing its packages.
+func GenerateBuildEnvironment(name string, packages []BuildPackage, created time.Time) ([]byte, error) {
+	packages = append([]BuildPackage{}, packages...)
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+
+	h := sha256.New()
+	for _, p := range packages {
+		fmt.Fprintf(h, "%s\n", PackageURL(p.Name, p.Version, p.Arch))
+	}
+
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/melange/%s-%s", name, hex.EncodeToString(h.Sum(nil))),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: melange"},
+		},
+		DocumentDescribes: []string{BuildEnvironmentElement},
+		Packages: []spdxPackage{{
+			SPDXID:           BuildEnvironmentElement,
+			Name:             name,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}},
+	}
+
+	for i, p := range packages {
+		// the custom licenses of the packages are not known.
+		license := p.License
+		if license == "" || len(LicenseRefs(license)) > 0 {
+			license = "NOASSERTION"
+		}
+
+		id := fmt.Sprintf("SPDXRef-Package-%d-%s", i, spdxIDString(p.Name))
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  license,
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  PackageURL(p.Name, p.Version, p.Arch),
+			}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			Element: BuildEnvironmentElement,
+			Type:    "CONTAINS",
+			Related: id,
+		})
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checksumCache keeps the digests of the files of a package between
+// builds, so that the files which an epoch-only rebuild leaves unchanged
+// are not hashed again.  A file is considered unchanged when its path,
+// size, modification time and inode are, so that a file replaced by
+// another one of the same size, such as one copied with its timestamps
+// preserved, is hashed again.
+type checksumCache struct {
+	path string
+	// entries are the digests read from the cache file.
+	entries map[string]cachedChecksums
+	// scanned are the digests of the files of this build, which
+	// replace the entries when the cache is saved, so that the
+	// digests of removed files are not kept forever.
+	scanned map[string]cachedChecksums
+	hits    int
+}
+
+// cachedChecksums are the digests of a file.
+type cachedChecksums struct {
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"mtime"`
+	Inode   uint64            `json:"inode"`
+	Digests map[string]string `json:"digests"`
+	Types   []string          `json:"types"`
+	// LicenseTags are null in the caches written before the files
+	// were scanned for SPDX-License-Identifier tags.
+	LicenseTags []string `json:"license_tags"`
+}
+
+// loadChecksumCache reads a cache file.  A missing or unreadable cache is
+// not an error, as it only makes the scan slower.
+func loadChecksumCache(path string) *checksumCache {
+	c := &checksumCache{
+		path:    path,
+		entries: map[string]cachedChecksums{},
+		scanned: map[string]cachedChecksums{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil || c.entries == nil {
+		c.entries = map[string]cachedChecksums{}
+	}
+
+	return c
+}
+
+// lookup returns the cached digests, types and license tags of an
+// unchanged file, if the digests were computed with all the algorithms.
+// The entries of older caches, without types or license tags, are not
+// used.
+func (c *checksumCache) lookup(rel string, fi fs.FileInfo, algorithms []string) (file, bool) {
+	if c == nil {
+		return file{}, false
+	}
+
+	e, ok := c.entries[rel]
+	if !ok || e.Size != fi.Size() || e.ModTime != fi.ModTime().UnixNano() || e.Inode != inode(fi) || len(e.Types) == 0 || e.LicenseTags == nil {
+		return file{}, false
+	}
+
+	digests := map[string]string{}
+	for _, a := range algorithms {
+		d, ok := e.Digests[a]
+		if !ok {
+			return file{}, false
+		}
+		digests[a] = d
+	}
+
+	c.hits++
+	c.scanned[rel] = e
+	return file{path: rel, digests: digests, types: e.Types, licenseTags: e.LicenseTags}, true
+}
+
+// store records the digests, types and license tags of a file.
+func (c *checksumCache) store(f file, fi fs.FileInfo) {
+	if c == nil {
+		return
+	}
+
+	c.scanned[f.path] = cachedChecksums{
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime().UnixNano(),
+		Inode:       inode(fi),
+		Digests:     f.digests,
+		Types:       f.types,
+		LicenseTags: f.licenseTags,
+	}
+}
+
+// inode returns the inode number of a file, or zero when the file system
+// does not have any.
+func inode(fi fs.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Ino)
+}
+
+// save writes the digests of the files of this build to the cache file.
+func (c *checksumCache) save() error {
+	if c == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(c.scanned)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("unable to create checksum cache directory: %w", err)
+	}
+
+	// builds of other packages may read the cache directory
+	// concurrently, so the cache is replaced atomically.
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".checksums-*")
+	if err != nil {
+		return fmt.Errorf("unable to write checksum cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write checksum cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write checksum cache: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("unable to write checksum cache: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"compress/zlib"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// cargoAuditableSection is the ELF section where cargo auditable embeds
+// the zlib compressed JSON description of the crates of a Rust program.
+const cargoAuditableSection = ".dep-v0"
+
+// maxCargoAuditableSize bounds the size of the uncompressed description,
+// which is about a hundred bytes per crate.
+const maxCargoAuditableSize = 8 << 20
+
+// cargoAuditableInfo is the description embedded by cargo auditable.
+type cargoAuditableInfo struct {
+	Packages []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		// Source is crates.io, git, local, registry or other.
+		Source string `json:"source"`
+		// Kind is runtime, the default, or build for the crates
+		// only used by build scripts, which are not linked.
+		Kind string `json:"kind"`
+		Root bool   `json:"root"`
+	} `json:"packages"`
+}
+
+// cargoCrate returns the component of a Rust crate linked into a program.
+func cargoCrate(name, version string) component {
+	return component{
+		name:       name,
+		version:    version,
+		purl:       fmt.Sprintf("pkg:cargo/%s@%s", name, version),
+		dependency: true,
+	}
+}
+
+// scanCargoAuditable returns the crates linked into a Rust program built
+// with cargo auditable: the crates of its runtime dependencies and, unless
+// it is built from a local directory, its own crate.  Other files have no
+// crates.
+func scanCargoAuditable(path, rel string) ([]component, error) {
+	isELF, err := hasMagic(path, elfMagic)
+	if err != nil || !isELF {
+		return nil, err
+	}
+
+	f, err := elf.Open(path)
+	if err != nil {
+		// not an ELF file melange can read, which the ELF checks
+		// report.
+		return nil, nil
+	}
+	defer f.Close()
+
+	section := f.Section(cargoAuditableSection)
+	if section == nil {
+		return nil, nil
+	}
+
+	zr, err := zlib.NewReader(section.Open())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the cargo auditable data: %w", err)
+	}
+	defer zr.Close()
+
+	var info cargoAuditableInfo
+	if err := json.NewDecoder(io.LimitReader(zr, maxCargoAuditableSize)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("unable to parse the cargo auditable data: %w", err)
+	}
+
+	crates := []component{}
+	for _, p := range info.Packages {
+		if p.Name == "" || p.Version == "" || p.Kind == "build" || (p.Root && p.Source == "local") {
+			continue
+		}
+		crates = append(crates, cargoCrate(p.Name, p.Version))
+	}
+
+	return crates, nil
+}
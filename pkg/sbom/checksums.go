@@ -0,0 +1,169 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// The checksum algorithms of the files listed in the SBOMs.
+const (
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+)
+
+// DefaultChecksumAlgorithms are the algorithms used when a Spec lists
+// none.  SPDX 2 expects every file to have a SHA1 checksum.
+var DefaultChecksumAlgorithms = []string{ChecksumSHA1, ChecksumSHA256}
+
+// checksumAlgorithm is a checksum algorithm and its names in the SBOM
+// formats.
+type checksumAlgorithm struct {
+	name  string
+	new   func() hash.Hash
+	spdx  string
+	cdx   string
+	spdx3 string
+}
+
+// checksumAlgorithms are the supported algorithms, in the order they are
+// listed in the SBOMs.
+var checksumAlgorithms = []checksumAlgorithm{
+	{name: ChecksumSHA1, new: sha1.New, spdx: "SHA1", cdx: "SHA-1", spdx3: "sha1"},
+	{name: ChecksumSHA256, new: sha256.New, spdx: "SHA256", cdx: "SHA-256", spdx3: "sha256"},
+	{name: ChecksumSHA512, new: sha512.New, spdx: "SHA512", cdx: "SHA-512", spdx3: "sha512"},
+}
+
+// ValidateChecksumAlgorithms checks that the algorithms are supported,
+// and include SHA256, which identifies the files.
+func ValidateChecksumAlgorithms(algorithms []string) error {
+	if len(algorithms) == 0 {
+		return nil
+	}
+
+	names := []string{}
+	for _, a := range checksumAlgorithms {
+		names = append(names, a.name)
+	}
+
+	sha256 := false
+	for _, name := range algorithms {
+		if lookupChecksumAlgorithm(name) == nil {
+			return fmt.Errorf("unknown checksum algorithm %q, must be one of %s", name, strings.Join(names, ", "))
+		}
+		sha256 = sha256 || name == ChecksumSHA256
+	}
+	if !sha256 {
+		return errors.New("the checksum algorithms must include sha256")
+	}
+
+	return nil
+}
+
+func lookupChecksumAlgorithm(name string) *checksumAlgorithm {
+	for i := range checksumAlgorithms {
+		if checksumAlgorithms[i].name == name {
+			return &checksumAlgorithms[i]
+		}
+	}
+	return nil
+}
+
+// fileChecksum is a checksum of a file.
+type fileChecksum struct {
+	algorithm *checksumAlgorithm
+	value     string
+}
+
+// checksums returns the checksums of the file, in the order of
+// checksumAlgorithms.
+func (f *file) checksums() []fileChecksum {
+	sums := []fileChecksum{}
+	for i := range checksumAlgorithms {
+		a := &checksumAlgorithms[i]
+		if v, ok := f.digests[a.name]; ok {
+			sums = append(sums, fileChecksum{algorithm: a, value: v})
+		}
+	}
+	return sums
+}
+
+// hashFile returns the digests of a file with the algorithms, its types
+// and the SPDX-License-Identifier tags of the text files, computed in a
+// single read of the file.
+func hashFile(path string, algorithms []string) (file, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return file{}, err
+	}
+	defer f.Close()
+
+	hashes := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for _, name := range algorithms {
+		h := lookupChecksumAlgorithm(name).new()
+		hashes[name] = h
+		writers = append(writers, h)
+	}
+
+	head := &headWriter{size: licenseTagHeadSize}
+	writers = append(writers, head)
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return file{}, err
+	}
+
+	digests := map[string]string{}
+	for name, h := range hashes {
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	start := head.head
+	if len(start) > fileTypeHeadSize {
+		start = start[:fileTypeHeadSize]
+	}
+	types := fileTypes(path, start)
+
+	hashed := file{digests: digests, types: types, licenseTags: []string{}}
+	for _, t := range types {
+		if t == FileTypeText {
+			hashed.licenseTags = licenseTags(head.head)
+		}
+	}
+	return hashed, nil
+}
+
+// hashLink returns the digests of a symbolic link with the algorithms,
+// which are the ones of its target, as git records symbolic links.
+func hashLink(target string, algorithms []string) file {
+	digests := map[string]string{}
+	for _, name := range algorithms {
+		h := lookupChecksumAlgorithm(name).new()
+		io.WriteString(h, target)
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return file{digests: digests, types: []string{FileTypeOther}, link: target}
+}
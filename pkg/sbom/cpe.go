@@ -0,0 +1,105 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cpeAttributes are the attributes of a CPE 2.3 formatted string, after
+// its "cpe:2.3:" prefix.
+var cpeAttributes = []string{"part", "vendor", "product", "version", "update", "edition", "language", "sw_edition", "target_sw", "target_hw", "other"}
+
+// ValidateCPE checks that cpe is a CPE 2.3 formatted string, e.g.
+// cpe:2.3:a:gnu:hello:2.12:*:*:*:*:*:*:*, whose colons and other special
+// characters within the attributes are escaped with backslashes.
+func ValidateCPE(cpe string) error {
+	rest := strings.TrimPrefix(cpe, "cpe:2.3:")
+	if rest == cpe {
+		return fmt.Errorf("CPE %q does not start with cpe:2.3:", cpe)
+	}
+
+	values := splitCPE(rest)
+	if len(values) != len(cpeAttributes) {
+		return fmt.Errorf("CPE %q has %d attributes, want %d", cpe, len(values), len(cpeAttributes))
+	}
+	for i, v := range values {
+		if v == "" {
+			return fmt.Errorf("CPE %q has an empty %s, use * for any", cpe, cpeAttributes[i])
+		}
+	}
+	switch values[0] {
+	case "a", "o", "h", "*":
+	default:
+		return fmt.Errorf("CPE %q has part %q, want a, o or h", cpe, values[0])
+	}
+	return nil
+}
+
+// splitCPE splits the attributes of a CPE 2.3 formatted string at its
+// unescaped colons.
+func splitCPE(s string) []string {
+	values := []string{}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			b.WriteByte(s[i])
+			i++
+			b.WriteByte(s[i])
+		case s[i] == ':':
+			values = append(values, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return append(values, b.String())
+}
+
+// WithCPEVersion returns a CPE 2.3 formatted string with the version of
+// the package when its version is any (*).
+func WithCPEVersion(cpe, version string) string {
+	values := splitCPE(strings.TrimPrefix(cpe, "cpe:2.3:"))
+	if len(values) != len(cpeAttributes) || values[3] != "*" {
+		return cpe
+	}
+	values[3] = escapeCPE(version)
+	return "cpe:2.3:" + strings.Join(values, ":")
+}
+
+// DeriveCPE returns the CPE 2.3 formatted string of an application
+// whose vendor and product are both its name, which is how the NVD
+// names many projects.
+func DeriveCPE(name, version string) string {
+	name = escapeCPE(strings.ToLower(name))
+	return fmt.Sprintf("cpe:2.3:a:%s:%s:%s:*:*:*:*:*:*:*", name, name, escapeCPE(version))
+}
+
+// escapeCPE escapes the characters of a value of a CPE 2.3 formatted
+// string which are not alphanumeric, "-", "." or "_".
+func escapeCPE(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+		default:
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,229 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// cycloneDX generates CycloneDX 1.5 JSON documents.
+type cycloneDX struct{}
+
+type cdxDocument struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+	// Dependencies are the components linked into the programs.
+	Dependencies []cdxDependency `json:"dependencies,omitempty"`
+}
+
+type cdxMetadata struct {
+	Timestamp string      `json:"timestamp"`
+	Tools     cdxTools    `json:"tools"`
+	Authors   []cdxEntity `json:"authors,omitempty"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	BOMRef  string `json:"bom-ref,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+	// CPE is the first CPE of the package, the others are properties.
+	CPE       string     `json:"cpe,omitempty"`
+	Supplier  *cdxEntity `json:"supplier,omitempty"`
+	Author    string     `json:"author,omitempty"`
+	Copyright string     `json:"copyright,omitempty"`
+	// Description tells the targets of the symbolic links.
+	Description string       `json:"description,omitempty"`
+	Licenses    []cdxLicense `json:"licenses,omitempty"`
+	Hashes      []cdxHash    `json:"hashes,omitempty"`
+	// Properties record the pipeline steps which produced the files,
+	// and the deprecation of the package.
+	Properties []cdxProperty `json:"properties,omitempty"`
+	// ExternalReferences locate the sources of the package.
+	ExternalReferences []cdxExternalReference `json:"externalReferences,omitempty"`
+	Components         []cdxComponent         `json:"components,omitempty"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxExternalReference struct {
+	Type    string    `json:"type"`
+	URL     string    `json:"url"`
+	Comment string    `json:"comment,omitempty"`
+	Hashes  []cdxHash `json:"hashes,omitempty"`
+}
+
+type cdxEntity struct {
+	Name string `json:"name"`
+}
+
+type cdxLicense struct {
+	Expression string `json:"expression"`
+}
+
+type cdxHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+func (*cycloneDX) Ext() string {
+	return "cdx.json"
+}
+
+func (*cycloneDX) Generate(spec *Spec, contents *packageContents) ([]byte, error) {
+	pkg := cdxComponent{
+		BOMRef:    spec.purl(),
+		Type:      "application",
+		Name:      spec.PackageName,
+		Version:   spec.PackageVersion,
+		PURL:      spec.purl(),
+		Copyright: spec.Copyright,
+	}
+	if spec.Supplier != "" {
+		pkg.Supplier = &cdxEntity{Name: agentName(spec.Supplier)}
+	}
+	if spec.Originator != "" {
+		pkg.Author = agentName(spec.Originator)
+	}
+	if spec.License != "" {
+		pkg.Licenses = []cdxLicense{{Expression: spec.License}}
+	}
+	for i, cpe := range spec.CPEs {
+		if i == 0 {
+			pkg.CPE = cpe
+			continue
+		}
+		pkg.Properties = append(pkg.Properties, cdxProperty{Name: "melange:cpe", Value: cpe})
+	}
+	if d := spec.Deprecation; d != nil {
+		reason := d.Reason
+		if reason == "" {
+			reason = "true"
+		}
+		pkg.Properties = append(pkg.Properties, cdxProperty{Name: "melange:deprecated", Value: reason})
+		if d.Replacement != "" {
+			pkg.Properties = append(pkg.Properties, cdxProperty{Name: "melange:replacement", Value: d.Replacement})
+		}
+		if !d.EndOfLife.IsZero() {
+			pkg.Properties = append(pkg.Properties, cdxProperty{Name: "melange:end-of-life", Value: d.EndOfLife.UTC().Format("2006-01-02")})
+		}
+	}
+	for _, f := range spec.Provenance.facts() {
+		pkg.Properties = append(pkg.Properties, cdxProperty{Name: f.name, Value: f.value})
+	}
+
+	for _, s := range spec.Sources {
+		ref := cdxExternalReference{Type: "source-distribution", URL: s.URL}
+		if s.Commit != "" {
+			ref.Type = "vcs"
+			ref.Comment = "commit " + s.Commit
+		}
+		if s.SHA256 != "" {
+			ref.Hashes = []cdxHash{{Algorithm: lookupChecksumAlgorithm(ChecksumSHA256).cdx, Content: s.SHA256}}
+		}
+		pkg.ExternalReferences = append(pkg.ExternalReferences, ref)
+	}
+
+	dependencies := []cdxDependency{}
+	for _, f := range contents.files {
+		c := cdxComponent{
+			Type:        "file",
+			Name:        "/" + f.path,
+			Description: f.comment(),
+			Hashes:      cdxHashes(&f),
+		}
+		if purls := contents.dependencies[f.path]; len(purls) > 0 {
+			c.BOMRef = "file:/" + f.path
+			dependencies = append(dependencies, cdxDependency{Ref: c.BOMRef, DependsOn: purls})
+		}
+		if expression := f.licenseExpression(); expression != "" {
+			c.Licenses = []cdxLicense{{Expression: expression}}
+		}
+		if step, ok := spec.FileSteps[f.path]; ok {
+			c.Properties = []cdxProperty{{Name: "melange:pipeline-step", Value: step}}
+		}
+		pkg.Components = append(pkg.Components, c)
+	}
+
+	for _, m := range contents.components {
+		pkg.Components = append(pkg.Components, cdxComponent{
+			BOMRef:   m.purl,
+			Type:     "library",
+			Name:     m.name,
+			Version:  m.version,
+			PURL:     m.purl,
+			Supplier: pkg.Supplier,
+		})
+	}
+
+	doc := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + digestUUID(contentDigest(spec, contents)),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: spec.created(),
+			Tools: cdxTools{
+				Components: []cdxComponent{{Type: "application", Name: "melange"}},
+			},
+		},
+		Components:   []cdxComponent{pkg},
+		Dependencies: dependencies,
+	}
+	// the supplier is the author of the SBOM, which melange creates
+	// on its behalf.
+	if pkg.Supplier != nil {
+		doc.Metadata.Authors = []cdxEntity{*pkg.Supplier}
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// digestUUID formats the start of a hex digest as a version 5 style
+// UUID, which CycloneDX requires as serial number.
+func digestUUID(digest string) string {
+	b := []byte(digest[:32])
+	b[12] = '5'
+	b[16] = "89ab"[b[16]%4]
+
+	return fmt.Sprintf("%s-%s-%s-%s-%s", b[0:8], b[8:12], b[12:16], b[16:20], b[20:32])
+}
+
+// cdxHashes returns the hashes of a file.
+func cdxHashes(f *file) []cdxHash {
+	hashes := []cdxHash{}
+	for _, c := range f.checksums() {
+		hashes = append(hashes, cdxHash{Algorithm: c.algorithm.cdx, Content: c.value})
+	}
+	return hashes
+}
@@ -0,0 +1,234 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Diff is the difference between the SBOMs of two versions of a package.
+type Diff struct {
+	// Old and New are the names of the compared documents.
+	Old string `json:"old"`
+	New string `json:"new"`
+	// Dependencies are the added, removed and updated components of
+	// the package, the packages of the documents with a package URL
+	// other than the described ones, sorted by name.
+	Dependencies []DependencyChange `json:"dependencies"`
+	// Licenses are the changed licenses of the described packages and
+	// of the components, sorted by name.
+	Licenses []LicenseChange `json:"licenses"`
+	Files    FileChurn       `json:"files"`
+}
+
+// DependencyChange is an added, removed or updated component.
+type DependencyChange struct {
+	Name string `json:"name"`
+	// Old and New are the versions of the component, Old is empty for
+	// an added component and New for a removed one.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// Kind returns "added", "removed" or "updated".
+func (c *DependencyChange) Kind() string {
+	switch {
+	case c.Old == "":
+		return "added"
+	case c.New == "":
+		return "removed"
+	default:
+		return "updated"
+	}
+}
+
+// LicenseChange is a changed license of a package.
+type LicenseChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// FileChurn lists the files which are added, removed or whose contents
+// changed, sorted by path.
+type FileChurn struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// Empty reports whether the documents describe the same contents.
+func (d *Diff) Empty() bool {
+	return len(d.Dependencies) == 0 && len(d.Licenses) == 0 && len(d.Files.Added) == 0 && len(d.Files.Removed) == 0 && len(d.Files.Changed) == 0
+}
+
+// diffPackage is a package of a compared document.
+type diffPackage struct {
+	version string
+	license string
+}
+
+// DiffSPDX compares the SPDX 2 JSON documents of two versions of a
+// package.  The components are matched by their package URL, without
+// its version, and the files by path.  The sources are not compared:
+// their changes are the ones of the version of the package.
+func DiffSPDX(old, new []byte) (*Diff, error) {
+	var oldDoc, newDoc spdxDocument
+	if err := json.Unmarshal(old, &oldDoc); err != nil {
+		return nil, fmt.Errorf("unable to parse SPDX document: %w", err)
+	}
+	if err := json.Unmarshal(new, &newDoc); err != nil {
+		return nil, fmt.Errorf("unable to parse SPDX document: %w", err)
+	}
+
+	diff := &Diff{
+		Old:          oldDoc.Name,
+		New:          newDoc.Name,
+		Dependencies: []DependencyChange{},
+		Licenses:     []LicenseChange{},
+		Files:        FileChurn{Added: []string{}, Removed: []string{}, Changed: []string{}},
+	}
+
+	oldDescribed, oldComponents := diffPackages(&oldDoc)
+	newDescribed, newComponents := diffPackages(&newDoc)
+
+	for name, o := range oldComponents {
+		n, ok := newComponents[name]
+		switch {
+		case !ok:
+			diff.Dependencies = append(diff.Dependencies, DependencyChange{Name: name, Old: o.version})
+		case o.version != n.version:
+			diff.Dependencies = append(diff.Dependencies, DependencyChange{Name: name, Old: o.version, New: n.version})
+		}
+	}
+	for name, n := range newComponents {
+		if _, ok := oldComponents[name]; !ok {
+			diff.Dependencies = append(diff.Dependencies, DependencyChange{Name: name, New: n.version})
+		}
+	}
+	sort.Slice(diff.Dependencies, func(i, j int) bool { return diff.Dependencies[i].Name < diff.Dependencies[j].Name })
+
+	for _, packages := range []struct{ old, new map[string]diffPackage }{
+		{oldDescribed, newDescribed},
+		{oldComponents, newComponents},
+	} {
+		for name, o := range packages.old {
+			if n, ok := packages.new[name]; ok && o.license != n.license {
+				diff.Licenses = append(diff.Licenses, LicenseChange{Name: name, Old: o.license, New: n.license})
+			}
+		}
+	}
+	sort.Slice(diff.Licenses, func(i, j int) bool { return diff.Licenses[i].Name < diff.Licenses[j].Name })
+
+	oldFiles := diffFiles(&oldDoc)
+	newFiles := diffFiles(&newDoc)
+	for path, o := range oldFiles {
+		n, ok := newFiles[path]
+		switch {
+		case !ok:
+			diff.Files.Removed = append(diff.Files.Removed, path)
+		case checksumsDiffer(o, n):
+			diff.Files.Changed = append(diff.Files.Changed, path)
+		default:
+			diff.Files.Unchanged++
+		}
+	}
+	for path := range newFiles {
+		if _, ok := oldFiles[path]; !ok {
+			diff.Files.Added = append(diff.Files.Added, path)
+		}
+	}
+	sort.Strings(diff.Files.Added)
+	sort.Strings(diff.Files.Removed)
+	sort.Strings(diff.Files.Changed)
+
+	return diff, nil
+}
+
+// diffPackages returns the described packages of a document, by name,
+// and its components, by package URL without version.
+func diffPackages(doc *spdxDocument) (described, components map[string]diffPackage) {
+	isDescribed := map[string]bool{}
+	for _, id := range doc.DocumentDescribes {
+		isDescribed[id] = true
+	}
+	for _, r := range doc.Relationships {
+		if r.Element == doc.SPDXID && r.Type == "DESCRIBES" {
+			isDescribed[r.Related] = true
+		}
+	}
+
+	described = map[string]diffPackage{}
+	components = map[string]diffPackage{}
+	for _, p := range doc.Packages {
+		license := p.LicenseDeclared
+		if license == "" || license == "NOASSERTION" {
+			license = p.LicenseConcluded
+		}
+		dp := diffPackage{version: p.VersionInfo, license: license}
+
+		if isDescribed[p.SPDXID] {
+			described[p.Name] = dp
+			continue
+		}
+		for _, ref := range p.ExternalRefs {
+			if ref.ReferenceType == "purl" {
+				components[purlName(ref.ReferenceLocator)] = dp
+			}
+		}
+	}
+	return described, components
+}
+
+// purlName returns a package URL without its version, qualifiers and
+// subpath.
+func purlName(purl string) string {
+	name, _, _ := strings.Cut(purl, "#")
+	name, _, _ = strings.Cut(name, "?")
+	if i := strings.LastIndex(name, "@"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+// diffFiles returns the checksums of the files of a document, by path
+// and algorithm.
+func diffFiles(doc *spdxDocument) map[string]map[string]string {
+	files := map[string]map[string]string{}
+	for _, f := range doc.Files {
+		sums := map[string]string{}
+		for _, c := range f.Checksums {
+			sums[c.Algorithm] = strings.ToLower(c.ChecksumValue)
+		}
+		files[f.FileName] = sums
+	}
+	return files
+}
+
+// checksumsDiffer reports whether the checksums of a file differ for an
+// algorithm of both versions, the algorithms of the SBOMs being
+// configurable.
+func checksumsDiffer(old, new map[string]string) bool {
+	for alg, sum := range old {
+		if other, ok := new[alg]; ok && other != sum {
+			return true
+		}
+	}
+	return false
+}
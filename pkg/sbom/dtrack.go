@@ -0,0 +1,100 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Exporter sends the SBOMs of the packages to another system.
+type Exporter interface {
+	// Name describes the exporter in messages.
+	Name() string
+	// Format is the format of the SBOMs the exporter sends.
+	Format() string
+	// Export sends the SBOM of the package described by spec.
+	Export(spec *Spec, data []byte) error
+}
+
+// DependencyTrack uploads the SBOMs to a Dependency-Track server, or a
+// server implementing its BOM upload API, creating a project for each
+// package version if there is none.
+type DependencyTrack struct {
+	// URL is the base URL of the API server.
+	URL string
+	// APIKey authenticates the uploads.  It needs the BOM_UPLOAD and
+	// PROJECT_CREATION_UPLOAD permissions.
+	APIKey string
+	// Client makes the requests, by default http.DefaultClient.
+	Client *http.Client
+}
+
+type dtrackUpload struct {
+	ProjectName    string `json:"projectName"`
+	ProjectVersion string `json:"projectVersion"`
+	AutoCreate     bool   `json:"autoCreate"`
+	BOM            string `json:"bom"`
+}
+
+func (dt *DependencyTrack) Name() string {
+	return "Dependency-Track"
+}
+
+func (dt *DependencyTrack) Format() string {
+	return FormatCycloneDX
+}
+
+func (dt *DependencyTrack) Export(spec *Spec, data []byte) error {
+	body, err := json.Marshal(dtrackUpload{
+		ProjectName:    spec.PackageName,
+		ProjectVersion: spec.PackageVersion,
+		AutoCreate:     true,
+		BOM:            base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(dt.URL, "/")+"/api/v1/bom", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", dt.APIKey)
+
+	client := dt.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("uploading to %s: %s: %s", dt.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
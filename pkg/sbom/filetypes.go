@@ -0,0 +1,161 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The SPDX file types of the files listed in the SBOMs.
+const (
+	FileTypeBinary  = "BINARY"
+	FileTypeText    = "TEXT"
+	FileTypeSource  = "SOURCE"
+	FileTypeArchive = "ARCHIVE"
+	FileTypeImage   = "IMAGE"
+	FileTypeOther   = "OTHER"
+)
+
+// spdx3Purposes are the SPDX 3 purposes of the file types which have
+// one.
+var spdx3Purposes = map[string]string{
+	FileTypeBinary:  "executable",
+	FileTypeSource:  "source",
+	FileTypeArchive: "archive",
+}
+
+// fileTypeHeadSize is the size of the start of the files read to
+// classify them.
+const fileTypeHeadSize = 512
+
+// fileMagic is the start of the files of a type.
+type fileMagic struct {
+	offset   int
+	magic    string
+	fileType string
+}
+
+var fileMagics = []fileMagic{
+	{0, "\x7fELF", FileTypeBinary},
+	{0, "\xcf\xfa\xed\xfe", FileTypeBinary}, // Mach-O
+	{0, "MZ", FileTypeBinary},               // PE
+	{0, "\x00asm", FileTypeBinary},          // WebAssembly
+	{0, "\xca\xfe\xba\xbe", FileTypeBinary}, // Java class
+	{0, "\x1f\x8b", FileTypeArchive},        // gzip
+	{0, "BZh", FileTypeArchive},
+	{0, "\xfd7zXZ\x00", FileTypeArchive},
+	{0, "\x28\xb5\x2f\xfd", FileTypeArchive}, // zstd
+	{0, "PK\x03\x04", FileTypeArchive},       // zip, jar, wheel
+	{0, "!<arch>\n", FileTypeArchive},        // ar, static libraries
+	{257, "ustar", FileTypeArchive},
+	{0, "\x89PNG\r\n\x1a\n", FileTypeImage},
+	{0, "\xff\xd8\xff", FileTypeImage}, // JPEG
+	{0, "GIF8", FileTypeImage},
+	{0, "\x00\x00\x01\x00", FileTypeImage}, // ICO
+}
+
+// sourceExts are the extensions of source files.
+var sourceExts = map[string]bool{
+	".c": true, ".h": true, ".cc": true, ".cpp": true, ".cxx": true,
+	".hh": true, ".hpp": true, ".s": true, ".S": true, ".go": true,
+	".rs": true, ".py": true, ".rb": true, ".pl": true, ".pm": true,
+	".java": true, ".js": true, ".mjs": true, ".ts": true, ".lua": true,
+	".php": true, ".sh": true, ".bash": true, ".el": true, ".m4": true,
+	".cmake": true, ".tcl": true,
+}
+
+// imageExts are the extensions of images which are text files.
+var imageExts = map[string]bool{
+	".svg": true, ".xpm": true, ".xbm": true,
+}
+
+// fileTypes classifies a file by the start of its content, head, and by
+// the extension of its path.  Text files may also be source files or
+// images, and scripts starting with #! are source files.
+func fileTypes(name string, head []byte) []string {
+	types := map[string]bool{}
+
+	for _, m := range fileMagics {
+		if len(head) >= m.offset+len(m.magic) && string(head[m.offset:m.offset+len(m.magic)]) == m.magic {
+			types[m.fileType] = true
+			break
+		}
+	}
+
+	// WebP images are RIFF files.
+	if len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP" {
+		types[FileTypeImage] = true
+	}
+
+	if len(types) == 0 && isText(head) {
+		types[FileTypeText] = true
+
+		ext := path.Ext(name)
+		if sourceExts[ext] || bytes.HasPrefix(head, []byte("#!")) {
+			types[FileTypeSource] = true
+		}
+		if imageExts[strings.ToLower(ext)] {
+			types[FileTypeImage] = true
+		}
+	}
+
+	if len(types) == 0 {
+		types[FileTypeOther] = true
+	}
+
+	sorted := []string{}
+	for t := range types {
+		sorted = append(sorted, t)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// isText reports whether the start of a file is UTF-8 text, which may be
+// cut in the middle of a character.
+func isText(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+
+	for len(head) > 0 {
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size == 1 {
+			return len(head) < utf8.UTFMax && !utf8.FullRune(head)
+		}
+		head = head[size:]
+	}
+	return true
+}
+
+// headWriter keeps the first size bytes written to it.
+type headWriter struct {
+	size int
+	head []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := w.size - len(w.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.head = append(w.head, p[:n]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"fmt"
+	"io"
+	"os"
+)
+
+// goModule returns the component of a Go module.
+func goModule(path, version string) component {
+	return component{
+		name:    path,
+		version: version,
+		purl:    fmt.Sprintf("pkg:golang/%s@%s", path, version),
+	}
+}
+
+// elfMagic starts the ELF files.
+var elfMagic = []byte("\x7fELF")
+
+// scanGoProgram returns the modules linked into a Go program: its main
+// module, unless it was built from a checkout without version, and its
+// dependencies, with their replacements applied.  Other files have no
+// modules.
+func scanGoProgram(path, rel string) ([]component, error) {
+	isELF, err := hasMagic(path, elfMagic)
+	if err != nil || !isELF {
+		return nil, err
+	}
+
+	info, err := buildinfo.ReadFile(path)
+	if err != nil {
+		// not a Go program, or built without module support.
+		return nil, nil
+	}
+
+	modules := []component{}
+	if info.Main.Path != "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		modules = append(modules, goModule(info.Main.Path, info.Main.Version))
+	}
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		// modules replaced by local directories have no version.
+		if dep.Version == "" {
+			continue
+		}
+		modules = append(modules, goModule(dep.Path, dep.Version))
+	}
+
+	return modules, nil
+}
+
+// hasMagic reports whether a file starts with magic.
+func hasMagic(path string, magic []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false, nil
+	}
+
+	return bytes.Equal(buf, magic), nil
+}
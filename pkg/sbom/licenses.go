@@ -0,0 +1,68 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"fmt"
+	"strings"
+)
+
+// licenseRefPrefix starts the identifiers of the licenses which are not
+// on the SPDX license list.
+const licenseRefPrefix = "LicenseRef-"
+
+// ExtractedLicense is the text of a custom license of a package.
+type ExtractedLicense struct {
+	// ID is the LicenseRef-<id> identifier of the license in the
+	// license expressions.
+	ID   string
+	Text string
+}
+
+// name returns the name of the license, its identifier without prefix.
+func (l *ExtractedLicense) name() string {
+	return strings.TrimPrefix(l.ID, licenseRefPrefix)
+}
+
+func (l *ExtractedLicense) validate() error {
+	if !IsLicenseRef(l.ID) {
+		return fmt.Errorf("license %q is not a custom license, LicenseRef-<id>", l.ID)
+	}
+	if strings.TrimSpace(l.Text) == "" {
+		return fmt.Errorf("license %s has no text", l.ID)
+	}
+	return nil
+}
+
+// IsLicenseRef reports whether id is the identifier of a custom
+// license, LicenseRef-<id>, whose id consists of letters, digits, '.' and
+// '-'.
+func IsLicenseRef(id string) bool {
+	ref := strings.TrimPrefix(id, licenseRefPrefix)
+	return ref != id && ref != "" && strings.Trim(ref, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-") == ""
+}
+
+// LicenseRefs returns the custom licenses of a license expression.
+func LicenseRefs(expression string) []string {
+	refs := []string{}
+	for _, token := range strings.FieldsFunc(expression, func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')'
+	}) {
+		if IsLicenseRef(token) {
+			refs = append(refs, token)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,396 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// licenseTagHeadSize is the size of the start of the text files scanned
+// for SPDX-License-Identifier tags, which follow the copyright notices at
+// the top of the files.
+const licenseTagHeadSize = 4096
+
+// licenseTagPrefix starts the SPDX-License-Identifier tags.
+const licenseTagPrefix = "SPDX-License-Identifier:"
+
+// maxLicenseFileSize bounds the size of the license files which are
+// scanned, well above the one of the longest license texts.
+const maxLicenseFileSize = 256 << 10
+
+// licenseRule identifies a license by phrases of its text, compared
+// after normalization, see normalizeLicenseText.
+type licenseRule struct {
+	id string
+	// all the phrases are in the texts of the license.
+	phrases []string
+	// none of the phrases are in the texts of the license, which
+	// tells apart the licenses sharing phrases.
+	unless []string
+}
+
+// licenseRules are the licenses ScanLicenses detects.  The GNU licenses
+// are identified by their titles, which the texts of the other GNU
+// licenses mention.
+var licenseRules = []licenseRule{{
+	id:      "Apache-2.0",
+	phrases: []string{"apache license", "version 2 0", "terms and conditions for use reproduction and distribution"},
+}, {
+	id:      "MIT",
+	phrases: []string{"permission is hereby granted free of charge to any person obtaining a copy", "the above copyright notice and this permission notice shall be included"},
+}, {
+	id:      "ISC",
+	phrases: []string{"permission to use copy modify and or distribute this software for any purpose with or without fee is hereby granted"},
+}, {
+	id:      "BSD-3-Clause",
+	phrases: []string{"redistribution and use in source and binary forms with or without modification are permitted", "neither the name of"},
+	unless:  []string{"all advertising materials"},
+}, {
+	id:      "BSD-2-Clause",
+	phrases: []string{"redistribution and use in source and binary forms with or without modification are permitted"},
+	unless:  []string{"neither the name of", "all advertising materials"},
+}, {
+	id:      "BSD-4-Clause",
+	phrases: []string{"redistribution and use in source and binary forms with or without modification are permitted", "all advertising materials"},
+}, {
+	id:      "GPL-2.0-only",
+	phrases: []string{"gnu general public license version 2 june 1991"},
+}, {
+	id:      "GPL-3.0-only",
+	phrases: []string{"gnu general public license version 3 29 june 2007"},
+}, {
+	id:      "LGPL-2.0-only",
+	phrases: []string{"gnu library general public license version 2 june 1991"},
+}, {
+	id:      "LGPL-2.1-only",
+	phrases: []string{"gnu lesser general public license version 2 1 february 1999"},
+}, {
+	id:      "LGPL-3.0-only",
+	phrases: []string{"gnu lesser general public license version 3 29 june 2007"},
+}, {
+	id:      "AGPL-3.0-only",
+	phrases: []string{"gnu affero general public license version 3 19 november 2007"},
+}, {
+	id:      "MPL-2.0",
+	phrases: []string{"mozilla public license version 2 0"},
+}, {
+	id:      "BSL-1.0",
+	phrases: []string{"boost software license version 1 0"},
+}, {
+	id:      "Zlib",
+	phrases: []string{"this software is provided as is without any express or implied warranty", "altered source versions must be plainly marked as such"},
+}, {
+	id:      "Unlicense",
+	phrases: []string{"this is free and unencumbered software released into the public domain"},
+}, {
+	id:      "CC0-1.0",
+	phrases: []string{"cc0 1 0 universal"},
+}}
+
+// normalizeLicenseText lowers the case of a text and replaces its runs
+// of punctuation and spaces by single spaces, so that the phrases of the
+// licenses are found whatever the line wrapping and the formatting.
+func normalizeLicenseText(text string) string {
+	var b strings.Builder
+	space := true
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+			space = false
+			continue
+		}
+		if !space {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return " " + strings.TrimSpace(b.String()) + " "
+}
+
+// containsPhrase reports whether a normalized text contains a phrase,
+// which starts and ends at word boundaries.
+func containsPhrase(text, phrase string) bool {
+	return strings.Contains(text, " "+phrase+" ")
+}
+
+// ScanLicenses returns the SPDX identifiers of the licenses whose texts
+// are found in a text, such as the one of a LICENSE file, in the order
+// of the SPDX license list.  Texts bundling several licenses yield all
+// of them.
+func ScanLicenses(text string) []string {
+	normalized := normalizeLicenseText(text)
+
+	ids := []string{}
+	for _, rule := range licenseRules {
+		matches := true
+		for _, phrase := range rule.phrases {
+			if !containsPhrase(normalized, phrase) {
+				matches = false
+				break
+			}
+		}
+		for _, phrase := range rule.unless {
+			if containsPhrase(normalized, phrase) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			ids = append(ids, rule.id)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// isLicenseFile reports whether a file of a package holds license texts:
+// the LICENSE, LICENCE, COPYING and UNLICENSE files, whatever their
+// extension, and the files installed in /usr/share/licenses.
+func isLicenseFile(p string) bool {
+	if strings.HasPrefix(p, "usr/share/licenses/") {
+		return true
+	}
+
+	name := strings.ToUpper(path.Base(p))
+	for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING", "UNLICENSE"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanLicenseFile returns the licenses whose texts are in a file, none
+// for the files too large to be license files.
+func scanLicenseFile(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	text, err := io.ReadAll(io.LimitReader(f, maxLicenseFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(text) > maxLicenseFileSize {
+		return nil, nil
+	}
+
+	return ScanLicenses(string(text)), nil
+}
+
+// licenseTags returns the license expressions of the
+// SPDX-License-Identifier tags of the start of a text file, without the
+// comment delimiters around them.  The tags whose values are not license
+// expressions, such as the ones of the programs handling the tags, are
+// ignored.
+func licenseTags(head []byte) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(head), "\n") {
+		i := strings.Index(line, licenseTagPrefix)
+		if i < 0 {
+			continue
+		}
+
+		expression := line[i+len(licenseTagPrefix):]
+		for _, end := range []string{"*/", "-->", "*)", "-}", "#}", "%>"} {
+			if j := strings.Index(expression, end); j >= 0 {
+				expression = expression[:j]
+			}
+		}
+		expression = strings.Join(strings.Fields(expression), " ")
+
+		if isLicenseExpression(expression) && !seen[expression] {
+			tags = append(tags, expression)
+			seen[expression] = true
+		}
+	}
+	return tags
+}
+
+// isLicenseExpression reports whether a text looks like an SPDX license
+// expression: license identifiers and operators, with balanced
+// parentheses.
+func isLicenseExpression(expression string) bool {
+	depth := 0
+	ids := 0
+	for _, token := range licenseTokens(expression) {
+		switch token {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth < 0 {
+				return false
+			}
+		case "AND", "OR", "WITH", "and", "or", "with":
+		default:
+			for _, r := range token {
+				if r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(".-+:", r) {
+					return false
+				}
+			}
+			ids++
+		}
+	}
+	return depth == 0 && ids > 0
+}
+
+// licenseTokens splits a license expression into parentheses, operators
+// and identifiers.
+func licenseTokens(expression string) []string {
+	expression = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expression)
+	return strings.Fields(expression)
+}
+
+// expressionLicenses returns the licenses of a license expression, without
+// its exceptions.
+func expressionLicenses(expression string) []string {
+	ids := []string{}
+	exception := false
+	for _, token := range licenseTokens(expression) {
+		switch strings.ToUpper(token) {
+		case "(", ")", "AND", "OR":
+		case "WITH":
+			exception = true
+		default:
+			if !exception {
+				ids = append(ids, token)
+			}
+			exception = false
+		}
+	}
+	return ids
+}
+
+// licenseInfo returns the licenses found in a file, in its license texts
+// and in its SPDX-License-Identifier tags, sorted.
+func (f *file) licenseInfo() []string {
+	set := map[string]bool{}
+	for _, id := range f.licenses {
+		set[id] = true
+	}
+	for _, tag := range f.licenseTags {
+		for _, id := range expressionLicenses(tag) {
+			set[id] = true
+		}
+	}
+
+	ids := []string{}
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// taggedLicense returns the license of a file declared by its
+// SPDX-License-Identifier tags, or NOASSERTION.
+func (f *file) taggedLicense() string {
+	switch len(f.licenseTags) {
+	case 0:
+		return "NOASSERTION"
+	case 1:
+		return f.licenseTags[0]
+	}
+
+	terms := []string{}
+	for _, tag := range f.licenseTags {
+		if strings.Contains(tag, " ") {
+			tag = "(" + tag + ")"
+		}
+		terms = append(terms, tag)
+	}
+	return strings.Join(terms, " AND ")
+}
+
+// licenseExpression returns the license of a file: the one of its
+// SPDX-License-Identifier tags or the licenses whose texts it contains,
+// empty when none is found.
+func (f *file) licenseExpression() string {
+	if len(f.licenseTags) > 0 {
+		return f.taggedLicense()
+	}
+	return strings.Join(f.licenses, " AND ")
+}
+
+// licensesFromFiles returns the licenses found in the files of a package,
+// sorted.
+func licensesFromFiles(contents *packageContents) []string {
+	set := map[string]bool{}
+	for _, f := range contents.files {
+		for _, id := range f.licenseInfo() {
+			set[id] = true
+		}
+	}
+
+	ids := []string{}
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// licenseFamily returns the identifier of a license without the -only
+// and -or-later suffixes of the GNU licenses, which their texts do not
+// tell apart.
+func licenseFamily(id string) string {
+	id = strings.TrimSuffix(id, "+")
+	id = strings.TrimSuffix(id, "-only")
+	return strings.TrimSuffix(id, "-or-later")
+}
+
+// concludedLicense returns the license of the package concluded from its
+// declared license and the licenses found in its files: the declared
+// license and the licenses found besides it, or NOASSERTION when no
+// license is found.
+func (spec *Spec) concludedLicense(contents *packageContents) string {
+	found := licensesFromFiles(contents)
+	if len(found) == 0 {
+		return "NOASSERTION"
+	}
+
+	declared := map[string]bool{}
+	for _, token := range strings.FieldsFunc(spec.License, func(r rune) bool { return r == ' ' || r == '(' || r == ')' }) {
+		declared[licenseFamily(token)] = true
+	}
+
+	extra := []string{}
+	for _, id := range found {
+		if !declared[licenseFamily(id)] {
+			extra = append(extra, id)
+		}
+	}
+
+	switch {
+	case len(extra) == 0:
+		return spec.License
+	case spec.License == "":
+		return strings.Join(extra, " AND ")
+	case strings.Contains(spec.License, " "):
+		return "(" + spec.License + ") AND " + strings.Join(extra, " AND ")
+	default:
+		return spec.License + " AND " + strings.Join(extra, " AND ")
+	}
+}
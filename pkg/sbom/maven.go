@@ -0,0 +1,152 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// javaArchiveExts are the extensions of the Java archives, which are zip
+// files.
+var javaArchiveExts = map[string]bool{".jar": true, ".war": true, ".ear": true}
+
+const (
+	// maxNestedArchiveDepth bounds the nesting of the archives read in
+	// a Java archive, such as the jars shaded in a Spring Boot jar.
+	maxNestedArchiveDepth = 3
+	// maxNestedArchiveSize bounds the size of a nested archive, which
+	// is read in memory.
+	maxNestedArchiveSize = 256 << 20
+	// maxPomPropertiesSize bounds the size of a pom.properties.
+	maxPomPropertiesSize = 64 << 10
+)
+
+// mavenArtifact returns the component of a Maven artifact.
+func mavenArtifact(group, artifact, version string) component {
+	return component{
+		name:       group + ":" + artifact,
+		version:    version,
+		purl:       fmt.Sprintf("pkg:maven/%s/%s@%s", group, artifact, version),
+		dependency: true,
+	}
+}
+
+// isPomProperties reports whether a path is the one of the
+// pom.properties of a Maven artifact, META-INF/maven/<group>/<artifact>/
+// pom.properties.
+func isPomProperties(name string) bool {
+	parts := strings.Split(name, "/")
+	n := len(parts)
+	return n >= 5 && parts[n-1] == "pom.properties" && parts[n-4] == "maven" && parts[n-5] == "META-INF"
+}
+
+// scanJavaArchive returns the Maven artifacts of a Java archive, described
+// by the pom.properties files it contains and the ones of the archives
+// nested in it, or of an unpacked pom.properties.  Other files have no
+// artifacts.
+func scanJavaArchive(file, rel string) ([]component, error) {
+	if isPomProperties(rel) {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return pomPropertiesArtifact(f), nil
+	}
+
+	if !javaArchiveExts[strings.ToLower(path.Ext(rel))] {
+		return nil, nil
+	}
+
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		// not a zip file.
+		return nil, nil
+	}
+	defer r.Close()
+
+	return scanZipArtifacts(&r.Reader, 0)
+}
+
+// scanZipArtifacts returns the Maven artifacts of the pom.properties of a
+// zip archive and of the Java archives nested in it.
+func scanZipArtifacts(r *zip.Reader, depth int) ([]component, error) {
+	artifacts := []component{}
+	for _, f := range r.File {
+		switch {
+		case isPomProperties(f.Name):
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			artifacts = append(artifacts, pomPropertiesArtifact(rc)...)
+			rc.Close()
+		case javaArchiveExts[strings.ToLower(path.Ext(f.Name))] && depth < maxNestedArchiveDepth && f.UncompressedSize64 <= maxNestedArchiveSize:
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(io.LimitReader(rc, maxNestedArchiveSize))
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			nested, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				// not a zip file.
+				continue
+			}
+			found, err := scanZipArtifacts(nested, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			artifacts = append(artifacts, found...)
+		}
+	}
+	return artifacts, nil
+}
+
+// pomPropertiesArtifact returns the artifact described by a
+// pom.properties, none if it lacks its group, artifact or version.
+func pomPropertiesArtifact(r io.Reader) []component {
+	properties := map[string]string{}
+	scanner := bufio.NewScanner(io.LimitReader(r, maxPomPropertiesSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i < 0 {
+			continue
+		}
+		properties[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+
+	group, artifact, version := properties["groupId"], properties["artifactId"], properties["version"]
+	if group == "" || artifact == "" || version == "" {
+		return nil
+	}
+	return []component{mavenArtifact(group, artifact, version)}
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MergeSPDX merges SPDX 2 JSON documents, such as the SBOMs of the
+// packages of a release for every architecture, into a single document
+// named name.  The elements of every document are copied, renamed when
+// their identifiers are already used, and the packages with the same
+// package URL and checksums, such as the components found in several
+// packages, are only listed once.  The merged document references the
+// documents it is merged from, and each of their described packages is
+// DESCRIBED_BY its document.  The references between the merged
+// documents, such as the ones of the SBOMs of subpackages to the SBOM of
+// their origin package, become references to the copied elements.
+func MergeSPDX(name string, docs [][]byte) ([]byte, error) {
+	if len(docs) == 0 {
+		return nil, errors.New("no SPDX document to merge")
+	}
+
+	parsed := make([]spdxDocument, len(docs))
+	inputs := map[string]int{}
+	for i, data := range docs {
+		doc := &parsed[i]
+		if err := json.Unmarshal(data, doc); err != nil {
+			return nil, fmt.Errorf("unable to parse SPDX document %d: %w", i, err)
+		}
+		if !strings.HasPrefix(doc.SPDXVersion, "SPDX-2") {
+			return nil, fmt.Errorf("document %s is not an SPDX 2 document", doc.Name)
+		}
+		if _, ok := inputs[doc.DocumentNamespace]; ok {
+			return nil, fmt.Errorf("document %s is given more than once", doc.DocumentNamespace)
+		}
+		inputs[doc.DocumentNamespace] = i
+	}
+
+	merged := &spdxDocument{
+		SPDXVersion:  "SPDX-2.3",
+		DataLicense:  "CC0-1.0",
+		SPDXID:       "SPDXRef-DOCUMENT",
+		Name:         name,
+		CreationInfo: spdxCreationInfo{Creators: []string{}},
+	}
+
+	ids := map[string]bool{merged.SPDXID: true}
+	creators := map[string]bool{}
+	licenses := map[string]spdxExtractedLicense{}
+	// packages maps the package URLs and checksums of the merged
+	// packages to their identifiers.
+	packages := map[string]string{}
+	// docRefs maps the namespaces of the referenced documents to their
+	// references in the merged document.
+	docRefs := map[string]string{}
+	usedDocRefs := map[string]bool{}
+	addDocRef := func(name, namespace string, checksum spdxChecksum) string {
+		if ref, ok := docRefs[namespace]; ok {
+			return ref
+		}
+		ref := uniqueName(usedDocRefs, name)
+		docRefs[namespace] = ref
+		merged.ExternalDocumentRefs = append(merged.ExternalDocumentRefs, spdxExternalDocumentRef{
+			ExternalDocumentID: ref,
+			SPDXDocument:       namespace,
+			Checksum:           checksum,
+		})
+		return ref
+	}
+	// renamed maps the identifiers of the elements of every document
+	// to the ones of the merged document.
+	renamed := make([]map[string]string, len(docs))
+	namespaces := sha256.New()
+
+	for i, data := range docs {
+		doc := &parsed[i]
+		fmt.Fprintf(namespaces, "%s\n", doc.DocumentNamespace)
+
+		// the created date of the merged document is the latest
+		// one, which the RFC 3339 dates of melange sort by.
+		if doc.CreationInfo.Created > merged.CreationInfo.Created {
+			merged.CreationInfo.Created = doc.CreationInfo.Created
+		}
+		for _, c := range doc.CreationInfo.Creators {
+			if !creators[c] {
+				creators[c] = true
+				merged.CreationInfo.Creators = append(merged.CreationInfo.Creators, c)
+			}
+		}
+
+		digest := sha1.Sum(data) // nolint:gosec
+		addDocRef("DocumentRef-"+spdxIDString(doc.Name), doc.DocumentNamespace, spdxChecksum{Algorithm: "SHA1", ChecksumValue: hex.EncodeToString(digest[:])})
+
+		// the identifiers of the document are renamed to the unused
+		// ones of the merged document.
+		renamed[i] = map[string]string{doc.SPDXID: merged.SPDXID}
+		rename := func(id string) string {
+			newID := id
+			for n := i + 1; ids[newID]; n++ {
+				newID = fmt.Sprintf("%s-%d", id, n)
+			}
+			ids[newID] = true
+			renamed[i][id] = newID
+			return newID
+		}
+
+		for _, p := range doc.Packages {
+			key := packageKey(p)
+			if id, ok := packages[key]; ok && key != "" {
+				renamed[i][p.SPDXID] = id
+				continue
+			}
+
+			p.SPDXID = rename(p.SPDXID)
+			if key != "" {
+				packages[key] = p.SPDXID
+			}
+			merged.Packages = append(merged.Packages, p)
+		}
+
+		for _, f := range doc.Files {
+			f.SPDXID = rename(f.SPDXID)
+			merged.Files = append(merged.Files, f)
+		}
+
+		for _, l := range doc.ExtractedLicenses {
+			if seen, ok := licenses[l.LicenseID]; ok {
+				if seen.ExtractedText != l.ExtractedText {
+					return nil, fmt.Errorf("document %s has another text for %s", doc.Name, l.LicenseID)
+				}
+				continue
+			}
+			licenses[l.LicenseID] = l
+			merged.ExtractedLicenses = append(merged.ExtractedLicenses, l)
+		}
+	}
+
+	// the relationships are copied once every element is renamed, for
+	// the references between the merged documents to be resolved.
+	for i := range parsed {
+		doc := &parsed[i]
+		docRef := docRefs[doc.DocumentNamespace]
+
+		external := map[string]spdxExternalDocumentRef{}
+		for _, ref := range doc.ExternalDocumentRefs {
+			external[ref.ExternalDocumentID] = ref
+		}
+		resolve := func(id string) string {
+			ref, element, ok := strings.Cut(id, ":")
+			if !ok {
+				if newID, ok := renamed[i][id]; ok {
+					return newID
+				}
+				return id
+			}
+			ext, ok := external[ref]
+			if !ok {
+				return id
+			}
+			if j, ok := inputs[ext.SPDXDocument]; ok {
+				if newID, ok := renamed[j][element]; ok {
+					return newID
+				}
+			}
+			return addDocRef(ref, ext.SPDXDocument, ext.Checksum) + ":" + element
+		}
+
+		described := append([]string{}, doc.DocumentDescribes...)
+		for _, r := range doc.Relationships {
+			// the described packages are listed in
+			// documentDescribes.
+			if r.Element == doc.SPDXID && r.Type == "DESCRIBES" {
+				described = append(described, r.Related)
+				continue
+			}
+			merged.Relationships = append(merged.Relationships, spdxRelationship{
+				Element: resolve(r.Element),
+				Type:    r.Type,
+				Related: resolve(r.Related),
+			})
+		}
+
+		for _, id := range uniqueStrings(described) {
+			merged.DocumentDescribes = append(merged.DocumentDescribes, resolve(id))
+			merged.Relationships = append(merged.Relationships, spdxRelationship{
+				Element: resolve(id),
+				Type:    "DESCRIBED_BY",
+				Related: docRef + ":" + doc.SPDXID,
+			})
+		}
+	}
+
+	merged.Relationships = uniqueRelationships(merged.Relationships)
+	merged.DocumentDescribes = uniqueStrings(merged.DocumentDescribes)
+	merged.DocumentNamespace = fmt.Sprintf("https://spdx.org/spdxdocs/melange/%s-%s", name, hex.EncodeToString(namespaces.Sum(nil)))
+
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+// packageKey identifies the packages which are the same in the documents
+// being merged: their package URL and checksums.  It is empty for the
+// packages without a package URL, which are never deduplicated.
+func packageKey(p spdxPackage) string {
+	purl := ""
+	for _, ref := range p.ExternalRefs {
+		if ref.ReferenceType == "purl" {
+			purl = ref.ReferenceLocator
+		}
+	}
+	if purl == "" {
+		return ""
+	}
+
+	sums := []string{}
+	for _, c := range p.Checksums {
+		sums = append(sums, c.Algorithm+":"+c.ChecksumValue)
+	}
+	sort.Strings(sums)
+	return purl + " " + strings.Join(sums, " ")
+}
+
+// uniqueName returns name, or name with a numeric suffix if it is
+// already used, and marks it as used.
+func uniqueName(used map[string]bool, name string) string {
+	unique := name
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d", name, n)
+	}
+	used[unique] = true
+	return unique
+}
+
+func uniqueRelationships(relationships []spdxRelationship) []spdxRelationship {
+	seen := map[spdxRelationship]bool{}
+	unique := []spdxRelationship{}
+	for _, r := range relationships {
+		if !seen[r] {
+			seen[r] = true
+			unique = append(unique, r)
+		}
+	}
+	return unique
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// npmPackage returns the component of an npm package, whose scope, if
+// any, is the namespace of its package URL.
+func npmPackage(name, version string) component {
+	purlName := name
+	if strings.HasPrefix(name, "@") {
+		purlName = "%40" + name[1:]
+	}
+
+	return component{
+		name:    name,
+		version: version,
+		purl:    fmt.Sprintf("pkg:npm/%s@%s", purlName, version),
+	}
+}
+
+// scanNodeModule returns the npm package described by the package.json
+// of a package installed in a node_modules directory, including the ones
+// nested in the node_modules of other packages.
+func scanNodeModule(file, rel string) ([]component, error) {
+	if path.Base(rel) != "package.json" {
+		return nil, nil
+	}
+
+	dir := path.Dir(rel)
+	parent := path.Dir(dir)
+	if strings.HasPrefix(path.Base(parent), "@") {
+		parent = path.Dir(parent)
+	}
+	if path.Base(parent) != "node_modules" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		// the test fixtures of some packages are not valid.
+		return nil, nil
+	}
+	if manifest.Name == "" || manifest.Version == "" {
+		return nil, nil
+	}
+
+	return []component{npmPackage(manifest.Name, manifest.Version)}, nil
+}
@@ -0,0 +1,325 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ntiaComponent holds the minimum elements of a component of an SBOM,
+// as defined by the NTIA.
+type ntiaComponent struct {
+	id       string
+	name     string
+	version  string
+	supplier string
+	// uniqueID is a package URL, CPE or SWID tag of the component.
+	uniqueID string
+}
+
+// ntiaDocument holds the minimum elements of an SBOM.
+type ntiaDocument struct {
+	// authors are the people or organizations who created the SBOM,
+	// not the tools they used.
+	authors   []string
+	timestamp string
+	// related is whether the document states the relationship of the
+	// components to the package it describes.
+	related    bool
+	components []ntiaComponent
+}
+
+// problems returns the missing minimum elements.
+func (d *ntiaDocument) problems() []string {
+	problems := []string{}
+	if len(d.authors) == 0 {
+		problems = append(problems, "no author other than tools")
+	}
+	if d.timestamp == "" {
+		problems = append(problems, "no timestamp")
+	}
+	if !d.related {
+		problems = append(problems, "no relationship to the described package")
+	}
+	if len(d.components) == 0 {
+		problems = append(problems, "no component")
+	}
+
+	for _, c := range d.components {
+		missing := []string{}
+		for _, e := range []struct{ element, value string }{
+			{"name", c.name},
+			{"version", c.version},
+			{"supplier", c.supplier},
+			{"unique identifier", c.uniqueID},
+		} {
+			if e.value == "" || e.value == "NOASSERTION" {
+				missing = append(missing, e.element)
+			}
+		}
+
+		if len(missing) > 0 {
+			name := c.name
+			if name == "" {
+				name = c.id
+			}
+			problems = append(problems, fmt.Sprintf("component %s: no %s", name, strings.Join(missing, ", ")))
+		}
+	}
+
+	return problems
+}
+
+// CheckNTIA returns the NTIA minimum elements missing from an SBOM in
+// one of the formats: the author and timestamp of the document, the
+// relationship of the components to the described package, and the
+// supplier, name, version and unique identifier of the package and the
+// components it contains.  The sources a package is generated from are
+// provenance, not components, and are not checked.
+func CheckNTIA(format string, data []byte) ([]string, error) {
+	var doc *ntiaDocument
+	var err error
+	switch format {
+	case FormatSPDX:
+		doc, err = ntiaSPDX(data)
+	case FormatSPDX3:
+		doc, err = ntiaSPDX3(data)
+	case FormatCycloneDX:
+		doc, err = ntiaCycloneDX(data)
+	default:
+		return nil, fmt.Errorf("unknown SBOM format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s SBOM: %w", format, err)
+	}
+
+	return doc.problems(), nil
+}
+
+func ntiaSPDX(data []byte) (*ntiaDocument, error) {
+	var doc struct {
+		CreationInfo struct {
+			Created  string   `json:"created"`
+			Creators []string `json:"creators"`
+		} `json:"creationInfo"`
+		DocumentDescribes []string `json:"documentDescribes"`
+		Packages          []struct {
+			SPDXID       string `json:"SPDXID"`
+			Name         string `json:"name"`
+			VersionInfo  string `json:"versionInfo"`
+			Supplier     string `json:"supplier"`
+			ExternalRefs []struct {
+				ReferenceType    string `json:"referenceType"`
+				ReferenceLocator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+		Relationships []spdxRelationship `json:"relationships"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	d := &ntiaDocument{timestamp: doc.CreationInfo.Created}
+	for _, creator := range doc.CreationInfo.Creators {
+		if !strings.HasPrefix(creator, "Tool:") {
+			d.authors = append(d.authors, creator)
+		}
+	}
+
+	checked := map[string]bool{}
+	for _, id := range doc.DocumentDescribes {
+		checked[id] = true
+	}
+	for _, r := range doc.Relationships {
+		if r.Element == "SPDXRef-DOCUMENT" && r.Type == "DESCRIBES" {
+			checked[r.Related] = true
+		}
+	}
+	d.related = len(checked) > 0
+	for _, r := range doc.Relationships {
+		if checked[r.Element] && r.Type == "CONTAINS" {
+			checked[r.Related] = true
+		}
+	}
+
+	for _, p := range doc.Packages {
+		if !checked[p.SPDXID] {
+			continue
+		}
+
+		c := ntiaComponent{id: p.SPDXID, name: p.Name, version: p.VersionInfo, supplier: p.Supplier}
+		for _, ref := range p.ExternalRefs {
+			switch ref.ReferenceType {
+			case "purl", "cpe22Type", "cpe23Type", "swid":
+				c.uniqueID = ref.ReferenceLocator
+			}
+		}
+		d.components = append(d.components, c)
+	}
+
+	return d, nil
+}
+
+func ntiaSPDX3(data []byte) (*ntiaDocument, error) {
+	var doc struct {
+		Graph []map[string]interface{} `json:"@graph"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	str := func(e map[string]interface{}, key string) string {
+		s, _ := e[key].(string)
+		return s
+	}
+	strs := func(e map[string]interface{}, key string) []string {
+		values := []string{}
+		list, _ := e[key].([]interface{})
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	elements := map[string]map[string]interface{}{}
+	for _, e := range doc.Graph {
+		if id := str(e, "spdxId"); id != "" {
+			elements[id] = e
+		}
+	}
+
+	d := &ntiaDocument{}
+	checked := map[string]bool{}
+	for _, e := range doc.Graph {
+		switch str(e, "type") {
+		case "CreationInfo":
+			d.timestamp = str(e, "created")
+			for _, id := range strs(e, "createdBy") {
+				if t := str(elements[id], "type"); t == "Organization" || t == "Person" {
+					d.authors = append(d.authors, str(elements[id], "name"))
+				}
+			}
+		case "SpdxDocument":
+			for _, id := range strs(e, "rootElement") {
+				checked[id] = true
+			}
+		}
+	}
+	d.related = len(checked) > 0
+
+	for _, e := range doc.Graph {
+		if str(e, "type") == "Relationship" && str(e, "relationshipType") == "contains" && checked[str(e, "from")] {
+			for _, id := range strs(e, "to") {
+				checked[id] = true
+			}
+		}
+	}
+
+	for _, e := range doc.Graph {
+		id := str(e, "spdxId")
+		if str(e, "type") != "software_Package" || !checked[id] {
+			continue
+		}
+
+		d.components = append(d.components, ntiaComponent{
+			id:       id,
+			name:     str(e, "name"),
+			version:  str(e, "software_packageVersion"),
+			supplier: str(elements[str(e, "suppliedBy")], "name"),
+			uniqueID: str(e, "software_packageUrl"),
+		})
+	}
+
+	return d, nil
+}
+
+func ntiaCycloneDX(data []byte) (*ntiaDocument, error) {
+	type component struct {
+		BOMRef   string     `json:"bom-ref"`
+		Type     string     `json:"type"`
+		Name     string     `json:"name"`
+		Version  string     `json:"version"`
+		PURL     string     `json:"purl"`
+		CPE      string     `json:"cpe"`
+		Supplier *cdxEntity `json:"supplier"`
+		// Components are not typed, as JSON cannot be decoded
+		// into recursive anonymous types.
+		Components []json.RawMessage `json:"components"`
+	}
+	var doc struct {
+		Metadata struct {
+			Timestamp string          `json:"timestamp"`
+			Authors   []cdxEntity     `json:"authors"`
+			Component json.RawMessage `json:"component"`
+		} `json:"metadata"`
+		Components   []json.RawMessage `json:"components"`
+		Dependencies []json.RawMessage `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	d := &ntiaDocument{timestamp: doc.Metadata.Timestamp}
+	for _, a := range doc.Metadata.Authors {
+		d.authors = append(d.authors, a.Name)
+	}
+	d.related = len(doc.Metadata.Component) > 0 || len(doc.Dependencies) > 0
+
+	var walk func(raw []json.RawMessage, nested bool) error
+	walk = func(raw []json.RawMessage, nested bool) error {
+		for _, r := range raw {
+			var c component
+			if err := json.Unmarshal(r, &c); err != nil {
+				return err
+			}
+			// nesting relates the components to the described one.
+			if nested {
+				d.related = true
+			}
+			if c.Type == "file" {
+				continue
+			}
+
+			nc := ntiaComponent{id: c.BOMRef, name: c.Name, version: c.Version, uniqueID: c.PURL}
+			if nc.uniqueID == "" {
+				nc.uniqueID = c.CPE
+			}
+			if c.Supplier != nil {
+				nc.supplier = c.Supplier.Name
+			}
+			d.components = append(d.components, nc)
+
+			if err := walk(c.Components, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(doc.Metadata.Component) > 0 {
+		if err := walk([]json.RawMessage{doc.Metadata.Component}, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := walk(doc.Components, false); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
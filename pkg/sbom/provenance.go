@@ -0,0 +1,71 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+// Provenance describes how melange built a package, so that its SBOM
+// alone identifies how the package was produced.  It is recorded as
+// annotations of the package in the SPDX SBOMs, and as properties in the
+// CycloneDX SBOM.
+type Provenance struct {
+	// ConfigDigest is the digest of the configuration file, such as
+	// sha256:<hex>.
+	ConfigDigest string
+	// Pipelines lists the pipelines used by the build, in the order
+	// they were first used, as "<uses> sha256:<hex>", the digest of the
+	// definition the pipeline was resolved to.
+	Pipelines []string
+	// Builder is the version of melange, such as "melange v0.2.0".
+	Builder string
+	// Runner runs the pipelines, such as bubblewrap.
+	Runner string
+	// BuildEnvironment is the digest of the database of the packages
+	// installed in the build environment, such as sha256:<hex>.
+	BuildEnvironment string
+}
+
+// provenanceFact is a fact of the provenance of a package, named after
+// the CycloneDX property which records it.
+type provenanceFact struct {
+	name  string
+	value string
+}
+
+// facts returns the facts of the provenance which are known, in order.
+func (p *Provenance) facts() []provenanceFact {
+	if p == nil {
+		return nil
+	}
+
+	facts := []provenanceFact{}
+	add := func(name, value string) {
+		if value != "" {
+			facts = append(facts, provenanceFact{name: name, value: value})
+		}
+	}
+
+	add("melange:config-digest", p.ConfigDigest)
+	for _, pipeline := range p.Pipelines {
+		add("melange:pipeline", pipeline)
+	}
+	add("melange:builder", p.Builder)
+	add("melange:runner", p.Runner)
+	add("melange:build-environment", p.BuildEnvironment)
+	return facts
+}
+
+// comment describes a fact in an annotation of the SPDX SBOMs.
+func (f provenanceFact) comment() string {
+	return f.name + ": " + f.value
+}
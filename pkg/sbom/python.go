@@ -0,0 +1,107 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pythonNameSeparators are the runs of characters which are equivalent
+// in the names of Python distributions.
+var pythonNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// pythonDistribution returns the component of a Python distribution,
+// with its name normalized as in PEP 503, like the pypi package URLs
+// require.
+func pythonDistribution(name, version string) component {
+	normalized := strings.ToLower(pythonNameSeparators.ReplaceAllString(name, "-"))
+	return component{
+		name:    name,
+		version: version,
+		purl:    fmt.Sprintf("pkg:pypi/%s@%s", normalized, version),
+	}
+}
+
+// scanPythonMetadata returns the Python distribution described by the
+// METADATA of a .dist-info directory, or the PKG-INFO of an .egg-info
+// directory or file, installed in a site-packages or dist-packages
+// directory.
+func scanPythonMetadata(file, rel string) ([]component, error) {
+	dir, base := path.Split(rel)
+	dir = strings.TrimSuffix(dir, "/")
+
+	switch {
+	case base == "METADATA" && strings.HasSuffix(dir, ".dist-info"):
+	case base == "PKG-INFO" && strings.HasSuffix(dir, ".egg-info"):
+	case strings.HasSuffix(base, ".egg-info"):
+		// distutils installs PKG-INFO as a file named after the
+		// distribution.
+		dir = rel
+	default:
+		return nil, nil
+	}
+
+	switch path.Base(path.Dir(dir)) {
+	case "site-packages", "dist-packages":
+	default:
+		return nil, nil
+	}
+
+	name, version, err := readPythonMetadata(file)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || version == "" {
+		return nil, nil
+	}
+
+	return []component{pythonDistribution(name, version)}, nil
+}
+
+// readPythonMetadata returns the name and version of the core metadata
+// of a Python distribution, whose headers end at the first empty line.
+func readPythonMetadata(file string) (name, version string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "name":
+			name = strings.TrimSpace(v)
+		case "version":
+			version = strings.TrimSpace(v)
+		}
+	}
+
+	return name, version, scanner.Err()
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"sync"
+)
+
+// GeneratorImplementation serializes the description of a package in an
+// SBOM format provided by a tool embedding melange, such as a format
+// with the results of a proprietary scanner.
+type GeneratorImplementation interface {
+	// Format is the name of the format, which the Formats of a Spec
+	// select.  Registering a format of melange replaces it.
+	Format() string
+	// Ext is the extension of the SBOM files.
+	Ext() string
+	// Generate returns the SBOM of a package.
+	Generate(spec *Spec, contents *Contents) ([]byte, error)
+}
+
+// Contents is what a package is found to contain.
+type Contents struct {
+	// Files are the regular files and the symbolic links of the
+	// package, in lexical order.
+	Files []File
+	// Components are the software of other ecosystems contained in
+	// the package, such as the Go modules linked into its Go
+	// programs, sorted by package URL.
+	Components []Component
+}
+
+// File is a regular file or a symbolic link of a package.
+type File struct {
+	// Path is relative to the root of the package.
+	Path string
+	// Digests maps the checksum algorithms to the hex encoded digests
+	// of the file.
+	Digests map[string]string
+	// Types are the SPDX file types of the file, such as BINARY.
+	Types []string
+	// LinkTarget is the target of a symbolic link, empty for the
+	// regular files.
+	LinkTarget string
+	// Licenses are the SPDX identifiers of the licenses whose texts
+	// are in the file, a LICENSE or COPYING file.
+	Licenses []string
+	// LicenseTags are the license expressions of the
+	// SPDX-License-Identifier tags of the file.
+	LicenseTags []string
+	// Dependencies are the package URLs of the components the file
+	// depends on, such as the crates linked into a program.
+	Dependencies []string
+}
+
+// Component is a package of another ecosystem contained in a package.
+type Component struct {
+	Name    string
+	Version string
+	PURL    string
+}
+
+var (
+	generatorsMu sync.Mutex
+	generators   = map[string]GeneratorImplementation{}
+)
+
+// RegisterGenerator makes an SBOM format available to the generators
+// created afterwards.  It is meant to be called from the init function
+// of the package implementing the format.
+func RegisterGenerator(impl GeneratorImplementation) {
+	generatorsMu.Lock()
+	defer generatorsMu.Unlock()
+
+	generators[impl.Format()] = impl
+}
+
+// registeredGenerators returns the implementations of the registered
+// formats, adapted to the ones of melange.
+func registeredGenerators() map[string]generatorImplementation {
+	generatorsMu.Lock()
+	defer generatorsMu.Unlock()
+
+	impls := map[string]generatorImplementation{}
+	for format, impl := range generators {
+		impls[format] = registeredGenerator{impl}
+	}
+	return impls
+}
+
+// registeredGenerator adapts a registered implementation.
+type registeredGenerator struct {
+	impl GeneratorImplementation
+}
+
+func (g registeredGenerator) Ext() string {
+	return g.impl.Ext()
+}
+
+func (g registeredGenerator) Generate(spec *Spec, contents *packageContents) ([]byte, error) {
+	c := &Contents{Files: []File{}, Components: []Component{}}
+	for _, f := range contents.files {
+		c.Files = append(c.Files, File{Path: f.path, Digests: f.digests, Types: f.types, LinkTarget: f.link, Licenses: f.licenses, LicenseTags: f.licenseTags, Dependencies: contents.dependencies[f.path]})
+	}
+	for _, m := range contents.components {
+		c.Components = append(c.Components, Component{Name: m.name, Version: m.version, PURL: m.purl})
+	}
+
+	return g.impl.Generate(spec, c)
+}
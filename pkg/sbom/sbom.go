@@ -0,0 +1,743 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sbom generates software bills of materials describing the
+// contents of the packages built by melange.
+package sbom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The formats of the generated SBOMs.
+const (
+	// FormatSPDX is SPDX 2.3 JSON.
+	FormatSPDX = "spdx"
+	// FormatSPDXTagValue is SPDX 2.3 tag-value, with the contents of
+	// the FormatSPDX document.
+	FormatSPDXTagValue = "spdx-tv"
+	// FormatSPDX3 is SPDX 3.0 JSON-LD.
+	FormatSPDX3 = "spdx3"
+	// FormatCycloneDX is CycloneDX 1.5 JSON.
+	FormatCycloneDX = "cyclonedx"
+)
+
+// DefaultFormats are the formats generated when a Spec lists none.
+var DefaultFormats = []string{FormatSPDX}
+
+// Spec describes the package an SBOM is generated for.
+type Spec struct {
+	// Path is the directory holding the contents of the package.
+	Path string
+	// OutputDir is where the SBOMs are written, as
+	// sbom-<arch>.<format extension>.  The SBOMs do not describe the
+	// files already in it.
+	OutputDir string
+
+	PackageName    string
+	PackageVersion string
+	// Arch is the APK architecture of the package.
+	Arch string
+	// License is the SPDX license expression of the package.
+	License string
+	// Copyright is the copyright text of the package.
+	Copyright string
+	// ExtractedLicenses are the texts of the custom licenses of the
+	// license expression.
+	ExtractedLicenses []ExtractedLicense
+	// Supplier distributes the package and its components, and
+	// Originator is the upstream author of the package, see
+	// ValidateAgent.  They are optional.
+	Supplier   string
+	Originator string
+	// CPEs are the CPE 2.3 formatted strings of the package, which
+	// vulnerability scanners match against the NVD, see ValidateCPE.
+	CPEs []string
+	// Sources are the artifacts the package is built from.
+	Sources []Source
+	// Origin, if set, is the SBOM of the package a subpackage is split
+	// from, which the SPDX 2 documents of the subpackage reference: the
+	// subpackage depends on its origin package.
+	Origin *DocumentRef
+	// BuildEnvironment, if set, is the SBOM of the build environment of
+	// the package, see GenerateBuildEnvironment, which the SPDX 2
+	// documents reference instead of listing its packages: the
+	// environment is a build dependency of the package.
+	BuildEnvironment *DocumentRef
+	// Deprecation, if set, tells the consumers that the package is
+	// deprecated.
+	Deprecation *Deprecation
+	// Provenance, if set, describes how melange built the package.
+	Provenance *Provenance
+	// SourceDateEpoch is the creation time of the SBOMs, which the
+	// caller takes from SOURCE_DATE_EPOCH, if set.  When zero, the
+	// time of the generation is used for all the SBOMs.
+	SourceDateEpoch time.Time
+
+	// Formats lists the formats to write, by default DefaultFormats.
+	Formats []string
+
+	// Signer, if set, signs the SPDX SBOM, which is written even if
+	// it is not among the formats, and attests it with an in-toto
+	// statement about the files of the package.
+	Signer Signer
+
+	// Exporters send the SBOMs to other systems.  They are generated
+	// in the formats of the exporters even if these are not among
+	// the written formats.  Failed exports are logged as warnings.
+	Exporters []Exporter
+
+	// ChecksumAlgorithms lists the algorithms of the checksums of the
+	// files, by default DefaultChecksumAlgorithms.  SHA256 is
+	// required.
+	ChecksumAlgorithms []string
+
+	// CheckNTIA logs the NTIA minimum elements missing from the
+	// written SBOMs as warnings, see CheckNTIA.  StrictNTIA fails the
+	// generation instead.
+	CheckNTIA  bool
+	StrictNTIA bool
+
+	// FileSteps maps the paths of files, relative to Path, to the
+	// pipeline steps which produced them, which are recorded as
+	// annotations of the files.
+	FileSteps map[string]string
+
+	// SkipSymlinks leaves the symbolic links of the package out of the
+	// SBOMs, which otherwise list them as files with the digests of
+	// their targets.
+	SkipSymlinks bool
+
+	// ChecksumCache is a file keeping the digests of the files of the
+	// package between builds, or empty to hash every file.
+	ChecksumCache string
+}
+
+// Deprecation tells that a package is deprecated, and by what and when
+// it is replaced.
+type Deprecation struct {
+	// Reason tells why the package is deprecated, if known.
+	Reason string
+	// Replacement is the package replacing this one, if any.
+	Replacement string
+	// EndOfLife is when the package stops being supported, if known.
+	EndOfLife time.Time
+}
+
+// comment describes the deprecation in the SBOMs.
+func (d *Deprecation) comment() string {
+	parts := []string{"deprecated"}
+	if d.Reason != "" {
+		parts[0] += ": " + d.Reason
+	}
+	if d.Replacement != "" {
+		parts = append(parts, "replaced by "+d.Replacement)
+	}
+	if !d.EndOfLife.IsZero() {
+		parts = append(parts, "end of life on "+d.EndOfLife.UTC().Format("2006-01-02"))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Source is an artifact a package is built from, a source tarball or a
+// git checkout.
+type Source struct {
+	// URL is the location of the tarball or of the git repository.
+	URL string
+	// SHA256 is the hex encoded digest of the tarball.
+	SHA256 string
+	// Commit is the commit of the git checkout.
+	Commit string
+}
+
+// name returns the name of the source, the last element of its URL.
+func (s *Source) name() string {
+	name := path.Base(strings.TrimSuffix(s.URL, "/"))
+	if s.Commit != "" {
+		name = strings.TrimSuffix(name, ".git")
+	}
+	return name
+}
+
+// downloadLocation returns the SPDX download location of the source,
+// which locates git checkouts as git+<repository>@<commit>.
+func (s *Source) downloadLocation() string {
+	if s.Commit == "" {
+		return s.URL
+	}
+	if strings.HasPrefix(s.URL, "git+") {
+		return s.URL + "@" + s.Commit
+	}
+	return "git+" + s.URL + "@" + s.Commit
+}
+
+// validate checks that the source has a URL and hex encoded digests.
+func (s *Source) validate() error {
+	if s.URL == "" {
+		return errors.New("source has no URL")
+	}
+	if s.SHA256 != "" {
+		if b, err := hex.DecodeString(s.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("source %s: %q is not a SHA256 digest", s.URL, s.SHA256)
+		}
+	}
+	if s.Commit != "" {
+		if _, err := hex.DecodeString(s.Commit); err != nil || len(s.Commit) < 7 {
+			return fmt.Errorf("source %s: %q is not a commit hash", s.URL, s.Commit)
+		}
+	}
+	return nil
+}
+
+// generatorImplementation serializes the description of a package in
+// one SBOM format.
+type generatorImplementation interface {
+	// Ext is the extension of the SBOM files.
+	Ext() string
+	// Generate returns the SBOM of a package.
+	Generate(spec *Spec, contents *packageContents) ([]byte, error)
+}
+
+// streamingImplementation is a generatorImplementation which writes its
+// SBOMs without holding them in memory.
+type streamingImplementation interface {
+	generatorImplementation
+	// Encode writes the SBOM of a package.
+	Encode(w io.Writer, spec *Spec, contents *packageContents) error
+}
+
+// packageContents is what a package is found to contain.
+type packageContents struct {
+	files []file
+	// components are the software of other ecosystems contained in
+	// the package, such as the Go modules linked into its Go programs,
+	// sorted by package URL.
+	components []component
+	// dependencies maps the paths of the files to the package URLs of
+	// the components they depend on, sorted.
+	dependencies map[string][]string
+}
+
+// component is a package of another ecosystem contained in a package.
+type component struct {
+	name    string
+	version string
+	purl    string
+	// dependency is set for the components which the file they are
+	// found in depends on, such as the crates linked into a program.
+	dependency bool
+}
+
+// fileScanner returns the components found in a file of a package,
+// given its path relative to the root of the package.
+type fileScanner func(path, rel string) ([]component, error)
+
+// fileScanners find the components of the packages.
+var fileScanners = []fileScanner{
+	scanGoProgram,
+	scanPythonMetadata,
+	scanNodeModule,
+	scanCargoAuditable,
+	scanJavaArchive,
+}
+
+// file is a regular file or a symbolic link of a package.
+type file struct {
+	// path is relative to the root of the package.
+	path string
+	// digests maps the checksum algorithms to the hex encoded
+	// digests of the file.
+	digests map[string]string
+	// types are the SPDX file types of the file, such as BINARY or
+	// TEXT, see fileTypes.
+	types []string
+	// link is the target of a symbolic link, empty for the regular
+	// files.
+	link string
+	// licenses are the SPDX identifiers of the licenses whose texts
+	// are in the license files, see isLicenseFile.
+	licenses []string
+	// licenseTags are the license expressions of the
+	// SPDX-License-Identifier tags at the start of the text files.
+	licenseTags []string
+}
+
+// stepAnnotation returns the annotation of a file produced by a pipeline
+// step, if any.
+func (spec *Spec) stepAnnotation(f *file) string {
+	step, ok := spec.FileSteps[f.path]
+	if !ok {
+		return ""
+	}
+	return "produced by pipeline " + step
+}
+
+// comment describes the symbolic links in the SBOMs.
+func (f *file) comment() string {
+	if f.link == "" {
+		return ""
+	}
+	return "symbolic link to " + f.link
+}
+
+// Generator writes the SBOMs of packages.
+type Generator struct {
+	impl map[string]generatorImplementation
+}
+
+// NewGenerator returns a generator supporting all the formats, including
+// the ones registered with RegisterGenerator.
+func NewGenerator() *Generator {
+	impl := map[string]generatorImplementation{
+		FormatSPDX:         &spdx{},
+		FormatSPDXTagValue: &spdxTagValue{},
+		FormatSPDX3:        &spdx3{},
+		FormatCycloneDX:    &cycloneDX{},
+	}
+	for format, registered := range registeredGenerators() {
+		impl[format] = registered
+	}
+
+	return &Generator{impl: impl}
+}
+
+// Formats returns the names of the supported formats.
+func (g *Generator) Formats() []string {
+	formats := []string{}
+	for format := range g.impl {
+		formats = append(formats, format)
+	}
+
+	sort.Strings(formats)
+	return formats
+}
+
+// ValidateFormats checks that the formats are supported.
+func (g *Generator) ValidateFormats(formats []string) error {
+	for _, format := range formats {
+		if _, ok := g.impl[format]; !ok {
+			return fmt.Errorf("unknown SBOM format %q, must be one of %s", format, strings.Join(g.Formats(), ", "))
+		}
+	}
+
+	return nil
+}
+
+// Generate writes the SBOMs of the package described by spec.
+func (g *Generator) Generate(spec *Spec) error {
+	if spec.SourceDateEpoch.IsZero() {
+		s := *spec
+		s.SourceDateEpoch = time.Now()
+		spec = &s
+	}
+
+	formats := spec.Formats
+	if len(formats) == 0 {
+		formats = DefaultFormats
+	}
+	if err := g.ValidateFormats(formats); err != nil {
+		return err
+	}
+
+	algorithms := spec.ChecksumAlgorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultChecksumAlgorithms
+	}
+	if err := ValidateChecksumAlgorithms(algorithms); err != nil {
+		return err
+	}
+
+	for _, agent := range []string{spec.Supplier, spec.Originator} {
+		if agent != "" {
+			if err := ValidateAgent(agent); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, s := range spec.Sources {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range spec.ExtractedLicenses {
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+
+	var cache *checksumCache
+	if spec.ChecksumCache != "" {
+		cache = loadChecksumCache(spec.ChecksumCache)
+	}
+
+	contents, err := scanFiles(spec.Path, spec.OutputDir, algorithms, cache, !spec.SkipSymlinks)
+	if err != nil {
+		return fmt.Errorf("unable to read the files of %s: %w", spec.PackageName, err)
+	}
+
+	if cache != nil {
+		log.Printf("  reused the checksums of %d of %d files", cache.hits, len(contents.files))
+		if err := cache.save(); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(spec.OutputDir, 0755); err != nil {
+		return fmt.Errorf("unable to create SBOM directory: %w", err)
+	}
+
+	generated := map[string][]byte{}
+	var written map[string]string
+	generate := func(format string) ([]byte, error) {
+		if data, ok := generated[format]; ok {
+			return data, nil
+		}
+		if path, ok := written[format]; ok {
+			return os.ReadFile(path)
+		}
+
+		data, err := g.impl[format].Generate(spec, contents)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate %s SBOM: %w", format, err)
+		}
+		generated[format] = data
+		return data, nil
+	}
+
+	// written holds the paths of the SBOMs which are streamed to their
+	// files, which are read back when they are needed again.
+	written = map[string]string{}
+	for _, format := range formats {
+		path := filepath.Join(spec.OutputDir, fmt.Sprintf("sbom-%s.%s", spec.Arch, g.impl[format].Ext()))
+
+		var data []byte
+		if s, ok := g.impl[format].(streamingImplementation); ok {
+			if err := encodeFile(path, s, spec, contents); err != nil {
+				return fmt.Errorf("unable to write %s SBOM: %w", format, err)
+			}
+			written[format] = path
+		} else {
+			if data, err = generate(format); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				return fmt.Errorf("unable to write %s SBOM: %w", format, err)
+			}
+		}
+
+		// The registered formats are unknown to CheckNTIA.  The
+		// tag-value document has the contents of the JSON one, which
+		// is checked in its place, unless it is written as well.
+		_, registered := g.impl[format].(registeredGenerator)
+		if registered || !(spec.CheckNTIA || spec.StrictNTIA) || format == FormatSPDXTagValue && containsFormat(formats, FormatSPDX) {
+			continue
+		}
+		checked := format
+		if format == FormatSPDXTagValue {
+			checked = FormatSPDX
+			if data, err = generate(FormatSPDX); err != nil {
+				return err
+			}
+		}
+		if data == nil {
+			if data, err = os.ReadFile(path); err != nil {
+				return fmt.Errorf("unable to read %s SBOM: %w", format, err)
+			}
+		}
+		problems, err := CheckNTIA(checked, data)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 && spec.StrictNTIA {
+			return fmt.Errorf("%s SBOM of %s does not meet the NTIA minimum elements: %s", format, spec.PackageName, strings.Join(problems, "; "))
+		}
+		for _, problem := range problems {
+			log.Printf("warning: %s SBOM of %s does not meet the NTIA minimum elements: %s", format, spec.PackageName, problem)
+		}
+	}
+
+	if spec.Signer != nil {
+		data, err := generate(FormatSPDX)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(spec.OutputDir, fmt.Sprintf("sbom-%s.%s", spec.Arch, g.impl[FormatSPDX].Ext()))
+		if !containsFormat(formats, FormatSPDX) {
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				return fmt.Errorf("unable to write %s SBOM: %w", FormatSPDX, err)
+			}
+		}
+
+		if err := attest(spec.Signer, path, data, contents); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range spec.Exporters {
+		if err := g.ValidateFormats([]string{e.Format()}); err != nil {
+			return err
+		}
+
+		data, err := generate(e.Format())
+		if err != nil {
+			return err
+		}
+
+		if err := e.Export(spec, data); err != nil {
+			log.Printf("warning: unable to export the SBOM of %s to %s: %v", spec.PackageName, e.Name(), err)
+			continue
+		}
+		log.Printf("  exported the SBOM of %s to %s", spec.PackageName, e.Name())
+	}
+
+	return nil
+}
+
+// encodeFile writes the SBOM of a package to a file.
+func encodeFile(path string, s streamingImplementation, spec *Spec, contents *packageContents) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.Encode(f, spec, contents); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func containsFormat(formats []string, format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// scanFiles returns the regular files below root, and the symbolic links
+// if links is set, except the ones below skip, in lexical order, and the
+// components found in the regular files.  The digests of the files are
+// computed with the algorithms, or taken from the cache, if any, for the
+// unchanged files.
+func scanFiles(root, skip string, algorithms []string, cache *checksumCache, links bool) (*packageContents, error) {
+	files := []file{}
+	components := map[component]bool{}
+	dependencies := map[string][]string{}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path == skip {
+			return filepath.SkipDir
+		}
+		if d.Type()&fs.ModeSymlink != 0 && links {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			f := hashLink(target, algorithms)
+			f.path = filepath.ToSlash(rel)
+			files = append(files, f)
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		f, ok := cache.lookup(filepath.ToSlash(rel), fi, algorithms)
+		if !ok {
+			if f, err = hashFile(path, algorithms); err != nil {
+				return err
+			}
+			f.path = filepath.ToSlash(rel)
+			cache.store(f, fi)
+		}
+		if isLicenseFile(f.path) {
+			if f.licenses, err = scanLicenseFile(path); err != nil {
+				return fmt.Errorf("unable to scan %s: %w", f.path, err)
+			}
+		}
+		files = append(files, f)
+
+		for _, scan := range fileScanners {
+			found, err := scan(path, f.path)
+			if err != nil {
+				return fmt.Errorf("unable to scan %s: %w", f.path, err)
+			}
+			for _, c := range found {
+				components[c] = true
+				if c.dependency {
+					dependencies[f.path] = append(dependencies[f.path], c.purl)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a file may be found to depend on a component more than once.
+	for path, purls := range dependencies {
+		sort.Strings(purls)
+		dependencies[path] = uniqueStrings(purls)
+	}
+
+	return &packageContents{files: files, components: sortedComponents(components), dependencies: dependencies}, nil
+}
+
+// sortedComponents returns the components of a set, sorted by package
+// URL.  The components found more than once with the same package URL,
+// such as a crate linked into a program and vendored next to it, are
+// listed once, as a dependency if any of them is.
+func sortedComponents(set map[component]bool) []component {
+	byPURL := map[string]component{}
+	for c := range set {
+		if existing, ok := byPURL[c.purl]; ok {
+			existing.dependency = existing.dependency || c.dependency
+			if c.name < existing.name {
+				existing.name = c.name
+			}
+			c = existing
+		}
+		byPURL[c.purl] = c
+	}
+
+	components := []component{}
+	for _, c := range byPURL {
+		components = append(components, c)
+	}
+
+	sort.Slice(components, func(i, j int) bool { return components[i].purl < components[j].purl })
+	return components
+}
+
+// purl returns the package URL of the package.
+func (spec *Spec) purl() string {
+	return PackageURL(spec.PackageName, spec.PackageVersion, spec.Arch)
+}
+
+// PackageURL returns the package URL of an APK package.
+func PackageURL(name, version, arch string) string {
+	return fmt.Sprintf("pkg:apk/%s@%s?arch=%s", name, version, arch)
+}
+
+// created returns the creation time of the SBOMs.
+func (spec *Spec) created() string {
+	return spec.SourceDateEpoch.UTC().Format(time.RFC3339)
+}
+
+// license returns the license expression of the package, or NOASSERTION.
+func (spec *Spec) license() string {
+	if spec.License == "" {
+		return "NOASSERTION"
+	}
+
+	return spec.License
+}
+
+// contentDigest identifies the contents of a package, so that the
+// identifiers of the SBOMs do not change when a package is rebuilt
+// reproducibly.
+func contentDigest(spec *Spec, contents *packageContents) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", spec.purl())
+	for _, f := range contents.files {
+		fmt.Fprintf(h, "%s %s\n", f.digests[ChecksumSHA256], f.path)
+	}
+	for _, s := range spec.Sources {
+		fmt.Fprintf(h, "source %s %s %s\n", s.URL, s.SHA256, s.Commit)
+	}
+	for _, cpe := range spec.CPEs {
+		fmt.Fprintf(h, "cpe %s\n", cpe)
+	}
+	if spec.Origin != nil {
+		fmt.Fprintf(h, "origin %s %s\n", spec.Origin.Namespace, spec.Origin.SHA1)
+	}
+	if spec.BuildEnvironment != nil {
+		fmt.Fprintf(h, "build environment %s %s\n", spec.BuildEnvironment.Namespace, spec.BuildEnvironment.SHA1)
+	}
+	for _, f := range spec.Provenance.facts() {
+		fmt.Fprintf(h, "provenance %s %s\n", f.name, f.value)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidateAgent checks the supplier or originator of a package, which is
+// an organization or a person, as "Organization: <name>" or
+// "Person: <name>", optionally followed by an email address in
+// parentheses, as in SPDX.
+func ValidateAgent(agent string) error {
+	if _, _, err := parseAgent(agent); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseAgent returns the kind and the name of an organization or person.
+func parseAgent(agent string) (kind, name string, err error) {
+	kind, name, ok := strings.Cut(agent, ":")
+	name = strings.TrimSpace(name)
+	if !ok || (kind != "Organization" && kind != "Person") || name == "" {
+		return "", "", fmt.Errorf("%q must be \"Organization: <name>\" or \"Person: <name>\"", agent)
+	}
+	return kind, name, nil
+}
+
+// agentName returns the name of an organization or person, without the
+// email address.
+func agentName(agent string) string {
+	_, name, err := parseAgent(agent)
+	if err != nil {
+		return ""
+	}
+	if i := strings.Index(name, " ("); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
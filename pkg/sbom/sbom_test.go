@@ -0,0 +1,1855 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chainguard.dev/melange/pkg/schema"
+)
+
+func testSpec(t *testing.T, formats ...string) *Spec {
+	dir := t.TempDir()
+	for path, contents := range map[string]string{
+		"usr/bin/hello":              "#!/bin/sh\necho hello\n",
+		"usr/share/doc/hello/README": "hello\n",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Spec{
+		Path:            dir,
+		OutputDir:       filepath.Join(dir, "var/lib/db/sbom/hello-1.0-r0"),
+		PackageName:     "hello",
+		PackageVersion:  "1.0-r0",
+		Arch:            "x86_64",
+		License:         "MIT",
+		SourceDateEpoch: time.Unix(1650000000, 0),
+		Formats:         formats,
+	}
+}
+
+func readJSON(t *testing.T, path string, v interface{}) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGenerateSPDX(t *testing.T) {
+	spec := testSpec(t)
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json")); err == nil {
+		t.Error("a CycloneDX SBOM was generated by default")
+	}
+
+	var doc spdxDocument
+	first := readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+
+	if doc.SPDXVersion != "SPDX-2.3" || doc.CreationInfo.Created != "2022-04-15T05:20:00Z" {
+		t.Errorf("unexpected document %s, created %s", doc.SPDXVersion, doc.CreationInfo.Created)
+	}
+	if len(doc.Packages) != 1 || doc.Packages[0].ExternalRefs[0].ReferenceLocator != "pkg:apk/hello@1.0-r0?arch=x86_64" {
+		t.Errorf("unexpected packages %+v", doc.Packages)
+	}
+	if doc.Packages[0].LicenseDeclared != "MIT" {
+		t.Errorf("license = %s, want MIT", doc.Packages[0].LicenseDeclared)
+	}
+
+	names := []string{}
+	for _, f := range doc.Files {
+		names = append(names, f.FileName)
+	}
+	if want := []string{"/usr/bin/hello", "/usr/share/doc/hello/README"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("files = %q, want %q", names, want)
+	}
+	if types := doc.Files[0].FileTypes; !reflect.DeepEqual(types, []string{FileTypeSource, FileTypeText}) {
+		t.Errorf("types of the script = %q", types)
+	}
+
+	// the SBOMs of a reproducible build are identical.
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+	second := readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	if string(first) != string(second) {
+		t.Error("the SBOM changed when generated again")
+	}
+}
+
+func TestGenerateCycloneDX(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatCycloneDX)
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json")); err != nil {
+		t.Error(err)
+	}
+
+	var doc cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &doc)
+
+	if doc.BOMFormat != "CycloneDX" || doc.SpecVersion != "1.5" || doc.Metadata.Timestamp != "2022-04-15T05:20:00Z" {
+		t.Errorf("unexpected document %s %s, created %s", doc.BOMFormat, doc.SpecVersion, doc.Metadata.Timestamp)
+	}
+	if len(doc.SerialNumber) != len("urn:uuid:")+36 {
+		t.Errorf("serial number %s is not a UUID URN", doc.SerialNumber)
+	}
+	if len(doc.Components) != 1 || doc.Components[0].PURL != "pkg:apk/hello@1.0-r0?arch=x86_64" {
+		t.Fatalf("unexpected components %+v", doc.Components)
+	}
+	if n := len(doc.Components[0].Components); n != 2 {
+		t.Errorf("package has %d files, want 2", n)
+	}
+}
+
+func TestGenerateSPDXTagValue(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDXTagValue)
+	spec.ExtractedLicenses = []ExtractedLicense{{ID: "LicenseRef-hello", Text: "Do what\nyou want."}}
+	spec.License = "MIT AND LicenseRef-hello"
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	data, err := os.ReadFile(filepath.Join(spec.OutputDir, "sbom-x86_64.spdx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tv := string(data)
+
+	for _, want := range []string{
+		"SPDXVersion: SPDX-2.3\n",
+		"DocumentNamespace: " + doc.DocumentNamespace + "\n",
+		"Created: 2022-04-15T05:20:00Z\n",
+		"Relationship: SPDXRef-DOCUMENT DESCRIBES SPDXRef-Package-hello\n",
+		"PackageName: hello\nSPDXID: SPDXRef-Package-hello\nPackageVersion: 1.0-r0\n",
+		"PackageLicenseDeclared: MIT AND LicenseRef-hello\n",
+		"ExternalRef: PACKAGE-MANAGER purl pkg:apk/hello@1.0-r0?arch=x86_64\n",
+		"FileName: /usr/bin/hello\nSPDXID: SPDXRef-File-0\nFileType: SOURCE\nFileType: TEXT\n",
+		"FileChecksum: SHA256: " + doc.Files[0].Checksums[1].ChecksumValue + "\n",
+		"Relationship: SPDXRef-Package-hello CONTAINS SPDXRef-File-1\n",
+		"LicenseID: LicenseRef-hello\nExtractedText: <text>Do what\nyou want.</text>\n",
+	} {
+		if !strings.Contains(tv, want) {
+			t.Errorf("tag-value document does not contain %q:\n%s", want, tv)
+		}
+	}
+	if n := strings.Count(tv, "\nFileName: "); n != len(doc.Files) {
+		t.Errorf("tag-value document has %d files, want %d", n, len(doc.Files))
+	}
+}
+
+func TestValidateSPDX(t *testing.T) {
+	spec := testSpec(t, FormatSPDX)
+	if err := os.Symlink("hello", filepath.Join(spec.Path, "usr/bin/hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	data := readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	if problems, err := ValidateSPDX(data); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() = %q, %v, want no problem", problems, err)
+	}
+	if problems, err := VerifySPDXChecksums(data, spec.Path); err != nil || len(problems) > 0 {
+		t.Errorf("VerifySPDXChecksums() = %q, %v, want no problem", problems, err)
+	}
+
+	// a dangling relationship, an unknown relationship type and a
+	// missing name.
+	doc["relationships"] = append(doc["relationships"].([]interface{}),
+		map[string]interface{}{"spdxElementId": "SPDXRef-Package-hello", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-File-99"},
+		map[string]interface{}{"spdxElementId": "SPDXRef-DOCUMENT", "relationshipType": "INCLUDES", "relatedSpdxElement": "SPDXRef-Package-hello"})
+	delete(doc, "name")
+	broken, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := ValidateSPDX(broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"document: name is missing",
+		"relationship SPDXRef-Package-hello CONTAINS SPDXRef-File-99: SPDXRef-File-99 is not an element of the document",
+		"relationship SPDXRef-DOCUMENT INCLUDES SPDXRef-Package-hello: unknown relationship type",
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("ValidateSPDX() = %q, want %q", problems, want)
+	}
+
+	// a modified file, and a removed link.
+	if err := os.WriteFile(filepath.Join(spec.Path, "usr/bin/hello"), []byte("#!/bin/sh\necho bye\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(spec.Path, "usr/bin/hi")); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = VerifySPDXChecksums(data, spec.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"file /usr/bin/hello: SHA1, SHA256 checksum does not match the package",
+		"file /usr/bin/hi: not in the package",
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("VerifySPDXChecksums() = %q, want %q", problems, want)
+	}
+}
+
+func TestGenerateSPDXOrigin(t *testing.T) {
+	origin := testSpec(t, FormatSPDX)
+	if err := NewGenerator().Generate(origin); err != nil {
+		t.Fatal(err)
+	}
+	var originDoc spdxDocument
+	data := readJSON(t, filepath.Join(origin.OutputDir, "sbom-x86_64.spdx.json"), &originDoc)
+
+	ref, err := NewDocumentRef("hello", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha1.Sum(data)
+	wantRef := &DocumentRef{ID: "hello", Namespace: originDoc.DocumentNamespace, SHA1: hex.EncodeToString(digest[:]), Element: "SPDXRef-Package-hello"}
+	if !reflect.DeepEqual(ref, wantRef) {
+		t.Errorf("NewDocumentRef() = %+v, want %+v", ref, wantRef)
+	}
+
+	spec := testSpec(t, FormatSPDX, FormatSPDXTagValue)
+	spec.PackageName = "hello-doc"
+	spec.Origin = ref
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	data = readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	wantDocRefs := []spdxExternalDocumentRef{{
+		ExternalDocumentID: "DocumentRef-hello",
+		SPDXDocument:       originDoc.DocumentNamespace,
+		Checksum:           spdxChecksum{Algorithm: "SHA1", ChecksumValue: ref.SHA1},
+	}}
+	if !reflect.DeepEqual(doc.ExternalDocumentRefs, wantDocRefs) {
+		t.Errorf("externalDocumentRefs = %+v, want %+v", doc.ExternalDocumentRefs, wantDocRefs)
+	}
+	wantRel := spdxRelationship{Element: "SPDXRef-Package-hello-doc", Type: "DEPENDS_ON", Related: "DocumentRef-hello:SPDXRef-Package-hello"}
+	found := false
+	for _, r := range doc.Relationships {
+		found = found || r == wantRel
+	}
+	if !found {
+		t.Errorf("relationships = %+v, want %+v", doc.Relationships, wantRel)
+	}
+	if problems, err := ValidateSPDX(data); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() = %q, %v, want no problem", problems, err)
+	}
+
+	tv, err := os.ReadFile(filepath.Join(spec.OutputDir, "sbom-x86_64.spdx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ExternalDocumentRef: DocumentRef-hello " + originDoc.DocumentNamespace + " SHA1: " + ref.SHA1 + "\n"
+	if !strings.Contains(string(tv), want) {
+		t.Errorf("tag-value document does not contain %q", want)
+	}
+}
+
+func TestBuildEnvironment(t *testing.T) {
+	packages := []BuildPackage{
+		{Name: "make", Version: "4.4-r0", Arch: "x86_64", License: "GPL-3.0-or-later"},
+		{Name: "busybox", Version: "1.36-r0", Arch: "x86_64", License: "GPL-2.0-only AND LicenseRef-custom"},
+	}
+	env, err := GenerateBuildEnvironment("hello-2.12-r0-build-environment", packages, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := ValidateSPDX(env); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() of the build environment = %q, %v, want no problem", problems, err)
+	}
+
+	var envDoc spdxDocument
+	if err := json.Unmarshal(env, &envDoc); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, p := range envDoc.Packages[1:] {
+		names = append(names, p.Name+" "+p.LicenseDeclared)
+	}
+	if want := []string{"busybox NOASSERTION", "make GPL-3.0-or-later"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("build environment packages = %q, want %q", names, want)
+	}
+
+	ref, err := NewDocumentRef("build-environment", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Element != BuildEnvironmentElement {
+		t.Errorf("build environment element = %s, want %s", ref.Element, BuildEnvironmentElement)
+	}
+
+	spec := testSpec(t, FormatSPDX)
+	spec.BuildEnvironment = ref
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	data := readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	wantDocRefs := []spdxExternalDocumentRef{{
+		ExternalDocumentID: "DocumentRef-build-environment",
+		SPDXDocument:       envDoc.DocumentNamespace,
+		Checksum:           spdxChecksum{Algorithm: "SHA1", ChecksumValue: ref.SHA1},
+	}}
+	if !reflect.DeepEqual(doc.ExternalDocumentRefs, wantDocRefs) {
+		t.Errorf("externalDocumentRefs = %+v, want %+v", doc.ExternalDocumentRefs, wantDocRefs)
+	}
+	wantRel := spdxRelationship{Element: "DocumentRef-build-environment:" + BuildEnvironmentElement, Type: "BUILD_DEPENDENCY_OF", Related: "SPDXRef-Package-hello"}
+	found := false
+	for _, r := range doc.Relationships {
+		found = found || r == wantRel
+	}
+	if !found {
+		t.Errorf("relationships = %+v, want %+v", doc.Relationships, wantRel)
+	}
+	if len(doc.Packages) != 1 {
+		t.Errorf("SBOM lists %d packages, want only the package", len(doc.Packages))
+	}
+	if problems, err := ValidateSPDX(data); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() = %q, %v, want no problem", problems, err)
+	}
+}
+
+func TestMergeSPDX(t *testing.T) {
+	generate := func(spec *Spec) []byte {
+		if err := NewGenerator().Generate(spec); err != nil {
+			t.Fatal(err)
+		}
+		var doc spdxDocument
+		return readJSON(t, filepath.Join(spec.OutputDir, "sbom-"+spec.Arch+".spdx.json"), &doc)
+	}
+	// withComponent adds the same component to a document.
+	withComponent := func(data []byte) []byte {
+		var doc spdxDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           "SPDXRef-Component-0",
+			Name:             "golang.org/x/text",
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs:     []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: "pkg:golang/golang.org/x/text@v0.3.7"}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: doc.DocumentDescribes[0], Type: "CONTAINS", Related: "SPDXRef-Component-0"})
+		out, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	origin := withComponent(generate(testSpec(t, FormatSPDX)))
+	ref, err := NewDocumentRef("hello", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := testSpec(t, FormatSPDX)
+	doc.PackageName = "hello-doc"
+	doc.Origin = ref
+	arm := testSpec(t, FormatSPDX)
+	arm.Arch = "aarch64"
+
+	data, err := MergeSPDX("hello-1.0", [][]byte{origin, generate(doc), withComponent(generate(arm))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := ValidateSPDX(data); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() = %q, %v, want no problem", problems, err)
+	}
+
+	var merged spdxDocument
+	if err := json.Unmarshal(data, &merged); err != nil {
+		t.Fatal(err)
+	}
+
+	wantDescribes := []string{"SPDXRef-Package-hello", "SPDXRef-Package-hello-doc", "SPDXRef-Package-hello-3"}
+	if !reflect.DeepEqual(merged.DocumentDescribes, wantDescribes) {
+		t.Errorf("documentDescribes = %q, want %q", merged.DocumentDescribes, wantDescribes)
+	}
+	if len(merged.ExternalDocumentRefs) != 3 {
+		t.Errorf("externalDocumentRefs = %+v, want the 3 merged documents", merged.ExternalDocumentRefs)
+	}
+
+	components := 0
+	for _, p := range merged.Packages {
+		if p.Name == "golang.org/x/text" {
+			components++
+		}
+	}
+	if components != 1 {
+		t.Errorf("the component is listed %d times, want once", components)
+	}
+
+	for _, want := range []spdxRelationship{
+		// the reference to the origin package is resolved.
+		{Element: "SPDXRef-Package-hello-doc", Type: "DEPENDS_ON", Related: "SPDXRef-Package-hello"},
+		{Element: "SPDXRef-Package-hello-3", Type: "CONTAINS", Related: "SPDXRef-Component-0"},
+		{Element: "SPDXRef-Package-hello-3", Type: "DESCRIBED_BY", Related: merged.ExternalDocumentRefs[2].ExternalDocumentID + ":SPDXRef-DOCUMENT"},
+	} {
+		found := false
+		for _, r := range merged.Relationships {
+			found = found || r == want
+		}
+		if !found {
+			t.Errorf("relationships do not include %+v", want)
+		}
+	}
+
+	if _, err := MergeSPDX("hello-1.0", [][]byte{origin, origin}); err == nil {
+		t.Error("MergeSPDX() merged a document with itself")
+	}
+}
+
+func TestDiffSPDX(t *testing.T) {
+	// generate returns the SPDX document of a package, with components
+	// of the versions.
+	generate := func(spec *Spec, components map[string]string) []byte {
+		if err := NewGenerator().Generate(spec); err != nil {
+			t.Fatal(err)
+		}
+		var doc spdxDocument
+		readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+		for name, version := range components {
+			doc.Packages = append(doc.Packages, spdxPackage{
+				SPDXID:           spdxIDString("SPDXRef-Component-" + name),
+				Name:             name,
+				VersionInfo:      version,
+				LicenseConcluded: "NOASSERTION",
+				LicenseDeclared:  "NOASSERTION",
+				ExternalRefs:     []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: "pkg:golang/" + name + "@" + version}},
+			})
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	old := generate(testSpec(t, FormatSPDX), map[string]string{"golang.org/x/text": "v0.3.7", "golang.org/x/sys": "v0.1.0"})
+
+	spec := testSpec(t, FormatSPDX)
+	spec.PackageVersion = "1.1-r0"
+	spec.License = "Apache-2.0"
+	if err := os.WriteFile(filepath.Join(spec.Path, "usr/share/doc/hello/README"), []byte("hello, world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(spec.Path, "usr/share/doc/hello/NEWS"), []byte("1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	new := generate(spec, map[string]string{"golang.org/x/text": "v0.3.8", "golang.org/x/net": "v0.2.0"})
+
+	diff, err := DiffSPDX(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Diff{
+		Old: "hello-1.0-r0",
+		New: "hello-1.1-r0",
+		Dependencies: []DependencyChange{
+			{Name: "pkg:golang/golang.org/x/net", New: "v0.2.0"},
+			{Name: "pkg:golang/golang.org/x/sys", Old: "v0.1.0"},
+			{Name: "pkg:golang/golang.org/x/text", Old: "v0.3.7", New: "v0.3.8"},
+		},
+		Licenses: []LicenseChange{{Name: "hello", Old: "MIT", New: "Apache-2.0"}},
+		Files: FileChurn{
+			Added:     []string{"/usr/share/doc/hello/NEWS"},
+			Removed:   []string{},
+			Changed:   []string{"/usr/share/doc/hello/README"},
+			Unchanged: 1,
+		},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("DiffSPDX() = %+v, want %+v", diff, want)
+	}
+
+	if diff, err := DiffSPDX(old, old); err != nil || !diff.Empty() {
+		t.Errorf("DiffSPDX() of a document with itself = %+v, %v, want no change", diff, err)
+	}
+}
+
+func TestEncodeSPDX(t *testing.T) {
+	spec := testSpec(t, FormatSPDX)
+	spec.Sources = []Source{{URL: "https://example.com/hello-1.0.tar.gz", SHA256: strings.Repeat("01", 32)}}
+	spec.ExtractedLicenses = []ExtractedLicense{{ID: "LicenseRef-hello", Text: "Do what you want."}}
+	spec.Deprecation = &Deprecation{Reason: "unmaintained"}
+	spec.Origin = &DocumentRef{ID: "hello", Namespace: "https://example.com/hello", SHA1: strings.Repeat("ab", 20), Element: "SPDXRef-Package-hello"}
+	contents := &packageContents{
+		files: []file{
+			{path: "usr/bin/hello", digests: map[string]string{ChecksumSHA1: "01", ChecksumSHA256: "02"}, types: []string{FileTypeBinary}},
+			{path: "usr/bin/hi", digests: map[string]string{ChecksumSHA1: "03", ChecksumSHA256: "04"}, link: "hello"},
+		},
+		components:   []component{{name: "golang.org/x/text", version: "v0.3.7", purl: "pkg:golang/golang.org/x/text@v0.3.7"}},
+		dependencies: map[string][]string{"usr/bin/hello": {"pkg:golang/golang.org/x/text@v0.3.7"}},
+	}
+
+	// the streamed document is the one json.MarshalIndent writes.
+	for _, c := range []*packageContents{contents, {}} {
+		want, err := json.MarshalIndent(newSPDXDocument(spec, c), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := (&spdx{}).Encode(&buf, spec, c); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(want) {
+			t.Errorf("Encode() =\n%s\nwant\n%s", buf.String(), want)
+		}
+	}
+}
+
+func TestValidateFormats(t *testing.T) {
+	g := NewGenerator()
+	if err := g.ValidateFormats([]string{"spdx", "cyclonedx"}); err != nil {
+		t.Error(err)
+	}
+	if err := g.ValidateFormats([]string{"swid"}); err == nil {
+		t.Error("ValidateFormats accepted an unknown format")
+	}
+}
+
+func TestGenerateSPDX3(t *testing.T) {
+	spec := testSpec(t, FormatSPDX3)
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc)
+
+	if doc.Context != spdx3Context {
+		t.Errorf("@context = %s", doc.Context)
+	}
+
+	types := map[string]int{}
+	ids := map[string]bool{}
+	var root []interface{}
+	for _, e := range doc.Graph {
+		typ, _ := e["type"].(string)
+		types[typ]++
+		if id, ok := e["spdxId"].(string); ok {
+			ids[id] = true
+		}
+		switch typ {
+		case "CreationInfo":
+			if e["specVersion"] != "3.0.1" || e["created"] != "2022-04-15T05:20:00Z" {
+				t.Errorf("unexpected creation info %v", e)
+			}
+		case "software_Package":
+			if e["software_packageUrl"] != "pkg:apk/hello@1.0-r0?arch=x86_64" {
+				t.Errorf("package URL = %v", e["software_packageUrl"])
+			}
+		case "SpdxDocument":
+			root, _ = e["rootElement"].([]interface{})
+		}
+	}
+
+	want := map[string]int{
+		"CreationInfo":                      1,
+		"SoftwareAgent":                     1,
+		"SpdxDocument":                      1,
+		"software_Package":                  1,
+		"software_File":                     2,
+		"Relationship":                      2,
+		"simplelicensing_LicenseExpression": 1,
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("elements = %v, want %v", types, want)
+	}
+	if len(root) != 1 || !ids[root[0].(string)] {
+		t.Errorf("root element %v is not in the graph", root)
+	}
+}
+
+func TestFileSteps(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	spec.FileSteps = map[string]string{"usr/bin/hello": "step 2 (strip)"}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	if a := doc.Files[0].Annotations; len(a) != 1 || a[0].Comment != "produced by pipeline step 2 (strip)" || a[0].AnnotationType != "OTHER" {
+		t.Errorf("annotations of the produced file = %+v", a)
+	}
+	if a := doc.Files[1].Annotations; len(a) != 0 {
+		t.Errorf("annotations of the other file = %+v", a)
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	if p := cdx.Components[0].Components[0].Properties; len(p) != 1 || p[0].Value != "step 2 (strip)" {
+		t.Errorf("properties of the produced file = %+v", p)
+	}
+
+	data, err := os.ReadFile(filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "produced by pipeline step 2 (strip)") {
+		t.Error("the SPDX 3 SBOM does not annotate the produced file")
+	}
+}
+
+const mitText = `Copyright (c) 2022 Example
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction.
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+`
+
+func TestScanLicenses(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want []string
+	}{
+		{mitText, []string{"MIT"}},
+		{"GNU LESSER GENERAL PUBLIC LICENSE\n   Version 2.1, February 1999\n", []string{"LGPL-2.1-only"}},
+		{"Redistribution and use in source and binary forms, with or\nwithout modification, are permitted provided...\n", []string{"BSD-2-Clause"}},
+		{"Redistribution and use in source and binary forms, with or without modification, are permitted.\nNeither the name of the copyright holder...\n\n" + mitText, []string{"BSD-3-Clause", "MIT"}},
+		{"All rights reserved.\n", []string{}},
+	} {
+		if got := ScanLicenses(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ScanLicenses(%.30q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	spec := testSpec(t, FormatSPDX, FormatCycloneDX)
+	spec.License = "MIT OR Apache-2.0"
+	if err := os.WriteFile(filepath.Join(spec.Path, "usr/share/doc/hello/COPYING"), []byte(mitText), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(spec.Path, "usr/share/licenses/hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(spec.Path, "usr/share/licenses/hello/zlib"), []byte("This software is provided 'as-is', without any express or implied\nwarranty.\n3. Altered source versions must be plainly marked as such.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	pkg := doc.Packages[0]
+	if want := "(MIT OR Apache-2.0) AND Zlib"; pkg.LicenseConcluded != want {
+		t.Errorf("concluded license = %q, want %q", pkg.LicenseConcluded, want)
+	}
+	if want := []string{"MIT", "Zlib"}; !reflect.DeepEqual(pkg.LicenseInfoFromFiles, want) {
+		t.Errorf("licenses from files = %q, want %q", pkg.LicenseInfoFromFiles, want)
+	}
+	found := map[string][]string{}
+	for _, f := range doc.Files {
+		if f.LicenseInfoInFiles != nil {
+			found[f.FileName] = f.LicenseInfoInFiles
+		}
+	}
+	if want := map[string][]string{"/usr/share/doc/hello/COPYING": {"MIT"}, "/usr/share/licenses/hello/zlib": {"Zlib"}}; !reflect.DeepEqual(found, want) {
+		t.Errorf("licenses in files = %q, want %q", found, want)
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	for _, c := range cdx.Components[0].Components {
+		if c.Name == "/usr/share/doc/hello/COPYING" && !reflect.DeepEqual(c.Licenses, []cdxLicense{{Expression: "MIT"}}) {
+			t.Errorf("licenses of %s = %+v", c.Name, c.Licenses)
+		}
+	}
+
+	// without license files, the license is not concluded.
+	spec = testSpec(t, FormatSPDX)
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	if doc.Packages[0].LicenseConcluded != "NOASSERTION" {
+		t.Errorf("concluded license without license files = %q", doc.Packages[0].LicenseConcluded)
+	}
+}
+
+func TestLicenseTags(t *testing.T) {
+	for _, tt := range []struct {
+		head string
+		want []string
+	}{
+		{"// SPDX-License-Identifier: MIT\n", []string{"MIT"}},
+		{"/* SPDX-License-Identifier: (GPL-2.0-only WITH Linux-syscall-note) OR BSD-2-Clause */\n", []string{"(GPL-2.0-only WITH Linux-syscall-note) OR BSD-2-Clause"}},
+		{"<!-- SPDX-License-Identifier: Apache-2.0 -->\n# SPDX-License-Identifier: Apache-2.0\n", []string{"Apache-2.0"}},
+		{"const tag = \"SPDX-License-Identifier:\"\n# SPDX-License-Identifier: $LICENSE\n# SPDX-License-Identifier: (MIT\n", []string{}},
+	} {
+		if got := licenseTags([]byte(tt.head)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("licenseTags(%q) = %q, want %q", tt.head, got, tt.want)
+		}
+	}
+
+	spec := testSpec(t, FormatSPDX, FormatCycloneDX)
+	spec.ChecksumCache = filepath.Join(t.TempDir(), "checksums.json")
+	if err := os.WriteFile(filepath.Join(spec.Path, "usr/bin/hello"), []byte("#!/bin/sh\n# SPDX-License-Identifier: GPL-2.0-or-later WITH Autoconf-exception-2.0\necho hello\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tags are kept in the checksum cache.
+	for i := 0; i < 2; i++ {
+		if err := NewGenerator().Generate(spec); err != nil {
+			t.Fatal(err)
+		}
+
+		var doc spdxDocument
+		readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+		for _, f := range doc.Files {
+			if f.FileName != "/usr/bin/hello" {
+				continue
+			}
+			if want := "GPL-2.0-or-later WITH Autoconf-exception-2.0"; f.LicenseConcluded != want {
+				t.Errorf("concluded license = %q, want %q", f.LicenseConcluded, want)
+			}
+			if want := []string{"GPL-2.0-or-later"}; !reflect.DeepEqual(f.LicenseInfoInFiles, want) {
+				t.Errorf("licenses in file = %q, want %q", f.LicenseInfoInFiles, want)
+			}
+		}
+		if want := "MIT AND GPL-2.0-or-later"; doc.Packages[0].LicenseConcluded != want {
+			t.Errorf("concluded license of the package = %q, want %q", doc.Packages[0].LicenseConcluded, want)
+		}
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	for _, c := range cdx.Components[0].Components {
+		if c.Name == "/usr/bin/hello" && !reflect.DeepEqual(c.Licenses, []cdxLicense{{Expression: "GPL-2.0-or-later WITH Autoconf-exception-2.0"}}) {
+			t.Errorf("licenses of %s = %+v", c.Name, c.Licenses)
+		}
+	}
+}
+
+// buildGoProgram builds a Go program linking the vendored module
+// example.com/greeting v1.2.3 into dir.
+func buildGoProgram(t *testing.T, dir string) {
+	t.Helper()
+
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not installed")
+	}
+
+	src := t.TempDir()
+	for path, contents := range map[string]string{
+		"go.mod":                               "module example.com/hello\n\ngo 1.18\n\nrequire example.com/greeting v1.2.3\n",
+		"main.go":                              "package main\n\nimport \"example.com/greeting\"\n\nfunc main() { println(greeting.Hello) }\n",
+		"vendor/modules.txt":                   "# example.com/greeting v1.2.3\n## explicit\nexample.com/greeting\n",
+		"vendor/example.com/greeting/hello.go": "package greeting\n\nconst Hello = \"hello\"\n",
+	} {
+		path = filepath.Join(src, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(goTool, "build", "-mod=vendor", "-o", filepath.Join(dir, "usr/bin/hello-go"), ".")
+	cmd.Dir = src
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GOTOOLCHAIN=local", "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("unable to build Go program: %v\n%s", err, out)
+	}
+}
+
+func TestGenerateGoModules(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatCycloneDX)
+	buildGoProgram(t, spec.Path)
+
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	const purl = "pkg:golang/example.com/greeting@v1.2.3"
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+
+	var moduleID string
+	for _, p := range doc.Packages {
+		if p.ExternalRefs[0].ReferenceLocator == purl {
+			moduleID = p.SPDXID
+		}
+	}
+	if moduleID == "" {
+		t.Fatalf("no package with the purl %s in %+v", purl, doc.Packages)
+	}
+
+	contained := false
+	for _, r := range doc.Relationships {
+		if r.Element == doc.Packages[0].SPDXID && r.Type == "CONTAINS" && r.Related == moduleID {
+			contained = true
+		}
+	}
+	if !contained {
+		t.Errorf("the package does not contain %s", moduleID)
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+
+	found := false
+	for _, c := range cdx.Components[0].Components {
+		found = found || c.PURL == purl
+	}
+	if !found {
+		t.Errorf("no component with the purl %s", purl)
+	}
+}
+
+func TestScanPythonMetadata(t *testing.T) {
+	root := t.TempDir()
+	for path, contents := range map[string]string{
+		"usr/lib/python3.10/site-packages/Jinja2-3.1.2.dist-info/METADATA":      "Metadata-Version: 2.1\nName: Jinja2\nVersion: 3.1.2\n\nName: not a header\n",
+		"usr/lib/python3.10/site-packages/zope.interface-5.4.egg-info/PKG-INFO": "Metadata-Version: 1.1\nName: zope.interface\nVersion: 5.4\n",
+		"usr/lib/python3/dist-packages/six-1.16.0.egg-info":                     "Metadata-Version: 1.2\nName: six\nVersion: 1.16.0\n",
+		"usr/share/doc/example.dist-info/METADATA":                              "Name: example\nVersion: 1.0\n",
+	} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := scanFiles(root, filepath.Join(root, "var/lib/db/sbom"), DefaultChecksumAlgorithms, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purls := []string{}
+	for _, c := range contents.components {
+		purls = append(purls, c.purl)
+	}
+	want := []string{"pkg:pypi/jinja2@3.1.2", "pkg:pypi/six@1.16.0", "pkg:pypi/zope-interface@5.4"}
+	if !reflect.DeepEqual(purls, want) {
+		t.Errorf("components = %q, want %q", purls, want)
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	spec.Deprecation = &Deprecation{Reason: "unmaintained upstream", Replacement: "hello2", EndOfLife: time.Date(2023, 6, 30, 0, 0, 0, 0, time.UTC)}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	comment := "deprecated: unmaintained upstream; replaced by hello2; end of life on 2023-06-30"
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	pkg := doc.Packages[0]
+	if pkg.ValidUntilDate != "2023-06-30T00:00:00Z" || len(pkg.Annotations) != 1 || pkg.Annotations[0].Comment != comment {
+		t.Errorf("SPDX package valid until %q, annotations %+v", pkg.ValidUntilDate, pkg.Annotations)
+	}
+
+	var doc3 spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc3)
+	found := false
+	for _, e := range doc3.Graph {
+		if e["type"] == "Annotation" && e["statement"] == comment {
+			found = true
+		}
+		if e["type"] == "software_Package" && e["name"] == "hello" && e["validUntilTime"] != "2023-06-30T00:00:00Z" {
+			t.Errorf("SPDX 3 package valid until %v", e["validUntilTime"])
+		}
+	}
+	if !found {
+		t.Errorf("SPDX 3 document does not annotate the deprecation")
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	want := []cdxProperty{
+		{Name: "melange:deprecated", Value: "unmaintained upstream"},
+		{Name: "melange:replacement", Value: "hello2"},
+		{Name: "melange:end-of-life", Value: "2023-06-30"},
+	}
+	if got := cdx.Components[0].Properties; !reflect.DeepEqual(got, want) {
+		t.Errorf("CycloneDX properties = %+v, want %+v", got, want)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	spec.Provenance = &Provenance{
+		ConfigDigest:     "sha256:c0ff",
+		Pipelines:        []string{"fetch sha256:f00d", "autoconf/configure sha256:beef"},
+		Builder:          "melange v0.2.0",
+		Runner:           "bubblewrap",
+		BuildEnvironment: "sha256:e4e4",
+	}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"melange:config-digest: sha256:c0ff",
+		"melange:pipeline: fetch sha256:f00d",
+		"melange:pipeline: autoconf/configure sha256:beef",
+		"melange:builder: melange v0.2.0",
+		"melange:runner: bubblewrap",
+		"melange:build-environment: sha256:e4e4",
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	got := []string{}
+	for _, a := range doc.Packages[0].Annotations {
+		got = append(got, a.Comment)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SPDX annotations = %q, want %q", got, want)
+	}
+
+	var doc3 spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc3)
+	got = []string{}
+	for _, e := range doc3.Graph {
+		if e["type"] == "Annotation" {
+			got = append(got, e["statement"].(string))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SPDX 3 annotations = %q, want %q", got, want)
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	got = []string{}
+	for _, p := range cdx.Components[0].Properties {
+		got = append(got, p.Name+": "+p.Value)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CycloneDX properties = %q, want %q", got, want)
+	}
+}
+
+func TestCPE(t *testing.T) {
+	for cpe, valid := range map[string]bool{
+		"cpe:2.3:a:gnu:hello:2.12:*:*:*:*:*:*:*":       true,
+		`cpe:2.3:a:foo\:bar:hello:*:*:*:*:*:*:*:*`:     true,
+		"cpe:2.3:x:gnu:hello:2.12:*:*:*:*:*:*:*":       false,
+		"cpe:2.3:a:gnu:hello:2.12":                     false,
+		"cpe:/a:gnu:hello:2.12":                        false,
+		"cpe:2.3:a:gnu::2.12:*:*:*:*:*:*:*":            false,
+		"cpe:2.3:a:gnu:hello:2.12:*:*:*:*:*:*:*:extra": false,
+	} {
+		if err := ValidateCPE(cpe); (err == nil) != valid {
+			t.Errorf("ValidateCPE(%q) = %v, want valid %t", cpe, err, valid)
+		}
+	}
+
+	if got, want := DeriveCPE("Hello", "2.12+git"), `cpe:2.3:a:hello:hello:2.12\+git:*:*:*:*:*:*:*`; got != want {
+		t.Errorf("DeriveCPE() = %q, want %q", got, want)
+	}
+	if got, want := WithCPEVersion("cpe:2.3:a:gnu:hello:*:*:*:*:*:*:*:*", "2.12"), "cpe:2.3:a:gnu:hello:2.12:*:*:*:*:*:*:*"; got != want {
+		t.Errorf("WithCPEVersion() = %q, want %q", got, want)
+	}
+	if got, want := WithCPEVersion("cpe:2.3:a:gnu:hello:2.10:*:*:*:*:*:*:*", "2.12"), "cpe:2.3:a:gnu:hello:2.10:*:*:*:*:*:*:*"; got != want {
+		t.Errorf("WithCPEVersion() = %q, want %q", got, want)
+	}
+
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	spec.CPEs = []string{"cpe:2.3:a:gnu:hello:2.12:*:*:*:*:*:*:*", "cpe:2.3:a:hello_project:hello:2.12:*:*:*:*:*:*:*"}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	data := readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	want := []spdxExternalRef{
+		{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: spec.purl()},
+		{ReferenceCategory: "SECURITY", ReferenceType: "cpe23Type", ReferenceLocator: spec.CPEs[0]},
+		{ReferenceCategory: "SECURITY", ReferenceType: "cpe23Type", ReferenceLocator: spec.CPEs[1]},
+	}
+	if got := doc.Packages[0].ExternalRefs; !reflect.DeepEqual(got, want) {
+		t.Errorf("SPDX external references = %+v, want %+v", got, want)
+	}
+	if problems, err := ValidateSPDX(data); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() = %q, %v, want no problem", problems, err)
+	}
+
+	var doc3 spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc3)
+	for _, e := range doc3.Graph {
+		if e["type"] == "software_Package" && e["name"] == "hello" {
+			if ids, _ := e["externalIdentifier"].([]interface{}); len(ids) != 2 {
+				t.Errorf("SPDX 3 external identifiers = %v, want the 2 CPEs", e["externalIdentifier"])
+			}
+		}
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	c := cdx.Components[0]
+	if c.CPE != spec.CPEs[0] || !reflect.DeepEqual(c.Properties, []cdxProperty{{Name: "melange:cpe", Value: spec.CPEs[1]}}) {
+		t.Errorf("CycloneDX cpe = %q, properties %+v", c.CPE, c.Properties)
+	}
+}
+
+func TestScanNodeModules(t *testing.T) {
+	root := t.TempDir()
+	for path, contents := range map[string]string{
+		"usr/lib/app/package.json":                                      `{"name": "app", "version": "1.0.0"}`,
+		"usr/lib/app/node_modules/express/package.json":                 `{"name": "express", "version": "4.18.2"}`,
+		"usr/lib/app/node_modules/express/node_modules/ms/package.json": `{"name": "ms", "version": "2.0.0"}`,
+		"usr/lib/app/node_modules/@babel/core/package.json":             `{"name": "@babel/core", "version": "7.20.5"}`,
+		"usr/lib/app/node_modules/@babel/core/lib/package.json":         `{"type": "commonjs"}`,
+		"usr/lib/app/node_modules/broken/package.json":                  `{`,
+	} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := scanFiles(root, filepath.Join(root, "var/lib/db/sbom"), DefaultChecksumAlgorithms, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purls := []string{}
+	for _, c := range contents.components {
+		purls = append(purls, c.purl)
+	}
+	want := []string{"pkg:npm/%40babel/core@7.20.5", "pkg:npm/express@4.18.2", "pkg:npm/ms@2.0.0"}
+	if !reflect.DeepEqual(purls, want) {
+		t.Errorf("components = %q, want %q", purls, want)
+	}
+}
+
+func TestDuplicateComponents(t *testing.T) {
+	// a crate linked into a program, and vendored next to it.
+	set := map[component]bool{
+		{name: "serde", version: "1.0.188", purl: "pkg:cargo/serde@1.0.188", dependency: true}:  true,
+		{name: "serde", version: "1.0.188", purl: "pkg:cargo/serde@1.0.188", dependency: false}: true,
+		{name: "libc", version: "0.2.148", purl: "pkg:cargo/libc@0.2.148"}:                      true,
+	}
+	components := sortedComponents(set)
+	want := []component{
+		{name: "libc", version: "0.2.148", purl: "pkg:cargo/libc@0.2.148"},
+		{name: "serde", version: "1.0.188", purl: "pkg:cargo/serde@1.0.188", dependency: true},
+	}
+	if !reflect.DeepEqual(components, want) {
+		t.Fatalf("sortedComponents() = %+v, want %+v", components, want)
+	}
+
+	spec := testSpec(t)
+	contents := &packageContents{
+		files:      []file{{path: "usr/bin/hello", digests: map[string]string{ChecksumSHA1: "01", ChecksumSHA256: "02"}}},
+		components: components,
+		dependencies: map[string][]string{
+			"usr/bin/hello": {"pkg:cargo/serde@1.0.188"},
+		},
+	}
+	data, err := (&spdx{}).Generate(spec, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := ValidateSPDX(data); err != nil || len(problems) > 0 {
+		t.Errorf("ValidateSPDX() = %q, %v, want no problem", problems, err)
+	}
+	if n := strings.Count(string(data), `"referenceLocator": "pkg:cargo/serde@1.0.188"`); n != 1 {
+		t.Errorf("the SPDX document lists serde %d times, want once", n)
+	}
+}
+
+func TestChecksumCache(t *testing.T) {
+	spec := testSpec(t)
+	spec.ChecksumCache = filepath.Join(t.TempDir(), "hello.json")
+
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unchanged file is not hashed again, so the cached digest
+	// is used even though it is wrong.
+	cache := loadChecksumCache(spec.ChecksumCache)
+	cache.entries["usr/bin/hello"].Digests[ChecksumSHA256] = "cached"
+	cache.scanned = cache.entries
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a changed file is hashed again.
+	readme := filepath.Join(spec.Path, "usr/share/doc/hello/README")
+	if err := os.WriteFile(readme, []byte("hello, world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = loadChecksumCache(spec.ChecksumCache)
+	contents, err := scanFiles(spec.Path, spec.OutputDir, DefaultChecksumAlgorithms, cache, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.hits != 1 {
+		t.Errorf("%d cache hits, want 1", cache.hits)
+	}
+	digests := map[string]string{}
+	for _, f := range contents.files {
+		digests[f.path] = f.digests[ChecksumSHA256]
+	}
+	if digests["usr/bin/hello"] != "cached" {
+		t.Errorf("the unchanged file was hashed again")
+	}
+	// sha256 of "hello, world\n"
+	if got, want := digests["usr/share/doc/hello/README"], "853ff93762a06ddbf722c4ebe9ddd66d8f63ddaea97f521c3ecc20da7c976020"; got != want {
+		t.Errorf("digest of the changed file = %s, want %s", got, want)
+	}
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file replaced by another one of the same size and
+	// modification time is hashed again.
+	hello := filepath.Join(spec.Path, "usr/bin/hello")
+	fi, err := os.Stat(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement := hello + ".new"
+	if err := os.WriteFile(replacement, []byte("#!/bin/sh\necho HELLO\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(replacement, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, hello); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = loadChecksumCache(spec.ChecksumCache)
+	if _, err := scanFiles(spec.Path, spec.OutputDir, DefaultChecksumAlgorithms, cache, true); err != nil {
+		t.Fatal(err)
+	}
+	if cache.hits != 1 {
+		t.Errorf("%d cache hits after replacing a file, want 1", cache.hits)
+	}
+}
+
+func TestCargoAuditable(t *testing.T) {
+	objcopy, err := exec.LookPath("objcopy")
+	if err != nil {
+		t.Skip("objcopy is not installed")
+	}
+	program, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	fmt.Fprint(zw, `{"packages":[`+
+		`{"name":"hello","version":"0.1.0","source":"local","root":true,"dependencies":[1,2]},`+
+		`{"name":"serde","version":"1.0.152","source":"crates.io"},`+
+		`{"name":"cc","version":"1.0.79","source":"crates.io","kind":"build"}]}`)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	section := filepath.Join(t.TempDir(), "dep-v0")
+	if err := os.WriteFile(section, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	out := filepath.Join(spec.Path, "usr/bin/hello-rs")
+	if out, err := exec.Command(objcopy, "--add-section", cargoAuditableSection+"="+section, program, out).CombinedOutput(); err != nil {
+		t.Fatalf("unable to add the cargo auditable section: %v\n%s", err, out)
+	}
+
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	const purl = "pkg:cargo/serde@1.0.152"
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	ids := map[string]string{}
+	for _, p := range doc.Packages {
+		if len(p.ExternalRefs) > 0 && strings.HasPrefix(p.ExternalRefs[0].ReferenceLocator, "pkg:cargo/") {
+			ids[p.ExternalRefs[0].ReferenceLocator] = p.SPDXID
+		}
+	}
+	if len(ids) != 1 || ids[purl] == "" {
+		t.Fatalf("crates = %v, want %s only", ids, purl)
+	}
+
+	var fileID string
+	for _, f := range doc.Files {
+		if f.FileName == "/usr/bin/hello-rs" {
+			fileID = f.SPDXID
+		}
+	}
+	dependsOn := false
+	for _, r := range doc.Relationships {
+		if r.Element == fileID && r.Type == "DEPENDS_ON" && r.Related == ids[purl] {
+			dependsOn = true
+		}
+	}
+	if !dependsOn {
+		t.Errorf("%s does not depend on %s", fileID, ids[purl])
+	}
+
+	var doc3 spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc3)
+	dependsOn = false
+	for _, e := range doc3.Graph {
+		dependsOn = dependsOn || e["relationshipType"] == "dependsOn"
+	}
+	if !dependsOn {
+		t.Errorf("no SPDX 3 dependsOn relationship")
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	if want := []cdxDependency{{Ref: "file:/usr/bin/hello-rs", DependsOn: []string{purl}}}; !reflect.DeepEqual(cdx.Dependencies, want) {
+		t.Errorf("CycloneDX dependencies = %+v, want %+v", cdx.Dependencies, want)
+	}
+}
+
+func TestDependencyTrack(t *testing.T) {
+	var upload dtrackUpload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/api/v1/bom" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Api-Key") != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+			t.Error(err)
+		}
+		fmt.Fprintln(w, `{"token": "c1f2"}`)
+	}))
+	defer server.Close()
+
+	// the exporter is given a CycloneDX SBOM although only SPDX is
+	// written.
+	spec := testSpec(t)
+	spec.Exporters = []Exporter{&DependencyTrack{URL: server.URL + "/", APIKey: "secret"}}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if upload.ProjectName != "hello" || upload.ProjectVersion != "1.0-r0" || !upload.AutoCreate {
+		t.Errorf("unexpected upload %+v", upload)
+	}
+	data, err := base64.StdEncoding.DecodeString(upload.BOM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc cdxDocument
+	if err := json.Unmarshal(data, &doc); err != nil || doc.BOMFormat != "CycloneDX" {
+		t.Errorf("uploaded SBOM is not CycloneDX: %v", err)
+	}
+
+	dt := &DependencyTrack{URL: server.URL, APIKey: "wrong"}
+	if err := dt.Export(spec, data); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Export() = %v, want an authorization error", err)
+	}
+}
+
+// writeZip returns a zip archive of files.
+func writeZip(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScanJavaArchives(t *testing.T) {
+	shaded := writeZip(t, map[string][]byte{
+		"META-INF/maven/com.fasterxml.jackson.core/jackson-core/pom.properties": []byte("#Generated by Maven\ngroupId=com.fasterxml.jackson.core\nartifactId=jackson-core\nversion=2.14.1\n"),
+	})
+	jar := writeZip(t, map[string][]byte{
+		"META-INF/MANIFEST.MF":                            []byte("Manifest-Version: 1.0\n"),
+		"META-INF/maven/org.example/hello/pom.properties": []byte("groupId = org.example\nartifactId: hello\nversion=1.0\n"),
+		"BOOT-INF/lib/jackson-core-2.14.1.jar":            shaded,
+	})
+
+	spec := testSpec(t, FormatSPDX)
+	if err := os.MkdirAll(filepath.Join(spec.Path, "usr/share/java/hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(spec.Path, "usr/share/java/hello/hello.jar"), jar, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	ids := map[string]string{}
+	for _, p := range doc.Packages {
+		if len(p.ExternalRefs) > 0 && strings.HasPrefix(p.ExternalRefs[0].ReferenceLocator, "pkg:maven/") {
+			ids[p.ExternalRefs[0].ReferenceLocator] = p.SPDXID
+		}
+	}
+
+	want := []string{"pkg:maven/com.fasterxml.jackson.core/jackson-core@2.14.1", "pkg:maven/org.example/hello@1.0"}
+	dependencies := 0
+	for _, r := range doc.Relationships {
+		if r.Type == "DEPENDS_ON" {
+			dependencies++
+		}
+	}
+	if len(ids) != len(want) || ids[want[0]] == "" || ids[want[1]] == "" || dependencies != 2 {
+		t.Errorf("Maven artifacts = %v, %d dependencies, want %q", ids, dependencies, want)
+	}
+}
+
+func TestChecksumAlgorithms(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatCycloneDX)
+	spec.ChecksumAlgorithms = []string{ChecksumSHA512, ChecksumSHA256}
+	spec.ChecksumCache = filepath.Join(t.TempDir(), "hello.json")
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	algorithms := []string{}
+	for _, c := range doc.Files[0].Checksums {
+		algorithms = append(algorithms, c.Algorithm)
+	}
+	if want := []string{"SHA256", "SHA512"}; !reflect.DeepEqual(algorithms, want) {
+		t.Errorf("checksums = %q, want %q", algorithms, want)
+	}
+
+	// the cached digests lack SHA1, so the files are hashed again.
+	cache := loadChecksumCache(spec.ChecksumCache)
+	if _, err := scanFiles(spec.Path, spec.OutputDir, DefaultChecksumAlgorithms, cache, true); err != nil {
+		t.Fatal(err)
+	}
+	if cache.hits != 0 {
+		t.Errorf("%d cache hits, want none", cache.hits)
+	}
+
+	for _, algorithms := range [][]string{{ChecksumSHA1}, {ChecksumSHA256, "md5"}} {
+		if err := ValidateChecksumAlgorithms(algorithms); err == nil {
+			t.Errorf("ValidateChecksumAlgorithms(%q) succeeded", algorithms)
+		}
+	}
+}
+
+type testSigner struct {
+	key ed25519.PrivateKey
+}
+
+func (s testSigner) KeyID() string {
+	return "test.pub"
+}
+
+func (s testSigner) Sign(message []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, message), nil
+}
+
+func TestAttest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the SPDX SBOM is attested even if only CycloneDX is written.
+	spec := testSpec(t, FormatCycloneDX)
+	spec.Signer = testSigner{priv}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json")
+	doc, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, doc, sig) {
+		t.Error("the signature of the SBOM does not verify")
+	}
+
+	var envelope dsseEnvelope
+	readJSON(t, path+".att", &envelope)
+	if data, err := os.ReadFile(path + ".att"); err != nil {
+		t.Fatal(err)
+	} else if err := schema.Validate(schema.SBOMAttestation, data); err != nil {
+		t.Error(err)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Signatures[0].KeyID != "test.pub" || !ed25519.Verify(pub, dssePAE(envelope.PayloadType, payload), sig) {
+		t.Error("the signature of the attestation does not verify")
+	}
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		t.Fatal(err)
+	}
+	if statement.PredicateType != spdxPredicateType || len(statement.Subject) != 2 || statement.Subject[0].Name != "/usr/bin/hello" {
+		t.Errorf("unexpected statement %s about %+v", statement.PredicateType, statement.Subject)
+	}
+	var predicate spdxDocument
+	if err := json.Unmarshal(statement.Predicate, &predicate); err != nil || predicate.SPDXVersion != "SPDX-2.3" {
+		t.Errorf("the predicate is not the SPDX SBOM: %v", err)
+	}
+}
+
+func TestSupplierOriginator(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	spec.Supplier = "Organization: Example, Inc. (sbom@example.com)"
+	spec.Originator = "Person: Jane Doe"
+	buildGoProgram(t, spec.Path)
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	for _, p := range doc.Packages {
+		if p.Supplier != spec.Supplier {
+			t.Errorf("supplier of %s = %q", p.Name, p.Supplier)
+		}
+	}
+	if doc.Packages[0].Originator != spec.Originator {
+		t.Errorf("originator = %q", doc.Packages[0].Originator)
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	if s := cdx.Components[0].Supplier; s == nil || s.Name != "Example, Inc." || cdx.Components[0].Author != "Jane Doe" {
+		t.Errorf("supplier = %+v, author = %q", s, cdx.Components[0].Author)
+	}
+
+	var doc3 spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc3)
+	names := map[string]string{}
+	for _, e := range doc3.Graph {
+		if e["type"] == "Organization" || e["type"] == "Person" {
+			names[e["spdxId"].(string)] = e["type"].(string) + ": " + e["name"].(string)
+		}
+	}
+	for _, e := range doc3.Graph {
+		if e["type"] == "software_Package" && e["name"] == "hello" {
+			if names[e["suppliedBy"].(string)] != "Organization: Example, Inc." {
+				t.Errorf("suppliedBy = %v", e["suppliedBy"])
+			}
+		}
+	}
+
+	for _, agent := range []string{"Example", "Tool: melange", "Organization: "} {
+		if err := ValidateAgent(agent); err == nil {
+			t.Errorf("ValidateAgent(%q) succeeded", agent)
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	spec.Sources = []Source{{
+		URL:    "https://example.com/hello-1.0.tar.gz",
+		SHA256: strings.Repeat("ab", 32),
+	}, {
+		URL:    "https://github.com/example/hello.git",
+		Commit: "0123456789abcdef0123456789abcdef01234567",
+	}}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	locations := map[string]string{}
+	for _, p := range doc.Packages {
+		locations[p.SPDXID] = p.DownloadLocation
+	}
+	generatedFrom := []string{}
+	for _, r := range doc.Relationships {
+		if r.Type == "GENERATED_FROM" && r.Element == doc.DocumentDescribes[0] {
+			generatedFrom = append(generatedFrom, locations[r.Related])
+		}
+	}
+	want := []string{
+		"https://example.com/hello-1.0.tar.gz",
+		"git+https://github.com/example/hello.git@0123456789abcdef0123456789abcdef01234567",
+	}
+	if !reflect.DeepEqual(generatedFrom, want) {
+		t.Errorf("generated from %q, want %q", generatedFrom, want)
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	if refs := cdx.Components[0].ExternalReferences; len(refs) != 2 || refs[0].Type != "source-distribution" || refs[1].Type != "vcs" {
+		t.Errorf("external references = %+v", refs)
+	}
+
+	var doc3 spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc3)
+	found := false
+	for _, e := range doc3.Graph {
+		if e["relationshipType"] == "generatedFrom" {
+			found = len(e["to"].([]interface{})) == 2
+		}
+	}
+	if !found {
+		t.Errorf("SPDX 3 SBOM has no generatedFrom relationship to the sources")
+	}
+
+	spec.Sources = []Source{{URL: "https://example.com/hello.tar.gz", SHA256: "1234"}}
+	if err := NewGenerator().Generate(spec); err == nil {
+		t.Errorf("source with an invalid digest was accepted")
+	}
+}
+
+func TestCheckNTIA(t *testing.T) {
+	formats := []string{FormatSPDX, FormatSPDX3, FormatCycloneDX}
+	exts := map[string]string{FormatSPDX: "spdx.json", FormatSPDX3: "spdx3.json", FormatCycloneDX: "cdx.json"}
+
+	spec := testSpec(t, formats...)
+	spec.Sources = []Source{{URL: "https://example.com/hello-1.0.tar.gz", SHA256: strings.Repeat("ab", 32)}}
+	spec.CheckNTIA = true
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range formats {
+		data, err := os.ReadFile(filepath.Join(spec.OutputDir, "sbom-x86_64."+exts[format]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		problems, err := CheckNTIA(format, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"no author other than tools", "component hello: no supplier"}; !reflect.DeepEqual(problems, want) {
+			t.Errorf("CheckNTIA(%s) = %q, want %q", format, problems, want)
+		}
+	}
+
+	spec.StrictNTIA = true
+	if err := NewGenerator().Generate(spec); err == nil || !strings.Contains(err.Error(), "no supplier") {
+		t.Errorf("Generate() of an SBOM without supplier = %v", err)
+	}
+
+	// the supplier is the author of the SBOMs.
+	spec.Supplier = "Organization: Example, Inc."
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range formats {
+		data, err := os.ReadFile(filepath.Join(spec.OutputDir, "sbom-x86_64."+exts[format]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if problems, err := CheckNTIA(format, data); err != nil || len(problems) > 0 {
+			t.Errorf("CheckNTIA(%s) = %q, %v", format, problems, err)
+		}
+	}
+
+	problems, err := CheckNTIA(FormatSPDX, []byte(`{"packages": [{"SPDXID": "SPDXRef-A", "name": "a"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"no author other than tools", "no timestamp", "no relationship to the described package", "no component"}; !reflect.DeepEqual(problems, want) {
+		t.Errorf("CheckNTIA() of an empty document = %q, want %q", problems, want)
+	}
+
+	if _, err := CheckNTIA("swid", nil); err == nil {
+		t.Error("CheckNTIA() accepted an unknown format")
+	}
+}
+
+func TestFileTypes(t *testing.T) {
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar")
+
+	for _, tt := range []struct {
+		name string
+		head string
+		want []string
+	}{
+		{"usr/bin/hello", "\x7fELF\x02\x01\x01", []string{FileTypeBinary}},
+		{"usr/lib/libz.a", "!<arch>\n", []string{FileTypeArchive}},
+		{"usr/share/java/x.jar", "PK\x03\x04", []string{FileTypeArchive}},
+		{"usr/share/x.tar", string(tar), []string{FileTypeArchive}},
+		{"usr/share/icons/x.png", "\x89PNG\r\n\x1a\n", []string{FileTypeImage}},
+		{"usr/share/icons/x.webp", "RIFF\x00\x00\x00\x00WEBPVP8 ", []string{FileTypeImage}},
+		{"usr/share/icons/x.svg", "<svg/>", []string{FileTypeImage, FileTypeText}},
+		{"usr/include/zlib.h", "#ifndef ZLIB_H\n", []string{FileTypeSource, FileTypeText}},
+		{"usr/bin/configure", "#!/bin/sh\n", []string{FileTypeSource, FileTypeText}},
+		{"usr/share/doc/README", "h\xc3\xa9llo", []string{FileTypeText}},
+		// the start of the file ends in the middle of a character.
+		{"usr/share/doc/NEWS", "h\xc3", []string{FileTypeText}},
+		{"usr/share/doc/empty", "", []string{FileTypeText}},
+		{"usr/share/x.dat", "\x01\x00\x02", []string{FileTypeOther}},
+		{"usr/share/x.bin", "\xff\xfe\xfd", []string{FileTypeOther}},
+	} {
+		if got := fileTypes(tt.name, []byte(tt.head)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fileTypes(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtractedLicenses(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDX3)
+	spec.License = "(MIT OR LicenseRef-Example) AND LicenseRef-Other"
+	spec.ExtractedLicenses = []ExtractedLicense{{ID: "LicenseRef-Example", Text: "Use it.\n"}}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	if want := []spdxExtractedLicense{{LicenseID: "LicenseRef-Example", Name: "Example", ExtractedText: "Use it.\n"}}; !reflect.DeepEqual(doc.ExtractedLicenses, want) {
+		t.Errorf("extracted licenses = %+v, want %+v", doc.ExtractedLicenses, want)
+	}
+
+	var doc3 spdx3Document
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"), &doc3)
+	texts := map[string]string{}
+	var customIDs []interface{}
+	for _, e := range doc3.Graph {
+		switch e["type"] {
+		case "simplelicensing_SimpleLicensingText":
+			texts[e["spdxId"].(string)] = e["simplelicensing_licenseText"].(string)
+		case "simplelicensing_LicenseExpression":
+			customIDs, _ = e["simplelicensing_customIdToUri"].([]interface{})
+		}
+	}
+	if len(customIDs) != 1 {
+		t.Fatalf("custom license identifiers = %v", customIDs)
+	}
+	entry := customIDs[0].(map[string]interface{})
+	if entry["key"] != "LicenseRef-Example" || texts[entry["value"].(string)] != "Use it.\n" {
+		t.Errorf("custom license identifier %v, texts %v", entry, texts)
+	}
+
+	if got, want := LicenseRefs(spec.License), []string{"LicenseRef-Example", "LicenseRef-Other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LicenseRefs() = %q, want %q", got, want)
+	}
+
+	for _, l := range []ExtractedLicense{{ID: "MIT", Text: "x"}, {ID: "LicenseRef-", Text: "x"}, {ID: "LicenseRef-Example"}} {
+		spec.ExtractedLicenses = []ExtractedLicense{l}
+		if err := NewGenerator().Generate(spec); err == nil {
+			t.Errorf("Generate() accepted the extracted license %+v", l)
+		}
+	}
+}
+
+type listGenerator struct{}
+
+func (listGenerator) Format() string { return "list" }
+
+func (listGenerator) Ext() string { return "txt" }
+
+func (listGenerator) Generate(spec *Spec, contents *Contents) ([]byte, error) {
+	lines := []string{}
+	for _, f := range contents.Files {
+		lines = append(lines, fmt.Sprintf("%s %s", f.Digests[ChecksumSHA256], f.Path))
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func TestRegisterGenerator(t *testing.T) {
+	RegisterGenerator(listGenerator{})
+	t.Cleanup(func() {
+		generatorsMu.Lock()
+		delete(generators, "list")
+		generatorsMu.Unlock()
+	})
+
+	g := NewGenerator()
+	if err := g.ValidateFormats([]string{"list", FormatSPDX}); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := testSpec(t, "list")
+	spec.StrictNTIA = true
+	if err := g.Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(spec.OutputDir, "sbom-x86_64.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " usr/bin/hello") {
+		t.Errorf("unexpected SBOM %q", data)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatSPDX3, FormatCycloneDX)
+	if err := os.Symlink("hello", filepath.Join(spec.Path, "usr/bin/hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	if len(doc.Files) != 3 {
+		t.Fatalf("unexpected files %+v", doc.Files)
+	}
+	link := doc.Files[1]
+	if link.FileName != "/usr/bin/hi" || link.Comment != "symbolic link to hello" || !reflect.DeepEqual(link.FileTypes, []string{FileTypeOther}) {
+		t.Errorf("unexpected symbolic link %+v", link)
+	}
+	// the digest of a symbolic link is the one of its target.
+	if want := "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"; link.Checksums[0].ChecksumValue != want {
+		t.Errorf("checksum = %s, want %s", link.Checksums[0].ChecksumValue, want)
+	}
+
+	var cdx cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdx)
+	if c := cdx.Components[0].Components[1]; c.Description != "symbolic link to hello" {
+		t.Errorf("unexpected CycloneDX component %+v", c)
+	}
+
+	data, err := os.ReadFile(filepath.Join(spec.OutputDir, "sbom-x86_64.spdx3.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"symbolic link to hello"`) {
+		t.Error("the SPDX 3 SBOM does not describe the symbolic link")
+	}
+
+	spec.SkipSymlinks = true
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &doc)
+	if len(doc.Files) != 2 {
+		t.Errorf("the symbolic link was not skipped: %+v", doc.Files)
+	}
+}
+
+func TestCreationTime(t *testing.T) {
+	spec := testSpec(t, FormatSPDX, FormatCycloneDX)
+	spec.SourceDateEpoch = time.Time{}
+	if err := NewGenerator().Generate(spec); err != nil {
+		t.Fatal(err)
+	}
+	if !spec.SourceDateEpoch.IsZero() {
+		t.Error("Generate changed the spec")
+	}
+
+	var spdxDoc spdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.spdx.json"), &spdxDoc)
+	var cdxDoc cdxDocument
+	readJSON(t, filepath.Join(spec.OutputDir, "sbom-x86_64.cdx.json"), &cdxDoc)
+
+	created, err := time.Parse(time.RFC3339, spdxDoc.CreationInfo.Created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(created) > time.Minute {
+		t.Errorf("created %s, not at the generation", created)
+	}
+	if cdxDoc.Metadata.Timestamp != spdxDoc.CreationInfo.Created {
+		t.Errorf("the SBOMs were created at %s and %s", spdxDoc.CreationInfo.Created, cdxDoc.Metadata.Timestamp)
+	}
+}
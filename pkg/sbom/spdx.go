@@ -0,0 +1,434 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// spdx generates SPDX 2.3 JSON documents.
+type spdx struct{}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	DocumentDescribes []string           `json:"documentDescribes"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files,omitempty"`
+	Relationships     []spdxRelationship `json:"relationships,omitempty"`
+	// ExternalDocumentRefs are the other documents whose elements
+	// the relationships reference.
+	ExternalDocumentRefs []spdxExternalDocumentRef `json:"externalDocumentRefs,omitempty"`
+	// ExtractedLicenses are the texts of the custom licenses.
+	ExtractedLicenses []spdxExtractedLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxExternalDocumentRef struct {
+	ExternalDocumentID string       `json:"externalDocumentId"`
+	SPDXDocument       string       `json:"spdxDocument"`
+	Checksum           spdxChecksum `json:"checksum"`
+}
+
+type spdxExtractedLicense struct {
+	LicenseID     string `json:"licenseId"`
+	Name          string `json:"name"`
+	ExtractedText string `json:"extractedText"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	Supplier         string         `json:"supplier,omitempty"`
+	Originator       string         `json:"originator,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	LicenseDeclared  string         `json:"licenseDeclared"`
+	// LicenseInfoFromFiles are the licenses found in the files of
+	// the package.
+	LicenseInfoFromFiles []string          `json:"licenseInfoFromFiles,omitempty"`
+	CopyrightText        string            `json:"copyrightText"`
+	ExternalRefs         []spdxExternalRef `json:"externalRefs,omitempty"`
+	// ValidUntilDate is the end of life of a deprecated package,
+	// whose deprecation is annotated.
+	ValidUntilDate string           `json:"validUntilDate,omitempty"`
+	Annotations    []spdxAnnotation `json:"annotations,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	FileTypes        []string       `json:"fileTypes,omitempty"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	// LicenseInfoInFiles are the licenses whose texts are in the
+	// license files and the ones of the SPDX-License-Identifier tags
+	// of the files, whose expressions are the concluded licenses.
+	LicenseInfoInFiles []string `json:"licenseInfoInFiles,omitempty"`
+	CopyrightText      string   `json:"copyrightText"`
+	Comment            string   `json:"comment,omitempty"`
+	// Annotations record the pipeline steps which produced the
+	// files.
+	Annotations []spdxAnnotation `json:"annotations,omitempty"`
+}
+
+type spdxAnnotation struct {
+	AnnotationDate string `json:"annotationDate"`
+	AnnotationType string `json:"annotationType"`
+	Annotator      string `json:"annotator"`
+	Comment        string `json:"comment"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+func (*spdx) Ext() string {
+	return "spdx.json"
+}
+
+func (s *spdx) Generate(spec *Spec, contents *packageContents) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := s.Encode(&buf, spec, contents); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newSPDXDocument returns the SPDX document of a package, which is
+// serialized as tag-value.
+func newSPDXDocument(spec *Spec, contents *packageContents) *spdxDocument {
+	doc := newSPDXSkeleton(spec, contents)
+
+	relationships := []spdxRelationship{}
+	for i := range contents.files {
+		doc.Files = append(doc.Files, spdxFileOf(spec, contents, i))
+		relationships = append(relationships, spdxContainsFile(spec, i))
+	}
+	if len(relationships) > 0 {
+		doc.Relationships = append(relationships, doc.Relationships...)
+	}
+
+	return doc
+}
+
+// spdxFileID returns the identifier of the i-th file of a package.
+func spdxFileID(i int) string {
+	return fmt.Sprintf("SPDXRef-File-%d", i)
+}
+
+// spdxFileOf returns the SPDX file of the i-th file of a package.
+func spdxFileOf(spec *Spec, contents *packageContents, i int) spdxFile {
+	f := &contents.files[i]
+	sf := spdxFile{
+		SPDXID:             spdxFileID(i),
+		FileName:           "/" + f.path,
+		FileTypes:          f.types,
+		Checksums:          spdxChecksums(f),
+		LicenseConcluded:   f.taggedLicense(),
+		LicenseInfoInFiles: f.licenseInfo(),
+		CopyrightText:      "NOASSERTION",
+		Comment:            f.comment(),
+	}
+	if step := spec.stepAnnotation(f); step != "" {
+		sf.Annotations = []spdxAnnotation{{
+			AnnotationDate: spec.created(),
+			AnnotationType: "OTHER",
+			Annotator:      "Tool: melange",
+			Comment:        step,
+		}}
+	}
+
+	return sf
+}
+
+// spdxContainsFile returns the relationship of a package containing its
+// i-th file.
+func spdxContainsFile(spec *Spec, i int) spdxRelationship {
+	return spdxRelationship{
+		Element: spdxPackageID(spec),
+		Type:    "CONTAINS",
+		Related: spdxFileID(i),
+	}
+}
+
+// spdxPackageID returns the identifier of the package described by the
+// SPDX document.
+func spdxPackageID(spec *Spec) string {
+	return "SPDXRef-Package-" + spdxIDString(spec.PackageName)
+}
+
+// newSPDXSkeleton returns the SPDX document of a package without its
+// files and the relationships of the package containing them, which
+// are appended to it, or streamed, one at a time.
+func newSPDXSkeleton(spec *Spec, contents *packageContents) *spdxDocument {
+	copyright := spec.Copyright
+	if copyright == "" {
+		copyright = "NOASSERTION"
+	}
+
+	pkgID := spdxPackageID(spec)
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              fmt.Sprintf("%s-%s", spec.PackageName, spec.PackageVersion),
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/melange/%s-%s-%s", spec.PackageName, spec.PackageVersion, contentDigest(spec, contents)),
+		CreationInfo: spdxCreationInfo{
+			Created:  spec.created(),
+			Creators: []string{"Tool: melange"},
+		},
+		DocumentDescribes: []string{pkgID},
+		Packages: []spdxPackage{{
+			SPDXID:               pkgID,
+			Name:                 spec.PackageName,
+			VersionInfo:          spec.PackageVersion,
+			Supplier:             spec.Supplier,
+			Originator:           spec.Originator,
+			DownloadLocation:     "NOASSERTION",
+			FilesAnalyzed:        len(contents.files) > 0,
+			LicenseConcluded:     spec.concludedLicense(contents),
+			LicenseDeclared:      spec.license(),
+			LicenseInfoFromFiles: licensesFromFiles(contents),
+			CopyrightText:        copyright,
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  spec.purl(),
+			}},
+		}},
+	}
+
+	for _, cpe := range spec.CPEs {
+		doc.Packages[0].ExternalRefs = append(doc.Packages[0].ExternalRefs, spdxExternalRef{
+			ReferenceCategory: "SECURITY",
+			ReferenceType:     "cpe23Type",
+			ReferenceLocator:  cpe,
+		})
+	}
+
+	if d := spec.Deprecation; d != nil {
+		if !d.EndOfLife.IsZero() {
+			doc.Packages[0].ValidUntilDate = d.EndOfLife.UTC().Format(time.RFC3339)
+		}
+		doc.Packages[0].Annotations = append(doc.Packages[0].Annotations, spdxAnnotation{
+			AnnotationDate: spec.created(),
+			AnnotationType: "OTHER",
+			Annotator:      "Tool: melange",
+			Comment:        d.comment(),
+		})
+	}
+
+	for _, f := range spec.Provenance.facts() {
+		doc.Packages[0].Annotations = append(doc.Packages[0].Annotations, spdxAnnotation{
+			AnnotationDate: spec.created(),
+			AnnotationType: "OTHER",
+			Annotator:      "Tool: melange",
+			Comment:        f.comment(),
+		})
+	}
+
+	for _, l := range spec.ExtractedLicenses {
+		doc.ExtractedLicenses = append(doc.ExtractedLicenses, spdxExtractedLicense{
+			LicenseID:     l.ID,
+			Name:          l.name(),
+			ExtractedText: l.Text,
+		})
+	}
+
+	// the supplier is the author of the SBOM, which melange creates
+	// on its behalf.
+	if spec.Supplier != "" {
+		doc.CreationInfo.Creators = append(doc.CreationInfo.Creators, spec.Supplier)
+	}
+
+	// a subpackage depends on the package it is split from, which
+	// its SBOM describes with the sources it is built from.
+	if o := spec.Origin; o != nil {
+		ref := "DocumentRef-" + spdxIDString(o.ID)
+		doc.ExternalDocumentRefs = append(doc.ExternalDocumentRefs, spdxExternalDocumentRef{
+			ExternalDocumentID: ref,
+			SPDXDocument:       o.Namespace,
+			Checksum:           spdxChecksum{Algorithm: "SHA1", ChecksumValue: o.SHA1},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			Element: pkgID,
+			Type:    "DEPENDS_ON",
+			Related: ref + ":" + o.Element,
+		})
+	}
+
+	if b := spec.BuildEnvironment; b != nil {
+		ref := "DocumentRef-" + spdxIDString(b.ID)
+		doc.ExternalDocumentRefs = append(doc.ExternalDocumentRefs, spdxExternalDocumentRef{
+			ExternalDocumentID: ref,
+			SPDXDocument:       b.Namespace,
+			Checksum:           spdxChecksum{Algorithm: "SHA1", ChecksumValue: b.SHA1},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			Element: ref + ":" + b.Element,
+			Type:    "BUILD_DEPENDENCY_OF",
+			Related: pkgID,
+		})
+	}
+
+	componentIDs := map[string]string{}
+	for i, m := range contents.components {
+		id := fmt.Sprintf("SPDXRef-Component-%d", i)
+		componentIDs[m.purl] = id
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             m.name,
+			VersionInfo:      m.version,
+			Supplier:         spec.Supplier,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  m.purl,
+			}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			Element: pkgID,
+			Type:    "CONTAINS",
+			Related: id,
+		})
+	}
+
+	// the programs depend on the components linked into them.
+	for i, f := range contents.files {
+		for _, purl := range contents.dependencies[f.path] {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				Element: spdxFileID(i),
+				Type:    "DEPENDS_ON",
+				Related: componentIDs[purl],
+			})
+		}
+	}
+
+	for i, s := range spec.Sources {
+		id := fmt.Sprintf("SPDXRef-Source-%d", i)
+		p := spdxPackage{
+			SPDXID:           id,
+			Name:             s.name(),
+			VersionInfo:      s.Commit,
+			Originator:       spec.Originator,
+			DownloadLocation: s.downloadLocation(),
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}
+		if s.SHA256 != "" {
+			p.Checksums = []spdxChecksum{{Algorithm: lookupChecksumAlgorithm(ChecksumSHA256).spdx, ChecksumValue: s.SHA256}}
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			Element: pkgID,
+			Type:    "GENERATED_FROM",
+			Related: id,
+		})
+	}
+
+	return doc
+}
+
+// spdxChecksums returns the checksums of a file.
+func spdxChecksums(f *file) []spdxChecksum {
+	sums := []spdxChecksum{}
+	for _, c := range f.checksums() {
+		sums = append(sums, spdxChecksum{Algorithm: c.algorithm.spdx, ChecksumValue: c.value})
+	}
+	return sums
+}
+
+// spdxIDString replaces the characters which are not allowed in SPDX
+// identifiers.
+func spdxIDString(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			b[i] = '-'
+		}
+	}
+
+	return string(b)
+}
+
+// DocumentRef references an element of another SPDX 2 document, such as
+// the package described by the SBOM of the origin of a subpackage.
+type DocumentRef struct {
+	// ID identifies the document in the references, as
+	// DocumentRef-<ID>.
+	ID string
+	// Namespace is the namespace of the document.
+	Namespace string
+	// SHA1 is the hex encoded SHA1 digest of the document.
+	SHA1 string
+	// Element is the SPDX identifier of the referenced element.
+	Element string
+}
+
+// NewDocumentRef returns a reference, identified by id, to the element
+// an SPDX 2 JSON document describes.
+func NewDocumentRef(id string, data []byte) (*DocumentRef, error) {
+	var doc spdxDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse SPDX document: %w", err)
+	}
+	if doc.DocumentNamespace == "" || len(doc.DocumentDescribes) == 0 {
+		return nil, errors.New("the SPDX document has no namespace or describes no element")
+	}
+
+	digest := sha1.Sum(data) // nolint:gosec
+	return &DocumentRef{
+		ID:        id,
+		Namespace: doc.DocumentNamespace,
+		SHA1:      hex.EncodeToString(digest[:]),
+		Element:   doc.DocumentDescribes[0],
+	}, nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// spdx3 generates SPDX 3.0 JSON-LD documents, conforming to the core,
+// software and simple licensing profiles.
+type spdx3 struct{}
+
+// spdx3Context is the JSON-LD context of SPDX 3.0 documents.
+const spdx3Context = "https://spdx.org/rdf/3.0.1/spdx-context.jsonld"
+
+// spdx3CreationInfo is the blank node of the creation information, which
+// all the elements share.
+const spdx3CreationInfo = "_:creationinfo"
+
+type spdx3Document struct {
+	Context string                   `json:"@context"`
+	Graph   []map[string]interface{} `json:"@graph"`
+}
+
+func (*spdx3) Ext() string {
+	return "spdx3.json"
+}
+
+func (*spdx3) Generate(spec *Spec, contents *packageContents) ([]byte, error) {
+	ns := fmt.Sprintf("https://spdx.org/spdxdocs/melange/%s-%s-%s", spec.PackageName, spec.PackageVersion, contentDigest(spec, contents))
+	agentID := ns + "#melange"
+	pkgID := ns + "#SPDXRef-Package-" + spdxIDString(spec.PackageName)
+
+	element := func(typ, id string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":         typ,
+			"spdxId":       id,
+			"creationInfo": spdx3CreationInfo,
+		}
+	}
+
+	pkg := element("software_Package", pkgID)
+	pkg["name"] = spec.PackageName
+	pkg["software_packageVersion"] = spec.PackageVersion
+	pkg["software_packageUrl"] = spec.purl()
+	if len(spec.CPEs) > 0 {
+		identifiers := []map[string]interface{}{}
+		for _, cpe := range spec.CPEs {
+			identifiers = append(identifiers, map[string]interface{}{
+				"type":                   "ExternalIdentifier",
+				"externalIdentifierType": "cpe23",
+				"identifier":             cpe,
+			})
+		}
+		pkg["externalIdentifier"] = identifiers
+	}
+	if spec.Copyright != "" {
+		pkg["software_copyrightText"] = spec.Copyright
+	}
+
+	agent := element("SoftwareAgent", agentID)
+	agent["name"] = "melange"
+
+	graph := []map[string]interface{}{{
+		"type":        "CreationInfo",
+		"@id":         spdx3CreationInfo,
+		"specVersion": "3.0.1",
+		"created":     spec.created(),
+		"createdBy":   []string{agentID},
+	}, agent, pkg}
+	elements := []string{agentID, pkgID}
+
+	// the supplier and originator are Organization or Person
+	// elements.
+	agents := map[string]string{}
+	agentElement := func(value string) string {
+		if id, ok := agents[value]; ok {
+			return id
+		}
+		kind, _, _ := parseAgent(value)
+		id := fmt.Sprintf("%s#SPDXRef-Agent-%d", ns, len(agents))
+		e := element(kind, id)
+		e["name"] = agentName(value)
+		graph = append(graph, e)
+		elements = append(elements, id)
+		agents[value] = id
+		return id
+	}
+
+	if spec.Supplier != "" {
+		pkg["suppliedBy"] = agentElement(spec.Supplier)
+		// the supplier is the author of the SBOM, which melange
+		// creates on its behalf.
+		graph[0]["createdBy"] = []string{agentID, agentElement(spec.Supplier)}
+	}
+	if spec.Originator != "" {
+		pkg["originatedBy"] = []string{agentElement(spec.Originator)}
+	}
+
+	annotations := []string{}
+	if d := spec.Deprecation; d != nil {
+		if !d.EndOfLife.IsZero() {
+			pkg["validUntilTime"] = d.EndOfLife.UTC().Format(time.RFC3339)
+		}
+		a := element("Annotation", ns+"#SPDXRef-Annotation-Deprecation")
+		a["annotationType"] = "other"
+		a["subject"] = pkgID
+		a["statement"] = d.comment()
+		graph = append(graph, a)
+		annotations = append(annotations, a["spdxId"].(string))
+	}
+	for i, f := range spec.Provenance.facts() {
+		a := element("Annotation", fmt.Sprintf("%s#SPDXRef-Annotation-Provenance-%d", ns, i))
+		a["annotationType"] = "other"
+		a["subject"] = pkgID
+		a["statement"] = f.comment()
+		graph = append(graph, a)
+		annotations = append(annotations, a["spdxId"].(string))
+	}
+
+	contained := []string{}
+	for i, f := range contents.files {
+		id := fmt.Sprintf("%s#SPDXRef-File-%d", ns, i)
+		e := element("software_File", id)
+		e["name"] = "/" + f.path
+		hashes := []map[string]string{}
+		for _, c := range f.checksums() {
+			hashes = append(hashes, map[string]string{"type": "Hash", "algorithm": c.algorithm.spdx3, "hashValue": c.value})
+		}
+		e["verifiedUsing"] = hashes
+		if f.link != "" {
+			e["comment"] = f.comment()
+		}
+		purposes := []string{}
+		for _, t := range f.types {
+			if p, ok := spdx3Purposes[t]; ok {
+				purposes = append(purposes, p)
+			}
+		}
+		if len(purposes) > 0 {
+			e["software_primaryPurpose"] = purposes[0]
+		}
+		if len(purposes) > 1 {
+			e["software_additionalPurpose"] = purposes[1:]
+		}
+		graph = append(graph, e)
+		contained = append(contained, id)
+
+		if step := spec.stepAnnotation(&f); step != "" {
+			a := element("Annotation", fmt.Sprintf("%s#SPDXRef-Annotation-File-%d", ns, i))
+			a["annotationType"] = "other"
+			a["subject"] = id
+			a["statement"] = step
+			graph = append(graph, a)
+			annotations = append(annotations, a["spdxId"].(string))
+		}
+	}
+
+	componentIDs := map[string]string{}
+	for i, m := range contents.components {
+		id := fmt.Sprintf("%s#SPDXRef-Component-%d", ns, i)
+		componentIDs[m.purl] = id
+		e := element("software_Package", id)
+		e["name"] = m.name
+		e["software_packageVersion"] = m.version
+		e["software_packageUrl"] = m.purl
+		if spec.Supplier != "" {
+			e["suppliedBy"] = agentElement(spec.Supplier)
+		}
+		graph = append(graph, e)
+		contained = append(contained, id)
+	}
+
+	elements = append(elements, annotations...)
+	if len(contained) > 0 {
+		elements = append(elements, contained...)
+
+		contains := element("Relationship", ns+"#SPDXRef-Relationship-contains")
+		contains["from"] = pkgID
+		contains["to"] = contained
+		contains["relationshipType"] = "contains"
+		graph = append(graph, contains)
+		elements = append(elements, ns+"#SPDXRef-Relationship-contains")
+	}
+
+	// the programs depend on the components linked into them.
+	for i, f := range contents.files {
+		purls := contents.dependencies[f.path]
+		if len(purls) == 0 {
+			continue
+		}
+
+		to := []string{}
+		for _, purl := range purls {
+			to = append(to, componentIDs[purl])
+		}
+		id := fmt.Sprintf("%s#SPDXRef-Relationship-File-%d-dependsOn", ns, i)
+		dependsOn := element("Relationship", id)
+		dependsOn["from"] = fmt.Sprintf("%s#SPDXRef-File-%d", ns, i)
+		dependsOn["to"] = to
+		dependsOn["relationshipType"] = "dependsOn"
+		graph = append(graph, dependsOn)
+		elements = append(elements, id)
+	}
+
+	sources := []string{}
+	for i, s := range spec.Sources {
+		id := fmt.Sprintf("%s#SPDXRef-Source-%d", ns, i)
+		e := element("software_Package", id)
+		e["name"] = s.name()
+		e["software_downloadLocation"] = s.downloadLocation()
+		if s.Commit != "" {
+			e["software_packageVersion"] = s.Commit
+		}
+		if s.SHA256 != "" {
+			e["verifiedUsing"] = []map[string]string{{"type": "Hash", "algorithm": lookupChecksumAlgorithm(ChecksumSHA256).spdx3, "hashValue": s.SHA256}}
+		}
+		if spec.Originator != "" {
+			e["originatedBy"] = []string{agentElement(spec.Originator)}
+		}
+		graph = append(graph, e)
+		sources = append(sources, id)
+	}
+
+	if len(sources) > 0 {
+		elements = append(elements, sources...)
+
+		generated := element("Relationship", ns+"#SPDXRef-Relationship-generated-from")
+		generated["from"] = pkgID
+		generated["to"] = sources
+		generated["relationshipType"] = "generatedFrom"
+		graph = append(graph, generated)
+		elements = append(elements, ns+"#SPDXRef-Relationship-generated-from")
+	}
+
+	if spec.License != "" {
+		licenseID := ns + "#SPDXRef-License"
+		license := element("simplelicensing_LicenseExpression", licenseID)
+		license["simplelicensing_licenseExpression"] = spec.License
+
+		// the custom licenses of the expression are mapped to
+		// their texts.
+		if len(spec.ExtractedLicenses) > 0 {
+			customIDs := []map[string]string{}
+			for i, l := range spec.ExtractedLicenses {
+				textID := fmt.Sprintf("%s#SPDXRef-LicenseText-%d", ns, i)
+				text := element("simplelicensing_SimpleLicensingText", textID)
+				text["simplelicensing_licenseText"] = l.Text
+				graph = append(graph, text)
+				elements = append(elements, textID)
+				customIDs = append(customIDs, map[string]string{"type": "DictionaryEntry", "key": l.ID, "value": textID})
+			}
+			license["simplelicensing_customIdToUri"] = customIDs
+		}
+
+		declared := element("Relationship", ns+"#SPDXRef-Relationship-declared-license")
+		declared["from"] = pkgID
+		declared["to"] = []string{licenseID}
+		declared["relationshipType"] = "hasDeclaredLicense"
+
+		graph = append(graph, license, declared)
+		elements = append(elements, licenseID, ns+"#SPDXRef-Relationship-declared-license")
+	}
+
+	doc := element("SpdxDocument", ns+"#SPDXRef-DOCUMENT")
+	doc["name"] = fmt.Sprintf("%s-%s", spec.PackageName, spec.PackageVersion)
+	doc["profileConformance"] = []string{"core", "software", "simpleLicensing"}
+	doc["rootElement"] = []string{pkgID}
+	doc["element"] = elements
+	graph = append(graph, doc)
+
+	return json.MarshalIndent(spdx3Document{Context: spdx3Context, Graph: graph}, "", "  ")
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// Encode writes the SPDX JSON document of a package, as indented by
+// json.MarshalIndent, without holding it in memory: its files and their
+// relationships are written one at a time, so that the memory used for
+// packages with hundreds of thousands of files, such as texlive or
+// linux-firmware, is bounded by the size of the largest element.
+func (*spdx) Encode(w io.Writer, spec *Spec, contents *packageContents) error {
+	doc := newSPDXSkeleton(spec, contents)
+	jw := &jsonStreamWriter{w: bufio.NewWriter(w)}
+
+	jw.WriteString("{")
+	jw.field("spdxVersion", doc.SPDXVersion)
+	jw.field("dataLicense", doc.DataLicense)
+	jw.field("SPDXID", doc.SPDXID)
+	jw.field("name", doc.Name)
+	jw.field("documentNamespace", doc.DocumentNamespace)
+	jw.field("creationInfo", doc.CreationInfo)
+	jw.field("documentDescribes", doc.DocumentDescribes)
+	jw.field("packages", doc.Packages)
+
+	if len(contents.files) > 0 {
+		jw.list("files", func(element func(v interface{})) {
+			for i := range contents.files {
+				element(spdxFileOf(spec, contents, i))
+			}
+		})
+	}
+
+	if len(contents.files) > 0 || len(doc.Relationships) > 0 {
+		jw.list("relationships", func(element func(v interface{})) {
+			for i := range contents.files {
+				element(spdxContainsFile(spec, i))
+			}
+			for _, r := range doc.Relationships {
+				element(r)
+			}
+		})
+	}
+
+	if len(doc.ExternalDocumentRefs) > 0 {
+		jw.field("externalDocumentRefs", doc.ExternalDocumentRefs)
+	}
+	if len(doc.ExtractedLicenses) > 0 {
+		jw.field("hasExtractedLicensingInfos", doc.ExtractedLicenses)
+	}
+	jw.WriteString("\n}")
+
+	if jw.err != nil {
+		return jw.err
+	}
+	return jw.w.Flush()
+}
+
+// jsonStreamWriter writes the fields of a JSON object one at a time, as
+// indented by json.MarshalIndent with an indent of two spaces.  The
+// first error is kept in err, and the following writes are skipped.
+type jsonStreamWriter struct {
+	w      *bufio.Writer
+	fields int
+	err    error
+}
+
+func (jw *jsonStreamWriter) WriteString(s string) {
+	if jw.err == nil {
+		_, jw.err = jw.w.WriteString(s)
+	}
+}
+
+// value writes a value indented at a depth.
+func (jw *jsonStreamWriter) value(v interface{}, prefix string) {
+	if jw.err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(v, prefix, "  ")
+	if err != nil {
+		jw.err = err
+		return
+	}
+	_, jw.err = jw.w.Write(data)
+}
+
+// key writes the key of the next field of the object.
+func (jw *jsonStreamWriter) key(name string) {
+	if jw.fields > 0 {
+		jw.WriteString(",")
+	}
+	jw.fields++
+	jw.WriteString("\n  ")
+	jw.value(name, "")
+	jw.WriteString(": ")
+}
+
+// field writes a field of the object.
+func (jw *jsonStreamWriter) field(name string, v interface{}) {
+	jw.key(name)
+	jw.value(v, "  ")
+}
+
+// list writes a field of the object whose value is a list of the
+// elements passed to element by elements.
+func (jw *jsonStreamWriter) list(name string, elements func(element func(v interface{}))) {
+	jw.key(name)
+	jw.WriteString("[")
+
+	n := 0
+	elements(func(v interface{}) {
+		if n > 0 {
+			jw.WriteString(",")
+		}
+		n++
+		jw.WriteString("\n    ")
+		jw.value(v, "    ")
+	})
+
+	if n > 0 {
+		jw.WriteString("\n  ")
+	}
+	jw.WriteString("]")
+}
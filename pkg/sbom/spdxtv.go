@@ -0,0 +1,151 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// spdxTagValue writes the SPDX documents of spdx in the tag-value format.
+type spdxTagValue struct{}
+
+func (*spdxTagValue) Ext() string {
+	return "spdx"
+}
+
+func (*spdxTagValue) Generate(spec *Spec, contents *packageContents) ([]byte, error) {
+	return newSPDXDocument(spec, contents).tagValue(), nil
+}
+
+// tagValueWriter writes the tags of a tag-value document.
+type tagValueWriter struct {
+	bytes.Buffer
+}
+
+// tag writes a tag, unless its value is empty.
+func (w *tagValueWriter) tag(name, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s: %s\n", name, value)
+}
+
+// text writes a tag whose value is free-form text, which is wrapped in
+// <text> when it spans several lines.
+func (w *tagValueWriter) text(name, value string) {
+	if strings.Contains(value, "\n") {
+		value = "<text>" + value + "</text>"
+	}
+	w.tag(name, value)
+}
+
+// annotations writes the annotations of an element.
+func (w *tagValueWriter) annotations(id string, annotations []spdxAnnotation) {
+	for _, a := range annotations {
+		w.tag("Annotator", a.Annotator)
+		w.tag("AnnotationDate", a.AnnotationDate)
+		w.tag("AnnotationType", a.AnnotationType)
+		w.tag("SPDXREF", id)
+		w.text("AnnotationComment", a.Comment)
+	}
+}
+
+// tagValue returns the document in the tag-value format.  The files are
+// written after the package which contains them, so that tools which
+// ignore the relationships associate them with it.
+func (doc *spdxDocument) tagValue() []byte {
+	w := &tagValueWriter{}
+
+	w.tag("SPDXVersion", doc.SPDXVersion)
+	w.tag("DataLicense", doc.DataLicense)
+	w.tag("SPDXID", doc.SPDXID)
+	w.tag("DocumentName", doc.Name)
+	w.tag("DocumentNamespace", doc.DocumentNamespace)
+	for _, r := range doc.ExternalDocumentRefs {
+		w.tag("ExternalDocumentRef", fmt.Sprintf("%s %s %s: %s", r.ExternalDocumentID, r.SPDXDocument, r.Checksum.Algorithm, r.Checksum.ChecksumValue))
+	}
+	for _, c := range doc.CreationInfo.Creators {
+		w.tag("Creator", c)
+	}
+	w.tag("Created", doc.CreationInfo.Created)
+	for _, id := range doc.DocumentDescribes {
+		w.tag("Relationship", doc.SPDXID+" DESCRIBES "+id)
+	}
+
+	for i, p := range doc.Packages {
+		w.WriteString("\n")
+		w.tag("PackageName", p.Name)
+		w.tag("SPDXID", p.SPDXID)
+		w.tag("PackageVersion", p.VersionInfo)
+		w.tag("PackageSupplier", p.Supplier)
+		w.tag("PackageOriginator", p.Originator)
+		w.tag("PackageDownloadLocation", p.DownloadLocation)
+		w.tag("FilesAnalyzed", fmt.Sprint(p.FilesAnalyzed))
+		for _, c := range p.Checksums {
+			w.tag("PackageChecksum", c.Algorithm+": "+c.ChecksumValue)
+		}
+		w.tag("PackageLicenseConcluded", p.LicenseConcluded)
+		for _, l := range p.LicenseInfoFromFiles {
+			w.tag("PackageLicenseInfoFromFiles", l)
+		}
+		w.tag("PackageLicenseDeclared", p.LicenseDeclared)
+		w.text("PackageCopyrightText", p.CopyrightText)
+		for _, r := range p.ExternalRefs {
+			w.tag("ExternalRef", strings.Join([]string{r.ReferenceCategory, r.ReferenceType, r.ReferenceLocator}, " "))
+		}
+		w.tag("ValidUntilDate", p.ValidUntilDate)
+		w.annotations(p.SPDXID, p.Annotations)
+
+		if i > 0 {
+			continue
+		}
+		for _, f := range doc.Files {
+			w.WriteString("\n")
+			w.tag("FileName", f.FileName)
+			w.tag("SPDXID", f.SPDXID)
+			for _, t := range f.FileTypes {
+				w.tag("FileType", t)
+			}
+			for _, c := range f.Checksums {
+				w.tag("FileChecksum", c.Algorithm+": "+c.ChecksumValue)
+			}
+			w.tag("LicenseConcluded", f.LicenseConcluded)
+			for _, l := range f.LicenseInfoInFiles {
+				w.tag("LicenseInfoInFile", l)
+			}
+			w.text("FileCopyrightText", f.CopyrightText)
+			w.text("FileComment", f.Comment)
+			w.annotations(f.SPDXID, f.Annotations)
+		}
+	}
+
+	if len(doc.Relationships) > 0 {
+		w.WriteString("\n")
+	}
+	for _, r := range doc.Relationships {
+		w.tag("Relationship", strings.Join([]string{r.Element, r.Type, r.Related}, " "))
+	}
+
+	for _, l := range doc.ExtractedLicenses {
+		w.WriteString("\n")
+		w.tag("LicenseID", l.LicenseID)
+		w.tag("ExtractedText", "<text>"+l.ExtractedText+"</text>")
+		w.tag("LicenseName", l.Name)
+	}
+
+	return w.Bytes()
+}
@@ -0,0 +1,307 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// spdxIDPattern is the pattern of the identifiers of the elements of an
+// SPDX 2.3 document.
+var spdxIDPattern = regexp.MustCompile(`^SPDXRef-[A-Za-z0-9.-]+$`)
+
+// spdxChecksumAlgorithms are the checksum algorithms of the SPDX 2.3
+// schema.
+var spdxChecksumAlgorithms = map[string]bool{
+	"SHA1": true, "SHA224": true, "SHA256": true, "SHA384": true, "SHA512": true,
+	"SHA3-256": true, "SHA3-384": true, "SHA3-512": true,
+	"BLAKE2b-256": true, "BLAKE2b-384": true, "BLAKE2b-512": true, "BLAKE3": true,
+	"MD2": true, "MD4": true, "MD5": true, "MD6": true, "ADLER32": true,
+}
+
+// spdxRelationshipTypes are the relationship types of the SPDX 2.3
+// schema.
+var spdxRelationshipTypes = map[string]bool{}
+
+func init() {
+	for _, t := range strings.Fields(`AMENDS ANCESTOR_OF BUILD_DEPENDENCY_OF BUILD_TOOL_OF
+		CONTAINED_BY CONTAINS COPY_OF DATA_FILE_OF DEPENDENCY_MANIFEST_OF
+		DEPENDENCY_OF DEPENDS_ON DESCENDANT_OF DESCRIBED_BY DESCRIBES
+		DEV_DEPENDENCY_OF DEV_TOOL_OF DISTRIBUTION_ARTIFACT DOCUMENTATION_OF
+		DYNAMIC_LINK EXAMPLE_OF EXPANDED_FROM_ARCHIVE FILE_ADDED FILE_DELETED
+		FILE_MODIFIED GENERATED_FROM GENERATES HAS_PREREQUISITE METAFILE_OF
+		OPTIONAL_COMPONENT_OF OPTIONAL_DEPENDENCY_OF OTHER PACKAGE_OF
+		PATCH_APPLIED PATCH_FOR PREREQUISITE_FOR PROVIDED_DEPENDENCY_OF
+		REQUIREMENT_DESCRIPTION_FOR RUNTIME_DEPENDENCY_OF SPECIFICATION_FOR
+		STATIC_LINK TEST_CASE_OF TEST_DEPENDENCY_OF TEST_OF TEST_TOOL_OF
+		VARIANT_OF`) {
+		spdxRelationshipTypes[t] = true
+	}
+}
+
+// spdxProblems collects the problems found in a document.
+type spdxProblems []string
+
+func (p *spdxProblems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// required adds a problem for each of the required properties of an
+// element which is empty.
+func (p *spdxProblems) required(element string, properties ...string) {
+	for i := 0; i < len(properties); i += 2 {
+		if properties[i+1] == "" {
+			p.add("%s: %s is missing", element, properties[i])
+		}
+	}
+}
+
+// checksums adds the problems of the checksums of an element.
+func (p *spdxProblems) checksums(element string, sums []spdxChecksum) {
+	for _, c := range sums {
+		if !spdxChecksumAlgorithms[c.Algorithm] {
+			p.add("%s: unknown checksum algorithm %q", element, c.Algorithm)
+		}
+		if c.ChecksumValue == "" || strings.Trim(strings.ToLower(c.ChecksumValue), "0123456789abcdef") != "" {
+			p.add("%s: %s checksum %q is not hexadecimal", element, c.Algorithm, c.ChecksumValue)
+		}
+	}
+}
+
+// ValidateSPDX returns the problems of an SPDX 2.3 JSON document: the
+// properties which the SPDX 2.3 schema requires and are missing, the
+// values which are not among the ones the schema allows, such as the
+// checksum algorithms and relationship types, and the identifiers which
+// the relationships and the described elements reference but no element
+// of the document, or of a declared external document, has.
+func ValidateSPDX(data []byte) ([]string, error) {
+	var doc spdxDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse SPDX document: %w", err)
+	}
+
+	problems := spdxProblems{}
+	problems.required("document",
+		"spdxVersion", doc.SPDXVersion,
+		"dataLicense", doc.DataLicense,
+		"SPDXID", doc.SPDXID,
+		"name", doc.Name,
+		"documentNamespace", doc.DocumentNamespace,
+		"creationInfo.created", doc.CreationInfo.Created)
+	if doc.SPDXVersion != "" && doc.SPDXVersion != "SPDX-2.3" {
+		problems.add("document: spdxVersion is %s, not SPDX-2.3", doc.SPDXVersion)
+	}
+	if doc.DataLicense != "" && doc.DataLicense != "CC0-1.0" {
+		problems.add("document: dataLicense is %s, not CC0-1.0", doc.DataLicense)
+	}
+	if doc.SPDXID != "" && doc.SPDXID != "SPDXRef-DOCUMENT" {
+		problems.add("document: SPDXID is %s, not SPDXRef-DOCUMENT", doc.SPDXID)
+	}
+	if doc.CreationInfo.Created != "" {
+		if _, err := time.Parse(time.RFC3339, doc.CreationInfo.Created); err != nil {
+			problems.add("document: creationInfo.created %q is not a date and time", doc.CreationInfo.Created)
+		}
+	}
+	if len(doc.CreationInfo.Creators) == 0 {
+		problems.add("document: creationInfo.creators is empty")
+	}
+	for _, creator := range doc.CreationInfo.Creators {
+		if !strings.HasPrefix(creator, "Person:") && !strings.HasPrefix(creator, "Organization:") && !strings.HasPrefix(creator, "Tool:") {
+			problems.add("document: creator %q is not a person, organization or tool", creator)
+		}
+	}
+
+	// ids are the identifiers of the elements of the document.
+	ids := map[string]bool{doc.SPDXID: true}
+	define := func(element, id string) {
+		switch {
+		case id == "":
+			return
+		case !spdxIDPattern.MatchString(id):
+			problems.add("%s: SPDXID %q is not a valid identifier", element, id)
+		case ids[id]:
+			problems.add("%s: SPDXID %s is used more than once", element, id)
+		}
+		ids[id] = true
+	}
+
+	externalDocs := map[string]bool{}
+	for i, ref := range doc.ExternalDocumentRefs {
+		element := fmt.Sprintf("external document reference %d", i)
+		problems.required(element, "externalDocumentId", ref.ExternalDocumentID, "spdxDocument", ref.SPDXDocument, "checksum", ref.Checksum.Algorithm)
+		if ref.Checksum.Algorithm != "" {
+			problems.checksums(element, []spdxChecksum{ref.Checksum})
+		}
+		externalDocs[ref.ExternalDocumentID] = true
+	}
+
+	for i, p := range doc.Packages {
+		element := fmt.Sprintf("package %d", i)
+		if p.SPDXID != "" {
+			element = "package " + p.SPDXID
+		}
+		problems.required(element, "SPDXID", p.SPDXID, "name", p.Name, "downloadLocation", p.DownloadLocation)
+		define(element, p.SPDXID)
+		problems.checksums(element, p.Checksums)
+		for _, ref := range p.ExternalRefs {
+			problems.required(element+": external reference", "referenceCategory", ref.ReferenceCategory, "referenceType", ref.ReferenceType, "referenceLocator", ref.ReferenceLocator)
+			switch ref.ReferenceCategory {
+			case "", "OTHER", "PERSISTENT-ID", "PERSISTENT_ID", "SECURITY", "PACKAGE-MANAGER", "PACKAGE_MANAGER":
+			default:
+				problems.add("%s: unknown external reference category %q", element, ref.ReferenceCategory)
+			}
+		}
+		problems.annotations(element, p.Annotations)
+	}
+
+	for i, f := range doc.Files {
+		element := fmt.Sprintf("file %d", i)
+		if f.FileName != "" {
+			element = "file " + f.FileName
+		}
+		problems.required(element, "SPDXID", f.SPDXID, "fileName", f.FileName)
+		define(element, f.SPDXID)
+		problems.checksums(element, f.Checksums)
+
+		sha1 := false
+		for _, c := range f.Checksums {
+			sha1 = sha1 || c.Algorithm == "SHA1"
+		}
+		if !sha1 {
+			problems.add("%s: no SHA1 checksum", element)
+		}
+		problems.annotations(element, f.Annotations)
+	}
+
+	for _, l := range doc.ExtractedLicenses {
+		problems.required("extracted license "+l.LicenseID, "licenseId", l.LicenseID, "extractedText", l.ExtractedText)
+	}
+
+	// references are checked once every element is defined.
+	referenced := func(id string) bool {
+		if ref, _, ok := strings.Cut(id, ":"); ok && strings.HasPrefix(ref, "DocumentRef-") {
+			return externalDocs[ref]
+		}
+		return ids[id]
+	}
+	for _, id := range doc.DocumentDescribes {
+		if !referenced(id) {
+			problems.add("document: describes %s, which is not an element of the document", id)
+		}
+	}
+	for _, r := range doc.Relationships {
+		element := fmt.Sprintf("relationship %s %s %s", r.Element, r.Type, r.Related)
+		problems.required(element, "spdxElementId", r.Element, "relationshipType", r.Type, "relatedSpdxElement", r.Related)
+		if r.Type != "" && !spdxRelationshipTypes[r.Type] {
+			problems.add("%s: unknown relationship type", element)
+		}
+		if r.Element != "" && !referenced(r.Element) {
+			problems.add("%s: %s is not an element of the document", element, r.Element)
+		}
+		if r.Related != "" && r.Related != "NONE" && r.Related != "NOASSERTION" && !referenced(r.Related) {
+			problems.add("%s: %s is not an element of the document", element, r.Related)
+		}
+	}
+
+	return problems, nil
+}
+
+// annotations adds the problems of the annotations of an element.
+func (p *spdxProblems) annotations(element string, annotations []spdxAnnotation) {
+	for _, a := range annotations {
+		p.required(element+": annotation", "annotationDate", a.AnnotationDate, "annotationType", a.AnnotationType, "annotator", a.Annotator, "comment", a.Comment)
+		if a.AnnotationType != "" && a.AnnotationType != "OTHER" && a.AnnotationType != "REVIEW" {
+			p.add("%s: unknown annotation type %q", element, a.AnnotationType)
+		}
+	}
+}
+
+// VerifySPDXChecksums returns the files of an SPDX 2.3 JSON document
+// whose checksums do not match the files installed in root, such as the
+// extracted contents of the package the document describes, and the
+// files which are missing from root.  The checksums of the symbolic
+// links are the ones of their targets, as melange computes them.
+func VerifySPDXChecksums(data []byte, root string) ([]string, error) {
+	var doc spdxDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse SPDX document: %w", err)
+	}
+
+	problems := []string{}
+	for _, sf := range doc.Files {
+		algorithms := []string{}
+		want := map[string]string{}
+		for _, c := range sf.Checksums {
+			for _, a := range checksumAlgorithms {
+				if a.spdx == c.Algorithm {
+					algorithms = append(algorithms, a.name)
+					want[a.name] = strings.ToLower(c.ChecksumValue)
+				}
+			}
+		}
+		if len(algorithms) == 0 {
+			continue
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(sf.FileName, "/")))
+		fi, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			problems = append(problems, fmt.Sprintf("file %s: not in the package", sf.FileName))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var f file
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return nil, err
+			}
+			f = hashLink(target, algorithms)
+		case fi.Mode().IsRegular():
+			if f, err = hashFile(path, algorithms); err != nil {
+				return nil, err
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("file %s: not a regular file or a symbolic link in the package", sf.FileName))
+			continue
+		}
+
+		mismatched := []string{}
+		for _, name := range algorithms {
+			if f.digests[name] != want[name] {
+				mismatched = append(mismatched, lookupChecksumAlgorithm(name).spdx)
+			}
+		}
+		if len(mismatched) > 0 {
+			sort.Strings(mismatched)
+			problems = append(problems, fmt.Sprintf("file %s: %s checksum does not match the package", sf.FileName, strings.Join(mismatched, ", ")))
+		}
+	}
+
+	return problems, nil
+}
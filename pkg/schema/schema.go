@@ -0,0 +1,107 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema embeds the JSON schemas of the machine-readable outputs
+// of melange, so that the tools consuming them can code against a stable
+// contract.
+//
+// Every schema is named after its output and versioned, such as
+// scan-report/v1, and its $id is BaseURL followed by its name.  The
+// outputs which are objects record the $id of their schema in their
+// "schema" property.
+//
+// Within a version, a schema only changes compatibly: optional
+// properties are added, and descriptions clarified.  Removing or
+// renaming a property, changing its type or meaning, or making it
+// required is a new version, whose schema is added next to the previous
+// ones, so that consumers can tell which version an output follows.
+package schema
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BaseURL prefixes the names of the schemas to make their $id.
+const BaseURL = "https://melange.chainguard.dev/schemas/"
+
+// The $id of the current versions of the schemas.
+const (
+	// PackageInfo describes a package printed by melange info.
+	PackageInfo = BaseURL + "package-info/v1"
+	// ScanReport is the vulnerability report of melange scan.
+	ScanReport = BaseURL + "scan-report/v1"
+	// DependencyExplanation is the explanation of the dependencies of
+	// a package of melange why.
+	DependencyExplanation = BaseURL + "dependency-explanation/v1"
+	// SBOMAttestation is the signed in-toto attestation of the SPDX
+	// SBOM of a package.
+	SBOMAttestation = BaseURL + "sbom-attestation/v1"
+)
+
+// files holds the schemas, named after their name with a - instead of
+// the /, e.g. scan-report-v1.json.
+//
+//go:embed *.json
+var files embed.FS
+
+// Names returns the names of the schemas, such as scan-report/v1, in
+// order.
+func Names() []string {
+	entries, _ := fs.ReadDir(files, ".")
+
+	names := []string{}
+	for _, e := range entries {
+		base := strings.TrimSuffix(e.Name(), ".json")
+		i := strings.LastIndex(base, "-v")
+		names = append(names, base[:i]+"/"+base[i+1:])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns a schema by name, or its $id.  The latest version is
+// returned when the name has no version.
+func Get(name string) ([]byte, error) {
+	name = strings.TrimPrefix(name, BaseURL)
+
+	if !strings.Contains(name, "/") {
+		latest := ""
+		for _, n := range Names() {
+			if strings.HasPrefix(n, name+"/v") && (latest == "" || versionOf(n) > versionOf(latest)) {
+				latest = n
+			}
+		}
+		if latest == "" {
+			return nil, fmt.Errorf("unknown schema %q, must be one of %s", name, strings.Join(Names(), ", "))
+		}
+		name = latest
+	}
+
+	data, err := files.ReadFile(strings.Replace(name, "/", "-", 1) + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("unknown schema %q, must be one of %s", name, strings.Join(Names(), ", "))
+	}
+	return data, nil
+}
+
+// versionOf returns the version number of a schema name.
+func versionOf(name string) int {
+	v, _ := strconv.Atoi(name[strings.LastIndex(name, "/v")+2:])
+	return v
+}
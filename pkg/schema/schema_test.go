@@ -0,0 +1,83 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSchemas(t *testing.T) {
+	names := Names()
+	if len(names) == 0 {
+		t.Fatal("Names() returned no schemas")
+	}
+
+	for _, name := range names {
+		data, err := Get(name)
+		if err != nil {
+			t.Errorf("Get(%q): %v", name, err)
+			continue
+		}
+
+		var s struct {
+			ID string `json:"$id"`
+		}
+		if err := json.Unmarshal(data, &s); err != nil {
+			t.Errorf("schema %s is not valid JSON: %v", name, err)
+		} else if s.ID != BaseURL+name {
+			t.Errorf("schema %s has $id %q, want %q", name, s.ID, BaseURL+name)
+		}
+	}
+
+	for _, id := range []string{PackageInfo, ScanReport, DependencyExplanation, SBOMAttestation} {
+		if _, err := Get(id); err != nil {
+			t.Errorf("Get(%q): %v", id, err)
+		}
+	}
+
+	latest, err := Get("scan-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(latest), ScanReport) {
+		t.Error("Get() did not return the latest version of an unversioned name")
+	}
+
+	for _, name := range []string{"build-report", "scan-report/v0"} {
+		if _, err := Get(name); err == nil {
+			t.Errorf("Get(%q) succeeded", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := `{"schema": "` + ScanReport + `", "packages": [{"file": "hello-2.12-r0.apk", "name": "hello", "version": "2.12-r0", "findings": [{"component": "pkg:generic/zlib@1.2", "id": "CVE-2022-37434", "new": true}], "extra": 1}]}`
+	if err := Validate("scan-report/v1", []byte(valid)); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	for _, doc := range []string{
+		`{"packages": []}`,
+		`{"schema": "` + ScanReport + `", "packages": {}}`,
+		`{"schema": "` + ScanReport + `", "packages": [{"file": "hello-2.12-r0.apk", "name": "hello", "version": "2.12-r0", "findings": [{"id": 42}]}]}`,
+		`{"schema": "` + PackageInfo + `", "packages": []}`,
+	} {
+		if err := Validate("scan-report/v1", []byte(doc)); err == nil {
+			t.Errorf("Validate() accepted %s", doc)
+		}
+	}
+}
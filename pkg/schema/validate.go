@@ -0,0 +1,147 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Validate checks a JSON document against a schema, given by name like
+// for Get.  Only the keywords the schemas of melange use are checked:
+// type, const, enum, required, properties, additionalProperties, items,
+// minItems and minimum.  Properties the schema does not describe are
+// allowed, as later compatible versions may add them.
+func Validate(name string, data []byte) error {
+	s, err := Get(name)
+	if err != nil {
+		return err
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(s, &schema); err != nil {
+		return fmt.Errorf("unable to parse schema %s: %w", name, err)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("unable to parse document: %w", err)
+	}
+
+	problems := validate("", schema, doc)
+	if len(problems) > 0 {
+		return fmt.Errorf("document does not match schema %s:\n  %s", name, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// validate returns the problems of a value at a location of the
+// document.
+func validate(at string, schema map[string]interface{}, value interface{}) []string {
+	where := at
+	if where == "" {
+		where = "document"
+	}
+
+	if want, ok := schema["const"]; ok && !reflect.DeepEqual(value, want) {
+		return []string{fmt.Sprintf("%s must be %v", where, want)}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, want := range enum {
+			found = found || reflect.DeepEqual(value, want)
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s must be one of %v", where, enum)}
+		}
+	}
+	if t, ok := schema["type"].(string); ok && !hasType(value, t) {
+		return []string{fmt.Sprintf("%s must be of type %s", where, t)}
+	}
+
+	problems := []string{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := v[r.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s is missing %s", where, r))
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if p, ok := properties[key].(map[string]interface{}); ok {
+				problems = append(problems, validate(at+"."+key, p, v[key])...)
+			} else if additional != nil {
+				problems = append(problems, validate(at+"."+key, additional, v[key])...)
+			}
+		}
+
+	case []interface{}:
+		if min, ok := schema["minItems"].(float64); ok && float64(len(v)) < min {
+			problems = append(problems, fmt.Sprintf("%s must have at least %v items", where, min))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				problems = append(problems, validate(fmt.Sprintf("%s[%d]", at, i), items, item)...)
+			}
+		}
+
+	case float64:
+		if min, ok := schema["minimum"].(float64); ok && v < min {
+			problems = append(problems, fmt.Sprintf("%s must be at least %v", where, min))
+		}
+	}
+
+	return problems
+}
+
+// hasType reports whether a decoded JSON value has a JSON schema type.
+func hasType(value interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "null":
+		return value == nil
+	}
+	return false
+}
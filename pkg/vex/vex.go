@@ -0,0 +1,247 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vex generates OpenVEX documents stating how the vulnerabilities
+// of the components of the packages built by melange affect them.
+package vex
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The statuses of a vulnerability in OpenVEX.
+const (
+	StatusNotAffected        = "not_affected"
+	StatusAffected           = "affected"
+	StatusFixed              = "fixed"
+	StatusUnderInvestigation = "under_investigation"
+)
+
+// Justifications are the reasons a package is not affected by a
+// vulnerability.
+var Justifications = []string{
+	"component_not_present",
+	"vulnerable_code_not_present",
+	"vulnerable_code_not_in_execute_path",
+	"vulnerable_code_cannot_be_controlled_by_adversary",
+	"inline_mitigations_already_exist",
+}
+
+// openVEXContext is the JSON-LD context of OpenVEX documents.
+const openVEXContext = "https://openvex.dev/ns/v0.2.0"
+
+// Advisories maps vulnerability identifiers, such as CVE-2023-1234, to
+// the advisories about them, in the order they were made.
+type Advisories map[string][]Advisory
+
+// Advisory states how a vulnerability affects a package.
+type Advisory struct {
+	// Timestamp is when the advisory was made.
+	Timestamp time.Time `yaml:"timestamp"`
+	// Status is one of not_affected, affected, fixed or
+	// under_investigation.
+	Status string `yaml:"status"`
+	// Justification is why the package is not affected, one of
+	// Justifications.  A not_affected advisory needs a
+	// justification or an impact statement.
+	Justification string `yaml:"justification"`
+	// Impact explains why the package is not affected.
+	Impact string `yaml:"impact"`
+	// Action tells how to remediate an affected package, which it
+	// requires.
+	Action string `yaml:"action"`
+	// Components are the package URLs of the components of the
+	// package, such as bundled Go modules, which the vulnerability is
+	// about.  When empty, the advisory is about the package itself.
+	Components []string `yaml:"components"`
+}
+
+// Config is the document level information of the OpenVEX documents.
+type Config struct {
+	// Author is the author of the advisories, by default the
+	// supplier of the package.
+	Author string `yaml:"author"`
+	// Role is the role of the author, such as "Package Maintainer".
+	Role string `yaml:"role"`
+}
+
+// Validate checks the advisories.
+func (a Advisories) Validate() error {
+	for vuln, advisories := range a {
+		if vuln == "" {
+			return fmt.Errorf("advisory without a vulnerability identifier")
+		}
+
+		for _, adv := range advisories {
+			if err := adv.validate(); err != nil {
+				return fmt.Errorf("advisory of %s: %w", vuln, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (adv *Advisory) validate() error {
+	switch adv.Status {
+	case StatusNotAffected:
+		if adv.Justification == "" && adv.Impact == "" {
+			return fmt.Errorf("status %s requires a justification or an impact", adv.Status)
+		}
+	case StatusAffected:
+		if adv.Action == "" {
+			return fmt.Errorf("status %s requires an action", adv.Status)
+		}
+	case StatusFixed, StatusUnderInvestigation:
+	default:
+		return fmt.Errorf("unknown status %q, must be one of %s, %s, %s or %s", adv.Status, StatusNotAffected, StatusAffected, StatusFixed, StatusUnderInvestigation)
+	}
+
+	if adv.Justification != "" {
+		if adv.Status != StatusNotAffected {
+			return fmt.Errorf("only the status %s has a justification", StatusNotAffected)
+		}
+		if !isJustification(adv.Justification) {
+			return fmt.Errorf("unknown justification %q", adv.Justification)
+		}
+	}
+
+	return nil
+}
+
+func isJustification(s string) bool {
+	for _, j := range Justifications {
+		if s == j {
+			return true
+		}
+	}
+	return false
+}
+
+// Spec describes the OpenVEX document of a package.
+type Spec struct {
+	// PackageURL identifies the package, which is the product of the
+	// statements.
+	PackageURL string
+	Config     Config
+	Advisories Advisories
+	// Timestamp is the creation time of the document.  When zero, the
+	// current time is used.
+	Timestamp time.Time
+}
+
+type document struct {
+	Context    string      `json:"@context"`
+	ID         string      `json:"@id"`
+	Author     string      `json:"author"`
+	Role       string      `json:"role,omitempty"`
+	Timestamp  string      `json:"timestamp"`
+	Version    int         `json:"version"`
+	Tooling    string      `json:"tooling"`
+	Statements []statement `json:"statements"`
+}
+
+type statement struct {
+	Vulnerability   vulnerability `json:"vulnerability"`
+	Timestamp       string        `json:"timestamp,omitempty"`
+	Products        []product     `json:"products"`
+	Status          string        `json:"status"`
+	Justification   string        `json:"justification,omitempty"`
+	ImpactStatement string        `json:"impact_statement,omitempty"`
+	ActionStatement string        `json:"action_statement,omitempty"`
+}
+
+type vulnerability struct {
+	Name string `json:"name"`
+}
+
+type product struct {
+	ID            string      `json:"@id"`
+	Subcomponents []component `json:"subcomponents,omitempty"`
+}
+
+type component struct {
+	ID string `json:"@id"`
+}
+
+// Generate returns the OpenVEX document of a package, with a statement
+// for each of its advisories.  The statements of a vulnerability are in
+// the order of its advisories, so that the last one is its current
+// status.
+func Generate(spec *Spec) ([]byte, error) {
+	if err := spec.Advisories.Validate(); err != nil {
+		return nil, err
+	}
+
+	author := spec.Config.Author
+	if author == "" {
+		author = "Unknown Author"
+	}
+
+	t := spec.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	vulns := []string{}
+	for vuln := range spec.Advisories {
+		vulns = append(vulns, vuln)
+	}
+	sort.Strings(vulns)
+
+	statements := []statement{}
+	for _, vuln := range vulns {
+		for _, adv := range spec.Advisories[vuln] {
+			p := product{ID: spec.PackageURL}
+			for _, c := range adv.Components {
+				p.Subcomponents = append(p.Subcomponents, component{ID: c})
+			}
+
+			s := statement{
+				Vulnerability:   vulnerability{Name: vuln},
+				Products:        []product{p},
+				Status:          adv.Status,
+				Justification:   adv.Justification,
+				ImpactStatement: adv.Impact,
+				ActionStatement: adv.Action,
+			}
+			if !adv.Timestamp.IsZero() {
+				s.Timestamp = adv.Timestamp.UTC().Format(time.RFC3339)
+			}
+			statements = append(statements, s)
+		}
+	}
+
+	data, err := json.Marshal(statements)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := document{
+		Context:    openVEXContext,
+		ID:         fmt.Sprintf("https://openvex.dev/docs/melange/%x", sha256.Sum256(append([]byte(spec.PackageURL+"\n"), data...))),
+		Author:     author,
+		Role:       spec.Config.Role,
+		Timestamp:  t.UTC().Format(time.RFC3339),
+		Version:    1,
+		Tooling:    "melange",
+		Statements: statements,
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vex
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerate(t *testing.T) {
+	var advisories Advisories
+	if err := yaml.Unmarshal([]byte(`
+CVE-2023-0001:
+  - timestamp: 2023-01-02T03:04:05Z
+    status: under_investigation
+  - timestamp: 2023-01-03T03:04:05Z
+    status: not_affected
+    justification: vulnerable_code_not_in_execute_path
+    components:
+      - pkg:golang/golang.org/x/net@v0.1.0
+CVE-2022-0002:
+  - status: fixed
+`), &advisories); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Generate(&Spec{
+		PackageURL: "pkg:apk/hello@1.0-r0?arch=x86_64",
+		Config:     Config{Author: "Example, Inc.", Role: "Package Maintainer"},
+		Advisories: advisories,
+		Timestamp:  time.Unix(1660000000, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Context != openVEXContext || doc.Author != "Example, Inc." || doc.Timestamp != "2022-08-08T23:06:40Z" {
+		t.Errorf("document = %+v", doc)
+	}
+
+	if len(doc.Statements) != 3 {
+		t.Fatalf("statements = %+v, want 3", doc.Statements)
+	}
+	if s := doc.Statements[0]; s.Vulnerability.Name != "CVE-2022-0002" || s.Status != StatusFixed || s.Timestamp != "" {
+		t.Errorf("statement = %+v", s)
+	}
+	s := doc.Statements[2]
+	if s.Vulnerability.Name != "CVE-2023-0001" || s.Status != StatusNotAffected || s.Timestamp != "2023-01-03T03:04:05Z" {
+		t.Errorf("statement = %+v", s)
+	}
+	if p := s.Products[0]; p.ID != "pkg:apk/hello@1.0-r0?arch=x86_64" || len(p.Subcomponents) != 1 || p.Subcomponents[0].ID != "pkg:golang/golang.org/x/net@v0.1.0" {
+		t.Errorf("product = %+v", p)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, adv := range []Advisory{
+		{Status: "wontfix"},
+		{Status: StatusNotAffected},
+		{Status: StatusNotAffected, Justification: "not_my_problem"},
+		{Status: StatusAffected},
+		{Status: StatusFixed, Justification: "component_not_present"},
+	} {
+		if err := (Advisories{"CVE-2023-0001": {adv}}).Validate(); err == nil {
+			t.Errorf("advisory %+v was accepted", adv)
+		}
+	}
+
+	if err := (Advisories{"CVE-2023-0001": {{Status: StatusAffected, Action: "upgrade"}}}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vuln reports the known vulnerabilities of the components listed
+// in the SBOMs of the packages of a repository.
+package vuln
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultOSVURL is the location of the public OSV API.
+const DefaultOSVURL = "https://api.osv.dev"
+
+// osvBatchSize is the maximum number of queries of a batch request.
+const osvBatchSize = 1000
+
+// OSVClient queries an OSV database.
+type OSVClient struct {
+	URL    string
+	Client *http.Client
+}
+
+type osvQuery struct {
+	Package osvPackage `json:"package"`
+}
+
+type osvPackage struct {
+	PURL string `json:"purl"`
+}
+
+type osvBatchRequest struct {
+	Queries []osvQuery `json:"queries"`
+}
+
+type osvBatchResponse struct {
+	Results []osvResult `json:"results"`
+}
+
+type osvResult struct {
+	Vulns []osvVuln `json:"vulns"`
+}
+
+type osvVuln struct {
+	ID string `json:"id"`
+}
+
+// Query returns the identifiers of the vulnerabilities affecting each of
+// the given package URLs, in the same order.
+func (c *OSVClient) Query(purls []string) ([][]string, error) {
+	results := [][]string{}
+
+	for start := 0; start < len(purls); start += osvBatchSize {
+		end := start + osvBatchSize
+		if end > len(purls) {
+			end = len(purls)
+		}
+
+		batch, err := c.queryBatch(purls[start:end])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, batch...)
+	}
+
+	return results, nil
+}
+
+func (c *OSVClient) queryBatch(purls []string) ([][]string, error) {
+	req := osvBatchRequest{Queries: []osvQuery{}}
+	for _, purl := range purls {
+		req.Queries = append(req.Queries, osvQuery{Package: osvPackage{PURL: purl}})
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(strings.TrimSuffix(c.URL, "/")+"/v1/querybatch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("querying OSV: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("querying OSV: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var batch osvBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("decoding OSV response: %w", err)
+	}
+
+	if len(batch.Results) != len(purls) {
+		return nil, fmt.Errorf("OSV returned %d results for %d queries", len(batch.Results), len(purls))
+	}
+
+	results := [][]string{}
+	for _, result := range batch.Results {
+		ids := []string{}
+		for _, v := range result.Vulns {
+			ids = append(ids, v.ID)
+		}
+		results = append(results, ids)
+	}
+
+	return results, nil
+}
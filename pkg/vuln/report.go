@@ -0,0 +1,195 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vuln
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/schema"
+)
+
+// Report lists the vulnerabilities found in the packages of a repository.
+type Report struct {
+	// Schema identifies the schema of the report, see package
+	// schema.
+	Schema   string          `json:"schema"`
+	Packages []PackageReport `json:"packages"`
+}
+
+// PackageReport lists the vulnerabilities of the components of a package.
+type PackageReport struct {
+	File     string    `json:"file"`
+	Name     string    `json:"name"`
+	Version  string    `json:"version"`
+	Findings []Finding `json:"findings"`
+	// NoSBOM is set when the package does not contain an SBOM, so
+	// it could not be scanned.
+	NoSBOM bool `json:"no_sbom,omitempty"`
+}
+
+// Finding is a vulnerability of a component of a package.
+type Finding struct {
+	Component string `json:"component"`
+	ID        string `json:"id"`
+	// New is set when the finding is not in the baseline report.
+	New bool `json:"new,omitempty"`
+}
+
+// sbomComponents returns the package URLs of the components of an SPDX
+// 2, SPDX 3 JSON-LD or CycloneDX JSON document.
+func sbomComponents(data []byte) ([]string, error) {
+	var doc struct {
+		Packages []struct {
+			ExternalRefs []struct {
+				ReferenceType    string `json:"referenceType"`
+				ReferenceLocator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+		Components []struct {
+			PURL string `json:"purl"`
+		} `json:"components"`
+		Graph []struct {
+			PackageURL string `json:"software_packageUrl"`
+		} `json:"@graph"`
+	}
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	purls := []string{}
+	for _, p := range doc.Packages {
+		for _, ref := range p.ExternalRefs {
+			if ref.ReferenceType == "purl" {
+				purls = append(purls, ref.ReferenceLocator)
+			}
+		}
+	}
+	for _, c := range doc.Components {
+		if c.PURL != "" {
+			purls = append(purls, c.PURL)
+		}
+	}
+	for _, e := range doc.Graph {
+		if e.PackageURL != "" {
+			purls = append(purls, e.PackageURL)
+		}
+	}
+
+	return purls, nil
+}
+
+// ScanRepository reports the vulnerabilities of the components listed in
+// the SBOMs of the packages of a repository directory.
+func ScanRepository(dir string, client *OSVClient) (*Report, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	report := &Report{Schema: schema.ScanReport, Packages: []PackageReport{}}
+	// components maps the package URLs to query to the packages
+	// containing them.
+	components := map[string][]int{}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		pkg, err := apk.ReadPackage(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", path, err)
+		}
+
+		pr := PackageReport{
+			File:     filepath.Base(path),
+			Name:     pkg.Info.Get("pkgname"),
+			Version:  pkg.Info.Get("pkgver"),
+			Findings: []Finding{},
+			NoSBOM:   len(pkg.SBOMs) == 0,
+		}
+
+		for sbomPath, data := range pkg.SBOMs {
+			purls, err := sbomComponents(data)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse SBOM %s of %s: %w", sbomPath, path, err)
+			}
+			n := len(report.Packages)
+			for _, purl := range purls {
+				if pkgs := components[purl]; len(pkgs) == 0 || pkgs[len(pkgs)-1] != n {
+					components[purl] = append(pkgs, n)
+				}
+			}
+		}
+
+		report.Packages = append(report.Packages, pr)
+	}
+
+	purls := []string{}
+	for purl := range components {
+		purls = append(purls, purl)
+	}
+	sort.Strings(purls)
+
+	results, err := client.Query(purls)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ids := range results {
+		for _, n := range components[purls[i]] {
+			for _, id := range ids {
+				report.Packages[n].Findings = append(report.Packages[n].Findings, Finding{Component: purls[i], ID: id})
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// MarkNew flags the findings of the report whose vulnerability was not
+// found in the package of the same name by the baseline report, and
+// returns their number.  Components are not compared, as their versions
+// change when packages are rebuilt.
+func (r *Report) MarkNew(baseline *Report) int {
+	known := map[string]bool{}
+	for _, pr := range baseline.Packages {
+		for _, f := range pr.Findings {
+			known[pr.Name+"\x00"+f.ID] = true
+		}
+	}
+
+	count := 0
+	for i := range r.Packages {
+		pr := &r.Packages[i]
+		for j := range pr.Findings {
+			f := &pr.Findings[j]
+			f.New = !known[pr.Name+"\x00"+f.ID]
+			if f.New {
+				count++
+			}
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vuln
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"chainguard.dev/melange/pkg/schema"
+)
+
+// writeTestPackage writes an unsigned package with the given files.
+func writeTestPackage(t *testing.T, path, pkginfo string, files map[string]string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for i, section := range []map[string]string{{".PKGINFO": pkginfo}, files} {
+		gzw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gzw)
+		for name, content := range section {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var err error
+		if i == 0 {
+			err = tw.Flush()
+		} else {
+			err = tw.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testSPDX = `{
+  "spdxVersion": "SPDX-2.3",
+  "packages": [{
+    "externalRefs": [{"referenceType": "purl", "referenceLocator": "pkg:golang/example.com/lib@v1.0.0"}]
+  }]
+}`
+
+const testCycloneDX = `{
+  "bomFormat": "CycloneDX",
+  "components": [{"purl": "pkg:golang/example.com/lib@v1.0.0"}, {"purl": "pkg:golang/example.com/safe@v2.0.0"}]
+}`
+
+func TestScanRepository(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPackage(t, filepath.Join(dir, "foo-1.0-r0.apk"), "pkgname = foo\npkgver = 1.0-r0\n",
+		map[string]string{"var/lib/db/sbom/foo.spdx.json": testSPDX})
+	writeTestPackage(t, filepath.Join(dir, "bar-2.0-r0.apk"), "pkgname = bar\npkgver = 2.0-r0\n",
+		map[string]string{"var/lib/db/sbom/bar.cdx.json": testCycloneDX})
+	writeTestPackage(t, filepath.Join(dir, "baz-3.0-r0.apk"), "pkgname = baz\npkgver = 3.0-r0\n",
+		map[string]string{"usr/bin/baz": "#!/bin/sh\n"})
+
+	osv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req osvBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		var resp osvBatchResponse
+		for _, q := range req.Queries {
+			result := osvResult{}
+			if q.Package.PURL == "pkg:golang/example.com/lib@v1.0.0" {
+				result.Vulns = append(result.Vulns, osvVuln{ID: "GHSA-1234"})
+			}
+			resp.Results = append(resp.Results, result)
+		}
+		json.NewEncoder(w).Encode(resp) // nolint:errcheck
+	}))
+	defer osv.Close()
+
+	report, err := ScanRepository(dir, &OSVClient{URL: osv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string][]string{}
+	for _, pr := range report.Packages {
+		ids := []string{}
+		for _, f := range pr.Findings {
+			ids = append(ids, f.ID)
+		}
+		got[pr.Name] = ids
+
+		if pr.NoSBOM != (pr.Name == "baz") {
+			t.Errorf("%s: NoSBOM = %t", pr.Name, pr.NoSBOM)
+		}
+	}
+
+	want := map[string][]string{"foo": {"GHSA-1234"}, "bar": {"GHSA-1234"}, "baz": {}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findings = %v, want %v", got, want)
+	}
+
+	baseline := &Report{Packages: []PackageReport{{
+		Name:     "foo",
+		Findings: []Finding{{Component: "pkg:golang/example.com/lib@v0.9.0", ID: "GHSA-1234"}},
+	}}}
+	if n := report.MarkNew(baseline); n != 1 {
+		t.Errorf("MarkNew() = %d, want only the finding of bar to be new", n)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate(report.Schema, data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSBOMComponentsSPDX3(t *testing.T) {
+	doc := `{
+  "@context": "https://spdx.org/rdf/3.0.1/spdx-context.jsonld",
+  "@graph": [
+    {"type": "software_Package", "spdxId": "urn:foo", "software_packageUrl": "pkg:apk/foo@1.0-r0?arch=x86_64"},
+    {"type": "software_File", "spdxId": "urn:bar", "name": "/usr/bin/foo"}
+  ]
+}`
+
+	purls, err := sbomComponents([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pkg:apk/foo@1.0-r0?arch=x86_64"}; !reflect.DeepEqual(purls, want) {
+		t.Errorf("sbomComponents() = %q, want %q", purls, want)
+	}
+}